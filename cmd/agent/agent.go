@@ -0,0 +1,197 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// agent applies config bundles written by the UI (-bundle_file) on proxies
+// that don't run the UI themselves. Bundles are verified against the UI's
+// public key before anything is written.
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/bundle"
+)
+
+var (
+	bundleFile       = flag.String("bundle", "", "Bundle file to apply.")
+	publicKey        = flag.String("public_key", "", "ed25519 public key file the bundle must be signed with.")
+	insecureUnsigned = flag.Bool("insecure_unsigned", false, "Apply bundles without checking a signature. Only if the bundle can't be tampered with.")
+	stateFile        = flag.String("state", "", "File to keep the last applied revision in, so restarts don't reapply.")
+	squidConf        = flag.String("squid_conf", "", "File to write the squid config to.")
+	squidReconfigure = flag.String("squid_reconfigure", "", "Command to make squid reload its config, e.g. 'squid3 -k reconfigure'.")
+	firewallConf     = flag.String("firewall_conf", "", "File to write the firewall rules to.")
+	firewallReload   = flag.String("firewall_reload", "", "Command to load the firewall rules, e.g. 'nft -f /etc/squidwarden-quic.nft'.")
+	interval         = flag.Duration("interval", 0, "How often to check the bundle. 0 applies once and exits.")
+	genKey           = flag.String("gen_key", "", "Write a new key pair to <this>.key and <this>.pub and exit.")
+)
+
+// writeFile writes a file atomically.
+func writeFile(fn string, b []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".squidwarden")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+func runCommand(cmd string) error {
+	if cmd == "" {
+		return nil
+	}
+	args := strings.Fields(cmd)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%q failed: %v, output %q", args, err, out)
+	}
+	return nil
+}
+
+func writeKeys(prefix string) error {
+	priv, pub, err := bundle.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := writeFile(prefix+".key", []byte(priv+"\n"), 0600); err != nil {
+		return err
+	}
+	return writeFile(prefix+".pub", []byte(pub+"\n"), 0644)
+}
+
+func readState() int64 {
+	if *stateFile == "" {
+		return 0
+	}
+	b, err := ioutil.ReadFile(*stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Reading %q: %v", *stateFile, err)
+		}
+		return 0
+	}
+	rev, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		log.Printf("Bad revision in %q: %v", *stateFile, err)
+		return 0
+	}
+	return rev
+}
+
+// apply applies the bundle if it's newer than last, and returns the
+// revision now applied.
+func apply(pub ed25519.PublicKey, last int64) (int64, error) {
+	data, err := ioutil.ReadFile(*bundleFile)
+	if err != nil {
+		return last, err
+	}
+	b, err := bundle.Unmarshal(data, pub)
+	if err != nil {
+		return last, err
+	}
+	if b.Revision <= last {
+		return last, nil
+	}
+	if *firewallConf != "" {
+		if fw, ok := b.Files[bundle.FileFirewall]; ok {
+			if err := writeFile(*firewallConf, []byte(fw), 0644); err != nil {
+				return last, err
+			}
+			if err := runCommand(*firewallReload); err != nil {
+				return last, err
+			}
+		}
+	}
+	if *squidConf != "" {
+		conf, ok := b.Files[bundle.FileSquid]
+		if !ok {
+			return last, fmt.Errorf("bundle revision %d has no squid config", b.Revision)
+		}
+		if err := writeFile(*squidConf, []byte(conf), 0644); err != nil {
+			return last, err
+		}
+		if err := runCommand(*squidReconfigure); err != nil {
+			return last, err
+		}
+	}
+	if *stateFile != "" {
+		if err := writeFile(*stateFile, []byte(fmt.Sprintf("%d\n", b.Revision)), 0644); err != nil {
+			return b.Revision, err
+		}
+	}
+	log.Printf("Applied revision %d, generated %s", b.Revision, b.Generated)
+	return b.Revision, nil
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.LUTC)
+	if flag.NArg() > 0 {
+		log.Fatalf("Extra args on cmdline: %q", flag.Args())
+	}
+	if *genKey != "" {
+		if err := writeKeys(*genKey); err != nil {
+			log.Fatalf("Writing keys: %v", err)
+		}
+		return
+	}
+	if *bundleFile == "" {
+		log.Fatalf("-bundle is required")
+	}
+	var pub ed25519.PublicKey
+	switch {
+	case *publicKey != "":
+		var err error
+		if pub, err = bundle.ReadPublicKey(*publicKey); err != nil {
+			log.Fatalf("Reading public key: %v", err)
+		}
+	case !*insecureUnsigned:
+		log.Fatalf("-public_key is required, unless -insecure_unsigned")
+	}
+
+	last := readState()
+	for {
+		var err error
+		if last, err = apply(pub, last); err != nil {
+			if *interval == 0 {
+				log.Fatalf("Applying %q: %v", *bundleFile, err)
+			}
+			log.Printf("Applying %q: %v", *bundleFile, err)
+		}
+		if *interval == 0 {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
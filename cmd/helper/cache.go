@@ -0,0 +1,79 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+type cacheEntry struct {
+	d       policy.Decision
+	expires time.Time
+}
+
+// decisionCache caches decisions of one policy, so that the many
+// requests a page load makes to the same hosts are only decided once.
+type decisionCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[policy.Request]cacheEntry
+}
+
+func newDecisionCache(ttl time.Duration, max int) *decisionCache {
+	return &decisionCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[policy.Request]cacheEntry),
+	}
+}
+
+func (c *decisionCache) get(req policy.Request, now time.Time) (policy.Decision, bool) {
+	if c.ttl <= 0 {
+		return policy.Decision{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[req]
+	if !ok || !now.Before(e.expires) {
+		return policy.Decision{}, false
+	}
+	return e.d, true
+}
+
+func (c *decisionCache) add(req policy.Request, d policy.Decision, now time.Time) {
+	if c.ttl <= 0 || c.max <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.max {
+			// All fresh. Starting over is cheaper than tracking age.
+			c.entries = make(map[policy.Request]cacheEntry)
+		}
+	}
+	c.entries[req] = cacheEntry{d: d, expires: now.Add(c.ttl)}
+}
@@ -27,338 +27,285 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net"
 	"net/url"
 	"os"
-	"regexp"
-	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/publish"
+	"github.com/google/squidwarden/internal/store"
 )
 
 var (
-	dbFile   = flag.String("db", "", "sqlite database.")
-	logFile  = flag.String("log", "", "Logfile. Default to stderr.")
-	verbose  = flag.Int("v", 1, "Verbosity level.")
-	blockLog = flag.String("block_log", "", "Block log.")
+	dbFile    = flag.String("db", "", "sqlite database.")
+	logFile   = flag.String("log", "", "Logfile. Default to stderr.")
+	verbose   = flag.Int("v", 1, "Verbosity level.")
+	blockLog  = flag.String("block_log", "", "Block log.")
+	workers   = flag.Int("workers", 8, "Requests to decide in parallel, when squid sends channel IDs (concurrency= in external_acl_type).")
+	cacheTTL  = flag.Duration("cache_ttl", 5*time.Second, "How long to cache decisions. The cache is also dropped whenever the policy is reloaded. 0 disables.")
+	cacheSize = flag.Int("cache_size", 100000, "Max number of cached decisions.")
+	dbFailure = flag.String("db_failure", failCache, "What to do while the database can't be read: 'cache' keeps deciding with the last policy loaded, 'open' allows everything, 'closed' blocks everything.")
+	schema    = flag.String("schema", "", "sqlite.schema of this version, to bring an older database up to date with at startup. Empty leaves that to the UI.")
+
+	natsURL     = flag.String("nats", "", "NATS server to publish decisions to, as nats://[user:password@]host:port, or tls:// for TLS. Empty disables.")
+	natsSubject = flag.String("nats_subject", "squidwarden", "Prefix of NATS subjects. Decisions are published on <prefix>.decision.")
+	kafkaREST   = flag.String("kafka_rest", "", "Kafka REST proxy URL to publish decisions through, e.g. http://localhost:8082. Empty disables.")
+	kafkaTopic  = flag.String("kafka_topic", "squidwarden", "Kafka topic to publish decisions to.")
+	publishWhat = flag.String("publish_decisions", publishAll, "Which decisions to publish: 'all', or only 'block'.")
 
 	db *sql.DB
-)
-
-type action string
 
-const (
-	actionNone   action = "none"
-	actionBlock  action = "block"
-	actionIgnore action = "ignore"
-	actionAllow  action = "allow"
+	// Reloaded at least every second, for schedules and quotas. Rules
+	// that didn't change aren't compiled again.
+	policies *policy.Cache
 
-	actionDefault = actionBlock
+	// publisher is nil unless publishing is configured.
+	publisher *publish.Publisher
+)
 
+const (
 	aclMatch   = "OK"
 	aclNoMatch = "ERR"
-)
 
-type source interface {
-	String() string
-	Contains(net.IP) bool
-	PrefixLen() int
-}
+	// Must match the UI's generated squid config.
+	aclTagPrefix = "sw_acl_"
 
-type sourceMask struct {
-	host net.IP
-	mask net.IP
-}
+	// Values of -db_failure.
+	failCache  = "cache"
+	failOpen   = "open"
+	failClosed = "closed"
 
-func (s *sourceMask) String() string {
-	return s.host.String() + "/" + s.mask.String()
-}
-
-func (s *sourceMask) Contains(a net.IP) bool {
-	for n := range s.host {
-		if s.host[n] != a[n]&s.mask[n] {
-			return false
-		}
-	}
-	return true
-}
-
-func (s *sourceMask) PrefixLen() int {
-	// This is used for sorting only.
-	// TODO: what should be sorted by?
-	return 0
-}
+	// Values of -publish_decisions.
+	publishAll   = "all"
+	publishBlock = "block"
 
-type sourceNet net.IPNet
-
-func (s *sourceNet) Contains(a net.IP) bool {
-	return (*net.IPNet)(s).Contains(a)
-}
-
-func (s *sourceNet) String() string {
-	return (*net.IPNet)(s).String()
-}
-
-func (s *sourceNet) PrefixLen() int {
-	r, _ := s.Mask.Size()
-	return r
-}
-
-type sourceRule struct {
-	source source
-	rules  []string
-}
+	// publishCloseWait is how long to keep publishing queued decisions
+	// on exit.
+	publishCloseWait = 5 * time.Second
+)
 
-type Config struct {
-	// Map from source to rules.
-	Sources []sourceRule
-	Rules   map[string]RuleAction
+// decisionEvent is a decision as published.
+type decisionEvent struct {
+	Type   string `json:"type"`
+	Time   string `json:"time"`
+	Proto  string `json:"proto"`
+	Client string `json:"client"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Action string `json:"action"`
+	Match  bool   `json:"match"`
+	Source string `json:"source,omitempty"`
+	Group  string `json:"group,omitempty"`
+	ACL    string `json:"acl,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
-type Rule interface {
-	Check(proto, src, method, uri string) (bool, error)
+// publishDecision publishes d, if -publish_decisions says so.
+func publishDecision(req policy.Request, d policy.Decision, now time.Time) {
+	if publisher == nil || (*publishWhat == publishBlock && d.Action != policy.ActionBlock) {
+		return
+	}
+	publisher.Publish("decision", &decisionEvent{
+		Type:   "decision",
+		Time:   now.UTC().Format(time.RFC3339Nano),
+		Proto:  req.Proto,
+		Client: req.Source,
+		Method: req.Method,
+		URL:    req.URI,
+		Action: d.Action,
+		Match:  d.Match,
+		Source: d.Source,
+		Group:  d.Group,
+		ACL:    d.ACL,
+		Rule:   d.Rule,
+		Reason: d.Reason,
+	})
 }
 
-type RuleAction struct {
-	rule   Rule
-	action action
-}
+// state is the current policy, and the decisions cached from it.
+type state struct {
+	mu    sync.Mutex
+	cfg   *policy.Policy
+	rev   int64
+	cache *decisionCache
 
-type DomainRule struct {
-	value string
+	// Set while the database can't be read.
+	failed bool
 }
 
-func splitHostPortDefault(s, def string) (string, string) {
-	host, port, err := net.SplitHostPort(s)
-	if err != nil {
-		host = s
-		port = def
+// get returns the policy to decide with, or nil if requests should get
+// the -db_failure reply.
+func (st *state) get() (*policy.Policy, *decisionCache) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.failed && *dbFailure != failCache {
+		return nil, nil
 	}
-	return host, port
+	return st.cfg, st.cache
 }
 
-func (d *DomainRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "HTTP" {
-		return false, nil
-	}
-	if d.value == "" {
-		return false, nil
-	}
-	p, err := url.Parse(uri)
-	if err != nil {
-		return false, err
+// fail notes that the database couldn't be read.
+func (st *state) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.failed {
+		log.Printf("Failed to load policy, failing %s: %v", *dbFailure, err)
 	}
-
-	// If query doesn't have port, assume port 80.
-	ruleHost, rulePort := splitHostPortDefault(d.value, "80")
-	hostOnly, portOnly := splitHostPortDefault(p.Host, "80")
-
-	if portOnly != rulePort && rulePort != "*" {
-		return false, nil
-	}
-
-	// Exact match.
-	if hostOnly == ruleHost {
-		return true, nil
-	}
-
-	// If rule is CIDR, allow anything in it.
-	if _, cidr, err := net.ParseCIDR(ruleHost); err == nil {
-		if ip := net.ParseIP(hostOnly); ip != nil {
-			if cidr.Contains(ip) {
-				return true, nil
-			}
-		}
-	}
-
-	// Domain suffix.
-	if strings.HasPrefix(d.value, ".") {
-		// No extra level.
-		if "."+hostOnly == ruleHost {
-			return true, nil
-		}
-		if strings.HasSuffix(hostOnly, ruleHost) {
-			return true, nil
-		}
-	}
-	return false, nil
+	st.failed = true
 }
 
-type RegexRule struct {
-	re *regexp.Regexp
+// set replaces the policy. Cached decisions are dropped if the policy
+// changed. Otherwise they're kept until they expire, which bounds how
+// late schedules and quotas take effect.
+func (st *state) set(cfg *policy.Policy, rev int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.failed {
+		log.Printf("Policy loaded again")
+	}
+	st.failed = false
+	st.cfg = cfg
+	if st.cache == nil || rev != st.rev {
+		st.cache = newDecisionCache(*cacheTTL, *cacheSize)
+	}
+	st.rev = rev
 }
 
-func (d *RegexRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "HTTP" {
-		return false, nil
-	}
-	if d.re.MatchString(uri) {
-		return true, nil
+// reloadLoop reloads the policy every second, off the request path.
+func reloadLoop(st *state) {
+	for range time.Tick(time.Second) {
+		reload(st)
 	}
-	return false, nil
 }
 
-type HTTPSRegexRule struct {
-	re *regexp.Regexp
-}
-
-func (d *HTTPSRegexRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "NONE" {
-		return false, nil
-	}
-	if d.re.MatchString(uri) {
-		return true, nil
+func reload(st *state) {
+	cfg, rev, err := policies.Get(time.Now())
+	if err != nil {
+		st.fail(err)
+		return
 	}
-	return false, nil
+	st.set(cfg, rev)
 }
 
-type ExactRule struct {
-	value string
-}
-
-func (d *ExactRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "HTTP" {
-		return false, nil
+// failureReply is the reply while there's no policy to decide with.
+func failureReply() string {
+	if *dbFailure == failOpen {
+		return aclMatch
 	}
-	return d.value == uri, nil
-}
-
-type HTTPSDomainRule struct {
-	value string
+	return aclNoMatch
 }
 
-func (d *HTTPSDomainRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "NONE" {
-		return false, nil
-	}
-	if method != "CONNECT" {
-		return false, nil
+// decide returns the reply to a request line without the channel ID.
+func decide(cfg *policy.Policy, cache *decisionCache, s []string) string {
+	if cfg == nil {
+		return failureReply()
 	}
-	dhost, dport := splitHostPortDefault(d.value, "443")
-	if dhost == "" {
-		return false, nil
+	if len(s) != 4 {
+		log.Printf("Bad request line %q", s)
+		return aclNoMatch
 	}
-	host, port, err := net.SplitHostPort(uri)
+	proto := s[0]
+	src := s[1]
+	method := s[2]
+	urip, err := url.QueryUnescape(s[3])
 	if err != nil {
-		return false, fmt.Errorf("failed to parse HTTPS host:port %q: %v", uri, err)
+		log.Printf("URI escape error on %q: %v", s, err)
+		return aclNoMatch
 	}
-	if port != dport && dport != "*" {
-		return false, nil
+	req := policy.Request{Proto: proto, Source: src, Method: method, URI: urip}
+	d, ok := cache.get(req, time.Now())
+	if !ok {
+		d, err = cfg.Decide(req)
+		if err != nil {
+			log.Printf("Decision error on %q: %v", s, err)
+		} else {
+			cache.add(req, d, time.Now())
+		}
 	}
-	// Exact hostname.
-	if host == dhost {
-		return true, nil
+	if err == nil {
+		publishDecision(req, d, time.Now())
 	}
-
-	// If rule is CIDR, allow those.
-	if _, cidr, err := net.ParseCIDR(dhost); err == nil {
-		if ip := net.ParseIP(host); ip != nil {
-			if cidr.Contains(ip) {
-				return true, nil
-			}
+	reply := aclNoMatch
+	switch d.Action {
+	case policy.ActionBlock:
+		if *verbose > 0 {
+			log.Printf("No match(%s): %q", d.Action, s)
 		}
-	}
-
-	// Domain suffix.
-	if strings.HasPrefix(d.value, ".") {
-		// No extra level.
-		if "."+host == dhost {
-			return true, nil
+		if err := logBlock(proto, src, method, urip); err != nil {
+			log.Printf("Logging block: %v", err)
 		}
-		if strings.HasSuffix(host, dhost) {
-			return true, nil
+		if d.ACL != "" {
+			// Lets squid pick the deny page of the ACL.
+			reply += " tag=" + aclTagPrefix + d.ACL
 		}
+	case policy.ActionIgnore:
+	case policy.ActionAllow:
+		reply = aclMatch
 	}
-	return false, nil
+	return reply
 }
 
-// decide returns 'match found', 'action to take', error
-func decide(cfg *Config, proto, src, method, uri string) (bool, action, error) {
-	// Special case this because net/url can't parse these.
-	if strings.HasPrefix(uri, "cache_object://") {
-		return true, actionIgnore, nil
-	}
+// mainLoop answers requests from squid. With concurrency= in the
+// external_acl_type every line starts with a channel ID, and replies may
+// be sent in any order, so those requests are decided by -workers
+// goroutines. Without it, replies must be in order.
+func mainLoop() {
+	st := &state{}
+	reload(st)
+	go reloadLoop(st)
 
-	source := net.ParseIP(src)
-	if source == nil {
-		return false, actionNone, fmt.Errorf("source is not a valid address: %q", src)
-	}
-	for _, rs := range cfg.Sources {
-		if !rs.source.Contains(source) {
-			continue
+	var outMu sync.Mutex
+	out := bufio.NewWriter(os.Stdout)
+	reply := func(s string) {
+		if *verbose > 1 {
+			log.Printf("Replied: %s", s)
 		}
-		for _, ruleName := range rs.rules {
-			rule := cfg.Rules[ruleName]
-			t, err := rule.rule.Check(proto, src, method, uri)
-			if err != nil {
-				log.Printf("Failed to evaluate rule %q: %v", ruleName, err)
-			} else if t {
-				return true, rule.action, nil
-			}
+		outMu.Lock()
+		defer outMu.Unlock()
+		fmt.Fprintln(out, s)
+		if err := out.Flush(); err != nil {
+			log.Fatalf("Writing reply: %v", err)
 		}
 	}
-	return false, actionDefault, nil
-}
 
-func mainLoop() {
-	cfg, err := loadConfig()
-	if err != nil {
-		log.Fatal(err)
+	type job struct {
+		channel string
+		fields  []string
 	}
-	// TODO: multithread this.
-	scanner := bufio.NewScanner(os.Stdin)
-	lastLoad := time.Now()
-	for scanner.Scan() {
-		if time.Since(lastLoad) > time.Second {
-			cfg2, err := loadConfig()
-			if err != nil {
-				log.Printf("Failed to reload database")
-			} else {
-				cfg = cfg2
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				cfg, cache := st.get()
+				reply(j.channel + " " + decide(cfg, cache, j.fields))
 			}
-			lastLoad = time.Now()
-		}
+		}()
+	}
 
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
 		s := strings.Split(scanner.Text(), " ")
 		if *verbose > 1 {
 			log.Printf("Got %q", s)
 		}
-		token := s[0]
-		proto := s[1]
-		src := s[2]
-		method := s[3]
-		uri := s[4]
-		urip, err := url.QueryUnescape(uri)
-		reply := aclNoMatch
-		if err != nil {
-			log.Printf("URI escape error on %q: %v", s, err)
-		} else {
-			_, act, err := decide(cfg, proto, src, method, urip)
-			if err != nil {
-				log.Printf("Decision error on %q: %v", s, err)
-			}
-			switch act {
-			case actionBlock, actionNone:
-				if *verbose > 0 && reply != aclMatch {
-					log.Printf("No match(%s): %q", act, s)
-				}
-				if err := logBlock(proto, src, method, urip); err != nil {
-					log.Printf("Logging block: %v", err)
-				}
-			case actionIgnore:
-			case actionAllow:
-				reply = aclMatch
-			}
-		}
-		if *verbose > 1 {
-			log.Printf("Replied: %s %s", token, reply)
+		if len(s) == 5 {
+			jobs <- job{channel: s[0], fields: s[1:]}
+			continue
 		}
-		fmt.Printf("%s %s\n", token, reply)
+		cfg, cache := st.get()
+		reply(decide(cfg, cache, s))
 	}
+	close(jobs)
+	wg.Wait()
 	if err := scanner.Err(); err != nil {
 		log.Fatal(err)
 	}
@@ -384,140 +331,26 @@ func logBlock(proto, src, method, urip string) error {
 	return nil
 }
 
-func parseMask(s string) (source, error) {
-	re := regexp.MustCompile(`^([0-9a-fA-F:.]+)/([0-9a-fA-F:.]+)$`)
-	m := re.FindStringSubmatch(s)
-	if m == nil {
-		return nil, fmt.Errorf("not a host match")
-	}
-	a := net.ParseIP(m[1])
-	if a == nil {
-		return nil, fmt.Errorf("not a valid address: %q", m[1])
-	}
-	b := net.ParseIP(m[2])
-	if b == nil {
-		return nil, fmt.Errorf("not a valid address: %q", m[2])
-	}
-	return &sourceMask{host: a, mask: b}, nil
-}
-
-func loadConfig() (*Config, error) {
-	cfg := &Config{
-		Rules: make(map[string]RuleAction),
-	}
-	if err := func() error {
-		rows, err := db.Query(`
-SELECT sources.source, rules.rule_id
-FROM sources
-JOIN members ON sources.source_id=members.source_id
-JOIN groups ON members.group_id=groups.group_id
-JOIN groupaccess ON groups.group_id=groupaccess.group_id
-JOIN acls ON groupaccess.acl_id=acls.acl_id
-JOIN aclrules ON acls.acl_id=aclrules.acl_id
-JOIN rules ON aclrules.rule_id=rules.rule_id
-ORDER BY sources.source`)
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
-		var prevSource source
-		var rs []string
-		for rows.Next() {
-			var src, rule string
-			if err := rows.Scan(&src, &rule); err != nil {
-				return err
-			}
-			var s source
-			if _, t, err := net.ParseCIDR(src); err != nil {
-				if t, err := parseMask(src); err != nil {
-					log.Printf("%q is not valid CIDR: %v", src, err)
-					continue
-				} else {
-					s = t
-				}
-			} else {
-				t := sourceNet(*t)
-				s = &t
-			}
-			if prevSource != nil && (prevSource.String() != s.String()) {
-				cfg.Sources = append(cfg.Sources, sourceRule{source: prevSource, rules: rs})
-				rs = nil
-			}
-			prevSource = s
-			rs = append(rs, rule)
-		}
-		if prevSource != nil {
-			cfg.Sources = append(cfg.Sources, sourceRule{source: prevSource, rules: rs})
-		}
-		return rows.Err()
-	}(); err != nil {
-		return nil, err
-	}
-
-	if err := func() error {
-		rows, err := db.Query(`
-SELECT rule_id, type, value, action
-FROM rules
-`)
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			var rule, typ, val, act string
-			if err := rows.Scan(&rule, &typ, &val, &act); err != nil {
-				return err
-			}
-			r := RuleAction{action: action(act)}
-			switch typ {
-			case "https-domain":
-				r.rule = &HTTPSDomainRule{value: val}
-			case "domain":
-				r.rule = &DomainRule{value: val}
-			case "exact":
-				r.rule = &ExactRule{value: val}
-			case "regex":
-				x, err := regexp.Compile("^" + val + "$")
-				if err != nil {
-					return fmt.Errorf("compiling regex %q: %v", val, err)
-				}
-				r.rule = &RegexRule{re: x}
-			case "https-regex":
-				x, err := regexp.Compile("^" + val + "$")
-				if err != nil {
-					return fmt.Errorf("compiling regex %q: %v", val, err)
-				}
-				r.rule = &HTTPSRegexRule{re: x}
-			default:
-				return fmt.Errorf("unknown rule type %q", typ)
-			}
-			cfg.Rules[rule] = r
-		}
-		return rows.Err()
-	}(); err != nil {
-		return nil, err
-	}
-	sort.Sort(sort.Reverse(byPrefixLen(cfg.Sources)))
-	return cfg, nil
-}
-
-type byPrefixLen []sourceRule
-
-func (a byPrefixLen) Len() int      { return len(a) }
-func (a byPrefixLen) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byPrefixLen) Less(i, j int) bool {
-	return a[i].source.PrefixLen() < a[j].source.PrefixLen()
+func loadConfig() (*policy.Policy, error) {
+	return policy.Load(db, time.Now())
 }
 
 func openDB() {
 	var err error
-	db, err = sql.Open("sqlite3", *dbFile)
+	db, err = store.Open(*dbFile)
 	if err != nil {
 		log.Fatalf("Failed to open database %q: %v", *dbFile, err)
 	}
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		log.Fatalf("Failed to turn on foreign keys")
+	if *schema != "" {
+		b, err := ioutil.ReadFile(*schema)
+		if err != nil {
+			log.Fatalf("Failed to read schema: %v", err)
+		}
+		if err := store.Migrate(db, string(b)); err != nil {
+			log.Fatalf("Failed to migrate database %q: %v", *dbFile, err)
+		}
 	}
+	policies = policy.NewCache(db, time.Second)
 }
 
 func main() {
@@ -526,6 +359,11 @@ func main() {
 	if flag.NArg() > 0 {
 		log.Fatalf("Extra args on cmdline: %q", flag.Args())
 	}
+	switch *dbFailure {
+	case failCache, failOpen, failClosed:
+	default:
+		log.Fatalf("-db_failure must be %q, %q or %q, not %q", failCache, failOpen, failClosed, *dbFailure)
+	}
 	if *logFile != "" {
 		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
@@ -534,8 +372,24 @@ func main() {
 		defer f.Close()
 		log.SetOutput(f)
 	}
+	switch *publishWhat {
+	case publishAll, publishBlock:
+	default:
+		log.Fatalf("-publish_decisions must be %q or %q, not %q", publishAll, publishBlock, *publishWhat)
+	}
+	var err error
+	publisher, err = publish.New(publish.Options{
+		NATS:        *natsURL,
+		NATSSubject: *natsSubject,
+		KafkaREST:   *kafkaREST,
+		KafkaTopic:  *kafkaTopic,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up publishing: %v", err)
+	}
 	openDB()
 	defer db.Close()
 	log.Printf("Running...")
 	mainLoop()
+	publisher.Close(publishCloseWait)
 }
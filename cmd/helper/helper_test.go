@@ -17,12 +17,16 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"testing"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
 )
 
 var (
@@ -77,11 +81,12 @@ func TestOrder(t *testing.T) {
 		"::1234:5678/::ffff:ffff",
 	}
 
-	if got, want := len(cfg.Sources), len(ss); got != want {
+	sources := cfg.Sources()
+	if got, want := len(sources), len(ss); got != want {
 		t.Fatalf("Got %d sources, want %d", got, want)
 	}
 	for n, s := range ss {
-		if got, want := cfg.Sources[n].source.String(), s; got != want {
+		if got, want := sources[n], s; got != want {
 			t.Errorf("Got %dth entry %v, want %v", n, got, want)
 		}
 	}
@@ -157,8 +162,9 @@ func TestDecisions(t *testing.T) {
 		{"HTTP", "129.99.0.2", "GET", "http://www.unencrypted.habets.se/", false, false},
 		{"HTTP", "129.99.99.2", "GET", "http://www.unencrypted.habets.se/", false, false},
 	} {
-		v, action, err := decide(cfg, test.proto, test.src, test.method, test.uri)
-		if action == actionIgnore {
+		d, err := cfg.Decide(policy.Request{Proto: test.proto, Source: test.src, Method: test.method, URI: test.uri})
+		v := d.Match
+		if d.Action == policy.ActionIgnore {
 			v = false
 		}
 		if err != nil != test.err {
@@ -170,3 +176,115 @@ func TestDecisions(t *testing.T) {
 		}
 	}
 }
+
+func TestQuotaExhausted(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.AddExhausted("sfw", "127.0.0.1")
+	for _, test := range []struct {
+		src  string
+		want string
+	}{
+		{"127.0.0.1", policy.ActionBlock},
+		{"127.0.0.3", policy.ActionAllow},
+	} {
+		d, err := cfg.Decide(policy.Request{Proto: "HTTP", Source: test.src, Method: "GET", URI: "http://www.unencrypted.habets.se/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Action != test.want {
+			t.Errorf("%s: got %q, want %q", test.src, d.Action, test.want)
+		}
+	}
+}
+
+func TestPaused(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.AddPaused("127.0.0.1/32", "friends"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		src  string
+		want string
+	}{
+		{"127.0.0.1", policy.ActionBlock},
+		{"127.0.0.3", policy.ActionAllow},
+	} {
+		d, err := cfg.Decide(policy.Request{Proto: "HTTP", Source: test.src, Method: "GET", URI: "http://www.unencrypted.habets.se/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Action != test.want {
+			t.Errorf("%s: got %q, want %q", test.src, d.Action, test.want)
+		}
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	now := time.Now()
+	req := policy.Request{Proto: "HTTP", Source: "127.0.0.1", Method: "GET", URI: "http://example.com/"}
+	other := req
+	other.Source = "127.0.0.2"
+	want := policy.Decision{Match: true, Action: policy.ActionAllow}
+
+	c := newDecisionCache(time.Second, 1)
+	if _, ok := c.get(req, now); ok {
+		t.Fatalf("Empty cache hit")
+	}
+	c.add(req, want, now)
+	if got, ok := c.get(req, now); !ok || got != want {
+		t.Errorf("Got %+v %v, want %+v", got, ok, want)
+	}
+	if _, ok := c.get(req, now.Add(time.Second)); ok {
+		t.Errorf("Hit on expired entry")
+	}
+	c.add(other, want, now)
+	if _, ok := c.get(req, now); ok {
+		t.Errorf("Cache grew past max")
+	}
+	if _, ok := c.get(other, now); !ok {
+		t.Errorf("Newest entry not cached")
+	}
+
+	c = newDecisionCache(0, 10)
+	c.add(req, want, now)
+	if _, ok := c.get(req, now); ok {
+		t.Errorf("Hit with caching disabled")
+	}
+}
+
+func TestDBFailure(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { *dbFailure = old }(*dbFailure)
+	line := []string{"HTTP", "127.0.0.1", "GET", "http%3A%2F%2Fwww.unencrypted.habets.se%2F"}
+	for _, test := range []struct {
+		mode string
+		want string
+	}{
+		{failCache, aclMatch},
+		{failOpen, aclMatch},
+		{failClosed, aclNoMatch},
+	} {
+		*dbFailure = test.mode
+		st := &state{}
+		if cfg, cache := st.get(); cfg != nil {
+			t.Fatalf("%s: got policy before loading", test.mode)
+		} else if got := decide(cfg, cache, line); got != failureReply() {
+			t.Errorf("%s: before loading got %q, want %q", test.mode, got, failureReply())
+		}
+		st.set(cfg, 1)
+		st.fail(fmt.Errorf("database gone"))
+		p, cache := st.get()
+		if got := decide(p, cache, line); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
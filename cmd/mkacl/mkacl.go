@@ -23,7 +23,7 @@ import (
 	"log"
 	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/google/squidwarden/internal/store"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -39,13 +39,10 @@ var (
 
 func openDB() {
 	var err error
-	db, err = sql.Open("sqlite3", *dbFile)
+	db, err = store.Open(*dbFile)
 	if err != nil {
 		log.Fatalf("Failed to open database %q: %v", *dbFile, err)
 	}
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		log.Fatalf("Failed to turn on foreign keys")
-	}
 }
 
 func main() {
@@ -59,32 +56,29 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	aclID := fmt.Sprint(uuid.NewV4())
-	if *appendID != "" {
-		aclID = *appendID
-	} else {
-		if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, aclID, *name); err != nil {
-			log.Fatal(err)
-		}
-	}
-	for _, e := range strings.Split(string(b), "\n") {
-		if e == "" {
-			continue
+	if err := store.Update(db, func(tx *sql.Tx) error {
+		aclID := fmt.Sprint(uuid.NewV4())
+		if *appendID != "" {
+			aclID = *appendID
+		} else {
+			if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, aclID, *name); err != nil {
+				return err
+			}
 		}
-		id := uuid.NewV4()
-		if _, err := tx.Exec(`INSERT INTO rules(rule_id, type, value) VALUES(?, ?, ?)`, id, *ruleType, e); err != nil {
-			log.Fatal(err)
+		var rules, links [][]interface{}
+		for _, e := range strings.Split(string(b), "\n") {
+			if e == "" {
+				continue
+			}
+			id := uuid.NewV4().String()
+			rules = append(rules, []interface{}{id, *ruleType, e})
+			links = append(links, []interface{}{aclID, id})
 		}
-		if _, err := tx.Exec(`INSERT INTO aclrules(acl_id, rule_id) VALUES(?, ?)`, aclID, id); err != nil {
-			log.Fatal(err)
+		if err := store.InsertMany(tx, `INSERT INTO rules(rule_id, type, value)`, rules); err != nil {
+			return err
 		}
-	}
-	if err := tx.Commit(); err != nil {
+		return store.InsertMany(tx, `INSERT INTO aclrules(acl_id, rule_id)`, links)
+	}); err != nil {
 		log.Fatal(err)
 	}
 }
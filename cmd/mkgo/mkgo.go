@@ -30,6 +30,7 @@ var (
 	dir    = flag.String("dir", "", "Dir full of files.")
 	out    = flag.String("out", "", "Output file.")
 	prefix = flag.String("prefix", "", "Prefix dir.")
+	pkg    = flag.String("package", "main", "Package name of output file.")
 )
 
 func main() {
@@ -50,7 +51,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("ReadDir(.) after Chdir(%q): %v", *dir, err)
 	}
-	if _, err := fo.Write([]byte("package main\nimport \"path\"\nfunc init() {\n")); err != nil {
+	if _, err := fmt.Fprintf(fo, "package %s\nimport \"path\"\nfunc init() {\n", *pkg); err != nil {
 		log.Fatalf("Writing to %q: %v", *out, err)
 	}
 
@@ -0,0 +1,141 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// ui is the squidwarden web UI. The UI itself is in internal/web; this only
+// parses flags and serves it. With the argument "doctor" it instead checks
+// the installation, and exits non-zero if there are problems. With "report"
+// it writes the policy report, an HTML page, to stdout.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+
+	"github.com/google/squidwarden/internal/store"
+	"github.com/google/squidwarden/internal/web"
+)
+
+var (
+	addr       = flag.String("addr", ":8080", "Address to listen to.")
+	socketPath = flag.String("fcgi", "", "UNIX socket to listen to.")
+	dbFile     = flag.String("db", "", "sqlite database.")
+	requestLog = flag.String("request_log", "", "File to log requests to the UI to, one JSON object per line. Empty disables.")
+)
+
+func main() {
+	var opts web.Options
+	opts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	doctor := flag.NArg() == 1 && flag.Arg(0) == "doctor"
+	report := flag.NArg() == 1 && flag.Arg(0) == "report"
+	if flag.NArg() > 0 && !doctor && !report {
+		log.Fatalf("Extra args on cmdline: %q", flag.Args())
+	}
+
+	opts.FastCGI = *socketPath != ""
+	if doctor {
+		if web.Doctor(*dbFile, opts, os.Stdout) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := web.CheckFiles(opts); err != nil {
+		log.Fatal(err)
+	}
+	if report {
+		db, err := store.Open(*dbFile)
+		if err != nil {
+			log.Fatalf("Failed to open database %q: %v", *dbFile, err)
+		}
+		defer db.Close()
+		if err := web.Migrate(db, opts); err != nil {
+			log.Fatalf("Failed to migrate database %q: %v", *dbFile, err)
+		}
+		if err := web.Report(db, opts, os.Stdout); err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+		return
+	}
+	if *requestLog != "" {
+		f, err := os.OpenFile(*requestLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			log.Fatalf("Failed to open request log %q: %v", *requestLog, err)
+		}
+		defer f.Close()
+		opts.RequestLog = f
+	}
+
+	var sock net.Listener
+	if *socketPath != "" {
+		os.Remove(*socketPath)
+		var err error
+		sock, err = net.Listen("unix", *socketPath)
+		if err != nil {
+			log.Fatalf("Unable to listen to socket %q: %v", *socketPath, err)
+		}
+		defer sock.Close()
+		if err = os.Chmod(*socketPath, 0666); err != nil {
+			log.Fatal("Unable to chmod socket: ", err)
+		}
+	}
+
+	var db *sql.DB
+	if opts.Demo {
+		var err error
+		if db, err = web.OpenDemo(); err != nil {
+			log.Fatalf("Failed to create demo database: %v", err)
+		}
+		f, err := ioutil.TempFile("", "squidwarden_demo_")
+		if err != nil {
+			log.Fatalf("Failed to create demo log: %v", err)
+		}
+		f.Close()
+		opts.SquidLog = f.Name()
+		if err := web.StartDemoLog(db, opts.SquidLog); err != nil {
+			log.Fatalf("Failed to start demo log: %v", err)
+		}
+		log.Printf("Demo mode, log in %q", opts.SquidLog)
+	} else {
+		var err error
+		if db, err = store.Open(*dbFile); err != nil {
+			log.Fatalf("Failed to open database %q: %v", *dbFile, err)
+		}
+		if err := web.Migrate(db, opts); err != nil {
+			log.Fatalf("Failed to migrate database %q: %v", *dbFile, err)
+		}
+	}
+	h := web.NewServer(db, opts)
+	web.StartBackground()
+
+	log.Printf("Running...")
+
+	// Start fastcgi.
+	if *socketPath != "" {
+		go func() {
+			if err := fcgi.Serve(sock, h); err != nil {
+				log.Fatalf("Failed to start serving fcgi: %v", err)
+			}
+		}()
+	}
+
+	// Start normal port.
+	log.Fatal(http.ListenAndServe(*addr, h))
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package bundle has the config bundles the UI writes for agents on other
+// proxies: the generated files of one policy revision, optionally signed
+// with ed25519 so that agents can refuse bundles tampered with on the
+// shared storage they're distributed over.
+package bundle
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Names of the files in a bundle.
+const (
+	FileSquid    = "squid"
+	FileFirewall = "firewall"
+)
+
+// Bundle is the generated config of one policy revision.
+type Bundle struct {
+	Revision  int64             `json:"revision"`
+	Generated string            `json:"generated"`
+	Files     map[string]string `json:"files"`
+}
+
+// envelope is what's written: the bundle as JSON, and the signature of
+// exactly those bytes.
+type envelope struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// ErrUnsigned is returned when verifying a bundle that isn't signed.
+var ErrUnsigned = errors.New("bundle is not signed")
+
+// Marshal serializes b, signed with key unless it's nil.
+func Marshal(b *Bundle, key ed25519.PrivateKey) ([]byte, error) {
+	p, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	e := envelope{Payload: p}
+	if key != nil {
+		e.Signature = ed25519.Sign(key, p)
+	}
+	return json.MarshalIndent(&e, "", "  ")
+}
+
+// Unmarshal parses a bundle. If pub is set the bundle must be signed
+// with its private key. If pub is nil the signature isn't checked.
+func Unmarshal(data []byte, pub ed25519.PublicKey) (*Bundle, error) {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("bad bundle: %v", err)
+	}
+	if pub != nil {
+		if len(e.Signature) == 0 {
+			return nil, ErrUnsigned
+		}
+		if !ed25519.Verify(pub, e.Payload, e.Signature) {
+			return nil, errors.New("bad bundle signature")
+		}
+	}
+	var b Bundle
+	if err := json.Unmarshal(e.Payload, &b); err != nil {
+		return nil, fmt.Errorf("bad bundle payload: %v", err)
+	}
+	return &b, nil
+}
+
+// GenerateKey returns a new key pair, encoded for key files.
+func GenerateKey() (priv, pub string, err error) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(sk.Seed()), base64.StdEncoding.EncodeToString(pk), nil
+}
+
+func readKey(fn string, size int) ([]byte, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %q is not base64: %v", fn, err)
+	}
+	if len(k) != size {
+		return nil, fmt.Errorf("key in %q is %d bytes, want %d", fn, len(k), size)
+	}
+	return k, nil
+}
+
+// ReadPrivateKey reads a private key file written by GenerateKey.
+func ReadPrivateKey(fn string) (ed25519.PrivateKey, error) {
+	seed, err := readKey(fn, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReadPublicKey reads a public key file written by GenerateKey.
+func ReadPublicKey(fn string) (ed25519.PublicKey, error) {
+	k, err := readKey(fn, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(k), nil
+}
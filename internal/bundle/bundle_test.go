@@ -0,0 +1,64 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func testKey(t *testing.T) (ed25519.PrivateKey, ed25519.PublicKey) {
+	priv, pub, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := base64.StdEncoding.DecodeString(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed), ed25519.PublicKey(pk)
+}
+
+func TestSignVerify(t *testing.T) {
+	sk, pk := testKey(t)
+	b := &Bundle{Revision: 7, Generated: "now", Files: map[string]string{FileSquid: "acl x src 10.0.0.0/8\n"}}
+	data, err := Marshal(b, sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(data, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, b) {
+		t.Errorf("got %+v, want %+v", got, b)
+	}
+
+	// Another key.
+	_, other := testKey(t)
+	if _, err := Unmarshal(data, other); err == nil {
+		t.Errorf("verified with the wrong key")
+	}
+
+	// Tampered with.
+	b.Files[FileSquid] = "http_access allow all\n"
+	evil, err := Marshal(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(evil, pk); err != ErrUnsigned {
+		t.Errorf("unsigned: got %v, want ErrUnsigned", err)
+	}
+	if _, err := Unmarshal(evil, nil); err != nil {
+		t.Errorf("unsigned without key: %v", err)
+	}
+	data = bytes.Replace(data, []byte(`"payload": "`), []byte(`"payload": "AAAA`), 1)
+	if _, err := Unmarshal(data, pk); err == nil {
+		t.Errorf("verified changed payload")
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package pdf writes simple text-only PDF documents, for reports.
+//
+// Text is Courier, so that columns line up, and headings are
+// Helvetica-Bold. Only Latin-1 characters are supported; others are
+// written as '?'. Lines that don't fit are wrapped.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	pageWidth  = 595 // A4, in points.
+	pageHeight = 842
+	margin     = 50
+
+	fontSize    = 9
+	headingSize = 13
+	lineHeight  = 12
+
+	// Courier is 0.6 em wide.
+	lineChars = (pageWidth - 2*margin) * 10 / (6 * fontSize)
+)
+
+type line struct {
+	text    string
+	heading bool
+}
+
+// Document is a PDF document being built.
+type Document struct {
+	title string
+	lines []line
+}
+
+// New returns an empty document.
+func New(title string) *Document {
+	return &Document{title: title}
+}
+
+// Heading adds a heading.
+func (d *Document) Heading(s string) {
+	d.lines = append(d.lines, line{text: s, heading: true})
+}
+
+// Line adds a line of text, wrapped if it's too long.
+func (d *Document) Line(s string) {
+	for len(s) > lineChars {
+		n := strings.LastIndex(s[:lineChars], " ")
+		if n <= 0 {
+			n = lineChars
+		}
+		d.lines = append(d.lines, line{text: s[:n]})
+		s = strings.TrimLeft(s[n:], " ")
+	}
+	d.lines = append(d.lines, line{text: s})
+}
+
+// Linef adds a formatted line of text.
+func (d *Document) Linef(format string, a ...interface{}) {
+	d.Line(fmt.Sprintf(format, a...))
+}
+
+// pages splits the lines into pages of content streams.
+func (d *Document) pages() []string {
+	var pages []string
+	var buf bytes.Buffer
+	y := pageHeight - margin
+	for _, l := range d.lines {
+		h := lineHeight
+		if l.heading {
+			h = 2 * lineHeight
+		}
+		if y-h < margin && buf.Len() > 0 {
+			pages = append(pages, buf.String())
+			buf.Reset()
+			y = pageHeight - margin
+		}
+		y -= h
+		font, size := "F1", fontSize
+		if l.heading {
+			font, size = "F2", headingSize
+		}
+		fmt.Fprintf(&buf, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, size, margin, y, escape(l.text))
+	}
+	if buf.Len() > 0 || len(pages) == 0 {
+		pages = append(pages, buf.String())
+	}
+	return pages
+}
+
+// escape returns s as the inside of a PDF string in WinAnsi encoding.
+func escape(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < 32:
+			buf.WriteByte(' ')
+		case r < 128:
+			buf.WriteRune(r)
+		case r < 256:
+			fmt.Fprintf(&buf, "\\%03o", r)
+		default:
+			buf.WriteByte('?')
+		}
+	}
+	return buf.String()
+}
+
+// WriteTo writes the document as PDF.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	pages := d.pages()
+
+	// Objects are 1: catalog, 2: pages, 3: info, 4-5: fonts, and then
+	// page and content pairs.
+	objs := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		fmt.Sprintf("<< /Title (%s) /Producer (squidwarden) >>", escape(d.title)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	var kids []string
+	for _, p := range pages {
+		n := len(objs) + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", n))
+		objs = append(objs,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, n+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(p)+1, p),
+		)
+	}
+	objs[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for n, o := range objs {
+		offsets[n] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", n+1, o)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return buf.WriteTo(w)
+}
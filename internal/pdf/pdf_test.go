@@ -0,0 +1,72 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":     "plain",
+		"(a\\b)":    "\\(a\\\\b\\)",
+		"café":      "caf\\351",
+		"tab\there": "tab here",
+		"世":         "?",
+	} {
+		if got := escape(in); got != want {
+			t.Errorf("escape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLineWrap(t *testing.T) {
+	d := New("test")
+	d.Line(strings.Repeat("word ", 50))
+	d.Line(strings.Repeat("x", lineChars+10))
+	for _, l := range d.lines {
+		if len(l.text) > lineChars {
+			t.Errorf("line too long: %d > %d", len(l.text), lineChars)
+		}
+	}
+	if len(d.lines) != 5 {
+		t.Errorf("got %d lines, want 5", len(d.lines))
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	d := New("Report")
+	d.Heading("Heading")
+	for n := 0; n < 100; n++ {
+		d.Linef("line %d", n)
+	}
+	var buf bytes.Buffer
+	if _, err := d.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if !bytes.HasPrefix(b, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(b, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF: %q...", b[:20])
+	}
+	if got := regexp.MustCompile(`/Count (\d+)`).FindSubmatch(b); got == nil || string(got[1]) != "2" {
+		t.Errorf("got page count %q, want 2", got)
+	}
+
+	// Every xref offset must point at its object.
+	m := regexp.MustCompile(`(?s)xref\n0 (\d+)\n(.*)trailer`).FindSubmatch(b)
+	if m == nil {
+		t.Fatal("no xref")
+	}
+	for n, l := range strings.Split(strings.TrimSpace(string(m[2])), "\n")[1:] {
+		off, err := strconv.Atoi(l[:10])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%d 0 obj", n+1); !bytes.HasPrefix(b[off:], []byte(want)) {
+			t.Errorf("xref %d points at %q", n+1, b[off:off+10])
+		}
+	}
+}
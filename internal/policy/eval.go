@@ -0,0 +1,624 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// Evaluation of the policy for a request, as done by the helper. Sources are
+// tried most specific first, and the first source with a matching rule
+// decides. If several rules of that source match, block beats ignore beats
+// allow, so that adding an allow rule to a group never unblocks something
+// another ACL of the same group blocks. Remaining ties are broken by group,
+// ACL and rule ID, so the result never depends on load order.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Protocols as squid passes them to the helper.
+const (
+	ProtoHTTP    = "HTTP"
+	ProtoConnect = "NONE" // CONNECT requests, i.e. HTTPS.
+)
+
+// ActionDefault is the action when no rule matches.
+const ActionDefault = ActionBlock
+
+// Source is a client address range, from CIDR or addr/mask form.
+type Source struct {
+	net *net.IPNet
+	str string
+}
+
+// ParseSource parses a source in CIDR or addr/mask form.
+func ParseSource(s string) (*Source, error) {
+	n, err := SourceNet(s)
+	if err != nil {
+		return nil, err
+	}
+	str := n.String()
+	if _, _, err := net.ParseCIDR(s); err != nil {
+		p := strings.SplitN(s, "/", 2)
+		str = net.ParseIP(p[0]).String() + "/" + net.ParseIP(p[1]).String()
+	}
+	return &Source{net: n, str: str}, nil
+}
+
+func (s *Source) String() string { return s.str }
+
+// Contains returns true if a is in the source.
+func (s *Source) Contains(a net.IP) bool { return s.net.Contains(a) }
+
+// PrefixLen is the CIDR prefix length, or 0 for non-contiguous masks.
+func (s *Source) PrefixLen() int {
+	r, _ := s.net.Mask.Size()
+	return r
+}
+
+// Request is a request as squid passes it to the helper.
+type Request struct {
+	Proto  string // ProtoHTTP or ProtoConnect.
+	Source string // Client address.
+	Method string
+	URI    string // URL, or host:port for CONNECT.
+}
+
+// URLRequest returns the request a client at src makes to fetch u. https
+// URLs are CONNECTs to the host, other URLs are plain GETs.
+func URLRequest(src, u string) (Request, error) {
+	p, err := url.Parse(u)
+	if err != nil {
+		return Request{}, err
+	}
+	switch p.Scheme {
+	case "https":
+		host := p.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), "443")
+		}
+		return Request{Proto: ProtoConnect, Source: src, Method: "CONNECT", URI: host}, nil
+	case "http":
+		return Request{Proto: ProtoHTTP, Source: src, Method: "GET", URI: u}, nil
+	}
+	return Request{}, fmt.Errorf("unsupported scheme in %q, want http or https", u)
+}
+
+// Decision is the outcome of evaluating a request.
+type Decision struct {
+	Match  bool   // False if nothing matched and Action is ActionDefault.
+	Action string // ActionAllow, ActionBlock or ActionIgnore.
+	Source string // Source the request matched, if any.
+	Group  string // Group of the matching rule, or of the paused source.
+	ACL    string // ACL of the matching rule.
+	Rule   string // ID of the matching rule.
+	Reason string // Why, if not decided by a rule. E.g. "paused".
+}
+
+type matcher interface {
+	match(req Request) (bool, error)
+}
+
+type compiledRule struct {
+	m      matcher
+	typ    string
+	value  string
+	action string
+}
+
+// Grant is a rule given to a source through a group and an ACL.
+type Grant struct {
+	Group, ACL, Rule string
+}
+
+type sourceGrants struct {
+	source *Source
+	grants []Grant
+}
+
+type quotaKey struct {
+	acl    string
+	client string
+}
+
+type pausedSource struct {
+	source *Source
+	group  string
+}
+
+// Policy is a compiled policy. Build it with New and the Add methods, or
+// load it from the database with Load. It's not safe to add to a policy
+// while it's being used.
+type Policy struct {
+	sources   []sourceGrants // Most specific first.
+	rules     map[string]compiledRule
+	exhausted map[quotaKey]bool
+	paused    []pausedSource
+
+	// For clients in no source.
+	defaultGroup  string
+	defaultGrants []Grant
+	defaultPaused bool
+
+	// Built on first use after rules or grants changed.
+	idxMu sync.Mutex
+	idx   *policyIndex
+}
+
+// New returns an empty policy, which blocks everything.
+func New() *Policy {
+	return &Policy{
+		rules:     make(map[string]compiledRule),
+		exhausted: make(map[quotaKey]bool),
+	}
+}
+
+// AddRule adds an enabled rule. Grants of rules that aren't added, e.g.
+// because they're disabled or expired, are ignored.
+func (p *Policy) AddRule(id, typ, value, action string) error {
+	m, err := newMatcher(typ, value)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case ActionAllow, ActionBlock, ActionIgnore:
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	p.rules[id] = compiledRule{m: m, typ: typ, value: value, action: action}
+	p.idx = nil
+	return nil
+}
+
+// AddGrant gives the rule to clients in source, through group and ACL.
+func (p *Policy) AddGrant(source string, g Grant) error {
+	s, err := ParseSource(source)
+	if err != nil {
+		return err
+	}
+	p.idx = nil
+	for n := range p.sources {
+		if p.sources[n].source.String() == s.String() {
+			p.sources[n].grants = append(p.sources[n].grants, g)
+			return nil
+		}
+	}
+	i := sort.Search(len(p.sources), func(i int) bool {
+		return sourceBefore(s, p.sources[i].source)
+	})
+	p.sources = append(p.sources, sourceGrants{})
+	copy(p.sources[i+1:], p.sources[i:])
+	p.sources[i] = sourceGrants{source: s, grants: []Grant{g}}
+	return nil
+}
+
+// DefaultSource is the source of decisions by the default group.
+const DefaultSource = "default"
+
+// SetDefaultGroup makes group apply to clients that are in no source. Its
+// grants are added with AddDefaultGrant.
+func (p *Policy) SetDefaultGroup(group string, paused bool) {
+	p.defaultGroup = group
+	p.defaultPaused = paused
+}
+
+// AddDefaultGrant gives the rule to clients in no source, through the
+// default group and acl.
+func (p *Policy) AddDefaultGrant(acl, rule string) {
+	p.defaultGrants = append(p.defaultGrants, Grant{Group: p.defaultGroup, ACL: acl, Rule: rule})
+	p.idx = nil
+}
+
+// AddPaused blocks everything from source, a member of paused group.
+func (p *Policy) AddPaused(source, group string) error {
+	s, err := ParseSource(source)
+	if err != nil {
+		return err
+	}
+	p.paused = append(p.paused, pausedSource{source: s, group: group})
+	return nil
+}
+
+// AddExhausted makes allow rules of acl not apply to client, since it has
+// used up its quota.
+func (p *Policy) AddExhausted(acl, client string) {
+	if ip := net.ParseIP(client); ip != nil {
+		client = ip.String()
+	}
+	p.exhausted[quotaKey{acl: acl, client: client}] = true
+}
+
+// Sources returns the sources with grants, in the order they're tried.
+func (p *Policy) Sources() []string {
+	var ret []string
+	for _, s := range p.sources {
+		ret = append(ret, s.source.String())
+	}
+	return ret
+}
+
+// Covers returns true if any rule matches req, whether or not it's granted
+// to the client.
+func (p *Policy) Covers(req Request) bool {
+	for id, r := range p.rules {
+		m, err := r.m.match(req)
+		if err != nil {
+			log.Printf("Failed to evaluate rule %q: %v", id, err)
+			continue
+		}
+		if m {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceBefore returns true if a should be tried before b.
+func sourceBefore(a, b *Source) bool {
+	if a.PrefixLen() != b.PrefixLen() {
+		return a.PrefixLen() > b.PrefixLen()
+	}
+	return a.String() < b.String()
+}
+
+// rank orders matching rules of a source. An allow rule blocked by an
+// exhausted quota comes last, so that another ACL can still allow.
+func (d *Decision) rank() int {
+	switch {
+	case d.Reason != "":
+		return 3
+	case d.Action == ActionBlock:
+		return 0
+	case d.Action == ActionIgnore:
+		return 1
+	}
+	return 2
+}
+
+// Results of trace steps.
+const (
+	TracePaused   = "paused"   // The client is in a paused source.
+	TraceSource   = "source"   // Trying the grants of a source containing the client.
+	TraceSkipped  = "skipped"  // Source not tried, since a more specific one decided.
+	TraceDisabled = "disabled" // Granted rule isn't loaded, e.g. disabled or expired.
+	TraceError    = "error"    // Rule failed to evaluate.
+	TraceNoMatch  = "no-match"
+	TraceMatch    = "match"
+	TraceChosen   = "chosen"    // The matching rule that decided.
+	TraceOutrank  = "outranked" // Matched, but another match of the source won.
+	TraceDefault  = "default"   // Nothing matched.
+)
+
+// TraceStep is one step of evaluating a request.
+type TraceStep struct {
+	Result string
+	Source string
+	Group  string
+	ACL    string
+	Rule   string
+	Type   string // Of the rule.
+	Value  string // Of the rule.
+	Action string // Of the rule, or the decision for TracePaused and TraceDefault.
+	Detail string
+}
+
+// Decide evaluates the policy for req. Rules that fail to evaluate are
+// logged, and don't match.
+func (p *Policy) Decide(req Request) (Decision, error) {
+	return p.decide(req, nil)
+}
+
+// Explain is like Decide, but also returns every step of the evaluation:
+// each source and rule tried, why it did or didn't match, and which match
+// won and why.
+func (p *Policy) Explain(req Request) (Decision, []TraceStep, error) {
+	var trace []TraceStep
+	d, err := p.decide(req, &trace)
+	return d, trace, err
+}
+
+func (p *Policy) decide(req Request, trace *[]TraceStep) (Decision, error) {
+	step := func(s TraceStep) {
+		if trace != nil {
+			*trace = append(*trace, s)
+		}
+	}
+	// Special case this because net/url can't parse these.
+	if strings.HasPrefix(req.URI, "cache_object://") {
+		return Decision{Match: true, Action: ActionIgnore, Reason: "cache manager"}, nil
+	}
+
+	none := Decision{Action: ActionDefault}
+	client := net.ParseIP(req.Source)
+	if client == nil {
+		return none, fmt.Errorf("source is not a valid address: %q", req.Source)
+	}
+	for _, ps := range p.paused {
+		if ps.source.Contains(client) {
+			step(TraceStep{Result: TracePaused, Source: ps.source.String(), Group: ps.group, Action: ActionBlock, Detail: "everything is blocked while the group is paused"})
+			return Decision{Match: true, Action: ActionBlock, Source: ps.source.String(), Group: ps.group, Reason: "paused"}, nil
+		}
+	}
+	var idx *policyIndex
+	if trace == nil {
+		idx = p.index()
+	}
+	var containing []int
+	if idx != nil {
+		containing = idx.sources.containing(p.sources, client)
+	} else {
+		for i, sg := range p.sources {
+			if sg.source.Contains(client) {
+				containing = append(containing, i)
+			}
+		}
+	}
+	var decided *Decision
+	inSource := len(containing) > 0
+	for _, i := range containing {
+		sg := p.sources[i]
+		if decided != nil {
+			step(TraceStep{Result: TraceSkipped, Source: sg.source.String(), Detail: fmt.Sprintf("decided by more specific source %s", decided.Source)})
+			continue
+		}
+		step(TraceStep{Result: TraceSource, Source: sg.source.String()})
+		grants := sg.grants
+		if idx != nil {
+			grants = candidates(req, grants, idx.grants[i])
+		}
+		decided = p.decideGrants(req, client, sg.source.String(), grants, trace)
+	}
+	if !inSource && p.defaultGroup != "" {
+		if p.defaultPaused {
+			step(TraceStep{Result: TracePaused, Source: DefaultSource, Group: p.defaultGroup, Action: ActionBlock, Detail: "everything is blocked while the default group is paused"})
+			return Decision{Match: true, Action: ActionBlock, Source: DefaultSource, Group: p.defaultGroup, Reason: "paused"}, nil
+		}
+		step(TraceStep{Result: TraceSource, Source: DefaultSource, Group: p.defaultGroup, Detail: "the client is in no source, so the default group applies"})
+		grants := p.defaultGrants
+		if idx != nil {
+			grants = candidates(req, grants, idx.defaults)
+		}
+		decided = p.decideGrants(req, client, DefaultSource, grants, trace)
+	}
+	if decided != nil {
+		return *decided, nil
+	}
+	step(TraceStep{Result: TraceDefault, Action: ActionDefault, Detail: "no rule matched"})
+	return none, nil
+}
+
+// candidates returns the grants that may match req.
+func candidates(req Request, grants []Grant, idx *grantIndex) []Grant {
+	host, ok := requestHost(req)
+	if !ok {
+		return grants
+	}
+	return idx.grants(grants, req, host)
+}
+
+// decideGrants returns the best matching grant of a source, or nil.
+func (p *Policy) decideGrants(req Request, client net.IP, source string, grants []Grant, trace *[]TraceStep) *Decision {
+	var best *Decision
+	type traced struct {
+		n int // Index in trace.
+		d Decision
+	}
+	var matched []traced
+	for _, g := range grants {
+		r, ok := p.rules[g.Rule]
+		s := TraceStep{Source: source, Group: g.Group, ACL: g.ACL, Rule: g.Rule, Type: r.typ, Value: r.value, Action: r.action}
+		if !ok {
+			s.Result = TraceDisabled
+			if trace != nil {
+				*trace = append(*trace, s)
+			}
+			continue
+		}
+		m, err := r.m.match(req)
+		if err != nil {
+			log.Printf("Failed to evaluate rule %q: %v", g.Rule, err)
+			s.Result, s.Detail = TraceError, err.Error()
+		} else if !m {
+			s.Result = TraceNoMatch
+		} else {
+			d := Decision{Match: true, Action: r.action, Source: source, Group: g.Group, ACL: g.ACL, Rule: g.Rule}
+			if d.Action == ActionAllow && p.exhausted[quotaKey{acl: g.ACL, client: client.String()}] {
+				d.Action = ActionBlock
+				d.Reason = "quota exhausted"
+				s.Detail = "allow turned into block, since the quota is used up"
+			}
+			s.Result = TraceMatch
+			if trace != nil {
+				matched = append(matched, traced{len(*trace), d})
+			}
+			if best == nil || decisionBefore(&d, best) {
+				best = &d
+			}
+		}
+		if trace != nil {
+			*trace = append(*trace, s)
+		}
+	}
+	if best == nil || trace == nil {
+		return best
+	}
+	for _, m := range matched {
+		s := &(*trace)[m.n]
+		if m.d == *best {
+			s.Result = TraceChosen
+			continue
+		}
+		s.Result = TraceOutrank
+		s.Detail = fmt.Sprintf("rule %s wins: %s", best.Rule, outrankReason(best, &m.d))
+	}
+	return best
+}
+
+// outrankReason explains why best was chosen over d.
+func outrankReason(best, d *Decision) string {
+	switch {
+	case best.rank() == d.rank():
+		return "same precedence, so the lowest group, ACL and rule ID wins"
+	case d.Reason != "":
+		return "allow rules of ACLs with the quota used up come last"
+	}
+	return fmt.Sprintf("%s comes before %s", best.Action, d.Action)
+}
+
+func decisionBefore(a, b *Decision) bool {
+	if a.rank() != b.rank() {
+		return a.rank() < b.rank()
+	}
+	if a.Group != b.Group {
+		return a.Group < b.Group
+	}
+	if a.ACL != b.ACL {
+		return a.ACL < b.ACL
+	}
+	return a.Rule < b.Rule
+}
+
+// Validate returns an error if a rule of type typ with the given value
+// can't be loaded by the helper. Rules that load but are likely wrong are
+// found by Lint.
+func Validate(typ, value string) error {
+	if value == "" {
+		return fmt.Errorf("empty value")
+	}
+	_, err := newMatcher(typ, value)
+	return err
+}
+
+func newMatcher(typ, value string) (matcher, error) {
+	switch typ {
+	case TypeDomain:
+		return &domainRule{value: value}, nil
+	case TypeHTTPSDomain:
+		return &httpsDomainRule{value: value}, nil
+	case TypeExact:
+		return &exactRule{value: value}, nil
+	case TypeRegex, TypeHTTPSRegex:
+		x, err := regexp.Compile("^" + value + "$")
+		if err != nil {
+			return nil, fmt.Errorf("compiling regex %q: %v", value, err)
+		}
+		if typ == TypeRegex {
+			return &regexRule{re: x}, nil
+		}
+		return &httpsRegexRule{re: x}, nil
+	}
+	return nil, fmt.Errorf("unknown rule type %q", typ)
+}
+
+func splitHostPortDefault(s, def string) (string, string) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+		port = def
+	}
+	return host, port
+}
+
+// hostMatches returns true if host is ruleHost, is in it if it's a CIDR, or
+// is a subdomain of it if it starts with a dot.
+func hostMatches(ruleHost, host string) bool {
+	// Exact match.
+	if host == ruleHost {
+		return true
+	}
+
+	// If rule is CIDR, allow anything in it.
+	if _, cidr, err := net.ParseCIDR(ruleHost); err == nil {
+		if ip := net.ParseIP(host); ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	// Domain suffix, or the domain itself.
+	return strings.HasPrefix(ruleHost, ".") && ("."+host == ruleHost || strings.HasSuffix(host, ruleHost))
+}
+
+type domainRule struct {
+	value string
+}
+
+func (d *domainRule) match(req Request) (bool, error) {
+	if req.Proto != ProtoHTTP || d.value == "" {
+		return false, nil
+	}
+	p, err := url.Parse(req.URI)
+	if err != nil {
+		return false, err
+	}
+
+	// If query doesn't have port, assume port 80.
+	ruleHost, rulePort := splitHostPortDefault(d.value, "80")
+	host, port := splitHostPortDefault(p.Host, "80")
+	if port != rulePort && rulePort != "*" {
+		return false, nil
+	}
+	return hostMatches(ruleHost, host), nil
+}
+
+type httpsDomainRule struct {
+	value string
+}
+
+func (d *httpsDomainRule) match(req Request) (bool, error) {
+	if req.Proto != ProtoConnect || req.Method != "CONNECT" {
+		return false, nil
+	}
+	ruleHost, rulePort := splitHostPortDefault(d.value, "443")
+	if ruleHost == "" {
+		return false, nil
+	}
+	host, port, err := net.SplitHostPort(req.URI)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse HTTPS host:port %q: %v", req.URI, err)
+	}
+	if port != rulePort && rulePort != "*" {
+		return false, nil
+	}
+	return hostMatches(ruleHost, host), nil
+}
+
+type exactRule struct {
+	value string
+}
+
+func (d *exactRule) match(req Request) (bool, error) {
+	return req.Proto == ProtoHTTP && d.value == req.URI, nil
+}
+
+type regexRule struct {
+	re *regexp.Regexp
+}
+
+func (d *regexRule) match(req Request) (bool, error) {
+	return req.Proto == ProtoHTTP && d.re.MatchString(req.URI), nil
+}
+
+type httpsRegexRule struct {
+	re *regexp.Regexp
+}
+
+func (d *httpsRegexRule) match(req Request) (bool, error) {
+	return req.Proto == ProtoConnect && d.re.MatchString(req.URI), nil
+}
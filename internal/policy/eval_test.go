@@ -0,0 +1,324 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testPolicy(t *testing.T) *Policy {
+	p := New()
+	for _, r := range []struct {
+		id, typ, value, action string
+	}{
+		{"r-domain", TypeDomain, ".example.com", ActionAllow},
+		{"r-domain-port", TypeDomain, "port.example.net:8080", ActionAllow},
+		{"r-domain-cidr", TypeDomain, "10.1.0.0/16", ActionAllow},
+		{"r-https", TypeHTTPSDomain, ".example.com", ActionAllow},
+		{"r-https-any", TypeHTTPSDomain, "any.example.org:*", ActionAllow},
+		{"r-https-cidr", TypeHTTPSDomain, "10.2.0.0/16:8443", ActionAllow},
+		{"r-exact", TypeExact, "http://exact.example.org/a?b", ActionAllow},
+		{"r-regex", TypeRegex, `http://re\.example\.org/[0-9]+`, ActionAllow},
+		{"r-https-regex", TypeHTTPSRegex, `.*\.cdn\.example\.org:443`, ActionAllow},
+		{"r-block-ads", TypeDomain, ".ads.example.com", ActionBlock},
+		{"r-ignore-ads", TypeDomain, ".ads.example.com", ActionIgnore},
+		{"r-ignore", TypeDomain, ".telemetry.example.com", ActionIgnore},
+		{"r-kid-block", TypeHTTPSDomain, ".games.example.com", ActionBlock},
+		{"r-kid-allow", TypeHTTPSDomain, ".games.example.com", ActionAllow},
+	} {
+		if err := p.AddRule(r.id, r.typ, r.value, r.action); err != nil {
+			t.Fatalf("AddRule(%q): %v", r.id, err)
+		}
+	}
+	for _, g := range []struct {
+		source string
+		grant  Grant
+	}{
+		// Everyone in the LAN gets the basics.
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-domain"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-domain-port"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-domain-cidr"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-https"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-https-any"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-https-cidr"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-exact"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-regex"}},
+		{"192.168.0.0/16", Grant{"lan", "basic", "r-https-regex"}},
+		{"192.168.0.0/16", Grant{"lan", "extra", "r-https"}},
+		{"192.168.0.0/16", Grant{"lan", "noads", "r-block-ads"}},
+		{"192.168.0.0/16", Grant{"lan", "quiet", "r-ignore-ads"}},
+		{"192.168.0.0/16", Grant{"lan", "quiet", "r-ignore"}},
+		// The kid is blocked from games, unless granted by a more
+		// specific source.
+		{"192.168.1.0/24", Grant{"kids", "games", "r-kid-block"}},
+		{"192.168.1.0/24", Grant{"kids", "homework", "r-kid-allow"}},
+		{"192.168.1.7/32", Grant{"weekend", "games", "r-kid-allow"}},
+		// Disabled rule.
+		{"192.168.1.0/24", Grant{"kids", "games", "r-disabled"}},
+	} {
+		if err := p.AddGrant(g.source, g.grant); err != nil {
+			t.Fatalf("AddGrant(%q): %v", g.source, err)
+		}
+	}
+	return p
+}
+
+func TestSourceOrder(t *testing.T) {
+	p := testPolicy(t)
+	for _, s := range []string{"10.0.0.1/255.0.0.255", "10.0.0.0/8", "2001:db8::/32"} {
+		if err := p.AddGrant(s, Grant{"g", "a", "r-domain"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"192.168.1.7/32",
+		"2001:db8::/32",
+		"192.168.1.0/24",
+		"192.168.0.0/16",
+		"10.0.0.0/8",
+		"10.0.0.1/255.0.0.255",
+	}
+	if got := p.Sources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	p := testPolicy(t)
+	if err := p.AddPaused("192.168.2.0/24", "paused"); err != nil {
+		t.Fatal(err)
+	}
+	p.AddExhausted("basic", "192.168.3.1")
+	for _, test := range []struct {
+		src, url string
+		want     Decision
+	}{
+		// Domain.
+		{"192.168.0.1", "http://example.com/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-domain", ""}},
+		{"192.168.0.1", "http://www.example.com/foo", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-domain", ""}},
+		{"192.168.0.1", "http://www.example.com:8080/", Decision{Action: ActionBlock}},
+		{"192.168.0.1", "http://badexample.com/", Decision{Action: ActionBlock}},
+		{"192.168.0.1", "http://port.example.net:8080/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-domain-port", ""}},
+		{"192.168.0.1", "http://port.example.net/", Decision{Action: ActionBlock}},
+
+		// CIDR.
+		{"192.168.0.1", "http://10.1.2.3/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-domain-cidr", ""}},
+		{"192.168.0.1", "http://10.3.2.3/", Decision{Action: ActionBlock}},
+		{"192.168.0.1", "https://10.2.0.1:8443/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-https-cidr", ""}},
+		{"192.168.0.1", "https://10.2.0.1/", Decision{Action: ActionBlock}},
+		{"10.0.0.1", "http://example.com/", Decision{Action: ActionBlock}},
+
+		// HTTPS domain.
+		{"192.168.0.1", "https://www.example.com/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-https", ""}},
+		{"192.168.0.1", "https://any.example.org:1234/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-https-any", ""}},
+
+		// Exact.
+		{"192.168.0.1", "http://exact.example.org/a?b", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-exact", ""}},
+		{"192.168.0.1", "http://exact.example.org/a?c", Decision{Action: ActionBlock}},
+
+		// Regex is anchored.
+		{"192.168.0.1", "http://re.example.org/123", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-regex", ""}},
+		{"192.168.0.1", "http://re.example.org/123x", Decision{Action: ActionBlock}},
+		{"192.168.0.1", "https://img.cdn.example.org/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-https-regex", ""}},
+
+		// Block beats ignore beats allow within a source.
+		{"192.168.0.1", "http://x.ads.example.com/", Decision{true, ActionBlock, "192.168.0.0/16", "lan", "noads", "r-block-ads", ""}},
+		{"192.168.0.1", "http://telemetry.example.com/", Decision{true, ActionIgnore, "192.168.0.0/16", "lan", "quiet", "r-ignore", ""}},
+		{"192.168.1.1", "https://games.example.com/", Decision{true, ActionBlock, "192.168.1.0/24", "kids", "games", "r-kid-block", ""}},
+
+		// More specific source first.
+		{"192.168.1.7", "https://games.example.com/", Decision{true, ActionAllow, "192.168.1.7/32", "weekend", "games", "r-kid-allow", ""}},
+		// Falls through to less specific sources.
+		{"192.168.1.7", "http://example.com/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "basic", "r-domain", ""}},
+
+		// Paused and quota.
+		{"192.168.2.1", "http://example.com/", Decision{true, ActionBlock, "192.168.2.0/24", "paused", "", "", "paused"}},
+		{"192.168.3.1", "http://example.com/", Decision{true, ActionBlock, "192.168.0.0/16", "lan", "basic", "r-domain", "quota exhausted"}},
+		{"192.168.3.1", "http://x.ads.example.com/", Decision{true, ActionBlock, "192.168.0.0/16", "lan", "noads", "r-block-ads", ""}},
+		// Quota of one ACL doesn't stop another from allowing.
+		{"192.168.3.1", "https://www.example.com/", Decision{true, ActionAllow, "192.168.0.0/16", "lan", "extra", "r-https", ""}},
+	} {
+		req, err := URLRequest(test.src, test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Decide(req)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.src, test.url, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s %s: got %+v, want %+v", test.src, test.url, got, test.want)
+		}
+	}
+}
+
+func TestDecideDeterministic(t *testing.T) {
+	// Same rules, granted in different orders.
+	grants := []Grant{{"b", "acl2", "r2"}, {"a", "acl2", "r1"}, {"a", "acl1", "r2"}}
+	var first Decision
+	for n := 0; n < len(grants); n++ {
+		p := New()
+		for _, id := range []string{"r1", "r2"} {
+			if err := p.AddRule(id, TypeDomain, "example.com", ActionAllow); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range grants {
+			if err := p.AddGrant("0.0.0.0/0", grants[(i+n)%len(grants)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := p.Decide(Request{Proto: ProtoHTTP, Source: "1.2.3.4", Method: "GET", URI: "http://example.com/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			first = got
+			if got.Group != "a" || got.ACL != "acl1" {
+				t.Errorf("got %+v, want group a ACL acl1", got)
+			}
+		} else if got != first {
+			t.Errorf("order %d: got %+v, want %+v", n, got, first)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	p := testPolicy(t)
+	req := Request{Proto: ProtoConnect, Source: "192.168.1.8", Method: "CONNECT", URI: "www.games.example.com:443"}
+	got, trace, err := p.Explain(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err := p.Decide(req); err != nil || got != want {
+		t.Errorf("Explain decided %+v, Decide %+v, %v", got, want, err)
+	}
+	type step struct{ result, source, rule string }
+	var steps []step
+	for _, s := range trace {
+		steps = append(steps, step{s.Result, s.Source, s.Rule})
+	}
+	want := []step{
+		{TraceSource, "192.168.1.0/24", ""},
+		{TraceChosen, "192.168.1.0/24", "r-kid-block"},
+		{TraceOutrank, "192.168.1.0/24", "r-kid-allow"},
+		{TraceDisabled, "192.168.1.0/24", "r-disabled"},
+		{TraceSkipped, "192.168.0.0/16", ""},
+	}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("got %+v, want %+v", steps, want)
+	}
+	if got, want := trace[2].Detail, "rule r-kid-block wins: block comes before allow"; got != want {
+		t.Errorf("outranked detail: got %q, want %q", got, want)
+	}
+
+	_, trace, err = p.Explain(Request{Proto: ProtoHTTP, Source: "10.0.0.1", Method: "GET", URI: "http://example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 1 || trace[0].Result != TraceDefault {
+		t.Errorf("no source: got %+v, want just default", trace)
+	}
+}
+
+func TestDefaultGroup(t *testing.T) {
+	p := testPolicy(t)
+	if err := p.AddRule("r-guest", TypeHTTPSDomain, ".example.org", ActionAllow); err != nil {
+		t.Fatal(err)
+	}
+	p.SetDefaultGroup("guests", false)
+	p.AddDefaultGrant("guest-acl", "r-guest")
+
+	for _, test := range []struct {
+		src  string
+		want Decision
+	}{
+		// In no source.
+		{"10.9.9.9", Decision{Match: true, Action: ActionAllow, Source: DefaultSource, Group: "guests", ACL: "guest-acl", Rule: "r-guest"}},
+		// In a source, so the default group doesn't apply.
+		{"192.168.0.5", Decision{Action: ActionDefault}},
+	} {
+		got, err := p.Decide(Request{Proto: ProtoConnect, Source: test.src, Method: "CONNECT", URI: "www.example.org:443"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.src, got, test.want)
+		}
+	}
+
+	p.SetDefaultGroup("guests", true)
+	got, err := p.Decide(Request{Proto: ProtoConnect, Source: "10.9.9.9", Method: "CONNECT", URI: "www.example.org:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Action != ActionBlock || got.Reason != "paused" {
+		t.Errorf("paused: got %+v, want paused block", got)
+	}
+}
+
+func TestCovers(t *testing.T) {
+	p := testPolicy(t)
+	for _, test := range []struct {
+		src, url string
+		want     bool
+	}{
+		{"192.168.0.1", "http://www.example.com/foo", true},
+		// Not granted to this client, but still covered.
+		{"10.0.0.1", "http://www.example.com/foo", true},
+		{"10.0.0.1", "https://www.cdn.example.org/", true},
+		{"10.0.0.1", "http://re.example.org/123", true},
+		{"10.0.0.1", "http://re.example.org/abc", false},
+		{"10.0.0.1", "http://badexample.com/", false},
+	} {
+		req, err := URLRequest(test.src, test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Covers(req); got != test.want {
+			t.Errorf("%s %s: got %t, want %t", test.src, test.url, got, test.want)
+		}
+	}
+}
+
+func TestURLRequest(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		want Request
+		err  bool
+	}{
+		{"http://example.com/a", Request{ProtoHTTP, "1.2.3.4", "GET", "http://example.com/a"}, false},
+		{"https://example.com/a", Request{ProtoConnect, "1.2.3.4", "CONNECT", "example.com:443"}, false},
+		{"https://example.com:8443/", Request{ProtoConnect, "1.2.3.4", "CONNECT", "example.com:8443"}, false},
+		{"https://[2001:db8::1]/", Request{ProtoConnect, "1.2.3.4", "CONNECT", "[2001:db8::1]:443"}, false},
+		{"ftp://example.com/", Request{}, true},
+	} {
+		got, err := URLRequest("1.2.3.4", test.url)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got err %v, want err %t", test.url, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		typ, value string
+		err        bool
+	}{
+		{TypeDomain, ".example.com", false},
+		{TypeDomain, "", true},
+		{TypeExact, "http://example.com/", false},
+		{TypeRegex, `.*\.example\.com/.*`, false},
+		{TypeRegex, `(unclosed`, true},
+		{TypeHTTPSRegex, `[a-`, true},
+		{"bogus", "example.com", true},
+	} {
+		if err := Validate(test.typ, test.value); (err != nil) != test.err {
+			t.Errorf("%s %q: got err %v, want err %t", test.typ, test.value, err, test.err)
+		}
+	}
+}
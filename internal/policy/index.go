@@ -0,0 +1,287 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// Indexes that let Decide only try the sources containing the client, and
+// the domain rules for the requested host, instead of every source and
+// every granted rule. Sources with CIDR masks go in a binary trie per
+// address family, domain rules in maps keyed by host. Regex rules of an
+// ACL are combined into one alternation, and only tried one by one if it
+// matches, to tell which did. Everything else (exact URLs, CIDR hosts,
+// non-contiguous masks) is still tried one by one. Explain doesn't use the
+// indexes, since it shows every step.
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+const (
+	// Fewer regex rules of an ACL aren't worth combining.
+	regexGroupMin = 2
+	// More are split into several alternations, to stay well below the
+	// regexp size limit.
+	regexGroupMax = 500
+)
+
+type trieNode struct {
+	child   [2]*trieNode
+	sources []int
+}
+
+func (n *trieNode) insert(ip []byte, ones, source int) {
+	for bit := 0; bit < ones; bit++ {
+		b := ip[bit/8] >> uint(7-bit%8) & 1
+		if n.child[b] == nil {
+			n.child[b] = &trieNode{}
+		}
+		n = n.child[b]
+	}
+	n.sources = append(n.sources, source)
+}
+
+func (n *trieNode) lookup(ip []byte, ret []int) []int {
+	for bit := 0; n != nil; bit++ {
+		ret = append(ret, n.sources...)
+		if bit == len(ip)*8 {
+			break
+		}
+		n = n.child[ip[bit/8]>>uint(7-bit%8)&1]
+	}
+	return ret
+}
+
+// sourceIndex finds the sources containing a client.
+type sourceIndex struct {
+	v4, v6 trieNode
+	linear []int
+}
+
+func newSourceIndex(sources []sourceGrants) *sourceIndex {
+	idx := &sourceIndex{}
+	for i, sg := range sources {
+		n := sg.source.net
+		ones, bits := n.Mask.Size()
+		switch {
+		case bits == 32 && n.IP.To4() != nil:
+			idx.v4.insert(n.IP.To4(), ones, i)
+		case bits == 128 && n.IP.To4() == nil:
+			idx.v6.insert(n.IP.To16(), ones, i)
+		default:
+			// Non-contiguous masks, and IPv6 nets that net.IPNet
+			// treats as IPv4.
+			idx.linear = append(idx.linear, i)
+		}
+	}
+	return idx
+}
+
+// containing returns the indexes of the sources containing client, in
+// the order they're tried.
+func (idx *sourceIndex) containing(sources []sourceGrants, client net.IP) []int {
+	var ret []int
+	if c4 := client.To4(); c4 != nil {
+		ret = idx.v4.lookup(c4, ret)
+	} else {
+		ret = idx.v6.lookup(client.To16(), ret)
+	}
+	for _, i := range idx.linear {
+		if sources[i].source.Contains(client) {
+			ret = append(ret, i)
+		}
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// regexGroup is regex rules of one ACL and type, combined.
+type regexGroup struct {
+	proto  string // Requests the rules can match.
+	re     *regexp.Regexp
+	grants []int
+}
+
+// grantIndex finds the grants of a source that may match a request.
+type grantIndex struct {
+	exact   map[string][]int // Host → grants of rules for only that host.
+	suffix  map[string][]int // Domain → grants of rules for it and its subdomains.
+	regexes []regexGroup
+	linear  []int // Grants to always try.
+}
+
+func newGrantIndex(rules map[string]compiledRule, grants []Grant) *grantIndex {
+	idx := &grantIndex{
+		exact:  make(map[string][]int),
+		suffix: make(map[string][]int),
+	}
+	type regexKey struct{ acl, typ string }
+	var regexKeys []regexKey
+	regexes := make(map[regexKey][]int)
+	for i, g := range grants {
+		r, ok := rules[g.Rule]
+		if !ok {
+			// Not loaded, so never matches.
+			continue
+		}
+		if (r.typ == TypeRegex || r.typ == TypeHTTPSRegex) && anchored(r.value) {
+			k := regexKey{g.ACL, r.typ}
+			if regexes[k] == nil {
+				regexKeys = append(regexKeys, k)
+			}
+			regexes[k] = append(regexes[k], i)
+			continue
+		}
+		if r.typ != TypeDomain && r.typ != TypeHTTPSDomain {
+			idx.linear = append(idx.linear, i)
+			continue
+		}
+		host, _ := splitHostPortDefault(r.value, "")
+		if _, _, err := net.ParseCIDR(host); err == nil || strings.Trim(host, ".") == "" {
+			idx.linear = append(idx.linear, i)
+		} else if strings.HasPrefix(host, ".") {
+			idx.suffix[host[1:]] = append(idx.suffix[host[1:]], i)
+		} else {
+			idx.exact[host] = append(idx.exact[host], i)
+		}
+	}
+	for _, k := range regexKeys {
+		ns := regexes[k]
+		for len(ns) > 0 {
+			n := len(ns)
+			if n > regexGroupMax {
+				n = regexGroupMax
+			}
+			idx.addRegexGroup(rules, grants, k.typ, ns[:n])
+			ns = ns[n:]
+		}
+	}
+	sort.Ints(idx.linear)
+	return idx
+}
+
+// anchored returns true if the regex rule value only matches whole URLs,
+// i.e. isn't something like "a|b", which becomes "^a|b$". Only those can
+// be combined in an anchored alternation, which is much quicker than one
+// that has to be tried at every position.
+func anchored(value string) bool {
+	re, err := syntax.Parse("^"+value+"$", syntax.Perl)
+	if err != nil {
+		return false
+	}
+	re = re.Simplify()
+	return re.Op == syntax.OpConcat && len(re.Sub) >= 2 &&
+		re.Sub[0].Op == syntax.OpBeginText && re.Sub[len(re.Sub)-1].Op == syntax.OpEndText
+}
+
+// addRegexGroup combines the regex rules of grants ns, all of type typ
+// and anchored, so the alternation matches exactly when one of the rules
+// does.
+func (idx *grantIndex) addRegexGroup(rules map[string]compiledRule, grants []Grant, typ string, ns []int) {
+	if len(ns) < regexGroupMin {
+		idx.linear = append(idx.linear, ns...)
+		return
+	}
+	alts := make([]string, len(ns))
+	for n, i := range ns {
+		alts[n] = "(?:" + rules[grants[i].Rule].value + ")"
+	}
+	re, err := regexp.Compile("^(?:" + strings.Join(alts, "|") + ")$")
+	if err != nil {
+		// Every rule compiled on its own, so this shouldn't happen, but
+		// trying them one by one still works.
+		idx.linear = append(idx.linear, ns...)
+		return
+	}
+	proto := ProtoHTTP
+	if typ == TypeHTTPSRegex {
+		proto = ProtoConnect
+	}
+	idx.regexes = append(idx.regexes, regexGroup{proto: proto, re: re, grants: ns})
+}
+
+// grants returns the grants that may match req, a request for host.
+func (idx *grantIndex) grants(grants []Grant, req Request, host string) []Grant {
+	ns := append([]int(nil), idx.linear...)
+	for _, g := range idx.regexes {
+		if req.Proto == g.proto && g.re.MatchString(req.URI) {
+			ns = append(ns, g.grants...)
+		}
+	}
+	ns = append(ns, idx.exact[host]...)
+	for s := host; ; {
+		ns = append(ns, idx.suffix[s]...)
+		i := strings.Index(s, ".")
+		if i < 0 {
+			break
+		}
+		s = s[i+1:]
+	}
+	sort.Ints(ns)
+	ret := make([]Grant, len(ns))
+	for n, i := range ns {
+		ret[n] = grants[i]
+	}
+	return ret
+}
+
+// requestHost returns the host domain rules match req against, or false
+// if there's none, in which case every rule is tried.
+func requestHost(req Request) (string, bool) {
+	switch req.Proto {
+	case ProtoHTTP:
+		p, err := url.Parse(req.URI)
+		if err != nil {
+			return "", false
+		}
+		host, _ := splitHostPortDefault(p.Host, "80")
+		return host, true
+	case ProtoConnect:
+		host, _, err := net.SplitHostPort(req.URI)
+		if err != nil {
+			return "", false
+		}
+		return host, true
+	}
+	return "", false
+}
+
+// policyIndex has the indexes of a policy.
+type policyIndex struct {
+	sources  *sourceIndex
+	grants   []*grantIndex // Same order as Policy.sources.
+	defaults *grantIndex
+}
+
+// index returns the indexes, building them if the policy changed.
+func (p *Policy) index() *policyIndex {
+	p.idxMu.Lock()
+	defer p.idxMu.Unlock()
+	if p.idx == nil {
+		idx := &policyIndex{
+			sources:  newSourceIndex(p.sources),
+			defaults: newGrantIndex(p.rules, p.defaultGrants),
+		}
+		for _, sg := range p.sources {
+			idx.grants = append(idx.grants, newGrantIndex(p.rules, sg.grants))
+		}
+		p.idx = idx
+	}
+	return p.idx
+}
@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestIndexMatchesLinear checks that Decide, which uses the indexes, decides
+// like Explain, which tries every source and rule.
+func TestIndexMatchesLinear(t *testing.T) {
+	p := testPolicy(t)
+	for _, s := range []string{"10.0.0.1/255.0.0.255", "10.0.0.0/8", "2001:db8::/32", "0.0.0.0/0", "::ffff:172.16.0.0/108"} {
+		for _, r := range []string{"r-domain", "r-https", "r-kid-block"} {
+			if err := p.AddGrant(s, Grant{"g", "a", r}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	p.SetDefaultGroup("default", false)
+	p.AddDefaultGrant("basic", "r-domain")
+	p.AddDefaultGrant("basic", "r-regex")
+
+	clients := []string{"192.168.1.7", "192.168.1.8", "192.168.2.1", "10.0.0.1", "10.1.0.1", "172.16.3.4", "::ffff:192.168.1.7", "2001:db8::1", "2001:db9::1", "fe80::1", "8.8.8.8"}
+	urls := []string{
+		"http://example.com/", "http://www.example.com/", "http://wwwexample.com/",
+		"http://port.example.net:8080/", "http://port.example.net/",
+		"http://10.1.2.3/", "https://10.2.0.1:8443/",
+		"http://exact.example.org/a?b", "http://re.example.org/123",
+		"https://x.cdn.example.org/", "https://any.example.org:99/",
+		"http://ads.example.com/", "https://games.example.com/", "https://www.games.example.com/",
+		"http://telemetry.example.com/x", "http://[2001:db8::1]/", "https://[2001:db8::1]/",
+	}
+	for _, c := range clients {
+		for _, u := range urls {
+			req, err := URLRequest(c, u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Decide(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _, err := p.Explain(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s %s: indexed %+v, linear %+v", c, u, got, want)
+			}
+		}
+	}
+}
+
+func TestRegexGroups(t *testing.T) {
+	p := New()
+	for _, r := range []struct {
+		id, typ, value, action string
+	}{
+		{"re-a", TypeRegex, `http://a\.example\.org/.*`, ActionAllow},
+		{"re-alt", TypeRegex, `http://x\.example\.org/|.*\.gif`, ActionAllow},
+		{"re-case", TypeRegex, `(?i)http://CASE\.example\.org/`, ActionAllow},
+		{"re-block", TypeRegex, `http://a\.example\.org/ads/.*`, ActionBlock},
+		{"re-other-acl", TypeRegex, `http://b\.example\.org/.*`, ActionAllow},
+		{"re-https", TypeHTTPSRegex, `a\.example\.org:443`, ActionAllow},
+		{"re-https2", TypeHTTPSRegex, `.*\.example\.net:443`, ActionAllow},
+	} {
+		if err := p.AddRule(r.id, r.typ, r.value, r.action); err != nil {
+			t.Fatalf("AddRule(%q): %v", r.id, err)
+		}
+	}
+	for _, g := range []Grant{
+		{"g", "one", "re-a"},
+		{"g", "one", "re-alt"},
+		{"g", "one", "re-case"},
+		{"g", "one", "re-block"},
+		{"g", "one", "re-https"},
+		{"g", "one", "re-https2"},
+		{"g", "two", "re-other-acl"},
+	} {
+		if err := p.AddGrant("10.0.0.0/8", g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(p.index().grants[0].regexes), 2; got != want {
+		t.Errorf("Got %d regex groups, want %d", got, want)
+	}
+	for _, test := range []struct {
+		url  string
+		rule string
+	}{
+		{"http://a.example.org/x", "re-a"},
+		{"http://a.example.org/ads/x", "re-block"},
+		{"http://x.example.org/", "re-alt"},
+		{"http://z.example.org/pic.gif", "re-alt"},
+		{"http://case.example.org/", "re-case"},
+		{"http://b.example.org/x", "re-other-acl"},
+		{"http://c.example.org/x", ""},
+		{"https://a.example.org/", "re-https"},
+		{"https://www.example.net/", "re-https2"},
+		{"https://b.example.org/", ""},
+	} {
+		req, err := URLRequest("10.0.0.1", test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Decide(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Rule != test.rule {
+			t.Errorf("%s: got rule %q, want %q", test.url, got.Rule, test.rule)
+		}
+		if want, _, _ := p.Explain(req); got != want {
+			t.Errorf("%s: indexed %+v, linear %+v", test.url, got, want)
+		}
+	}
+}
+
+func TestIndexRebuilt(t *testing.T) {
+	p := testPolicy(t)
+	req := Request{Proto: ProtoHTTP, Source: "192.168.3.1", Method: "GET", URI: "http://new.example.net/"}
+	if d, err := p.Decide(req); err != nil || d.Match {
+		t.Fatalf("Before adding: %+v %v", d, err)
+	}
+	if err := p.AddRule("r-new", TypeDomain, "new.example.net", ActionAllow); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddGrant("192.168.0.0/16", Grant{"lan", "basic", "r-new"}); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := p.Decide(req); err != nil || d.Rule != "r-new" {
+		t.Errorf("After adding: %+v %v", d, err)
+	}
+}
+
+func BenchmarkDecide(b *testing.B) {
+	p := New()
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("r%d", i)
+		if err := p.AddRule(id, TypeHTTPSDomain, fmt.Sprintf(".site%d.example.com", i), ActionAllow); err != nil {
+			b.Fatal(err)
+		}
+		if err := p.AddGrant("10.0.0.0/8", Grant{"g", "a", id}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	req := Request{Proto: ProtoConnect, Source: "10.1.2.3", Method: "CONNECT", URI: "www.site5000.example.com:443"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if d, err := p.Decide(req); err != nil || d.Rule != "r5000" {
+			b.Fatalf("Got %+v %v", d, err)
+		}
+	}
+}
+
+func BenchmarkDecideRegex(b *testing.B) {
+	p := New()
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("r%d", i)
+		if err := p.AddRule(id, TypeRegex, fmt.Sprintf(`http://site%d\.example\.com/[a-z]+/[0-9]+`, i), ActionAllow); err != nil {
+			b.Fatal(err)
+		}
+		if err := p.AddGrant("10.0.0.0/8", Grant{"g", "a", id}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	req := Request{Proto: ProtoHTTP, Source: "10.1.2.3", Method: "GET", URI: "http://www.example.com/foo/123"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if d, err := p.Decide(req); err != nil || d.Match {
+			b.Fatalf("Got %+v %v", d, err)
+		}
+	}
+}
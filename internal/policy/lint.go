@@ -0,0 +1,109 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// Rule linting. These are warnings, not errors: the helper will load the
+// rule, but it probably doesn't do what was intended.
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Warning is a likely mistake in a rule value.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Characters that make an exact rule look like it was meant to be a regex.
+// '.', '?' and '+' are left out since they're common in URLs.
+const regexMeta = `*^$[]()|\`
+
+// Lint returns warnings about value as a rule of type typ.
+func Lint(typ, value string) []Warning {
+	var ret []Warning
+	warn := func(code, format string, args ...interface{}) {
+		ret = append(ret, Warning{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+	if value == "" {
+		warn("empty", "Value is empty, so the rule matches nothing.")
+		return ret
+	}
+	if strings.TrimSpace(value) != value {
+		warn("whitespace", "Value has leading or trailing whitespace.")
+	} else if strings.ContainsAny(value, " \t") {
+		warn("whitespace", "Value contains whitespace.")
+	}
+
+	switch typ {
+	case TypeDomain, TypeHTTPSDomain:
+		if strings.Contains(value, "://") {
+			warn("scheme", "Domain rules match a host name, not a URL. Remove the scheme.")
+			break
+		}
+		if strings.Contains(value, "/") {
+			warn("path", "Domain rules can't match a path. Use an exact or regex rule.")
+		}
+		if strings.HasPrefix(value, "*.") {
+			warn("wildcard", "Use %q to match a domain and all its subdomains.", strings.TrimPrefix(value, "*"))
+		}
+		host := strings.TrimSpace(value)
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			host = h
+			switch {
+			case typ == TypeDomain && port == "443":
+				warn("port", "HTTPS isn't matched by domain rules. Use an https-domain rule.")
+			case typ == TypeHTTPSDomain && port == "80":
+				warn("port", "Plain HTTP isn't matched by https-domain rules. Use a domain rule.")
+			case port != "*":
+				warn("port", "Rule only matches port %s.", port)
+			}
+		}
+		if strings.ToLower(host) != host {
+			warn("uppercase", "Host names are matched in lower case, so this never matches.")
+		}
+	case TypeExact:
+		if !strings.HasPrefix(value, "http://") {
+			if strings.HasPrefix(value, "https://") {
+				warn("https", "HTTPS URLs can't be seen by the proxy. Use an https-domain rule.")
+			} else {
+				warn("scheme", "Exact rules match the whole URL, starting with http://.")
+			}
+		}
+		if strings.ContainsAny(value, regexMeta) {
+			warn("regex", "Value looks like a regex, but exact rules match it literally.")
+		}
+		if u := strings.SplitN(strings.TrimPrefix(value, "http://"), "/", 2)[0]; strings.ToLower(u) != u {
+			warn("uppercase", "Host names are matched in lower case, so this never matches.")
+		}
+	case TypeRegex, TypeHTTPSRegex:
+		if _, err := regexp.Compile("^" + value + "$"); err != nil {
+			warn("invalid", "Invalid regex: %v", err)
+		}
+		if strings.HasPrefix(value, "^") || (strings.HasSuffix(value, "$") && !strings.HasSuffix(value, `\$`)) {
+			warn("anchored", "Regexes are already anchored at both ends.")
+		}
+		if typ == TypeHTTPSRegex && strings.Contains(value, "://") {
+			warn("scheme", "https-regex rules match host:port, not a URL.")
+		}
+	default:
+		warn("type", "Unknown rule type %q.", typ)
+	}
+	return ret
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+)
+
+// QuotaDay is the format of quotausage.day.
+const QuotaDay = "2006-01-02"
+
+// Load reads the enabled policy from the database, as of now. Sources that
+// don't parse are logged and skipped, so that one bad entry doesn't take
+// down the whole policy.
+func Load(db *sql.DB, now time.Time) (*Policy, error) {
+	return load(db, now, nil)
+}
+
+// load is Load, reusing the compiled rules of prev that didn't change.
+func load(db *sql.DB, now time.Time, prev *Policy) (*Policy, error) {
+	p := New()
+	if err := func() error {
+		rows, err := db.Query(`
+SELECT rule_id, type, value, action
+FROM rules
+WHERE enabled
+AND rule_id NOT IN (SELECT rule_id FROM ruleexpiry WHERE expires <= ?)
+`, now.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var rule, typ, val, act string
+			if err := rows.Scan(&rule, &typ, &val, &act); err != nil {
+				return err
+			}
+			if prev != nil {
+				if r, ok := prev.rules[rule]; ok && r.typ == typ && r.value == val && r.action == act {
+					p.rules[rule] = r
+					continue
+				}
+			}
+			if err := p.AddRule(rule, typ, val, act); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}(); err != nil {
+		return nil, err
+	}
+
+	if err := func() error {
+		rows, err := db.Query(`
+SELECT sources.source, groups.group_id, acls.acl_id, rules.rule_id
+FROM sources
+JOIN members ON sources.source_id=members.source_id
+JOIN groups ON members.group_id=groups.group_id
+JOIN groupaccess ON groups.group_id=groupaccess.group_id
+JOIN acls ON groupaccess.acl_id=acls.acl_id
+JOIN aclrules ON acls.acl_id=aclrules.acl_id
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE acls.enabled
+AND NOT EXISTS (SELECT 1 FROM memberexpiry WHERE memberexpiry.source_id=members.source_id AND memberexpiry.group_id=members.group_id AND expires <= ?)
+ORDER BY sources.source`, now.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var src string
+			var g Grant
+			if err := rows.Scan(&src, &g.Group, &g.ACL, &g.Rule); err != nil {
+				return err
+			}
+			if err := p.AddGrant(src, g); err != nil {
+				log.Printf("%q is not valid CIDR: %v", src, err)
+			}
+		}
+		return rows.Err()
+	}(); err != nil {
+		return nil, err
+	}
+
+	if err := func() error {
+		rows, err := db.Query(`
+SELECT quotas.acl_id, quotausage.client
+FROM quotausage
+JOIN quotas ON quotausage.quota_id=quotas.quota_id
+WHERE quotausage.day=? AND quotausage.used >= quotas.daily_limit
+`, now.Format(QuotaDay))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var acl, client string
+			if err := rows.Scan(&acl, &client); err != nil {
+				return err
+			}
+			p.AddExhausted(acl, client)
+		}
+		return rows.Err()
+	}(); err != nil {
+		return nil, err
+	}
+
+	if err := func() error {
+		rows, err := db.Query(`
+SELECT sources.source, grouppause.group_id
+FROM grouppause
+JOIN members ON grouppause.group_id=members.group_id
+JOIN sources ON members.source_id=sources.source_id
+WHERE (grouppause.expires IS NULL OR grouppause.expires > ?)
+AND NOT EXISTS (SELECT 1 FROM memberexpiry WHERE memberexpiry.source_id=members.source_id AND memberexpiry.group_id=members.group_id AND expires <= ?)
+`, now.Unix(), now.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var src, group string
+			if err := rows.Scan(&src, &group); err != nil {
+				return err
+			}
+			if err := p.AddPaused(src, group); err != nil {
+				log.Printf("%q is not valid CIDR: %v", src, err)
+			}
+		}
+		return rows.Err()
+	}(); err != nil {
+		return nil, err
+	}
+	if err := func() error {
+		var group string
+		var paused int
+		if err := db.QueryRow(`
+SELECT defaultgroup.group_id, COUNT(grouppause.group_id)
+FROM defaultgroup
+LEFT JOIN grouppause ON defaultgroup.group_id=grouppause.group_id AND (grouppause.expires IS NULL OR grouppause.expires > ?)
+GROUP BY defaultgroup.group_id`, now.Unix()).Scan(&group, &paused); err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p.SetDefaultGroup(group, paused > 0)
+		rows, err := db.Query(`
+SELECT acls.acl_id, aclrules.rule_id
+FROM groupaccess
+JOIN acls ON groupaccess.acl_id=acls.acl_id
+JOIN aclrules ON acls.acl_id=aclrules.acl_id
+WHERE groupaccess.group_id=? AND acls.enabled
+ORDER BY acls.acl_id, aclrules.rule_id`, group)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var acl, rule string
+			if err := rows.Scan(&acl, &rule); err != nil {
+				return err
+			}
+			p.AddDefaultGrant(acl, rule)
+		}
+		return rows.Err()
+	}(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Cache keeps the loaded policy for everything in a process that decides
+// requests. It's reloaded when the policy revision changed, or when it's
+// older than maxAge, since schedules, pauses and quotas change with time
+// rather than revision. Rules that didn't change aren't compiled again.
+type Cache struct {
+	db     *sql.DB
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	p      *Policy
+	rev    int64
+	loaded time.Time
+}
+
+// NewCache returns a cache of the policy in db.
+func NewCache(db *sql.DB, maxAge time.Duration) *Cache {
+	return &Cache{db: db, maxAge: maxAge}
+}
+
+// Get returns the policy as of now, and its revision.
+func (c *Cache) Get(now time.Time) (*Policy, int64, error) {
+	rev, err := store.Revision(c.db)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.p != nil && c.rev == rev && now.Sub(c.loaded) < c.maxAge {
+		return c.p, c.rev, nil
+	}
+	p, err := load(c.db, now, c.p)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.p, c.rev, c.loaded = p, rev, now
+	return p, rev, nil
+}
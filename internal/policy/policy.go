@@ -0,0 +1,96 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package policy has the rule and source semantics shared by the UI and the
+// helper: rule types and actions, how values match, evaluating a request
+// against the whole policy, and rule warnings.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Rule actions.
+const (
+	ActionAllow  = "allow"
+	ActionBlock  = "block"
+	ActionIgnore = "ignore"
+)
+
+// Rule types.
+const (
+	TypeDomain      = "domain"
+	TypeHTTPSDomain = "https-domain"
+	TypeExact       = "exact"
+	TypeRegex       = "regex"
+	TypeHTTPSRegex  = "https-regex"
+)
+
+// DomainMatches returns true if a domain or https-domain rule value
+// matches host. Ports are ignored.
+func DomainMatches(value, host string) bool {
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		value = h
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if value == host {
+		return true
+	}
+	if _, cidr, err := net.ParseCIDR(value); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return cidr.Contains(ip)
+		}
+	}
+	return strings.HasPrefix(value, ".") && ("."+host == value || strings.HasSuffix(host, value))
+}
+
+// SourceNet parses a source in CIDR or addr/mask form.
+func SourceNet(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	p := strings.SplitN(s, "/", 2)
+	if len(p) != 2 {
+		return nil, fmt.Errorf("invalid source %q", s)
+	}
+	a, m := net.ParseIP(p[0]), net.ParseIP(p[1])
+	if a == nil || m == nil {
+		return nil, fmt.Errorf("invalid source %q", s)
+	}
+	if a4, m4 := a.To4(), m.To4(); a4 != nil && m4 != nil {
+		a, m = a4, m4
+	}
+	if len(a) != len(m) {
+		return nil, fmt.Errorf("address and mask of %q are different families", s)
+	}
+	return &net.IPNet{IP: a.Mask(net.IPMask(m)), Mask: net.IPMask(m)}, nil
+}
+
+// NetContains returns true if every address in inner is in outer.
+func NetContains(outer, inner *net.IPNet) bool {
+	if len(outer.Mask) != len(inner.Mask) {
+		return false
+	}
+	for n := range outer.Mask {
+		if inner.Mask[n]&outer.Mask[n] != outer.Mask[n] {
+			return false
+		}
+	}
+	return outer.Contains(inner.IP)
+}
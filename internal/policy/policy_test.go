@@ -0,0 +1,117 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+)
+
+// TestStoreEnums checks that the store, which can't use this package,
+// knows the same rule types and actions.
+func TestStoreEnums(t *testing.T) {
+	if want := []string{TypeDomain, TypeHTTPSDomain, TypeExact, TypeRegex, TypeHTTPSRegex}; !reflect.DeepEqual(store.RuleTypes, want) {
+		t.Errorf("store.RuleTypes = %q, want %q", store.RuleTypes, want)
+	}
+	if want := []string{ActionAllow, ActionBlock, ActionIgnore}; !reflect.DeepEqual(store.RuleActions, want) {
+		t.Errorf("store.RuleActions = %q, want %q", store.RuleActions, want)
+	}
+}
+
+func TestDomainMatches(t *testing.T) {
+	for _, test := range []struct {
+		value, host string
+		want        bool
+	}{
+		{"www.youtube.com", "www.youtube.com", true},
+		{"www.youtube.com", "youtube.com", false},
+		{".youtube.com", "youtube.com", true},
+		{".youtube.com", "r1.googlevideo.youtube.com", true},
+		{".youtube.com", "notyoutube.com", false},
+		{".youtube.com:443", "www.youtube.com:443", true},
+		{"9.1.2.0/24", "9.1.2.3", true},
+		{"9.1.2.0/24", "9.1.3.3", false},
+	} {
+		if got := DomainMatches(test.value, test.host); got != test.want {
+			t.Errorf("DomainMatches(%q, %q) = %t, want %t", test.value, test.host, got, test.want)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// 2016-10-02 is a Sunday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2016, 10, 2+day, hour, minute, 0, 0, time.Local)
+	}
+	for _, test := range []struct {
+		sched string
+		t     time.Time
+		want  bool
+	}{
+		{"* 08:00-17:00", at(0, 8, 0), true},
+		{"* 08:00-17:00", at(0, 17, 0), false},
+		{"mon-fri 08:00-17:00", at(0, 12, 0), false},
+		{"mon-fri 08:00-17:00", at(1, 12, 0), true},
+		{"sat,sun 10:00-11:00", at(6, 10, 30), true},
+		{"fri-mon 10:00-11:00", at(0, 10, 30), true},
+		{"fri-mon 10:00-11:00", at(2, 10, 30), false},
+		// School nights, past midnight.
+		{"sun-thu 20:00-06:00", at(0, 21, 0), true},
+		{"sun-thu 20:00-06:00", at(1, 5, 0), true},
+		{"sun-thu 20:00-06:00", at(5, 21, 0), false},
+		{"sun-thu 20:00-06:00", at(6, 5, 0), false},
+		{"sun-thu 20:00-06:00", at(5, 5, 0), true},
+		{"mon 01:00-02:00; tue 03:00-04:00", at(2, 3, 30), true},
+		{"", at(0, 0, 0), false},
+	} {
+		s, err := ParseSchedule(test.sched)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", test.sched, err)
+			continue
+		}
+		if got := s.Active(test.t); got != test.want {
+			t.Errorf("%q at %v: got %t, want %t", test.sched, test.t, got, test.want)
+		}
+	}
+	for _, bad := range []string{"mon", "xyz 08:00-09:00", "mon 8-9", "mon 25:00-26:00", "mon 08:60-09:00"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	for _, test := range []struct {
+		typ, value string
+		want       []string
+	}{
+		{TypeDomain, ".example.com", nil},
+		{TypeDomain, "", []string{"empty"}},
+		{TypeDomain, "http://example.com/", []string{"scheme"}},
+		{TypeDomain, "example.com/foo", []string{"path"}},
+		{TypeDomain, " example.com", []string{"whitespace"}},
+		{TypeDomain, "Example.com", []string{"uppercase"}},
+		{TypeDomain, "*.example.com", []string{"wildcard"}},
+		{TypeDomain, "example.com:443", []string{"port"}},
+		{TypeDomain, "example.com:*", nil},
+		{TypeHTTPSDomain, "example.com:8443", []string{"port"}},
+		{TypeExact, "http://example.com/foo?bar=1", nil},
+		{TypeExact, "example.com/foo", []string{"scheme"}},
+		{TypeExact, "https://example.com/", []string{"https"}},
+		{TypeExact, "http://example.com/.*", []string{"regex"}},
+		{TypeRegex, `http://example\.com/.*`, nil},
+		{TypeRegex, `^http://example\.com/$`, []string{"anchored"}},
+		{TypeRegex, `http://(example`, []string{"invalid"}},
+		{TypeHTTPSRegex, `.*\.example\.com:443`, nil},
+		{"bogus", "x", []string{"type"}},
+	} {
+		var got []string
+		for _, w := range Lint(test.typ, test.value) {
+			got = append(got, w.Code)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q: got %q, want %q", test.typ, test.value, got, test.want)
+		}
+	}
+}
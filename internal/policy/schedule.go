@@ -0,0 +1,143 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// Schedules say when an ACL should be enabled, as a list of weekly
+// windows separated by ';', each "DAYS HH:MM-HH:MM", in local time. DAYS is
+// a comma separated list of days or day ranges, or '*'. A window ending
+// before it starts continues past midnight. E.g. school nights:
+//
+//   sun-thu 20:00-06:00
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type window struct {
+	days       [7]bool
+	start, end int // Minutes after midnight.
+}
+
+// Schedule is a parsed ACL schedule.
+type Schedule []window
+
+func parseDay(s string) (int, error) {
+	for n, d := range scheduleDays {
+		if strings.EqualFold(s, d) {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+// ParseWeekday parses a day as in schedules, e.g. "mon".
+func ParseWeekday(s string) (time.Weekday, error) {
+	d, err := parseDay(s)
+	return time.Weekday(d), err
+}
+
+// ParseClock parses "HH:MM" into minutes after midnight.
+func ParseClock(s string) (int, error) {
+	p := strings.Split(s, ":")
+	if len(p) != 2 {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	h, err := strconv.Atoi(p[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	m, err := strconv.Atoi(p[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid minute in %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// ParseSchedule parses a schedule. The empty schedule is never active.
+func ParseSchedule(s string) (Schedule, error) {
+	var ret Schedule
+	for _, ws := range strings.Split(s, ";") {
+		ws = strings.TrimSpace(ws)
+		if ws == "" {
+			continue
+		}
+		f := strings.Fields(ws)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("invalid window %q, want 'DAYS HH:MM-HH:MM'", ws)
+		}
+		var w window
+		if f[0] == "*" {
+			for n := range w.days {
+				w.days[n] = true
+			}
+		} else {
+			for _, dr := range strings.Split(f[0], ",") {
+				se := strings.SplitN(dr, "-", 2)
+				a, err := parseDay(se[0])
+				if err != nil {
+					return nil, err
+				}
+				b := a
+				if len(se) == 2 {
+					if b, err = parseDay(se[1]); err != nil {
+						return nil, err
+					}
+				}
+				for d := a; ; d = (d + 1) % 7 {
+					w.days[d] = true
+					if d == b {
+						break
+					}
+				}
+			}
+		}
+		t := strings.SplitN(f[1], "-", 2)
+		if len(t) != 2 {
+			return nil, fmt.Errorf("invalid time range %q", f[1])
+		}
+		var err error
+		if w.start, err = ParseClock(t[0]); err != nil {
+			return nil, err
+		}
+		if w.end, err = ParseClock(t[1]); err != nil {
+			return nil, err
+		}
+		ret = append(ret, w)
+	}
+	return ret, nil
+}
+
+// Active returns true if t is inside any window.
+func (s Schedule) Active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	d := int(t.Weekday())
+	prev := (d + 6) % 7
+	for _, w := range s {
+		if w.start <= w.end {
+			if w.days[d] && m >= w.start && m < w.end {
+				return true
+			}
+		} else if (w.days[d] && m >= w.start) || (w.days[prev] && m < w.end) {
+			return true
+		}
+	}
+	return false
+}
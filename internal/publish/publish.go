@@ -0,0 +1,363 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package publish sends events, like policy changes and helper decisions,
+// to a message bus: NATS, or Kafka through the Kafka REST proxy.
+//
+// Events are queued and sent in the background, so that publishing never
+// holds up the caller. If the bus is down or too slow, events are dropped
+// once the queue is full.
+package publish
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// QueueSize is how many events can wait to be sent.
+	QueueSize = 10000
+
+	// maxBatch is the most events sent at once.
+	maxBatch = 500
+
+	timeout = 30 * time.Second
+)
+
+// Options configures where events are published. Both NATS and Kafka can be
+// used at once.
+type Options struct {
+	// NATS server, as nats://[user:password@]host[:port], or tls:// to
+	// require TLS. Empty disables.
+	NATS string
+
+	// NATSSubject is the prefix of subjects. Events are published on
+	// <prefix>.<type>, e.g. squidwarden.change.
+	NATSSubject string
+
+	// KafkaREST is the base URL of a Kafka REST proxy (v2 API), e.g.
+	// http://localhost:8082. Empty disables.
+	KafkaREST string
+
+	// KafkaTopic is the topic events are produced to, keyed by type.
+	KafkaTopic string
+}
+
+type event struct {
+	typ  string
+	body json.RawMessage
+}
+
+// Publisher publishes events. A nil *Publisher publishes nothing.
+type Publisher struct {
+	opts    Options
+	c       chan event
+	done    chan struct{}
+	dropped int64 // Updated atomically.
+	client  *http.Client
+	nats    *natsConn
+	failing map[string]bool
+}
+
+// New returns a publisher for opts, or nil if opts has nowhere to publish
+// to. It starts sending in the background right away.
+func New(opts Options) (*Publisher, error) {
+	if opts.NATS == "" && opts.KafkaREST == "" {
+		return nil, nil
+	}
+	p := &Publisher{
+		opts:    opts,
+		c:       make(chan event, QueueSize),
+		done:    make(chan struct{}),
+		client:  &http.Client{Timeout: timeout},
+		failing: make(map[string]bool),
+	}
+	if opts.NATS != "" {
+		u, err := url.Parse(opts.NATS)
+		if err != nil {
+			return nil, fmt.Errorf("bad NATS URL %q: %v", opts.NATS, err)
+		}
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return nil, fmt.Errorf("bad NATS URL %q: want nats:// or tls://", opts.NATS)
+		}
+		if opts.NATSSubject == "" || strings.ContainsAny(opts.NATSSubject, " \t\r\n*>") {
+			return nil, fmt.Errorf("bad NATS subject %q", opts.NATSSubject)
+		}
+		p.nats = &natsConn{u: u}
+	}
+	if opts.KafkaREST != "" {
+		if _, err := url.Parse(opts.KafkaREST); err != nil {
+			return nil, fmt.Errorf("bad Kafka REST proxy URL %q: %v", opts.KafkaREST, err)
+		}
+		if opts.KafkaTopic == "" {
+			return nil, fmt.Errorf("no Kafka topic")
+		}
+	}
+	go p.run()
+	return p, nil
+}
+
+// Publish queues v, encoded as JSON, to be published as an event of type
+// typ. It never blocks.
+func (p *Publisher) Publish(typ string, v interface{}) {
+	if p == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Publish: encoding %s event: %v", typ, err)
+		return
+	}
+	select {
+	case p.c <- event{typ: typ, body: b}:
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+	}
+}
+
+// Close sends what's queued, waiting at most wait. Publish must not be
+// called after Close.
+func (p *Publisher) Close(wait time.Duration) {
+	if p == nil {
+		return
+	}
+	close(p.c)
+	select {
+	case <-p.done:
+	case <-time.After(wait):
+		log.Printf("Publish: gave up sending %d queued events", len(p.c))
+	}
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+	for e := range p.c {
+		batch := []event{e}
+	more:
+		for len(batch) < maxBatch {
+			select {
+			case e, ok := <-p.c:
+				if !ok {
+					break more
+				}
+				batch = append(batch, e)
+			default:
+				break more
+			}
+		}
+		if n := atomic.SwapInt64(&p.dropped, 0); n > 0 {
+			log.Printf("Publish: queue full, dropped %d events", n)
+		}
+		if p.nats != nil {
+			p.report("NATS", p.nats.publish(p.opts.NATSSubject, batch))
+		}
+		if p.opts.KafkaREST != "" {
+			p.report("Kafka", p.publishKafka(batch))
+		}
+	}
+}
+
+// report logs when publishing to a bus starts and stops failing, rather
+// than every failed batch.
+func (p *Publisher) report(bus string, err error) {
+	if err != nil && !p.failing[bus] {
+		log.Printf("Publish: failed to publish to %s, dropping events until it works again: %v", bus, err)
+	} else if err == nil && p.failing[bus] {
+		log.Printf("Publish: publishing to %s works again", bus)
+	}
+	p.failing[bus] = err != nil
+}
+
+// publishKafka produces events with the Kafka REST proxy v2 API.
+func (p *Publisher) publishKafka(batch []event) error {
+	type record struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	var req struct {
+		Records []record `json:"records"`
+	}
+	for _, e := range batch {
+		req.Records = append(req.Records, record{Key: e.typ, Value: e.body})
+	}
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(p.opts.KafkaREST, "/") + "/topics/" + url.PathEscape(p.opts.KafkaTopic)
+	r, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	r.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := p.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%q returned %q", u, resp.Status)
+	}
+	return nil
+}
+
+// natsConn is a connection to a NATS server, speaking enough of the
+// protocol to publish. It's connected when needed, and again after errors.
+type natsConn struct {
+	u *url.URL
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// connect connects to the server, and waits for it to accept the
+// connection.
+func (n *natsConn) connect() error {
+	host := n.u.Host
+	if n.u.Port() == "" {
+		host = net.JoinHostPort(n.u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(conn)
+	l, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(l, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("expected INFO from NATS server, got %q", strings.TrimSpace(l))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(l[len("INFO "):]), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("bad INFO from NATS server: %v", err)
+	}
+	if n.u.Scheme == "tls" || info.TLSRequired {
+		t := tls.Client(conn, &tls.Config{ServerName: n.u.Hostname()})
+		if err := t.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = t
+		r = bufio.NewReader(conn)
+	}
+
+	c := struct {
+		Verbose  bool   `json:"verbose"`
+		Pedantic bool   `json:"pedantic"`
+		Name     string `json:"name"`
+		Lang     string `json:"lang"`
+		Version  string `json:"version"`
+		User     string `json:"user,omitempty"`
+		Pass     string `json:"pass,omitempty"`
+	}{
+		Name:    "squidwarden",
+		Lang:    "go",
+		Version: "1",
+	}
+	if n.u.User != nil {
+		c.User = n.u.User.Username()
+		c.Pass, _ = n.u.User.Password()
+	}
+	b, err := json.Marshal(&c)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\nPING\r\n", b)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	if l, err = r.ReadString('\n'); err != nil {
+		conn.Close()
+		return err
+	}
+	if l = strings.TrimSpace(l); l != "PONG" {
+		conn.Close()
+		return fmt.Errorf("NATS server refused connection: %s", l)
+	}
+	conn.SetDeadline(time.Time{})
+	n.conn, n.w = conn, w
+	go n.read(conn, r)
+	return nil
+}
+
+// read answers the server's pings, which it sends to find dead clients,
+// until the connection fails.
+func (n *natsConn) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return
+		}
+		l = strings.TrimSpace(l)
+		switch {
+		case l == "PING":
+			n.mu.Lock()
+			if n.conn == conn {
+				n.w.WriteString("PONG\r\n")
+				n.w.Flush()
+			}
+			n.mu.Unlock()
+		case strings.HasPrefix(l, "-ERR"):
+			log.Printf("Publish: NATS server: %s", l)
+		}
+	}
+}
+
+func (n *natsConn) publish(subject string, batch []event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	n.conn.SetWriteDeadline(time.Now().Add(timeout))
+	for _, e := range batch {
+		fmt.Fprintf(n.w, "PUB %s.%s %d\r\n", subject, e.typ, len(e.body))
+		n.w.Write(e.body)
+		n.w.WriteString("\r\n")
+	}
+	if err := n.w.Flush(); err != nil {
+		n.conn.Close()
+		n.conn, n.w = nil, nil
+		return err
+	}
+	return nil
+}
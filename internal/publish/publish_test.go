@@ -0,0 +1,181 @@
+package publish
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	Summary string `json:"summary"`
+}
+
+func TestNew(t *testing.T) {
+	if p, err := New(Options{}); p != nil || err != nil {
+		t.Errorf("Nothing configured: got %v, %v, want nil publisher", p, err)
+	}
+	for _, opts := range []Options{
+		{NATS: "http://localhost:4222", NATSSubject: "squidwarden"},
+		{NATS: "nats://localhost:4222", NATSSubject: "squid warden"},
+		{NATS: "nats://localhost:4222", NATSSubject: "squidwarden.>"},
+		{KafkaREST: "http://localhost:8082"},
+	} {
+		if _, err := New(opts); err == nil {
+			t.Errorf("%+v: want error", opts)
+		}
+	}
+	// Publishing to nil is fine.
+	var p *Publisher
+	p.Publish("change", &testEvent{"x"})
+	p.Close(time.Second)
+}
+
+func TestKafka(t *testing.T) {
+	type record struct {
+		Key   string    `json:"key"`
+		Value testEvent `json:"value"`
+	}
+	var got []record
+	var gotPath, gotType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotType = r.URL.Path, r.Header.Get("Content-Type")
+		var req struct {
+			Records []record `json:"records"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Decoding request: %v", err)
+		}
+		got = append(got, req.Records...)
+		fmt.Fprintf(w, `{"offsets": []}`)
+	}))
+	defer ts.Close()
+
+	p, err := New(Options{KafkaREST: ts.URL + "/", KafkaTopic: "squidwarden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Publish("change", &testEvent{"one"})
+	p.Publish("decision", &testEvent{"two"})
+	p.Close(10 * time.Second)
+
+	if want := "/topics/squidwarden"; gotPath != want {
+		t.Errorf("Got path %q, want %q", gotPath, want)
+	}
+	if want := "application/vnd.kafka.json.v2+json"; gotType != want {
+		t.Errorf("Got content type %q, want %q", gotType, want)
+	}
+	want := []record{{"change", testEvent{"one"}}, {"decision", testEvent{"two"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+// fakeNATS accepts one client, and returns what it published.
+func fakeNATS(t *testing.T, l net.Listener, user, pass string) <-chan []string {
+	ret := make(chan []string, 1)
+	go func() {
+		var pubs []string
+		defer func() { ret <- pubs }()
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "INFO {\"server_id\":\"test\",\"auth_required\":true}\r\n")
+		r := bufio.NewReader(c)
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(l, "CONNECT "):
+				var opts struct {
+					User string `json:"user"`
+					Pass string `json:"pass"`
+				}
+				if err := json.Unmarshal([]byte(l[len("CONNECT "):]), &opts); err != nil {
+					t.Errorf("Bad CONNECT %q: %v", l, err)
+				}
+				if opts.User != user || opts.Pass != pass {
+					fmt.Fprintf(c, "-ERR 'Authorization Violation'\r\n")
+					return
+				}
+			case l == "PING\r\n":
+				fmt.Fprintf(c, "PONG\r\n")
+			case strings.HasPrefix(l, "PUB "):
+				var subject string
+				var n int
+				if _, err := fmt.Sscanf(l, "PUB %s %d\r\n", &subject, &n); err != nil {
+					t.Errorf("Bad PUB %q: %v", l, err)
+					return
+				}
+				b := make([]byte, n+2)
+				if _, err := io.ReadFull(r, b); err != nil {
+					return
+				}
+				pubs = append(pubs, subject+" "+string(b[:n]))
+			default:
+				t.Errorf("Unexpected %q", l)
+			}
+		}
+	}()
+	return ret
+}
+
+func TestNATS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pubs := fakeNATS(t, l, "bob", "secret")
+
+	p, err := New(Options{NATS: "nats://bob:secret@" + l.Addr().String(), NATSSubject: "squidwarden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Publish("change", &testEvent{"one"})
+	p.Publish("decision", &testEvent{"two"})
+	p.Close(10 * time.Second)
+	p.nats.conn.Close()
+
+	want := []string{
+		`squidwarden.change {"summary":"one"}`,
+		`squidwarden.decision {"summary":"two"}`,
+	}
+	if got := <-pubs; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestNATSRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fakeNATS(t, l, "bob", "secret")
+	n := &natsConn{u: mustParse(t, "nats://bob:wrong@"+l.Addr().String())}
+	if err := n.publish("squidwarden", []event{{typ: "change", body: []byte(`{}`)}}); err == nil {
+		t.Error("Published with the wrong password")
+	}
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
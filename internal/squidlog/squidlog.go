@@ -0,0 +1,249 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package squidlog parses squid access logs.
+package squidlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// TimeFormat is the format of Entry.Time.
+const TimeFormat = "2006-01-02 15:04:05 MST"
+
+// Entry is one parsed access log line.
+type Entry struct {
+	Time    string
+	Elapsed time.Duration
+	Client  string
+	Status  string
+	Bytes   int64
+	Method  string
+	Domain  string
+	Host    string
+	Path    string
+	URL     string
+}
+
+// ErrSkip is returned by Parse for lines that aren't entries, like blank ones.
+var ErrSkip = errors.New("skip this one, don't log")
+
+// Fields of a log line used by Parse.
+const (
+	fieldTime = iota
+	fieldElapsed
+	fieldClient
+	fieldStatus
+	fieldSize
+	fieldMethod
+	fieldURL
+	fieldType
+	numFields
+)
+
+// reEntry is the slow path, for lines splitFields doesn't accept. Columns:
+//
+//	time ms client status size method URL - HIER type
+var reEntry = regexp.MustCompile(`([0-9.]+)\s+(\d+)\s+([^\s]+)\s+([^\s]+)\s+(\d+)\s+(\w+)\s+([^\s]+)\s+-\s[^\s]+\s([^\s]+)`)
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// allBytes returns true if s is non-empty and ok for every byte.
+func allBytes(s string, ok func(byte) bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !ok(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool      { return c >= '0' && c <= '9' }
+func isTimeByte(c byte) bool   { return isDigit(c) || c == '.' }
+func isMethodByte(c byte) bool { return isDigit(c) || c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z') }
+
+// splitFields is the fast path of Parse. It splits a well formed line
+// without allocating, and returns false for anything unusual, in which case
+// the regexp decides.
+func splitFields(l string, f *[numFields]string) bool {
+	var tok [10]string
+	n := 0
+	for i := 0; i < len(l) && n < len(tok); {
+		for i < len(l) && isSpace(l[i]) {
+			i++
+		}
+		start := i
+		for i < len(l) && !isSpace(l[i]) {
+			i++
+		}
+		if start < i {
+			tok[n] = l[start:i]
+			n++
+		}
+	}
+	if n < len(tok) || tok[7] != "-" {
+		return false
+	}
+	if !allBytes(tok[0], isTimeByte) || !allBytes(tok[1], isDigit) || !allBytes(tok[4], isDigit) || !allBytes(tok[5], isMethodByte) {
+		return false
+	}
+	copy(f[:fieldType], tok[:7])
+	f[fieldType] = tok[9]
+	return true
+}
+
+// Parse parses one line of a squid access log.
+func Parse(l string) (*Entry, error) {
+	if len(l) == 0 {
+		return nil, ErrSkip
+	}
+	var f [numFields]string
+	if !splitFields(l, &f) {
+		m := reEntry.FindStringSubmatch(l)
+		if len(m) == 0 {
+			return nil, fmt.Errorf("bad log line: %q", l)
+		}
+		copy(f[:], m[1:])
+	}
+	return parseFields(&f)
+}
+
+func parseFields(s *[numFields]string) (*Entry, error) {
+	var host, p string
+	u := s[fieldURL]
+	var ur *url.URL
+	if strings.Contains(u, "/") {
+		ur, _ = url.Parse(u)
+	}
+	if ur != nil && ur.Scheme != "" {
+		host = ur.Host
+		p = ur.Path
+		if ur.ForceQuery || ur.RawQuery != "" {
+			p += "?" + ur.RawQuery
+		}
+	} else {
+		var port string
+		host, port, _ = net.SplitHostPort(u)
+		if port != "443" {
+			host = u
+		}
+	}
+
+	ts, err := strconv.ParseFloat(s[fieldTime], 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse epoch time %q: %v", s[fieldTime], err)
+	}
+	ms, err := strconv.ParseInt(s[fieldElapsed], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse elapsed time %q: %v", s[fieldElapsed], err)
+	}
+	size, err := strconv.ParseInt(s[fieldSize], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse size %q: %v", s[fieldSize], err)
+	}
+	return &Entry{
+		Time:    time.Unix(int64(ts), int64(1e9*(ts-math.Trunc(ts)))).UTC().Format(TimeFormat),
+		Elapsed: time.Duration(ms) * time.Millisecond,
+		Client:  s[fieldClient],
+		Status:  s[fieldStatus],
+		Bytes:   size,
+		Method:  s[fieldMethod],
+		Domain:  HostToDomain(host),
+		Host:    host,
+		Path:    p,
+		URL:     u,
+	}, nil
+}
+
+// HostToDomain returns the registered domain of a FQDN, with a leading dot.
+// IP literals, with or without port, are returned as just the IP.
+func HostToDomain(h string) string {
+	if net.ParseIP(h) != nil {
+		return h
+	}
+	if hst, _, err := net.SplitHostPort(h); err == nil && net.ParseIP(hst) != nil {
+		return hst
+	}
+	r, err := publicsuffix.EffectiveTLDPlusOne(h)
+	if err != nil {
+		return h
+	}
+	return "." + r
+}
+
+// Line is a line of a log file, and the file offset it starts at.
+type Line struct {
+	Offset int64
+	Text   string
+}
+
+// ReadLinesBefore returns up to n complete lines ending before offset end,
+// newest first. A trailing line with no newline is still being written, and
+// is skipped. Fewer than n lines are only returned at the start of the file.
+func ReadLinesBefore(r io.ReaderAt, end int64, n int, chunk int64) ([]Line, error) {
+	var ret []Line
+	var buf []byte // Data from pos to the start of the last returned line.
+	pos := end
+	trimmed := false
+	for len(ret) < n && pos > 0 {
+		sz := chunk
+		if sz > pos {
+			sz = pos
+		}
+		b := make([]byte, sz)
+		if _, err := r.ReadAt(b, pos-sz); err != nil && err != io.EOF {
+			return nil, err
+		}
+		pos -= sz
+		buf = append(b, buf...)
+		if !trimmed {
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				continue
+			}
+			buf = buf[:i+1]
+			trimmed = true
+		}
+		for len(ret) < n && len(buf) > 0 {
+			i := bytes.LastIndexByte(buf[:len(buf)-1], '\n')
+			if i < 0 && pos > 0 {
+				break
+			}
+			ret = append(ret, Line{
+				Offset: pos + int64(i+1),
+				Text:   string(buf[i+1 : len(buf)-1]),
+			})
+			buf = buf[:i+1]
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,282 @@
+package squidlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want Entry
+	}{
+		{
+			"1451606400 10 10.0.0.1 DENIED 100 GET http://blog.habets.se/ - HIER/- foo/bar",
+			Entry{
+				Time:    "2016-01-01 00:00:00 UTC",
+				Elapsed: 10 * time.Millisecond,
+				Client:  "10.0.0.1",
+				Status:  "DENIED",
+				Bytes:   100,
+				Method:  "GET",
+				Domain:  ".habets.se",
+				Host:    "blog.habets.se",
+				Path:    "/",
+				URL:     "http://blog.habets.se/",
+			},
+		},
+		{
+			"1451606400 10 10.0.0.1 DENIED 100 CONNECT blog.habets.se:443 - HIER/- foo/bar",
+			Entry{
+				Time:    "2016-01-01 00:00:00 UTC",
+				Elapsed: 10 * time.Millisecond,
+				Client:  "10.0.0.1",
+				Status:  "DENIED",
+				Bytes:   100,
+				Method:  "CONNECT",
+				Domain:  ".habets.se",
+				Host:    "blog.habets.se",
+				URL:     "blog.habets.se:443",
+			},
+		},
+		{
+			"1451606400 10 10.0.0.1 DENIED 100 CONNECT shell.habets.se:22 - HIER/- foo/bar",
+			Entry{
+				Time:    "2016-01-01 00:00:00 UTC",
+				Elapsed: 10 * time.Millisecond,
+				Client:  "10.0.0.1",
+				Status:  "DENIED",
+				Bytes:   100,
+				Method:  "CONNECT",
+				Domain:  ".habets.se:22",
+				Host:    "shell.habets.se:22",
+				URL:     "shell.habets.se:22",
+			},
+		},
+	} {
+		got, err := Parse(test.in)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", test.in, err)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.in, *got, test.want)
+		}
+	}
+}
+
+func TestHostToDomain(t *testing.T) {
+	for _, test := range []struct {
+		in, out string
+	}{
+		{"internal", "internal"},
+		{"example.com", ".example.com"},
+		{"www.example.com", ".example.com"},
+		{"www.foo.bar.example.com", ".example.com"},
+		{"example.pp.se", ".example.pp.se"},
+		{"www.example.co.uk", ".example.co.uk"},
+		{"www.example.com.br", ".example.com.br"},
+		{"1.2.3.4", "1.2.3.4"},
+		{"1.2.3.4:8080", "1.2.3.4"},
+	} {
+		if got := HostToDomain(test.in); got != test.out {
+			t.Errorf("got %q, want %q", got, test.out)
+		}
+	}
+}
+
+func TestReadLinesBefore(t *testing.T) {
+	const log = "one\ntwo\n\nfour\nfive\nsix partial"
+	for _, test := range []struct {
+		end   int64
+		n     int
+		chunk int64
+		want  []Line
+	}{
+		{int64(len(log)), 2, 3, []Line{{14, "five"}, {9, "four"}}},
+		{int64(len(log)), 10, 4, []Line{{14, "five"}, {9, "four"}, {8, ""}, {4, "two"}, {0, "one"}}},
+		{8, 10, 100, []Line{{4, "two"}, {0, "one"}}},
+		{4, 1, 1, []Line{{0, "one"}}},
+		{0, 10, 3, nil},
+		{3, 10, 3, nil},
+	} {
+		got, err := ReadLinesBefore(strings.NewReader(log), test.end, test.n, test.chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("end=%d n=%d chunk=%d: got %+v, want %+v", test.end, test.n, test.chunk, got, test.want)
+		}
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	for _, test := range []struct {
+		in string
+		ok bool
+	}{
+		{"1451606400 10 10.0.0.1 DENIED 100 GET http://blog.habets.se/ - HIER/- foo/bar", true},
+		{"1451606400.123    523 10.0.0.1 TCP_MISS/200 1234 CONNECT www.habets.se:443 - HIER_DIRECT/1.2.3.4 -", true},
+		{"1451606400.123 523 10.0.0.1 TCP_MISS/200 1234 GET http://a/ - HIER_DIRECT/1.2.3.4 text/html extra", true},
+		// Unusual lines are left to the regexp.
+		{"1451606400 10 10.0.0.1 DENIED 100 GET http://blog.habets.se/ bob HIER/- foo/bar", false},
+		{"1451606400 10 10.0.0.1 DENIED 100 GET http://blog.habets.se/ -", false},
+		{"1e9 10 10.0.0.1 DENIED 100 GET http://blog.habets.se/ - HIER/- foo/bar", false},
+		{"1451606400 -10 10.0.0.1 DENIED 100 GET http://blog.habets.se/ - HIER/- foo/bar", false},
+		{"1451606400 10 10.0.0.1 DENIED 100 G-T http://blog.habets.se/ - HIER/- foo/bar", false},
+	} {
+		var f [numFields]string
+		ok := splitFields(test.in, &f)
+		if ok != test.ok {
+			t.Errorf("%q: got %t, want %t", test.in, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		// Must agree with the regexp.
+		m := reEntry.FindStringSubmatch(test.in)
+		if m == nil {
+			t.Errorf("%q: regexp doesn't match", test.in)
+			continue
+		}
+		if got, want := f[:], m[1:]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, regexp got %q", test.in, got, want)
+		}
+	}
+}
+
+func TestParseSyslog(t *testing.T) {
+	const line = "1451606400.123 523 10.0.0.1 TCP_MISS/200 1234 GET http://a/ - HIER_DIRECT/1.2.3.4 text/html"
+	stamp := func(s string) time.Time {
+		ts, err := time.Parse(time.Stamp, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	for _, test := range []struct {
+		in   string
+		want Syslog
+	}{
+		{
+			"<166>Jan  1 00:00:00 proxy1 squid[1234]: " + line,
+			Syslog{Facility: 20, Severity: 6, Time: stamp("Jan  1 00:00:00"), Host: "proxy1", Tag: "squid", Message: line},
+		},
+		{
+			// Local, without a host.
+			"<166>Jan  1 00:00:00 squid: " + line + "\n",
+			Syslog{Facility: 20, Severity: 6, Time: stamp("Jan  1 00:00:00"), Tag: "squid", Message: line},
+		},
+		{
+			// No header at all.
+			"<13>" + line,
+			Syslog{Facility: 1, Severity: 5, Message: line},
+		},
+		{
+			"<166>1 2016-01-01T00:00:00.123Z proxy1 squid 1234 - - " + line,
+			Syslog{Facility: 20, Severity: 6, Time: time.Date(2016, 1, 1, 0, 0, 0, 123e6, time.UTC), Host: "proxy1", Tag: "squid", Message: line},
+		},
+		{
+			"<166>1 - - - - - [a b=\"x\\]y\"][c] \xef\xbb\xbf" + line,
+			Syslog{Facility: 20, Severity: 6, Message: line},
+		},
+	} {
+		got, err := ParseSyslog(test.in)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.in, *got, test.want)
+		}
+	}
+	for _, bad := range []string{
+		line,
+		"<>" + line,
+		"<192>" + line,
+		"<166>1 yesterday proxy1 squid 1234 - - " + line,
+		"<166>1 - - - - - [a b=\"]" + line,
+		"<166>1 - - squid",
+	} {
+		if got, err := ParseSyslog(bad); err == nil {
+			t.Errorf("%q: got %+v, want error", bad, *got)
+		}
+	}
+}
+
+func TestReadSyslog(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("<13>one\r\n9 <13>two\nx<13>three"))
+	var got []string
+	for {
+		m, err := ReadSyslog(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+	if want := []string{"<13>one", "<13>two\nx", "<13>three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := ReadSyslog(bufio.NewReader(strings.NewReader(strings.Repeat("a", MaxSyslogSize+1)))); err == nil {
+		t.Error("Read too long message")
+	}
+	if _, err := ReadSyslog(bufio.NewReader(strings.NewReader("99999999 <13>x"))); err == nil {
+		t.Error("Read too long length")
+	}
+}
+
+func benchLines(n int) []string {
+	var ret []string
+	for i := 0; i < n; i++ {
+		if i%3 == 0 {
+			ret = append(ret, fmt.Sprintf("1451606400.%03d %6d 10.0.0.%d TCP_TUNNEL/200 %d CONNECT www%d.example.com:443 - HIER_DIRECT/1.2.3.4 -", i%1000, i, i%250, 1000+i, i%100))
+		} else {
+			ret = append(ret, fmt.Sprintf("1451606400.%03d %6d 10.0.0.%d TCP_MISS/200 %d GET http://www%d.example.co.uk/path/%d?q=1 - HIER_DIRECT/1.2.3.4 text/html", i%1000, i, i%250, 1000+i, i%100, i))
+		}
+	}
+	return ret
+}
+
+func BenchmarkParse(b *testing.B) {
+	lines := benchLines(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(lines[i%len(lines)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseRegexp(b *testing.B) {
+	lines := benchLines(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var f [numFields]string
+		m := reEntry.FindStringSubmatch(lines[i%len(lines)])
+		copy(f[:], m[1:])
+		if _, err := parseFields(&f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSplitFields(b *testing.B) {
+	lines := benchLines(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var f [numFields]string
+		if !splitFields(lines[i%len(lines)], &f) {
+			b.Fatal("not split")
+		}
+	}
+}
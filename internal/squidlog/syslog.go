@@ -0,0 +1,207 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package squidlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxSyslogSize is the largest syslog message accepted.
+const MaxSyslogSize = 64 << 10
+
+// Syslog is a parsed syslog message, in either RFC 3164 or RFC 5424 format.
+// Fields that aren't in the message are empty.
+type Syslog struct {
+	Facility int
+	Severity int
+	Time     time.Time // RFC 3164 has no year, so it's year 0 for those.
+	Host     string
+	Tag      string // APP-NAME in RFC 5424.
+	Message  string
+}
+
+// ParseSyslog parses a syslog message, as sent by e.g. squid's
+// "access_log syslog:..." or a relay like rsyslog.
+func ParseSyslog(s string) (*Syslog, error) {
+	s = strings.TrimRight(s, "\r\n\x00")
+	if !strings.HasPrefix(s, "<") {
+		return nil, fmt.Errorf("syslog message doesn't start with <PRI>: %q", s)
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return nil, fmt.Errorf("bad syslog PRI in %q", s)
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return nil, fmt.Errorf("bad syslog PRI %q", s[1:end])
+	}
+	m := &Syslog{Facility: pri / 8, Severity: pri % 8}
+	s = s[end+1:]
+	if strings.HasPrefix(s, "1 ") {
+		return m, parseRFC5424(m, s[2:])
+	}
+	parseRFC3164(m, s)
+	return m, nil
+}
+
+// nextField returns the field up to the next space, and the rest after it.
+func nextField(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// nilValue turns RFC 5424's "-" into "".
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+func parseRFC5424(m *Syslog, s string) error {
+	var ts, procID, msgID string
+	ts, s = nextField(s)
+	m.Host, s = nextField(s)
+	m.Tag, s = nextField(s)
+	procID, s = nextField(s)
+	msgID, s = nextField(s)
+	if procID == "" || msgID == "" || s == "" {
+		return fmt.Errorf("truncated RFC 5424 syslog message")
+	}
+	m.Host, m.Tag = nilValue(m.Host), nilValue(m.Tag)
+	if ts != "-" {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return fmt.Errorf("bad RFC 5424 timestamp %q: %v", ts, err)
+		}
+		m.Time = t
+	}
+
+	// Skip the structured data, which is "-" or one or more
+	// [id name="value"...], where values can have escaped '"' and ']'.
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	} else {
+		for strings.HasPrefix(s, "[") {
+			quoted := false
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] == '\\' && quoted {
+					i++
+				} else if s[i] == '"' {
+					quoted = !quoted
+				} else if s[i] == ']' && !quoted {
+					break
+				}
+			}
+			if i >= len(s) {
+				return fmt.Errorf("unterminated RFC 5424 structured data")
+			}
+			s = s[i+1:]
+		}
+	}
+	if s != "" && s[0] != ' ' {
+		return fmt.Errorf("bad RFC 5424 structured data")
+	}
+	m.Message = strings.TrimPrefix(strings.TrimPrefix(s, " "), "\xef\xbb\xbf")
+	return nil
+}
+
+// parseRFC3164 parses what's after the PRI. RFC 3164 only describes what's
+// common, so anything that doesn't look like a header is the message.
+func parseRFC3164(m *Syslog, s string) {
+	if len(s) < len(time.Stamp)+1 || s[len(time.Stamp)] != ' ' {
+		m.Message = s
+		return
+	}
+	t, err := time.Parse(time.Stamp, s[:len(time.Stamp)])
+	if err != nil {
+		m.Message = s
+		return
+	}
+	m.Time = t
+	s = s[len(time.Stamp)+1:]
+
+	// The host is left out by some senders, e.g. when logging locally, in
+	// which case the tag comes right after the time.
+	f, rest := nextField(s)
+	if !isTag(f) {
+		m.Host = f
+		s = rest
+		f, rest = nextField(s)
+	}
+	if isTag(f) {
+		m.Tag = strings.TrimSuffix(f, ":")
+		if i := strings.IndexByte(m.Tag, '['); i >= 0 {
+			m.Tag = m.Tag[:i]
+		}
+		s = rest
+	}
+	m.Message = s
+}
+
+// isTag returns true for a tag with its colon, like "squid:" or
+// "squid[123]:".
+func isTag(s string) bool {
+	return len(s) > 1 && strings.HasSuffix(s, ":")
+}
+
+// ReadSyslog reads a syslog message from a stream, like a TCP connection,
+// framed either by octet counting ("<length> <message>") or by newlines, as
+// in RFC 6587.
+func ReadSyslog(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] < '0' || b[0] > '9' {
+		var l []byte
+		for {
+			b, err := r.ReadSlice('\n')
+			l = append(l, b...)
+			if len(l) > MaxSyslogSize {
+				return "", fmt.Errorf("syslog message longer than %d bytes", MaxSyslogSize)
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF && len(l) > 0 {
+				err = nil
+			}
+			return strings.TrimRight(string(l), "\r\n"), err
+		}
+	}
+	ls, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(ls, " "))
+	if err != nil || n <= 0 || n > MaxSyslogSize {
+		return "", fmt.Errorf("bad syslog message length %q", ls)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
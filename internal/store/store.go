@@ -0,0 +1,392 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package store opens the squidwarden database and has the helpers for
+// changing the policy in it.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Open opens the sqlite database in fn, with foreign keys turned on.
+func Open(fn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// RuleTypes and RuleActions are what the type and action of a rule can be.
+// They're the same as the Type* and Action* constants of the policy
+// package, which can't be used here since it uses this package.
+var (
+	RuleTypes   = []string{"domain", "https-domain", "exact", "regex", "https-regex"}
+	RuleActions = []string{"allow", "block", "ignore"}
+)
+
+// CheckRule returns an error if typ or action isn't one of RuleTypes or
+// RuleActions.
+func CheckRule(typ, action string) error {
+	if !contains(RuleTypes, typ) {
+		return fmt.Errorf("invalid rule type %q, want one of %s", typ, strings.Join(RuleTypes, ", "))
+	}
+	if !contains(RuleActions, action) {
+		return fmt.Errorf("invalid rule action %q, want one of %s", action, strings.Join(RuleActions, ", "))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlList returns list as an SQL list of strings. The values must not
+// contain quotes.
+func sqlList(list []string) string {
+	return "('" + strings.Join(list, "', '") + "')"
+}
+
+// Migrate brings a database created with an older schema up to date with
+// schema, the sqlite.schema of this version, as far as it can be changed in
+// place. Run it before using the database. It's safe to run any number of
+// times.
+//
+// Missing tables, indexes, triggers and views are created, and new tables
+// get the rows the schema inserts into them, like the revision. Missing
+// columns are added, without any constraints SQLite can't add to an
+// existing table.
+//
+// Databases from before the CHECK constraints on the type and action of
+// rules get triggers that do the same, since SQLite can't add constraints
+// to existing tables. Rules already in the table aren't checked.
+func Migrate(db *sql.DB, schema string) error {
+	var def string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type='table' AND name='rules'`).Scan(&def); err == sql.ErrNoRows {
+		// Empty, the setup wizard creates it with the current schema.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading rules table definition: %v", err)
+	}
+	if err := migrateSchema(db, schema); err != nil {
+		return err
+	}
+	if strings.Contains(def, "CHECK") {
+		return nil
+	}
+	cond := fmt.Sprintf(`NEW.type NOT IN %s OR NEW.action NOT IN %s`, sqlList(RuleTypes), sqlList(RuleActions))
+	for _, op := range []string{"INSERT", "UPDATE"} {
+		q := fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS rules_check_%s BEFORE %s ON rules WHEN %s BEGIN SELECT RAISE(ABORT, 'CHECK constraint failed: rules'); END`, strings.ToLower(op), op, cond)
+		if _, err := db.Exec(q); err != nil {
+			return fmt.Errorf("adding rule %s trigger: %v", strings.ToLower(op), err)
+		}
+	}
+	return nil
+}
+
+// querier is a *sql.DB or *sql.Tx.
+type querier interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+// schemaObject is a table, index, trigger or view in sqlite_master.
+type schemaObject struct {
+	typ, name, sql string
+}
+
+// schemaObjects returns the objects q has, in the order they were created.
+// Indexes SQLite makes for constraints have no SQL and are left out.
+func schemaObjects(q querier) ([]schemaObject, error) {
+	rows, err := q.Query(`SELECT type, name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []schemaObject
+	for rows.Next() {
+		var o schemaObject
+		if err := rows.Scan(&o.typ, &o.name, &o.sql); err != nil {
+			return nil, err
+		}
+		ret = append(ret, o)
+	}
+	return ret, rows.Err()
+}
+
+// column is a column as PRAGMA table_info describes it.
+type column struct {
+	name, typ string
+	notNull   bool
+	dflt      sql.NullString
+}
+
+func tableColumns(q querier, table string) ([]column, error) {
+	rows, err := q.Query(fmt.Sprintf(`PRAGMA table_info(%q)`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []column
+	for rows.Next() {
+		var c column
+		var cid, pk int
+		if err := rows.Scan(&cid, &c.name, &c.typ, &c.notNull, &c.dflt, &pk); err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
+
+// addColumnSQL returns the ALTER TABLE that adds c to table. NOT NULL is
+// only kept with a default, since SQLite can't fill in the existing rows
+// otherwise.
+func addColumnSQL(table string, c column) string {
+	q := fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %q %s`, table, c.name, c.typ)
+	if c.dflt.Valid {
+		q += " DEFAULT " + c.dflt.String
+		if c.notNull {
+			q += " NOT NULL"
+		}
+	}
+	return q
+}
+
+// migrateSchema adds what schema has and db doesn't.
+func migrateSchema(db *sql.DB, schema string) error {
+	want, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return err
+	}
+	defer want.Close()
+	// Every connection gets its own in-memory database.
+	want.SetMaxOpenConns(1)
+	if _, err := want.Exec(schema); err != nil {
+		return fmt.Errorf("loading schema: %v", err)
+	}
+	objs, err := schemaObjects(want)
+	if err != nil {
+		return fmt.Errorf("reading schema: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	got, err := schemaObjects(tx)
+	if err != nil {
+		return fmt.Errorf("reading database schema: %v", err)
+	}
+	have := make(map[string]bool)
+	for _, o := range got {
+		have[o.name] = true
+	}
+	for _, o := range objs {
+		if have[o.name] {
+			if o.typ != "table" {
+				continue
+			}
+			if err := addColumns(tx, want, o.name); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec(o.sql); err != nil {
+			return fmt.Errorf("creating %s %s: %v", o.typ, o.name, err)
+		}
+		if o.typ == "table" {
+			if err := copyRows(tx, want, o.name); err != nil {
+				return fmt.Errorf("filling table %s: %v", o.name, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// addColumns adds the columns of table in want that tx lacks.
+func addColumns(tx *sql.Tx, want *sql.DB, table string) error {
+	wantCols, err := tableColumns(want, table)
+	if err != nil {
+		return err
+	}
+	gotCols, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, c := range gotCols {
+		have[c.name] = true
+	}
+	for _, c := range wantCols {
+		if have[c.name] {
+			continue
+		}
+		if _, err := tx.Exec(addColumnSQL(table, c)); err != nil {
+			return fmt.Errorf("adding column %s.%s: %v", table, c.name, err)
+		}
+	}
+	return nil
+}
+
+// copyRows copies the rows of table in from into tx.
+func copyRows(tx *sql.Tx, from *sql.DB, table string) error {
+	rows, err := from.Query(fmt.Sprintf(`SELECT * FROM %q`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	var all [][]interface{}
+	for rows.Next() {
+		r := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range r {
+			ptrs[i] = &r[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		all = append(all, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = fmt.Sprintf("%q", c)
+	}
+	return InsertMany(tx, fmt.Sprintf(`INSERT INTO %q(%s)`, table, strings.Join(quoted, ", ")), all)
+}
+
+// Revision returns the policy revision. It's bumped on every change, so that
+// the helper and UI can tell when to reload.
+func Revision(db *sql.DB) (int64, error) {
+	var rev int64
+	if err := db.QueryRow(`SELECT revision FROM revision`).Scan(&rev); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// BumpRevision marks the policy as changed.
+func BumpRevision(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE revision SET revision=revision+1`)
+	return err
+}
+
+// Update runs f in a transaction and bumps the revision. Nothing is committed
+// if f returns an error.
+func Update(db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	if err := BumpRevision(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateNoBump runs f in a transaction, like Update, but doesn't bump the
+// revision. It's for changes that aren't policy, like stats or settings.
+func UpdateNoBump(db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rows per multi-row INSERT. Keeps statements well under SQLite's limits
+// on variables (999) and compound selects (500).
+const maxInsertRows = 100
+
+// insertSQL returns prefix followed by n rows of cols placeholders.
+func insertSQL(prefix string, cols, n int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?,", cols), ",") + ")"
+	return prefix + " VALUES" + strings.TrimSuffix(strings.Repeat(row+",", n), ",")
+}
+
+// InsertMany inserts rows using multi-row INSERTs, with a prepared
+// statement for the full size batches. prefix is the statement without
+// VALUES, e.g. "INSERT INTO members(group_id, source_id)". All rows must have
+// the same number of columns.
+func InsertMany(tx *sql.Tx, prefix string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	cols := len(rows[0])
+	for _, r := range rows {
+		if len(r) != cols {
+			return fmt.Errorf("rows have %d and %d columns", cols, len(r))
+		}
+	}
+	exec := func(stmt *sql.Stmt, batch [][]interface{}) error {
+		args := make([]interface{}, 0, len(batch)*cols)
+		for _, r := range batch {
+			args = append(args, r...)
+		}
+		_, err := stmt.Exec(args...)
+		return err
+	}
+	if len(rows) >= maxInsertRows {
+		stmt, err := tx.Prepare(insertSQL(prefix, cols, maxInsertRows))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for len(rows) >= maxInsertRows {
+			if err := exec(stmt, rows[:maxInsertRows]); err != nil {
+				return err
+			}
+			rows = rows[maxInsertRows:]
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(insertSQL(prefix, cols, len(rows)))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return exec(stmt, rows)
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+func TestInsertSQL(t *testing.T) {
+	for _, test := range []struct {
+		cols, n int
+		want    string
+	}{
+		{1, 1, "INSERT INTO t(a) VALUES(?)"},
+		{2, 1, "INSERT INTO t(a) VALUES(?,?)"},
+		{3, 2, "INSERT INTO t(a) VALUES(?,?,?),(?,?,?)"},
+	} {
+		if got := insertSQL("INSERT INTO t(a)", test.cols, test.n); got != test.want {
+			t.Errorf("%d cols %d rows: got %q, want %q", test.cols, test.n, got, test.want)
+		}
+	}
+}
+
+// testDB returns an in-memory database with table t and a revision, or
+// skips the test if there's no sqlite driver.
+func testDB(tb testing.TB) *sql.DB {
+	db, err := Open(":memory:")
+	if err != nil {
+		tb.Skipf("No sqlite: %v", err)
+	}
+	// Only one connection, since every connection gets its own in-memory
+	// database.
+	db.SetMaxOpenConns(1)
+	for _, q := range []string{
+		`CREATE TABLE revision(revision INTEGER NOT NULL)`,
+		`INSERT INTO revision(revision) VALUES(0)`,
+		`CREATE TABLE t(id TEXT PRIMARY KEY, n INTEGER, comment TEXT)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return db
+}
+
+func testRows(n int) [][]interface{} {
+	var ret [][]interface{}
+	for i := 0; i < n; i++ {
+		ret = append(ret, []interface{}{fmt.Sprintf("id-%d", i), i, "comment"})
+	}
+	return ret
+}
+
+func TestInsertMany(t *testing.T) {
+	for _, n := range []int{0, 1, maxInsertRows - 1, maxInsertRows, 3*maxInsertRows + 7} {
+		db := testDB(t)
+		if err := Update(db, func(tx *sql.Tx) error {
+			return InsertMany(tx, "INSERT INTO t(id, n, comment)", testRows(n))
+		}); err != nil {
+			t.Fatalf("%d rows: %v", n, err)
+		}
+		var got, sum int
+		if err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(n), 0) FROM t`).Scan(&got, &sum); err != nil {
+			t.Fatal(err)
+		}
+		if got != n || sum != n*(n-1)/2 {
+			t.Errorf("%d rows: got %d rows summing to %d", n, got, sum)
+		}
+		db.Close()
+	}
+}
+
+func TestInsertManyColumns(t *testing.T) {
+	if err := InsertMany(nil, "INSERT INTO t(id)", [][]interface{}{{1}, {1, 2}}); err == nil {
+		t.Errorf("uneven rows succeeded, want error")
+	}
+}
+
+const benchRows = 5000
+
+func BenchmarkInsertRowByRow(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		db := testDB(b)
+		if err := Update(db, func(tx *sql.Tx) error {
+			for _, r := range testRows(benchRows) {
+				if _, err := tx.Exec(`INSERT INTO t(id, n, comment) VALUES(?,?,?)`, r...); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+		db.Close()
+	}
+}
+
+func BenchmarkInsertMany(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		db := testDB(b)
+		if err := Update(db, func(tx *sql.Tx) error {
+			return InsertMany(tx, "INSERT INTO t(id, n, comment)", testRows(benchRows))
+		}); err != nil {
+			b.Fatal(err)
+		}
+		db.Close()
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Skipf("No sqlite: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE rules(rule_id TEXT NOT NULL PRIMARY KEY, type TEXT NOT NULL CHECK(type != ''), value TEXT NOT NULL, action TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO rules(rule_id, type, value, action) VALUES('r1', 'domain', 'example.com', 'allow')`); err != nil {
+		t.Fatal(err)
+	}
+	const schema = `
+CREATE TABLE revision(revision INTEGER NOT NULL);
+CREATE TABLE rules(
+  rule_id TEXT NOT NULL PRIMARY KEY,
+  type TEXT NOT NULL CHECK(type != ''),
+  value TEXT NOT NULL,
+  action TEXT NOT NULL,
+  enabled INTEGER NOT NULL DEFAULT 1,
+  comment TEXT
+);
+CREATE INDEX rules_value ON rules(value);
+CREATE TABLE ruletags(
+  rule_id TEXT NOT NULL REFERENCES rules(rule_id),
+  tag TEXT NOT NULL,
+  PRIMARY KEY(rule_id, tag)
+);
+CREATE TABLE t(id TEXT PRIMARY KEY, n INTEGER, comment TEXT);
+CREATE TABLE seeded(name TEXT NOT NULL PRIMARY KEY, value INTEGER);
+INSERT INTO seeded(name, value) VALUES('a', 1);
+INSERT INTO seeded(name, value) VALUES('b', NULL);
+INSERT INTO revision(revision) VALUES(0);
+`
+	for i := 0; i < 2; i++ {
+		if err := Migrate(db, schema); err != nil {
+			t.Fatalf("Migrate #%d: %v", i+1, err)
+		}
+	}
+	var enabled int
+	var comment sql.NullString
+	if err := db.QueryRow(`SELECT enabled, comment FROM rules WHERE rule_id='r1'`).Scan(&enabled, &comment); err != nil {
+		t.Fatal(err)
+	}
+	if enabled != 1 || comment.Valid {
+		t.Errorf("new columns of old rule: got %d %v, want 1 NULL", enabled, comment)
+	}
+	if _, err := db.Exec(`INSERT INTO ruletags(rule_id, tag) VALUES('r1', 'x')`); err != nil {
+		t.Errorf("insert into new table: %v", err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name='rules_value'`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("index: got %d %v, want 1", n, err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM seeded`).Scan(&n); err != nil || n != 2 {
+		t.Errorf("rows of new table: got %d %v, want 2", n, err)
+	}
+	if rev, err := Revision(db); err != nil || rev != 0 {
+		t.Errorf("Revision: got %d %v, want 0", rev, err)
+	}
+	if err := Migrate(db, "CREATE TABLE broken("); err == nil {
+		t.Errorf("bad schema: got no error")
+	}
+}
+
+func TestMigrateRuleChecks(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE rules(rule_id TEXT NOT NULL, type TEXT NOT NULL, value TEXT NOT NULL, action TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Migrate(db, ""); err != nil {
+			t.Fatalf("Migrate #%d: %v", i+1, err)
+		}
+	}
+	for _, test := range []struct {
+		typ, action string
+		ok          bool
+	}{
+		{"domain", "allow", true},
+		{"https-regex", "ignore", true},
+		{"Domain", "allow", false},
+		{"domain", "permit", false},
+		{"", "", false},
+	} {
+		if err := CheckRule(test.typ, test.action); (err == nil) != test.ok {
+			t.Errorf("CheckRule(%q, %q): got %v, want ok=%t", test.typ, test.action, err, test.ok)
+		}
+		_, err := db.Exec(`INSERT INTO rules(rule_id, type, value, action) VALUES(?,?,?,?)`, test.typ+test.action, test.typ, "example.com", test.action)
+		if (err == nil) != test.ok {
+			t.Errorf("insert %q %q: got %v, want ok=%t", test.typ, test.action, err, test.ok)
+		}
+	}
+	if _, err := db.Exec(`UPDATE rules SET action='permit'`); err == nil {
+		t.Errorf("update to invalid action: got no error")
+	}
+}
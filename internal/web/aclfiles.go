@@ -0,0 +1,312 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// ACL domain files let squid.conf use the domains of an ACL directly, e.g.
+// for ssl_bump or cache rules, with one dstdomain acl per ACL and action.
+// ACLs fed by list subscriptions can have hundreds of thousands of
+// domains, so the files are streamed from the database rather than built
+// in memory, split into shards, and only rewritten when their checksum
+// changed.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	aclFilesManifest = "checksums"
+	aclFilesPrefix   = "acl_"
+	aclFilesSuffix   = ".domains"
+)
+
+// aclDomainsWhere picks the rules of an ACL and action that squid can
+// match with dstdomain: enabled domain rules without a port.
+const aclDomainsWhere = `
+FROM aclrules
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE aclrules.acl_id=?
+AND rules.action=?
+AND rules.enabled
+AND rules.type IN ('domain', 'https-domain')
+AND instr(rules.value, ':')=0
+AND rules.rule_id NOT IN (SELECT rule_id FROM ruleexpiry WHERE expires <= ?)`
+
+// aclFileSet is the files of one ACL and action.
+type aclFileSet struct {
+	ACL     aclID
+	Comment string
+	Action  string
+	Domains int
+	Files   []string // Base names, in order.
+}
+
+// base names the set in file names and the checksums.
+func (s *aclFileSet) base() string {
+	return fmt.Sprintf("%s_%s", s.ACL, s.Action)
+}
+
+// name is the set's squid acl name.
+func (s *aclFileSet) name() string {
+	return "sw_acl_" + s.base()
+}
+
+func aclShardName(base string, n int) string {
+	return fmt.Sprintf("%s%s.%d%s", aclFilesPrefix, base, n, aclFilesSuffix)
+}
+
+// getACLFileSets returns the file sets of all enabled, unarchived ACLs
+// with any domains.
+func getACLFileSets(now time.Time, shard int) ([]aclFileSet, error) {
+	rows, err := db.Query(`
+SELECT acl_id, comment
+FROM acls
+WHERE enabled
+AND acl_id NOT IN (SELECT acl_id FROM aclarchive)
+ORDER BY acl_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var acls []acl
+	for rows.Next() {
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &c); err != nil {
+			return nil, err
+		}
+		acls = append(acls, acl{ACLID: aclID(s), Comment: c.String})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	var ret []aclFileSet
+	for _, a := range acls {
+		for _, action := range []string{actionAllow, actionBlock} {
+			s := aclFileSet{ACL: a.ACLID, Comment: a.Comment, Action: action}
+			if err := db.QueryRow(`SELECT COUNT(DISTINCT rules.value)`+aclDomainsWhere, string(a.ACLID), action, now.Unix()).Scan(&s.Domains); err != nil {
+				return nil, err
+			}
+			if s.Domains == 0 {
+				continue
+			}
+			for n := 0; n*shard < s.Domains; n++ {
+				s.Files = append(s.Files, aclShardName(s.base(), n))
+			}
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+// streamACLDomains calls f with each domain of the set, sorted.
+func streamACLDomains(s *aclFileSet, now time.Time) func(func(string) error) error {
+	return func(f func(string) error) error {
+		rows, err := db.Query(`SELECT DISTINCT rules.value`+aclDomainsWhere+` ORDER BY rules.value`, string(s.ACL), s.Action, now.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var d string
+			if err := rows.Scan(&d); err != nil {
+				return err
+			}
+			if err := f(d); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+}
+
+// hashDomains is the checksum of the files that writeDomainShards would
+// write, without writing them.
+func hashDomains(shard int, stream func(func(string) error) error) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "shard %d\n", shard)
+	if err := stream(func(d string) error {
+		_, err := io.WriteString(h, d+"\n")
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeDomainShards writes the domains to files, at most shard in each,
+// replacing each file atomically.
+func writeDomainShards(dir string, files []string, shard int, stream func(func(string) error) error) error {
+	var f *os.File
+	var w *bufio.Writer
+	n, lines := 0, 0
+	closeShard := func() error {
+		if f == nil {
+			return nil
+		}
+		defer os.Remove(f.Name())
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(f.Name(), 0644); err != nil {
+			return err
+		}
+		err := os.Rename(f.Name(), filepath.Join(dir, files[n]))
+		f = nil
+		n++
+		return err
+	}
+	err := stream(func(d string) error {
+		if f != nil && lines == shard {
+			if err := closeShard(); err != nil {
+				return err
+			}
+		}
+		if f == nil {
+			if n >= len(files) {
+				return fmt.Errorf("more domains than fit in %d files", len(files))
+			}
+			var err error
+			if f, err = ioutil.TempFile(dir, ".squidwarden"); err != nil {
+				return err
+			}
+			w = bufio.NewWriter(f)
+			lines = 0
+		}
+		lines++
+		_, err := w.WriteString(d + "\n")
+		return err
+	})
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		return err
+	}
+	if err := closeShard(); err != nil {
+		return err
+	}
+	if n != len(files) {
+		return fmt.Errorf("wrote %d files, expected %d; did the ACL change?", n, len(files))
+	}
+	return nil
+}
+
+// readACLManifest reads the checksums of the files last written.
+func readACLManifest(dir string) map[string]string {
+	ret := make(map[string]string)
+	b, err := ioutil.ReadFile(filepath.Join(dir, aclFilesManifest))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read ACL file checksums: %v", err)
+		}
+		return ret
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) == 2 {
+			ret[f[1]] = f[0]
+		}
+	}
+	return ret
+}
+
+func filesExist(dir string, files []string) bool {
+	for _, fn := range files {
+		if _, err := os.Stat(filepath.Join(dir, fn)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// writeACLFiles writes the files of the sets that changed, and removes
+// the files of ACLs that are gone.
+func writeACLFiles(dir string, sets []aclFileSet, shard int, now time.Time) error {
+	old := readACLManifest(dir)
+	var manifest bytes.Buffer
+	keep := make(map[string]bool)
+	written, skipped := 0, 0
+	for n := range sets {
+		s := &sets[n]
+		stream := streamACLDomains(s, now)
+		sum, err := hashDomains(shard, stream)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sum, s.base())
+		for _, fn := range s.Files {
+			keep[fn] = true
+		}
+		if old[s.base()] == sum && filesExist(dir, s.Files) {
+			skipped++
+			continue
+		}
+		if err := writeDomainShards(dir, s.Files, shard, stream); err != nil {
+			return fmt.Errorf("writing domains of ACL %s: %v", s.ACL, err)
+		}
+		written++
+	}
+	if err := writeConf(filepath.Join(dir, aclFilesManifest), manifest.Bytes()); err != nil {
+		return err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, aclFilesPrefix+"*"+aclFilesSuffix))
+	if err != nil {
+		return err
+	}
+	for _, fn := range stale {
+		if !keep[filepath.Base(fn)] {
+			if err := os.Remove(fn); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("ACL files: wrote %d, %d unchanged", written, skipped)
+	return nil
+}
+
+// generateACLFilesConf emits the dstdomain acls of the ACL files.
+func generateACLFilesConf(w io.Writer, dir string, sets []aclFileSet) {
+	if len(sets) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n# ACL domains.\n")
+	for _, s := range sets {
+		fmt.Fprintf(w, "# %s: %s, %d domains\n", oneLine(s.Comment), s.Action, s.Domains)
+		fmt.Fprintf(w, "acl %s dstdomain", s.name())
+		for _, fn := range s.Files {
+			fmt.Fprintf(w, " %q", filepath.Join(dir, fn))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type activeRequest struct {
+	Client string
+	URI    string
+	Age    string
+
+	// Rule that would match this request.
+	Type string
+	Host string
+}
+
+type activeClient struct {
+	Client   string
+	Source   *source
+	Requests []activeRequest
+
+	// ACLs to block in. Those applied to the client's groups, or all of
+	// them if none are, for the user to pick from.
+	ACLs      []acl
+	GroupACLs bool
+}
+
+var reActiveAge = regexp.MustCompile(`\(([0-9.]+ seconds) ago\)`)
+
+// parseActiveRequests parses the output of the 'active_requests' cache
+// manager section.
+func parseActiveRequests(s string) []activeRequest {
+	var ret []activeRequest
+	var cur *activeRequest
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, "Connection:"):
+			if cur != nil {
+				ret = append(ret, *cur)
+			}
+			cur = &activeRequest{}
+		case cur == nil:
+		case strings.HasPrefix(l, "remote:"):
+			if h, _, err := net.SplitHostPort(strings.TrimSpace(strings.TrimPrefix(l, "remote:"))); err == nil {
+				cur.Client = h
+			}
+		case strings.HasPrefix(l, "uri "):
+			cur.URI = strings.TrimPrefix(l, "uri ")
+			cur.Type, cur.Host = uriTarget(cur.URI)
+		case strings.HasPrefix(l, "start "):
+			if m := reActiveAge.FindStringSubmatch(l); m != nil {
+				cur.Age = m[1]
+			}
+		}
+	}
+	if cur != nil {
+		ret = append(ret, *cur)
+	}
+	return ret
+}
+
+// uriTarget returns the rule type and host that would match a request
+// URI as squid shows it, or empty strings if it can't be parsed. CONNECT
+// requests only have "host:port".
+func uriTarget(uri string) (string, string) {
+	if u, err := url.Parse(uri); err == nil && u.Scheme != "" && u.Host != "" {
+		return typeDomain, u.Host
+	}
+	if h, _, err := net.SplitHostPort(uri); err == nil {
+		return typeHTTPSDomain, h
+	}
+	return "", ""
+}
+
+// sourceContains returns true if source, in CIDR or addr/mask form, contains ip.
+func sourceContains(src string, ip net.IP) bool {
+	if _, n, err := net.ParseCIDR(src); err == nil {
+		return n.Contains(ip)
+	}
+	s := strings.SplitN(src, "/", 2)
+	if len(s) != 2 {
+		return false
+	}
+	a, m := net.ParseIP(s[0]), net.ParseIP(s[1])
+	if a == nil || m == nil {
+		return false
+	}
+	if len(ip) != len(a) {
+		ip = ip.To16()
+	}
+	for n := range a {
+		if a[n] != ip[n]&m[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// groupActiveRequests groups requests by client and attaches the first
+// matching source, if any.
+func groupActiveRequests(reqs []activeRequest, sources []source) []*activeClient {
+	byClient := make(map[string]*activeClient)
+	var clients []string
+	for _, r := range reqs {
+		c, found := byClient[r.Client]
+		if !found {
+			c = &activeClient{Client: r.Client}
+			if ip := net.ParseIP(r.Client); ip != nil {
+				for n := range sources {
+					if sourceContains(sources[n].Source, ip) {
+						c.Source = &sources[n]
+						break
+					}
+				}
+			}
+			byClient[r.Client] = c
+			clients = append(clients, r.Client)
+		}
+		c.Requests = append(c.Requests, r)
+	}
+	sort.Strings(clients)
+	var ret []*activeClient
+	for _, c := range clients {
+		ret = append(ret, byClient[c])
+	}
+	return ret
+}
+
+// getClientACLs returns the ACLs applied to the groups of src, or to the
+// default group if src is nil.
+func getClientACLs(src *source) ([]acl, error) {
+	var rows *sql.Rows
+	var err error
+	if src != nil {
+		rows, err = db.Query(`
+SELECT DISTINCT acls.acl_id, acls.comment
+FROM members
+JOIN groupaccess ON members.group_id=groupaccess.group_id
+JOIN acls ON groupaccess.acl_id=acls.acl_id
+WHERE members.source_id=?
+AND acls.acl_id NOT IN (SELECT acl_id FROM aclarchive)
+ORDER BY acls.comment`, string(src.SourceID))
+	} else {
+		var g groupID
+		if g, err = getDefaultGroup(); err != nil || g == "" {
+			return nil, err
+		}
+		rows, err = db.Query(`
+SELECT acls.acl_id, acls.comment
+FROM groupaccess
+JOIN acls ON groupaccess.acl_id=acls.acl_id
+WHERE groupaccess.group_id=?
+AND acls.acl_id NOT IN (SELECT acl_id FROM aclarchive)
+ORDER BY acls.comment`, string(g))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []acl
+	for rows.Next() {
+		var id string
+		var c sql.NullString
+		if err := rows.Scan(&id, &c); err != nil {
+			return nil, err
+		}
+		ret = append(ret, acl{ACLID: aclID(id), Comment: c.String})
+	}
+	return ret, rows.Err()
+}
+
+// addClientACLs sets the ACLs each client can be blocked in.
+func addClientACLs(clients []*activeClient) error {
+	var all []acl
+	for _, c := range clients {
+		var err error
+		if c.ACLs, err = getClientACLs(c.Source); err != nil {
+			return err
+		}
+		if len(c.ACLs) > 0 {
+			c.GroupACLs = true
+			continue
+		}
+		if all == nil {
+			if all, err = getACLs(); err != nil {
+				return err
+			}
+		}
+		c.ACLs = all
+	}
+	return nil
+}
+
+func activeHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Configured bool
+		CanKill    bool
+		Error      string
+		Clients    []*activeClient
+	}{
+		Configured: serverOpts.CacheMgr != "",
+		CanKill:    serverOpts.KillCommand != "",
+	}
+	if data.Configured {
+		t, err := fetchCacheMgr("active_requests")
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			sources, err := getSources()
+			if err != nil {
+				return "", err
+			}
+			data.Clients = groupActiveRequests(parseActiveRequests(t), sources)
+			if err := addClientACLs(data.Clients); err != nil {
+				return "", err
+			}
+		}
+	}
+	tmpl := getTemplate("active.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func activeKillHandler(r *http.Request) (interface{}, error) {
+	if serverOpts.KillCommand == "" {
+		return nil, errHTTP{
+			external: "-kill_command not configured",
+			code:     http.StatusNotImplemented,
+		}
+	}
+	var data struct {
+		Client string `form:"client,required"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(data.Client)
+	if ip == nil {
+		return nil, errHTTP{
+			external: fmt.Sprintf("%q is not a valid address", data.Client),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if err := killClient(ip); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: "kill command failed",
+			code:     http.StatusInternalServerError,
+		}
+	}
+	return &struct {
+		Client string `json:"client"`
+	}{Client: ip.String()}, nil
+}
+
+// killClient runs -kill_command for the client.
+func killClient(ip net.IP) error {
+	args := append(strings.Fields(serverOpts.KillCommand), ip.String())
+	log.Printf("Killing connections from %s: %q", ip, args)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%q: %v, output %q", args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Activity reports show what a source did over a date range: top domains,
+// bytes and denials. They're built from traffic stats, so need -stats.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/squidwarden/internal/pdf"
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultActivityDays    = 7
+	defaultActivityDomains = 50
+	maxActivityDomains     = 10000
+)
+
+type activityDomain struct {
+	Domain   string
+	Requests int64
+	Denied   int64
+	Bytes    int64
+}
+
+type activityReport struct {
+	Source   source
+	From     string
+	To       string
+	Clients  []string
+	Requests int64
+	Denied   int64
+	Bytes    int64
+	Domains  []activityDomain
+	Limit    int
+	More     int
+}
+
+// parseActivityParams parses from and to (days, inclusive, in now's time
+// zone, as YYYY-MM-DD or anything else parseRangeTime takes) and limit,
+// defaulting to the last week.
+func parseActivityParams(r *http.Request, now time.Time) (from, to time.Time, limit int, err error) {
+	y, m, d := now.Date()
+	to = time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	from = to.AddDate(0, 0, 1-defaultActivityDays)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"from", &from},
+		{"to", &to},
+	} {
+		if s := r.FormValue(p.name); s != "" {
+			t, err := parseRangeTime(s, now, now.Location())
+			if err != nil {
+				return from, to, 0, errHTTP{
+					internal: err,
+					external: fmt.Sprintf("bad %s %q, %s", p.name, s, rangeTimeHelp),
+					code:     http.StatusBadRequest,
+				}
+			}
+			y, m, d := t.In(now.Location()).Date()
+			*p.t = time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+		}
+	}
+	if to.Before(from) {
+		return from, to, 0, errHTTP{
+			external: "from must not be after to",
+			code:     http.StatusBadRequest,
+		}
+	}
+	limit = defaultActivityDomains
+	if s := r.FormValue("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxActivityDomains {
+			return from, to, 0, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("limit must be 1-%d", maxActivityDomains),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	return from, to, limit, nil
+}
+
+func getSource(id sourceID) (source, error) {
+	s := source{SourceID: id}
+	var c sql.NullString
+	if err := db.QueryRow(`SELECT source, comment FROM sources WHERE source_id=?`, string(id)).Scan(&s.Source, &c); err == sql.ErrNoRows {
+		return s, errHTTP{
+			external: "source not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return s, err
+	}
+	s.Comment = c.String
+	return s, nil
+}
+
+// getActivity builds the activity report of src from from to to,
+// inclusive, with the top limit domains.
+func getActivity(src source, from, to time.Time, limit int) (*activityReport, error) {
+	start, end := from.Unix(), to.AddDate(0, 0, 1).Unix()
+	rows, err := db.Query(`
+SELECT client, host, SUM(requests), SUM(denied), SUM(bytes)
+FROM (
+  SELECT client, host, requests, denied, bytes FROM trafficstats WHERE hour >= ? AND hour < ?
+  UNION ALL
+  SELECT client, host, 1, denied, bytes FROM trafficlog WHERE time >= ? AND time < ?
+)
+GROUP BY client, host`, start, end, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rep := &activityReport{
+		Source: src,
+		From:   from.Format(quotaDay),
+		To:     to.Format(quotaDay),
+		Limit:  limit,
+	}
+	clients := make(map[string]bool)
+	domains := make(map[string]*activityDomain)
+	for rows.Next() {
+		var client, host string
+		var requests, denied, bytes int64
+		if err := rows.Scan(&client, &host, &requests, &denied, &bytes); err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(client); ip == nil || !sourceContains(src.Source, ip) {
+			continue
+		}
+		clients[client] = true
+		d := squidlog.HostToDomain(host)
+		a, found := domains[d]
+		if !found {
+			a = &activityDomain{Domain: d}
+			domains[d] = a
+		}
+		a.Requests += requests
+		a.Denied += denied
+		a.Bytes += bytes
+		rep.Requests += requests
+		rep.Denied += denied
+		rep.Bytes += bytes
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for c := range clients {
+		rep.Clients = append(rep.Clients, c)
+	}
+	sort.Strings(rep.Clients)
+	for _, a := range domains {
+		rep.Domains = append(rep.Domains, *a)
+	}
+	sort.Sort(activityByRequests(rep.Domains))
+	if len(rep.Domains) > limit {
+		rep.More = len(rep.Domains) - limit
+		rep.Domains = rep.Domains[:limit]
+	}
+	return rep, nil
+}
+
+// activityByRequests sorts domains by requests, most first.
+type activityByRequests []activityDomain
+
+func (a activityByRequests) Len() int      { return len(a) }
+func (a activityByRequests) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a activityByRequests) Less(i, j int) bool {
+	if a[i].Requests != a[j].Requests {
+		return a[i].Requests > a[j].Requests
+	}
+	return a[i].Domain < a[j].Domain
+}
+
+func loadActivity(r *http.Request) (*activityReport, error) {
+	src, err := getSource(assertSourceID(mux.Vars(r)["sourceID"]))
+	if err != nil {
+		return nil, err
+	}
+	from, to, limit, err := parseActivityParams(r, time.Now().In(requestZone(r)))
+	if err != nil {
+		return nil, err
+	}
+	return getActivity(src, from, to, limit)
+}
+
+func activityHandler(r *http.Request) (template.HTML, error) {
+	rep, err := loadActivity(r)
+	if err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("activity.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, rep); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// activityExportHandler downloads the report as PDF, or as domain records
+// for the stream formats.
+func activityExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("format") != "pdf" {
+		streamWrap(activityRecordsHandler)(w, r)
+		return
+	}
+	rep, err := loadActivity(r)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := activityPDF(rep).WriteTo(&buf); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("activity-%s-%s-%s.pdf", rep.Source.SourceID, rep.From, rep.To)))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Failed to write activity report: %v", err)
+	}
+}
+
+func activityRecordsHandler(r *http.Request, s *recordStream) error {
+	rep, err := loadActivity(r)
+	if err != nil {
+		return err
+	}
+	for n := range rep.Domains {
+		if err := s.Write(&rep.Domains[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func activityPDF(rep *activityReport) *pdf.Document {
+	d := pdf.New(fmt.Sprintf("Activity of %s", rep.Source.Source))
+	d.Heading(fmt.Sprintf("Activity of %s", rep.Source.Source))
+	if rep.Source.Comment != "" {
+		d.Line(rep.Source.Comment)
+	}
+	d.Linef("%s to %s", rep.From, rep.To)
+	d.Line("")
+	d.Linef("Requests: %d", rep.Requests)
+	d.Linef("Denied:   %d", rep.Denied)
+	d.Linef("Bytes:    %d", rep.Bytes)
+	d.Linef("Clients:  %d", len(rep.Clients))
+	d.Heading("Top domains")
+	d.Linef("%-50s %10s %10s %14s", "Domain", "Requests", "Denied", "Bytes")
+	for _, a := range rep.Domains {
+		d.Linef("%-50s %10d %10d %14d", a.Domain, a.Requests, a.Denied, a.Bytes)
+	}
+	if rep.More > 0 {
+		d.Linef("... and %d more", rep.More)
+	}
+	return d
+}
@@ -0,0 +1,366 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Alerts notify admins when the squid log shows something they asked to
+// hear about: a client with many denials in a short time, or hits on an ACL.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	alertClientDenials = "client-denials"
+	alertACLHits       = "acl-hits"
+
+	// How often alert rules and the policy are reloaded.
+	alertReloadInterval = 10 * time.Second
+)
+
+type alertID string
+
+func assertAlertID(s string) alertID { return alertID(assertUUID(s)) }
+
+type alertRule struct {
+	AlertID   alertID
+	Kind      string
+	ACL       acl
+	Threshold int64
+	Window    time.Duration
+	Comment   string
+}
+
+// Minutes is the window for the UI.
+func (a *alertRule) Minutes() int64 { return int64(a.Window / time.Minute) }
+
+func getAlertRules() ([]alertRule, error) {
+	rows, err := db.Query(`
+SELECT alertrules.alert_id, alertrules.kind, alertrules.acl_id, acls.comment, alertrules.threshold, alertrules.window_seconds, alertrules.comment
+FROM alertrules
+LEFT JOIN acls ON alertrules.acl_id=acls.acl_id
+ORDER BY alertrules.kind, acls.comment, alertrules.threshold`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []alertRule
+	for rows.Next() {
+		var a alertRule
+		var id string
+		var aid, ac sql.NullString
+		var window int64
+		if err := rows.Scan(&id, &a.Kind, &aid, &ac, &a.Threshold, &window, &a.Comment); err != nil {
+			return nil, err
+		}
+		a.AlertID = alertID(id)
+		a.ACL = acl{ACLID: aclID(aid.String), Comment: ac.String}
+		a.Window = time.Duration(window) * time.Second
+		ret = append(ret, a)
+	}
+	return ret, rows.Err()
+}
+
+type alertKey struct {
+	alert  alertID
+	client string // Empty for alerts that aren't per client.
+}
+
+// alerter counts matching log entries per alert rule in a sliding window.
+type alerter struct {
+	mu     sync.Mutex
+	rules  []alertRule
+	policy *policy.Policy // Only loaded if needed by a rule.
+	hits   map[alertKey][]time.Time
+	fired  map[alertKey]time.Time
+	send   func(subject, text string)
+}
+
+func newAlerter(send func(subject, text string)) *alerter {
+	return &alerter{
+		hits:  make(map[alertKey][]time.Time),
+		fired: make(map[alertKey]time.Time),
+		send:  send,
+	}
+}
+
+// setRules replaces the rules, forgetting counts of rules that are gone.
+func (a *alerter) setRules(rules []alertRule, p *policy.Policy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+	a.policy = p
+	keep := make(map[alertID]bool)
+	for _, r := range rules {
+		keep[r.AlertID] = true
+	}
+	for k := range a.hits {
+		if !keep[k.alert] {
+			delete(a.hits, k)
+			delete(a.fired, k)
+		}
+	}
+}
+
+func (a *alerter) needPolicy() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range a.rules {
+		if r.Kind == alertACLHits {
+			return true
+		}
+	}
+	return false
+}
+
+// check counts e against all rules, and sends alerts for those that went
+// over their threshold. Each alert fires at most once per window.
+func (a *alerter) check(e *squidlog.Entry, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var decision *policy.Decision
+	for _, r := range a.rules {
+		var k alertKey
+		switch r.Kind {
+		case alertClientDenials:
+			if !strings.Contains(e.Status, "DENIED") {
+				continue
+			}
+			k = alertKey{alert: r.AlertID, client: e.Client}
+		case alertACLHits:
+			if a.policy == nil {
+				continue
+			}
+			if decision == nil {
+				d, err := a.policy.Decide(logRequest(e.Client, e.Method, e.URL))
+				if err != nil {
+					log.Printf("Alerts: deciding %q: %v", e.URL, err)
+				}
+				decision = &d
+			}
+			if decision.ACL != string(r.ACL.ACLID) {
+				continue
+			}
+			k = alertKey{alert: r.AlertID}
+		default:
+			continue
+		}
+
+		cutoff := now.Add(-r.Window)
+		h := append(a.hits[k], now)
+		for len(h) > 0 && !h[0].After(cutoff) {
+			h = h[1:]
+		}
+		a.hits[k] = h
+		if int64(len(h)) <= r.Threshold {
+			continue
+		}
+		if f, found := a.fired[k]; found && f.After(cutoff) {
+			continue
+		}
+		a.fired[k] = now
+		subject, text := alertMessage(&r, e, len(h))
+		a.send(subject, text)
+	}
+}
+
+// expire forgets counts and firings that are older than their window.
+func (a *alerter) expire(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	windows := make(map[alertID]time.Duration)
+	for _, r := range a.rules {
+		windows[r.AlertID] = r.Window
+	}
+	for k, h := range a.hits {
+		if len(h) == 0 || !h[len(h)-1].After(now.Add(-windows[k.alert])) {
+			delete(a.hits, k)
+		}
+	}
+	for k, f := range a.fired {
+		if !f.After(now.Add(-windows[k.alert])) {
+			delete(a.fired, k)
+		}
+	}
+}
+
+func alertMessage(r *alertRule, e *squidlog.Entry, n int) (string, string) {
+	var subject, text string
+	switch r.Kind {
+	case alertClientDenials:
+		subject = fmt.Sprintf("squidwarden alert: %d denials from %s", n, e.Client)
+		text = fmt.Sprintf("%s had %d denied requests in the last %v, more than %d.\nLatest: %s %s\n", e.Client, n, r.Window, r.Threshold, e.Method, e.URL)
+	case alertACLHits:
+		subject = fmt.Sprintf("squidwarden alert: %d hits on ACL %s", n, r.ACL.Comment)
+		text = fmt.Sprintf("ACL %q had %d hits in the last %v, more than %d.\nLatest: %s %s %s\n", r.ACL.Comment, n, r.Window, r.Threshold, e.Client, e.Method, e.URL)
+	}
+	if r.Comment != "" {
+		text = r.Comment + "\n\n" + text
+	}
+	return subject, text
+}
+
+// reload loads the rules, and the policy if any rule needs it.
+func (a *alerter) reload() error {
+	rules, err := getAlertRules()
+	if err != nil {
+		return err
+	}
+	var p *policy.Policy
+	for _, r := range rules {
+		if r.Kind == alertACLHits {
+			if p, err = currentPolicy(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	a.setRules(rules, p)
+	return nil
+}
+
+func startAlerts() {
+	if !ingestConfigured() {
+		return
+	}
+	a := newAlerter(func(subject, text string) {
+		log.Printf("Alert: %s", subject)
+		go notifyLog(subject, text)
+	})
+	go func() {
+		for {
+			if err := a.reload(); err != nil {
+				log.Printf("Alerts: failed to reload: %v", err)
+			}
+			a.expire(time.Now())
+			time.Sleep(alertReloadInterval)
+		}
+	}()
+	go newLogIngester("", func(e *squidlog.Entry) {
+		a.check(e, time.Now())
+	}).run()
+}
+
+func alertsHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Configured bool
+		Alerts     []alertRule
+		ACLs       []acl
+		Kinds      []string
+	}{
+		Configured: ingestConfigured() && (serverOpts.NotifyWebhook != "" || serverOpts.NotifyEmail != ""),
+		Kinds:      []string{alertClientDenials, alertACLHits},
+	}
+	var err error
+	if data.Alerts, err = getAlertRules(); err != nil {
+		return "", err
+	}
+	if data.ACLs, err = getACLs(); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("alerts.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func alertNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Kind      string `form:"kind,required"`
+		ACL       string `form:"acl,uuid"`
+		Threshold int64  `form:"threshold,required"`
+		Minutes   int64  `form:"minutes,required"`
+		Comment   string `form:"comment"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	kind, threshold, minutes := data.Kind, data.Threshold, data.Minutes
+	var acl sql.NullString
+	switch kind {
+	case alertClientDenials:
+	case alertACLHits:
+		if data.ACL == "" {
+			return nil, errHTTP{
+				external: fmt.Sprintf("%s alerts need an acl", kind),
+				code:     http.StatusBadRequest,
+			}
+		}
+		acl = sql.NullString{String: data.ACL, Valid: true}
+	default:
+		return nil, errHTTP{
+			external: fmt.Sprintf("invalid alert kind %q", kind),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if threshold < 0 {
+		return nil, errHTTP{
+			external: fmt.Sprintf("invalid threshold %d", threshold),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if minutes < 1 {
+		return nil, errHTTP{
+			external: fmt.Sprintf("invalid window %d, want minutes", minutes),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if acl.Valid {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM acls WHERE acl_id=?`, acl.String).Scan(&n); err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, errHTTP{
+				external: "ACL not found",
+				code:     http.StatusNotFound,
+			}
+		}
+	}
+
+	id := uuid.NewV4().String()
+	resp := struct {
+		Alert string `json:"alert"`
+	}{Alert: id}
+	log.Printf("Creating alert %s: %s over %d in %d minutes", id, kind, threshold, minutes)
+	_, err := db.Exec(`INSERT INTO alertrules(alert_id, kind, acl_id, threshold, window_seconds, comment) VALUES(?,?,?,?,?,?)`, id, kind, acl, threshold, minutes*60, data.Comment)
+	return &resp, err
+}
+
+func alertDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertAlertID(mux.Vars(r)["alertID"])
+	log.Printf("Deleting alert %s", id)
+	resp := struct {
+		Alert   string `json:"alert"`
+		Deleted int64  `json:"deleted"`
+	}{Alert: string(id)}
+	var err error
+	resp.Deleted, err = rowsAffected(db.Exec(`DELETE FROM alertrules WHERE alert_id=?`, string(id)))
+	return &resp, err
+}
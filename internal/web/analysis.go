@@ -0,0 +1,346 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Policy analysis. The helper checks every source containing the client,
+// in sort order of the source, and within a source the rules of all the
+// group's ACLs in no particular order. The first matching rule wins. So:
+//
+//   If a source is inside a source of another group, clients there get
+//   both groups' rules, and which wins isn't obvious.
+//
+//   If one rule matches everything another does, the other is either
+//   redundant (same action) or may never apply (different action).
+//
+//   If the same value has different actions in ACLs of a group, only one
+//   of them applies.
+//
+// Only domain, https-domain and exact rules are compared for covering.
+// Regexes can't be, though identical ones are checked for conflicts.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+const (
+	findingSourceOverlap = "source-overlap"
+	findingValueConflict = "value-conflict"
+	findingConflict      = "conflicting-rule"
+	findingRedundant     = "redundant-rule"
+
+	maxFindings = 500
+)
+
+type finding struct {
+	Kind    string        `json:"kind"`
+	Message string        `json:"message"`
+	Links   []errHTTPLink `json:"links"`
+}
+
+type analysisSource struct {
+	SourceID sourceID
+	Source   string
+	Group    group
+}
+
+type analysisRule struct {
+	RuleID ruleID
+	Type   string
+	Value  string
+	Action string
+	ACL    acl
+}
+
+// findSourceOverlaps reports sources inside sources of other groups.
+func findSourceOverlaps(srcs []analysisSource) []finding {
+	type parsed struct {
+		analysisSource
+		net *net.IPNet
+	}
+	var ps []parsed
+	for _, s := range srcs {
+		n, err := policy.SourceNet(s.Source)
+		if err != nil {
+			continue
+		}
+		ps = append(ps, parsed{s, n})
+	}
+	var ret []finding
+	for _, in := range ps {
+		for _, out := range ps {
+			if in.Group.GroupID == out.Group.GroupID || !policy.NetContains(out.net, in.net) {
+				continue
+			}
+			// Report identical sources once.
+			if policy.NetContains(in.net, out.net) && in.Group.GroupID > out.Group.GroupID {
+				continue
+			}
+			ret = append(ret, finding{
+				Kind:    findingSourceOverlap,
+				Message: fmt.Sprintf("Source %s of group %q is inside source %s of group %q. Clients there get the rules of both groups.", in.Source, in.Group.Comment, out.Source, out.Group.Comment),
+				Links: []errHTTPLink{
+					{Text: in.Group.Comment, Link: "/members/" + string(in.Group.GroupID)},
+					{Text: out.Group.Comment, Link: "/members/" + string(out.Group.GroupID)},
+				},
+			})
+		}
+	}
+	return ret
+}
+
+// ruleTarget returns the type, host and port a rule matches, with the
+// type of exact rules being that of the domain rules that cover them.
+func ruleTarget(r analysisRule) (typ, host, port string, ok bool) {
+	split := func(s, def string) (string, string) {
+		h, p, err := net.SplitHostPort(s)
+		if err != nil {
+			return s, def
+		}
+		return h, p
+	}
+	switch r.Type {
+	case typeDomain:
+		host, port = split(r.Value, "80")
+		return typeDomain, host, port, true
+	case typeHTTPSDomain:
+		host, port = split(r.Value, "443")
+		return typeHTTPSDomain, host, port, true
+	case typeExact:
+		if !strings.HasPrefix(r.Value, "http://") {
+			return "", "", "", false
+		}
+		hp := strings.SplitN(strings.TrimPrefix(r.Value, "http://"), "/", 2)[0]
+		host, port = split(hp, "80")
+		return typeDomain, host, port, true
+	}
+	return "", "", "", false
+}
+
+// ruleShadows returns true if outer matches everything inner does.
+func ruleShadows(outer, inner analysisRule) bool {
+	if outer.Type == typeExact {
+		return inner.Type == typeExact && outer.Value == inner.Value
+	}
+	ot, oh, op, ok := ruleTarget(outer)
+	if !ok {
+		return false
+	}
+	it, ih, ip, ok := ruleTarget(inner)
+	if !ok || ot != it || (op != "*" && op != ip) {
+		return false
+	}
+	if ih == oh {
+		return true
+	}
+	if !strings.HasPrefix(oh, ".") {
+		return false
+	}
+	return "."+ih == oh || strings.HasSuffix(ih, oh)
+}
+
+// findShadowedRules reports rules covered by other rules of the same group.
+func findShadowedRules(g group, rules []analysisRule) []finding {
+	// Index by what they match, so that each rule only needs to be
+	// compared to rules for its host and parent domains.
+	type key struct{ typ, host string }
+	idx := make(map[key][]analysisRule)
+	for _, r := range rules {
+		if t, h, _, ok := ruleTarget(r); ok && r.Type != typeExact {
+			idx[key{t, h}] = append(idx[key{t, h}], r)
+		}
+	}
+	var ret []finding
+	seen := make(map[[2]ruleID]bool)
+	for _, in := range rules {
+		t, h, _, ok := ruleTarget(in)
+		if !ok {
+			continue
+		}
+		cands := idx[key{t, h}]
+		for p := strings.TrimPrefix(h, "."); ; {
+			cands = append(cands, idx[key{t, "." + p}]...)
+			n := strings.Index(p, ".")
+			if n < 0 {
+				break
+			}
+			p = p[n+1:]
+		}
+		for _, out := range cands {
+			if out.RuleID == in.RuleID || !ruleShadows(out, in) {
+				continue
+			}
+			// Same value with another action is a value conflict.
+			if out.Type == in.Type && out.Value == in.Value {
+				continue
+			}
+			// Rules covering each other are the same; report once.
+			if ruleShadows(in, out) && in.RuleID < out.RuleID {
+				continue
+			}
+			k := [2]ruleID{out.RuleID, in.RuleID}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			f := finding{
+				Links: []errHTTPLink{
+					{Text: "covered rule", Link: "/rule/" + string(in.RuleID)},
+					{Text: "covering rule", Link: "/rule/" + string(out.RuleID)},
+				},
+			}
+			desc := fmt.Sprintf("%s rule %q (%s, ACL %q) is covered by %s rule %q (%s, ACL %q)", in.Type, in.Value, in.Action, in.ACL.Comment, out.Type, out.Value, out.Action, out.ACL.Comment)
+			if in.Action == out.Action {
+				f.Kind = findingRedundant
+				f.Message = fmt.Sprintf("Group %q: %s, so it's not needed.", g.Comment, desc)
+			} else {
+				f.Kind = findingConflict
+				f.Message = fmt.Sprintf("Group %q: %s, so it may never apply.", g.Comment, desc)
+			}
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// Most important first.
+var findingOrder = map[string]int{
+	findingSourceOverlap: 0,
+	findingValueConflict: 1,
+	findingConflict:      2,
+	findingRedundant:     3,
+}
+
+type findingsByKind []finding
+
+func (a findingsByKind) Len() int      { return len(a) }
+func (a findingsByKind) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a findingsByKind) Less(i, j int) bool {
+	if a[i].Kind != a[j].Kind {
+		return findingOrder[a[i].Kind] < findingOrder[a[j].Kind]
+	}
+	return a[i].Message < a[j].Message
+}
+
+type policyAnalysis struct {
+	Findings  []finding `json:"findings"`
+	Truncated bool      `json:"truncated"`
+}
+
+// getGrantedRules returns the enabled rules granted to each group.
+func getGrantedRules() (map[groupID]group, map[groupID][]analysisRule, error) {
+	groups := make(map[groupID]group)
+	rules := make(map[groupID][]analysisRule)
+	rows, err := db.Query(`
+SELECT groups.group_id, groups.comment, acls.acl_id, acls.comment, rules.rule_id, rules.type, rules.value, rules.action
+FROM groupaccess
+JOIN groups ON groupaccess.group_id=groups.group_id
+JOIN acls ON groupaccess.acl_id=acls.acl_id
+JOIN aclrules ON acls.acl_id=aclrules.acl_id
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE acls.enabled AND rules.enabled`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g group
+		var r analysisRule
+		var gc, ac sql.NullString
+		if err := rows.Scan(&g.GroupID, &gc, &r.ACL.ACLID, &ac, &r.RuleID, &r.Type, &r.Value, &r.Action); err != nil {
+			return nil, nil, err
+		}
+		g.Comment = gc.String
+		r.ACL.Comment = ac.String
+		groups[g.GroupID] = g
+		rules[g.GroupID] = append(rules[g.GroupID], r)
+	}
+	return groups, rules, rows.Err()
+}
+
+func analyzePolicy() (*policyAnalysis, error) {
+	var srcs []analysisSource
+	{
+		rows, err := db.Query(`
+SELECT sources.source_id, sources.source, groups.group_id, groups.comment
+FROM sources
+JOIN members ON sources.source_id=members.source_id
+JOIN groups ON members.group_id=groups.group_id`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s analysisSource
+			var gc sql.NullString
+			if err := rows.Scan(&s.SourceID, &s.Source, &s.Group.GroupID, &gc); err != nil {
+				return nil, err
+			}
+			s.Group.Comment = gc.String
+			srcs = append(srcs, s)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	groups, rules, err := getGrantedRules()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &policyAnalysis{Findings: findSourceOverlaps(srcs)}
+	for id, rs := range rules {
+		for _, c := range findValueConflicts(groups[id], rs) {
+			ret.Findings = append(ret.Findings, c.finding())
+		}
+		ret.Findings = append(ret.Findings, findShadowedRules(groups[id], rs)...)
+	}
+	sort.Sort(findingsByKind(ret.Findings))
+	if len(ret.Findings) > maxFindings {
+		ret.Findings = ret.Findings[:maxFindings]
+		ret.Truncated = true
+	}
+	if ret.Findings == nil {
+		ret.Findings = []finding{}
+	}
+	return ret, nil
+}
+
+func analysisHandler(r *http.Request) (template.HTML, error) {
+	a, err := analyzePolicy()
+	if err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("analysis.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, a); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func analysisJSONHandler(r *http.Request) (interface{}, error) {
+	return analyzePolicy()
+}
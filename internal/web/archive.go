@@ -0,0 +1,150 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Archived ACLs are retired: disabled, left out of menus and the matrix, and
+// read-only, but kept with their rules so that they can still be looked at.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type archivedACL struct {
+	ACLID    aclID
+	Comment  string
+	Archived string
+	Actor    string
+}
+
+// checkNotArchived fails if any of the ACLs is archived.
+func checkNotArchived(tx *sql.Tx, ids ...aclID) error {
+	for _, id := range ids {
+		var c sql.NullString
+		if err := tx.QueryRow(`
+SELECT acls.comment
+FROM aclarchive
+JOIN acls ON aclarchive.acl_id=acls.acl_id
+WHERE aclarchive.acl_id=?`, string(id)).Scan(&c); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		return errHTTP{
+			external: fmt.Sprintf("ACL %q is archived, and read-only until unarchived", c.String),
+			links:    []errHTTPLink{{Text: "archived ACL", Link: "/acl/" + string(id)}},
+			code:     http.StatusConflict,
+		}
+	}
+	return nil
+}
+
+// checkRulesNotArchived fails if any of the rules is in an archived ACL.
+func checkRulesNotArchived(tx *sql.Tx, rules ...string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(rules))
+	for n, r := range rules {
+		args[n] = r
+	}
+	var id string
+	if err := tx.QueryRow(`
+SELECT aclrules.acl_id
+FROM aclrules
+JOIN aclarchive ON aclrules.acl_id=aclarchive.acl_id
+WHERE aclrules.rule_id IN (?`+strings.Repeat(",?", len(rules)-1)+`)
+LIMIT 1`, args...).Scan(&id); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return checkNotArchived(tx, aclID(id))
+}
+
+func isArchived(id aclID) (bool, error) {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM aclarchive WHERE acl_id=?`, string(id)).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func getArchivedACLs(loc *time.Location) ([]archivedACL, error) {
+	rows, err := db.Query(`
+SELECT acls.acl_id, acls.comment, aclarchive.archived, aclarchive.actor
+FROM aclarchive
+JOIN acls ON aclarchive.acl_id=acls.acl_id
+ORDER BY acls.comment`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []archivedACL
+	for rows.Next() {
+		var a archivedACL
+		var c sql.NullString
+		var t int64
+		if err := rows.Scan(&a.ACLID, &c, &t, &a.Actor); err != nil {
+			return nil, err
+		}
+		a.Comment = c.String
+		a.Archived = formatUnix(t, loc)
+		ret = append(ret, a)
+	}
+	return ret, rows.Err()
+}
+
+// aclArchiveHandler archives the ACL if archived=true, which also disables
+// it, or unarchives it. Unarchived ACLs stay disabled until enabled.
+func aclArchiveHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	var data struct {
+		Archived bool `form:"archived"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	archived := data.Archived
+	log.Printf("Setting ACL %s archived=%t", id, archived)
+	resp := struct {
+		ACL      string `json:"acl"`
+		Archived bool   `json:"archived"`
+		Updated  int64  `json:"updated"`
+	}{ACL: string(id), Archived: archived}
+	if err := txWrap(func(tx *sql.Tx) error {
+		var err error
+		if !archived {
+			resp.Updated, err = rowsAffected(tx.Exec(`DELETE FROM aclarchive WHERE acl_id=?`, string(id)))
+			return err
+		}
+		if resp.Updated, err = rowsAffected(tx.Exec(`INSERT OR IGNORE INTO aclarchive(acl_id, archived, actor) VALUES(?,?,?)`, string(id), time.Now().Unix(), remoteUser(r))); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE acls SET enabled=0 WHERE acl_id=?`, string(id))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	aclScheduler.forget(id)
+	return &resp, nil
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Authorization. Squidwarden doesn't authenticate users itself, but trusts
+// the web server in front of it to do so:
+//
+//   With -fcgi, the REMOTE_USER FastCGI parameter.
+//   Otherwise, the -auth_header header, if the request comes from localhost.
+//
+// Every route declares the permission it needs, and authWrap enforces it.
+// Users can also be given permissions in the users table, e.g. the admin
+// created by the setup wizard. With none of -readers, -writers and -admins
+// set and no users in the table, authorization is off, and everyone can do
+// everything.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strings"
+	"sync"
+)
+
+type permission int
+
+const (
+	permPublic permission = iota // End user pages, like the exception form.
+	permRead                     // Viewing policy and logs.
+	permWrite                    // Changing policy.
+	permAdmin                    // Changing squid and squidwarden itself.
+)
+
+var (
+	// dbUsers caches the users table.
+	dbUsers = struct {
+		sync.RWMutex
+		m map[string]permission
+	}{m: make(map[string]permission)}
+)
+
+func (p permission) String() string {
+	switch p {
+	case permPublic:
+		return "public"
+	case permRead:
+		return "read"
+	case permWrite:
+		return "write"
+	case permAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("permission(%d)", int(p))
+}
+
+func parsePermission(s string) (permission, error) {
+	for _, p := range []permission{permRead, permWrite, permAdmin} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return permPublic, fmt.Errorf("unknown permission %q", s)
+}
+
+// loadUsers reads the users table into dbUsers. It's called at startup and
+// whenever the table changes.
+func loadUsers() error {
+	rows, err := db.Query(`SELECT user, permission FROM users`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m := make(map[string]permission)
+	for rows.Next() {
+		var u, p string
+		if err := rows.Scan(&u, &p); err != nil {
+			return err
+		}
+		perm, err := parsePermission(p)
+		if err != nil {
+			return fmt.Errorf("user %q: %v", u, err)
+		}
+		m[u] = perm
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	dbUsers.Lock()
+	defer dbUsers.Unlock()
+	dbUsers.m = m
+	return nil
+}
+
+// addUser gives user perm, replacing any permission they had in the table.
+func addUser(tx *sql.Tx, user string, perm permission) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO users(user, permission) VALUES(?,?)`, user, perm.String())
+	return err
+}
+
+// remoteUser returns the user the web server or an API token
+// authenticated, or "".
+func remoteUser(r *http.Request) string {
+	if t := requestToken(r); t != nil {
+		return t.User()
+	}
+	if serverOpts.FastCGI {
+		return fcgi.ProcessEnv(r)["REMOTE_USER"]
+	}
+	h, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		h = r.RemoteAddr
+	}
+	if ip := net.ParseIP(h); ip == nil || !ip.IsLoopback() {
+		return ""
+	}
+	return r.Header.Get(serverOpts.AuthHeader)
+}
+
+func authEnabled() bool {
+	if serverOpts.Readers != "" || serverOpts.Writers != "" || serverOpts.Admins != "" {
+		return true
+	}
+	dbUsers.RLock()
+	defer dbUsers.RUnlock()
+	return len(dbUsers.m) > 0
+}
+
+func userListed(list, user string) bool {
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u == "*" || (u != "" && u == user) {
+			return true
+		}
+	}
+	return false
+}
+
+// userPermission returns the highest permission of a user.
+func userPermission(user string) permission {
+	if user == "" {
+		return permPublic
+	}
+	dbUsers.RLock()
+	perm := dbUsers.m[user]
+	dbUsers.RUnlock()
+	for _, l := range []struct {
+		list string
+		perm permission
+	}{
+		{serverOpts.Admins, permAdmin},
+		{serverOpts.Writers, permWrite},
+		{serverOpts.Readers, permRead},
+	} {
+		if userListed(l.list, user) && l.perm > perm {
+			return l.perm
+		}
+	}
+	return perm
+}
+
+// requestPermission returns the highest permission of the user making r.
+// Tokens have the permission they were created with.
+func requestPermission(r *http.Request) permission {
+	if t := requestToken(r); t != nil {
+		return t.Permission
+	}
+	return userPermission(remoteUser(r))
+}
+
+// authWrap only lets through requests from users with at least perm, and
+// with tokens that are allowed to use route.
+func authWrap(perm permission, route string, h http.HandlerFunc) http.HandlerFunc {
+	if perm == permPublic {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Tokens are held to their scopes and ACLs even when users
+		// aren't checked.
+		if t := requestToken(r); t != nil {
+			if msg := t.denies(r, route, perm); msg != "" {
+				log.Printf("Denied %q %s %s: %s", t.User(), r.Method, r.URL.Path, msg)
+				httpError(w, r, errHTTP{
+					external: "Forbidden - " + msg,
+					code:     http.StatusForbidden,
+				})
+				return
+			}
+		}
+		if !authEnabled() {
+			h(w, r)
+			return
+		}
+		user := remoteUser(r)
+		if user == "" {
+			httpError(w, r, errHTTP{
+				external: "Unauthorized - not logged in",
+				code:     http.StatusUnauthorized,
+			})
+			return
+		}
+		if got := requestPermission(r); got < perm {
+			log.Printf("Denied %q %s %s: has %s, needs %s", user, r.Method, r.URL.Path, got, perm)
+			httpError(w, r, errHTTP{
+				external: fmt.Sprintf("Forbidden - needs %s permission", perm),
+				code:     http.StatusForbidden,
+				details:  map[string]string{"needs": perm.String()},
+			})
+			return
+		}
+		h(w, r)
+	}
+}
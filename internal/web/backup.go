@@ -0,0 +1,126 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Nightly backups write the config export (the same as /config/export) to
+// a file, keeping the last few.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix = "squidwarden-config-"
+	backupSuffix = ".json"
+)
+
+// fileResponse lets a recordStream write to a file.
+type fileResponse struct {
+	*bufio.Writer
+	header http.Header
+}
+
+func (f *fileResponse) Header() http.Header { return f.header }
+func (f *fileResponse) WriteHeader(int)     {}
+
+// backupConfig writes a backup to -backup_dir, and removes old ones.
+func backupConfig(j *jobRun) error {
+	if serverOpts.BackupDir == "" {
+		return fmt.Errorf("-backup_dir not configured")
+	}
+	f, err := ioutil.TempFile(serverOpts.BackupDir, ".squidwarden")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := &fileResponse{Writer: bufio.NewWriter(f), header: make(http.Header)}
+	s := &recordStream{w: w, format: formatJSON, enc: json.NewEncoder(w), csv: csv.NewWriter(w)}
+	for _, t := range exportTables {
+		if err := exportTable(s, t); err != nil {
+			f.Close()
+			return fmt.Errorf("exporting %s: %v", t, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fn := filepath.Join(serverOpts.BackupDir, backupPrefix+time.Now().UTC().Format("20060102-150405")+backupSuffix)
+	if err := os.Rename(f.Name(), fn); err != nil {
+		return err
+	}
+	j.logf("Wrote %d records to %s", s.n, fn)
+	return removeOldBackups(j, serverOpts.BackupDir, serverOpts.BackupKeep)
+}
+
+// removeOldBackups removes all but the newest keep backups in dir.
+func removeOldBackups(j *jobRun, dir string, keep int) error {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, f := range fs {
+		if strings.HasPrefix(f.Name(), backupPrefix) && strings.HasSuffix(f.Name(), backupSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+	// The names sort by time.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for n := keep; n < len(names); n++ {
+		fn := filepath.Join(dir, names[n])
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
+		j.logf("Removed old backup %s", fn)
+	}
+	return nil
+}
+
+// backupScheduler queues a backup every night.
+func backupScheduler() {
+	if serverOpts.BackupDir == "" {
+		return
+	}
+	for {
+		next, err := nextSyncTime(time.Now().In(scheduleZone()), serverOpts.BackupTime)
+		if err != nil {
+			log.Fatalf("Invalid -backup_time %q: %v", serverOpts.BackupTime, err)
+		}
+		time.Sleep(next.Sub(time.Now()))
+		if _, err := enqueueJob(jobConfigBackup, ""); err != nil {
+			log.Printf("Failed to queue backup: %v", err)
+		}
+	}
+}
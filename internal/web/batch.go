@@ -0,0 +1,316 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The batch API runs a list of operations in one transaction, so that a
+// composite change is either all done or not at all.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/squidwarden/internal/policy"
+	uuid "github.com/satori/go.uuid"
+)
+
+const maxBatchOps = 1000
+
+// batchOp is one operation. Which fields are used depends on Op. ID
+// fields can be "$N" to use the ID created by operation N, counting from
+// 0.
+type batchOp struct {
+	Op      string `json:"op"`
+	ACL     string `json:"acl"`
+	Group   string `json:"group"`
+	Rule    string `json:"rule"`
+	Source  string `json:"source"`
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Action  string `json:"action"`
+	Comment string `json:"comment"`
+}
+
+type batchResult struct {
+	Op      string `json:"op"`
+	ID      string `json:"id,omitempty"`      // Of what was created.
+	Updated int64  `json:"updated,omitempty"` // Rows changed.
+}
+
+// batchOps are the operations, and what they do in tx.
+var batchOps = map[string]func(tx *sql.Tx, op *batchOp, res *batchResult) error{
+	"acl.create":    batchACLCreate,
+	"group.create":  batchGroupCreate,
+	"rule.create":   batchRuleCreate,
+	"rule.delete":   batchRuleDelete,
+	"rule.bind":     batchRuleBind,
+	"rule.unbind":   batchRuleUnbind,
+	"access.grant":  batchAccessGrant,
+	"access.revoke": batchAccessRevoke,
+	"member.add":    batchMemberAdd,
+	"member.remove": batchMemberRemove,
+}
+
+func batchInvalid(format string, a ...interface{}) error {
+	return errHTTP{external: fmt.Sprintf(format, a...), code: http.StatusBadRequest}
+}
+
+// batchExists fails if there's no row with id in table.
+func batchExists(tx *sql.Tx, table, col, what, id string) error {
+	if !reUUID.MatchString(id) {
+		return batchInvalid("bad %s ID %q", what, id)
+	}
+	var n int
+	if err := tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s=?`, table, col), id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errHTTP{external: fmt.Sprintf("%s %s not found", what, id), code: http.StatusNotFound}
+	}
+	return nil
+}
+
+func batchACL(tx *sql.Tx, id string) error {
+	if err := batchExists(tx, "acls", "acl_id", "ACL", id); err != nil {
+		return err
+	}
+	return checkNotArchived(tx, aclID(id))
+}
+
+func batchACLCreate(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if op.Comment == "" {
+		return batchInvalid("won't create empty ACL name")
+	}
+	res.ID = uuid.NewV4().String()
+	_, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, res.ID, op.Comment)
+	return err
+}
+
+func batchGroupCreate(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if op.Comment == "" {
+		return batchInvalid("won't create with empty group name")
+	}
+	res.ID = uuid.NewV4().String()
+	_, err := tx.Exec(`INSERT INTO groups(group_id, comment) VALUES(?,?)`, res.ID, op.Comment)
+	return err
+}
+
+func batchRuleCreate(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if op.ACL == "" {
+		op.ACL = string(newACLID)
+	}
+	if err := batchACL(tx, op.ACL); err != nil {
+		return err
+	}
+	switch op.Type {
+	case typeDomain, typeHTTPSDomain, typeRegex, typeHTTPSRegex, typeExact:
+	default:
+		return batchInvalid("bad type %q", op.Type)
+	}
+	switch op.Action {
+	case actionAllow, actionBlock, actionIgnore:
+	default:
+		return batchInvalid("bad action %q", op.Action)
+	}
+	if err := policy.Validate(op.Type, op.Value); err != nil {
+		return batchInvalid("%v", err)
+	}
+	var err error
+	if res.ID, err = insertRule(tx, aclID(op.ACL), op.Type, op.Value, op.Action); err != nil {
+		return err
+	}
+	if op.Comment != "" {
+		_, err = tx.Exec(`UPDATE rules SET comment=? WHERE rule_id=?`, op.Comment, res.ID)
+	}
+	return err
+}
+
+func batchRuleDelete(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if err := batchExists(tx, "rules", "rule_id", "rule", op.Rule); err != nil {
+		return err
+	}
+	if err := checkRulesNotArchived(tx, op.Rule); err != nil {
+		return err
+	}
+	for _, q := range []string{
+		`DELETE FROM ruleexpiry WHERE rule_id=?`,
+		`DELETE FROM aclrules WHERE rule_id=?`,
+	} {
+		if _, err := tx.Exec(q, op.Rule); err != nil {
+			return err
+		}
+	}
+	var err error
+	if res.Updated, err = rowsAffected(tx.Exec(`DELETE FROM rules WHERE rule_id=?`, op.Rule)); err != nil {
+		return err
+	}
+	return deleteOrphanOrigins(tx)
+}
+
+func batchRuleBind(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if err := batchExists(tx, "rules", "rule_id", "rule", op.Rule); err != nil {
+		return err
+	}
+	if err := batchACL(tx, op.ACL); err != nil {
+		return err
+	}
+	var err error
+	res.Updated, err = rowsAffected(tx.Exec(`INSERT OR IGNORE INTO aclrules(acl_id, rule_id) VALUES(?,?)`, op.ACL, op.Rule))
+	return err
+}
+
+func batchRuleUnbind(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if err := batchACL(tx, op.ACL); err != nil {
+		return err
+	}
+	var err error
+	res.Updated, err = rowsAffected(tx.Exec(`DELETE FROM aclrules WHERE acl_id=? AND rule_id=?`, op.ACL, op.Rule))
+	return err
+}
+
+func batchAccessGrant(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if err := batchExists(tx, "groups", "group_id", "group", op.Group); err != nil {
+		return err
+	}
+	if err := batchACL(tx, op.ACL); err != nil {
+		return err
+	}
+	var err error
+	res.Updated, err = rowsAffected(tx.Exec(`INSERT OR IGNORE INTO groupaccess(group_id, acl_id, comment) VALUES(?,?,?)`, op.Group, op.ACL, op.Comment))
+	return err
+}
+
+func batchAccessRevoke(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if err := batchACL(tx, op.ACL); err != nil {
+		return err
+	}
+	var err error
+	res.Updated, err = rowsAffected(tx.Exec(`DELETE FROM groupaccess WHERE group_id=? AND acl_id=?`, op.Group, op.ACL))
+	return err
+}
+
+func batchMemberAdd(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if err := batchExists(tx, "groups", "group_id", "group", op.Group); err != nil {
+		return err
+	}
+	if err := batchExists(tx, "sources", "source_id", "source", op.Source); err != nil {
+		return err
+	}
+	var err error
+	res.Updated, err = rowsAffected(tx.Exec(`INSERT OR IGNORE INTO members(group_id, source_id, comment) VALUES(?,?,?)`, op.Group, op.Source, op.Comment))
+	return err
+}
+
+func batchMemberRemove(tx *sql.Tx, op *batchOp, res *batchResult) error {
+	if _, err := tx.Exec(`DELETE FROM memberexpiry WHERE group_id=? AND source_id=?`, op.Group, op.Source); err != nil {
+		return err
+	}
+	var err error
+	res.Updated, err = rowsAffected(tx.Exec(`DELETE FROM members WHERE group_id=? AND source_id=?`, op.Group, op.Source))
+	return err
+}
+
+// resolve replaces "$N" references in op with the IDs of earlier results.
+func (op *batchOp) resolve(results []batchResult) error {
+	for _, f := range []*string{&op.ACL, &op.Group, &op.Rule, &op.Source} {
+		if !strings.HasPrefix(*f, "$") {
+			continue
+		}
+		n, err := strconv.Atoi((*f)[1:])
+		if err != nil || n < 0 || n >= len(results) {
+			return batchInvalid("bad reference %q, must be to an earlier operation", *f)
+		}
+		if results[n].ID == "" {
+			return batchInvalid("reference %q is to %s, which creates nothing", *f, results[n].Op)
+		}
+		*f = results[n].ID
+	}
+	return nil
+}
+
+// parseBatch parses the "ops" form value, a JSON list of batchOp.
+func parseBatch(s string) ([]batchOp, error) {
+	var ops []batchOp
+	if err := json.Unmarshal([]byte(s), &ops); err != nil {
+		return nil, batchInvalid("bad ops: %v", err)
+	}
+	if len(ops) == 0 {
+		return nil, batchInvalid("no ops given")
+	}
+	if len(ops) > maxBatchOps {
+		return nil, batchInvalid("too many ops, max %d at a time", maxBatchOps)
+	}
+	for n, op := range ops {
+		if batchOps[op.Op] == nil {
+			return nil, batchInvalid("op %d: unknown op %q", n, op.Op)
+		}
+	}
+	return ops, nil
+}
+
+// batchFailed says which operation failed and why, keeping the status
+// code and details of the error.
+func batchFailed(n int, op string, err error) error {
+	e, ok := err.(errHTTP)
+	if !ok {
+		return err
+	}
+	e.external = fmt.Sprintf("op %d (%s): %s", n, op, e.external)
+	e.details = map[string]interface{}{
+		"op":      n,
+		"details": e.details,
+	}
+	return e
+}
+
+func batchHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Ops string `form:"ops"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	ops, err := parseBatch(data.Ops)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Running batch of %d ops", len(ops))
+	resp := struct {
+		Results []batchResult `json:"results"`
+	}{}
+	if err := txWrap(func(tx *sql.Tx) error {
+		resp.Results = nil
+		for n := range ops {
+			op := &ops[n]
+			res := batchResult{Op: op.Op}
+			if err := op.resolve(resp.Results); err != nil {
+				return batchFailed(n, op.Op, err)
+			}
+			if err := batchOps[op.Op](tx, op, &res); err != nil {
+				return batchFailed(n, op.Op, err)
+			}
+			resp.Results = append(resp.Results, res)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+// maxBulkRules is the most values accepted by one bulk add.
+const maxBulkRules = 10000
+
+// Status of a value in a bulk add.
+const (
+	bulkCreated  = "created"  // Added.
+	bulkWarning  = "warning"  // Added, but Lint found likely mistakes.
+	bulkRejected = "rejected" // Not added, see Error.
+	bulkSkipped  = "skipped"  // Not added since the batch was aborted.
+)
+
+// bulkRuleResult is the outcome for one value of a bulk add.
+type bulkRuleResult struct {
+	Value    string           `json:"value"`
+	Status   string           `json:"status"`
+	Rule     string           `json:"rule,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Warnings []policy.Warning `json:"warnings,omitempty"`
+}
+
+// bulkResult is the reply of a bulk add.
+type bulkResult struct {
+	ACL      string            `json:"acl"`
+	Created  int               `json:"created"`
+	Warned   int               `json:"warned"`
+	Rejected int               `json:"rejected"`
+	Aborted  bool              `json:"aborted"`
+	Results  []*bulkRuleResult `json:"results"`
+}
+
+func (b *bulkResult) reject(res *bulkRuleResult, msg string) {
+	res.Status = bulkRejected
+	res.Error = msg
+	b.Rejected++
+}
+
+// abort marks everything not rejected as skipped, and returns an error
+// carrying b so the client learns which values were the problem.
+func (b *bulkResult) abort() error {
+	b.Aborted = true
+	b.Created, b.Warned = 0, 0
+	for _, res := range b.Results {
+		if res.Status != bulkRejected {
+			res.Status = bulkSkipped
+			res.Rule = ""
+		}
+	}
+	return errHTTP{
+		external: fmt.Sprintf("%d of %d values rejected, nothing added", b.Rejected, len(b.Results)),
+		code:     http.StatusUnprocessableEntity,
+		details:  b,
+	}
+}
+
+// bulkValues returns the values of a bulk add, from either a values[]
+// list or a pasted "values" text with one value per line. Blank lines and
+// repeats are dropped.
+func bulkValues(list []string, text string) []string {
+	vs := list
+	if len(vs) == 0 {
+		vs = strings.Split(text, "\n")
+	}
+	seen := make(map[string]bool)
+	var ret []string
+	for _, v := range vs {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// ruleBulkHandler creates one rule per value, all with the same type,
+// action, comment and ACL, in one transaction. Values that can't be rules,
+// or duplicate existing rules, are rejected. By default only they are
+// left out; with abort_on_error=true nothing is added if any is rejected.
+func ruleBulkHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Type         string   `form:"type,required,enum=type"`
+		Action       string   `form:"action,required,enum=action"`
+		Comment      string   `form:"comment"`
+		AbortOnError bool     `form:"abort_on_error"`
+		ACL          string   `form:"acl,uuid"`
+		Values       []string `form:"values[]"`
+		Text         string   `form:"values"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	typ, action, comment, abortOnError := data.Type, data.Action, data.Comment, data.AbortOnError
+	acl := newACLID
+	if data.ACL != "" {
+		acl = aclID(data.ACL)
+	}
+	values := bulkValues(data.Values, data.Text)
+	if len(values) == 0 {
+		return nil, errHTTP{external: "no values given", code: http.StatusBadRequest}
+	}
+	if len(values) > maxBulkRules {
+		return nil, errHTTP{
+			external: fmt.Sprintf("too many values, max %d at a time", maxBulkRules),
+			code:     http.StatusBadRequest,
+		}
+	}
+
+	resp := &bulkResult{ACL: string(acl)}
+	for _, v := range values {
+		res := &bulkRuleResult{Value: v}
+		resp.Results = append(resp.Results, res)
+		if err := policy.Validate(typ, v); err != nil {
+			resp.reject(res, err.Error())
+			continue
+		}
+		res.Warnings = policy.Lint(typ, v)
+	}
+	if abortOnError && resp.Rejected > 0 {
+		return nil, resp.abort()
+	}
+
+	log.Printf("Bulk adding %d %s rules to ACL %s", len(values)-resp.Rejected, typ, acl)
+	err := txWrap(func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM acls WHERE acl_id=?`, string(acl)).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return errHTTP{external: "ACL not found", code: http.StatusNotFound}
+		}
+		if err := checkNotArchived(tx, acl); err != nil {
+			return err
+		}
+		setComment, err := tx.Prepare(`UPDATE rules SET comment=? WHERE rule_id=?`)
+		if err != nil {
+			return err
+		}
+		defer setComment.Close()
+		for _, res := range resp.Results {
+			if res.Status == bulkRejected {
+				continue
+			}
+			id, err := insertRule(tx, acl, typ, res.Value, action)
+			if e, ok := err.(errHTTP); ok && e.code == http.StatusConflict {
+				resp.reject(res, e.external)
+				if abortOnError {
+					return resp.abort()
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if comment != "" {
+				if _, err := setComment.Exec(comment, id); err != nil {
+					return err
+				}
+			}
+			res.Rule = id
+			if len(res.Warnings) > 0 {
+				res.Status = bulkWarning
+				resp.Warned++
+			} else {
+				res.Status = bulkCreated
+			}
+			resp.Created++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Config bundles let proxies that don't run the UI pick up the generated
+// config, e.g. over NFS or an object store, and apply it with cmd/agent.
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/google/squidwarden/internal/bundle"
+	"github.com/google/squidwarden/internal/store"
+)
+
+// writeBundle writes the generated config to -bundle_file.
+func writeBundle() error {
+	rev, err := store.Revision(db)
+	if err != nil {
+		return err
+	}
+	b := &bundle.Bundle{
+		Revision:  rev,
+		Generated: time.Now().UTC().Format(saneTime),
+		Files:     make(map[string]string),
+	}
+	var buf bytes.Buffer
+	if err := generateSquidConf(&buf); err != nil {
+		return err
+	}
+	b.Files[bundle.FileSquid] = buf.String()
+	if serverOpts.FirewallConf != "" {
+		buf.Reset()
+		if err := generateAllFirewallConf(&buf); err != nil {
+			return err
+		}
+		b.Files[bundle.FileFirewall] = buf.String()
+	}
+	var key []byte
+	if serverOpts.BundleKey != "" {
+		k, err := bundle.ReadPrivateKey(serverOpts.BundleKey)
+		if err != nil {
+			return err
+		}
+		key = k
+	}
+	data, err := bundle.Marshal(b, key)
+	if err != nil {
+		return err
+	}
+	return writeConf(serverOpts.BundleFile, data)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Clients using DNS over HTTPS, or proxy and VPN services, get around
+// domain based filtering. The "bypass-block" ACL blocks the known ones,
+// from a curated list that's refreshed on startup and nightly, so that
+// upgrading squidwarden updates it. -bypass_list_url adds a site's own list.
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// Comment of the managed ACL. It's created when first granted.
+	bypassACLName = "bypass-block"
+
+	bypassDoH   = "DNS over HTTPS"
+	bypassProxy = "Proxy bypass"
+	bypassExtra = "Site list"
+)
+
+type bypassEntry struct {
+	value    string
+	category string
+}
+
+// bypassEntries is the curated list. Values are as for domain rules, so a
+// leading dot includes subdomains.
+var bypassEntries = []bypassEntry{
+	// Public DoH resolvers. Browsers also connect to some by IP.
+	{"dns.google", bypassDoH},
+	{"dns.google.com", bypassDoH},
+	{"8.8.8.8", bypassDoH},
+	{"8.8.4.4", bypassDoH},
+	{".cloudflare-dns.com", bypassDoH},
+	{"one.one.one.one", bypassDoH},
+	{"1.1.1.1", bypassDoH},
+	{"1.0.0.1", bypassDoH},
+	{".quad9.net", bypassDoH},
+	{"9.9.9.9", bypassDoH},
+	{"149.112.112.112", bypassDoH},
+	{"doh.opendns.com", bypassDoH},
+	{"doh.familyshield.opendns.com", bypassDoH},
+	{".adguard-dns.com", bypassDoH},
+	{"dns.adguard.com", bypassDoH},
+	{".nextdns.io", bypassDoH},
+	{".cleanbrowsing.org", bypassDoH},
+	{".controld.com", bypassDoH},
+	{"doh.dns.sb", bypassDoH},
+	{"dns.alidns.com", bypassDoH},
+	{"doh.pub", bypassDoH},
+	{"dns.mullvad.net", bypassDoH},
+	{"doh.mullvad.net", bypassDoH},
+	{"dns.switch.ch", bypassDoH},
+	{"doh.libredns.gr", bypassDoH},
+
+	// Circumvention tools and web proxies.
+	{".torproject.org", bypassProxy},
+	{".psiphon.ca", bypassProxy},
+	{".psiphon3.com", bypassProxy},
+	{".ultrasurf.us", bypassProxy},
+	{".hola.org", bypassProxy},
+	{".hidemyass.com", bypassProxy},
+	{".proxysite.com", bypassProxy},
+	{".kproxy.com", bypassProxy},
+	{".croxyproxy.com", bypassProxy},
+	{".hide.me", bypassProxy},
+	{".windscribe.com", bypassProxy},
+}
+
+// bypassList returns the curated list, plus -bypass_list_url if set.
+func bypassList() ([]bypassEntry, error) {
+	ret := append([]bypassEntry{}, bypassEntries...)
+	if serverOpts.BypassListURL == "" {
+		return ret, nil
+	}
+	b, err := fetchList(serverOpts.BypassListURL)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := parseList(bytes.NewReader(b), listHosts, actionBlock)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range extra {
+		ret = append(ret, bypassEntry{value: e.Value, category: bypassExtra})
+	}
+	return ret, nil
+}
+
+// syncBypassACL makes the ACL (creating it if create is set) match the
+// list. It returns the ACL, or "" if it doesn't exist.
+func syncBypassACL(tx *sql.Tx, entries []bypassEntry, create bool) (aclID, error) {
+	var id string
+	if err := tx.QueryRow(`SELECT acl_id FROM acls WHERE comment=? ORDER BY acl_id LIMIT 1`, bypassACLName).Scan(&id); err == sql.ErrNoRows {
+		if !create {
+			return "", nil
+		}
+		id = uuid.NewV4().String()
+		log.Printf("Creating bypass ACL %s", id)
+		if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, id, bypassACLName); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	var list []listEntry
+	for _, e := range entries {
+		list = append(list, listEntry{Value: e.value, Action: actionBlock})
+	}
+	if _, _, err := importList(tx, aclID(id), list, true); err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if _, err := tx.Exec(`
+UPDATE aclrules SET comment=?
+WHERE acl_id=? AND rule_id IN (SELECT rule_id FROM rules WHERE type IN (?,?) AND value=? AND action=?)`,
+			e.category, id, typeDomain, typeHTTPSDomain, e.value, actionBlock); err != nil {
+			return "", err
+		}
+	}
+	return aclID(id), nil
+}
+
+// refreshBypassACL updates the ACL from the list, if it exists.
+func refreshBypassACL() {
+	entries, err := bypassList()
+	if err != nil {
+		log.Printf("Failed to get bypass list: %v", err)
+		return
+	}
+	if err := txWrap(func(tx *sql.Tx) error {
+		_, err := syncBypassACL(tx, entries, false)
+		return err
+	}); err != nil {
+		log.Printf("Failed to refresh bypass ACL: %v", err)
+	}
+}
+
+// groupBlockBypassHandler grants the bypass ACL to a group, creating and
+// refreshing it first.
+func groupBlockBypassHandler(r *http.Request) (interface{}, error) {
+	g := assertGroupID(mux.Vars(r)["groupID"])
+	entries, err := bypassList()
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: "failed to get -bypass_list_url",
+			code:     http.StatusBadGateway,
+		}
+	}
+	log.Printf("Blocking bypass services for group %s", g)
+	resp := struct {
+		Group   string `json:"group"`
+		ACL     string `json:"acl"`
+		Entries int    `json:"entries"`
+		Changed int64  `json:"changed"`
+	}{Group: string(g), Entries: len(entries)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM groups WHERE group_id=?`, string(g)).Scan(&n); err != nil {
+			return err
+		} else if n == 0 {
+			return errHTTP{
+				external: "group not found",
+				code:     http.StatusNotFound,
+			}
+		}
+		a, err := syncBypassACL(tx, entries, true)
+		if err != nil {
+			return err
+		}
+		resp.ACL = string(a)
+		resp.Changed, err = rowsAffected(tx.Exec(`INSERT OR IGNORE INTO groupaccess(group_id, acl_id, comment) VALUES(?,?,?)`, string(g), string(a), "Blocks DNS over HTTPS and proxy bypass"))
+		return err
+	})
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	cacheMgrClient = &http.Client{Timeout: 5 * time.Second}
+
+	// Lines from 'info' worth showing at the top of the page.
+	cacheMgrHighlights = []string{
+		"UP Time",
+		"Number of clients accessing cache",
+		"Average HTTP requests per minute since start",
+		"CPU Usage",
+		"Maximum Resident Size",
+		"Number of file desc currently in use",
+	}
+)
+
+// fetchCacheMgr returns the raw text of a cache manager section, such as
+// "info" or "active_requests".
+func fetchCacheMgr(section string) (string, error) {
+	if serverOpts.CacheMgr == "" {
+		return "", fmt.Errorf("-cachemgr not configured")
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(serverOpts.CacheMgr, "/")+"/"+section, nil)
+	if err != nil {
+		return "", err
+	}
+	if serverOpts.CacheMgrPassword != "" {
+		req.SetBasicAuth("squidwarden", serverOpts.CacheMgrPassword)
+	}
+	resp, err := cacheMgrClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cache manager %q returned %q", section, resp.Status)
+	}
+	return string(b), nil
+}
+
+type cacheMgrValue struct {
+	Key   string
+	Value string
+}
+
+// parseCacheMgrInfo picks out the highlighted "key: value" lines of 'info'.
+func parseCacheMgrInfo(s string) []cacheMgrValue {
+	found := make(map[string]string)
+	for _, l := range strings.Split(s, "\n") {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		found[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	var ret []cacheMgrValue
+	for _, k := range cacheMgrHighlights {
+		if v, ok := found[k]; ok {
+			ret = append(ret, cacheMgrValue{Key: k, Value: v})
+		}
+	}
+	return ret
+}
+
+func cacheMgrHandler(r *http.Request) (template.HTML, error) {
+	type section struct {
+		Name  string
+		Text  string
+		Error string
+	}
+	data := struct {
+		Configured bool
+		Health     []cacheMgrValue
+		Sections   []section
+	}{
+		Configured: serverOpts.CacheMgr != "",
+	}
+	if data.Configured {
+		for _, name := range []string{"info", "5min", "active_requests"} {
+			s := section{Name: name}
+			t, err := fetchCacheMgr(name)
+			if err != nil {
+				s.Error = err.Error()
+			}
+			s.Text = t
+			if name == "info" {
+				data.Health = parseCacheMgrInfo(t)
+			}
+			data.Sections = append(data.Sections, s)
+		}
+	}
+	tmpl := getTemplate("cachemgr.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The change log records every successful write through the UI or API, for
+// the dashboard feed. It's not part of the policy, so it's not exported and
+// doesn't bump the revision.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultChangeFeed = 20
+	maxChangeFeed     = 500
+)
+
+type change struct {
+	Time     string `json:"time"`
+	Actor    string `json:"actor"`
+	Entity   string `json:"entity"`
+	EntityID string `json:"entity_id,omitempty"`
+	Summary  string `json:"summary"`
+	Link     string `json:"link,omitempty"`
+}
+
+// changeVars are the route variables that identify what a change is about,
+// most specific first.
+var changeVars = []string{"ruleID", "aclID", "groupID", "sourceID", "icapID", "exceptionID", "quotaID", "listID", "alertID", "feedID", "freezeID", "jobID", "snapshotID", "promotionID"}
+
+// changeSummary turns a route into a short description, e.g. "DELETE
+// /acl/{aclID:...}" into "delete acl" and "POST /acl/{aclID:...}/owner" into
+// "acl owner".
+func changeSummary(method, route string) (entity, summary string) {
+	var words []string
+	for _, p := range strings.Split(route, "/") {
+		if p == "" || strings.HasPrefix(p, "{") {
+			continue
+		}
+		words = append(words, p)
+	}
+	if len(words) == 0 {
+		return "", strings.ToLower(method)
+	}
+	entity = words[0]
+	if method == "DELETE" {
+		words = append([]string{"delete"}, words...)
+	} else if len(words) == 1 {
+		words = append(words, "update")
+	}
+	return entity, strings.Join(words, " ")
+}
+
+// changeWrap records a change log entry when h succeeds.
+func changeWrap(method, route string, h func(*http.Request) (interface{}, error)) func(*http.Request) (interface{}, error) {
+	entity, summary := changeSummary(method, route)
+	return func(r *http.Request) (interface{}, error) {
+		resp, err := h(r)
+		if err != nil {
+			return resp, err
+		}
+		var id string
+		vars := mux.Vars(r)
+		for _, v := range changeVars {
+			if id = vars[v]; id != "" {
+				break
+			}
+		}
+		now := time.Now()
+		if _, err := db.Exec(`INSERT INTO changelog(time, actor, entity, entity_id, summary) VALUES(?,?,?,?,?)`, now.Unix(), remoteUser(r), entity, id, summary); err != nil {
+			log.Printf("Failed to record change %q: %v", summary, err)
+		}
+		audit.change(remoteUser(r), entity, id, summary)
+		publishChange(now, remoteUser(r), entity, id, summary)
+		return resp, nil
+	}
+}
+
+// changeLink returns the page showing what changed, if it still exists.
+func changeLink(entity, id, summary string) string {
+	if id == "" || strings.HasPrefix(summary, "delete ") {
+		return ""
+	}
+	switch entity {
+	case "acl", "rule", "access", "members", "source":
+		return "/" + entity + "/" + id
+	case "group", "pause":
+		return "/members/" + id
+	}
+	return ""
+}
+
+func getChanges(limit int, loc *time.Location) ([]change, error) {
+	return getChangesSince(time.Unix(0, 0), limit, loc)
+}
+
+// getChangesSince returns up to limit changes made since since, newest
+// first, with times in loc.
+func getChangesSince(since time.Time, limit int, loc *time.Location) ([]change, error) {
+	rows, err := db.Query(`
+SELECT time, actor, entity, entity_id, summary
+FROM changelog
+WHERE time >= ?
+ORDER BY time DESC, rowid DESC
+LIMIT ?`, since.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []change{}
+	for rows.Next() {
+		var c change
+		var t int64
+		if err := rows.Scan(&t, &c.Actor, &c.Entity, &c.EntityID, &c.Summary); err != nil {
+			return nil, err
+		}
+		c.Time = formatUnix(t, loc)
+		c.Link = changeLink(c.Entity, c.EntityID, c.Summary)
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
+
+// getDenials returns the latest denied requests in the squid log, newest
+// first.
+func getDenials(limit int, loc *time.Location) ([]tailEntry, error) {
+	if serverOpts.SquidLog == "" {
+		return []tailEntry{}, nil
+	}
+	f, err := os.Open(serverOpts.SquidLog)
+	if os.IsNotExist(err) {
+		return []tailEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	page, err := readTailPage(f, fi.Size(), limit, true, timeRange{}, loc)
+	if err != nil {
+		return nil, err
+	}
+	return page.Entries, nil
+}
+
+type dashboard struct {
+	Changes []change    `json:"changes"`
+	Denials []tailEntry `json:"denials"`
+}
+
+func getDashboard(limit int, loc *time.Location) (*dashboard, error) {
+	var d dashboard
+	var err error
+	if d.Changes, err = getChanges(limit, loc); err != nil {
+		return nil, err
+	}
+	if d.Denials, err = getDenials(limit, loc); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func dashboardHandler(r *http.Request) (interface{}, error) {
+	limit := defaultChangeFeed
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxChangeFeed {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("limit must be 1-%d", maxChangeFeed),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	return getDashboard(limit, requestZone(r))
+}
+
+const defaultChangeLogLimit = 1000
+
+// changeLogHandler streams the change log, newest first, between from and
+// to if set. actor and entity, if set, must match exactly.
+func changeLogHandler(r *http.Request, s *recordStream) error {
+	tr, err := parseTimeRange(r, time.Now())
+	if err != nil {
+		return err
+	}
+	limit := defaultChangeLogLimit
+	if l := r.FormValue("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return errHTTP{
+				internal: err,
+				external: "invalid limit",
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	q := `
+SELECT time, actor, entity, entity_id, summary
+FROM changelog
+WHERE time >= ? AND time < ?`
+	args := []interface{}{tr.fromUnix(), tr.toUnix()}
+	for _, f := range []string{"actor", "entity"} {
+		if v := r.FormValue(f); v != "" {
+			q += ` AND ` + f + `=?`
+			args = append(args, v)
+		}
+	}
+	q += ` ORDER BY time DESC, rowid DESC`
+	if limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	loc := requestZone(r)
+	for rows.Next() {
+		var c change
+		var t int64
+		if err := rows.Scan(&t, &c.Actor, &c.Entity, &c.EntityID, &c.Summary); err != nil {
+			return err
+		}
+		c.Time = formatUnix(t, loc)
+		c.Link = changeLink(c.Entity, c.EntityID, c.Summary)
+		if err := s.Write(&c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func changesHandler(r *http.Request) (template.HTML, error) {
+	tmpl := getTemplate("changes.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Bulk comment editing: append, prepend, set or find-and-replace in the
+// comments of many rules at once, with a preview.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Comment edit operations.
+const (
+	commentAppend  = "append"
+	commentPrepend = "prepend"
+	commentSet     = "set"
+	commentReplace = "replace"
+)
+
+// commentEdit is a change to apply to rule comments.
+type commentEdit struct {
+	op      string
+	text    string         // For append, prepend and set.
+	find    string         // For replace.
+	re      *regexp.Regexp // For replace, if find is a regex.
+	replace string
+}
+
+// apply returns the comment edited.
+func (e *commentEdit) apply(old string) string {
+	switch e.op {
+	case commentAppend:
+		if old == "" {
+			return e.text
+		}
+		return old + " " + e.text
+	case commentPrepend:
+		if old == "" {
+			return e.text
+		}
+		return e.text + " " + old
+	case commentSet:
+		return e.text
+	case commentReplace:
+		if e.re != nil {
+			return e.re.ReplaceAllString(old, e.replace)
+		}
+		return strings.Replace(old, e.find, e.replace, -1)
+	}
+	panic("unknown comment edit " + e.op)
+}
+
+// commentEditForm is the form of /rule/comments.
+type commentEditForm struct {
+	Rules   []string `form:"rules[],uuid"`
+	All     bool     `form:"all"`
+	Preview bool     `form:"preview"`
+	Op      string   `form:"op,required"`
+	Text    string   `form:"text"`
+	Find    string   `form:"find"`
+	Replace string   `form:"replace"`
+	Regex   bool     `form:"regex"`
+}
+
+// parseCommentEdit checks the edit in f.
+func parseCommentEdit(f *commentEditForm) (*commentEdit, error) {
+	e := &commentEdit{
+		op:      f.Op,
+		text:    f.Text,
+		find:    f.Find,
+		replace: f.Replace,
+	}
+	switch e.op {
+	case commentAppend, commentPrepend:
+		if e.text == "" {
+			return nil, errHTTP{external: "nothing to " + e.op, code: http.StatusBadRequest}
+		}
+	case commentSet:
+	case commentReplace:
+		if e.find == "" {
+			return nil, errHTTP{external: "nothing to find", code: http.StatusBadRequest}
+		}
+		if f.Regex {
+			var err error
+			if e.re, err = regexp.Compile(e.find); err != nil {
+				return nil, errHTTP{
+					internal: err,
+					external: fmt.Sprintf("bad regex: %v", err),
+					code:     http.StatusBadRequest,
+				}
+			}
+		}
+	default:
+		return nil, errHTTP{external: fmt.Sprintf("unknown op %q", e.op), code: http.StatusBadRequest}
+	}
+	return e, nil
+}
+
+// commentChange is a rule whose comment an edit changes.
+type commentChange struct {
+	Rule  string `json:"rule"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// getCommentChanges returns what e would do to the rules, or to all rules
+// if ids is empty.
+func getCommentChanges(tx *sql.Tx, ids []string, e *commentEdit) ([]commentChange, error) {
+	q := `SELECT rule_id, type, value, comment FROM rules`
+	if len(ids) > 0 {
+		q += fmt.Sprintf(` WHERE rule_id IN ('%s')`, strings.Join(ids, "','"))
+	}
+	rows, err := tx.Query(q + ` ORDER BY type, value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []commentChange{}
+	for rows.Next() {
+		var c commentChange
+		var old sql.NullString
+		if err := rows.Scan(&c.Rule, &c.Type, &c.Value, &old); err != nil {
+			return nil, err
+		}
+		c.Old = old.String
+		if c.New = e.apply(c.Old); c.New != c.Old {
+			changes = append(changes, c)
+		}
+	}
+	return changes, rows.Err()
+}
+
+// ruleCommentsHandler edits the comments of rules[], or of all rules if
+// all=true. With preview=true nothing is changed, and the reply says what
+// would be.
+func ruleCommentsHandler(r *http.Request) (interface{}, error) {
+	var data commentEditForm
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	ids := data.Rules
+	if len(ids) == 0 && !data.All {
+		return nil, errHTTP{
+			external: "no rules given. Use all=true to edit every rule",
+			code:     http.StatusBadRequest,
+		}
+	}
+	e, err := parseCommentEdit(&data)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Preview bool            `json:"preview"`
+		Changes []commentChange `json:"changes"`
+	}{Preview: data.Preview}
+
+	if resp.Preview {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		resp.Changes, err = getCommentChanges(tx, ids, e)
+		return &resp, err
+	}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var err error
+		if resp.Changes, err = getCommentChanges(tx, ids, e); err != nil {
+			return err
+		}
+		log.Printf("Editing comments of %d rules: %s", len(resp.Changes), e.op)
+		actor, now := remoteUser(r), time.Now()
+		for _, c := range resp.Changes {
+			if err := saveRuleVersion(tx, actor, c.Rule, now); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE rules SET comment=? WHERE rule_id=?`, c.New, c.Rule); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
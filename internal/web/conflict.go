@@ -0,0 +1,136 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Value conflicts: the same rule value with different actions, in ACLs
+// granted to the same group. The helper picks one by action (block, then
+// ignore, then allow) and then by lowest ACL and rule ID, so the others
+// never apply.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ruleConflict is a value with different actions in a group.
+type ruleConflict struct {
+	Group  group
+	Type   string
+	Value  string
+	Rules  []analysisRule // Winner first.
+	Winner analysisRule
+}
+
+// ruleBefore returns true if the helper prefers a to b, if both match.
+func ruleBefore(a, b analysisRule) bool {
+	if actionRank[a.Action] != actionRank[b.Action] {
+		return actionRank[a.Action] < actionRank[b.Action]
+	}
+	if a.ACL.ACLID != b.ACL.ACLID {
+		return a.ACL.ACLID < b.ACL.ACLID
+	}
+	return a.RuleID < b.RuleID
+}
+
+type rulesByPrecedence []analysisRule
+
+func (a rulesByPrecedence) Len() int           { return len(a) }
+func (a rulesByPrecedence) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a rulesByPrecedence) Less(i, j int) bool { return ruleBefore(a[i], a[j]) }
+
+type conflictsByValue []ruleConflict
+
+func (a conflictsByValue) Len() int      { return len(a) }
+func (a conflictsByValue) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a conflictsByValue) Less(i, j int) bool {
+	if a[i].Value != a[j].Value {
+		return a[i].Value < a[j].Value
+	}
+	return a[i].Type < a[j].Type
+}
+
+// findValueConflicts returns the values with different actions among the
+// rules of a group.
+func findValueConflicts(g group, rules []analysisRule) []ruleConflict {
+	byValue := make(map[[2]string][]analysisRule)
+	for _, r := range rules {
+		k := [2]string{r.Type, r.Value}
+		byValue[k] = append(byValue[k], r)
+	}
+	var ret []ruleConflict
+	for k, rs := range byValue {
+		conflict := false
+		for _, r := range rs {
+			if r.Action != rs[0].Action {
+				conflict = true
+			}
+		}
+		if !conflict {
+			continue
+		}
+		sort.Sort(rulesByPrecedence(rs))
+		ret = append(ret, ruleConflict{Group: g, Type: k[0], Value: k[1], Rules: rs, Winner: rs[0]})
+	}
+	sort.Sort(conflictsByValue(ret))
+	return ret
+}
+
+// Message describes the conflict and which rule wins.
+func (c *ruleConflict) Message() string {
+	var others []string
+	for _, r := range c.Rules[1:] {
+		others = append(others, fmt.Sprintf("%s in ACL %q", r.Action, r.ACL.Comment))
+	}
+	return fmt.Sprintf("Group %q: %s %q is %s in ACL %q, which wins over %s.", c.Group.Comment, c.Type, c.Value, c.Winner.Action, c.Winner.ACL.Comment, strings.Join(others, ", "))
+}
+
+func (c *ruleConflict) finding() finding {
+	f := finding{
+		Kind:    findingValueConflict,
+		Message: c.Message(),
+		Links:   []errHTTPLink{{Text: "winning rule", Link: "/rule/" + string(c.Winner.RuleID)}},
+	}
+	for _, r := range c.Rules[1:] {
+		f.Links = append(f.Links, errHTTPLink{Text: "overridden rule", Link: "/rule/" + string(r.RuleID)})
+	}
+	return f
+}
+
+// getRuleConflicts returns the conflicts involving any of the rules.
+func getRuleConflicts(ids ...ruleID) ([]ruleConflict, error) {
+	want := make(map[ruleID]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	groups, rules, err := getGrantedRules()
+	if err != nil {
+		return nil, err
+	}
+	var ret []ruleConflict
+	for id, rs := range rules {
+		for _, c := range findValueConflicts(groups[id], rs) {
+			for _, r := range c.Rules {
+				if want[r.RuleID] {
+					ret = append(ret, c)
+					break
+				}
+			}
+		}
+	}
+	sort.Sort(conflictsByValue(ret))
+	return ret, nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Dashboard stats are hourly totals per group, and denials per ACL, for
+// sites building their own dashboards, e.g. in Grafana. They're added up
+// as the traffic stats are recorded, since which group a client is in and
+// which ACL denied a request can't be worked out later. Dashboards read
+// them as JSON from /stats/acl-denials and /stats/group-traffic, or with
+// SQL from the dashboard_* views. Their columns are kept stable.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+// defaultDashboardDays is the range returned without from and to.
+const defaultDashboardDays = 7
+
+type aclDenialsRecord struct {
+	Time   string `json:"time"`
+	ACLID  string `json:"acl_id"`
+	ACL    string `json:"acl_name"`
+	Denied int64  `json:"denied"`
+}
+
+type groupTrafficRecord struct {
+	Time     string `json:"time"`
+	GroupID  string `json:"group_id"`
+	Group    string `json:"group_name"`
+	Requests int64  `json:"requests"`
+	Denied   int64  `json:"denied"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type sourceGroup struct {
+	source string
+	group  string
+}
+
+func getSourceGroups(tx *sql.Tx) ([]sourceGroup, error) {
+	rows, err := tx.Query(`
+SELECT sources.source, members.group_id
+FROM sources
+JOIN members ON sources.source_id=members.source_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []sourceGroup
+	for rows.Next() {
+		var s sourceGroup
+		if err := rows.Scan(&s.source, &s.group); err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
+
+// addDashboardStats adds entries to the dashboard stats. A client counts
+// for every group it's in, and "" if it's in none. Denials are counted for
+// the ACL that p says denied them, and "" if it wasn't an ACL, e.g. the
+// default action. p may be nil if the policy can't be loaded.
+func addDashboardStats(tx *sql.Tx, p *policy.Policy, entries []trafficEntry) error {
+	sgs, err := getSourceGroups(tx)
+	if err != nil {
+		return err
+	}
+	type groupKey struct {
+		hour  int64
+		group string
+	}
+	type aclKey struct {
+		hour int64
+		acl  string
+	}
+	groups := make(map[groupKey]*trafficCounters)
+	acls := make(map[aclKey]int64)
+	clientGroups := make(map[string][]string)
+	for _, e := range entries {
+		hour := e.time / 3600 * 3600
+		gs, found := clientGroups[e.client]
+		if !found {
+			seen := make(map[string]bool)
+			if ip := net.ParseIP(e.client); ip != nil {
+				for _, sg := range sgs {
+					if !seen[sg.group] && sourceContains(sg.source, ip) {
+						seen[sg.group] = true
+						gs = append(gs, sg.group)
+					}
+				}
+			}
+			if len(gs) == 0 {
+				gs = []string{""}
+			}
+			clientGroups[e.client] = gs
+		}
+		for _, g := range gs {
+			k := groupKey{hour, g}
+			c := groups[k]
+			if c == nil {
+				c = &trafficCounters{}
+				groups[k] = c
+			}
+			c.requests++
+			c.bytes += e.bytes
+			if e.denied {
+				c.denied++
+			}
+		}
+		if !e.denied {
+			continue
+		}
+		var acl string
+		if p != nil {
+			d, err := p.Decide(logRequest(e.client, e.method, e.url))
+			if err != nil {
+				log.Printf("Dashboard stats: deciding %q: %v", e.url, err)
+			} else if d.Match {
+				acl = d.ACL
+			}
+		}
+		acls[aclKey{hour, acl}]++
+	}
+
+	for k, c := range groups {
+		n, err := rowsAffected(tx.Exec(`UPDATE groupstats SET requests=requests+?, denied=denied+?, bytes=bytes+? WHERE hour=? AND group_id=?`, c.requests, c.denied, c.bytes, k.hour, k.group))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO groupstats(hour, group_id, requests, denied, bytes) VALUES(?,?,?,?,?)`, k.hour, k.group, c.requests, c.denied, c.bytes); err != nil {
+			return err
+		}
+	}
+	for k, denied := range acls {
+		n, err := rowsAffected(tx.Exec(`UPDATE acldenials SET denied=denied+? WHERE hour=? AND acl_id=?`, denied, k.hour, k.acl))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO acldenials(hour, acl_id, denied) VALUES(?,?,?)`, k.hour, k.acl, denied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDashboardTime parses Unix milliseconds, as in Grafana's ${__from}
+// and ${__to}, or anything parseRangeTime does, in UTC.
+func parseDashboardTime(s string, now time.Time) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	return parseRangeTime(s, now, time.UTC)
+}
+
+// parseDashboardRange parses from and to, defaulting to the
+// defaultDashboardDays before now.
+func parseDashboardRange(r *http.Request, now time.Time) (from, to time.Time, err error) {
+	to = now
+	from = now.AddDate(0, 0, -defaultDashboardDays)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"from", &from},
+		{"to", &to},
+	} {
+		if s := r.FormValue(p.name); s != "" {
+			if *p.t, err = parseDashboardTime(s, now); err != nil {
+				return from, to, errHTTP{
+					internal: err,
+					external: fmt.Sprintf("bad %s %q, want Unix milliseconds, or %s", p.name, s, rangeTimeHelp),
+					code:     http.StatusBadRequest,
+				}
+			}
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errHTTP{
+			external: "from must be before to",
+			code:     http.StatusBadRequest,
+		}
+	}
+	return from, to, nil
+}
+
+// dashboardHour formats an hour of dashboard stats.
+func dashboardHour(hour int64) string {
+	return time.Unix(hour, 0).UTC().Format(time.RFC3339)
+}
+
+// aclDenialsHandler streams denials per hour and ACL, oldest first, for
+// the hours in the range.
+func aclDenialsHandler(r *http.Request, s *recordStream) error {
+	from, to, err := parseDashboardRange(r, time.Now())
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+SELECT time, acl_id, acl_name, denied
+FROM dashboard_acl_denials
+WHERE time >= ? AND time < ?
+ORDER BY time, acl_id`, from.Unix()/3600*3600, to.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec aclDenialsRecord
+		var hour int64
+		if err := rows.Scan(&hour, &rec.ACLID, &rec.ACL, &rec.Denied); err != nil {
+			return err
+		}
+		rec.Time = dashboardHour(hour)
+		if err := s.Write(&rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// groupTrafficHandler streams traffic per hour and group, oldest first,
+// for the hours in the range.
+func groupTrafficHandler(r *http.Request, s *recordStream) error {
+	from, to, err := parseDashboardRange(r, time.Now())
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+SELECT time, group_id, group_name, requests, denied, bytes
+FROM dashboard_group_traffic
+WHERE time >= ? AND time < ?
+ORDER BY time, group_id`, from.Unix()/3600*3600, to.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec groupTrafficRecord
+		var hour int64
+		if err := rows.Scan(&hour, &rec.GroupID, &rec.Group, &rec.Requests, &rec.Denied, &rec.Bytes); err != nil {
+			return err
+		}
+		rec.Time = dashboardHour(hour)
+		if err := s.Write(&rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The default group applies to clients that aren't in any source, so that
+// new devices get its (presumably restrictive) policy rather than falling
+// through to squid's.
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// getDefaultGroup returns the default group, or "" if there is none.
+func getDefaultGroup() (groupID, error) {
+	var g string
+	if err := db.QueryRow(`SELECT group_id FROM defaultgroup ORDER BY group_id LIMIT 1`).Scan(&g); err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return groupID(g), nil
+}
+
+// groupDefaultHandler makes a group the default one, replacing any other,
+// or stops it being the default.
+func groupDefaultHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	var data struct {
+		Default string `form:"default,required,enum=bool"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	def := data.Default == "true"
+	log.Printf("Setting default group %s to %t", id, def)
+	return &struct {
+		Group   string `json:"group"`
+		Default bool   `json:"default"`
+	}{string(id), def}, txWrap(func(tx *sql.Tx) error {
+		if !def {
+			_, err := tx.Exec(`DELETE FROM defaultgroup WHERE group_id=?`, string(id))
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM defaultgroup`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO defaultgroup(group_id) VALUES(?)`, string(id))
+		return err
+	})
+}
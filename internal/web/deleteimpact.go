@@ -0,0 +1,302 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Deleting an ACL or a source cascades: grants, members and rules that
+// only the ACL had go with it. So the first DELETE only returns what would
+// go, with a confirm token, and only a DELETE with that token deletes.
+// The token is tied to the policy revision, so it can't be reused once
+// anything has changed.
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/gorilla/mux"
+)
+
+// impactDays is how far back traffic is counted.
+const impactDays = 7
+
+// deleteImpact is what deleting an ACL or source would take with it.
+type deleteImpact struct {
+	Kind     string   `json:"kind"`
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups"`
+	Rules    int64    `json:"rules"`    // Rules in the ACL.
+	Orphaned int64    `json:"orphaned"` // Rules in no other ACL, deleted too.
+	Quotas   int64    `json:"quotas"`
+	Requests int64    `json:"requests"` // Matched in the last impactDays.
+	Confirm  string   `json:"confirm"`
+}
+
+// confirmToken returns the token that confirms deleting kind id at
+// revision rev.
+func confirmToken(kind, id string, rev int64) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d", kind, id, rev)))
+	return hex.EncodeToString(h[:8])
+}
+
+func impactRevision(tx *sql.Tx) (int64, error) {
+	var rev int64
+	err := tx.QueryRow(`SELECT revision FROM revision`).Scan(&rev)
+	return rev, err
+}
+
+func impactGroups(tx *sql.Tx, q string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := []string{}
+	for rows.Next() {
+		var c sql.NullString
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		groups = append(groups, c.String)
+	}
+	return groups, rows.Err()
+}
+
+func getACLImpact(tx *sql.Tx, id aclID) (*deleteImpact, error) {
+	im := &deleteImpact{Kind: "acl", ID: string(id)}
+	var c sql.NullString
+	if err := tx.QueryRow(`SELECT comment FROM acls WHERE acl_id=?`, string(id)).Scan(&c); err == sql.ErrNoRows {
+		return nil, errHTTP{external: "no such ACL", code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	im.Name = c.String
+	var err error
+	if im.Groups, err = impactGroups(tx, `
+SELECT groups.comment FROM groupaccess
+JOIN groups ON groupaccess.group_id=groups.group_id
+WHERE groupaccess.acl_id=?
+ORDER BY groups.comment`, string(id)); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM aclrules WHERE acl_id=?`, string(id)).Scan(&im.Rules); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(`
+SELECT COUNT(*) FROM aclrules
+WHERE acl_id=?
+AND rule_id NOT IN (SELECT rule_id FROM aclrules WHERE acl_id<>?)`, string(id), string(id)).Scan(&im.Orphaned); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM quotas WHERE acl_id=?`, string(id)).Scan(&im.Quotas); err != nil {
+		return nil, err
+	}
+	rev, err := impactRevision(tx)
+	if err != nil {
+		return nil, err
+	}
+	im.Confirm = confirmToken(im.Kind, im.ID, rev)
+	return im, nil
+}
+
+func getSourceImpact(tx *sql.Tx, id sourceID) (*deleteImpact, error) {
+	im := &deleteImpact{Kind: "source", ID: string(id)}
+	if err := tx.QueryRow(`SELECT source FROM sources WHERE source_id=?`, string(id)).Scan(&im.Name); err == sql.ErrNoRows {
+		return nil, errHTTP{external: "no such source", code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	var err error
+	if im.Groups, err = impactGroups(tx, `
+SELECT groups.comment FROM members
+JOIN groups ON members.group_id=groups.group_id
+WHERE members.source_id=?
+ORDER BY groups.comment`, string(id)); err != nil {
+		return nil, err
+	}
+	rev, err := impactRevision(tx)
+	if err != nil {
+		return nil, err
+	}
+	im.Confirm = confirmToken(im.Kind, im.ID, rev)
+	return im, nil
+}
+
+// recentTraffic calls f with every client and host seen since from, and
+// how many requests there were.
+func recentTraffic(from time.Time, f func(client, host string, requests int64)) error {
+	start := from.Unix()
+	rows, err := db.Query(`
+SELECT client, host, SUM(requests)
+FROM (
+  SELECT client, host, requests FROM trafficstats WHERE hour >= ?
+  UNION ALL
+  SELECT client, host, 1 FROM trafficlog WHERE time >= ?
+)
+GROUP BY client, host`, start, start)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client, host string
+		var n int64
+		if err := rows.Scan(&client, &host, &n); err != nil {
+			return err
+		}
+		f(client, host, n)
+	}
+	return rows.Err()
+}
+
+// addImpactTraffic counts the recent requests that the ACL decided, or
+// that came from the source.
+func addImpactTraffic(im *deleteImpact, now time.Time) error {
+	from := now.AddDate(0, 0, -impactDays)
+	switch im.Kind {
+	case "source":
+		n, err := policy.SourceNet(im.Name)
+		if err != nil {
+			return err
+		}
+		return recentTraffic(from, func(client, host string, requests int64) {
+			if ip := net.ParseIP(client); ip != nil && n.Contains(ip) {
+				im.Requests += requests
+			}
+		})
+	case "acl":
+		p, _, err := policies.Get(now)
+		if err != nil {
+			return err
+		}
+		return recentTraffic(from, func(client, host string, requests int64) {
+			// The log only has the host, so try it both ways.
+			for _, u := range []string{"https://" + host + "/", "http://" + host + "/"} {
+				req, err := policy.URLRequest(client, u)
+				if err != nil {
+					continue
+				}
+				if d, err := p.Decide(req); err == nil && d.ACL == im.ID {
+					im.Requests += requests
+					return
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// readImpact gets an impact summary, with traffic, outside of any change.
+func readImpact(get func(*sql.Tx) (*deleteImpact, error)) (*deleteImpact, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	im, err := get(tx)
+	tx.Rollback()
+	if err != nil {
+		return nil, err
+	}
+	if err := addImpactTraffic(im, time.Now()); err != nil {
+		log.Printf("Failed to count traffic for %s %s: %v", im.Kind, im.ID, err)
+	}
+	return im, nil
+}
+
+// checkConfirm makes sure that r confirms deleting what im describes. The
+// token is in the URL, since DELETE bodies aren't parsed.
+func checkConfirm(r *http.Request, im *deleteImpact) error {
+	var data struct {
+		Confirm string `form:"confirm"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return err
+	}
+	if data.Confirm == im.Confirm {
+		return nil
+	}
+	msg := fmt.Sprintf("deleting %s %q needs confirmation", im.Kind, im.Name)
+	if data.Confirm != "" {
+		msg = fmt.Sprintf("confirm token for %s %q is stale, something changed", im.Kind, im.Name)
+	}
+	return errHTTP{
+		external: msg,
+		code:     http.StatusPreconditionRequired,
+		reason:   "confirm_required",
+		details:  im,
+	}
+}
+
+func aclImpactHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	return readImpact(func(tx *sql.Tx) (*deleteImpact, error) { return getACLImpact(tx, id) })
+}
+
+func sourceImpactHandler(r *http.Request) (interface{}, error) {
+	id := assertSourceID(mux.Vars(r)["sourceID"])
+	return readImpact(func(tx *sql.Tx) (*deleteImpact, error) { return getSourceImpact(tx, id) })
+}
+
+// deleteACLDependents removes the grants, quotas and rules of the ACL id,
+// and the rules that no other ACL has.
+func deleteACLDependents(tx *sql.Tx, id aclID) error {
+	rows, err := tx.Query(`
+SELECT rule_id FROM aclrules
+WHERE acl_id=?
+AND rule_id NOT IN (SELECT rule_id FROM aclrules WHERE acl_id<>?)`, string(id), string(id))
+	if err != nil {
+		return err
+	}
+	var orphans []interface{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			rows.Close()
+			return err
+		}
+		orphans = append(orphans, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, q := range []string{
+		`DELETE FROM groupaccess WHERE acl_id=?`,
+		`DELETE FROM quotausage WHERE quota_id IN (SELECT quota_id FROM quotas WHERE acl_id=?)`,
+		`DELETE FROM quotas WHERE acl_id=?`,
+		`DELETE FROM aclrules WHERE acl_id=?`,
+	} {
+		if _, err := tx.Exec(q, string(id)); err != nil {
+			return err
+		}
+	}
+	for _, o := range orphans {
+		if _, err := tx.Exec(`DELETE FROM ruleexpiry WHERE rule_id=?`, o); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM rules WHERE rule_id=?`, o); err != nil {
+			return err
+		}
+	}
+	return deleteOrphanOrigins(tx)
+}
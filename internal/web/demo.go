@@ -0,0 +1,227 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Demo mode runs against an in-memory database with example groups, and a
+// made up squid log, so that the UI can be tried out without squid.
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/store"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// Shared cache, so that all connections see the same database.
+	demoDB = "file:squidwarden_demo?mode=memory&cache=shared"
+
+	demoLogInterval = 2 * time.Second
+	demoLogHistory  = 300 // Entries written at start, over the last hour.
+)
+
+type demoGroup struct {
+	name     string
+	template string
+	def      bool // Default group.
+	sources  []demoSource
+}
+
+type demoSource struct {
+	source  string
+	comment string
+	clients []string // Addresses requests are made from.
+}
+
+var demoGroups = []demoGroup{
+	{
+		name:     "Kids",
+		template: "kids",
+		sources: []demoSource{
+			{"192.168.1.20/32", "Tablet", []string{"192.168.1.20"}},
+			{"192.168.1.21/32", "School laptop", []string{"192.168.1.21"}},
+		},
+	},
+	{
+		name:     "Guests",
+		template: "guests",
+		def:      true,
+		sources: []demoSource{
+			{"192.168.2.0/24", "Guest wifi", []string{"192.168.2.14", "192.168.2.37", "192.168.2.102"}},
+		},
+	},
+	{
+		name:     "Servers",
+		template: "servers-egress-only",
+		sources: []demoSource{
+			{"10.0.0.0/24", "Server VLAN", []string{"10.0.0.5", "10.0.0.6"}},
+		},
+	},
+}
+
+// Clients in no source, for the discovery page.
+var demoUnknownClients = []string{"192.168.3.7", "192.168.3.8"}
+
+var demoURLs = []string{
+	"https://en.wikipedia.org/",
+	"https://www.khanacademy.org/",
+	"https://scratch.mit.edu/",
+	"https://www.tiktok.com/",
+	"https://www.roblox.com/",
+	"https://dns.google/",
+	"https://www.google.com/",
+	"https://www.youtube.com/",
+	"https://github.com/",
+	"https://thepiratebay.org/",
+	"http://deb.debian.org/debian/dists/stable/InRelease",
+	"http://security.debian.org/debian-security/dists/stable-security/InRelease",
+	"https://download.docker.com/linux/debian/gpg",
+	"http://example.com/",
+	"http://neverssl.com/",
+}
+
+// OpenDemo returns an in-memory database with the schema and the demo
+// groups, created from the built in templates.
+func OpenDemo() (*sql.DB, error) {
+	d, err := store.Open(demoDB)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readFile(serverOpts.Schema)
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("reading schema: %v", err)
+	}
+	if _, err := d.Exec(string(b)); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("creating schema: %v", err)
+	}
+	if err := store.Update(d, seedDemo); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("seeding: %v", err)
+	}
+	return d, nil
+}
+
+func seedDemo(tx *sql.Tx) error {
+	for _, g := range demoGroups {
+		t, err := findGroupTemplate(g.template)
+		if err != nil {
+			return err
+		}
+		id, err := applyGroupTemplate(tx, t, g.name)
+		if err != nil {
+			return err
+		}
+		for _, s := range g.sources {
+			sid := uuid.NewV4().String()
+			if _, err := tx.Exec(`INSERT INTO sources(source_id, source, comment) VALUES(?,?,?)`, sid, s.source, s.comment); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO members(group_id, source_id) VALUES(?,?)`, string(id), sid); err != nil {
+				return err
+			}
+		}
+		if g.def {
+			if _, err := tx.Exec(`INSERT INTO defaultgroup(group_id) VALUES(?)`, string(id)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.Exec(`INSERT INTO settings(name, value) VALUES(?,?)`, settingSetupDone, "demo")
+	return err
+}
+
+func demoClients() []string {
+	var ret []string
+	for _, g := range demoGroups {
+		for _, s := range g.sources {
+			ret = append(ret, s.clients...)
+		}
+	}
+	return append(ret, demoUnknownClients...)
+}
+
+// writeDemoEntry writes a log line for a random request at t, allowed or
+// denied as the policy p says.
+func writeDemoEntry(w io.Writer, p *policy.Policy, clients []string, t time.Time) error {
+	client := clients[rand.Intn(len(clients))]
+	u := demoURLs[rand.Intn(len(demoURLs))]
+	req, err := policy.URLRequest(client, u)
+	if err != nil {
+		return err
+	}
+	d, err := p.Decide(req)
+	if err != nil {
+		return err
+	}
+	status, size, hier := "TCP_MISS/200", 1000+rand.Intn(100000), "HIER_DIRECT/192.0.2.80"
+	if req.Method == "CONNECT" {
+		status = "TCP_TUNNEL/200"
+	}
+	if d.Action != actionAllow {
+		status, size, hier = "TCP_DENIED/403", 3900, "HIER_NONE/-"
+	}
+	_, err = fmt.Fprintf(w, "%d.%03d %6d %s %s %d %s %s - %s -\n",
+		t.Unix(), t.Nanosecond()/1e6, 20+rand.Intn(500), client, status, size, req.Method, req.URI, hier)
+	return err
+}
+
+// StartDemoLog writes made up requests from the demo clients to fn: an
+// hour's worth right away, and then a new one every few seconds.
+func StartDemoLog(d *sql.DB, fn string) error {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	clients := demoClients()
+	now := time.Now()
+	p, err := policy.Load(d, now)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for n := 0; n < demoLogHistory; n++ {
+		t := now.Add(time.Duration(n-demoLogHistory) * time.Hour / demoLogHistory)
+		if err := writeDemoEntry(f, p, clients, t); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	go func() {
+		defer f.Close()
+		for range time.Tick(demoLogInterval) {
+			// Reload, so that policy changes made in the UI show up.
+			now := time.Now()
+			p, err := policy.Load(d, now)
+			if err != nil {
+				log.Printf("Demo: loading policy: %v", err)
+				continue
+			}
+			if err := writeDemoEntry(f, p, clients, now); err != nil {
+				log.Printf("Demo: writing log: %v", err)
+			}
+		}
+	}()
+	return nil
+}
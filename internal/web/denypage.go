@@ -0,0 +1,225 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Deny pages are squid error pages shown when a block rule in an ACL
+// matches. The helper tags such requests with the ACL, and the generated
+// config maps the tag to the ACL's page with deny_info.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Must match the helper.
+	aclTagPrefix = "sw_acl_"
+
+	denyPagePrefix = "ERR_SQUIDWARDEN_"
+)
+
+type denyPage struct {
+	ACL             acl
+	Title           string
+	Body            string
+	Contact         string
+	ExceptionLink   bool
+	ExceptionPrefix string
+	WhyLink         bool // Link to the why page, if it's on.
+}
+
+func getDenyPage(id aclID) (*denyPage, error) {
+	p := &denyPage{ACL: acl{ACLID: id}}
+	var contact sql.NullString
+	if err := db.QueryRow(`SELECT title, body, contact, exception_link FROM denypages WHERE acl_id=?`, string(id)).Scan(&p.Title, &p.Body, &contact, &p.ExceptionLink); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	p.Contact = contact.String
+	return p, nil
+}
+
+func getDenyPages() ([]denyPage, error) {
+	rows, err := db.Query(`
+SELECT denypages.acl_id, acls.comment, title, body, contact, exception_link
+FROM denypages
+JOIN acls ON denypages.acl_id=acls.acl_id
+ORDER BY denypages.acl_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []denyPage
+	for rows.Next() {
+		var p denyPage
+		var s string
+		var c, contact sql.NullString
+		if err := rows.Scan(&s, &c, &p.Title, &p.Body, &contact, &p.ExceptionLink); err != nil {
+			return nil, err
+		}
+		p.ACL = acl{ACLID: aclID(s), Comment: c.String}
+		p.Contact = contact.String
+		p.ExceptionPrefix = serverOpts.PublicURL
+		p.WhyLink = serverOpts.WhyPage
+		ret = append(ret, p)
+	}
+	return ret, rows.Err()
+}
+
+// generateDenyPageConf emits the deny_info for each ACL with a deny page.
+// This needs to be included after the 'http_access allow' of the helper.
+func generateDenyPageConf(w io.Writer) error {
+	pages, err := getDenyPages()
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\n# Deny pages.\n")
+	for _, p := range pages {
+		name := "sw_denied_" + string(p.ACL.ACLID)
+		fmt.Fprintf(w, "# %s\n", oneLine(p.ACL.Comment))
+		fmt.Fprintf(w, "acl %s tag %s%s\n", name, aclTagPrefix, p.ACL.ACLID)
+		fmt.Fprintf(w, "deny_info %s%s %s\n", denyPagePrefix, p.ACL.ACLID, name)
+		fmt.Fprintf(w, "http_access deny %s\n", name)
+	}
+	return nil
+}
+
+// writeDenyPages writes all deny pages to -squid_errors_dir.
+func writeDenyPages() error {
+	pages, err := getDenyPages()
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return nil
+	}
+	if serverOpts.SquidErrorsDir == "" {
+		return fmt.Errorf("deny pages configured, but -squid_errors_dir not set")
+	}
+	// Text template, because html/template would escape squid's %-codes
+	// in links. Deny page bodies are written by admins, and may use HTML.
+	tmpl := getTextTemplate("denypage.html", nil)
+	for _, p := range pages {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, &p); err != nil {
+			return fmt.Errorf("template execute fail: %v", err)
+		}
+		fn := path.Join(serverOpts.SquidErrorsDir, denyPagePrefix+string(p.ACL.ACLID))
+		if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		log.Printf("Wrote deny page %q", fn)
+	}
+	return nil
+}
+
+func denyPageHandler(r *http.Request) (template.HTML, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	data := struct {
+		ACL        acl
+		Page       *denyPage
+		ErrorsDir  string
+		PublicURL  string
+		Configured bool
+	}{
+		ErrorsDir: serverOpts.SquidErrorsDir,
+		PublicURL: serverOpts.PublicURL,
+	}
+	if err := db.QueryRow(`SELECT comment FROM acls WHERE acl_id=?`, string(id)).Scan(&data.ACL.Comment); err == sql.ErrNoRows {
+		return "", errHTTP{
+			external: "ACL not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return "", err
+	}
+	data.ACL.ACLID = id
+	var err error
+	if data.Page, err = getDenyPage(id); err != nil {
+		return "", err
+	}
+	data.Configured = data.Page != nil
+	if data.Page == nil {
+		data.Page = &denyPage{
+			Title:         "Access denied",
+			Body:          "<p>Access to <tt>%U</tt> is not allowed from this network.</p>",
+			ExceptionLink: true,
+		}
+	}
+	tmpl := getTemplate("denypage-edit.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func denyPageUpdateHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	var data struct {
+		Title         string `form:"title,required"`
+		Body          string `form:"body,required"`
+		Contact       string `form:"contact"`
+		ExceptionLink bool   `form:"exception_link"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	log.Printf("Updating deny page for ACL %s", id)
+	resp := struct {
+		ACL  string `json:"acl"`
+		Link string `json:"link"`
+	}{ACL: string(id), Link: "/acl/" + string(id) + "/denypage"}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if err := checkNotArchived(tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM denypages WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO denypages(acl_id, title, body, contact, exception_link) VALUES(?,?,?,?,?)`, string(id), data.Title, data.Body, data.Contact, data.ExceptionLink)
+		return err
+	})
+}
+
+func denyPageDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	log.Printf("Deleting deny page for ACL %s", id)
+	// The page file is left in place, since squid may still be using a
+	// config that references it.
+	resp := struct {
+		ACL     string `json:"acl"`
+		Deleted int64  `json:"deleted"`
+	}{ACL: string(id)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var err error
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM denypages WHERE acl_id=?`, string(id)))
+		return err
+	})
+}
@@ -0,0 +1,368 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The weekly digest emails what happened in the last week: policy changes,
+// the most denied domains, clients seen for the first time, and how much is
+// waiting for review. Users subscribe themselves, with the address they
+// want it at, on the digest page.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+const (
+	digestDays       = 7
+	digestMaxChanges = 50
+	digestMaxDenied  = 10
+	digestMaxClients = 20
+)
+
+type digestSubscription struct {
+	User    string
+	Email   string
+	Created string
+}
+
+type digestDenied struct {
+	Domain string
+	Denied int64
+}
+
+type digestClient struct {
+	Client    string
+	FirstSeen string
+	Hits      int64
+}
+
+type weeklyDigest struct {
+	From        string
+	To          string
+	Changes     []change
+	MoreChanges int
+	Stats       bool
+	Denied      []digestDenied
+	NewClients  []digestClient
+	MoreClients int
+	ReviewQueue int
+}
+
+// getDigest returns the digest of the digestDays before now, with times in
+// loc.
+func getDigest(now time.Time, loc *time.Location) (*weeklyDigest, error) {
+	since := now.AddDate(0, 0, -digestDays)
+	d := &weeklyDigest{
+		From:  formatTime(since, loc),
+		To:    formatTime(now, loc),
+		Stats: serverOpts.Stats,
+	}
+
+	var err error
+	if d.Changes, err = getChangesSince(since, digestMaxChanges, loc); err != nil {
+		return nil, err
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM changelog WHERE time >= ?`, since.Unix()).Scan(&n); err != nil {
+		return nil, err
+	}
+	d.MoreChanges = n - len(d.Changes)
+
+	if d.Stats {
+		if d.Denied, err = getDigestDenied(since); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.Query(`
+SELECT client, first_seen, hits
+FROM seenclients
+WHERE first_seen >= ?
+ORDER BY hits DESC, client`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c digestClient
+		var first int64
+		if err := rows.Scan(&c.Client, &first, &c.Hits); err != nil {
+			return nil, err
+		}
+		if len(d.NewClients) == digestMaxClients {
+			d.MoreClients++
+			continue
+		}
+		c.FirstSeen = formatUnix(first, loc)
+		d.NewClients = append(d.NewClients, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := db.QueryRow(`SELECT COUNT(*) FROM reviewqueue`).Scan(&d.ReviewQueue); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// getDigestDenied returns the most denied domains since since.
+func getDigestDenied(since time.Time) ([]digestDenied, error) {
+	rows, err := db.Query(`
+SELECT host, SUM(denied)
+FROM (
+  SELECT host, denied FROM trafficstats WHERE hour >= ? AND denied > 0
+  UNION ALL
+  SELECT host, denied FROM trafficlog WHERE time >= ? AND denied
+)
+GROUP BY host`, since.Unix(), since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	domains := make(map[string]int64)
+	for rows.Next() {
+		var host string
+		var denied int64
+		if err := rows.Scan(&host, &denied); err != nil {
+			return nil, err
+		}
+		domains[squidlog.HostToDomain(host)] += denied
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var ret []digestDenied
+	for d, n := range domains {
+		ret = append(ret, digestDenied{Domain: d, Denied: n})
+	}
+	sort.Sort(digestByDenied(ret))
+	if len(ret) > digestMaxDenied {
+		ret = ret[:digestMaxDenied]
+	}
+	return ret, nil
+}
+
+// digestByDenied sorts domains by denials, most first.
+type digestByDenied []digestDenied
+
+func (a digestByDenied) Len() int      { return len(a) }
+func (a digestByDenied) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a digestByDenied) Less(i, j int) bool {
+	if a[i].Denied != a[j].Denied {
+		return a[i].Denied > a[j].Denied
+	}
+	return a[i].Domain < a[j].Domain
+}
+
+// renderDigest returns the digest as HTML, without the page around it.
+func renderDigest(d *weeklyDigest) (string, error) {
+	var buf bytes.Buffer
+	if err := getTemplate("digest-email.html", nil).Execute(&buf, d); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return buf.String(), nil
+}
+
+func getDigestSubscriptions(loc *time.Location) ([]digestSubscription, error) {
+	rows, err := db.Query(`SELECT user, email, created FROM digestsubscriptions ORDER BY user`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []digestSubscription
+	for rows.Next() {
+		var s digestSubscription
+		var created int64
+		if err := rows.Scan(&s.User, &s.Email, &created); err != nil {
+			return nil, err
+		}
+		s.Created = formatUnix(created, loc)
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
+
+// sendDigest emails the digest to every subscriber, one at a time so that
+// they don't see each other's addresses. It only fails if nobody got it,
+// so that a retry doesn't send it twice.
+func sendDigest(j *jobRun) error {
+	subs, err := getDigestSubscriptions(displayZone())
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		j.logf("No subscribers")
+		return nil
+	}
+	d, err := getDigest(time.Now(), displayZone())
+	if err != nil {
+		return err
+	}
+	body, err := renderDigest(d)
+	if err != nil {
+		return err
+	}
+	body = "<html><body>\n" + body + "</body></html>\n"
+	subject := fmt.Sprintf("squidwarden weekly digest, %s to %s", d.From, d.To)
+	sent := 0
+	for _, s := range subs {
+		if err := sendMail([]string{s.Email}, subject, "text/html", body); err != nil {
+			j.logf("Failed to email %s for %q: %v", s.Email, s.User, err)
+			continue
+		}
+		sent++
+	}
+	j.logf("Emailed %d of %d subscribers", sent, len(subs))
+	if sent == 0 {
+		return fmt.Errorf("failed to email all %d subscribers", len(subs))
+	}
+	return nil
+}
+
+// nextDigestTime returns the first time after now on day (e.g. "mon") at
+// clock (HH:MM).
+func nextDigestTime(now time.Time, day, clock string) (time.Time, error) {
+	wd, err := policy.ParseWeekday(day)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := nextSyncTime(now, clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for t.Weekday() != wd {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// digestScheduler queues the digest every week.
+func digestScheduler() {
+	if serverOpts.DigestDay == "" {
+		return
+	}
+	for {
+		next, err := nextDigestTime(time.Now().In(scheduleZone()), serverOpts.DigestDay, serverOpts.DigestTime)
+		if err != nil {
+			log.Fatalf("Invalid -digest_day %q or -digest_time %q: %v", serverOpts.DigestDay, serverOpts.DigestTime, err)
+		}
+		time.Sleep(next.Sub(time.Now()))
+		if _, err := enqueueJob(jobDigest, ""); err != nil {
+			log.Printf("Failed to queue weekly digest: %v", err)
+		}
+	}
+}
+
+func digestHandler(r *http.Request) (template.HTML, error) {
+	user := remoteUser(r)
+	data := struct {
+		User       string
+		Email      string
+		Scheduled  string
+		Configured bool
+		Admin      bool
+		Subs       []digestSubscription
+	}{
+		User:       user,
+		Configured: serverOpts.DigestDay != "",
+		Admin:      requestPermission(r) >= permAdmin,
+	}
+	if data.Configured {
+		data.Scheduled = serverOpts.DigestDay + " " + serverOpts.DigestTime
+	}
+	if err := db.QueryRow(`SELECT email FROM digestsubscriptions WHERE user=?`, user).Scan(&data.Email); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if data.Admin {
+		var err error
+		if data.Subs, err = getDigestSubscriptions(requestZone(r)); err != nil {
+			return "", err
+		}
+	}
+	tmpl := getTemplate("digest.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func digestPreviewHandler(r *http.Request) (template.HTML, error) {
+	d, err := getDigest(time.Now(), requestZone(r))
+	if err != nil {
+		return "", err
+	}
+	s, err := renderDigest(d)
+	return template.HTML(s), err
+}
+
+// digestSubscribeHandler subscribes the user making the request, or
+// changes their address.
+func digestSubscribeHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Email string `form:"email,required,trim,max=254"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	if a, err := mail.ParseAddress(data.Email); err != nil || a.Name != "" || strings.ContainsAny(data.Email, "<>") {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("%q is not an email address", data.Email),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"email": "not an email address"}},
+		}
+	}
+	user := remoteUser(r)
+	log.Printf("Subscribing %q to the weekly digest at %s", user, data.Email)
+	if _, err := db.Exec(`INSERT OR REPLACE INTO digestsubscriptions(user, email, created) VALUES(?,?,?)`, user, data.Email, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	return &struct {
+		User  string `json:"user"`
+		Email string `json:"email"`
+	}{
+		User:  user,
+		Email: data.Email,
+	}, nil
+}
+
+// digestUnsubscribeHandler unsubscribes the user making the request.
+func digestUnsubscribeHandler(r *http.Request) (interface{}, error) {
+	user := remoteUser(r)
+	log.Printf("Unsubscribing %q from the weekly digest", user)
+	resp := struct {
+		User    string `json:"user"`
+		Deleted int64  `json:"deleted"`
+	}{User: user}
+	var err error
+	if resp.Deleted, err = rowsAffected(db.Exec(`DELETE FROM digestsubscriptions WHERE user=?`, user)); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
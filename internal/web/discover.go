@@ -0,0 +1,259 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Source discovery keeps track of every client in the squid log, so that
+// the ones not in any group's sources can be shown, busiest first, and
+// added to a group with one click.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/google/squidwarden/internal/store"
+)
+
+const discoverFlushInterval = time.Minute
+
+type seenClient struct {
+	first, last  int64
+	hits, denied int64
+}
+
+// clientTracker counts requests per client in memory, between flushes.
+type clientTracker struct {
+	ingest *logIngester // Nil in tests.
+
+	mu      sync.Mutex
+	pending map[string]*seenClient
+}
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{pending: make(map[string]*seenClient)}
+}
+
+func (c *clientTracker) add(e *squidlog.Entry) {
+	t, err := time.Parse(squidlog.TimeFormat, e.Time)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(e.Client)
+	if ip == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.pending[ip.String()]
+	if s == nil {
+		s = &seenClient{first: t.Unix()}
+		c.pending[ip.String()] = s
+	}
+	s.last = t.Unix()
+	s.hits++
+	if strings.Contains(e.Status, "DENIED") {
+		s.denied++
+	}
+}
+
+func (c *clientTracker) flush(now time.Time) error {
+	var p map[string]*seenClient
+	offsets := c.ingest.checkpoint(func() {
+		c.mu.Lock()
+		p = c.pending
+		c.pending = make(map[string]*seenClient)
+		c.mu.Unlock()
+	})
+
+	return store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		for client, s := range p {
+			n, err := rowsAffected(tx.Exec(`
+UPDATE seenclients SET last_seen=MAX(last_seen, ?), hits=hits+?, denied=denied+?
+WHERE client=?`, s.last, s.hits, s.denied, client))
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				continue
+			}
+			if _, err := tx.Exec(`INSERT INTO seenclients(client, first_seen, last_seen, hits, denied) VALUES(?,?,?,?,?)`, client, s.first, s.last, s.hits, s.denied); err != nil {
+				return err
+			}
+		}
+		if serverOpts.DiscoverDays > 0 {
+			if _, err := tx.Exec(`DELETE FROM seenclients WHERE last_seen < ?`, now.AddDate(0, 0, -serverOpts.DiscoverDays).Unix()); err != nil {
+				return err
+			}
+		}
+		return c.ingest.saveOffsets(tx, offsets)
+	})
+}
+
+func (c *clientTracker) run() {
+	for range time.Tick(discoverFlushInterval) {
+		if err := c.flush(time.Now()); err != nil {
+			log.Printf("Failed to flush seen clients: %v", err)
+		}
+	}
+}
+
+func startDiscovery() {
+	if !serverOpts.Discover || !ingestConfigured() {
+		return
+	}
+	c := newClientTracker()
+	c.ingest = newLogIngester("discover", c.add)
+	go c.run()
+	go c.ingest.run()
+}
+
+type unknownClient struct {
+	Client    string `json:"client"`
+	Source    string `json:"source"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	Hits      int64  `json:"hits"`
+	Denied    int64  `json:"denied"`
+}
+
+type unknownClientsByHits []unknownClient
+
+func (a unknownClientsByHits) Len() int      { return len(a) }
+func (a unknownClientsByHits) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a unknownClientsByHits) Less(i, j int) bool {
+	if a[i].Hits != a[j].Hits {
+		return a[i].Hits > a[j].Hits
+	}
+	return a[i].Client < a[j].Client
+}
+
+// getGroupedSources returns the sources that are in any group.
+func getGroupedSources() ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT sources.source FROM sources JOIN members ON sources.source_id=members.source_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
+
+// getUnknownClients returns the seen clients not in a source of any group,
+// busiest first, with times in loc.
+func getUnknownClients(limit int, loc *time.Location) ([]unknownClient, error) {
+	grouped, err := getGroupedSources()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT client, first_seen, last_seen, hits, denied FROM seenclients`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []unknownClient{}
+	for rows.Next() {
+		var c unknownClient
+		var first, last int64
+		if err := rows.Scan(&c.Client, &first, &last, &c.Hits, &c.Denied); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(c.Client)
+		if ip == nil {
+			// Anonymized.
+			continue
+		}
+		known := false
+		for _, s := range grouped {
+			if sourceContains(s, ip) {
+				known = true
+				break
+			}
+		}
+		if known {
+			continue
+		}
+		c.Source = hostSource(ip)
+		c.FirstSeen = formatUnix(first, loc)
+		c.LastSeen = formatUnix(last, loc)
+		ret = append(ret, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(unknownClientsByHits(ret))
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+const defaultUnknownClients = 200
+
+func parseUnknownLimit(r *http.Request) int {
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n > 0 {
+		return n
+	}
+	return defaultUnknownClients
+}
+
+func discoverHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Enabled bool
+		Clients []unknownClient
+		Groups  []group
+	}{Enabled: serverOpts.Discover && ingestConfigured()}
+	var err error
+	if data.Clients, err = getUnknownClients(parseUnknownLimit(r), requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.Groups, _, err = getGroups(""); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("discover.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func discoverJSONHandler(r *http.Request) (interface{}, error) {
+	c, err := getUnknownClients(parseUnknownLimit(r), requestZone(r))
+	if err != nil {
+		return nil, err
+	}
+	return &struct {
+		Clients []unknownClient `json:"clients"`
+	}{c}, nil
+}
@@ -0,0 +1,425 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The doctor checks an installation for the problems that otherwise only
+// show up later, as odd errors or an empty UI: a database with an old
+// schema or broken references, missing or broken templates, an unreadable
+// squid log, and missing squid commands. Every problem comes with what to
+// do about it.
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template/parse"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/google/squidwarden/internal/store"
+)
+
+// doctor collects the results of checks.
+type doctor struct {
+	w        io.Writer
+	problems int
+}
+
+func (d *doctor) ok(check, format string, a ...interface{}) {
+	fmt.Fprintf(d.w, "OK    %s: %s\n", check, fmt.Sprintf(format, a...))
+}
+
+func (d *doctor) warn(check, msg, fix string) {
+	fmt.Fprintf(d.w, "WARN  %s: %s\n", check, msg)
+	if fix != "" {
+		fmt.Fprintf(d.w, "      Fix: %s\n", fix)
+	}
+}
+
+func (d *doctor) fail(check, msg, fix string) {
+	d.problems++
+	fmt.Fprintf(d.w, "FAIL  %s: %s\n", check, msg)
+	if fix != "" {
+		fmt.Fprintf(d.w, "      Fix: %s\n", fix)
+	}
+}
+
+// Doctor checks the database in dbFile and the files and commands the UI
+// is configured to use, writes what it found to w, and returns the number
+// of problems.
+func Doctor(dbFile string, opts Options, w io.Writer) int {
+	serverOpts = opts
+	d := &doctor{w: w}
+	d.checkFiles(opts)
+	if db := d.openDB(dbFile); db != nil {
+		d.checkSchema(db)
+		d.checkIntegrity(db)
+		db.Close()
+	}
+	d.checkSquidLog(opts.SquidLog)
+	d.checkCommands()
+	d.checkDirs()
+	if d.problems == 0 {
+		fmt.Fprintf(w, "No problems found.\n")
+	} else {
+		fmt.Fprintf(w, "Problems found: %d.\n", d.problems)
+	}
+	return d.problems
+}
+
+func (d *doctor) openDB(fn string) *sql.DB {
+	const check = "database"
+	if fn == "" {
+		d.fail(check, "no database given", "pass -db=/path/to/squidwarden.sqlite")
+		return nil
+	}
+	if _, err := os.Stat(fn); err != nil {
+		d.fail(check, err.Error(), "check -db, or create the database with the setup wizard or 'sqlite3 "+fn+" < sqlite.schema'")
+		return nil
+	}
+	db, err := store.Open(fn)
+	if err != nil {
+		d.fail(check, err.Error(), "check the permissions of "+fn+" and its directory")
+		return nil
+	}
+	rev, err := store.Revision(db)
+	if err != nil {
+		d.fail(check, fmt.Sprintf("can't read the policy revision: %v", err), "check that -db is a squidwarden database")
+		db.Close()
+		return nil
+	}
+	d.ok(check, "%s, policy revision %d", fn, rev)
+	return db
+}
+
+// tableColumns returns the columns of every table in db.
+func tableColumns(db *sql.DB) (map[string][]string, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]string)
+	for _, t := range tables {
+		cols, err := func() ([]string, error) {
+			rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, t)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+			var cols []string
+			for rows.Next() {
+				var c string
+				if err := rows.Scan(&c); err != nil {
+					return nil, err
+				}
+				cols = append(cols, c)
+			}
+			return cols, rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+		ret[t] = cols
+	}
+	return ret, nil
+}
+
+// schemaDiff returns what's in want but not in got, as "table" or
+// "table.column", sorted.
+func schemaDiff(want, got map[string][]string) []string {
+	var ret []string
+	for t, cols := range want {
+		have, ok := got[t]
+		if !ok {
+			ret = append(ret, t)
+			continue
+		}
+		hs := make(map[string]bool)
+		for _, c := range have {
+			hs[c] = true
+		}
+		for _, c := range cols {
+			if !hs[c] {
+				ret = append(ret, t+"."+c)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// checkSchema compares the database with a fresh one from -schema.
+func (d *doctor) checkSchema(db *sql.DB) {
+	const check = "schema"
+	b, err := readFile(serverOpts.Schema)
+	if err != nil {
+		d.warn(check, fmt.Sprintf("can't read the schema to compare with: %v", err), "pass -schema=/path/to/sqlite.schema")
+		return
+	}
+	fresh, err := store.Open(":memory:")
+	if err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	defer fresh.Close()
+	// Every connection gets its own in-memory database.
+	fresh.SetMaxOpenConns(1)
+	if _, err := fresh.Exec(string(b)); err != nil {
+		d.warn(check, fmt.Sprintf("%s doesn't load: %v", serverOpts.Schema, err), "pass -schema with the sqlite.schema of this version")
+		return
+	}
+	want, err := tableColumns(fresh)
+	if err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	got, err := tableColumns(db)
+	if err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	if missing := schemaDiff(want, got); len(missing) > 0 {
+		d.fail(check, "the database is older than this version, it lacks "+strings.Join(missing, ", "),
+			"back up the database, then start the UI with this -schema, which adds them")
+		return
+	}
+	d.ok(check, "all %d tables of %s are there", len(want), serverOpts.Schema)
+}
+
+func (d *doctor) checkIntegrity(db *sql.DB) {
+	const check = "integrity"
+	var res string
+	if err := db.QueryRow(`PRAGMA quick_check`).Scan(&res); err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	if res != "ok" {
+		d.fail(check, "the database is corrupt: "+res, "restore from a backup, or try 'sqlite3 db .recover'")
+		return
+	}
+	rows, err := db.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	defer rows.Close()
+	bad := make(map[string]int)
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fk int
+		if err := rows.Scan(&table, &rowid, &parent, &fk); err != nil {
+			d.fail(check, err.Error(), "")
+			return
+		}
+		bad[table+" → "+parent]++
+	}
+	if err := rows.Err(); err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	if len(bad) > 0 {
+		var s []string
+		for k, n := range bad {
+			s = append(s, fmt.Sprintf("%s (%d rows)", k, n))
+		}
+		sort.Strings(s)
+		d.fail(check, "rows refer to rows that are gone: "+strings.Join(s, ", "),
+			"back up the database, and delete the rows 'PRAGMA foreign_key_check' lists")
+		return
+	}
+	d.ok(check, "no corruption or broken references")
+}
+
+// templateNames returns the templates there are, in memory or on disk.
+func templateNames(dir string) []string {
+	names := make(map[string]bool)
+	if serverOpts.MemFiles {
+		for fn := range internalFiles {
+			if strings.HasPrefix(fn, "templates/") {
+				names[strings.TrimPrefix(fn, "templates/")] = true
+			}
+		}
+	}
+	if serverOpts.DiskFiles {
+		if fs, err := ioutil.ReadDir(dir); err == nil {
+			for _, f := range fs {
+				if strings.HasSuffix(f.Name(), ".html") {
+					names[f.Name()] = true
+				}
+			}
+		}
+	}
+	var ret []string
+	for n := range names {
+		ret = append(ret, n)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// checkFiles checks that the theme, static files and templates load, and
+// that the templates, including any themed ones, parse.
+func (d *doctor) checkFiles(opts Options) {
+	if err := CheckFiles(opts); err != nil {
+		d.fail("files", err.Error(), "run from the directory with templates/ and static/, or pass -templates and -static")
+		return
+	}
+	const check = "templates"
+	names := templateNames(opts.Templates)
+	var broken []string
+	for _, n := range names {
+		b, err := readThemed("templates", opts.Templates, n)
+		if err == nil {
+			t := parse.New(n)
+			t.Mode = parse.SkipFuncCheck
+			_, err = t.Parse(string(b), "", "", make(map[string]*parse.Tree))
+		}
+		if err != nil {
+			broken = append(broken, fmt.Sprintf("%s: %v", n, err))
+		}
+	}
+	if len(broken) > 0 {
+		fix := "reinstall the templates of this version"
+		if serverOpts.Theme != "" {
+			fix = "fix or remove the template overrides in " + path.Join(serverOpts.Theme, "templates")
+		}
+		d.fail(check, strings.Join(broken, "; "), fix)
+		return
+	}
+	d.ok(check, "%d templates parse", len(names))
+}
+
+func (d *doctor) checkSquidLog(fn string) {
+	const check = "squid log"
+	if fn == "" {
+		d.warn(check, "no -squidlog, so there's no tail, stats, learning or alerts", "pass -squidlog=/var/log/squid3/access.log")
+		return
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) && syslogEnabled() {
+		d.ok(check, "%s will be created when squid logs arrive over syslog", fn)
+		return
+	}
+	if err != nil {
+		d.fail(check, err.Error(), "check -squidlog, and that the UI's user can read it, e.g. is in group proxy")
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	lines, err := squidlog.ReadLinesBefore(f, st.Size(), 1, 64<<10)
+	if err != nil {
+		d.fail(check, err.Error(), "")
+		return
+	}
+	if len(lines) == 0 {
+		d.ok(check, "%s is readable, but empty", fn)
+		return
+	}
+	if _, err := squidlog.Parse(lines[0].Text); err != nil {
+		d.fail(check, fmt.Sprintf("can't parse the last line of %s: %v", fn, err), "use squid's native log format: 'access_log daemon:"+fn+" squid'")
+		return
+	}
+	d.ok(check, "%s is readable and parses", fn)
+}
+
+// checkCommands checks that squid and the reload commands can be found.
+func (d *doctor) checkCommands() {
+	found := ""
+	for _, b := range []string{"squid", "squid3"} {
+		if p, err := exec.LookPath(b); err == nil {
+			found = p
+			break
+		}
+	}
+	if found == "" {
+		d.warn("squid", "neither squid nor squid3 is in $PATH", "fine if squid runs elsewhere, e.g. with cmd/agent; otherwise install squid")
+	} else {
+		d.ok("squid", "%s", found)
+	}
+	for _, c := range []struct{ flag, cmd string }{
+		{"-squid_reconfigure", serverOpts.SquidReconfigure},
+		{"-firewall_reload", serverOpts.FirewallReload},
+	} {
+		if c.cmd == "" {
+			continue
+		}
+		args := strings.Fields(c.cmd)
+		if _, err := exec.LookPath(args[0]); err != nil {
+			d.fail(c.flag, err.Error(), "use the full path of the command in "+c.flag)
+			continue
+		}
+		d.ok(c.flag, "%s found", args[0])
+	}
+}
+
+// checkDirs checks that the UI can write where it's configured to.
+func (d *doctor) checkDirs() {
+	for _, c := range []struct {
+		flag string
+		dir  string
+	}{
+		{"-squid_conf", dirOf(serverOpts.SquidConf)},
+		{"-firewall_conf", dirOf(serverOpts.FirewallConf)},
+		{"-bundle_file", dirOf(serverOpts.BundleFile)},
+		{"-acl_files_dir", serverOpts.ACLFilesDir},
+		{"-squid_errors_dir", serverOpts.SquidErrorsDir},
+		{"-backup_dir", serverOpts.BackupDir},
+	} {
+		if c.dir == "" {
+			continue
+		}
+		f, err := ioutil.TempFile(c.dir, ".squidwarden")
+		if err != nil {
+			d.fail(c.flag, err.Error(), "create "+c.dir+", writable by the UI's user")
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+		d.ok(c.flag, "%s is writable", c.dir)
+	}
+}
+
+// dirOf returns the directory of fn, or "" if fn is "".
+func dirOf(fn string) string {
+	if fn == "" {
+		return ""
+	}
+	return filepath.Dir(fn)
+}
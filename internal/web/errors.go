@@ -0,0 +1,178 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+type errHTTPLink struct {
+	Text string `json:"text"`
+	Link string `json:"link"`
+}
+
+// errHTTP is an error to show to the user. Only external is shown, and
+// internal is only logged.
+type errHTTP struct {
+	external string
+	internal error
+	code     int
+	links    []errHTTPLink
+
+	// reason overrides the machine-readable error code, which otherwise
+	// follows from the HTTP status code.
+	reason string
+
+	// details is extra data for API clients, e.g. the ID of a
+	// conflicting object.
+	details interface{}
+}
+
+func (e errHTTP) Error() string {
+	log.Printf("errHTTP converted to error, losing internal info: %v", e.internal)
+	return e.external
+}
+
+// Machine-readable error codes.
+const (
+	errCodeInvalid         = "invalid"
+	errCodeUnauthenticated = "unauthenticated"
+	errCodeForbidden       = "forbidden"
+	errCodeNotFound        = "not_found"
+	errCodeConflict        = "conflict"
+	errCodeTooMany         = "too_many_requests"
+	errCodeNotImplemented  = "not_implemented"
+	errCodeUpstream        = "upstream"
+	errCodeInternal        = "internal"
+)
+
+func errCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return errCodeInvalid
+	case http.StatusUnauthorized:
+		return errCodeUnauthenticated
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusConflict:
+		return errCodeConflict
+	case http.StatusTooManyRequests:
+		return errCodeTooMany
+	case http.StatusNotImplemented:
+		return errCodeNotImplemented
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return errCodeUpstream
+	}
+	if status >= 500 {
+		return errCodeInternal
+	}
+	return errCodeInvalid
+}
+
+// apiError is the body of all JSON API error replies, as
+// {"error": {...}}.
+type apiError struct {
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Details   interface{}   `json:"details,omitempty"`
+	Links     []errHTTPLink `json:"links,omitempty"`
+	RequestID string        `json:"request_id"`
+}
+
+// reRequestID is what's accepted as a request ID from a frontend proxy.
+var reRequestID = regexp.MustCompile(`^[\w.-]{1,64}$`)
+
+// requestID returns the ID to log and return with errors for r. It's
+// taken from X-Request-Id if the frontend proxy sets it.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); reRequestID.MatchString(id) {
+		return id
+	}
+	return uuid.NewV4().String()
+}
+
+// newAPIError logs err and turns it into what the client sees.
+// Errors other than errHTTP are internal errors.
+func newAPIError(r *http.Request, err error) (int, *apiError) {
+	id := requestID(r)
+	e, ok := err.(errHTTP)
+	if !ok {
+		log.Printf("Error in HTTP handler for %s %s (request %s): %v", r.Method, r.URL.Path, id, err)
+		return http.StatusInternalServerError, &apiError{
+			Code:      errCodeInternal,
+			Message:   "Internal error",
+			RequestID: id,
+		}
+	}
+	log.Printf("HTTP error for %s %s (request %s). External: %q Code: %d. Internal: %v", r.Method, r.URL.Path, id, e.external, e.code, e.internal)
+	code := e.reason
+	if code == "" {
+		code = errCode(e.code)
+	}
+	return e.code, &apiError{
+		Code:      code,
+		Message:   e.external,
+		Details:   e.details,
+		Links:     e.links,
+		RequestID: id,
+	}
+}
+
+// writeJSONError replies with err in the JSON error envelope.
+func writeJSONError(w http.ResponseWriter, r *http.Request, err error) {
+	status, e := newAPIError(r, err)
+	b, err := json.Marshal(struct {
+		Error *apiError `json:"error"`
+	}{e})
+	if err != nil {
+		log.Printf("Error marshalling JSON error reply: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Request-Id", e.RequestID)
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		log.Printf("Failed to write JSON error reply: %v", err)
+	}
+}
+
+// wantsJSON returns true for requests from the UI's JS or from API
+// clients, as opposed to a browser loading a page.
+func wantsJSON(r *http.Request) bool {
+	return r.Header.Get("X-Requested-With") == "XMLHttpRequest" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// httpError replies with err as JSON to API requests, and as plain text
+// otherwise. It's for wrappers that serve both pages and API routes.
+func httpError(w http.ResponseWriter, r *http.Request, err error) {
+	if wantsJSON(r) {
+		writeJSONError(w, r, err)
+		return
+	}
+	status, e := newAPIError(r, err)
+	w.Header().Set("X-Request-Id", e.RequestID)
+	http.Error(w, e.Message, status)
+}
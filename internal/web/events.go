@@ -0,0 +1,150 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+)
+
+const (
+	// How often to look for changes made by other processes (e.g. mkacl).
+	revisionPollInterval = time.Second
+
+	// Send a comment this often so that proxies don't time out idle streams.
+	eventKeepalive = 30 * time.Second
+)
+
+// events fans out policy revision changes to all open event streams.
+var events = newEventHub()
+
+type eventHub struct {
+	mu       sync.Mutex
+	revision int64
+	subs     map[chan int64]bool
+	poke     chan struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: make(map[chan int64]bool),
+		poke: make(chan struct{}, 1),
+	}
+}
+
+func (h *eventHub) subscribe() (chan int64, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := make(chan int64, 1)
+	h.subs[c] = true
+	return c, h.revision
+}
+
+func (h *eventHub) unsubscribe(c chan int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, c)
+}
+
+// notify asks the hub to check for a new revision right away, instead of
+// waiting for the next poll.
+func (h *eventHub) notify() {
+	select {
+	case h.poke <- struct{}{}:
+	default:
+	}
+}
+
+func (h *eventHub) set(rev int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rev == h.revision {
+		return
+	}
+	h.revision = rev
+	for c := range h.subs {
+		// Only the latest revision matters, so replace anything not yet sent.
+		select {
+		case <-c:
+		default:
+		}
+		c <- rev
+	}
+}
+
+// run polls the revision counter forever.
+func (h *eventHub) run() {
+	for {
+		rev, err := store.Revision(db)
+		if err != nil {
+			log.Printf("Failed to read revision: %v", err)
+		} else {
+			h.set(rev)
+		}
+		select {
+		case <-h.poke:
+		case <-time.After(revisionPollInterval):
+		}
+	}
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	c, rev := events.subscribe()
+	defer events.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(rev int64) error {
+		if _, err := fmt.Fprintf(w, "event: revision\ndata: {\"revision\": %d}\n\n", rev); err != nil {
+			return err
+		}
+		f.Flush()
+		return nil
+	}
+	if err := send(rev); err != nil {
+		return
+	}
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rev := <-c:
+			if err := send(rev); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Exception requests are submitted by end users, typically by following
+// the link on a deny page. Unlike the rest of the UI the submission page
+// is meant to be reachable without admin access.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	exceptionPending  = "pending"
+	exceptionApproved = "approved"
+	exceptionRejected = "rejected"
+
+	// Limit how much a single client can fill up the queue.
+	maxPendingExceptions = 10
+
+	maxJustification = 2000
+)
+
+type exceptionID string
+type exceptionRequest struct {
+	ExceptionID   exceptionID
+	Client        string
+	URL           string
+	Type          string
+	Host          string
+	Domain        string
+	Justification string
+	Created       string
+	Status        string
+	RuleID        ruleID
+}
+
+func assertExceptionID(s string) exceptionID { return exceptionID(assertUUID(s)) }
+
+// clientAddr returns the address of the end user. The X-Real-IP and
+// X-Forwarded-For headers are only believed from -trusted_proxy, since
+// anyone else can set them to whatever address they like.
+func clientAddr(r *http.Request) string {
+	h, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		h = r.RemoteAddr
+	}
+	if !trustedProxyAddr(h) {
+		return h
+	}
+	if s := r.Header.Get("X-Real-IP"); s != "" {
+		return s
+	}
+	if s := r.Header.Get("X-Forwarded-For"); s != "" {
+		// The proxy appends who it got the request from.
+		l := strings.Split(s, ",")
+		return strings.TrimSpace(l[len(l)-1])
+	}
+	return h
+}
+
+// trustedProxyAddr returns true if addr is one of -trusted_proxy.
+func trustedProxyAddr(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, p := range strings.Split(serverOpts.TrustedProxy, ",") {
+		p = strings.TrimSpace(p)
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpiry parses how long an approved exception should last. Empty
+// means forever. In addition to time.ParseDuration units, "d" is days.
+func parseExpiry(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid number of days in %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("expiry %q is not positive", s)
+	}
+	return d, nil
+}
+
+// getExceptionRequests returns pending, or already decided, requests, with
+// times in loc.
+func getExceptionRequests(pending bool, limit int, loc *time.Location) ([]exceptionRequest, error) {
+	op := "="
+	if !pending {
+		op = "!="
+	}
+	rows, err := db.Query(`
+SELECT request_id, client, url, justification, created, status, rule_id
+FROM exceptionrequests
+WHERE status`+op+`?
+ORDER BY created DESC
+LIMIT ?`, exceptionPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []exceptionRequest
+	for rows.Next() {
+		var e exceptionRequest
+		var id string
+		var created int64
+		var rule sql.NullString
+		if err := rows.Scan(&id, &e.Client, &e.URL, &e.Justification, &created, &e.Status, &rule); err != nil {
+			return nil, err
+		}
+		e.ExceptionID = exceptionID(id)
+		e.Created = formatUnix(created, loc)
+		e.RuleID = ruleID(rule.String)
+		e.Type, e.Host = uriTarget(e.URL)
+		if e.Host != "" {
+			e.Domain = squidlog.HostToDomain(e.Host)
+		}
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+// exceptionFormHandler is the end-user facing page. It's not wrapped in
+// the admin page template.
+func exceptionFormHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		CSRF          string
+		URL           string
+		Justification string
+		Client        string
+		Submitted     bool
+		Error         string
+	}{
+		CSRF:          csrf.Token(r),
+		URL:           r.FormValue("url"),
+		Justification: r.FormValue("justification"),
+		Client:        clientAddr(r),
+	}
+	if r.Method == "POST" {
+		if err := submitException(data.Client, data.URL, data.Justification); err != nil {
+			if e, ok := err.(errHTTP); ok {
+				log.Printf("Exception request rejected: %q. Internal: %v", e.external, e.internal)
+				data.Error = e.external
+				w.WriteHeader(e.code)
+			} else {
+				log.Printf("Failed to store exception request: %v", err)
+				data.Error = "Internal error. Please try again later."
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		} else {
+			data.Submitted = true
+		}
+	}
+	tmpl := getTemplate("exception.html", nil)
+	if err := tmpl.Execute(w, &data); err != nil {
+		log.Printf("template execute fail: %v", err)
+	}
+}
+
+func submitException(client, u, justification string) error {
+	if typ, _ := uriTarget(u); typ == "" {
+		return errHTTP{
+			external: "Please enter the full address that was blocked.",
+			code:     http.StatusBadRequest,
+		}
+	}
+	if strings.TrimSpace(justification) == "" {
+		return errHTTP{
+			external: "Please say why you need access.",
+			code:     http.StatusBadRequest,
+		}
+	}
+	if len(justification) > maxJustification {
+		return errHTTP{
+			external: fmt.Sprintf("Justification is too long, max %d characters.", maxJustification),
+			code:     http.StatusBadRequest,
+		}
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM exceptionrequests WHERE client=? AND status=?`, client, exceptionPending).Scan(&n); err != nil {
+		return err
+	}
+	if n >= maxPendingExceptions {
+		return errHTTP{
+			internal: fmt.Errorf("client %q has %d pending requests", client, n),
+			external: "You already have too many requests waiting for review.",
+			code:     http.StatusTooManyRequests,
+		}
+	}
+	id := uuid.NewV4().String()
+	log.Printf("Exception request %s from %s for %q", id, client, u)
+	_, err := db.Exec(`INSERT INTO exceptionrequests(request_id, client, url, justification, created, status) VALUES(?,?,?,?,?,?)`, id, client, u, justification, time.Now().Unix(), exceptionPending)
+	return err
+}
+
+func exceptionsHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Pending []exceptionRequest
+		Decided []exceptionRequest
+		ACLs    []acl
+		NewACL  aclID
+	}{
+		NewACL: newACLID,
+	}
+	var err error
+	if data.Pending, err = getExceptionRequests(true, 1000, requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.Decided, err = getExceptionRequests(false, 50, requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.ACLs, err = getACLs(); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("exceptions.html", template.FuncMap{
+		"aclIDEQ": func(a, b aclID) bool { return a == b },
+	})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// exceptionApproveHandler turns a request into an allow rule, optionally
+// expiring after a while.
+func exceptionApproveHandler(r *http.Request) (interface{}, error) {
+	id := assertExceptionID(mux.Vars(r)["exceptionID"])
+	var data struct {
+		Type   string `form:"type,required,enum=type"`
+		Value  string `form:"value,required"`
+		ACL    string `form:"acl,required,uuid"`
+		Expiry string `form:"expiry"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	expiry, err := parseExpiry(data.Expiry)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid expiry %q", data.Expiry),
+			code:     http.StatusBadRequest,
+		}
+	}
+
+	resp := struct {
+		Rule string `json:"rule"`
+	}{}
+	log.Printf("Approving exception request %s as %s %q in ACL %s, expiry %q", id, data.Type, data.Value, data.ACL, data.Expiry)
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var status string
+		if err := tx.QueryRow(`SELECT status FROM exceptionrequests WHERE request_id=?`, string(id)).Scan(&status); err == sql.ErrNoRows {
+			return errHTTP{
+				external: "exception request not found",
+				code:     http.StatusNotFound,
+			}
+		} else if err != nil {
+			return err
+		}
+		if status != exceptionPending {
+			return errHTTP{
+				external: fmt.Sprintf("exception request already %s", status),
+				code:     http.StatusConflict,
+			}
+		}
+		var err error
+		if resp.Rule, err = insertRule(tx, aclID(data.ACL), data.Type, data.Value, actionAllow); err != nil {
+			return err
+		}
+		if expiry > 0 {
+			if _, err := tx.Exec(`INSERT INTO ruleexpiry(rule_id, expires) VALUES(?,?)`, resp.Rule, time.Now().Add(expiry).Unix()); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`UPDATE exceptionrequests SET status=?, rule_id=? WHERE request_id=?`, exceptionApproved, resp.Rule, string(id))
+		return err
+	})
+}
+
+func exceptionRejectHandler(r *http.Request) (interface{}, error) {
+	id := assertExceptionID(mux.Vars(r)["exceptionID"])
+	log.Printf("Rejecting exception request %s", id)
+	resp := struct {
+		Request string `json:"request"`
+		Status  string `json:"status"`
+		Updated int64  `json:"updated"`
+	}{Request: string(id), Status: exceptionRejected}
+	var err error
+	if resp.Updated, err = rowsAffected(db.Exec(`UPDATE exceptionrequests SET status=? WHERE request_id=? AND status=?`, exceptionRejected, string(id), exceptionPending)); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -13,35 +13,31 @@ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 See the License for the specific language governing permissions and
 limitations under the License.
 */
-package main
+package web
 
 import (
-	"flag"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
 	"time"
 )
 
 var (
-	diskFiles = flag.Bool("disk_files", true, "Try to read files off of disk.")
-	memFiles  = flag.Bool("mem_files", true, "Try to read files in memory.")
-
 	internalFiles = make(map[string][]byte)
 )
 
-//go:generate go run ../mkgo/mkgo.go -exts=html -dir=templates -prefix=templates -out=templates.go
-//go:generate go run ../mkgo/mkgo.go -exts=css,js,gif -dir=static -prefix=static -out=static.go
+//go:generate go run ../../cmd/mkgo/mkgo.go -package=web -exts=html -dir=templates -prefix=templates -out=templates.go
+//go:generate go run ../../cmd/mkgo/mkgo.go -package=web -exts=css,js,gif -dir=static -prefix=static -out=static.go
+//go:generate go run ../../cmd/mkgo/mkgo.go -package=web -exts=schema -dir=../.. -out=schema.go
 
 func readFile(fn string) ([]byte, error) {
-	if *memFiles {
+	if serverOpts.MemFiles {
 		b, found := internalFiles[fn]
 		if found {
 			return b, nil
 		}
 	}
-	if *diskFiles {
+	if serverOpts.DiskFiles {
 		return ioutil.ReadFile(fn)
 	}
 	return nil, &os.PathError{
@@ -52,11 +48,12 @@ func readFile(fn string) ([]byte, error) {
 }
 
 type myDir struct {
-	r string
+	theme string // Sub directory of the theme.
+	r     string
 }
 
 func (d *myDir) Open(name string) (http.File, error) {
-	b, err := readFile(path.Join(d.r, name))
+	b, err := readThemed(d.theme, d.r, name)
 	if err != nil {
 		return nil, err
 	}
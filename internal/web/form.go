@@ -0,0 +1,221 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Handlers that change something read their parameters into a request
+// struct with decodeForm, which also checks them, instead of reading and
+// checking form values one by one. Pages and other reads take their few
+// query parameters directly. Fields are tagged with their form name and
+// checks:
+//
+//   Comment string   `form:"comment,required,trim"`
+//   Action  string   `form:"action,required,enum=action"`
+//   Rules   []string `form:"rules[],uuid"`
+//
+// The checks are required, trim (of spaces, before the other checks),
+// uuid, enum=<name of a formEnums list> and max=<length>. Fields can be
+// string, []string, bool or int64. Every failed check is returned at
+// once, as a 400 with the message per field in details.
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/squidwarden/internal/store"
+)
+
+// formEnums are the lists of values enum= checks against.
+var formEnums = map[string][]string{
+	"action":          store.RuleActions,
+	"type":            store.RuleTypes,
+	"permission":      {permRead.String(), permWrite.String(), permAdmin.String()},
+	"scope":           tokenScopes,
+	"bool":            {"true", "false"},
+	"vectoring_point": icapVectoringPoints,
+	"list_format":     listFormats,
+	"ignore":          {ignoreDomain, ignoreClient},
+}
+
+// formField is a parsed form tag.
+type formField struct {
+	name     string
+	required bool
+	trim     bool
+	uuid     bool
+	enum     string
+	max      int
+}
+
+func parseFormTag(tag string) (*formField, error) {
+	parts := strings.Split(tag, ",")
+	f := &formField{name: parts[0]}
+	for _, p := range parts[1:] {
+		switch {
+		case p == "required":
+			f.required = true
+		case p == "trim":
+			f.trim = true
+		case p == "uuid":
+			f.uuid = true
+		case strings.HasPrefix(p, "enum="):
+			f.enum = strings.TrimPrefix(p, "enum=")
+			if _, ok := formEnums[f.enum]; !ok {
+				return nil, fmt.Errorf("unknown enum %q", f.enum)
+			}
+		case strings.HasPrefix(p, "max="):
+			n, err := strconv.Atoi(strings.TrimPrefix(p, "max="))
+			if err != nil {
+				return nil, fmt.Errorf("bad max in %q: %v", p, err)
+			}
+			f.max = n
+		default:
+			return nil, fmt.Errorf("unknown check %q", p)
+		}
+	}
+	return f, nil
+}
+
+// check returns what's wrong with a single value v, or "".
+func (f *formField) check(v string) string {
+	if v == "" {
+		if f.required {
+			return "required"
+		}
+		return ""
+	}
+	return f.checkValue(v)
+}
+
+// checkValue is check without the required check, for values in lists,
+// which may not be empty if they're IDs or enums.
+func (f *formField) checkValue(v string) string {
+	if f.uuid && !reUUID.MatchString(v) {
+		return fmt.Sprintf("%q is not a valid ID", v)
+	}
+	if f.enum != "" {
+		ok := false
+		for _, e := range formEnums[f.enum] {
+			if v == e {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Sprintf("%q is not one of %s", v, strings.Join(formEnums[f.enum], ", "))
+		}
+	}
+	if f.max > 0 && len(v) > f.max {
+		return fmt.Sprintf("may be at most %d bytes", f.max)
+	}
+	return ""
+}
+
+// fieldErrors are the failed checks, by form name.
+type fieldErrors map[string]string
+
+func (e fieldErrors) Error() string {
+	var names []string
+	for n := range e {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var s []string
+	for _, n := range names {
+		s = append(s, n+": "+e[n])
+	}
+	return "invalid request: " + strings.Join(s, "; ")
+}
+
+// decodeForm fills in req, a pointer to a request struct, from the form of
+// r, and checks it. Bad tags are bugs, and panic.
+func decodeForm(r *http.Request, req interface{}) error {
+	r.ParseForm()
+	v := reflect.ValueOf(req).Elem()
+	t := v.Type()
+	errs := fieldErrors{}
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("form")
+		if tag == "" {
+			continue
+		}
+		f, err := parseFormTag(tag)
+		if err != nil {
+			panic(fmt.Sprintf("%s.%s: %v", t, t.Field(i).Name, err))
+		}
+		vals := r.Form[f.name]
+		if f.trim {
+			vals = append([]string(nil), vals...)
+			for n := range vals {
+				vals[n] = strings.TrimSpace(vals[n])
+			}
+		}
+		first := ""
+		if len(vals) > 0 {
+			first = vals[0]
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			if msg := f.check(first); msg != "" {
+				errs[f.name] = msg
+			}
+			field.SetString(first)
+		case reflect.Bool:
+			field.SetBool(first == "true")
+		case reflect.Int64:
+			if first == "" {
+				if f.required {
+					errs[f.name] = "required"
+				}
+				continue
+			}
+			n, err := strconv.ParseInt(first, 10, 64)
+			if err != nil {
+				errs[f.name] = fmt.Sprintf("%q is not a number", first)
+				continue
+			}
+			field.SetInt(n)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				panic(fmt.Sprintf("%s.%s: unsupported type %s", t, t.Field(i).Name, field.Type()))
+			}
+			if len(vals) == 0 && f.required {
+				errs[f.name] = "required"
+			}
+			for _, s := range vals {
+				if msg := f.checkValue(s); msg != "" {
+					errs[f.name] = msg
+					break
+				}
+			}
+			field.Set(reflect.ValueOf(append([]string(nil), vals...)))
+		default:
+			panic(fmt.Sprintf("%s.%s: unsupported type %s", t, t.Field(i).Name, field.Type()))
+		}
+	}
+	if len(errs) > 0 {
+		return errHTTP{
+			external: errs.Error(),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": errs},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Change freezes reject all changes through the UI and API while they're
+// on, e.g. over a holiday or a release, and show a banner saying why.
+// Admins can still make changes by breaking the glass: sending an
+// X-Break-Glass header with the reason, which is logged. The freezes
+// themselves are not policy, so they're not exported and don't bump the
+// revision.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	breakGlassHeader = "X-Break-Glass"
+
+	// freezeTime is how freeze start times are entered, in the user's
+	// time zone.
+	freezeTime = "2006-01-02 15:04"
+
+	// freezeKeepDays is how long ended freezes are still listed.
+	freezeKeepDays = 30
+)
+
+type freezeID string
+
+type freezeWindow struct {
+	FreezeID freezeID
+	Start    string
+	End      string
+	Reason   string
+	Actor    string
+	Active   bool
+	Ended    bool
+
+	end int64
+}
+
+func assertFreezeID(s string) freezeID { return freezeID(assertUUID(s)) }
+
+// getFreezes returns the freezes that end after since, soonest first, with
+// times in loc.
+func getFreezes(now, since time.Time, loc *time.Location) ([]freezeWindow, error) {
+	rows, err := db.Query(`
+SELECT freeze_id, start_time, end_time, reason, actor
+FROM freezes
+WHERE end_time > ?
+ORDER BY start_time, freeze_id`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []freezeWindow
+	for rows.Next() {
+		var f freezeWindow
+		var id string
+		var start, end int64
+		if err := rows.Scan(&id, &start, &end, &f.Reason, &f.Actor); err != nil {
+			return nil, err
+		}
+		f.FreezeID = freezeID(id)
+		f.Start = formatUnix(start, loc)
+		f.End = formatUnix(end, loc)
+		f.end = end
+		f.Active = start <= now.Unix() && now.Unix() < end
+		f.Ended = end <= now.Unix()
+		ret = append(ret, f)
+	}
+	return ret, rows.Err()
+}
+
+// activeFreeze returns the freeze on at now that ends last, or nil.
+func activeFreeze(now time.Time, loc *time.Location) (*freezeWindow, error) {
+	fs, err := getFreezes(now, now, loc)
+	if err != nil {
+		return nil, err
+	}
+	var ret *freezeWindow
+	for n := range fs {
+		if f := &fs[n]; f.Active && (ret == nil || f.end > ret.end) {
+			ret = f
+		}
+	}
+	return ret, nil
+}
+
+// freezeWrap rejects h during a freeze, unless an admin breaks the glass.
+func freezeWrap(h func(*http.Request) (interface{}, error)) func(*http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		f, err := activeFreeze(time.Now(), requestZone(r))
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			return h(r)
+		}
+		user := remoteUser(r)
+		if reason := r.Header.Get(breakGlassHeader); reason != "" {
+			if !authEnabled() || requestPermission(r) >= permAdmin {
+				log.Printf("Break glass by %q during freeze %s: %s %s: %q", user, f.FreezeID, r.Method, r.URL.Path, reason)
+				return h(r)
+			}
+			log.Printf("Break glass by non-admin %q refused: %s %s", user, r.Method, r.URL.Path)
+		}
+		msg := fmt.Sprintf("changes are frozen until %s", f.End)
+		if f.Reason != "" {
+			msg += ": " + f.Reason
+		}
+		return nil, errHTTP{
+			external: msg,
+			code:     http.StatusLocked,
+			reason:   "frozen",
+			details:  map[string]string{"freeze": string(f.FreezeID), "end": f.End},
+			links:    []errHTTPLink{{Text: "change freezes", Link: "/freeze"}},
+		}
+	}
+}
+
+// freezeExempt are the routes that work during a freeze, so that it can
+// be ended early.
+func freezeExempt(route string) bool {
+	// Taking a snapshot or asking for a promotion doesn't change the
+	// policy. Approving one does. Rotating tokens mustn't wait. The setup
+	// wizard runs before there's a freezes table.
+	return strings.HasPrefix(route, "/freeze") || strings.HasPrefix(route, "/setup") || route == "/snapshots/new" || strings.HasPrefix(route, "/promotions/") ||
+		(strings.HasPrefix(route, "/tokens/") && strings.HasSuffix(route, "/rotate"))
+}
+
+func freezeHandler(r *http.Request) (template.HTML, error) {
+	now := time.Now()
+	loc := requestZone(r)
+	data := struct {
+		Freezes []freezeWindow
+		Now     string
+		Format  string
+		Zone    string
+	}{
+		Now:    now.In(loc).Format(freezeTime),
+		Format: freezeTime,
+		Zone:   loc.String(),
+	}
+	var err error
+	if data.Freezes, err = getFreezes(now, now.AddDate(0, 0, -freezeKeepDays), loc); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("freeze.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func freezeNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Start    string `form:"start,trim"`
+		Duration string `form:"duration,required"`
+		Reason   string `form:"reason"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	loc := requestZone(r)
+	if s := data.Start; s != "" {
+		t, err := time.ParseInLocation(freezeTime, s, loc)
+		if err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("invalid start %q, want e.g. %q %s", s, freezeTime, loc),
+				code:     http.StatusBadRequest,
+			}
+		}
+		start = t
+	}
+	d, err := parseExpiry(data.Duration)
+	if err != nil || d == 0 {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid duration %q", data.Duration),
+			code:     http.StatusBadRequest,
+		}
+	}
+	end := start.Add(d)
+	if !end.After(time.Now()) {
+		return nil, errHTTP{external: "freeze would already be over", code: http.StatusBadRequest}
+	}
+	resp := struct {
+		Freeze string `json:"freeze"`
+		Start  string `json:"start"`
+		End    string `json:"end"`
+	}{
+		Freeze: uuid.NewV4().String(),
+		Start:  formatTime(start, loc),
+		End:    formatTime(end, loc),
+	}
+	log.Printf("Adding change freeze %s from %s to %s", resp.Freeze, resp.Start, resp.End)
+	if _, err := db.Exec(`INSERT INTO freezes(freeze_id, start_time, end_time, reason, actor) VALUES(?,?,?,?,?)`, resp.Freeze, start.Unix(), end.Unix(), data.Reason, remoteUser(r)); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func freezeDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertFreezeID(mux.Vars(r)["freezeID"])
+	log.Printf("Deleting change freeze %s", id)
+	resp := struct {
+		Freeze  string `json:"freeze"`
+		Deleted int64  `json:"deleted"`
+	}{Freeze: string(id)}
+	var err error
+	if resp.Deleted, err = rowsAffected(db.Exec(`DELETE FROM freezes WHERE freeze_id=?`, string(id))); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// expireFreezes forgets freezes that ended freezeKeepDays ago.
+func expireFreezes(now time.Time) error {
+	_, err := db.Exec(`DELETE FROM freezes WHERE end_time < ?`, now.AddDate(0, 0, -freezeKeepDays).Unix())
+	return err
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Comparing the effective policy of two groups: the rules granted to one
+// but not the other, or with a different action. Optionally a URL is
+// evaluated as if from a client in each group, to answer "why can this
+// laptop reach the site but not that tablet".
+//
+// Pausing, schedules and quotas aren't taken into account.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+// Made up clients standing in for the two groups when checking a URL.
+const (
+	diffClientA = "192.0.2.1"
+	diffClientB = "192.0.2.2"
+)
+
+// groupDiffEntry is a rule that differs. An empty action means the group
+// doesn't have the rule.
+type groupDiffEntry struct {
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	ActionA string `json:"action_a"`
+	ActionB string `json:"action_b"`
+	RuleA   ruleID `json:"rule_a,omitempty"`
+	RuleB   ruleID `json:"rule_b,omitempty"`
+	ACLA    string `json:"acl_a,omitempty"`
+	ACLB    string `json:"acl_b,omitempty"`
+}
+
+type groupDiffByValue []groupDiffEntry
+
+func (a groupDiffByValue) Len() int      { return len(a) }
+func (a groupDiffByValue) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a groupDiffByValue) Less(i, j int) bool {
+	if a[i].Value != a[j].Value {
+		return a[i].Value < a[j].Value
+	}
+	return a[i].Type < a[j].Type
+}
+
+// actionRank is the order the helper prefers matching actions in.
+var actionRank = map[string]int{
+	actionBlock:  0,
+	actionIgnore: 1,
+	actionAllow:  2,
+}
+
+// effectiveRules returns the rule that applies for each type and value,
+// preferring actions the same way the helper does.
+func effectiveRules(rules []analysisRule) map[[2]string]analysisRule {
+	ret := make(map[[2]string]analysisRule)
+	for _, r := range rules {
+		k := [2]string{r.Type, r.Value}
+		if o, found := ret[k]; found && actionRank[o.Action] <= actionRank[r.Action] {
+			continue
+		}
+		ret[k] = r
+	}
+	return ret
+}
+
+// diffGroupRules returns the rules of a and b that differ.
+func diffGroupRules(a, b []analysisRule) []groupDiffEntry {
+	ea, eb := effectiveRules(a), effectiveRules(b)
+	ret := []groupDiffEntry{}
+	add := func(k [2]string) {
+		ra, rb := ea[k], eb[k]
+		if ra.Action == rb.Action {
+			return
+		}
+		ret = append(ret, groupDiffEntry{
+			Type:    k[0],
+			Value:   k[1],
+			ActionA: ra.Action,
+			ActionB: rb.Action,
+			RuleA:   ra.RuleID,
+			RuleB:   rb.RuleID,
+			ACLA:    ra.ACL.Comment,
+			ACLB:    rb.ACL.Comment,
+		})
+	}
+	for k := range ea {
+		add(k)
+	}
+	for k := range eb {
+		if _, found := ea[k]; !found {
+			add(k)
+		}
+	}
+	sort.Sort(groupDiffByValue(ret))
+	return ret
+}
+
+// diffDecision is the outcome of a URL for one group.
+type diffDecision struct {
+	Action string `json:"action"`
+	ACL    string `json:"acl"`
+	Rule   ruleID `json:"rule"`
+}
+
+// decideForGroups evaluates u for a client in each group.
+func decideForGroups(u string, a, b []analysisRule) (diffDecision, diffDecision, error) {
+	p := policy.New()
+	acls := make(map[string]string)
+	grant := func(client, g string, rules []analysisRule) error {
+		for _, r := range rules {
+			if err := p.AddRule(string(r.RuleID), r.Type, r.Value, r.Action); err != nil {
+				// Like the helper, skip rules that don't compile.
+				continue
+			}
+			acls[string(r.ACL.ACLID)] = r.ACL.Comment
+			if err := p.AddGrant(client+"/32", policy.Grant{Group: g, ACL: string(r.ACL.ACLID), Rule: string(r.RuleID)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := grant(diffClientA, "a", a); err != nil {
+		return diffDecision{}, diffDecision{}, err
+	}
+	if err := grant(diffClientB, "b", b); err != nil {
+		return diffDecision{}, diffDecision{}, err
+	}
+	decide := func(client string) (diffDecision, error) {
+		req, err := policy.URLRequest(client, u)
+		if err != nil {
+			return diffDecision{}, err
+		}
+		d, err := p.Decide(req)
+		if err != nil {
+			return diffDecision{}, err
+		}
+		if !d.Match {
+			return diffDecision{Action: "default"}, nil
+		}
+		return diffDecision{Action: d.Action, ACL: acls[d.ACL], Rule: ruleID(d.Rule)}, nil
+	}
+	decA, err := decide(diffClientA)
+	if err != nil {
+		return diffDecision{}, diffDecision{}, err
+	}
+	decB, err := decide(diffClientB)
+	return decA, decB, err
+}
+
+// getGroupRules returns the enabled rules granted to a group.
+func getGroupRules(g groupID) ([]analysisRule, error) {
+	rows, err := db.Query(`
+SELECT acls.acl_id, acls.comment, rules.rule_id, rules.type, rules.value, rules.action
+FROM groupaccess
+JOIN acls ON groupaccess.acl_id=acls.acl_id
+JOIN aclrules ON acls.acl_id=aclrules.acl_id
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE groupaccess.group_id=? AND acls.enabled AND rules.enabled`, string(g))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []analysisRule
+	for rows.Next() {
+		var r analysisRule
+		var ac sql.NullString
+		if err := rows.Scan(&r.ACL.ACLID, &ac, &r.RuleID, &r.Type, &r.Value, &r.Action); err != nil {
+			return nil, err
+		}
+		r.ACL.Comment = ac.String
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+type groupDiff struct {
+	A       group            `json:"a"`
+	B       group            `json:"b"`
+	Rules   []groupDiffEntry `json:"rules"`
+	URL     string           `json:"url,omitempty"`
+	URLA    *diffDecision    `json:"url_a,omitempty"`
+	URLB    *diffDecision    `json:"url_b,omitempty"`
+	URLErr  string           `json:"url_error,omitempty"`
+	Groups  []group          `json:"-"`
+	Compare bool             `json:"-"`
+}
+
+// getGroupDiff compares the groups in the a and b parameters, if set.
+func getGroupDiff(r *http.Request) (*groupDiff, error) {
+	var ret groupDiff
+	var err error
+	ret.Groups, ret.A, err = getGroups(groupID(r.FormValue("a")))
+	if err != nil {
+		return nil, err
+	}
+	if _, ret.B, err = getGroups(groupID(r.FormValue("b"))); err != nil {
+		return nil, err
+	}
+	if ret.A.GroupID == "" || ret.B.GroupID == "" {
+		if r.FormValue("a") != "" || r.FormValue("b") != "" {
+			return nil, errHTTP{
+				external: "group not found",
+				code:     http.StatusNotFound,
+			}
+		}
+		return &ret, nil
+	}
+	ret.Compare = true
+	a, err := getGroupRules(ret.A.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := getGroupRules(ret.B.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	ret.Rules = diffGroupRules(a, b)
+	if ret.URL = r.FormValue("url"); ret.URL != "" {
+		decA, decB, err := decideForGroups(ret.URL, a, b)
+		if err != nil {
+			ret.URLErr = err.Error()
+		} else {
+			ret.URLA, ret.URLB = &decA, &decB
+		}
+	}
+	return &ret, nil
+}
+
+func groupDiffHandler(r *http.Request) (template.HTML, error) {
+	d, err := getGroupDiff(r)
+	if err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("groupdiff.html", template.FuncMap{"groupIDEQ": func(a, b groupID) bool { return a == b }})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func groupDiffJSONHandler(r *http.Request) (interface{}, error) {
+	d, err := getGroupDiff(r)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Compare {
+		return nil, errHTTP{
+			external: "a and b groups are required",
+			code:     http.StatusBadRequest,
+		}
+	}
+	return d, nil
+}
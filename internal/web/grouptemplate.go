@@ -0,0 +1,305 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Group templates create a group with starter ACLs in one go. A few are
+// built in; more can be put in -group_templates as JSON files, in the
+// format that any group can be exported as from /group/<id>/template.json.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+type templateRule struct {
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Action string `json:"action"`
+}
+
+type templateACL struct {
+	Name  string         `json:"name"`
+	Rules []templateRule `json:"rules"`
+}
+
+type groupTemplate struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	ACLs        []templateACL `json:"acls"`
+	// Also grant the bypass-block ACL.
+	BlockBypass bool `json:"block_bypass,omitempty"`
+}
+
+// sites makes allow or block rules for whole sites, over http and https.
+func sites(action string, domains ...string) []templateRule {
+	var ret []templateRule
+	for _, d := range domains {
+		ret = append(ret,
+			templateRule{Type: typeDomain, Value: d, Action: action},
+			templateRule{Type: typeHTTPSDomain, Value: d, Action: action})
+	}
+	return ret
+}
+
+var builtinTemplates = []groupTemplate{
+	{
+		Name:        "kids",
+		Description: "Reference, school and learning sites only. Social media and games blocked.",
+		ACLs: []templateACL{
+			{Name: "learning", Rules: sites(actionAllow,
+				".wikipedia.org", ".wikimedia.org", ".khanacademy.org", ".kastatic.org",
+				"scratch.mit.edu", ".code.org", ".britannica.com", ".nationalgeographic.com")},
+			{Name: "social and games", Rules: sites(actionBlock,
+				".tiktok.com", ".instagram.com", ".snapchat.com", ".facebook.com",
+				".roblox.com", ".twitch.tv", ".discord.com", ".discord.gg")},
+		},
+		BlockBypass: true,
+	},
+	{
+		Name:        "guests",
+		Description: "The whole web, except proxy and DNS bypass services and file sharing.",
+		ACLs: []templateACL{
+			{Name: "web", Rules: []templateRule{
+				{Type: typeRegex, Value: ".*", Action: actionAllow},
+				{Type: typeHTTPSRegex, Value: ".*", Action: actionAllow},
+			}},
+			{Name: "file sharing", Rules: sites(actionBlock,
+				".thepiratebay.org", ".1337x.to", ".rarbg.to", ".yts.mx")},
+		},
+		BlockBypass: true,
+	},
+	{
+		Name:        "servers-egress-only",
+		Description: "Operating system package updates only.",
+		ACLs: []templateACL{
+			{Name: "package updates", Rules: sites(actionAllow,
+				"deb.debian.org", "security.debian.org", ".archive.ubuntu.com", "security.ubuntu.com",
+				"packages.microsoft.com", "dl.fedoraproject.org", "mirrors.fedoraproject.org",
+				"dl-cdn.alpinelinux.org", "download.docker.com")},
+		},
+	},
+}
+
+// validateTemplate checks that every rule can be loaded by the helper.
+func validateTemplate(t *groupTemplate) error {
+	if t.Name == "" {
+		return fmt.Errorf("template has no name")
+	}
+	for _, a := range t.ACLs {
+		for _, r := range a.Rules {
+			if err := policy.Validate(r.Type, r.Value); err != nil {
+				return fmt.Errorf("template %q ACL %q: %s %q: %v", t.Name, a.Name, r.Type, r.Value, err)
+			}
+			switch r.Action {
+			case actionAllow, actionBlock, actionIgnore:
+			default:
+				return fmt.Errorf("template %q ACL %q: unknown action %q", t.Name, a.Name, r.Action)
+			}
+		}
+	}
+	return nil
+}
+
+type templatesByName []groupTemplate
+
+func (a templatesByName) Len() int           { return len(a) }
+func (a templatesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a templatesByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// getGroupTemplates returns the built in templates and the ones in
+// -group_templates, which replace built in ones of the same name.
+func getGroupTemplates() ([]groupTemplate, error) {
+	byName := make(map[string]groupTemplate)
+	for _, t := range builtinTemplates {
+		byName[t.Name] = t
+	}
+	if serverOpts.GroupTemplates != "" {
+		files, err := filepath.Glob(filepath.Join(serverOpts.GroupTemplates, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range files {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return nil, err
+			}
+			var t groupTemplate
+			if err := json.Unmarshal(b, &t); err != nil {
+				return nil, fmt.Errorf("%s: %v", fn, err)
+			}
+			if t.Name == "" {
+				t.Name = strings.TrimSuffix(filepath.Base(fn), ".json")
+			}
+			if err := validateTemplate(&t); err != nil {
+				return nil, fmt.Errorf("%s: %v", fn, err)
+			}
+			byName[t.Name] = t
+		}
+	}
+	var ret []groupTemplate
+	for _, t := range byName {
+		ret = append(ret, t)
+	}
+	sort.Sort(templatesByName(ret))
+	return ret, nil
+}
+
+// applyGroupTemplate creates a group named name, and an ACL per template
+// ACL, named after both, granted to it.
+func applyGroupTemplate(tx *sql.Tx, t *groupTemplate, name string) (groupID, error) {
+	g := uuid.NewV4().String()
+	if _, err := tx.Exec(`INSERT INTO groups(group_id, comment) VALUES(?,?)`, g, name); err != nil {
+		return "", err
+	}
+	for _, ta := range t.ACLs {
+		a := aclID(uuid.NewV4().String())
+		if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, string(a), name+": "+ta.Name); err != nil {
+			return "", err
+		}
+		l, err := newRuleLinker(tx, a)
+		if err != nil {
+			return "", err
+		}
+		for _, r := range ta.Rules {
+			if _, err := l.add(r.Type, r.Value, r.Action); err != nil {
+				l.close()
+				return "", err
+			}
+		}
+		l.close()
+		if _, err := tx.Exec(`INSERT INTO groupaccess(group_id, acl_id, comment) VALUES(?,?,?)`, g, string(a), "from template "+t.Name); err != nil {
+			return "", err
+		}
+	}
+	if t.BlockBypass {
+		a, err := syncBypassACL(tx, bypassEntries, true)
+		if err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec(`INSERT INTO groupaccess(group_id, acl_id, comment) VALUES(?,?,?)`, g, string(a), "from template "+t.Name); err != nil {
+			return "", err
+		}
+	}
+	return groupID(g), nil
+}
+
+// findGroupTemplate returns the template called name.
+func findGroupTemplate(name string) (*groupTemplate, error) {
+	templates, err := getGroupTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for n := range templates {
+		if templates[n].Name == name {
+			return &templates[n], nil
+		}
+	}
+	return nil, errHTTP{
+		external: fmt.Sprintf("no template %q", name),
+		code:     http.StatusNotFound,
+	}
+}
+
+func groupTemplatesHandler(r *http.Request) (interface{}, error) {
+	t, err := getGroupTemplates()
+	if err != nil {
+		return nil, err
+	}
+	return &struct {
+		Templates []groupTemplate `json:"templates"`
+	}{t}, nil
+}
+
+// groupNewFromTemplateHandler creates a group from the template parameter,
+// named comment.
+func groupNewFromTemplateHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Template string `form:"template,required"`
+		Comment  string `form:"comment,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	name, comment := data.Template, data.Comment
+	if comment == "" {
+		comment = name
+	}
+	t, err := findGroupTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Creating group %q from template %q", comment, name)
+	resp := struct {
+		Group string `json:"group"`
+	}{}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		g, err := applyGroupTemplate(tx, t, comment)
+		resp.Group = string(g)
+		return err
+	})
+}
+
+// groupTemplateExportHandler returns a group's enabled ACLs as a template.
+func groupTemplateExportHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	var name string
+	if err := db.QueryRow(`SELECT comment FROM groups WHERE group_id=?`, string(id)).Scan(&name); err == sql.ErrNoRows {
+		return nil, errHTTP{
+			external: "group not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	t := groupTemplate{Name: name, ACLs: []templateACL{}}
+	rows, err := db.Query(`
+SELECT acls.comment, rules.type, rules.value, rules.action
+FROM groupaccess
+JOIN acls ON groupaccess.acl_id=acls.acl_id
+JOIN aclrules ON acls.acl_id=aclrules.acl_id
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE groupaccess.group_id=? AND acls.enabled AND rules.enabled
+ORDER BY acls.comment, acls.acl_id, rules.type, rules.value`, string(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var acl sql.NullString
+		var r templateRule
+		if err := rows.Scan(&acl, &r.Type, &r.Value, &r.Action); err != nil {
+			return nil, err
+		}
+		// Drop the group name that applying a template adds.
+		a := strings.TrimPrefix(acl.String, name+": ")
+		if len(t.ACLs) == 0 || t.ACLs[len(t.ACLs)-1].Name != a {
+			t.ACLs = append(t.ACLs, templateACL{Name: a})
+		}
+		t.ACLs[len(t.ACLs)-1].Rules = append(t.ACLs[len(t.ACLs)-1].Rules, r)
+	}
+	return &t, rows.Err()
+}
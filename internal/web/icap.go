@@ -0,0 +1,244 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	icapVectoringPoints = []string{"reqmod_precache", "respmod_precache"}
+
+	reICAPName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+type icapID string
+type icapService struct {
+	ICAPID         icapID
+	Name           string
+	VectoringPoint string
+	URL            string
+	Bypass         bool
+	Comment        string
+	Groups         []groupID
+}
+
+func assertICAPID(s string) icapID { return icapID(assertUUID(s)) }
+
+func getICAPServices() ([]icapService, error) {
+	rows, err := db.Query(`SELECT icap_id, name, vectoring_point, url, bypass, comment FROM icapservices ORDER BY name, icap_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []icapService
+	byID := make(map[icapID]int)
+	for rows.Next() {
+		var e icapService
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &e.Name, &e.VectoringPoint, &e.URL, &e.Bypass, &c); err != nil {
+			return nil, err
+		}
+		e.ICAPID = icapID(s)
+		e.Comment = c.String
+		byID[e.ICAPID] = len(ret)
+		ret = append(ret, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows2, err := db.Query(`SELECT icap_id, group_id FROM groupicap ORDER BY group_id, icap_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var i, g string
+		if err := rows2.Scan(&i, &g); err != nil {
+			return nil, err
+		}
+		if n, ok := byID[icapID(i)]; ok {
+			ret[n].Groups = append(ret[n].Groups, groupID(g))
+		}
+	}
+	return ret, rows2.Err()
+}
+
+// generateICAPConf turns ICAP on and emits icap_service and
+// adaptation_access lines. Groups without squid acls (e.g. without
+// members, unless the default group) are skipped.
+func generateICAPConf(w io.Writer, sg *squidGroups) error {
+	services, err := getICAPServices()
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\n# ICAP services.\n")
+	fmt.Fprintf(w, "icap_enable on\n")
+	for _, s := range services {
+		name := "sw_icap_" + s.Name
+		bypass := "off"
+		if s.Bypass {
+			bypass = "on"
+		}
+		fmt.Fprintf(w, "icap_service %s %s %s bypass=%s\n", name, s.VectoringPoint, s.URL, bypass)
+		for _, g := range s.Groups {
+			for _, ref := range sg.refs(g) {
+				fmt.Fprintf(w, "adaptation_access %s allow %s\n", name, ref)
+			}
+		}
+		fmt.Fprintf(w, "adaptation_access %s deny all\n", name)
+	}
+	return nil
+}
+
+func icapHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Services        []icapService
+		Groups          []group
+		VectoringPoints []string
+	}{
+		VectoringPoints: icapVectoringPoints,
+	}
+	var err error
+	if data.Services, err = getICAPServices(); err != nil {
+		return "", err
+	}
+	if data.Groups, _, err = getGroups(""); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("icap.html", template.FuncMap{
+		"hasGroup": func(gs []groupID, g groupID) bool {
+			for _, t := range gs {
+				if t == g {
+					return true
+				}
+			}
+			return false
+		},
+	})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func icapNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Name           string `form:"name,required"`
+		VectoringPoint string `form:"vectoring_point,required,enum=vectoring_point"`
+		URL            string `form:"url,required"`
+		Bypass         bool   `form:"bypass"`
+		Comment        string `form:"comment"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	if !reICAPName.MatchString(data.Name) {
+		return nil, errHTTP{
+			external: "name must only contain letters, digits, '_' and '-'",
+			code:     http.StatusBadRequest,
+		}
+	}
+	if u, err := url.Parse(data.URL); err != nil || u.Scheme != "icap" {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid ICAP URL %q", data.URL),
+			code:     http.StatusBadRequest,
+		}
+	}
+
+	id := uuid.NewV4().String()
+	resp := struct {
+		ICAP string `json:"icap"`
+	}{ICAP: id}
+	log.Printf("Creating ICAP service %s %q", id, data.Name)
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO icapservices(icap_id, name, vectoring_point, url, bypass, comment) VALUES(?,?,?,?,?,?)`, id, data.Name, data.VectoringPoint, data.URL, data.Bypass, data.Comment); err != nil {
+			return errHTTP{
+				internal: err,
+				external: fmt.Sprintf("failed to create ICAP service %q, does it already exist?", data.Name),
+				code:     http.StatusConflict,
+			}
+		}
+		return nil
+	})
+}
+
+func icapDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertICAPID(mux.Vars(r)["icapID"])
+	log.Printf("Deleting ICAP service %s", id)
+	resp := struct {
+		ICAP    string `json:"icap"`
+		Deleted int64  `json:"deleted"`
+	}{ICAP: string(id)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM groupicap WHERE icap_id=?`, string(id)); err != nil {
+			return err
+		}
+		var err error
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM icapservices WHERE icap_id=?`, string(id)))
+		return err
+	})
+}
+
+// icapGroupsHandler sets which groups have their traffic sent to the service.
+func icapGroupsHandler(r *http.Request) (interface{}, error) {
+	id := assertICAPID(mux.Vars(r)["icapID"])
+	var data struct {
+		Groups []string `form:"groups[],uuid"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	groups := data.Groups
+	log.Printf("Setting ICAP service %s groups to %v", id, groups)
+	resp := struct {
+		ICAP   string   `json:"icap"`
+		Groups []string `json:"groups"`
+	}{ICAP: string(id), Groups: groups}
+	if resp.Groups == nil {
+		resp.Groups = []string{}
+	}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM groupicap WHERE icap_id=?`, string(id)); err != nil {
+			return err
+		}
+		for _, g := range groups {
+			if _, err := tx.Exec(`INSERT INTO groupicap(group_id, icap_id) VALUES(?,?)`, g, string(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
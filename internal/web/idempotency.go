@@ -0,0 +1,159 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Idempotency keys let automation retry a write that timed out without
+// doing it twice. A POST or DELETE with an Idempotency-Key header stores
+// its reply, and a retry with the same key gets the stored reply instead
+// of running again. Like the change log, this isn't policy.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+
+	// maxIdempotentBody is the largest request body that can be
+	// used with a key, since it's read into memory to be hashed.
+	maxIdempotentBody = 10 << 20
+)
+
+var reIdempotencyKey = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// idempotencyInFlight are the keys of requests still running, so that a
+// retry racing the original doesn't run too.
+var idempotencyInFlight = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// requestHash identifies what a request asks for, so a key reused for a
+// different request can be refused. The body is put back for the handler.
+func requestHash(r *http.Request) (string, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxIdempotentBody)); err != nil {
+			return "", errHTTP{
+				internal: err,
+				external: fmt.Sprintf("request body too large for %s", idempotencyHeader),
+				code:     http.StatusBadRequest,
+			}
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// idempotencyExempt are the routes whose replies mustn't be stored, since
+// they have secrets in them.
+func idempotencyExempt(route string) bool {
+	return strings.HasPrefix(route, "/tokens")
+}
+
+// idempotencyWrap replays the stored reply of h if the request has an
+// Idempotency-Key that was already used. Only successes are stored, so a
+// failed request can be retried with the same key.
+func idempotencyWrap(h func(*http.Request) (interface{}, error)) func(*http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			return h(r)
+		}
+		if !reIdempotencyKey.MatchString(key) {
+			return nil, errHTTP{
+				external: fmt.Sprintf("bad %s, want 1-255 printable ASCII characters", idempotencyHeader),
+				code:     http.StatusBadRequest,
+			}
+		}
+		hash, err := requestHash(r)
+		if err != nil {
+			return nil, err
+		}
+		// Keys are per user, so users can't see each other's replies.
+		actor := remoteUser(r)
+		var storedHash, reply string
+		switch err := db.QueryRow(`SELECT request_hash, response FROM idempotencykeys WHERE actor=? AND key=?`, actor, key).Scan(&storedHash, &reply); {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return nil, err
+		case storedHash != hash:
+			return nil, errHTTP{
+				external: fmt.Sprintf("%s %q was already used for a different request", idempotencyHeader, key),
+				code:     http.StatusUnprocessableEntity,
+				reason:   "idempotency_key_reused",
+			}
+		default:
+			log.Printf("Replaying reply for %s %q", idempotencyHeader, key)
+			return json.RawMessage(reply), nil
+		}
+
+		inFlight := actor + "\x00" + key
+		idempotencyInFlight.Lock()
+		busy := idempotencyInFlight.keys[inFlight]
+		idempotencyInFlight.keys[inFlight] = true
+		idempotencyInFlight.Unlock()
+		if busy {
+			return nil, errHTTP{
+				external: fmt.Sprintf("a request with %s %q is still running", idempotencyHeader, key),
+				code:     http.StatusConflict,
+			}
+		}
+		defer func() {
+			idempotencyInFlight.Lock()
+			delete(idempotencyInFlight.keys, inFlight)
+			idempotencyInFlight.Unlock()
+		}()
+
+		resp, err := h(r)
+		if err != nil {
+			return resp, err
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			return nil, fmt.Errorf("marshalling JSON reply: %v", err)
+		}
+		// The change is done, so don't fail it just because it can't be
+		// replayed.
+		if _, err := db.Exec(`INSERT OR REPLACE INTO idempotencykeys(actor, key, request_hash, response, created) VALUES(?,?,?,?,?)`, actor, key, hash, string(b), time.Now().Unix()); err != nil {
+			log.Printf("Failed to store reply for %s %q: %v", idempotencyHeader, key, err)
+		}
+		return json.RawMessage(b), nil
+	}
+}
+
+// expireIdempotencyKeys forgets replies stored before -idempotency_hours.
+func expireIdempotencyKeys(now time.Time) error {
+	_, err := db.Exec(`DELETE FROM idempotencykeys WHERE created < ?`, now.Add(-time.Duration(serverOpts.IdempotencyHours)*time.Hour).Unix())
+	return err
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The ignore list hides domains and clients, like telemetry endpoints and
+// monitoring probes, from the tail log and the review queue, so that they
+// don't drown out what needs looking at. It's not policy: ignored requests
+// are allowed or blocked as before, and the list isn't exported. Not to be
+// confused with rules with the ignore action, which are policy.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Kinds of ignore list entries.
+const (
+	ignoreDomain = "domain"
+	ignoreClient = "client"
+)
+
+type ignoreID string
+
+func assertIgnoreID(s string) ignoreID { return ignoreID(assertUUID(s)) }
+
+type ignoreEntry struct {
+	IgnoreID ignoreID `json:"ignore"`
+	Kind     string   `json:"kind"`
+	Value    string   `json:"value"`
+	Comment  string   `json:"comment"`
+	Actor    string   `json:"actor"`
+	Created  string   `json:"created"`
+}
+
+// ignoreSet is the ignore list, for matching. A nil *ignoreSet ignores
+// nothing.
+type ignoreSet struct {
+	domains map[string]bool
+	clients map[string]bool
+	nets    []*net.IPNet
+}
+
+// hidesHost returns true if host is an ignored domain, or under one.
+func (s *ignoreSet) hidesHost(host string) bool {
+	if s == nil || len(s.domains) == 0 {
+		return false
+	}
+	host = strings.ToLower(host)
+	for {
+		if s.domains[host] {
+			return true
+		}
+		n := strings.Index(host, ".")
+		if n < 0 {
+			return false
+		}
+		host = host[n+1:]
+	}
+}
+
+// hidesClient returns true if client is an ignored address, or in an
+// ignored network.
+func (s *ignoreSet) hidesClient(client string) bool {
+	if s == nil {
+		return false
+	}
+	if s.clients[client] {
+		return true
+	}
+	if len(s.nets) == 0 {
+		return false
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hides returns true if e is to a hidden domain or from a hidden client.
+func (s *ignoreSet) hides(e *squidlog.Entry) bool {
+	return s.hidesHost(e.Host) || s.hidesClient(e.Client)
+}
+
+// ignores is the ignore list, loaded by loadIgnores. The set is replaced,
+// not changed, when the list changes.
+var ignores struct {
+	sync.Mutex
+	set *ignoreSet
+}
+
+// currentIgnores returns the ignore list.
+func currentIgnores() *ignoreSet {
+	ignores.Lock()
+	defer ignores.Unlock()
+	return ignores.set
+}
+
+// parseIgnoreValue checks and normalizes the value of an ignore list entry
+// of kind: a domain, which also covers its subdomains, or a client address
+// or network.
+func parseIgnoreValue(kind, value string) (string, error) {
+	bad := func(msg string) error {
+		return errHTTP{
+			external: fmt.Sprintf("invalid %s %q: %s", kind, value, msg),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"value": msg}},
+		}
+	}
+	switch kind {
+	case ignoreDomain:
+		v := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(value), "*"), ".")
+		if v == "" || strings.ContainsAny(v, " /:*") {
+			return "", bad("want a domain, like telemetry.example.com")
+		}
+		return v, nil
+	case ignoreClient:
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String(), nil
+		}
+		if _, n, err := net.ParseCIDR(value); err == nil {
+			return n.String(), nil
+		}
+		return "", bad("want an address or network, like 10.0.0.1 or 10.0.0.0/24")
+	}
+	return "", bad("unknown kind")
+}
+
+// getIgnores returns the ignore list, domains first, with times in loc.
+func getIgnores(loc *time.Location) ([]ignoreEntry, error) {
+	rows, err := db.Query(`
+SELECT ignore_id, kind, value, comment, actor, created
+FROM ignores
+ORDER BY kind DESC, value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []ignoreEntry
+	for rows.Next() {
+		var e ignoreEntry
+		var id string
+		var created int64
+		if err := rows.Scan(&id, &e.Kind, &e.Value, &e.Comment, &e.Actor, &created); err != nil {
+			return nil, err
+		}
+		e.IgnoreID = ignoreID(id)
+		e.Created = formatUnix(created, loc)
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+// loadIgnores loads the ignore list. Called from loadSettings, and when the
+// list is changed.
+func loadIgnores() error {
+	entries, err := getIgnores(time.UTC)
+	if err != nil {
+		return err
+	}
+	s := &ignoreSet{
+		domains: make(map[string]bool),
+		clients: make(map[string]bool),
+	}
+	for _, e := range entries {
+		switch e.Kind {
+		case ignoreDomain:
+			s.domains[e.Value] = true
+		case ignoreClient:
+			if _, n, err := net.ParseCIDR(e.Value); err == nil {
+				s.nets = append(s.nets, n)
+			} else {
+				s.clients[e.Value] = true
+			}
+		}
+	}
+	ignores.Lock()
+	defer ignores.Unlock()
+	ignores.set = s
+	return nil
+}
+
+func ignoreHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Ignores []ignoreEntry
+		Admin   bool
+	}{
+		Admin: requestPermission(r) >= permAdmin,
+	}
+	var err error
+	if data.Ignores, err = getIgnores(requestZone(r)); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("ignore.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// ignoreJSONHandler returns the ignore list.
+func ignoreJSONHandler(r *http.Request) (interface{}, error) {
+	ret, err := getIgnores(requestZone(r))
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		ret = []ignoreEntry{}
+	}
+	return ret, nil
+}
+
+func ignoreNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Kind    string `form:"kind,required,enum=ignore"`
+		Value   string `form:"value,required,trim,max=253"`
+		Comment string `form:"comment,trim,max=1000"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	value, err := parseIgnoreValue(data.Kind, data.Value)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Ignore string `json:"ignore"`
+		Kind   string `json:"kind"`
+		Value  string `json:"value"`
+	}{
+		Ignore: uuid.NewV4().String(),
+		Kind:   data.Kind,
+		Value:  value,
+	}
+	log.Printf("Ignoring %s %q in the tail and review queue", data.Kind, value)
+	if _, err := db.Exec(`INSERT INTO ignores(ignore_id, kind, value, comment, actor, created) VALUES(?,?,?,?,?,?)`, resp.Ignore, data.Kind, value, data.Comment, remoteUser(r), time.Now().Unix()); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("failed to ignore %s %q, is it already ignored?", data.Kind, value),
+			code:     http.StatusConflict,
+		}
+	}
+	if err := loadIgnores(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func ignoreDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertIgnoreID(mux.Vars(r)["ignoreID"])
+	log.Printf("Deleting ignore list entry %s", id)
+	resp := struct {
+		Ignore  string `json:"ignore"`
+		Deleted int64  `json:"deleted"`
+	}{Ignore: string(id)}
+	var err error
+	if resp.Deleted, err = rowsAffected(db.Exec(`DELETE FROM ignores WHERE ignore_id=?`, string(id))); err != nil {
+		return nil, err
+	}
+	if err := loadIgnores(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,367 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Squid logs are ingested by stats, learning, client discovery, alerts and
+// metrics, each following every log on its own. With SMP workers that each
+// write their own log, -ingest_logs lists them all, and they're read at the
+// same time. Lines seen in more than one log, or twice in one, are only
+// given to the consumer once.
+//
+// Consumers that store what they ingest save how far they got into each
+// log in the same transaction, and pick up from there after a restart, so
+// that nothing is counted twice or missed. A log is recognized by its
+// first line, so that a rotated one is read from the start.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+const (
+	ingestPollInterval = time.Second
+
+	// dedupWindow is how many of the latest lines duplicates are looked
+	// for in.
+	dedupWindow = 100000
+
+	// fingerprintSize is the most of the first line of a log used to
+	// recognize it.
+	fingerprintSize = 4096
+)
+
+// ingestConfigured returns true if there are squid logs to ingest.
+func ingestConfigured() bool {
+	return serverOpts.SquidLog != "" || serverOpts.IngestLogs != ""
+}
+
+// ingestFiles returns the squid logs to ingest. Patterns are matched again
+// every time, so that logs of workers added later are picked up.
+func ingestFiles() []string {
+	if serverOpts.IngestLogs == "" {
+		return []string{serverOpts.SquidLog}
+	}
+	var ret []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(serverOpts.IngestLogs, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		fns, err := filepath.Glob(p)
+		if err != nil {
+			log.Printf("Ingest: bad pattern %q: %v", p, err)
+			continue
+		}
+		if len(fns) == 0 && !strings.ContainsAny(p, "*?[") {
+			// Not there yet.
+			fns = []string{p}
+		}
+		for _, fn := range fns {
+			if !seen[fn] {
+				seen[fn] = true
+				ret = append(ret, fn)
+			}
+		}
+	}
+	return ret
+}
+
+// logOffset is how far into a log a consumer has read.
+type logOffset struct {
+	pos         int64
+	fingerprint string
+}
+
+// logFingerprint returns what recognizes f: a hash of its first line, or
+// "" if that's not complete yet.
+func logFingerprint(f *os.File) (string, error) {
+	b := make([]byte, fingerprintSize)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	b = b[:n]
+	if i := strings.IndexByte(string(b), '\n'); i >= 0 {
+		b = b[:i]
+	} else if n < fingerprintSize {
+		return "", nil
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// recentLines remembers hashes of the latest lines, to find duplicates.
+type recentLines struct {
+	ring  []uint64
+	next  int
+	count map[uint64]int
+}
+
+func newRecentLines(n int) *recentLines {
+	return &recentLines{
+		ring:  make([]uint64, 0, n),
+		count: make(map[uint64]int),
+	}
+}
+
+// seen returns true if line is one of the latest lines, and remembers it
+// if not.
+func (r *recentLines) seen(line string) bool {
+	h := fnv.New64a()
+	io.WriteString(h, line)
+	k := h.Sum64()
+	if r.count[k] > 0 {
+		return true
+	}
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, k)
+	} else {
+		old := r.ring[r.next]
+		if r.count[old]--; r.count[old] == 0 {
+			delete(r.count, old)
+		}
+		r.ring[r.next] = k
+		r.next = (r.next + 1) % len(r.ring)
+	}
+	r.count[k]++
+	return false
+}
+
+// logIngester follows every squid log for one consumer, calling cb for
+// every new entry, one at a time.
+type logIngester struct {
+	name string // Offsets are saved under this name, unless "".
+	cb   func(*squidlog.Entry)
+
+	mu      sync.Mutex // Held while calling cb.
+	offsets map[string]logOffset
+	recent  *recentLines
+}
+
+// newLogIngester returns an ingester for cb. With a name, it starts where
+// the consumer's last checkpoint left off. Without, or the first time, it
+// starts at the end of the logs.
+func newLogIngester(name string, cb func(*squidlog.Entry)) *logIngester {
+	return &logIngester{
+		name:    name,
+		cb:      cb,
+		offsets: make(map[string]logOffset),
+		recent:  newRecentLines(dedupWindow),
+	}
+}
+
+// run follows the logs. It never returns.
+func (g *logIngester) run() {
+	following := make(map[string]bool)
+	for ; ; time.Sleep(ingestPollInterval) {
+		for _, fn := range ingestFiles() {
+			if !following[fn] {
+				following[fn] = true
+				go g.follow(fn)
+			}
+		}
+	}
+}
+
+// loadOffset returns where to start reading fn: the last saved offset, or
+// -1 for the end.
+func (g *logIngester) loadOffset(fn string) logOffset {
+	if g.name == "" {
+		return logOffset{pos: -1}
+	}
+	var off logOffset
+	if err := db.QueryRow(`SELECT pos, fingerprint FROM logoffsets WHERE consumer=? AND file=?`, g.name, fn).Scan(&off.pos, &off.fingerprint); err == sql.ErrNoRows {
+		return logOffset{pos: -1}
+	} else if err != nil {
+		log.Printf("Ingest: loading %s offset of %q, starting at the end: %v", g.name, fn, err)
+		return logOffset{pos: -1}
+	}
+	return off
+}
+
+// follow follows one log. It never returns.
+func (g *logIngester) follow(fn string) {
+	off := g.loadOffset(fn)
+	failing := false
+	for ; ; time.Sleep(ingestPollInterval) {
+		f, err := os.Open(fn)
+		if err != nil {
+			if !failing {
+				log.Printf("Ingest: opening %q: %v", fn, err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		off = g.followOnce(f, off)
+		f.Close()
+	}
+}
+
+// followOnce gives the entries of f from off on to cb, and returns how far
+// it got. A negative offset means "start at the end".
+func (g *logIngester) followOnce(f *os.File, off logOffset) logOffset {
+	st, err := f.Stat()
+	if err != nil {
+		log.Printf("Ingest: stat: %v", err)
+		return off
+	}
+	fp, err := logFingerprint(f)
+	if err != nil {
+		log.Printf("Ingest: reading %q: %v", f.Name(), err)
+		return off
+	}
+	if off.pos < 0 {
+		off = logOffset{pos: st.Size(), fingerprint: fp}
+		g.mu.Lock()
+		g.offsets[f.Name()] = off
+		g.mu.Unlock()
+		return off
+	}
+	if st.Size() < off.pos || (off.fingerprint != "" && fp != off.fingerprint) {
+		log.Printf("Ingest: %q was rotated, starting from the beginning", f.Name())
+		off.pos = 0
+	}
+	off.fingerprint = fp
+	off.pos = readLogLines(f, off.pos, func(line string, end int64) {
+		e := parseLogLine(line)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.offsets[f.Name()] = logOffset{pos: end, fingerprint: fp}
+		if e == nil || g.recent.seen(line) {
+			return
+		}
+		g.cb(e)
+	})
+	return off
+}
+
+// checkpoint calls take, which takes the entries given to cb so far, and
+// returns how far into each log they go. Save that with saveOffsets in the
+// transaction that stores the entries. g may be nil.
+func (g *logIngester) checkpoint(take func()) map[string]logOffset {
+	if g == nil {
+		take()
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	take()
+	ret := make(map[string]logOffset, len(g.offsets))
+	for fn, off := range g.offsets {
+		ret[fn] = off
+	}
+	return ret
+}
+
+// saveOffsets saves offsets from checkpoint. g may be nil.
+func (g *logIngester) saveOffsets(tx *sql.Tx, offsets map[string]logOffset) error {
+	if g == nil || g.name == "" {
+		return nil
+	}
+	for fn, off := range offsets {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO logoffsets(consumer, file, pos, fingerprint) VALUES(?,?,?,?)`, g.name, fn, off.pos, off.fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followLog calls cb for every new complete log line appended to the file
+// after startup. It never returns. Truncated (rotated) files are read again
+// from the start.
+func followLog(fn string, cb func(*squidlog.Entry)) {
+	var pos int64 = -1
+	for ; ; time.Sleep(ingestPollInterval) {
+		f, err := os.Open(fn)
+		if err != nil {
+			log.Printf("Ingest: opening %q: %v", fn, err)
+			continue
+		}
+		pos = followLogOnce(f, pos, cb)
+		f.Close()
+	}
+}
+
+// followLogOnce reads complete lines from f starting at pos, returning the
+// position after the last complete line. A negative pos means "start at end".
+func followLogOnce(f *os.File, pos int64, cb func(*squidlog.Entry)) int64 {
+	st, err := f.Stat()
+	if err != nil {
+		log.Printf("Ingest: stat: %v", err)
+		return pos
+	}
+	if pos < 0 {
+		return st.Size()
+	}
+	if st.Size() < pos {
+		log.Printf("Ingest: %q shrank, starting from the beginning", f.Name())
+		pos = 0
+	}
+	return readLogLines(f, pos, func(line string, end int64) {
+		if e := parseLogLine(line); e != nil {
+			cb(e)
+		}
+	})
+}
+
+// readLogLines calls cb with every complete line of f from pos on, and the
+// position after it, and returns the position after the last one.
+func readLogLines(f *os.File, pos int64, cb func(line string, end int64)) int64 {
+	if _, err := f.Seek(pos, 0); err != nil {
+		log.Printf("Ingest: seek: %v", err)
+		return pos
+	}
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF || !strings.HasSuffix(line, "\n") {
+			return pos
+		}
+		if err != nil {
+			log.Printf("Ingest: read: %v", err)
+			return pos
+		}
+		pos += int64(len(line))
+		cb(line, pos)
+	}
+}
+
+// parseLogLine parses a log line, or returns nil if it's not an entry.
+func parseLogLine(line string) *squidlog.Entry {
+	e, err := squidlog.Parse(line)
+	switch err {
+	case nil:
+		return e
+	case squidlog.ErrSkip:
+	default:
+		log.Printf("Ingest: %v", err)
+	}
+	return nil
+}
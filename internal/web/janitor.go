@@ -0,0 +1,107 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The janitor removes rules, group pauses and group memberships that have
+// expired. The helper already ignores them, so this is just cleanup.
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+const janitorInterval = time.Minute
+
+func janitor() {
+	for {
+		if err := expireRules(time.Now()); err != nil {
+			log.Printf("Janitor failed to expire rules: %v", err)
+		}
+		if err := expirePauses(time.Now()); err != nil {
+			log.Printf("Janitor failed to expire group pauses: %v", err)
+		}
+		if err := expireMembers(time.Now()); err != nil {
+			log.Printf("Janitor failed to expire group memberships: %v", err)
+		}
+		if err := expireIdempotencyKeys(time.Now()); err != nil {
+			log.Printf("Janitor failed to expire idempotency keys: %v", err)
+		}
+		if err := expireFreezes(time.Now()); err != nil {
+			log.Printf("Janitor failed to expire change freezes: %v", err)
+		}
+		if err := expireJobs(time.Now()); err != nil {
+			log.Printf("Janitor failed to expire jobs: %v", err)
+		}
+		time.Sleep(janitorInterval)
+	}
+}
+
+// expireRules deletes all rules that expired before now.
+func expireRules(now time.Time) error {
+	rows, err := db.Query(`SELECT rule_id FROM ruleexpiry WHERE expires <= ?`, now.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var rules []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return err
+		}
+		rules = append(rules, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		// Don't bump the revision for nothing.
+		return nil
+	}
+	log.Printf("Expiring %s", strings.Join(rules, ", "))
+	return txWrap(func(tx *sql.Tx) error {
+		for _, r := range rules {
+			for _, q := range []string{
+				`DELETE FROM ruleexpiry WHERE rule_id=?`,
+				`DELETE FROM aclrules WHERE rule_id=?`,
+				`DELETE FROM rules WHERE rule_id=?`,
+			} {
+				if _, err := tx.Exec(q, r); err != nil {
+					return err
+				}
+			}
+		}
+		return deleteOrphanOrigins(tx)
+	})
+}
+
+// expirePauses unpauses groups whose pause expired before now.
+func expirePauses(now time.Time) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM grouppause WHERE expires <= ?`, now.Unix()).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	log.Printf("Expiring %d group pauses", n)
+	return txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM grouppause WHERE expires <= ?`, now.Unix())
+		return err
+	})
+}
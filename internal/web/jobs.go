@@ -0,0 +1,352 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Background jobs, like list syncs, scheduled applies and backups, are
+// queued in the jobs table and run one at a time by jobRunner, so they
+// survive restarts, failures are retried with backoff, and the jobs page
+// shows what ran, how it went and what it logged.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Job kinds.
+const (
+	jobListSync     = "list.sync"      // Arg is the list ID.
+	jobListSyncAll  = "lists.sync_all" // Also reports changes and refreshes the bypass ACL.
+	jobThreatSync   = "threat.sync"    // Arg is the feed ID.
+	jobConfigApply  = "config.apply"
+	jobConfigBackup = "config.backup"
+	jobDigest       = "digest.send"
+)
+
+const (
+	jobMaxAttempts  = 5
+	jobPollInterval = 10 * time.Second
+	jobMaxBackoff   = time.Hour
+	jobMaxLog       = 64 << 10 // Per attempt.
+
+	// jobKeepDays is how long finished jobs are listed.
+	jobKeepDays = 30
+)
+
+// jobKinds are what jobs run. Kinds that don't take an arg can also be
+// started from the jobs page.
+var jobKinds = map[string]struct {
+	run    func(j *jobRun) error
+	manual bool
+}{
+	jobListSync: {run: func(j *jobRun) error {
+		d, err := syncList(listID(j.arg))
+		if err != nil {
+			return err
+		}
+		j.logf("%d added, %d removed", len(d.Added), len(d.Removed))
+		return nil
+	}},
+	jobListSyncAll: {run: syncAllLists, manual: true},
+	jobThreatSync: {run: func(j *jobRun) error {
+		return syncThreatFeed(threatFeedID(j.arg))
+	}},
+	jobConfigApply: {run: func(j *jobRun) error {
+		return applySquidConf()
+	}, manual: true},
+	jobConfigBackup: {run: backupConfig, manual: true},
+	jobDigest:       {run: sendDigest, manual: true},
+}
+
+type jobID string
+
+func assertJobID(s string) jobID { return jobID(assertUUID(s)) }
+
+type job struct {
+	JobID       jobID
+	Kind        string
+	Arg         string
+	State       string
+	Attempts    int
+	MaxAttempts int
+	Created     string
+	RunAfter    string
+	Started     string
+	Finished    string
+	Error       string
+	Log         string
+}
+
+// jobRun is a job being run.
+type jobRun struct {
+	id   jobID
+	kind string
+	arg  string
+	log  bytes.Buffer
+}
+
+// logf logs to the server log and the job's log.
+func (j *jobRun) logf(format string, a ...interface{}) {
+	s := fmt.Sprintf(format, a...)
+	log.Printf("Job %s %s: %s", j.kind, j.id, s)
+	if j.log.Len() < jobMaxLog {
+		fmt.Fprintf(&j.log, "%s %s\n", formatTime(time.Now(), displayZone()), s)
+	}
+}
+
+// jobWake makes the runner look for jobs right away.
+var jobWake = make(chan struct{}, 1)
+
+// enqueueJob queues a job, unless the same one is already queued.
+func enqueueJob(kind, arg string) (jobID, error) {
+	if _, ok := jobKinds[kind]; !ok {
+		return "", fmt.Errorf("unknown job kind %q", kind)
+	}
+	var id string
+	if err := db.QueryRow(`SELECT job_id FROM jobs WHERE kind=? AND arg=? AND state=?`, kind, arg, jobQueued).Scan(&id); err == nil {
+		return jobID(id), nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	id = uuid.NewV4().String()
+	now := time.Now().Unix()
+	if _, err := db.Exec(`
+INSERT INTO jobs(job_id, kind, arg, state, attempts, max_attempts, created, run_after, error, log)
+VALUES(?,?,?,?,0,?,?,?,'','')`, id, kind, arg, jobQueued, jobMaxAttempts, now, now); err != nil {
+		return "", err
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return jobID(id), nil
+}
+
+// jobBackoff is how long to wait before another attempt.
+func jobBackoff(attempts int) time.Duration {
+	d := time.Minute
+	for n := 1; n < attempts && d < jobMaxBackoff; n++ {
+		d *= 2
+	}
+	if d > jobMaxBackoff {
+		d = jobMaxBackoff
+	}
+	return d
+}
+
+// runJobFunc runs f, turning a panic into an error.
+func runJobFunc(f func(*jobRun) error, j *jobRun) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f(j)
+}
+
+// runNextJob runs the job that's been waiting the longest, if any is due,
+// and returns true if it ran one.
+func runNextJob(now time.Time) (bool, error) {
+	j := &jobRun{}
+	var attempts, maxAttempts int
+	if err := db.QueryRow(`
+SELECT job_id, kind, arg, attempts, max_attempts
+FROM jobs
+WHERE state=? AND run_after <= ?
+ORDER BY run_after, created, job_id
+LIMIT 1`, jobQueued, now.Unix()).Scan(&j.id, &j.kind, &j.arg, &attempts, &maxAttempts); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	attempts++
+	if n, err := rowsAffected(db.Exec(`UPDATE jobs SET state=?, attempts=?, started=? WHERE job_id=? AND state=?`, jobRunning, attempts, now.Unix(), string(j.id), jobQueued)); err != nil {
+		return false, err
+	} else if n == 0 {
+		// Retried or deleted meanwhile.
+		return true, nil
+	}
+
+	fmt.Fprintf(&j.log, "Attempt %d of %d\n", attempts, maxAttempts)
+	var err error
+	if k, ok := jobKinds[j.kind]; !ok {
+		err = fmt.Errorf("unknown job kind %q", j.kind)
+		attempts = maxAttempts
+	} else {
+		err = runJobFunc(k.run, j)
+	}
+	end := time.Now()
+	state, runAfter, msg := jobDone, end, ""
+	if err != nil {
+		j.logf("Failed: %v", err)
+		msg = err.Error()
+		state = jobFailed
+		if attempts < maxAttempts {
+			state = jobQueued
+			runAfter = end.Add(jobBackoff(attempts))
+		}
+	} else {
+		j.logf("Done in %v", end.Sub(now).Round(time.Millisecond))
+	}
+	if _, err := db.Exec(`UPDATE jobs SET state=?, run_after=?, finished=?, error=?, log=log||? WHERE job_id=?`, state, runAfter.Unix(), end.Unix(), msg, j.log.String(), string(j.id)); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// jobRunner runs queued jobs, one at a time. Jobs that were running when
+// the UI stopped are run again.
+func jobRunner() {
+	if _, err := db.Exec(`UPDATE jobs SET state=?, log=log||? WHERE state=?`, jobQueued, "Interrupted by restart\n", jobRunning); err != nil {
+		log.Printf("Failed to requeue interrupted jobs: %v", err)
+	}
+	for {
+		ran, err := runNextJob(time.Now())
+		if err != nil {
+			log.Printf("Failed to run job: %v", err)
+		}
+		if ran {
+			continue
+		}
+		select {
+		case <-jobWake:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// expireJobs deletes jobs that finished more than jobKeepDays ago.
+func expireJobs(now time.Time) error {
+	_, err := db.Exec(`DELETE FROM jobs WHERE state IN (?,?) AND finished < ?`, jobDone, jobFailed, now.AddDate(0, 0, -jobKeepDays).Unix())
+	return err
+}
+
+// getJobs returns the newest jobs, with times in loc.
+func getJobs(limit int, loc *time.Location) ([]job, error) {
+	rows, err := db.Query(`
+SELECT job_id, kind, arg, state, attempts, max_attempts, created, run_after, started, finished, error, log
+FROM jobs
+ORDER BY created DESC, job_id
+LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []job
+	fmtTime := func(t sql.NullInt64) string {
+		if !t.Valid {
+			return ""
+		}
+		return formatUnix(t.Int64, loc)
+	}
+	for rows.Next() {
+		var j job
+		var created, runAfter int64
+		var started, finished sql.NullInt64
+		if err := rows.Scan(&j.JobID, &j.Kind, &j.Arg, &j.State, &j.Attempts, &j.MaxAttempts, &created, &runAfter, &started, &finished, &j.Error, &j.Log); err != nil {
+			return nil, err
+		}
+		j.Created = formatUnix(created, loc)
+		if j.State == jobQueued {
+			j.RunAfter = formatUnix(runAfter, loc)
+		}
+		j.Started, j.Finished = fmtTime(started), fmtTime(finished)
+		ret = append(ret, j)
+	}
+	return ret, rows.Err()
+}
+
+func jobsHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Jobs   []job
+		Manual []string
+	}{
+		Manual: []string{jobListSyncAll, jobConfigApply, jobConfigBackup},
+	}
+	var err error
+	if data.Jobs, err = getJobs(200, requestZone(r)); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("jobs.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func jobNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Kind string `form:"kind,required"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	kind := data.Kind
+	if k, ok := jobKinds[kind]; !ok || !k.manual {
+		return nil, errHTTP{
+			external: fmt.Sprintf("job kind %q can't be started by hand", kind),
+			code:     http.StatusBadRequest,
+		}
+	}
+	log.Printf("Starting %s job", kind)
+	id, err := enqueueJob(kind, "")
+	if err != nil {
+		return nil, err
+	}
+	return &struct {
+		Job string `json:"job"`
+	}{Job: string(id)}, nil
+}
+
+func jobRetryHandler(r *http.Request) (interface{}, error) {
+	id := assertJobID(mux.Vars(r)["jobID"])
+	log.Printf("Retrying job %s", id)
+	resp := struct {
+		Job     string `json:"job"`
+		Retried int64  `json:"retried"`
+	}{Job: string(id)}
+	var err error
+	if resp.Retried, err = rowsAffected(db.Exec(`UPDATE jobs SET state=?, attempts=0, run_after=? WHERE job_id=? AND state=?`, jobQueued, time.Now().Unix(), string(id), jobFailed)); err != nil {
+		return nil, err
+	}
+	if resp.Retried == 0 {
+		return nil, errHTTP{
+			external: "only failed jobs can be retried",
+			code:     http.StatusConflict,
+		}
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return &resp, nil
+}
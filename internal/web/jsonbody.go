@@ -0,0 +1,154 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// API routes take JSON request bodies as well as forms. A JSON object is
+// turned into the form values the handlers read, the way jQuery would
+// post it: scalars as they are, lists of scalars as "name[]", and
+// anything nested as its JSON text, e.g. the ops of a batch.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxJSONBody is the largest JSON request body, the same as for forms.
+const maxJSONBody = 10 << 20
+
+// isJSONBody returns true if r has a JSON body.
+func isJSONBody(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// jsonForm turns a JSON object into form values.
+func jsonForm(b []byte) (url.Values, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, fmt.Errorf("want a JSON object: %v", err)
+	}
+	ret := url.Values{}
+	for k, raw := range obj {
+		var list []json.RawMessage
+		// Null unmarshals into a list too, as nil.
+		if err := json.Unmarshal(raw, &list); err == nil && list != nil {
+			vs, ok := jsonScalars(list)
+			if !ok {
+				ret.Set(k, string(raw))
+				continue
+			}
+			if !strings.HasSuffix(k, "[]") {
+				k += "[]"
+			}
+			ret[k] = append(ret[k], vs...)
+			continue
+		}
+		v, ok := jsonScalar(raw)
+		if !ok {
+			ret.Set(k, string(raw))
+			continue
+		}
+		if v != nil {
+			ret.Set(k, *v)
+		}
+	}
+	return ret, nil
+}
+
+// jsonScalar returns the form value of a JSON string, number or boolean,
+// nil for null, and false for anything else.
+func jsonScalar(raw json.RawMessage) (*string, bool) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, false
+	}
+	var s string
+	switch t := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		s = t
+	case json.Number:
+		s = t.String()
+	case bool:
+		s = fmt.Sprint(t)
+	default:
+		return nil, false
+	}
+	return &s, true
+}
+
+// jsonScalars returns the form values of a list, and false if anything in
+// it isn't a string, number or boolean.
+func jsonScalars(list []json.RawMessage) ([]string, bool) {
+	ret := make([]string, 0, len(list))
+	for _, raw := range list {
+		v, ok := jsonScalar(raw)
+		if !ok || v == nil {
+			return nil, false
+		}
+		ret = append(ret, *v)
+	}
+	return ret, true
+}
+
+// parseJSONBody fills in the form of r from its JSON body, if it has one.
+// The body is left for reading again, e.g. for idempotency keys.
+func parseJSONBody(r *http.Request) error {
+	if r.Body == nil || !isJSONBody(r) {
+		return nil
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxJSONBody))
+	if err != nil {
+		return errHTTP{
+			internal: err,
+			external: "request body too large",
+			code:     http.StatusRequestEntityTooLarge,
+		}
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	post := url.Values{}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if post, err = jsonForm(b); err != nil {
+			return errHTTP{
+				internal: err,
+				external: fmt.Sprintf("bad JSON request body: %v", err),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	// Like ParseForm, body values come first, then the query string.
+	form := url.Values{}
+	for k, vs := range post {
+		form[k] = append(form[k], vs...)
+	}
+	for k, vs := range r.URL.Query() {
+		form[k] = append(form[k], vs...)
+	}
+	r.PostForm = post
+	r.Form = form
+	return nil
+}
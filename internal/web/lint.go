@@ -0,0 +1,34 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"net/http"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+func ruleLintHandler(r *http.Request) (interface{}, error) {
+	w := policy.Lint(r.FormValue("type"), r.FormValue("value"))
+	if w == nil {
+		w = []policy.Warning{}
+	}
+	return &struct {
+		Warnings []policy.Warning `json:"warnings"`
+	}{
+		Warnings: w,
+	}, nil
+}
@@ -0,0 +1,899 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Import and export of the list formats used by pi-hole and AdGuard:
+//
+//   hosts:   "0.0.0.0 example.com", or just "example.com". Exact hosts.
+//   adblock: "||example.com^" blocks the domain and its subdomains, and
+//            "@@||example.com^" allows them. Other rules are skipped.
+//
+// Each entry becomes a domain and an https-domain rule. Subscriptions
+// re-fetch a list nightly and make the ACL match it, as far as the rules
+// they put there go. What changed is kept, and sent as a report to admins.
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	listHosts   = "hosts"
+	listAdblock = "adblock"
+
+	maxListSize = 64 << 20
+
+	listChangeAdded   = "added"
+	listChangeRemoved = "removed"
+
+	// Max domains per list and change type to put in the report.
+	maxReportEntries = 50
+)
+
+var (
+	listFormats = []string{listHosts, listAdblock}
+	listClient  = &http.Client{Timeout: time.Minute}
+)
+
+type listEntry struct {
+	Value  string
+	Action string
+}
+
+type listID string
+type listSubscription struct {
+	ListID    listID
+	ACL       acl
+	URL       string
+	Format    string
+	Action    string
+	LastSync  string
+	LastError string
+}
+
+type listChange struct {
+	Time   string
+	URL    string
+	Change string
+	Value  string
+	Action string
+}
+
+// listDelta is what a sync changed in the ACL.
+type listDelta struct {
+	URL     string
+	ACL     string // Name of the ACL.
+	Owner   owner  // Owner of the ACL.
+	Added   []listEntry
+	Removed []listEntry
+}
+
+func assertListID(s string) listID { return listID(assertUUID(s)) }
+
+// validListHost returns true if s looks like a hostname. It rejects
+// "localhost" and friends, which are common in hosts files.
+func validListHost(s string) bool {
+	if s == "" || !strings.Contains(s, ".") || net.ParseIP(s) != nil {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return !strings.HasPrefix(s, ".") && !strings.HasSuffix(s, ".")
+}
+
+// parseList parses a list in the given format. Entries in hosts format get
+// the action 'action'.
+func parseList(r io.Reader, format, action string) ([]listEntry, error) {
+	var ret []listEntry
+	seen := make(map[listEntry]bool)
+	add := func(e listEntry) {
+		if !seen[e] {
+			seen[e] = true
+			ret = append(ret, e)
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		switch format {
+		case listHosts:
+			if n := strings.Index(l, "#"); n >= 0 {
+				l = l[:n]
+			}
+			f := strings.Fields(strings.ToLower(l))
+			if len(f) == 0 {
+				continue
+			}
+			hosts := f
+			if net.ParseIP(f[0]) != nil {
+				hosts = f[1:]
+			}
+			for _, h := range hosts {
+				if validListHost(h) {
+					add(listEntry{Value: h, Action: action})
+				}
+			}
+		case listAdblock:
+			if l == "" || strings.HasPrefix(l, "!") || strings.HasPrefix(l, "[") {
+				continue
+			}
+			act := actionBlock
+			if strings.HasPrefix(l, "@@") {
+				act = actionAllow
+				l = l[2:]
+			}
+			if !strings.HasPrefix(l, "||") {
+				continue
+			}
+			l = strings.TrimPrefix(l, "||")
+			// Options like $third-party restrict the rule, so it
+			// can't be expressed as a domain rule.
+			if strings.Contains(l, "$") {
+				continue
+			}
+			l = strings.TrimSuffix(l, "^")
+			if h := strings.ToLower(l); validListHost(h) {
+				add(listEntry{Value: "." + h, Action: act})
+			}
+		default:
+			return nil, fmt.Errorf("unknown list format %q", format)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// formatList writes rules in the given format. Rules that can't be
+// expressed in it are skipped.
+func formatList(w io.Writer, rules []rule, format string) error {
+	seen := make(map[string]bool)
+	var lines []string
+	for _, r := range rules {
+		if !r.Enabled || (r.Type != typeDomain && r.Type != typeHTTPSDomain) {
+			continue
+		}
+		if h, _, err := net.SplitHostPort(r.Value); err == nil && h != "" {
+			// Ports can't be expressed.
+			continue
+		}
+		var l string
+		switch format {
+		case listHosts:
+			if r.Action != actionBlock {
+				continue
+			}
+			l = "0.0.0.0 " + strings.TrimPrefix(r.Value, ".")
+		case listAdblock:
+			switch r.Action {
+			case actionBlock:
+				l = "||" + strings.TrimPrefix(r.Value, ".") + "^"
+			case actionAllow:
+				l = "@@||" + strings.TrimPrefix(r.Value, ".") + "^"
+			default:
+				continue
+			}
+		default:
+			return fmt.Errorf("unknown list format %q", format)
+		}
+		if !seen[l] {
+			seen[l] = true
+			lines = append(lines, l)
+		}
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ruleLinker adds rules to an ACL, with statements prepared once for the
+// whole import. Unlike insertRule, existing rules are reused.
+type ruleLinker struct {
+	id                 aclID
+	find, insert, link *sql.Stmt
+}
+
+func newRuleLinker(tx *sql.Tx, id aclID) (*ruleLinker, error) {
+	l := &ruleLinker{id: id}
+	var err error
+	if l.find, err = tx.Prepare(`SELECT rule_id FROM rules WHERE type=? AND value=? AND action=?`); err != nil {
+		return nil, err
+	}
+	if l.insert, err = tx.Prepare(`INSERT INTO rules(rule_id, type, value, action) VALUES(?,?,?,?)`); err != nil {
+		l.close()
+		return nil, err
+	}
+	if l.link, err = tx.Prepare(`INSERT OR IGNORE INTO aclrules(acl_id, rule_id) VALUES(?,?)`); err != nil {
+		l.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ruleLinker) close() {
+	for _, s := range []*sql.Stmt{l.find, l.insert, l.link} {
+		if s != nil {
+			s.Close()
+		}
+	}
+}
+
+// add makes sure a rule exists and is in the ACL, returning true if
+// anything was added.
+func (l *ruleLinker) add(typ, value, action string) (bool, error) {
+	var rid string
+	if err := l.find.QueryRow(typ, value, action).Scan(&rid); err == sql.ErrNoRows {
+		rid = uuid.NewV4().String()
+		if _, err := l.insert.Exec(rid, typ, value, action); err != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	}
+	res, err := l.link.Exec(string(l.id), rid)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// importList adds the entries to the ACL. If replace is set, domain rules
+// in the ACL not in the list are removed from it, so that's only for ACLs
+// nothing else puts rules in.
+func importList(tx *sql.Tx, id aclID, entries []listEntry, replace bool) (added, removed int, err error) {
+	l, err := newRuleLinker(tx, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer l.close()
+	want := make(map[rule]bool)
+	for _, e := range entries {
+		for _, typ := range []string{typeDomain, typeHTTPSDomain} {
+			want[rule{Type: typ, Value: e.Value, Action: e.Action}] = true
+			a, err := l.add(typ, e.Value, e.Action)
+			if err != nil {
+				return 0, 0, err
+			}
+			if a {
+				added++
+			}
+		}
+	}
+	if !replace {
+		return added, 0, nil
+	}
+	rows, err := tx.Query(`
+SELECT rules.rule_id, rules.type, rules.value, rules.action
+FROM aclrules
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE aclrules.acl_id=? AND rules.type IN (?,?)`, string(id), typeDomain, typeHTTPSDomain)
+	if err != nil {
+		return 0, 0, err
+	}
+	var stale []string
+	for rows.Next() {
+		var r rule
+		var rid string
+		if err := rows.Scan(&rid, &r.Type, &r.Value, &r.Action); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		if !want[r] {
+			stale = append(stale, rid)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(stale) == 0 {
+		return added, 0, nil
+	}
+	unlink, err := tx.Prepare(`DELETE FROM aclrules WHERE acl_id=? AND rule_id=?`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlink.Close()
+	// Delete the rule too, unless something else still uses it.
+	del, err := tx.Prepare(`
+DELETE FROM rules
+WHERE rule_id=?
+AND rule_id NOT IN (SELECT rule_id FROM aclrules)
+AND rule_id NOT IN (SELECT rule_id FROM ruleexpiry)`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer del.Close()
+	for _, rid := range stale {
+		if _, err := unlink.Exec(string(id), rid); err != nil {
+			return 0, 0, err
+		}
+		if _, err := del.Exec(rid); err != nil {
+			return 0, 0, err
+		}
+		removed++
+	}
+	return added, removed, deleteOrphanOrigins(tx)
+}
+
+func fetchList(u string) ([]byte, error) {
+	resp, err := listClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %q: %s", u, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxListSize {
+		return nil, fmt.Errorf("list %q is larger than %d bytes", u, maxListSize)
+	}
+	return b, nil
+}
+
+// listRules returns the rules of a query for type, value and action.
+func listRules(tx *sql.Tx, q string, args ...interface{}) (map[rule]bool, error) {
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[rule]bool)
+	for rows.Next() {
+		var r rule
+		if err := rows.Scan(&r.Type, &r.Value, &r.Action); err != nil {
+			return nil, err
+		}
+		ret[r] = true
+	}
+	return ret, rows.Err()
+}
+
+// unlinkListRule takes r out of the ACL, and deletes it unless something
+// else still uses it.
+func unlinkListRule(tx *sql.Tx, id aclID, r rule) error {
+	if _, err := tx.Exec(`
+DELETE FROM aclrules
+WHERE acl_id=?
+AND rule_id IN (SELECT rule_id FROM rules WHERE type=? AND value=? AND action=?)`, string(id), r.Type, r.Value, r.Action); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+DELETE FROM rules
+WHERE type=? AND value=? AND action=?
+AND rule_id NOT IN (SELECT rule_id FROM aclrules)
+AND rule_id NOT IN (SELECT rule_id FROM ruleexpiry)`, r.Type, r.Value, r.Action)
+	return err
+}
+
+// syncListRules makes the rules list id put into its ACL match entries,
+// and returns the entries it added to and removed from the ACL.
+//
+// The list owns the rules it added, and ones another list of the same ACL
+// owns too. Only those are ever removed, and only once no other list of
+// the ACL has them. Rules made by hand are left alone, even when the list
+// has them too. A list that synced fine before but owns nothing, from
+// before ownership was recorded, adopts what of it is already in the ACL.
+func syncListRules(tx *sql.Tx, id listID, a aclID, entries []listEntry) (added, removed []listEntry, err error) {
+	owned, err := listRules(tx, `SELECT type, value, action FROM listentries WHERE list_id=?`, string(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	others, err := listRules(tx, `
+SELECT listentries.type, listentries.value, listentries.action
+FROM listentries
+JOIN listsubscriptions ON listentries.list_id=listsubscriptions.list_id
+WHERE listsubscriptions.acl_id=? AND listentries.list_id!=?`, string(a), string(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	var synced int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM listsubscriptions WHERE list_id=? AND last_sync IS NOT NULL AND COALESCE(last_error, '')=''`, string(id)).Scan(&synced); err != nil {
+		return nil, nil, err
+	}
+	adopt := len(owned) == 0 && synced > 0
+
+	l, err := newRuleLinker(tx, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.close()
+	own, err := tx.Prepare(`INSERT OR IGNORE INTO listentries(list_id, type, value, action) VALUES(?,?,?,?)`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer own.Close()
+	want := make(map[rule]bool)
+	for _, e := range entries {
+		isNew := false
+		for _, typ := range []string{typeDomain, typeHTTPSDomain} {
+			r := rule{Type: typ, Value: e.Value, Action: e.Action}
+			want[r] = true
+			n, err := l.add(typ, e.Value, e.Action)
+			if err != nil {
+				return nil, nil, err
+			}
+			if n || owned[r] || others[r] || adopt {
+				if _, err := own.Exec(string(id), r.Type, r.Value, r.Action); err != nil {
+					return nil, nil, err
+				}
+			}
+			isNew = isNew || n
+		}
+		if isNew {
+			added = append(added, e)
+		}
+	}
+	gone := make(map[listEntry]bool)
+	for r := range owned {
+		if want[r] {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM listentries WHERE list_id=? AND type=? AND value=? AND action=?`, string(id), r.Type, r.Value, r.Action); err != nil {
+			return nil, nil, err
+		}
+		if others[r] {
+			continue
+		}
+		if err := unlinkListRule(tx, a, r); err != nil {
+			return nil, nil, err
+		}
+		gone[listEntry{Value: r.Value, Action: r.Action}] = true
+	}
+	for e := range gone {
+		removed = append(removed, e)
+	}
+	sort.Sort(listEntriesByValue(removed))
+	return added, removed, nil
+}
+
+// syncList fetches a subscribed list, makes its ACL match it, and records
+// what changed.
+func syncList(id listID) (*listDelta, error) {
+	var a, u, format, action string
+	if err := db.QueryRow(`SELECT acl_id, url, format, action FROM listsubscriptions WHERE list_id=?`, string(id)).Scan(&a, &u, &format, &action); err != nil {
+		return nil, err
+	}
+	delta := &listDelta{URL: u}
+	if err := db.QueryRow(`SELECT COALESCE(comment, '') FROM acls WHERE acl_id=?`, a).Scan(&delta.ACL); err != nil {
+		return nil, err
+	}
+	var err error
+	if delta.Owner, err = getACLOwner(aclID(a)); err != nil {
+		return nil, err
+	}
+	err = func() error {
+		b, err := fetchList(u)
+		if err != nil {
+			return err
+		}
+		entries, err := parseList(bytes.NewReader(b), format, action)
+		if err != nil {
+			return err
+		}
+		return txWrap(func(tx *sql.Tx) error {
+			var err error
+			if delta.Added, delta.Removed, err = syncListRules(tx, id, aclID(a), entries); err != nil {
+				return err
+			}
+			now := time.Now().Unix()
+			for _, c := range []struct {
+				change  string
+				entries []listEntry
+			}{
+				{listChangeAdded, delta.Added},
+				{listChangeRemoved, delta.Removed},
+			} {
+				for _, e := range c.entries {
+					if _, err := tx.Exec(`INSERT INTO listchanges(list_id, time, change, value, action) VALUES(?,?,?,?,?)`, string(id), now, c.change, e.Value, e.Action); err != nil {
+						return err
+					}
+				}
+			}
+			log.Printf("Synced list %s from %q: %d entries, %d added, %d removed", id, u, len(entries), len(delta.Added), len(delta.Removed))
+			return nil
+		})
+	}()
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	if _, e := db.Exec(`UPDATE listsubscriptions SET last_sync=?, last_error=? WHERE list_id=?`, time.Now().Unix(), msg, string(id)); e != nil {
+		log.Printf("Failed to update sync status of list %s: %v", id, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return delta, nil
+}
+
+type listEntriesByValue []listEntry
+
+func (a listEntriesByValue) Len() int           { return len(a) }
+func (a listEntriesByValue) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a listEntriesByValue) Less(i, j int) bool { return a[i].Value < a[j].Value }
+
+// listReport formats the result of syncing all lists. It returns the empty
+// string if nothing changed and nothing failed.
+func listReport(deltas []*listDelta, errs map[string]error) string {
+	var buf bytes.Buffer
+	var urls []string
+	for u := range errs {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		fmt.Fprintf(&buf, "%s: sync failed: %v\n\n", u, errs[u])
+	}
+	for _, d := range deltas {
+		if len(d.Added) == 0 && len(d.Removed) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %d added, %d removed\n", d.URL, len(d.Added), len(d.Removed))
+		if d.ACL != "" {
+			fmt.Fprintf(&buf, "  ACL: %s\n", d.ACL)
+		}
+		if o := d.Owner.String(); o != "" {
+			fmt.Fprintf(&buf, "  Owner: %s\n", o)
+		}
+		for _, c := range []struct {
+			sign    string
+			entries []listEntry
+		}{
+			{"+", d.Added},
+			{"-", d.Removed},
+		} {
+			for n, e := range c.entries {
+				if n == maxReportEntries {
+					fmt.Fprintf(&buf, "  %s ... and %d more\n", c.sign, len(c.entries)-n)
+					break
+				}
+				fmt.Fprintf(&buf, "  %s %s %s\n", c.sign, e.Action, e.Value)
+			}
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+	return buf.String()
+}
+
+// getListSubscriptions returns the subscribed lists, with times in loc.
+func getListSubscriptions(loc *time.Location) ([]listSubscription, error) {
+	rows, err := db.Query(`
+SELECT listsubscriptions.list_id, listsubscriptions.acl_id, acls.comment, url, format, action, last_sync, last_error
+FROM listsubscriptions
+JOIN acls ON listsubscriptions.acl_id=acls.acl_id
+ORDER BY url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []listSubscription
+	for rows.Next() {
+		var s listSubscription
+		var id, a string
+		var c, lastErr sql.NullString
+		var last sql.NullInt64
+		if err := rows.Scan(&id, &a, &c, &s.URL, &s.Format, &s.Action, &last, &lastErr); err != nil {
+			return nil, err
+		}
+		s.ListID = listID(id)
+		s.ACL = acl{ACLID: aclID(a), Comment: c.String}
+		if last.Valid {
+			s.LastSync = formatUnix(last.Int64, loc)
+		}
+		s.LastError = lastErr.String
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
+
+// nextSyncTime returns the first time after now at clock (HH:MM).
+func nextSyncTime(now time.Time, clock string) (time.Time, error) {
+	m, err := policy.ParseClock(clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), m/60, m%60, 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// listSyncer queues a refresh of all subscribed lists nightly.
+func listSyncer() {
+	if serverOpts.ListSyncTime == "" {
+		return
+	}
+	for {
+		next, err := nextSyncTime(time.Now().In(scheduleZone()), serverOpts.ListSyncTime)
+		if err != nil {
+			log.Fatalf("Invalid -list_sync_time %q: %v", serverOpts.ListSyncTime, err)
+		}
+		time.Sleep(next.Sub(time.Now()))
+		if _, err := enqueueJob(jobListSyncAll, ""); err != nil {
+			log.Printf("Failed to queue list sync: %v", err)
+		}
+	}
+}
+
+// syncAllLists refreshes all subscribed lists and the bypass ACL, and
+// reports changes. Lists that fail to sync are reported, and fail the job
+// so it's retried, which only refetches lists that changed.
+func syncAllLists(j *jobRun) error {
+	subs, err := getListSubscriptions(displayZone())
+	if err != nil {
+		return err
+	}
+	var deltas []*listDelta
+	errs := make(map[string]error)
+	for _, s := range subs {
+		d, err := syncList(s.ListID)
+		if err != nil {
+			j.logf("Failed to sync list %s: %v", s.ListID, err)
+			errs[s.URL] = err
+			continue
+		}
+		j.logf("Synced %s: %d added, %d removed", s.URL, len(d.Added), len(d.Removed))
+		deltas = append(deltas, d)
+	}
+	if r := listReport(deltas, errs); r != "" {
+		notifyLog("squidwarden list changes", r)
+	}
+	refreshBypassACL()
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d lists failed to sync", len(errs), len(subs))
+	}
+	return nil
+}
+
+// getListChanges returns the newest changes synced from lists, with times
+// in loc.
+func getListChanges(limit int, loc *time.Location) ([]listChange, error) {
+	rows, err := db.Query(`
+SELECT listchanges.time, listsubscriptions.url, listchanges.change, listchanges.value, listchanges.action
+FROM listchanges
+JOIN listsubscriptions ON listchanges.list_id=listsubscriptions.list_id
+ORDER BY listchanges.time DESC, listchanges.value
+LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []listChange
+	for rows.Next() {
+		var c listChange
+		var t int64
+		if err := rows.Scan(&t, &c.URL, &c.Change, &c.Value, &c.Action); err != nil {
+			return nil, err
+		}
+		c.Time = formatUnix(t, loc)
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
+
+func listsHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Subscriptions      []listSubscription
+		Changes            []listChange
+		ACLs               []acl
+		Formats            []string
+		SyncTime           string
+		ThreatFeeds        []threatFeed
+		ThreatFormats      []string
+		ThreatACL          string
+		ThreatSyncInterval time.Duration
+		ThreatTTLDays      int
+	}{
+		Formats:            listFormats,
+		SyncTime:           serverOpts.ListSyncTime,
+		ThreatFormats:      threatFormats,
+		ThreatACL:          threatACLName,
+		ThreatSyncInterval: serverOpts.ThreatSyncInterval,
+		ThreatTTLDays:      defaultThreatTTLDays,
+	}
+	var err error
+	if data.Subscriptions, err = getListSubscriptions(requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.ThreatFeeds, err = getThreatFeeds(requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.Changes, err = getListChanges(200, requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.ACLs, err = getACLs(); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("lists.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// listImportHandler imports a pasted list once.
+func listImportHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		ACL    string `form:"acl,required,uuid"`
+		Format string `form:"format,required,enum=list_format"`
+		Action string `form:"action,required,enum=action"`
+		List   string `form:"list"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	id, format, action := aclID(data.ACL), data.Format, data.Action
+	entries, err := parseList(strings.NewReader(data.List), format, action)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Entries int `json:"entries"`
+		Added   int `json:"added"`
+	}{Entries: len(entries)}
+	log.Printf("Importing %d %s list entries into ACL %s", len(entries), format, id)
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var err error
+		resp.Added, _, err = importList(tx, id, entries, false)
+		return err
+	})
+}
+
+func listSubscribeHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		ACL    string `form:"acl,required,uuid"`
+		Format string `form:"format,required,enum=list_format"`
+		Action string `form:"action,required,enum=action"`
+		URL    string `form:"url,required,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	acl, format, action, u := aclID(data.ACL), data.Format, data.Action, data.URL
+	if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid list URL %q", u),
+			code:     http.StatusBadRequest,
+		}
+	}
+	id := uuid.NewV4().String()
+	log.Printf("Subscribing ACL %s to %s list %q", acl, format, u)
+	if _, err := db.Exec(`INSERT INTO listsubscriptions(list_id, acl_id, url, format, action) VALUES(?,?,?,?,?)`, id, string(acl), u, format, action); err != nil {
+		return nil, err
+	}
+	if _, err := enqueueJob(jobListSync, id); err != nil {
+		log.Printf("Failed to queue initial sync of list %s: %v", id, err)
+	}
+	return &struct {
+		List string `json:"list"`
+	}{List: id}, nil
+}
+
+func listSyncHandler(r *http.Request) (interface{}, error) {
+	id := assertListID(mux.Vars(r)["listID"])
+	d, err := syncList(id)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("sync failed: %v", err),
+			code:     http.StatusBadGateway,
+		}
+	}
+	return &struct {
+		Added   int `json:"added"`
+		Removed int `json:"removed"`
+	}{
+		Added:   len(d.Added),
+		Removed: len(d.Removed),
+	}, nil
+}
+
+// listDeleteHandler removes the subscription. The rules stay in the ACL,
+// and count as made by hand from then on.
+func listDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertListID(mux.Vars(r)["listID"])
+	log.Printf("Deleting list subscription %s", id)
+	resp := struct {
+		List    string `json:"list"`
+		Deleted int64  `json:"deleted"`
+	}{List: string(id)}
+	return &resp, store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		for _, q := range []string{
+			`DELETE FROM listchanges WHERE list_id=?`,
+			`DELETE FROM listentries WHERE list_id=?`,
+		} {
+			if _, err := tx.Exec(q, string(id)); err != nil {
+				return err
+			}
+		}
+		var err error
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM listsubscriptions WHERE list_id=?`, string(id)))
+		return err
+	})
+}
+
+// aclExportHandler exports the rules of an ACL as a list, or as records
+// for the stream formats.
+func aclExportHandler(w http.ResponseWriter, r *http.Request) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	format := r.FormValue("format")
+	switch format {
+	case formatJSON, formatNDJSON, formatCSV:
+		streamWrap(aclRulesHandler)(w, r)
+		return
+	}
+	rules, err := loadACL(id)
+	if err != nil {
+		log.Printf("Export of ACL %s: %v", id, err)
+		http.Error(w, "Failed to load ACL", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := formatList(&buf, rules, format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", string(id)+"."+format+".txt"))
+	w.Write(buf.Bytes())
+}
+
+func aclRulesHandler(r *http.Request, s *recordStream) error {
+	rules, err := loadACL(assertACLID(mux.Vars(r)["aclID"]))
+	if err != nil {
+		return err
+	}
+	for n := range rules {
+		if err := s.Write(&rules[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// A small Markdown renderer for ACL descriptions. It handles headings,
+// paragraphs, lists, code blocks, emphasis, code and links. Everything
+// else is shown as text, and HTML in the input is always escaped.
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	reMDHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	reMDBullet  = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	reMDNumber  = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+)
+
+// renderMarkdown renders s as HTML.
+func renderMarkdown(s string) template.HTML {
+	var buf bytes.Buffer
+	var para []string
+	list := "" // "ul", "ol" or "" if not in a list.
+	closeBlock := func() {
+		if len(para) > 0 {
+			fmt.Fprintf(&buf, "<p>%s</p>\n", mdInline(strings.Join(para, " ")))
+			para = nil
+		}
+		if list != "" {
+			fmt.Fprintf(&buf, "</%s>\n", list)
+			list = ""
+		}
+	}
+	item := func(typ, text string) {
+		if len(para) > 0 || list != typ {
+			closeBlock()
+			fmt.Fprintf(&buf, "<%s>\n", typ)
+			list = typ
+		}
+		fmt.Fprintf(&buf, "<li>%s</li>\n", mdInline(text))
+	}
+
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	for n := 0; n < len(lines); n++ {
+		l := strings.TrimRight(lines[n], " \t")
+		t := strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(t, "```"):
+			closeBlock()
+			var code []string
+			for n++; n < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[n]), "```"); n++ {
+				code = append(code, lines[n])
+			}
+			fmt.Fprintf(&buf, "<pre><code>%s</code></pre>\n", html.EscapeString(strings.Join(code, "\n")))
+		case t == "":
+			closeBlock()
+		case reMDHeading.MatchString(t):
+			closeBlock()
+			m := reMDHeading.FindStringSubmatch(t)
+			// The page already uses h2 for the ACL name.
+			h := len(m[1]) + 2
+			if h > 6 {
+				h = 6
+			}
+			fmt.Fprintf(&buf, "<h%d>%s</h%d>\n", h, mdInline(m[2]), h)
+		case reMDBullet.MatchString(t):
+			item("ul", reMDBullet.FindStringSubmatch(t)[1])
+		case reMDNumber.MatchString(t):
+			item("ol", reMDNumber.FindStringSubmatch(t)[1])
+		default:
+			if list != "" {
+				closeBlock()
+			}
+			para = append(para, t)
+		}
+	}
+	closeBlock()
+	return template.HTML(buf.String())
+}
+
+// mdSafeURL returns true for link targets that can't run script.
+func mdSafeURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "mailto":
+		return true
+	case "":
+		return u.Host == "" && !strings.HasPrefix(s, "//")
+	}
+	return false
+}
+
+// mdWordByte returns true if c is part of a word, so that _ inside
+// snake_case isn't taken as emphasis.
+func mdWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// mdInline renders the inline parts of s: `code`, **strong**, *em*, _em_
+// and [links](url).
+func mdInline(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '`':
+			if j := strings.IndexByte(s[i+1:], '`'); j >= 0 {
+				fmt.Fprintf(&buf, "<code>%s</code>", html.EscapeString(s[i+1:i+1+j]))
+				i += j + 2
+				continue
+			}
+		case c == '*' && strings.HasPrefix(s[i:], "**"):
+			if j := strings.Index(s[i+2:], "**"); j > 0 {
+				fmt.Fprintf(&buf, "<strong>%s</strong>", mdInline(s[i+2:i+2+j]))
+				i += j + 4
+				continue
+			}
+		case (c == '*' || c == '_') && (i == 0 || !mdWordByte(s[i-1])):
+			if j := strings.IndexByte(s[i+1:], c); j > 0 {
+				end := i + 1 + j
+				if end+1 == len(s) || !mdWordByte(s[end+1]) {
+					fmt.Fprintf(&buf, "<em>%s</em>", mdInline(s[i+1:end]))
+					i = end + 1
+					continue
+				}
+			}
+		case c == '[':
+			if j := strings.Index(s[i:], "]("); j > 0 {
+				if k := strings.IndexByte(s[i+j+2:], ')'); k >= 0 {
+					text := s[i+1 : i+j]
+					target := s[i+j+2 : i+j+2+k]
+					if mdSafeURL(target) {
+						fmt.Fprintf(&buf, `<a href="%s">%s</a>`, html.EscapeString(target), mdInline(text))
+						i += j + 2 + k + 1
+						continue
+					}
+				}
+			}
+		}
+		buf.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return buf.String()
+}
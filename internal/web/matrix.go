@@ -0,0 +1,177 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The policy matrix shows all of groupaccess at once: groups as rows and
+// ACLs as columns.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type matrixGroup struct {
+	Group   group
+	Sources int
+	Access  []bool // Same order as policyMatrix.ACLs.
+}
+
+type matrixACL struct {
+	ACL    acl
+	Rules  int
+	Groups int
+}
+
+type policyMatrix struct {
+	ACLs   []matrixACL
+	Groups []matrixGroup
+}
+
+// countBy runs a query returning (id, count) rows.
+func countBy(q string) (map[string]int, error) {
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		ret[id] = n
+	}
+	return ret, rows.Err()
+}
+
+func getPolicyMatrix() (*policyMatrix, error) {
+	groups, _, err := getGroups("")
+	if err != nil {
+		return nil, err
+	}
+	acls, err := getACLs()
+	if err != nil {
+		return nil, err
+	}
+	sources, err := countBy(`SELECT group_id, COUNT(*) FROM members GROUP BY group_id`)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := countBy(`SELECT acl_id, COUNT(*) FROM aclrules GROUP BY acl_id`)
+	if err != nil {
+		return nil, err
+	}
+	enabled := make(map[aclID]bool)
+	{
+		rows, err := db.Query(`SELECT acl_id, enabled FROM acls`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var e bool
+			if err := rows.Scan(&id, &e); err != nil {
+				return nil, err
+			}
+			enabled[aclID(id)] = e
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &policyMatrix{}
+	for _, a := range acls {
+		a.Enabled = enabled[a.ACLID]
+		m.ACLs = append(m.ACLs, matrixACL{ACL: a, Rules: rules[string(a.ACLID)]})
+	}
+	for _, g := range groups {
+		access, err := getGroupACLs(g.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		mg := matrixGroup{Group: g, Sources: sources[string(g.GroupID)]}
+		for n, a := range m.ACLs {
+			_, ok := access[a.ACL.ACLID]
+			mg.Access = append(mg.Access, ok)
+			if ok {
+				m.ACLs[n].Groups++
+			}
+		}
+		m.Groups = append(m.Groups, mg)
+	}
+	return m, nil
+}
+
+func matrixHandler(r *http.Request) (template.HTML, error) {
+	m, err := getPolicyMatrix()
+	if err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("matrix.html", template.FuncMap{
+		"aclAt": func(n int) matrixACL { return m.ACLs[n] },
+	})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, m); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func matrixJSONHandler(r *http.Request) (interface{}, error) {
+	return getPolicyMatrix()
+}
+
+// matrixAccessHandler gives or takes away a group's access to an ACL.
+func matrixAccessHandler(r *http.Request) (interface{}, error) {
+	g := assertGroupID(mux.Vars(r)["groupID"])
+	a := assertACLID(mux.Vars(r)["aclID"])
+	var data struct {
+		Access bool `form:"access"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	access := data.Access
+	log.Printf("Setting access of group %s to ACL %s to %t", g, a, access)
+	resp := struct {
+		Group   string `json:"group"`
+		ACL     string `json:"acl"`
+		Access  bool   `json:"access"`
+		Changed int64  `json:"changed"`
+	}{Group: string(g), ACL: string(a), Access: access}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var err error
+		if !access {
+			resp.Changed, err = rowsAffected(tx.Exec(`DELETE FROM groupaccess WHERE group_id=? AND acl_id=?`, string(g), string(a)))
+			return err
+		}
+		if err := checkNotArchived(tx, a); err != nil {
+			return err
+		}
+		resp.Changed, err = rowsAffected(tx.Exec(`INSERT OR IGNORE INTO groupaccess(group_id, acl_id, comment) VALUES(?,?,'')`, string(g), string(a)))
+		return err
+	})
+}
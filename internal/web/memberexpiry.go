@@ -0,0 +1,201 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Group memberships can expire, e.g. a guest's phone being in "guests" for
+// a week. The helper ignores expired memberships, and the janitor removes
+// them and notifies admins, so that guest groups don't fill up with
+// devices long gone.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// expiredMember is a membership that the janitor removed.
+type expiredMember struct {
+	SourceID      string
+	GroupID       string
+	Source        string
+	SourceComment string
+	Group         string
+	Expires       int64
+}
+
+// memberExpiryReport describes expired memberships, for notifications.
+func memberExpiryReport(ms []expiredMember, loc *time.Location) string {
+	var lines []string
+	for _, m := range ms {
+		src := m.Source
+		if src == "" {
+			src = m.SourceID
+		}
+		if m.SourceComment != "" {
+			src += " (" + m.SourceComment + ")"
+		}
+		group := m.Group
+		if group == "" {
+			group = m.GroupID
+		}
+		lines = append(lines, fmt.Sprintf("%s removed from %s, expired %s", src, group, formatUnix(m.Expires, loc)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// expireMembers removes all memberships that expired before now, and
+// notifies admins of them.
+func expireMembers(now time.Time) error {
+	rows, err := db.Query(`
+SELECT memberexpiry.source_id, memberexpiry.group_id, sources.source, sources.comment, groups.comment, memberexpiry.expires
+FROM memberexpiry
+LEFT JOIN sources ON memberexpiry.source_id=sources.source_id
+LEFT JOIN groups ON memberexpiry.group_id=groups.group_id
+WHERE memberexpiry.expires <= ?
+ORDER BY groups.comment, sources.source`, now.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var ms []expiredMember
+	for rows.Next() {
+		var m expiredMember
+		var src, sc, gc sql.NullString
+		if err := rows.Scan(&m.SourceID, &m.GroupID, &src, &sc, &gc, &m.Expires); err != nil {
+			return err
+		}
+		m.Source, m.SourceComment, m.Group = src.String, sc.String, gc.String
+		ms = append(ms, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ms) == 0 {
+		// Don't bump the revision for nothing.
+		return nil
+	}
+	log.Printf("Expiring %d group memberships", len(ms))
+	if err := txWrap(func(tx *sql.Tx) error {
+		for _, m := range ms {
+			for _, q := range []string{
+				`DELETE FROM memberexpiry WHERE source_id=? AND group_id=?`,
+				`DELETE FROM members WHERE source_id=? AND group_id=?`,
+			} {
+				if _, err := tx.Exec(q, m.SourceID, m.GroupID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	notifyLog("squidwarden memberships expired", memberExpiryReport(ms, displayZone()))
+	return nil
+}
+
+// getMemberExpiries returns when the memberships of group g expire, in loc.
+func getMemberExpiries(g groupID, loc *time.Location) (map[sourceID]string, error) {
+	rows, err := db.Query(`SELECT source_id, expires FROM memberexpiry WHERE group_id=?`, string(g))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[sourceID]string)
+	for rows.Next() {
+		var s string
+		var e int64
+		if err := rows.Scan(&s, &e); err != nil {
+			return nil, err
+		}
+		ret[sourceID(s)] = formatUnix(e, loc)
+	}
+	return ret, rows.Err()
+}
+
+// parseMemberExpiry parses how long from now a membership lasts, as a 400
+// if it's bad. Zero is forever.
+func parseMemberExpiry(s string) (time.Duration, error) {
+	d, err := parseExpiry(s)
+	if err != nil {
+		return 0, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid expiry %q", s),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"expires": "want a duration like 7d or 12h"}},
+		}
+	}
+	return d, nil
+}
+
+// setMemberExpiry makes the membership of sid in gid expire after d, or
+// never if d is zero.
+func setMemberExpiry(tx *sql.Tx, gid groupID, sid sourceID, d time.Duration, now time.Time) error {
+	if _, err := tx.Exec(`DELETE FROM memberexpiry WHERE source_id=? AND group_id=?`, string(sid), string(gid)); err != nil {
+		return err
+	}
+	if d == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO memberexpiry(source_id, group_id, expires) VALUES(?,?,?)`, string(sid), string(gid), now.Add(d).Unix())
+	return err
+}
+
+// memberExpiryHandler sets or clears when a source's membership of a group
+// expires.
+func memberExpiryHandler(r *http.Request) (interface{}, error) {
+	gid := assertGroupID(mux.Vars(r)["groupID"])
+	var data struct {
+		Source  string `form:"source,required,uuid"`
+		Expires string `form:"expires,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	d, err := parseMemberExpiry(data.Expires)
+	if err != nil {
+		return nil, err
+	}
+	sid := sourceID(data.Source)
+	now := time.Now()
+	resp := struct {
+		Group   string `json:"group"`
+		Source  string `json:"source"`
+		Expires string `json:"expires,omitempty"`
+	}{Group: string(gid), Source: string(sid)}
+	if d > 0 {
+		resp.Expires = formatTime(now.Add(d), requestZone(r))
+	}
+	log.Printf("Setting expiry of %s in %s to %v", sid, gid, d)
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM members WHERE group_id=? AND source_id=?`, string(gid), string(sid)).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return errHTTP{
+				external: fmt.Sprintf("source %q is not a member of group %q", sid, gid),
+				code:     http.StatusNotFound,
+			}
+		}
+		return setMemberExpiry(tx, gid, sid, d, now)
+	})
+}
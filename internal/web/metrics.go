@@ -0,0 +1,151 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Metrics exporters push counters to InfluxDB and/or Graphite. Traffic
+// counters count requests in the squid log since startup, and the policy
+// gauges are read from the database at push time.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+var (
+	metricsClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// trafficCounters are updated atomically by the log follower.
+type trafficCounters struct {
+	requests int64
+	denied   int64
+	bytes    int64
+}
+
+func (c *trafficCounters) add(e *squidlog.Entry) {
+	atomic.AddInt64(&c.requests, 1)
+	atomic.AddInt64(&c.bytes, e.Bytes)
+	if strings.Contains(e.Status, "DENIED") {
+		atomic.AddInt64(&c.denied, 1)
+	}
+}
+
+type metric struct {
+	name  string
+	value int64
+}
+
+// metricTables are counted for the policy gauges.
+var metricTables = []string{"acls", "rules", "groups", "sources", "reviewqueue"}
+
+func collectMetrics(c *trafficCounters) ([]metric, error) {
+	ms := []metric{
+		{"requests", atomic.LoadInt64(&c.requests)},
+		{"denied", atomic.LoadInt64(&c.denied)},
+		{"bytes", atomic.LoadInt64(&c.bytes)},
+	}
+	for _, t := range metricTables {
+		var n int64
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + t).Scan(&n); err != nil {
+			return nil, err
+		}
+		ms = append(ms, metric{t, n})
+	}
+	return ms, nil
+}
+
+// formatInflux formats metrics as one InfluxDB line protocol point.
+func formatInflux(ms []metric, t time.Time) string {
+	var f []string
+	for _, m := range ms {
+		f = append(f, fmt.Sprintf("%s=%di", m.name, m.value))
+	}
+	return fmt.Sprintf("squidwarden %s %d\n", strings.Join(f, ","), t.UnixNano())
+}
+
+// formatGraphite formats metrics in the Graphite plaintext protocol.
+func formatGraphite(prefix string, ms []metric, t time.Time) string {
+	var buf bytes.Buffer
+	for _, m := range ms {
+		fmt.Fprintf(&buf, "%s.%s %d %d\n", prefix, m.name, m.value, t.Unix())
+	}
+	return buf.String()
+}
+
+func pushInflux(body string) error {
+	resp, err := metricsClient.Post(serverOpts.InfluxDBURL, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%q returned %q", serverOpts.InfluxDBURL, resp.Status)
+	}
+	return nil
+}
+
+func pushGraphite(body string) error {
+	conn, err := net.DialTimeout("tcp", serverOpts.Graphite, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(body))
+	return err
+}
+
+func pushMetrics(c *trafficCounters) {
+	for range time.Tick(serverOpts.MetricsInterval) {
+		ms, err := collectMetrics(c)
+		if err != nil {
+			log.Printf("Failed to collect metrics: %v", err)
+			continue
+		}
+		now := time.Now()
+		if serverOpts.InfluxDBURL != "" {
+			if err := pushInflux(formatInflux(ms, now)); err != nil {
+				log.Printf("Failed to push metrics to InfluxDB: %v", err)
+			}
+		}
+		if serverOpts.Graphite != "" {
+			if err := pushGraphite(formatGraphite(serverOpts.GraphitePrefix, ms, now)); err != nil {
+				log.Printf("Failed to push metrics to Graphite: %v", err)
+			}
+		}
+	}
+}
+
+func startMetrics() {
+	if serverOpts.InfluxDBURL == "" && serverOpts.Graphite == "" {
+		return
+	}
+	c := &trafficCounters{}
+	if ingestConfigured() {
+		go newLogIngester("", c.add).run()
+	}
+	go pushMetrics(c)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Notifications to admins, by email and/or webhook.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var (
+	notifyClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// notify sends a notification to all configured destinations.
+func notify(subject, text string) error {
+	var errs []string
+	if serverOpts.NotifyWebhook != "" {
+		if err := notifyByWebhook(subject, text); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook: %v", err))
+		}
+	}
+	if serverOpts.NotifyEmail != "" {
+		if err := notifyByEmail(subject, text); err != nil {
+			errs = append(errs, fmt.Sprintf("email: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("notification failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func notifyByWebhook(subject, text string) error {
+	b, err := json.Marshal(struct {
+		Subject string `json:"subject"`
+		Text    string `json:"text"`
+	}{
+		Subject: subject,
+		Text:    text,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(serverOpts.NotifyWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%q returned %q", serverOpts.NotifyWebhook, resp.Status)
+	}
+	return nil
+}
+
+func notifyByEmail(subject, text string) error {
+	var to []string
+	for _, a := range strings.Split(serverOpts.NotifyEmail, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			to = append(to, a)
+		}
+	}
+	return sendMail(to, subject, "text/plain", text)
+}
+
+// sendMail emails body, of contentType, from -notify_from.
+func sendMail(to []string, subject, contentType, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", serverOpts.NotifyFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", oneLine(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s; charset=utf-8\r\n\r\n", contentType)
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(serverOpts.SMTPServer, nil, serverOpts.NotifyFrom, to, msg.Bytes())
+}
+
+// notifyLog is notify for callers that can't do anything about errors.
+func notifyLog(subject, text string) {
+	if err := notify(subject, text); err != nil {
+		log.Printf("Failed to send notification %q: %v", subject, err)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"flag"
+	"io"
+	"time"
+)
+
+// Options configures the server. The fields that are flags are named after
+// them; see RegisterFlags.
+type Options struct {
+	Templates  string // Template directory.
+	Static     string // Static file directory.
+	SquidLog   string // Squid access log. Empty if there's none.
+	Websockets bool   // Stream the log over websockets.
+	FastCGI    bool   // Served over FastCGI. Turns off websockets.
+	HTTPSOnly  bool   // Only send the CSRF cookie over HTTPS.
+	HSTS       time.Duration
+	CSRFKey    []byte // 32 bytes. Random if nil.
+	Demo       bool   // Running on demo data. See OpenDemo.
+
+	// RequestLog gets a line per request to the UI. Nil disables.
+	RequestLog io.Writer
+
+	// Files and the database.
+	DiskFiles      bool
+	MemFiles       bool
+	Theme          string
+	Schema         string
+	GroupTemplates string
+
+	// Serving the UI.
+	Proxy            string
+	CSPWebsocket     string
+	CSP              string
+	FrameOptions     string
+	ReferrerPolicy   string
+	TrustedProxy     string
+	IdempotencyHours int
+	TailMaxLines     int
+	TimeZone         string
+
+	// Users.
+	AuthHeader string
+	Readers    string
+	Writers    string
+	Admins     string
+
+	// Reading the squid log.
+	IngestLogs        string
+	SyslogUDP         string
+	SyslogTCP         string
+	SyslogAudit       string
+	Learn             string
+	Stats             bool
+	StatsRawDays      int
+	StatsHourlyMonths int
+	Discover          bool
+	DiscoverDays      int
+	PrivacyAfter      time.Duration
+	PrivacyMode       string
+	PrivacySalt       string
+
+	// Applying policy to squid and around it.
+	SquidConf        string
+	SquidReconfigure string
+	ACLFilesDir      string
+	ACLFileShard     int
+	SquidErrorsDir   string
+	PublicURL        string
+	FirewallConf     string
+	FirewallReload   string
+	BundleFile       string
+	BundleKey        string
+	BypassListURL    string
+	CacheMgr         string
+	CacheMgrPassword string
+	KillCommand      string
+
+	// Public pages.
+	WhyPage           bool
+	Registration      bool
+	RegistrationGroup string
+
+	// Scheduled jobs.
+	BackupDir          string
+	BackupTime         string
+	BackupKeep         int
+	ListSyncTime       string
+	ThreatSyncInterval time.Duration
+	DigestDay          string
+	DigestTime         string
+
+	// Telling others about things.
+	NotifyWebhook   string
+	NotifyEmail     string
+	NotifyFrom      string
+	SMTPServer      string
+	InfluxDBURL     string
+	Graphite        string
+	GraphitePrefix  string
+	MetricsInterval time.Duration
+	NATS            string
+	NATSSubject     string
+	KafkaREST       string
+	KafkaTopic      string
+
+	// Looking things up.
+	SiteInfo            bool
+	ReputationList      string
+	ReputationAPI       string
+	ReputationAPIHeader string
+	DHCPLeases          string
+
+	// Promotion between instances.
+	PromoteFrom        string
+	PromoteFromToken   string
+	PromoteTo          string
+	PromoteToToken     string
+	PromoteSelfApprove bool
+}
+
+// DefaultOptions returns the options with every flag at its default.
+func DefaultOptions() Options {
+	var o Options
+	o.RegisterFlags(flag.NewFlagSet("defaults", flag.ContinueOnError))
+	return o
+}
+
+// RegisterFlags adds a flag for every option that has one to fs, setting
+// the option to its default.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Templates, "templates", "templates", "Template dir")
+	fs.StringVar(&o.Static, "static", "static", "Static dir")
+	fs.StringVar(&o.SquidLog, "squidlog", "", "Path to squid log.")
+	fs.BoolVar(&o.Websockets, "websockets", true, "Enable websockets (-fcgi turns them off).")
+	fs.BoolVar(&o.HTTPSOnly, "https_only", true, "Only work with HTTPS.")
+	fs.DurationVar(&o.HSTS, "hsts_ttl", 0, "HSTS TTL. If 0 don't set header.")
+	fs.BoolVar(&o.Demo, "demo", false, "Run on an in-memory database with example data and a made up squid log. -db and -squidlog are ignored.")
+
+	fs.BoolVar(&o.DiskFiles, "disk_files", true, "Try to read files off of disk.")
+	fs.BoolVar(&o.MemFiles, "mem_files", true, "Try to read files in memory.")
+	fs.StringVar(&o.Theme, "theme", "", "Theme directory. Overrides built in templates, static files and branding.")
+	fs.StringVar(&o.Schema, "schema", "sqlite.schema", "sqlite.schema of this version. The setup wizard creates the database with it, and older databases are brought up to date with it at startup.")
+	fs.StringVar(&o.GroupTemplates, "group_templates", "", "Directory of group templates (*.json) to offer in addition to the built in ones.")
+
+	fs.StringVar(&o.Proxy, "proxy", "", "Host:port to proxy.")
+	fs.StringVar(&o.CSPWebsocket, "csp_ws", "", "ws/wss URL to allow for CSP. 'self' is implied.")
+	fs.StringVar(&o.CSP, "csp", "", "Content-Security-Policy header. Default is to only allow this site.")
+	fs.StringVar(&o.FrameOptions, "frame_options", "DENY", "X-Frame-Options header. Empty allows framing.")
+	fs.StringVar(&o.ReferrerPolicy, "referrer_policy", "same-origin", "Referrer-Policy header. Empty doesn't set it.")
+	fs.StringVar(&o.TrustedProxy, "trusted_proxy", "", "Comma separated addresses or networks of the reverse proxy in front of the UI, e.g. 127.0.0.1,::1. Only requests from them are believed about the end user's address in X-Real-IP or X-Forwarded-For, for /why, /exception and /register. Empty believes nobody.")
+	fs.IntVar(&o.IdempotencyHours, "idempotency_hours", 24, "Hours to keep Idempotency-Key replies for.")
+	fs.IntVar(&o.TailMaxLines, "tail_max_lines", 500, "Most entries the tail log returns, or streams before following, whatever count asks for.")
+	fs.StringVar(&o.TimeZone, "time_zone", "", "IANA time zone (e.g. Europe/Stockholm) to show times and run schedules in. Overrides the one set in the UI. Empty uses the UI setting, or UTC.")
+
+	fs.StringVar(&o.AuthHeader, "auth_header", "X-Remote-User", "Header with the authenticated user, set by the reverse proxy.")
+	fs.StringVar(&o.Readers, "readers", "", "Comma separated users who can view. '*' is any authenticated user.")
+	fs.StringVar(&o.Writers, "writers", "", "Comma separated users who can change policy. '*' is any authenticated user.")
+	fs.StringVar(&o.Admins, "admins", "", "Comma separated users who can change everything. '*' is any authenticated user.")
+
+	fs.StringVar(&o.IngestLogs, "ingest_logs", "", "Comma separated squid logs or globs to ingest for stats, learning, discovery, alerts and metrics, e.g. /var/log/squid/access-*.log for SMP workers. Default is -squidlog.")
+	fs.StringVar(&o.SyslogUDP, "syslog_udp", "", "UDP address (e.g. :5514) to receive squid logs over syslog on, appending them to -squidlog. Empty disables.")
+	fs.StringVar(&o.SyslogTCP, "syslog_tcp", "", "TCP address (e.g. :5514) to receive squid logs over syslog on, appending them to -squidlog. Empty disables.")
+	fs.StringVar(&o.SyslogAudit, "syslog_audit", "", "Where to send changes to as syslog audit events: 'local', or network:host:port, e.g. udp:logs.example.com:514. Empty disables.")
+	fs.StringVar(&o.Learn, "learn", learnOff, "Collect hosts from the squid log into the review queue. 'denied' or 'all'.")
+	fs.BoolVar(&o.Stats, "stats", false, "Record traffic stats from the squid log.")
+	fs.IntVar(&o.StatsRawDays, "stats_raw_days", 7, "Days to keep raw traffic stats before compacting them into hourly totals. 0 keeps them forever.")
+	fs.IntVar(&o.StatsHourlyMonths, "stats_hourly_months", 12, "Months to keep hourly traffic totals. 0 keeps them forever.")
+	fs.BoolVar(&o.Discover, "discover", true, "Track clients in the squid log, to show the ones that aren't in any group.")
+	fs.IntVar(&o.DiscoverDays, "discover_days", 30, "Forget clients not seen for this many days.")
+	fs.DurationVar(&o.PrivacyAfter, "privacy_after", 0, "Anonymize clients and strip URL paths in stored traffic data older than this. 0 disables.")
+	fs.StringVar(&o.PrivacyMode, "privacy_mode", privacyTruncate, "How to anonymize clients: 'truncate' IPs to /24 (IPv4) or /48 (IPv6), or 'hash' them with -privacy_salt.")
+	fs.StringVar(&o.PrivacySalt, "privacy_salt", "", "Secret salt for -privacy_mode=hash.")
+
+	fs.StringVar(&o.SquidConf, "squid_conf", "", "File to write generated squid config to. Include it from squid.conf.")
+	fs.StringVar(&o.SquidReconfigure, "squid_reconfigure", "", "Command to make squid reload its config, e.g. 'squid3 -k reconfigure'.")
+	fs.StringVar(&o.ACLFilesDir, "acl_files_dir", "", "Directory to write a dstdomain file per ACL and action to, on apply. Empty disables.")
+	fs.IntVar(&o.ACLFileShard, "acl_file_shard", 100000, "Max domains per ACL domain file. Bigger ACLs are split into several files.")
+	fs.StringVar(&o.SquidErrorsDir, "squid_errors_dir", "", "Directory to write deny pages to. Must be where squid looks for error pages.")
+	fs.StringVar(&o.PublicURL, "public_url", "", "URL end users reach squidwarden at, for links on deny pages.")
+	fs.StringVar(&o.FirewallConf, "firewall_conf", "", "File to write generated nftables rules blocking QUIC to, on apply.")
+	fs.StringVar(&o.FirewallReload, "firewall_reload", "", "Command to load the firewall rules, e.g. 'nft -f /etc/squidwarden-quic.nft'.")
+	fs.StringVar(&o.BundleFile, "bundle_file", "", "File to write a bundle of the generated config to on apply, for cmd/agent. Empty disables.")
+	fs.StringVar(&o.BundleKey, "bundle_key", "", "ed25519 private key file to sign bundles with, from 'agent -gen_key'. Empty writes unsigned bundles.")
+	fs.StringVar(&o.BypassListURL, "bypass_list_url", "", "URL of a hosts file of more bypass services to block, added to the built in list.")
+	fs.StringVar(&o.CacheMgr, "cachemgr", "", "Squid cache manager base URL, e.g. http://127.0.0.1:3128/squid-internal-mgr/")
+	fs.StringVar(&o.CacheMgrPassword, "cachemgr_password", "", "Squid cachemgr_passwd, if any.")
+	fs.StringVar(&o.KillCommand, "kill_command", "", "Command to terminate all connections from a client. The client IP is appended as last argument. E.g. 'ss -K dst'. Empty disables.")
+
+	fs.BoolVar(&o.WhyPage, "why_page", false, "Serve /why, a public page where users can check why a URL is blocked for their address.")
+	fs.BoolVar(&o.Registration, "registration", false, "Let clients that aren't in any group register their device at /register, for approval.")
+	fs.StringVar(&o.RegistrationGroup, "registration_group", "", "ID of the group that devices registering without a code ask to join. Empty requires a code from /registrations.")
+
+	fs.StringVar(&o.BackupDir, "backup_dir", "", "Directory to write nightly config backups to. Empty disables.")
+	fs.StringVar(&o.BackupTime, "backup_time", "02:30", "Local time of day (HH:MM) to back up the config.")
+	fs.IntVar(&o.BackupKeep, "backup_keep", 14, "Number of config backups to keep.")
+	fs.StringVar(&o.ListSyncTime, "list_sync_time", "03:00", "Local time of day (HH:MM) to refresh subscribed lists. Empty disables.")
+	fs.DurationVar(&o.ThreatSyncInterval, "threat_sync_interval", time.Hour, "How often to refresh threat feeds. 0 disables.")
+	fs.StringVar(&o.DigestDay, "digest_day", "", "Day of the week (e.g. mon) to email the weekly digest to subscribers. Empty disables.")
+	fs.StringVar(&o.DigestTime, "digest_time", "08:00", "Local time of day (HH:MM) to email the weekly digest.")
+
+	fs.StringVar(&o.NotifyWebhook, "notify_webhook", "", "URL to POST notifications to, as JSON {\"subject\": ..., \"text\": ...}.")
+	fs.StringVar(&o.NotifyEmail, "notify_email", "", "Comma separated addresses to email notifications to.")
+	fs.StringVar(&o.NotifyFrom, "notify_from", "squidwarden@localhost", "From address of notification emails.")
+	fs.StringVar(&o.SMTPServer, "smtp_server", "localhost:25", "SMTP server host:port for notification emails.")
+	fs.StringVar(&o.InfluxDBURL, "influxdb_url", "", "InfluxDB write URL to push metrics to, e.g. http://localhost:8086/write?db=squid. Empty disables.")
+	fs.StringVar(&o.Graphite, "graphite", "", "Graphite plaintext host:port to push metrics to. Empty disables.")
+	fs.StringVar(&o.GraphitePrefix, "graphite_prefix", "squidwarden", "Prefix of Graphite metric names.")
+	fs.DurationVar(&o.MetricsInterval, "metrics_interval", time.Minute, "How often to push metrics.")
+	fs.StringVar(&o.NATS, "nats", "", "NATS server to publish changes to, as nats://[user:password@]host:port, or tls:// for TLS. Empty disables.")
+	fs.StringVar(&o.NATSSubject, "nats_subject", "squidwarden", "Prefix of NATS subjects. Changes are published on <prefix>.change.")
+	fs.StringVar(&o.KafkaREST, "kafka_rest", "", "Kafka REST proxy URL to publish changes through, e.g. http://localhost:8082. Empty disables.")
+	fs.StringVar(&o.KafkaTopic, "kafka_topic", "squidwarden", "Kafka topic to publish changes to.")
+
+	fs.BoolVar(&o.SiteInfo, "site_info", true, "Fetch favicons and titles of domains in the review queue and ACLs from the sites. False is offline mode: only already cached ones are shown.")
+	fs.StringVar(&o.ReputationList, "reputation_list", "", "File of domain reputation scores, one 'domain score [label]' per line, from 0 (good) to 100 (bad). Domains cover their subdomains. Reread when changed. Empty disables.")
+	fs.StringVar(&o.ReputationAPI, "reputation_api", "", "URL of a domain reputation API, with {domain} replaced by the host, returning JSON with a 'score' from 0 (good) to 100 (bad) and optionally a 'label'. Empty disables.")
+	fs.StringVar(&o.ReputationAPIHeader, "reputation_api_header", "", "Header to send to -reputation_api, e.g. 'X-Api-Key: secret'.")
+	fs.StringVar(&o.DHCPLeases, "dhcp_leases", "", "dnsmasq or ISC dhcpd leases file to suggest sources from, e.g. /var/lib/misc/dnsmasq.leases.")
+
+	fs.StringVar(&o.PromoteFrom, "promote_from", "", "Base URL of the instance (e.g. staging) to pull policies from for promotion to this one. Empty disables pulling.")
+	fs.StringVar(&o.PromoteFromToken, "promote_from_token", "", "File with an API token of -promote_from, with read permission.")
+	fs.StringVar(&o.PromoteTo, "promote_to", "", "Base URL of the instance (e.g. production) to push this policy to for promotion. Empty disables pushing.")
+	fs.StringVar(&o.PromoteToToken, "promote_to_token", "", "File with an API token of -promote_to, with write permission.")
+	fs.BoolVar(&o.PromoteSelfApprove, "promote_self_approve", false, "Let whoever asked for a promotion approve it too.")
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Owners of ACLs and groups, i.e. who to ask before changing them.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/mail"
+
+	"github.com/gorilla/mux"
+)
+
+// maxOwnerLength is the longest owner or contact accepted.
+const maxOwnerLength = 200
+
+type owner struct {
+	Owner   string // Team or person.
+	Contact string // Email address.
+}
+
+func (o owner) String() string {
+	switch {
+	case o.Owner == "":
+		return o.Contact
+	case o.Contact == "":
+		return o.Owner
+	}
+	return fmt.Sprintf("%s <%s>", o.Owner, o.Contact)
+}
+
+// getOwner returns the owner of the ACL or group id, which is empty if
+// not set. table is aclowners or groupowners.
+func getOwner(table, column, id string) (owner, error) {
+	var o owner
+	err := db.QueryRow(`SELECT owner, contact FROM `+table+` WHERE `+column+`=?`, id).Scan(&o.Owner, &o.Contact)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return o, err
+}
+
+func getACLOwner(id aclID) (owner, error)     { return getOwner("aclowners", "acl_id", string(id)) }
+func getGroupOwner(id groupID) (owner, error) { return getOwner("groupowners", "group_id", string(id)) }
+
+// parseOwner reads and checks the owner and contact form values.
+func parseOwner(r *http.Request) (owner, error) {
+	var data struct {
+		Owner   string `form:"owner,trim"`
+		Contact string `form:"contact,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return owner{}, err
+	}
+	o := owner{Owner: data.Owner, Contact: data.Contact}
+	if len(o.Owner) > maxOwnerLength || len(o.Contact) > maxOwnerLength {
+		return owner{}, errHTTP{
+			external: fmt.Sprintf("owner and contact may be at most %d characters", maxOwnerLength),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if o.Contact != "" {
+		a, err := mail.ParseAddress(o.Contact)
+		if err != nil || a.Name != "" {
+			return owner{}, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("contact %q is not an email address", o.Contact),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	return o, nil
+}
+
+// setOwner replaces the owner of the ACL or group id. An empty owner
+// removes it.
+func setOwner(table, column, id string, o owner) error {
+	return txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+column+`=?`, id); err != nil {
+			return err
+		}
+		if o == (owner{}) {
+			return nil
+		}
+		_, err := tx.Exec(`INSERT INTO `+table+`(`+column+`, owner, contact) VALUES(?,?,?)`, id, o.Owner, o.Contact)
+		return err
+	})
+}
+
+func aclOwnerHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	o, err := parseOwner(r)
+	if err != nil {
+		return nil, err
+	}
+	if archived, err := isArchived(id); err != nil {
+		return nil, err
+	} else if archived {
+		return nil, errHTTP{
+			external: "ACL is archived, and read-only until unarchived",
+			code:     http.StatusConflict,
+		}
+	}
+	if err := setOwner("aclowners", "acl_id", string(id), o); err != nil {
+		return nil, err
+	}
+	return &struct {
+		ACL     string `json:"acl"`
+		Owner   string `json:"owner"`
+		Contact string `json:"contact"`
+	}{string(id), o.Owner, o.Contact}, nil
+}
+
+func groupOwnerHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	o, err := parseOwner(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := setOwner("groupowners", "group_id", string(id), o); err != nil {
+		return nil, err
+	}
+	return &struct {
+		Group   string `json:"group"`
+		Owner   string `json:"owner"`
+		Contact string `json:"contact"`
+	}{string(id), o.Owner, o.Contact}, nil
+}
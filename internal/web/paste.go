@@ -0,0 +1,253 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+// maxPasteSize is the largest pasted text accepted by rulePasteHandler.
+const maxPasteSize = 1 << 20
+
+// pasteCandidate is a rule suggested from a line of pasted text.
+type pasteCandidate struct {
+	Line     int              `json:"line"`
+	Format   string           `json:"format"`
+	Type     string           `json:"type"`
+	Value    string           `json:"value"`
+	Action   string           `json:"action,omitempty"`
+	Warnings []policy.Warning `json:"warnings,omitempty"`
+}
+
+// pasteSkipped is a line of pasted text that gave no rules.
+type pasteSkipped struct {
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	Reason string `json:"reason"`
+}
+
+// Formats of pasted lines.
+const (
+	pasteHosts   = "hosts"
+	pasteAdblock = "adblock"
+	pasteURL     = "url"
+	pasteSquid   = "squid"
+	pasteHost    = "host"
+)
+
+// parsePasted turns pasted text into candidate rules. Each line can be a
+// hosts file line, an adblock rule, a URL, a squid acl line or a bare
+// host name. Host names become both a domain and an https-domain rule,
+// since they're meant to cover the whole site. Action is only set when
+// the format says what it should be.
+func parsePasted(text string) ([]pasteCandidate, []pasteSkipped) {
+	var cands []pasteCandidate
+	var skipped []pasteSkipped
+	seen := make(map[[2]string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), maxPasteSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, "!") || strings.HasPrefix(l, "[") {
+			continue
+		}
+		add := func(format, typ, value, action string) {
+			k := [2]string{typ, value}
+			if seen[k] {
+				return
+			}
+			seen[k] = true
+			cands = append(cands, pasteCandidate{
+				Line:     line,
+				Format:   format,
+				Type:     typ,
+				Value:    value,
+				Action:   action,
+				Warnings: policy.Lint(typ, value),
+			})
+		}
+		addSite := func(format, value, action string) {
+			add(format, typeDomain, value, action)
+			add(format, typeHTTPSDomain, value, action)
+		}
+		if err := parsePastedLine(l, add, addSite); err != nil {
+			skipped = append(skipped, pasteSkipped{Line: line, Text: l, Reason: err.Error()})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		skipped = append(skipped, pasteSkipped{Line: line + 1, Reason: err.Error()})
+	}
+	return cands, skipped
+}
+
+// parsePastedLine calls add or addSite for the rules in one non-empty,
+// non-comment line.
+func parsePastedLine(l string, add func(format, typ, value, action string), addSite func(format, value, action string)) error {
+	f := strings.Fields(l)
+	switch {
+	case strings.HasPrefix(l, "||") || strings.HasPrefix(l, "@@||"):
+		es, err := parseList(strings.NewReader(l), listAdblock, "")
+		if err != nil {
+			return err
+		}
+		if len(es) == 0 {
+			return fmt.Errorf("adblock rule with options or a path can't be a domain rule")
+		}
+		for _, e := range es {
+			addSite(pasteAdblock, e.Value, e.Action)
+		}
+		return nil
+
+	case f[0] == "acl":
+		return parsePastedSquid(f, add, addSite)
+
+	case strings.Contains(l, "://"):
+		u, err := url.Parse(f[0])
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("not a valid URL")
+		}
+		host := strings.ToLower(u.Host)
+		switch u.Scheme {
+		case "http":
+			if h, port, err := net.SplitHostPort(host); err == nil && port == "80" {
+				host = h
+			}
+			add(pasteURL, typeDomain, host, "")
+		case "https":
+			if h, port, err := net.SplitHostPort(host); err == nil && port == "443" {
+				host = h
+			}
+			add(pasteURL, typeHTTPSDomain, host, "")
+		default:
+			return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+		}
+		return nil
+
+	case net.ParseIP(f[0]) != nil:
+		es, err := parseList(strings.NewReader(l), listHosts, actionBlock)
+		if err != nil {
+			return err
+		}
+		if len(es) == 0 {
+			return fmt.Errorf("no host names in hosts file line")
+		}
+		for _, e := range es {
+			addSite(pasteHosts, e.Value, e.Action)
+		}
+		return nil
+	}
+
+	if len(f) != 1 {
+		return fmt.Errorf("unrecognized line")
+	}
+	h := strings.ToLower(f[0])
+	sub := ""
+	switch {
+	case strings.HasPrefix(h, "*."):
+		sub, h = ".", h[2:]
+	case strings.HasPrefix(h, "."):
+		sub, h = ".", h[1:]
+	}
+	if !validListHost(h) {
+		return fmt.Errorf("not a host name")
+	}
+	addSite(pasteHost, sub+h, "")
+	return nil
+}
+
+// parsePastedSquid handles "acl <name> <type> [-i] <values...>" lines.
+func parsePastedSquid(f []string, add func(format, typ, value, action string), addSite func(format, value, action string)) error {
+	if len(f) < 4 {
+		return fmt.Errorf("squid acl line without values")
+	}
+	var values []string
+	for _, v := range f[3:] {
+		if strings.HasPrefix(v, "-") {
+			continue
+		}
+		if strings.HasPrefix(v, `"`) {
+			return fmt.Errorf("squid acl values read from a file can't be imported")
+		}
+		values = append(values, v)
+	}
+	switch f[2] {
+	case "dstdomain":
+		for _, v := range values {
+			addSite(pasteSquid, strings.ToLower(v), "")
+		}
+	case "ssl::server_name":
+		for _, v := range values {
+			add(pasteSquid, typeHTTPSDomain, strings.ToLower(v), "")
+		}
+	case "url_regex":
+		// Squid regexes aren't anchored, but ours are.
+		for _, v := range values {
+			if strings.HasPrefix(v, "^") {
+				v = v[1:]
+			} else {
+				v = ".*" + v
+			}
+			if strings.HasSuffix(v, "$") && !strings.HasSuffix(v, `\$`) {
+				v = v[:len(v)-1]
+			} else {
+				v += ".*"
+			}
+			add(pasteSquid, typeRegex, v, "")
+		}
+	default:
+		return fmt.Errorf("squid acl type %q not supported", f[2])
+	}
+	return nil
+}
+
+// rulePasteHandler parses pasted text into candidate rules, for the user
+// to confirm before adding them with ruleBulkHandler.
+func rulePasteHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Text string `form:"text"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	text := data.Text
+	if len(text) > maxPasteSize {
+		return nil, errHTTP{
+			external: fmt.Sprintf("pasted text too long, max %d bytes", maxPasteSize),
+			code:     http.StatusBadRequest,
+		}
+	}
+	resp := struct {
+		Candidates []pasteCandidate `json:"candidates"`
+		Skipped    []pasteSkipped   `json:"skipped"`
+	}{}
+	resp.Candidates, resp.Skipped = parsePasted(text)
+	if resp.Candidates == nil {
+		resp.Candidates = []pasteCandidate{}
+	}
+	if resp.Skipped == nil {
+		resp.Skipped = []pasteSkipped{}
+	}
+	return &resp, nil
+}
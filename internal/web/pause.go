@@ -0,0 +1,187 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Pausing a group blocks all its traffic, ahead of any rules. The helper
+// picks it up on its next reload. Connections already open are killed if
+// -cachemgr and -kill_command are set.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type groupPause struct {
+	Group   group
+	Paused  bool
+	Expires string
+}
+
+// getGroupPauses returns all groups and whether they're paused, with
+// expiry times in loc.
+func getGroupPauses(loc *time.Location) ([]groupPause, error) {
+	groups, _, err := getGroups("")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT group_id, expires FROM grouppause WHERE expires IS NULL OR expires > ?`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	paused := make(map[groupID]string)
+	for rows.Next() {
+		var g string
+		var expires sql.NullInt64
+		if err := rows.Scan(&g, &expires); err != nil {
+			return nil, err
+		}
+		paused[groupID(g)] = ""
+		if expires.Valid {
+			paused[groupID(g)] = formatUnix(expires.Int64, loc)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var ret []groupPause
+	for _, g := range groups {
+		p := groupPause{Group: g}
+		p.Expires, p.Paused = paused[g.GroupID]
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// killGroupClients kills the open connections of all active clients in
+// the group.
+func killGroupClients(g groupID) error {
+	if serverOpts.CacheMgr == "" || serverOpts.KillCommand == "" {
+		return nil
+	}
+	t, err := fetchCacheMgr("active_requests")
+	if err != nil {
+		return err
+	}
+	srcs, err := getGroupSources(g)
+	if err != nil {
+		return err
+	}
+	killed := make(map[string]bool)
+	for _, r := range parseActiveRequests(t) {
+		ip := net.ParseIP(r.Client)
+		if ip == nil || killed[ip.String()] {
+			continue
+		}
+		for _, s := range srcs {
+			if sourceContains(s, ip) {
+				killed[ip.String()] = true
+				if err := killClient(ip); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func pauseHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Groups  []groupPause
+		CanKill bool
+	}{
+		CanKill: serverOpts.CacheMgr != "" && serverOpts.KillCommand != "",
+	}
+	var err error
+	if data.Groups, err = getGroupPauses(requestZone(r)); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("pause.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func pauseGroupHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	var data struct {
+		Duration string `form:"duration,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	d, err := parseExpiry(data.Duration)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid duration %q", data.Duration),
+			code:     http.StatusBadRequest,
+		}
+	}
+	var expires sql.NullInt64
+	resp := struct {
+		Group   string `json:"group"`
+		Expires string `json:"expires,omitempty"`
+	}{Group: string(id)}
+	if d > 0 {
+		t := time.Now().Add(d)
+		expires = sql.NullInt64{Int64: t.Unix(), Valid: true}
+		resp.Expires = formatTime(t, requestZone(r))
+	}
+	log.Printf("Pausing group %s for %v", id, d)
+	if err := txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM grouppause WHERE group_id=?`, string(id)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO grouppause(group_id, expires) VALUES(?,?)`, string(id), expires)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := killGroupClients(id); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: "group paused, but failed to kill open connections",
+			code:     http.StatusInternalServerError,
+		}
+	}
+	return &resp, nil
+}
+
+func unpauseGroupHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	log.Printf("Unpausing group %s", id)
+	resp := struct {
+		Group   string `json:"group"`
+		Deleted int64  `json:"deleted"`
+	}{Group: string(id)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var err error
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM grouppause WHERE group_id=?`, string(id)))
+		return err
+	})
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Pinned ACLs and groups are listed first in the "Go to" menus of the
+// user who pinned them. Without authorization everyone is the same user,
+// so pins are shared.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of pinned things.
+const (
+	pinACL   = "acl"
+	pinGroup = "group"
+)
+
+// getPins returns the IDs of the ACLs or groups the user has pinned.
+func getPins(user, kind string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT id FROM userpins WHERE user=? AND kind=?`, user, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pins := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		pins[id] = true
+	}
+	return pins, rows.Err()
+}
+
+// pinACLs marks the pinned ACLs, and moves them first. The order is
+// otherwise kept.
+func pinACLs(acls []acl, pins map[string]bool) []acl {
+	var pinned, rest []acl
+	for _, a := range acls {
+		a.Pinned = pins[string(a.ACLID)]
+		if a.Pinned {
+			pinned = append(pinned, a)
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	return append(pinned, rest...)
+}
+
+// pinGroups is pinACLs for groups.
+func pinGroups(groups []group, pins map[string]bool) []group {
+	var pinned, rest []group
+	for _, g := range groups {
+		g.Pinned = pins[string(g.GroupID)]
+		if g.Pinned {
+			pinned = append(pinned, g)
+		} else {
+			rest = append(rest, g)
+		}
+	}
+	return append(pinned, rest...)
+}
+
+// pinHandler pins or unpins an ACL or group for the current user.
+func pinHandler(r *http.Request) (interface{}, error) {
+	kind := mux.Vars(r)["kind"]
+	id := mux.Vars(r)["id"]
+	if kind != pinACL && kind != pinGroup {
+		return nil, errHTTP{
+			external: fmt.Sprintf("can't pin %q", kind),
+			code:     http.StatusNotFound,
+		}
+	}
+	if !reUUID.MatchString(id) {
+		return nil, errHTTP{
+			external: fmt.Sprintf("%q is not a valid ID", id),
+			code:     http.StatusBadRequest,
+		}
+	}
+	user := remoteUser(r)
+	var data struct {
+		Pinned bool `form:"pinned"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	pinned := data.Pinned
+	resp := struct {
+		Kind   string `json:"kind"`
+		ID     string `json:"id"`
+		Pinned bool   `json:"pinned"`
+	}{kind, id, pinned}
+	var err error
+	if pinned {
+		_, err = db.Exec(`INSERT OR IGNORE INTO userpins(user, kind, id) VALUES(?,?,?)`, user, kind, id)
+	} else {
+		_, err = db.Exec(`DELETE FROM userpins WHERE user=? AND kind=? AND id=?`, user, kind, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// deletePins removes all users' pins of a deleted ACL or group.
+func deletePins(tx *sql.Tx, kind, id string) error {
+	_, err := tx.Exec(`DELETE FROM userpins WHERE kind=? AND id=?`, kind, id)
+	return err
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Privacy mode anonymizes client addresses and strips URL paths in stored
+// traffic data once it's older than -privacy_after. Totals are merged, so
+// aggregates stay correct.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+)
+
+const (
+	privacyHash     = "hash"
+	privacyTruncate = "truncate"
+
+	privacyInterval = time.Hour
+
+	// Prefix of hashed clients, so that they're not hashed again.
+	hashedClientPrefix = "h:"
+)
+
+// anonymizeClient returns the anonymized form of client. It's idempotent.
+func anonymizeClient(mode, salt, client string) string {
+	if strings.HasPrefix(client, hashedClientPrefix) {
+		return client
+	}
+	// Clients that aren't IPs are hashed even when truncating.
+	if ip := net.ParseIP(client); ip != nil && mode == privacyTruncate {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	m := hmac.New(sha256.New, []byte(salt))
+	m.Write([]byte(client))
+	return hashedClientPrefix + hex.EncodeToString(m.Sum(nil))[:16]
+}
+
+// stripURLPath returns u with only the scheme and host left.
+func stripURLPath(u string) string {
+	p, err := url.Parse(u)
+	if err != nil || p.Host == "" {
+		return ""
+	}
+	return (&url.URL{Scheme: p.Scheme, Host: p.Host, Path: "/"}).String()
+}
+
+// anonTotals is a table of totals per client and some other key columns.
+type anonTotals struct {
+	table  string
+	time   string
+	keys   []string
+	counts []string
+}
+
+var anonTotalsTables = []anonTotals{
+	{table: "trafficstats", time: "hour", keys: []string{"hour", "host"}, counts: []string{"requests", "denied", "bytes"}},
+	{table: "quotausage", time: "day", keys: []string{"quota_id", "day"}, counts: []string{"used"}},
+}
+
+// anonymize merges the totals of t from before cutoff into their
+// anonymized clients.
+func (t anonTotals) anonymize(tx *sql.Tx, mode, salt string, cutoff interface{}) (int, error) {
+	cols := append(append([]string{"rowid", "client"}, t.keys...), t.counts...)
+	rows, err := tx.Query(fmt.Sprintf(`SELECT %s FROM %s WHERE %s < ?`, strings.Join(cols, ", "), t.table, t.time), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		rowid  int64
+		client string
+		vals   []interface{}
+	}
+	var todo []row
+	for rows.Next() {
+		r := row{vals: make([]interface{}, len(t.keys)+len(t.counts))}
+		dst := []interface{}{&r.rowid, &r.client}
+		for n := range r.vals {
+			dst = append(dst, &r.vals[n])
+		}
+		if err := rows.Scan(dst...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		for n, v := range r.vals {
+			// Text comes back as []byte, which would be a blob as an arg.
+			if b, ok := v.([]byte); ok {
+				r.vals[n] = string(b)
+			}
+		}
+		if anonymizeClient(mode, salt, r.client) != r.client {
+			todo = append(todo, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var set, where []string
+	for _, c := range t.counts {
+		set = append(set, c+"="+c+"+?")
+	}
+	for _, c := range append([]string{"client"}, t.keys...) {
+		where = append(where, c+"=?")
+	}
+	update := fmt.Sprintf(`UPDATE %s SET %s WHERE %s`, t.table, strings.Join(set, ", "), strings.Join(where, " AND "))
+	insert := fmt.Sprintf(`INSERT INTO %s(%s) VALUES(?%s)`, t.table, strings.Join(cols[1:], ", "), strings.Repeat(",?", len(cols)-2))
+	for _, r := range todo {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE rowid=?`, t.table), r.rowid); err != nil {
+			return 0, err
+		}
+		keys, counts := r.vals[:len(t.keys)], r.vals[len(t.keys):]
+		client := anonymizeClient(mode, salt, r.client)
+		args := append(append(append([]interface{}{}, counts...), client), keys...)
+		n, err := rowsAffected(tx.Exec(update, args...))
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			continue
+		}
+		args = append(append([]interface{}{client}, keys...), counts...)
+		if _, err := tx.Exec(insert, args...); err != nil {
+			return 0, err
+		}
+	}
+	return len(todo), nil
+}
+
+// anonymize anonymizes stored traffic data from before cutoff.
+func anonymize(cutoff time.Time, mode, salt string) error {
+	total := 0
+	if err := store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		// Raw traffic.
+		rows, err := tx.Query(`SELECT DISTINCT client FROM trafficlog WHERE time < ?`, cutoff.Unix())
+		if err != nil {
+			return err
+		}
+		var clients []string
+		for rows.Next() {
+			var c string
+			if err := rows.Scan(&c); err != nil {
+				rows.Close()
+				return err
+			}
+			clients = append(clients, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, c := range clients {
+			a := anonymizeClient(mode, salt, c)
+			if a == c {
+				continue
+			}
+			n, err := rowsAffected(tx.Exec(`UPDATE trafficlog SET client=? WHERE client=? AND time < ?`, a, c, cutoff.Unix()))
+			if err != nil {
+				return err
+			}
+			total += int(n)
+		}
+
+		// Totals.
+		for _, t := range anonTotalsTables {
+			c := interface{}(cutoff.Unix())
+			if t.time == "day" {
+				c = cutoff.Format(quotaDay)
+			}
+			n, err := t.anonymize(tx, mode, salt, c)
+			if err != nil {
+				return fmt.Errorf("%s: %v", t.table, err)
+			}
+			total += n
+		}
+
+		// Decided exception requests. Pending ones are left alone, since
+		// approving them needs the URL.
+		rows, err = tx.Query(`SELECT request_id, client, url FROM exceptionrequests WHERE created < ? AND status != ?`, cutoff.Unix(), exceptionPending)
+		if err != nil {
+			return err
+		}
+		type exc struct{ id, client, url string }
+		var excs []exc
+		for rows.Next() {
+			var e exc
+			if err := rows.Scan(&e.id, &e.client, &e.url); err != nil {
+				rows.Close()
+				return err
+			}
+			excs = append(excs, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, e := range excs {
+			c, u := anonymizeClient(mode, salt, e.client), stripURLPath(e.url)
+			if c == e.client && u == e.url {
+				continue
+			}
+			if _, err := tx.Exec(`UPDATE exceptionrequests SET client=?, url=? WHERE request_id=?`, c, u, e.id); err != nil {
+				return err
+			}
+			total++
+		}
+
+		// Decided device registrations. Pending ones need the address to be
+		// approved.
+		rows, err = tx.Query(`SELECT DISTINCT client FROM registrations WHERE created < ? AND status != ?`, cutoff.Unix(), registrationPending)
+		if err != nil {
+			return err
+		}
+		var regClients []string
+		for rows.Next() {
+			var c string
+			if err := rows.Scan(&c); err != nil {
+				rows.Close()
+				return err
+			}
+			regClients = append(regClients, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, c := range regClients {
+			a := anonymizeClient(mode, salt, c)
+			if a == c {
+				continue
+			}
+			n, err := rowsAffected(tx.Exec(`UPDATE registrations SET client=? WHERE client=? AND created < ? AND status != ?`, a, c, cutoff.Unix(), registrationPending))
+			if err != nil {
+				return err
+			}
+			total += int(n)
+		}
+
+		// Seen clients are only useful with the address, so forget them.
+		n, err := rowsAffected(tx.Exec(`DELETE FROM seenclients WHERE last_seen < ?`, cutoff.Unix()))
+		if err != nil {
+			return err
+		}
+		total += int(n)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if total > 0 {
+		log.Printf("Privacy: anonymized %d rows", total)
+	}
+	return nil
+}
+
+func startPrivacy() {
+	if serverOpts.PrivacyAfter <= 0 {
+		return
+	}
+	switch serverOpts.PrivacyMode {
+	case privacyTruncate:
+	case privacyHash:
+		if serverOpts.PrivacySalt == "" {
+			log.Fatalf("-privacy_mode=hash requires -privacy_salt")
+		}
+	default:
+		log.Fatalf("Invalid -privacy_mode %q", serverOpts.PrivacyMode)
+	}
+	go func() {
+		for {
+			if err := anonymize(time.Now().Add(-serverOpts.PrivacyAfter), serverOpts.PrivacyMode, serverOpts.PrivacySalt); err != nil {
+				log.Printf("Privacy: failed to anonymize: %v", err)
+			}
+			time.Sleep(privacyInterval)
+		}
+	}()
+}
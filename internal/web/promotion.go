@@ -0,0 +1,516 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Promotion moves a policy tested on one instance, like a staging proxy,
+// to another, like production. The receiving instance gets the sending
+// one's configuration export, either by pulling it (-promote_from) or by
+// the sender pushing it (-promote_to), both with API tokens. It's kept as
+// a pending promotion until an admin, other than whoever asked for it, has
+// looked at the diff against the current policy and approves or rejects
+// it. Approving replaces the policy in one transaction, after taking a
+// snapshot of the one it replaces.
+//
+// Sources and group members aren't promoted, since which clients there are
+// differs between instances.
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	promoteClient = &http.Client{Timeout: time.Minute}
+)
+
+const (
+	// maxPromotionSize is the largest export accepted from another
+	// instance.
+	maxPromotionSize = 50 << 20
+
+	promotionPending  = "pending"
+	promotionApplied  = "applied"
+	promotionRejected = "rejected"
+
+	// promotionBackupPrefix starts the names of snapshots taken before
+	// applying, followed by the promotion ID.
+	promotionBackupPrefix = "before-promotion-"
+)
+
+// promotionKeep are the tables that are left alone when promoting.
+var promotionKeep = map[string]bool{
+	"sources":      true,
+	"members":      true,
+	"memberexpiry": true,
+}
+
+type promotionID string
+
+func assertPromotionID(s string) promotionID { return promotionID(assertUUID(s)) }
+
+type promotion struct {
+	PromotionID promotionID `json:"promotion"`
+	Source      string      `json:"source"`
+	Records     int         `json:"records"`
+	RequestedBy string      `json:"requested_by"`
+	Created     string      `json:"created"`
+	State       string      `json:"state"`
+	DecidedBy   string      `json:"decided_by,omitempty"`
+	Decided     string      `json:"decided,omitempty"`
+	Backup      snapshotID  `json:"backup,omitempty"`
+}
+
+// readTokenFile reads an API token from a file.
+func readTokenFile(fn string) (string, error) {
+	if fn == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// promotionRequest sends a request to another instance, with the API token
+// in tokenFile, and returns the body of its reply.
+func promotionRequest(method, u, tokenFile, contentType string, body io.Reader) ([]byte, error) {
+	token, err := readTokenFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading API token: %v", err)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := promoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPromotionSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPromotionSize {
+		return nil, fmt.Errorf("reply from %q is over %d bytes", u, maxPromotionSize)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%q returned %q: %s", u, resp.Status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
+// checkExport decodes a configuration export, as a 400 if it isn't one.
+func checkExport(b []byte) ([]snapshotRecord, error) {
+	recs, err := decodeSnapshot(b)
+	if err == nil {
+		for _, rec := range recs {
+			t := recString(rec, "table")
+			if _, ok := tableOrder[t]; !ok {
+				err = fmt.Errorf("unknown table %q", t)
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("not a configuration export: %v", err),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"data": "not a configuration export"}},
+		}
+	}
+	return recs, nil
+}
+
+// addPromotion stores a pending promotion of the export in data.
+func addPromotion(source string, data []byte, actor string, now time.Time) (*promotion, error) {
+	recs, err := checkExport(data)
+	if err != nil {
+		return nil, err
+	}
+	p := &promotion{
+		PromotionID: promotionID(uuid.NewV4().String()),
+		Source:      source,
+		Records:     len(recs),
+		RequestedBy: actor,
+		State:       promotionPending,
+	}
+	log.Printf("Promotion %s of %d records from %q requested by %q", p.PromotionID, p.Records, source, actor)
+	if _, err := db.Exec(`INSERT INTO promotions(promotion_id, source, data, records, requested_by, created, state, decided_by, backup) VALUES(?,?,?,?,?,?,?,'','')`, string(p.PromotionID), source, string(data), p.Records, actor, now.Unix(), p.State); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func getPromotions(loc *time.Location) ([]promotion, error) {
+	rows, err := db.Query(`SELECT promotion_id, source, records, requested_by, created, state, decided_by, decided, backup FROM promotions ORDER BY created DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []promotion{}
+	for rows.Next() {
+		var p promotion
+		var created int64
+		var decided sql.NullInt64
+		if err := rows.Scan(&p.PromotionID, &p.Source, &p.Records, &p.RequestedBy, &created, &p.State, &p.DecidedBy, &decided, &p.Backup); err != nil {
+			return nil, err
+		}
+		p.Created = formatUnix(created, loc)
+		if decided.Valid {
+			p.Decided = formatUnix(decided.Int64, loc)
+		}
+		ret = append(ret, p)
+	}
+	return ret, rows.Err()
+}
+
+// getPromotion returns a promotion and its records, as a 404 if there's no
+// such promotion. Only who asked for it, from where and its state are set.
+func getPromotion(id promotionID) (*promotion, []snapshotRecord, error) {
+	p := &promotion{PromotionID: id}
+	var data string
+	if err := db.QueryRow(`SELECT source, requested_by, state, data FROM promotions WHERE promotion_id=?`, string(id)).Scan(&p.Source, &p.RequestedBy, &p.State, &data); err == sql.ErrNoRows {
+		return nil, nil, errHTTP{
+			external: "promotion not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	recs, err := decodeSnapshot([]byte(data))
+	return p, recs, err
+}
+
+// withoutKept returns recs without the tables that aren't promoted.
+func withoutKept(recs []snapshotRecord) []snapshotRecord {
+	var ret []snapshotRecord
+	for _, rec := range recs {
+		if !promotionKeep[recString(rec, "table")] {
+			ret = append(ret, rec)
+		}
+	}
+	return ret
+}
+
+// foreignKeyProblems returns what refers to rows that don't exist, as seen
+// by tx.
+func foreignKeyProblems(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	var order []string
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return nil, err
+		}
+		k := table + " " + parent
+		if counts[k] == 0 {
+			order = append(order, k)
+		}
+		counts[k]++
+	}
+	var ret []string
+	for _, k := range order {
+		parts := strings.SplitN(k, " ", 2)
+		ret = append(ret, fmt.Sprintf("%d rows of %s would refer to %s that don't exist", counts[k], parts[0], parts[1]))
+	}
+	return ret, rows.Err()
+}
+
+// applyPromotion replaces the policy with recs, and returns why it can't
+// be, if it can't.
+func applyPromotion(tx *sql.Tx, recs []snapshotRecord) ([]string, error) {
+	if err := restoreTables(tx, recs, promotionKeep); err != nil {
+		return nil, err
+	}
+	return foreignKeyProblems(tx)
+}
+
+func promotionsHandler(r *http.Request) (template.HTML, error) {
+	ps, err := getPromotions(requestZone(r))
+	if err != nil {
+		return "", err
+	}
+	data := struct {
+		Promotions []promotion
+		From       string
+		To         string
+		Admin      bool
+	}{
+		Promotions: ps,
+		From:       serverOpts.PromoteFrom,
+		To:         serverOpts.PromoteTo,
+		Admin:      requestPermission(r) >= permAdmin,
+	}
+	tmpl := getTemplate("promotions.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func promotionsJSONHandler(r *http.Request) (interface{}, error) {
+	return getPromotions(requestZone(r))
+}
+
+// promotionPullHandler fetches the policy of -promote_from as a pending
+// promotion.
+func promotionPullHandler(r *http.Request) (interface{}, error) {
+	if serverOpts.PromoteFrom == "" {
+		return nil, errHTTP{
+			external: "no instance to pull from, start with -promote_from",
+			code:     http.StatusBadRequest,
+		}
+	}
+	b, err := promotionRequest("GET", strings.TrimSuffix(serverOpts.PromoteFrom, "/")+"/export.json", serverOpts.PromoteFromToken, "", nil)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("failed to pull from %s: %v", serverOpts.PromoteFrom, err),
+			code:     http.StatusBadGateway,
+		}
+	}
+	return addPromotion(serverOpts.PromoteFrom, b, remoteUser(r), time.Now())
+}
+
+// promotionReceiveHandler takes a policy pushed by another instance as a
+// pending promotion.
+func promotionReceiveHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Data   string `form:"data,required"`
+		Source string `form:"source,trim,max=200"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	if data.Source == "" {
+		data.Source = "push"
+	}
+	return addPromotion(data.Source, []byte(data.Data), remoteUser(r), time.Now())
+}
+
+// promotionSendHandler pushes this instance's policy to -promote_to, and
+// returns the pending promotion made there.
+func promotionSendHandler(r *http.Request) (interface{}, error) {
+	if serverOpts.PromoteTo == "" {
+		return nil, errHTTP{
+			external: "no instance to push to, start with -promote_to",
+			code:     http.StatusBadRequest,
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := readConfig(tx)
+	tx.Rollback()
+	if err != nil {
+		return nil, err
+	}
+	source, err := os.Hostname()
+	if err != nil {
+		source = "push"
+	}
+	body, err := json.Marshal(map[string]string{"data": string(data), "source": source})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Pushing policy to %s for promotion", serverOpts.PromoteTo)
+	b, err := promotionRequest("POST", strings.TrimSuffix(serverOpts.PromoteTo, "/")+"/promotions/receive", serverOpts.PromoteToToken, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("failed to push to %s: %v", serverOpts.PromoteTo, err),
+			code:     http.StatusBadGateway,
+		}
+	}
+	var p promotion
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("bad reply from %s: %v", serverOpts.PromoteTo, err)
+	}
+	return &p, nil
+}
+
+// promotionDiffHandler compares the current policy with a promotion, and
+// says whether it can be applied.
+func promotionDiffHandler(r *http.Request) (interface{}, error) {
+	p, recs, err := getPromotion(assertPromotionID(mux.Vars(r)["promotionID"]))
+	if err != nil {
+		return nil, err
+	}
+	cur, err := currentConfig()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := primaryKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		State    string           `json:"state"`
+		Revision int64            `json:"revision"`
+		Changes  []snapshotChange `json:"changes"`
+		Problems []string         `json:"problems"`
+	}{
+		State:    p.State,
+		Changes:  diffSnapshots(withoutKept(cur), withoutKept(recs), keys),
+		Problems: []string{},
+	}
+	// Try it, to find problems.
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRow(`SELECT revision FROM revision`).Scan(&resp.Revision); err != nil {
+		return nil, err
+	}
+	problems, err := applyPromotion(tx, recs)
+	if err != nil {
+		resp.Problems = append(resp.Problems, err.Error())
+	}
+	resp.Problems = append(resp.Problems, problems...)
+	return &resp, nil
+}
+
+// decidePromotion marks a pending promotion as applied or rejected by the
+// user making the request.
+func decidePromotion(tx *sql.Tx, r *http.Request, id promotionID, state string, backup snapshotID) error {
+	res, err := tx.Exec(`UPDATE promotions SET state=?, decided_by=?, decided=?, backup=? WHERE promotion_id=? AND state=?`, state, remoteUser(r), time.Now().Unix(), string(backup), string(id), promotionPending)
+	if n, err := rowsAffected(res, err); err != nil {
+		return err
+	} else if n == 0 {
+		return errHTTP{
+			external: "promotion isn't pending",
+			code:     http.StatusConflict,
+		}
+	}
+	return nil
+}
+
+// promotionApproveHandler applies a promotion. revision is the policy
+// revision its diff was made against, so that nothing is applied that
+// wasn't looked at.
+func promotionApproveHandler(r *http.Request) (interface{}, error) {
+	id := assertPromotionID(mux.Vars(r)["promotionID"])
+	var data struct {
+		Revision int64 `form:"revision,required"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	p, recs, err := getPromotion(id)
+	if err != nil {
+		return nil, err
+	}
+	if p.State != promotionPending {
+		return nil, errHTTP{
+			external: fmt.Sprintf("promotion is already %s", p.State),
+			code:     http.StatusConflict,
+		}
+	}
+	if p.RequestedBy == remoteUser(r) && !serverOpts.PromoteSelfApprove {
+		return nil, errHTTP{
+			external: "someone other than who asked for the promotion has to approve it",
+			code:     http.StatusForbidden,
+		}
+	}
+	now := time.Now()
+	resp := struct {
+		Promotion string `json:"promotion"`
+		Backup    string `json:"backup"`
+	}{Promotion: string(id)}
+	log.Printf("Applying promotion %s", id)
+	if err := txWrap(func(tx *sql.Tx) error {
+		var rev int64
+		if err := tx.QueryRow(`SELECT revision FROM revision`).Scan(&rev); err != nil {
+			return err
+		}
+		if rev != data.Revision {
+			return errHTTP{
+				external: fmt.Sprintf("the policy has changed since revision %d, compare again", data.Revision),
+				code:     http.StatusConflict,
+			}
+		}
+		backup, err := takeSnapshot(tx, promotionBackupPrefix+string(id), "Taken before applying promotion from "+p.Source, remoteUser(r), now)
+		if err != nil {
+			return err
+		}
+		resp.Backup = string(backup.SnapshotID)
+		problems, err := applyPromotion(tx, recs)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return errHTTP{
+				external: "can't apply promotion: " + strings.Join(problems, "; "),
+				code:     http.StatusConflict,
+				details:  map[string][]string{"problems": problems},
+			}
+		}
+		return decidePromotion(tx, r, id, promotionApplied, backup.SnapshotID)
+	}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func promotionRejectHandler(r *http.Request) (interface{}, error) {
+	id := assertPromotionID(mux.Vars(r)["promotionID"])
+	log.Printf("Rejecting promotion %s", id)
+	if err := store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		return decidePromotion(tx, r, id, promotionRejected, "")
+	}); err != nil {
+		return nil, err
+	}
+	return &struct {
+		Promotion string `json:"promotion"`
+		State     string `json:"state"`
+	}{
+		Promotion: string(id),
+		State:     promotionRejected,
+	}, nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Changes can be published to NATS or Kafka, for SOC pipelines, as
+// "change" events with the same fields as the change log feed. The helper
+// publishes its decisions the same way.
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/squidwarden/internal/publish"
+)
+
+var (
+	// publisher is nil unless publishing is configured.
+	publisher *publish.Publisher
+)
+
+// changeEvent is a change as published.
+type changeEvent struct {
+	Type string `json:"type"`
+	change
+}
+
+// publishChange publishes a change log entry.
+func publishChange(now time.Time, actor, entity, id, summary string) {
+	publisher.Publish("change", &changeEvent{
+		Type: "change",
+		change: change{
+			Time:     now.UTC().Format(time.RFC3339),
+			Actor:    actor,
+			Entity:   entity,
+			EntityID: id,
+			Summary:  summary,
+		},
+	})
+}
+
+func startPublisher() {
+	var err error
+	publisher, err = publish.New(publish.Options{
+		NATS:        serverOpts.NATS,
+		NATSSubject: serverOpts.NATSSubject,
+		KafkaREST:   serverOpts.KafkaREST,
+		KafkaTopic:  serverOpts.KafkaTopic,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up publishing: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Browsers use QUIC (HTTP/3 over UDP port 443) when they can, which goes
+// around the proxy entirely. For groups with QUIC blocked the generated
+// squid config strips Alt-Svc headers, so browsers don't learn to try it,
+// and a generated nftables file rejects UDP 443 from their sources, so
+// that browsers fall back to TCP and the proxy.
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/gorilla/mux"
+)
+
+// quicTable is the nftables table of the generated rules.
+const quicTable = "inet squidwarden_quic"
+
+// getQUICGroups returns the groups with QUIC blocked.
+func getQUICGroups() (map[groupID]bool, error) {
+	rows, err := db.Query(`SELECT group_id FROM groupquic`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[groupID]bool)
+	for rows.Next() {
+		var g string
+		if err := rows.Scan(&g); err != nil {
+			return nil, err
+		}
+		ret[groupID(g)] = true
+	}
+	return ret, rows.Err()
+}
+
+// generateQUICConf writes the squid part: dropping Alt-Svc for the groups.
+func generateQUICConf(w io.Writer, sg *squidGroups, quic map[groupID]bool) {
+	first := true
+	for _, g := range sg.ids() {
+		if !quic[g] {
+			continue
+		}
+		if first {
+			fmt.Fprintf(w, "\n# QUIC blocking. Also load the generated firewall rules.\n")
+			first = false
+		}
+		for _, ref := range sg.refs(g) {
+			fmt.Fprintf(w, "reply_header_access Alt-Svc deny %s\n", ref)
+		}
+	}
+}
+
+// nftSource is the nftables match for a source.
+func nftSource(s string) (string, error) {
+	n, err := policy.SourceNet(s)
+	if err != nil {
+		return "", err
+	}
+	family := "ip6"
+	if len(n.IP) == net.IPv4len {
+		family = "ip"
+	}
+	if ones, _ := n.Mask.Size(); ones == 0 && n.Mask[0] != 0 {
+		// Non-contiguous mask.
+		return fmt.Sprintf("%s saddr & %s == %s", family, net.IP(n.Mask), n.IP), nil
+	}
+	return fmt.Sprintf("%s saddr %s", family, n), nil
+}
+
+// generateFirewallConf writes nftables rules rejecting UDP 443 from the
+// sources of groups with QUIC blocked. The file replaces the whole table, so
+// it can be loaded again after changes.
+func generateFirewallConf(w io.Writer, sg *squidGroups, quic map[groupID]bool) error {
+	confHeader(w, sg.rev)
+	fmt.Fprintf(w, "table %s {}\ndelete table %s\n", quicTable, quicTable)
+	fmt.Fprintf(w, "table %s {\n", quicTable)
+	fmt.Fprintf(w, "\tchain forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	rules := func(g groupSources, verdict string) error {
+		for _, s := range g.Sources {
+			m, err := nftSource(s)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "\t\t%s udp dport 443 %s\n", m, verdict)
+		}
+		return nil
+	}
+	for _, g := range sg.groups {
+		if !quic[g.Group.GroupID] {
+			continue
+		}
+		fmt.Fprintf(w, "\t\t# %s\n", oneLine(g.Group.Comment))
+		if err := rules(g, "reject"); err != nil {
+			return err
+		}
+	}
+	if sg.def != "" && quic[sg.def] {
+		// Clients of other groups have been rejected above if they
+		// should be, so let the rest of them through before rejecting.
+		fmt.Fprintf(w, "\t\t# Clients in no group, for the default group.\n")
+		for _, g := range sg.groups {
+			if err := rules(g, "accept"); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "\t\tudp dport 443 reject\n")
+	}
+	fmt.Fprintf(w, "\t}\n}\n")
+	return nil
+}
+
+// generateAllFirewallConf writes the firewall rules for the current policy.
+func generateAllFirewallConf(w io.Writer) error {
+	sg, err := getSquidGroups()
+	if err != nil {
+		return err
+	}
+	quic, err := getQUICGroups()
+	if err != nil {
+		return err
+	}
+	return generateFirewallConf(w, sg, quic)
+}
+
+// groupQUICHandler sets whether QUIC is blocked for a group.
+func groupQUICHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	var data struct {
+		Block string `form:"block,required,enum=bool"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	block := data.Block == "true"
+	log.Printf("Setting QUIC blocking for group %s to %t", id, block)
+	return &struct {
+		Group string `json:"group"`
+		Block bool   `json:"block"`
+	}{string(id), block}, txWrap(func(tx *sql.Tx) error {
+		if !block {
+			_, err := tx.Exec(`DELETE FROM groupquic WHERE group_id=?`, string(id))
+			return err
+		}
+		_, err := tx.Exec(`INSERT OR IGNORE INTO groupquic(group_id) VALUES(?)`, string(id))
+		return err
+	})
+}
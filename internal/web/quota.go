@@ -0,0 +1,501 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Quotas limit how much a group may use the sites allowed by an ACL each
+// day. Usage is accounted per client from the squid access log, and once a
+// client is over budget the helper stops applying the ACL's allow rules to
+// it for the rest of the day.
+//
+// Only domain and https-domain rules are used for accounting.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	quotaMinutes = "minutes"
+	quotaBytes   = "bytes"
+
+	quotaDay = policy.QuotaDay
+
+	quotaFlushInterval  = 10 * time.Second
+	quotaReloadInterval = time.Minute
+)
+
+type quotaID string
+type quota struct {
+	QuotaID quotaID
+	Group   group
+	ACL     acl
+	Kind    string
+	Limit   int64
+	Comment string
+	Usage   []quotaUsage
+}
+
+type quotaUsage struct {
+	Client    string
+	Used      int64
+	Exhausted bool
+}
+
+func assertQuotaID(s string) quotaID { return quotaID(assertUUID(s)) }
+
+// quotaDef is what the accountant needs to know about a quota.
+type quotaDef struct {
+	id      quotaID
+	kind    string
+	sources []string
+	rules   []rule
+}
+
+type usageKey struct {
+	quota  quotaID
+	client string
+	day    string
+}
+
+// accountant buffers usage in memory, like the learner.
+type accountant struct {
+	ingest *logIngester // Nil in tests.
+
+	// Only used by add, which the ingester calls one at a time, so
+	// they're not under mu.
+	defs   []quotaDef
+	loaded time.Time
+
+	mu      sync.Mutex
+	day     string
+	minutes map[usageKey]map[int64]bool // Minutes already counted on day.
+	pending map[usageKey]int64
+}
+
+func (d *quotaDef) matches(ip net.IP, e *squidlog.Entry) bool {
+	found := false
+	for _, s := range d.sources {
+		if sourceContains(s, ip) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	typ := typeDomain
+	if e.Method == "CONNECT" {
+		typ = typeHTTPSDomain
+	}
+	for _, r := range d.rules {
+		if r.Type == typ && policy.DomainMatches(r.Value, e.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadQuotaDefs() ([]quotaDef, error) {
+	rows, err := db.Query(`SELECT quota_id, group_id, acl_id, kind FROM quotas`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []quotaDef
+	var groups, acls []string
+	for rows.Next() {
+		var d quotaDef
+		var id, g, a string
+		if err := rows.Scan(&id, &g, &a, &d.kind); err != nil {
+			return nil, err
+		}
+		d.id = quotaID(id)
+		ret = append(ret, d)
+		groups = append(groups, g)
+		acls = append(acls, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for n := range ret {
+		srcs, err := getGroupSources(groupID(groups[n]))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range srcs {
+			ret[n].sources = append(ret[n].sources, s)
+		}
+		rules, err := loadACL(aclID(acls[n]))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			if r.Enabled && r.Action == actionAllow && (r.Type == typeDomain || r.Type == typeHTTPSDomain) {
+				ret[n].rules = append(ret[n].rules, r)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// reload loads the quotas again if they're older than quotaReloadInterval.
+func (a *accountant) reload(now time.Time) {
+	if now.Sub(a.loaded) <= quotaReloadInterval {
+		return
+	}
+	defs, err := loadQuotaDefs()
+	if err != nil {
+		log.Printf("Failed to load quotas: %v", err)
+	} else {
+		a.defs = defs
+	}
+	a.loaded = now
+}
+
+func (a *accountant) add(e *squidlog.Entry) {
+	ip := net.ParseIP(e.Client)
+	if ip == nil || e.Host == "" {
+		return
+	}
+	t, err := time.Parse(squidlog.TimeFormat, e.Time)
+	if err != nil {
+		log.Printf("Quota: bad time %q: %v", e.Time, err)
+		return
+	}
+	t = t.Local() // Days are local, like the helper's.
+	a.reload(time.Now())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	day := t.Format(quotaDay)
+	if day > a.day {
+		a.day = day
+		a.minutes = make(map[usageKey]map[int64]bool)
+	}
+	for _, d := range a.defs {
+		if !d.matches(ip, e) {
+			continue
+		}
+		k := usageKey{quota: d.id, client: ip.String(), day: day}
+		switch d.kind {
+		case quotaBytes:
+			a.pending[k] += e.Bytes
+		case quotaMinutes:
+			// The log line is written when the request ends, so count
+			// every minute it was active.
+			seen := a.minutes[k]
+			if seen == nil {
+				seen = make(map[int64]bool)
+				a.minutes[k] = seen
+			}
+			for m := t.Add(-e.Elapsed).Unix() / 60; m <= t.Unix()/60; m++ {
+				if !seen[m] {
+					seen[m] = true
+					a.pending[k]++
+				}
+			}
+		}
+	}
+}
+
+func (a *accountant) flush() error {
+	var p map[usageKey]int64
+	offsets := a.ingest.checkpoint(func() {
+		a.mu.Lock()
+		p = a.pending
+		a.pending = make(map[usageKey]int64)
+		a.mu.Unlock()
+	})
+	if len(p) == 0 {
+		return nil
+	}
+
+	return store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		for k, used := range p {
+			res, err := tx.Exec(`UPDATE quotausage SET used=used+? WHERE quota_id=? AND client=? AND day=?`, used, string(k.quota), k.client, k.day)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n > 0 {
+				continue
+			}
+			if _, err := tx.Exec(`INSERT INTO quotausage(quota_id, client, day, used) VALUES(?,?,?,?)`, string(k.quota), k.client, k.day, used); err != nil {
+				return err
+			}
+		}
+		return a.ingest.saveOffsets(tx, offsets)
+	})
+}
+
+func (a *accountant) run() {
+	for range time.Tick(quotaFlushInterval) {
+		if err := a.flush(); err != nil {
+			log.Printf("Failed to flush quota usage: %v", err)
+		}
+	}
+}
+
+func startQuotas() {
+	if !ingestConfigured() {
+		return
+	}
+	a := &accountant{pending: make(map[usageKey]int64)}
+	a.ingest = newLogIngester("quota", a.add)
+	go a.run()
+	go a.ingest.run()
+}
+
+func getQuotas() ([]quota, error) {
+	rows, err := db.Query(`
+SELECT quotas.quota_id, quotas.group_id, groups.comment, quotas.acl_id, acls.comment, quotas.kind, quotas.daily_limit, quotas.comment
+FROM quotas
+JOIN groups ON quotas.group_id=groups.group_id
+JOIN acls ON quotas.acl_id=acls.acl_id
+ORDER BY groups.comment, acls.comment`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []quota
+	byID := make(map[quotaID]int)
+	for rows.Next() {
+		var q quota
+		var id, g, a string
+		var gc, ac, c sql.NullString
+		if err := rows.Scan(&id, &g, &gc, &a, &ac, &q.Kind, &q.Limit, &c); err != nil {
+			return nil, err
+		}
+		q.QuotaID = quotaID(id)
+		q.Group = group{GroupID: groupID(g), Comment: gc.String}
+		q.ACL = acl{ACLID: aclID(a), Comment: ac.String}
+		q.Comment = c.String
+		byID[q.QuotaID] = len(ret)
+		ret = append(ret, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows2, err := db.Query(`SELECT quota_id, client, used FROM quotausage WHERE day=? ORDER BY used DESC`, time.Now().Format(quotaDay))
+	if err != nil {
+		return nil, err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var id string
+		var u quotaUsage
+		if err := rows2.Scan(&id, &u.Client, &u.Used); err != nil {
+			return nil, err
+		}
+		if n, ok := byID[quotaID(id)]; ok {
+			u.Exhausted = u.Used >= ret[n].Limit
+			ret[n].Usage = append(ret[n].Usage, u)
+		}
+	}
+	return ret, rows2.Err()
+}
+
+func quotaHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Configured bool
+		Quotas     []quota
+		Groups     []group
+		ACLs       []acl
+		Kinds      []string
+	}{
+		Configured: ingestConfigured(),
+		Kinds:      []string{quotaMinutes, quotaBytes},
+	}
+	var err error
+	if data.Quotas, err = getQuotas(); err != nil {
+		return "", err
+	}
+	if data.Groups, _, err = getGroups(""); err != nil {
+		return "", err
+	}
+	if data.ACLs, err = getACLs(); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("quota.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func quotaNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Group   string `form:"group,required,uuid"`
+		ACL     string `form:"acl,required,uuid"`
+		Kind    string `form:"kind"`
+		Limit   int64  `form:"limit,required"`
+		Comment string `form:"comment"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	if data.Kind != quotaMinutes && data.Kind != quotaBytes {
+		return nil, errHTTP{
+			external: fmt.Sprintf("invalid quota kind %q", data.Kind),
+			code:     http.StatusBadRequest,
+		}
+	}
+	limit := data.Limit
+	if limit < 0 {
+		return nil, errHTTP{
+			external: fmt.Sprintf("invalid daily limit %d", limit),
+			code:     http.StatusBadRequest,
+		}
+	}
+
+	id := uuid.NewV4().String()
+	resp := struct {
+		Quota string `json:"quota"`
+	}{Quota: id}
+	log.Printf("Creating quota %s: group %s, ACL %s, %d %s", id, data.Group, data.ACL, limit, data.Kind)
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO quotas(quota_id, group_id, acl_id, kind, daily_limit, comment) VALUES(?,?,?,?,?,?)`, id, data.Group, data.ACL, data.Kind, limit, data.Comment)
+		return err
+	})
+}
+
+func quotaDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertQuotaID(mux.Vars(r)["quotaID"])
+	log.Printf("Deleting quota %s", id)
+	resp := struct {
+		Quota   string `json:"quota"`
+		Deleted int64  `json:"deleted"`
+	}{Quota: string(id)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM quotausage WHERE quota_id=?`, string(id)); err != nil {
+			return err
+		}
+		var err error
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM quotas WHERE quota_id=?`, string(id)))
+		return err
+	})
+}
+
+// quotaResetHandler forgets today's usage, e.g. to grant extra time.
+func quotaResetHandler(r *http.Request) (interface{}, error) {
+	id := assertQuotaID(mux.Vars(r)["quotaID"])
+	var data struct {
+		Client string `form:"client"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	client := data.Client
+	log.Printf("Resetting quota %s for %q", id, client)
+	resp := struct {
+		Quota   string `json:"quota"`
+		Client  string `json:"client"`
+		Day     string `json:"day"`
+		Deleted int64  `json:"deleted"`
+	}{Quota: string(id), Client: client, Day: time.Now().Format(quotaDay)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var err error
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM quotausage WHERE quota_id=? AND client=? AND day=?`, string(id), client, resp.Day))
+		return err
+	})
+}
+
+type quotaUsageRecord struct {
+	Day       string
+	GroupID   string
+	Group     string
+	ACLID     string
+	ACL       string
+	Kind      string
+	Client    string
+	Used      int64
+	Limit     int64
+	Exhausted bool
+}
+
+// quotaStatsHandler streams quota usage, newest day first. ?day= limits it
+// to one day, and from and to to the days they're in.
+func quotaStatsHandler(r *http.Request, s *recordStream) error {
+	q := `
+SELECT quotausage.day, quotas.group_id, groups.comment, quotas.acl_id, acls.comment, quotas.kind, quotausage.client, quotausage.used, quotas.daily_limit
+FROM quotausage
+JOIN quotas ON quotausage.quota_id=quotas.quota_id
+JOIN groups ON quotas.group_id=groups.group_id
+JOIN acls ON quotas.acl_id=acls.acl_id`
+	var args []interface{}
+	if day := r.FormValue("day"); day != "" {
+		if _, err := time.Parse(quotaDay, day); err != nil {
+			return errHTTP{
+				internal: err,
+				external: "day must be YYYY-MM-DD",
+				code:     http.StatusBadRequest,
+			}
+		}
+		q += ` WHERE quotausage.day=?`
+		args = append(args, day)
+	} else {
+		tr, err := parseTimeRange(r, time.Now())
+		if err != nil {
+			return err
+		}
+		// Quota days are in the server's local time, like the helper
+		// counts them.
+		q += ` WHERE quotausage.day >= ? AND quotausage.day <= ?`
+		from, to := "0000-00-00", "9999-99-99"
+		if !tr.from.IsZero() {
+			from = tr.from.In(time.Local).Format(quotaDay)
+		}
+		if !tr.to.IsZero() {
+			to = tr.to.In(time.Local).Format(quotaDay)
+		}
+		args = append(args, from, to)
+	}
+	rows, err := db.Query(q+` ORDER BY quotausage.day DESC, groups.comment, acls.comment, quotausage.client`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u quotaUsageRecord
+		var gc, ac sql.NullString
+		if err := rows.Scan(&u.Day, &u.GroupID, &gc, &u.ACLID, &ac, &u.Kind, &u.Client, &u.Used, &u.Limit); err != nil {
+			return err
+		}
+		u.Group = gc.String
+		u.ACL = ac.String
+		u.Exhausted = u.Used >= u.Limit
+		if err := s.Write(&u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
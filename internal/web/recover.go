@@ -0,0 +1,133 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// A panic in a handler would otherwise kill the connection, which the
+// frontend proxy shows as a 502. recoverPanics turns it into a proper
+// error reply instead, and logs the stack. The handler wrappers do the
+// same, so that JSON handlers reply in the error envelope. Malformed IDs
+// panic in the assert* functions, and are replied to as the client's
+// mistake.
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// trackingWriter notes whether the reply has started, since after that
+// it's too late to send an error, and the status and size for the
+// request log.
+type trackingWriter struct {
+	http.ResponseWriter
+	started bool
+	status  int
+	size    int64
+}
+
+func (w *trackingWriter) WriteHeader(code int) {
+	if !w.started {
+		w.status = code
+	}
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.status = http.StatusOK
+	}
+	w.started = true
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// flushingWriter is a trackingWriter for a writer that can flush, so
+// that handlers streaming the reply only see a Flusher if there is one.
+type flushingWriter struct {
+	*trackingWriter
+}
+
+func (w flushingWriter) Flush() {
+	if !w.started {
+		w.status = http.StatusOK
+	}
+	w.started = true
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// track returns a trackingWriter for w, and the writer to pass on to the
+// handler, which can flush only if w can.
+func track(w http.ResponseWriter) (*trackingWriter, http.ResponseWriter) {
+	tw := &trackingWriter{ResponseWriter: w}
+	if _, ok := w.(http.Flusher); ok {
+		return tw, flushingWriter{tw}
+	}
+	return tw, tw
+}
+
+// Hijack is needed for websockets.
+func (w *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", w.ResponseWriter)
+	}
+	if !w.started {
+		w.status = http.StatusSwitchingProtocols
+	}
+	w.started = true
+	return h.Hijack()
+}
+
+// panicError turns what a handler panicked with into the error to reply
+// with. An errHTTP is the reply, anything else is logged with the stack.
+func panicError(r *http.Request, p interface{}) errHTTP {
+	if p == http.ErrAbortHandler {
+		panic(p)
+	}
+	if err, ok := p.(errHTTP); ok {
+		return err
+	}
+	log.Printf("PANIC serving %s %s for %q from %s: %v\n%s", r.Method, r.URL.Path, remoteUser(r), r.RemoteAddr, p, debug.Stack())
+	return errHTTP{
+		internal: fmt.Errorf("panic: %v", p),
+		external: "Internal error",
+		code:     http.StatusInternalServerError,
+	}
+}
+
+type recoverPanics struct{ h http.Handler }
+
+func (c recoverPanics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tw, hw := track(w)
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		err := panicError(r, p)
+		if tw.started {
+			log.Printf("Reply to %s %s already started, can't send error: %v", r.Method, r.URL.Path, err.external)
+			return
+		}
+		httpError(tw, r, err)
+	}()
+	c.h.ServeHTTP(hw, r)
+}
@@ -0,0 +1,523 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Devices can register themselves, captive portal style: a client that
+// isn't in any group opens /register, names the device and, if asked, enters
+// a code that an admin handed out. The registration then waits at
+// /registrations, and approving it adds the client's address to the group
+// as a source. Like the exception request page, /register is meant to be
+// reachable without admin access, so nothing it does changes the policy.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	registrationPending  = "pending"
+	registrationApproved = "approved"
+	registrationRejected = "rejected"
+
+	// Limit how much the public can fill up the queue.
+	maxPendingRegistrations = 1000
+
+	maxDeviceName = 100
+
+	// Codes are registrationCodeLen characters from registrationCodeChars,
+	// which has no look-alikes like 0 and O.
+	registrationCodeLen   = 8
+	registrationCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+type registrationID string
+type registrationCodeID string
+
+func assertRegistrationID(s string) registrationID         { return registrationID(assertUUID(s)) }
+func assertRegistrationCodeID(s string) registrationCodeID { return registrationCodeID(assertUUID(s)) }
+
+type registration struct {
+	RegistrationID registrationID
+	Client         string
+	Name           string
+	GroupID        groupID
+	Group          string
+	Code           string // Comment of the code registered with, if any.
+	Created        string
+	Status         string
+	SourceID       sourceID
+}
+
+type registrationCode struct {
+	CodeID   registrationCodeID
+	Code     string
+	GroupID  groupID
+	Group    string
+	Comment  string
+	Created  string
+	Expires  string // Empty is never.
+	UsesLeft string // Empty is unlimited.
+}
+
+// newRegistrationCode returns a random code.
+func newRegistrationCode() (string, error) {
+	b := make([]byte, registrationCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for n := range b {
+		// 256 is a multiple of the 32 characters, so this isn't biased.
+		b[n] = registrationCodeChars[int(b[n])%len(registrationCodeChars)]
+	}
+	return string(b), nil
+}
+
+// normalizeRegistrationCode forgives how people type codes in: lower case,
+// spaces and dashes.
+func normalizeRegistrationCode(s string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(s))
+}
+
+// registerHandler is the end-user facing page. It's not wrapped in the
+// admin page template.
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	if !serverOpts.Registration {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		CSRF      string
+		Client    string
+		Name      string
+		Code      string
+		NeedCode  bool
+		Submitted bool
+		Error     string
+	}{
+		CSRF:     csrf.Token(r),
+		Client:   clientAddr(r),
+		Name:     r.FormValue("name"),
+		Code:     r.FormValue("code"),
+		NeedCode: serverOpts.RegistrationGroup == "",
+	}
+	if r.Method == "POST" {
+		if err := submitRegistration(data.Client, data.Name, data.Code, time.Now()); err != nil {
+			if e, ok := err.(errHTTP); ok {
+				log.Printf("Registration rejected: %q. Internal: %v", e.external, e.internal)
+				data.Error = e.external
+				w.WriteHeader(e.code)
+			} else {
+				log.Printf("Failed to store registration: %v", err)
+				data.Error = "Internal error. Please try again later."
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		} else {
+			data.Submitted = true
+		}
+	}
+	tmpl := getTemplate("register.html", nil)
+	if err := tmpl.Execute(w, &data); err != nil {
+		log.Printf("template execute fail: %v", err)
+	}
+}
+
+// submitRegistration queues a registration of client's device, into the
+// group of code, or -registration_group if there's no code.
+func submitRegistration(client, name, code string, now time.Time) error {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return errHTTP{
+			internal: fmt.Errorf("client %q is not an IP", client),
+			external: "Your device's address can't be registered.",
+			code:     http.StatusBadRequest,
+		}
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errHTTP{
+			external: "Please name your device.",
+			code:     http.StatusBadRequest,
+		}
+	}
+	if len(name) > maxDeviceName {
+		return errHTTP{
+			external: fmt.Sprintf("Device name is too long, max %d characters.", maxDeviceName),
+			code:     http.StatusBadRequest,
+		}
+	}
+	code = normalizeRegistrationCode(code)
+	if code == "" && serverOpts.RegistrationGroup == "" {
+		return errHTTP{
+			external: "Please enter the registration code you were given.",
+			code:     http.StatusBadRequest,
+		}
+	}
+	grouped, err := getGroupedSources()
+	if err != nil {
+		return err
+	}
+	for _, s := range grouped {
+		if sourceContains(s, ip) {
+			return errHTTP{
+				internal: fmt.Errorf("client %q is in source %q", client, s),
+				external: "This device is already registered.",
+				code:     http.StatusConflict,
+			}
+		}
+	}
+
+	if err := store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		var mine, total int
+		if err := tx.QueryRow(`SELECT COUNT(CASE WHEN client=? THEN 1 END), COUNT(*) FROM registrations WHERE status=?`, client, registrationPending).Scan(&mine, &total); err != nil {
+			return err
+		}
+		if mine > 0 {
+			return errHTTP{
+				external: "This device is already waiting for approval.",
+				code:     http.StatusConflict,
+			}
+		}
+		if total >= maxPendingRegistrations {
+			return errHTTP{
+				internal: fmt.Errorf("%d pending registrations", total),
+				external: "Too many devices are waiting for approval. Please try again later.",
+				code:     http.StatusTooManyRequests,
+			}
+		}
+		gid := serverOpts.RegistrationGroup
+		var codeID sql.NullString
+		if code != "" {
+			var expires, usesLeft sql.NullInt64
+			err := tx.QueryRow(`SELECT code_id, group_id, expires, uses_left FROM registrationcodes WHERE code=?`, code).Scan(&codeID, &gid, &expires, &usesLeft)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if err == sql.ErrNoRows || (expires.Valid && expires.Int64 <= now.Unix()) || (usesLeft.Valid && usesLeft.Int64 <= 0) {
+				return errHTTP{
+					internal: fmt.Errorf("client %q tried code %q", client, code),
+					external: "Unknown or expired registration code.",
+					code:     http.StatusForbidden,
+				}
+			}
+			if _, err := tx.Exec(`UPDATE registrationcodes SET uses_left=uses_left-1 WHERE code_id=? AND uses_left IS NOT NULL`, codeID.String); err != nil {
+				return err
+			}
+		}
+		id := uuid.NewV4().String()
+		log.Printf("Registration %s from %s of %q into %s", id, client, name, gid)
+		if _, err := tx.Exec(`INSERT INTO registrations(registration_id, client, name, group_id, code_id, created, status) VALUES(?,?,?,?,?,?,?)`, id, client, name, gid, codeID, now.Unix(), registrationPending); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	go notifyLog("squidwarden device registration", fmt.Sprintf("%s registered %q, which is waiting for approval at %s/registrations", client, name, strings.TrimSuffix(serverOpts.PublicURL, "/")))
+	return nil
+}
+
+// getRegistrations returns pending, or already decided, registrations,
+// with times in loc.
+func getRegistrations(pending bool, limit int, loc *time.Location) ([]registration, error) {
+	op := "="
+	if !pending {
+		op = "!="
+	}
+	rows, err := db.Query(`
+SELECT registrations.registration_id, registrations.client, registrations.name, registrations.group_id, groups.comment, registrationcodes.comment, registrations.created, registrations.status, registrations.source_id
+FROM registrations
+LEFT JOIN groups ON registrations.group_id=groups.group_id
+LEFT JOIN registrationcodes ON registrations.code_id=registrationcodes.code_id
+WHERE registrations.status`+op+`?
+ORDER BY registrations.created DESC
+LIMIT ?`, registrationPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []registration
+	for rows.Next() {
+		var e registration
+		var id, gid string
+		var group, code, src sql.NullString
+		var created int64
+		if err := rows.Scan(&id, &e.Client, &e.Name, &gid, &group, &code, &created, &e.Status, &src); err != nil {
+			return nil, err
+		}
+		e.RegistrationID = registrationID(id)
+		e.GroupID = groupID(gid)
+		e.Group = group.String
+		e.Code = code.String
+		e.Created = formatUnix(created, loc)
+		e.SourceID = sourceID(src.String)
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+// getRegistrationCodes returns all codes, newest first, with times in loc.
+func getRegistrationCodes(loc *time.Location) ([]registrationCode, error) {
+	rows, err := db.Query(`
+SELECT registrationcodes.code_id, registrationcodes.code, registrationcodes.group_id, groups.comment, registrationcodes.comment, registrationcodes.created, registrationcodes.expires, registrationcodes.uses_left
+FROM registrationcodes
+JOIN groups ON registrationcodes.group_id=groups.group_id
+ORDER BY registrationcodes.created DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []registrationCode
+	for rows.Next() {
+		var c registrationCode
+		var id, gid string
+		var group sql.NullString
+		var created int64
+		var expires, usesLeft sql.NullInt64
+		if err := rows.Scan(&id, &c.Code, &gid, &group, &c.Comment, &created, &expires, &usesLeft); err != nil {
+			return nil, err
+		}
+		c.CodeID = registrationCodeID(id)
+		c.GroupID = groupID(gid)
+		c.Group = group.String
+		c.Created = formatUnix(created, loc)
+		if expires.Valid {
+			c.Expires = formatUnix(expires.Int64, loc)
+		}
+		if usesLeft.Valid {
+			c.UsesLeft = strconv.FormatInt(usesLeft.Int64, 10)
+		}
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
+
+func registrationsHandler(r *http.Request) (template.HTML, error) {
+	loc := requestZone(r)
+	data := struct {
+		Enabled  bool
+		NeedCode bool
+		Pending  []registration
+		Decided  []registration
+		Codes    []registrationCode
+		Groups   []group
+	}{
+		Enabled:  serverOpts.Registration,
+		NeedCode: serverOpts.RegistrationGroup == "",
+	}
+	var err error
+	if data.Pending, err = getRegistrations(true, 1000, loc); err != nil {
+		return "", err
+	}
+	if data.Decided, err = getRegistrations(false, 50, loc); err != nil {
+		return "", err
+	}
+	if data.Codes, err = getRegistrationCodes(loc); err != nil {
+		return "", err
+	}
+	if data.Groups, _, err = getGroups(""); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("registrations.html", template.FuncMap{
+		"groupIDEQ": func(a, b groupID) bool { return a == b },
+	})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// checkGroupExists returns a 404 if group gid doesn't exist.
+func checkGroupExists(tx *sql.Tx, gid groupID) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM groups WHERE group_id=?`, string(gid)).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errHTTP{
+			external: fmt.Sprintf("group %q not found", gid),
+			code:     http.StatusNotFound,
+		}
+	}
+	return nil
+}
+
+// registrationApproveHandler adds the registered address to a group,
+// creating a source for it if there isn't one, optionally expiring after a
+// while.
+func registrationApproveHandler(r *http.Request) (interface{}, error) {
+	id := assertRegistrationID(mux.Vars(r)["registrationID"])
+	var data struct {
+		Group   string `form:"group,required,uuid"`
+		Expires string `form:"expires,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	expiry, err := parseMemberExpiry(data.Expires)
+	if err != nil {
+		return nil, err
+	}
+	gid := groupID(data.Group)
+	resp := struct {
+		Registration string `json:"registration"`
+		Group        string `json:"group"`
+		Source       string `json:"source"`
+	}{Registration: string(id), Group: string(gid)}
+	log.Printf("Approving registration %s into %s, expiry %q", id, gid, data.Expires)
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var client, name, status string
+		if err := tx.QueryRow(`SELECT client, name, status FROM registrations WHERE registration_id=?`, string(id)).Scan(&client, &name, &status); err == sql.ErrNoRows {
+			return errHTTP{
+				external: "registration not found",
+				code:     http.StatusNotFound,
+			}
+		} else if err != nil {
+			return err
+		}
+		if status != registrationPending {
+			return errHTTP{
+				external: fmt.Sprintf("registration already %s", status),
+				code:     http.StatusConflict,
+			}
+		}
+		if err := checkGroupExists(tx, gid); err != nil {
+			return err
+		}
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return fmt.Errorf("registration %s has bad client %q", id, client)
+		}
+		src := hostSource(ip)
+		if err := tx.QueryRow(`SELECT source_id FROM sources WHERE source=?`, src).Scan(&resp.Source); err == sql.ErrNoRows {
+			resp.Source = uuid.NewV4().String()
+			if _, err := tx.Exec(`INSERT INTO sources(source_id, source, comment) VALUES(?,?,?)`, resp.Source, src, name); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO members(group_id, source_id) VALUES(?,?)`, string(gid), resp.Source); err != nil {
+			return err
+		}
+		if err := setMemberExpiry(tx, gid, sourceID(resp.Source), expiry, time.Now()); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE registrations SET status=?, group_id=?, source_id=? WHERE registration_id=?`, registrationApproved, string(gid), resp.Source, string(id))
+		return err
+	})
+}
+
+func registrationRejectHandler(r *http.Request) (interface{}, error) {
+	id := assertRegistrationID(mux.Vars(r)["registrationID"])
+	log.Printf("Rejecting registration %s", id)
+	resp := struct {
+		Registration string `json:"registration"`
+		Status       string `json:"status"`
+		Updated      int64  `json:"updated"`
+	}{Registration: string(id), Status: registrationRejected}
+	var err error
+	if resp.Updated, err = rowsAffected(db.Exec(`UPDATE registrations SET status=? WHERE registration_id=? AND status=?`, registrationRejected, string(id), registrationPending)); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// registrationCodeNewHandler creates a code for registering into a group,
+// optionally usable only a number of times, or for a while.
+func registrationCodeNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Group   string `form:"group,required,uuid"`
+		Comment string `form:"comment,trim,max=200"`
+		Uses    string `form:"uses,trim"`
+		Expires string `form:"expires,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	var uses sql.NullInt64
+	if data.Uses != "" {
+		n, err := strconv.ParseInt(data.Uses, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("invalid number of uses %q", data.Uses),
+				code:     http.StatusBadRequest,
+				details:  map[string]fieldErrors{"fields": {"uses": "want a positive number, or empty for unlimited"}},
+			}
+		}
+		uses = sql.NullInt64{Int64: n, Valid: true}
+	}
+	d, err := parseExpiry(data.Expires)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid expiry %q", data.Expires),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"expires": "want a duration like 7d or 12h"}},
+		}
+	}
+	now := time.Now()
+	var expires sql.NullInt64
+	if d > 0 {
+		expires = sql.NullInt64{Int64: now.Add(d).Unix(), Valid: true}
+	}
+	code, err := newRegistrationCode()
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		ID   string `json:"id"`
+		Code string `json:"code"`
+	}{ID: uuid.NewV4().String(), Code: code}
+	log.Printf("Creating registration code %s for %s", resp.ID, data.Group)
+
+	return &resp, store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		if err := checkGroupExists(tx, groupID(data.Group)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO registrationcodes(code_id, code, group_id, comment, created, expires, uses_left) VALUES(?,?,?,?,?,?,?)`, resp.ID, code, data.Group, data.Comment, now.Unix(), expires, uses)
+		return err
+	})
+}
+
+func registrationCodeDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertRegistrationCodeID(mux.Vars(r)["codeID"])
+	log.Printf("Deleting registration code %s", id)
+	resp := struct {
+		ID      string `json:"id"`
+		Deleted int64  `json:"deleted"`
+	}{ID: string(id)}
+	var err error
+	if resp.Deleted, err = rowsAffected(db.Exec(`DELETE FROM registrationcodes WHERE code_id=?`, string(id))); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
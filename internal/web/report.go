@@ -0,0 +1,336 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The policy report is the whole policy as one human-readable document, for
+// audits: every group with its members and ACLs, and every ACL with its
+// rules, schedule and owner, with who last changed each. It's a standalone
+// HTML page that prints well, so that browsers can save it as PDF. It's
+// served at /report, and written by "ui report" for scripts.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+// reportChange is the latest change log entry about a group, ACL or rule.
+type reportChange struct {
+	Time    string
+	Actor   string
+	Summary string
+}
+
+type reportRule struct {
+	RuleID     ruleID
+	Type       string
+	Value      string
+	Action     string
+	Comment    string
+	Enabled    bool
+	Expires    string
+	LastChange *reportChange
+}
+
+type reportACL struct {
+	ACLID       aclID
+	Name        string
+	Description string
+	Enabled     bool
+	Archived    bool
+	Schedule    string
+	Owner       owner
+	Groups      []string
+	Rules       []reportRule
+	LastChange  *reportChange
+}
+
+type reportGroup struct {
+	GroupID    groupID
+	Name       string
+	Default    bool
+	Paused     string // "forever", the time it ends, or empty if not paused.
+	Owner      owner
+	Members    []string
+	ACLs       []string
+	LastChange *reportChange
+}
+
+type policyReport struct {
+	Generated string
+	Zone      string
+	Revision  int64
+	Groups    []reportGroup
+	ACLs      []reportACL
+
+	// Style is static/report.css, for reports read away from the UI.
+	// Empty links to it instead.
+	Style template.CSS
+}
+
+// reportQuery runs q and calls f with a scanner for each row.
+func reportQuery(tx *sql.Tx, q string, f func(scan func(...interface{}) error) error) error {
+	rows, err := tx.Query(q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := f(rows.Scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// getPolicyReport reads the policy, all in one transaction so that the
+// report is of one revision. Times are in loc.
+func getPolicyReport(loc *time.Location, now time.Time) (*policyReport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Only reading.
+	defer tx.Rollback()
+
+	rep := &policyReport{
+		Generated: formatTime(now, loc),
+		Zone:      loc.String(),
+	}
+	if err := tx.QueryRow(`SELECT revision FROM revision`).Scan(&rep.Revision); err != nil {
+		return nil, err
+	}
+
+	// IDs are UUIDs, so changes of any entity can be found by ID alone.
+	changes := make(map[string]*reportChange)
+	if err := reportQuery(tx, `SELECT entity_id, MAX(time), actor, summary FROM changelog WHERE entity_id!='' GROUP BY entity_id`, func(scan func(...interface{}) error) error {
+		var id string
+		var t int64
+		c := &reportChange{}
+		if err := scan(&id, &t, &c.Actor, &c.Summary); err != nil {
+			return err
+		}
+		c.Time = formatUnix(t, loc)
+		changes[id] = c
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	groups := make(map[groupID]*reportGroup)
+	var groupIDs []groupID
+	if err := reportQuery(tx, `
+SELECT groups.group_id, groups.comment, groupowners.owner, groupowners.contact, defaultgroup.group_id IS NOT NULL, grouppause.group_id IS NOT NULL, grouppause.expires
+FROM groups
+LEFT JOIN groupowners ON groups.group_id=groupowners.group_id
+LEFT JOIN defaultgroup ON groups.group_id=defaultgroup.group_id
+LEFT JOIN grouppause ON groups.group_id=grouppause.group_id`, func(scan func(...interface{}) error) error {
+		g := &reportGroup{}
+		var name, ownerName, contact sql.NullString
+		var paused bool
+		var expires sql.NullInt64
+		if err := scan(&g.GroupID, &name, &ownerName, &contact, &g.Default, &paused, &expires); err != nil {
+			return err
+		}
+		// Unnamed ones go by their ID.
+		g.Name = name.String
+		if g.Name == "" {
+			g.Name = string(g.GroupID)
+		}
+		g.Owner = owner{Owner: ownerName.String, Contact: contact.String}
+		if paused {
+			g.Paused = "forever"
+			if expires.Valid {
+				g.Paused = "until " + formatUnix(expires.Int64, loc)
+			}
+		}
+		g.LastChange = changes[string(g.GroupID)]
+		groups[g.GroupID] = g
+		groupIDs = append(groupIDs, g.GroupID)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := reportQuery(tx, `
+SELECT members.group_id, sources.source
+FROM members
+JOIN sources ON members.source_id=sources.source_id
+ORDER BY sources.source`, func(scan func(...interface{}) error) error {
+		var g groupID
+		var s string
+		if err := scan(&g, &s); err != nil {
+			return err
+		}
+		if groups[g] != nil {
+			groups[g].Members = append(groups[g].Members, s)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	acls := make(map[aclID]*reportACL)
+	var aclIDs []aclID
+	if err := reportQuery(tx, `
+SELECT acls.acl_id, acls.comment, acls.enabled, aclarchive.acl_id IS NOT NULL, acldescriptions.description, aclschedule.schedule, aclowners.owner, aclowners.contact
+FROM acls
+LEFT JOIN aclarchive ON acls.acl_id=aclarchive.acl_id
+LEFT JOIN acldescriptions ON acls.acl_id=acldescriptions.acl_id
+LEFT JOIN aclschedule ON acls.acl_id=aclschedule.acl_id
+LEFT JOIN aclowners ON acls.acl_id=aclowners.acl_id`, func(scan func(...interface{}) error) error {
+		a := &reportACL{}
+		var name, desc, schedule, ownerName, contact sql.NullString
+		if err := scan(&a.ACLID, &name, &a.Enabled, &a.Archived, &desc, &schedule, &ownerName, &contact); err != nil {
+			return err
+		}
+		a.Name, a.Description, a.Schedule = name.String, desc.String, schedule.String
+		if a.Name == "" {
+			a.Name = string(a.ACLID)
+		}
+		a.Owner = owner{Owner: ownerName.String, Contact: contact.String}
+		a.LastChange = changes[string(a.ACLID)]
+		acls[a.ACLID] = a
+		aclIDs = append(aclIDs, a.ACLID)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := reportQuery(tx, `
+SELECT groupaccess.group_id, groupaccess.acl_id
+FROM groupaccess`, func(scan func(...interface{}) error) error {
+		var g groupID
+		var a aclID
+		if err := scan(&g, &a); err != nil {
+			return err
+		}
+		if groups[g] == nil || acls[a] == nil {
+			return nil
+		}
+		groups[g].ACLs = append(groups[g].ACLs, acls[a].Name)
+		acls[a].Groups = append(acls[a].Groups, groups[g].Name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := reportQuery(tx, `
+SELECT aclrules.acl_id, rules.rule_id, rules.type, rules.value, rules.action, rules.comment, rules.enabled, ruleexpiry.expires
+FROM aclrules
+JOIN rules ON aclrules.rule_id=rules.rule_id
+LEFT JOIN ruleexpiry ON rules.rule_id=ruleexpiry.rule_id
+ORDER BY rules.type, rules.value, rules.action`, func(scan func(...interface{}) error) error {
+		var a aclID
+		var r reportRule
+		var comment sql.NullString
+		var expires sql.NullInt64
+		if err := scan(&a, &r.RuleID, &r.Type, &r.Value, &r.Action, &comment, &r.Enabled, &expires); err != nil {
+			return err
+		}
+		r.Comment = comment.String
+		if expires.Valid {
+			r.Expires = formatUnix(expires.Int64, loc)
+		}
+		r.LastChange = changes[string(r.RuleID)]
+		if acls[a] != nil {
+			acls[a].Rules = append(acls[a].Rules, r)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, id := range groupIDs {
+		g := groups[id]
+		sort.Strings(g.ACLs)
+		rep.Groups = append(rep.Groups, *g)
+	}
+	sort.Stable(reportGroupsByName(rep.Groups))
+	for _, id := range aclIDs {
+		a := acls[id]
+		sort.Strings(a.Groups)
+		rep.ACLs = append(rep.ACLs, *a)
+	}
+	sort.Stable(reportACLsByName(rep.ACLs))
+	return rep, nil
+}
+
+type reportGroupsByName []reportGroup
+
+func (a reportGroupsByName) Len() int           { return len(a) }
+func (a reportGroupsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a reportGroupsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+type reportACLsByName []reportACL
+
+func (a reportACLsByName) Len() int           { return len(a) }
+func (a reportACLsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a reportACLsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// writeReport writes the report as an HTML page. A standalone one has its
+// style inline, since it's read without the UI's static files.
+func writeReport(w io.Writer, rep *policyReport, standalone bool) error {
+	if standalone {
+		b, err := readFile(path.Join(serverOpts.Static, "report.css"))
+		if err != nil {
+			return err
+		}
+		rep.Style = template.CSS(b)
+	}
+	var buf bytes.Buffer
+	if err := getTemplate("report.html", nil).Execute(&buf, rep); err != nil {
+		return fmt.Errorf("template execute fail: %v", err)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// reportHandler serves the policy report. With download set, browsers
+// save it instead of showing it.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	rep, err := getPolicyReport(requestZone(r), now)
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.FormValue("download") != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="squidwarden-policy-%s.html"`, now.In(requestZone(r)).Format("20060102")))
+	}
+	if err := writeReport(w, rep, r.FormValue("download") != ""); err != nil {
+		log.Printf("Failed to write policy report: %v", err)
+	}
+}
+
+// Report writes the policy report of the database d to w, with times in
+// the deployment's time zone. It's for running without a server, so it
+// can't be used together with NewServer.
+func Report(d *sql.DB, opts Options, w io.Writer) error {
+	db = d
+	serverOpts = opts
+	loadTimeZones()
+	rep, err := getPolicyReport(displayZone(), time.Now())
+	if err != nil {
+		return err
+	}
+	return writeReport(w, rep, true)
+}
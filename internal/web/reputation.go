@@ -0,0 +1,309 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Domain reputation, shown as a risk indicator next to hosts in the review
+// queue to help decide whether to allow or block them. Scores are from 0
+// (good) to 100 (bad), from a local file of scores and an external API,
+// whose answers are cached in the database. A host's risk is the worst
+// score any source gives it.
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	reputationClient = &http.Client{Timeout: 10 * time.Second}
+
+	// reputationSem limits concurrent API requests, since the review
+	// queue asks for many hosts at once.
+	reputationSem = make(chan struct{}, 4)
+)
+
+const (
+	// reputationTTL is how long API answers are cached, and
+	// reputationRetry how long until a failed request is retried.
+	reputationTTL   = 24 * time.Hour
+	reputationRetry = time.Hour
+
+	// reputationListCheck is how often the list file is checked for
+	// changes.
+	reputationListCheck = time.Minute
+
+	// Scores from these up are medium and high risk.
+	reputationMedium = 30
+	reputationHigh   = 70
+
+	reputationSourceList = "list"
+	reputationSourceAPI  = "api"
+)
+
+// reputationScore is what one source says about a host.
+type reputationScore struct {
+	Source string `json:"source"`
+	Score  int    `json:"score"`
+	Label  string `json:"label,omitempty"`
+}
+
+type reputation struct {
+	Host    string            `json:"host"`
+	Score   int               `json:"score"` // -1 if no source knows the host.
+	Level   string            `json:"level"` // low, medium, high, or unknown.
+	Sources []reputationScore `json:"sources"`
+	Errors  []string          `json:"errors,omitempty"`
+}
+
+// reputationEnabled returns true if there are any reputation sources.
+func reputationEnabled() bool {
+	return serverOpts.ReputationList != "" || serverOpts.ReputationAPI != ""
+}
+
+// reputationLevel returns the risk level of a score.
+func reputationLevel(score int) string {
+	switch {
+	case score < 0:
+		return "unknown"
+	case score >= reputationHigh:
+		return "high"
+	case score >= reputationMedium:
+		return "medium"
+	}
+	return "low"
+}
+
+// parseReputationList parses a list of scores, skipping blank lines and #
+// comments.
+func parseReputationList(r io.Reader) (map[string]reputationScore, error) {
+	ret := make(map[string]reputationScore)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		l := scanner.Text()
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		f := strings.Fields(l)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, fmt.Errorf("line %d: want 'domain score [label]', got %q", n, l)
+		}
+		score, err := strconv.Atoi(f[1])
+		if err != nil || score < 0 || score > 100 {
+			return nil, fmt.Errorf("line %d: score %q is not 0-100", n, f[1])
+		}
+		domain := strings.ToLower(strings.TrimPrefix(f[0], "."))
+		ret[domain] = reputationScore{
+			Source: reputationSourceList,
+			Score:  score,
+			Label:  strings.Join(f[2:], " "),
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// reputations is the -reputation_list file, reread when it changes.
+var reputations struct {
+	sync.Mutex
+	checked time.Time
+	mtime   time.Time
+	scores  map[string]reputationScore
+}
+
+// listReputation returns the score of host, or of the closest domain it's
+// under, in -reputation_list.
+func listReputation(host string, now time.Time) (*reputationScore, error) {
+	reputations.Lock()
+	defer reputations.Unlock()
+	if now.Sub(reputations.checked) >= reputationListCheck {
+		reputations.checked = now
+		st, err := os.Stat(serverOpts.ReputationList)
+		if err != nil {
+			return nil, err
+		}
+		if !st.ModTime().Equal(reputations.mtime) {
+			f, err := os.Open(serverOpts.ReputationList)
+			if err != nil {
+				return nil, err
+			}
+			scores, err := parseReputationList(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", serverOpts.ReputationList, err)
+			}
+			log.Printf("Loaded %d reputation scores from %q", len(scores), serverOpts.ReputationList)
+			reputations.scores, reputations.mtime = scores, st.ModTime()
+		}
+	}
+	for h := strings.ToLower(host); ; {
+		if s, ok := reputations.scores[h]; ok {
+			return &s, nil
+		}
+		n := strings.Index(h, ".")
+		if n < 0 {
+			return nil, nil
+		}
+		h = h[n+1:]
+	}
+}
+
+// fetchReputation asks -reputation_api about host.
+func fetchReputation(host string) (*reputationScore, error) {
+	reputationSem <- struct{}{}
+	defer func() { <-reputationSem }()
+	u := strings.Replace(serverOpts.ReputationAPI, "{domain}", url.QueryEscape(host), -1)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h := serverOpts.ReputationAPIHeader; h != "" {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad -reputation_api_header, want 'Name: value'")
+		}
+		req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	resp, err := reputationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Unknown host.
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reputation API returned %q", resp.Status)
+	}
+	var data struct {
+		Score *float64 `json:"score"`
+		Label string   `json:"label"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&data); err != nil {
+		return nil, fmt.Errorf("bad reply from reputation API: %v", err)
+	}
+	if data.Score == nil {
+		return nil, nil
+	}
+	if *data.Score < 0 || *data.Score > 100 {
+		return nil, fmt.Errorf("reputation API score %v is not 0-100", *data.Score)
+	}
+	return &reputationScore{Source: reputationSourceAPI, Score: int(*data.Score + 0.5), Label: data.Label}, nil
+}
+
+// apiReputation returns the score of host from -reputation_api, from the
+// cache if it's fresh.
+func apiReputation(host string, now time.Time) (*reputationScore, error) {
+	var score sql.NullInt64
+	var label, errText string
+	var fetched int64
+	err := db.QueryRow(`SELECT score, label, fetched, error FROM reputation WHERE host=?`, host).Scan(&score, &label, &fetched, &errText)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		ttl := reputationTTL
+		if errText != "" {
+			ttl = reputationRetry
+		}
+		if now.Sub(time.Unix(fetched, 0)) < ttl {
+			if errText != "" {
+				return nil, fmt.Errorf("%s", errText)
+			}
+			if !score.Valid {
+				return nil, nil
+			}
+			return &reputationScore{Source: reputationSourceAPI, Score: int(score.Int64), Label: label}, nil
+		}
+	}
+
+	s, ferr := fetchReputation(host)
+	score, label, errText = sql.NullInt64{}, "", ""
+	if ferr != nil {
+		errText = ferr.Error()
+	} else if s != nil {
+		score, label = sql.NullInt64{Int64: int64(s.Score), Valid: true}, s.Label
+	}
+	if _, err := db.Exec(`INSERT OR REPLACE INTO reputation(host, score, label, fetched, error) VALUES(?,?,?,?,?)`, host, score, label, now.Unix(), errText); err != nil {
+		return nil, err
+	}
+	return s, ferr
+}
+
+// getReputation asks every source about host. Sources that fail are left
+// out, with their errors.
+func getReputation(host string, now time.Time) (*reputation, error) {
+	ret := &reputation{Host: host, Score: -1, Sources: []reputationScore{}}
+	for _, src := range []struct {
+		enabled bool
+		get     func(string, time.Time) (*reputationScore, error)
+	}{
+		{serverOpts.ReputationList != "", listReputation},
+		{serverOpts.ReputationAPI != "", apiReputation},
+	} {
+		if !src.enabled {
+			continue
+		}
+		s, err := src.get(host, now)
+		if err != nil {
+			log.Printf("Reputation of %q: %v", host, err)
+			ret.Errors = append(ret.Errors, err.Error())
+			continue
+		}
+		if s == nil {
+			continue
+		}
+		ret.Sources = append(ret.Sources, *s)
+		if s.Score > ret.Score {
+			ret.Score = s.Score
+		}
+	}
+	ret.Level = reputationLevel(ret.Score)
+	return ret, nil
+}
+
+// reputationHandler returns the reputation of a host.
+func reputationHandler(r *http.Request) (interface{}, error) {
+	host := strings.ToLower(strings.TrimPrefix(mux.Vars(r)["domain"], "."))
+	if !validListHost(host) {
+		return nil, errHTTP{
+			external: fmt.Sprintf("%q is not a domain", mux.Vars(r)["domain"]),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if !reputationEnabled() {
+		return nil, errHTTP{
+			external: "no reputation sources configured",
+			code:     http.StatusNotFound,
+		}
+	}
+	return getReputation(host, time.Now())
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The request log records every request to the UI itself, one JSON object
+// per line, for auditing who looked at and changed what, and for finding
+// slow pages. It's separate from the squid logs, and from the error log.
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// requestLogEntry is a line in the request log.
+type requestLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Remote    string  `json:"remote"`
+	User      string  `json:"user"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Latency   float64 `json:"latency_ms"`
+}
+
+type requestLogger struct {
+	h   http.Handler
+	out *log.Logger
+}
+
+func newRequestLogger(h http.Handler, w io.Writer) requestLogger {
+	return requestLogger{h: h, out: log.New(w, "", 0)}
+}
+
+func (c requestLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := time.Now()
+
+	// Pin the request ID, so that errors logged for the request can be
+	// found from its line in the request log.
+	id := requestID(r)
+	r.Header.Set("X-Request-Id", id)
+
+	tw, hw := track(w)
+	defer func() {
+		status := tw.status
+		if status == 0 {
+			// Handler returned without writing anything.
+			status = http.StatusOK
+		}
+		b, err := json.Marshal(&requestLogEntry{
+			Time:      st.UTC().Format(time.RFC3339Nano),
+			RequestID: id,
+			Remote:    r.RemoteAddr,
+			User:      remoteUser(r),
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Status:    status,
+			Bytes:     tw.size,
+			Latency:   float64(time.Since(st)) / float64(time.Millisecond),
+		})
+		if err != nil {
+			log.Printf("Failed to encode request log entry: %v", err)
+			return
+		}
+		c.out.Print(string(b))
+	}()
+	c.h.ServeHTTP(hw, r)
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Learning mode aggregates hosts seen in the squid log into the review
+// queue, so that rules can be written for the most frequent ones first.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/google/squidwarden/internal/store"
+)
+
+const (
+	learnOff    = ""
+	learnDenied = "denied"
+	learnAll    = "all"
+
+	learnFlushInterval = 10 * time.Second
+)
+
+type reviewEntry struct {
+	Host      string
+	Domain    string
+	Type      string
+	Hits      int64
+	FirstSeen string
+	LastSeen  string
+}
+
+type reviewKey struct {
+	host, typ string
+}
+
+type reviewCount struct {
+	hits        int64
+	first, last time.Time
+}
+
+// learner buffers hits in memory so that busy proxies don't cause a write
+// per log line.
+type learner struct {
+	ingest *logIngester // Nil in tests.
+
+	mu      sync.Mutex
+	pending map[reviewKey]*reviewCount
+}
+
+func (l *learner) add(e *squidlog.Entry) {
+	if serverOpts.Learn == learnDenied && !strings.Contains(e.Status, "DENIED") {
+		return
+	}
+	if e.Host == "" || currentIgnores().hides(e) {
+		return
+	}
+	k := reviewKey{host: e.Host, typ: typeDomain}
+	if e.Method == "CONNECT" {
+		k.typ = typeHTTPSDomain
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, found := l.pending[k]
+	if !found {
+		c = &reviewCount{first: now}
+		l.pending[k] = c
+	}
+	c.hits++
+	c.last = now
+}
+
+func (l *learner) flush() error {
+	var p map[reviewKey]*reviewCount
+	offsets := l.ingest.checkpoint(func() {
+		l.mu.Lock()
+		p = l.pending
+		l.pending = make(map[reviewKey]*reviewCount)
+		l.mu.Unlock()
+	})
+	if len(p) == 0 {
+		return nil
+	}
+
+	return store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		for k, c := range p {
+			res, err := tx.Exec(`UPDATE reviewqueue SET hits=hits+?, last_seen=? WHERE host=? AND type=?`, c.hits, c.last.Unix(), k.host, k.typ)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n > 0 {
+				continue
+			}
+			if _, err := tx.Exec(`INSERT INTO reviewqueue(host, type, hits, first_seen, last_seen) VALUES(?,?,?,?,?)`, k.host, k.typ, c.hits, c.first.Unix(), c.last.Unix()); err != nil {
+				return err
+			}
+		}
+		return l.ingest.saveOffsets(tx, offsets)
+	})
+}
+
+func (l *learner) run() {
+	for range time.Tick(learnFlushInterval) {
+		if err := l.flush(); err != nil {
+			log.Printf("Failed to flush review queue: %v", err)
+		}
+	}
+}
+
+func startLearning() {
+	switch serverOpts.Learn {
+	case learnOff:
+		return
+	case learnDenied, learnAll:
+	default:
+		log.Fatalf("Invalid -learn mode %q", serverOpts.Learn)
+	}
+	if !ingestConfigured() {
+		log.Fatalf("-learn requires -squidlog or -ingest_logs")
+	}
+	l := &learner{pending: make(map[reviewKey]*reviewCount)}
+	l.ingest = newLogIngester("learn", l.add)
+	go l.run()
+	go l.ingest.run()
+}
+
+// getReviewQueue returns the review queue, most hits first, with times in
+// loc. Hosts on the ignore list are left out.
+func getReviewQueue(loc *time.Location) ([]reviewEntry, error) {
+	rows, err := db.Query(`
+SELECT host, type, hits, first_seen, last_seen
+FROM reviewqueue
+ORDER BY hits DESC, host`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []reviewEntry
+	ign := currentIgnores()
+	for rows.Next() {
+		var e reviewEntry
+		var first, last int64
+		if err := rows.Scan(&e.Host, &e.Type, &e.Hits, &first, &last); err != nil {
+			return nil, err
+		}
+		if ign.hidesHost(e.Host) {
+			continue
+		}
+		e.Domain = squidlog.HostToDomain(e.Host)
+		e.FirstSeen = formatUnix(first, loc)
+		e.LastSeen = formatUnix(last, loc)
+		ret = append(ret, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func reviewHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Mode        string
+		Reputation  bool
+		Suggestions []suggestion
+		Entries     []reviewEntry
+	}{
+		Mode:       serverOpts.Learn,
+		Reputation: reputationEnabled(),
+	}
+	var err error
+	if data.Entries, err = getReviewQueue(requestZone(r)); err != nil {
+		return "", err
+	}
+	data.Suggestions = suggestRules(data.Entries)
+	tmpl := getTemplate("review.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// dequeueCovered removes all queue entries of type typ covered by value.
+func dequeueCovered(tx *sql.Tx, typ, value string) (int64, error) {
+	res, err := tx.Exec(`DELETE FROM reviewqueue WHERE type=? AND (host=? OR ('.'||host)=? OR (SUBSTR(?,1,1)='.' AND host LIKE ?))`, typ, value, value, value, "%"+value)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// reviewConvertHandler turns a queue entry into a rule in the "new" ACL.
+func reviewConvertHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Type   string `form:"type,required,enum=type"`
+		Value  string `form:"value,required"`
+		Action string `form:"action,required,enum=action"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Rule    string `json:"rule"`
+		Removed int64  `json:"removed"`
+	}{}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var err error
+		if resp.Rule, err = insertRule(tx, newACLID, data.Type, data.Value, data.Action); err != nil {
+			return err
+		}
+		resp.Removed, err = dequeueCovered(tx, data.Type, data.Value)
+		return err
+	})
+}
+
+func reviewDismissHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Hosts []string `form:"hosts[]"`
+		Types []string `form:"types[]"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	hosts, types := data.Hosts, data.Types
+	if len(hosts) != len(types) {
+		return nil, errHTTP{
+			internal: fmt.Errorf("host/type list lengths unequal: %d/%d", len(hosts), len(types)),
+			external: "host and type lists must have equal length",
+			code:     http.StatusBadRequest,
+		}
+	}
+	resp := struct {
+		Removed int64 `json:"removed"`
+	}{}
+	return &resp, store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		for n := range hosts {
+			d, err := rowsAffected(tx.Exec(`DELETE FROM reviewqueue WHERE host=? AND type=?`, hosts[n], types[n]))
+			if err != nil {
+				return err
+			}
+			resp.Removed += d
+		}
+		return nil
+	})
+}
+
+// reviewStatsHandler streams the review queue, most hits first.
+func reviewStatsHandler(r *http.Request, s *recordStream) error {
+	entries, err := getReviewQueue(requestZone(r))
+	if err != nil {
+		return err
+	}
+	for n := range entries {
+		if err := s.Write(&entries[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Editing a rule keeps what it was before, and who changed it when, so
+// that "who changed this from block to allow?" can be answered from the
+// rule's history. The change log only has that the rule was edited.
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ruleValues are the editable parts of a rule.
+type ruleValues struct {
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Action  string `json:"action"`
+	Comment string `json:"comment"`
+	Enabled bool   `json:"enabled"`
+}
+
+// changed returns the names of what differs between v and o.
+func (v *ruleValues) changed(o *ruleValues) []string {
+	ret := []string{}
+	if v.Type != o.Type {
+		ret = append(ret, "type")
+	}
+	if v.Value != o.Value {
+		ret = append(ret, "value")
+	}
+	if v.Action != o.Action {
+		ret = append(ret, "action")
+	}
+	if v.Comment != o.Comment {
+		ret = append(ret, "comment")
+	}
+	if v.Enabled != o.Enabled {
+		ret = append(ret, "enabled")
+	}
+	return ret
+}
+
+// ruleEdit is an edit in the history of a rule.
+type ruleEdit struct {
+	Time    string     `json:"time"`
+	Actor   string     `json:"actor"`
+	From    ruleValues `json:"from"`
+	To      ruleValues `json:"to"`
+	Changed []string   `json:"changed"`
+}
+
+// saveRuleVersion records what rule id is before actor edits it.
+func saveRuleVersion(tx *sql.Tx, actor string, id string, now time.Time) error {
+	_, err := tx.Exec(`
+INSERT INTO rulehistory(rule_id, time, actor, type, value, action, comment, enabled)
+SELECT rule_id, ?, ?, type, value, action, IFNULL(comment, ''), enabled
+FROM rules
+WHERE rule_id=?`, now.Unix(), actor, id)
+	return err
+}
+
+// getRuleHistory returns the edits of a rule, newest first, with times in
+// loc. Saves that didn't change anything are left out.
+func getRuleHistory(id ruleID, loc *time.Location) ([]ruleEdit, error) {
+	var cur ruleValues
+	var c sql.NullString
+	if err := db.QueryRow(`SELECT type, value, action, comment, enabled FROM rules WHERE rule_id=?`, string(id)).Scan(&cur.Type, &cur.Value, &cur.Action, &c, &cur.Enabled); err == sql.ErrNoRows {
+		return nil, errHTTP{
+			external: "rule not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	cur.Comment = c.String
+
+	rows, err := db.Query(`
+SELECT time, actor, type, value, action, comment, enabled
+FROM rulehistory
+WHERE rule_id=?
+ORDER BY time DESC, rowid DESC`, string(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []ruleEdit{}
+	to := cur
+	for rows.Next() {
+		var e ruleEdit
+		var t int64
+		if err := rows.Scan(&t, &e.Actor, &e.From.Type, &e.From.Value, &e.From.Action, &e.From.Comment, &e.From.Enabled); err != nil {
+			return nil, err
+		}
+		e.Time = formatUnix(t, loc)
+		e.To = to
+		to = e.From
+		if e.Changed = e.From.changed(&e.To); len(e.Changed) > 0 {
+			ret = append(ret, e)
+		}
+	}
+	return ret, rows.Err()
+}
+
+func ruleHistoryHandler(r *http.Request) (interface{}, error) {
+	id := assertRuleID(mux.Vars(r)["ruleID"])
+	h, err := getRuleHistory(id, requestZone(r))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Rule  string     `json:"rule"`
+		Edits []ruleEdit `json:"edits"`
+	}{
+		Rule:  string(id),
+		Edits: h,
+	}, nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Rules made from a log entry remember the entry, so that whoever reviews
+// the rule later can see why it exists.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+// logOrigin is the log entry a rule was made from.
+type logOrigin struct {
+	Time   int64
+	Client string
+	URL    string
+
+	loc *time.Location // To show Time in. Nil is displayZone().
+}
+
+// parseLogOrigin returns the origin from a log entry's fields, or nil if
+// they're all empty. t is in squidlog.TimeFormat, as in entries shown in
+// loc.
+func parseLogOrigin(t, client, url string, loc *time.Location) (*logOrigin, error) {
+	if t == "" && client == "" && url == "" {
+		return nil, nil
+	}
+	o := &logOrigin{Client: client, URL: url, loc: loc}
+	if t != "" {
+		ts, err := time.ParseInLocation(squidlog.TimeFormat, t, loc)
+		if err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("bad log entry time %q", t),
+				code:     http.StatusBadRequest,
+			}
+		}
+		o.Time = ts.Unix()
+	}
+	return o, nil
+}
+
+// Comment is the rule comment describing the origin.
+func (o *logOrigin) Comment() string {
+	s := "From log:"
+	if o.Client != "" {
+		s += " " + o.Client
+	}
+	if o.URL != "" {
+		s += " requested " + o.URL
+	}
+	if t := o.When(); t != "" {
+		s += " at " + t
+	}
+	return s
+}
+
+// When returns the time of the entry, or "" if not known.
+func (o *logOrigin) When() string {
+	if o.Time == 0 {
+		return ""
+	}
+	loc := o.loc
+	if loc == nil {
+		loc = displayZone()
+	}
+	return formatUnix(o.Time, loc)
+}
+
+// recordRuleOrigin stores where a rule came from, and uses it as the rule's
+// comment unless it has one.
+func recordRuleOrigin(tx *sql.Tx, id string, o *logOrigin) error {
+	if o == nil {
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO ruleorigins(rule_id, time, client, url) VALUES(?,?,?,?)`, id, o.Time, o.Client, o.URL); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE rules SET comment=? WHERE rule_id=? AND IFNULL(comment, '')=''`, o.Comment(), id)
+	return err
+}
+
+// getRuleOrigin returns the log entry a rule was made from, or nil, to be
+// shown in loc.
+func getRuleOrigin(id ruleID, loc *time.Location) (*logOrigin, error) {
+	o := logOrigin{loc: loc}
+	if err := db.QueryRow(`SELECT time, client, url FROM ruleorigins WHERE rule_id=?`, string(id)).Scan(&o.Time, &o.Client, &o.URL); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// deleteOrphanOrigins removes origins, and history, of rules that are gone.
+func deleteOrphanOrigins(tx *sql.Tx) error {
+	if _, err := tx.Exec(`DELETE FROM ruleorigins WHERE rule_id NOT IN (SELECT rule_id FROM rules)`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM rulehistory WHERE rule_id NOT IN (SELECT rule_id FROM rules)`)
+	return err
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// ACL schedules are parsed by the policy package. The scheduler only flips
+// an ACL when the schedule changes state, so manually enabling or disabling
+// it sticks until the next transition.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/gorilla/mux"
+)
+
+const scheduleInterval = time.Minute
+
+// scheduler flips ACLs according to their schedules.
+type scheduler struct {
+	mu sync.Mutex
+
+	// State each schedule was in last time it was checked.
+	last map[aclID]bool
+}
+
+var aclScheduler = &scheduler{last: make(map[aclID]bool)}
+
+func (s *scheduler) run() {
+	for {
+		if err := s.check(time.Now().In(scheduleZone())); err != nil {
+			log.Printf("Scheduler: %v", err)
+		}
+		time.Sleep(scheduleInterval)
+	}
+}
+
+// forget makes the next check apply the schedule of the ACL, even if it
+// hasn't changed state.
+func (s *scheduler) forget(id aclID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.last, id)
+}
+
+func (s *scheduler) check(now time.Time) error {
+	rows, err := db.Query(`
+SELECT aclschedule.acl_id, aclschedule.schedule, acls.enabled
+FROM aclschedule
+JOIN acls ON aclschedule.acl_id=acls.acl_id
+WHERE aclschedule.acl_id NOT IN (SELECT acl_id FROM aclarchive)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type flip struct {
+		id      aclID
+		enabled bool
+	}
+	var flips []flip
+	s.mu.Lock()
+	for rows.Next() {
+		var id, sched string
+		var enabled bool
+		if err := rows.Scan(&id, &sched, &enabled); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		p, err := policy.ParseSchedule(sched)
+		if err != nil {
+			log.Printf("Scheduler: bad schedule for ACL %s: %v", id, err)
+			continue
+		}
+		want := p.Active(now)
+		last, known := s.last[aclID(id)]
+		s.last[aclID(id)] = want
+		if known && last == want {
+			continue
+		}
+		if enabled != want {
+			flips = append(flips, flip{id: aclID(id), enabled: want})
+		}
+	}
+	s.mu.Unlock()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(flips) == 0 {
+		return nil
+	}
+	if err := txWrap(func(tx *sql.Tx) error {
+		for _, f := range flips {
+			log.Printf("Scheduler: setting ACL %s enabled=%t", f.id, f.enabled)
+			if _, err := tx.Exec(`UPDATE acls SET enabled=? WHERE acl_id=?`, f.enabled, string(f.id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if serverOpts.SquidConf != "" {
+		_, err := enqueueJob(jobConfigApply, "")
+		return err
+	}
+	return nil
+}
+
+func aclEnabledHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	var data struct {
+		Enabled bool `form:"enabled"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	enabled := data.Enabled
+	log.Printf("Setting ACL %s enabled=%t", id, enabled)
+	resp := struct {
+		ACL     string `json:"acl"`
+		Enabled bool   `json:"enabled"`
+		Updated int64  `json:"updated"`
+	}{ACL: string(id), Enabled: enabled}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if err := checkNotArchived(tx, id); err != nil {
+			return err
+		}
+		var err error
+		resp.Updated, err = rowsAffected(tx.Exec(`UPDATE acls SET enabled=? WHERE acl_id=?`, enabled, string(id)))
+		return err
+	})
+}
+
+func aclScheduleHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	var data struct {
+		Schedule string `form:"schedule,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	sched := data.Schedule
+	if _, err := policy.ParseSchedule(sched); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid schedule: %v", err),
+			code:     http.StatusBadRequest,
+		}
+	}
+	log.Printf("Setting ACL %s schedule to %q", id, sched)
+	if err := txWrap(func(tx *sql.Tx) error {
+		if err := checkNotArchived(tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM aclschedule WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if sched == "" {
+			return nil
+		}
+		_, err := tx.Exec(`INSERT INTO aclschedule(acl_id, schedule) VALUES(?,?)`, string(id), sched)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	aclScheduler.forget(id)
+	return &struct {
+		ACL      string `json:"acl"`
+		Schedule string `json:"schedule"`
+	}{ACL: string(id), Schedule: sched}, nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package web is the squidwarden web UI.
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/csrf"
+)
+
+// serverOpts are the options of the running server.
+var serverOpts = DefaultOptions()
+
+// NewServer returns the UI, with all routes and middleware, using d as the
+// database. Background jobs like the janitor and list syncing are not
+// started; see StartBackground.
+//
+// Handlers share package state, so there can only be one server per process.
+func NewServer(d *sql.DB, opts Options) http.Handler {
+	db = d
+	policies = policy.NewCache(d, policyMaxAge)
+	serverOpts = opts
+	loadSettings()
+	key := opts.CSRFKey
+	if key == nil {
+		key = getCSRFKey()
+	}
+
+	r := makeRouter()
+
+	// CSRF protection.
+	h := csrf.Protect(key,
+		csrf.FieldName("csrf"),
+		csrf.CookieName("csrf"),
+		csrf.Secure(opts.HTTPSOnly),
+		csrf.Path("/"),
+		csrf.ErrorHandler(csrfFail{}))(r)
+	h = tokenAuth{h}
+
+	// Send browsers to the setup wizard if the database is empty.
+	h = setupRedirect{h}
+
+	// Add extra headers.
+	h = &securityHeaders{h}
+	if opts.HSTS > 0 {
+		h = &hstsAdder{h}
+	}
+	h = recoverPanics{h}
+
+	if opts.RequestLog != nil {
+		h = newRequestLogger(h, opts.RequestLog)
+	}
+	return h
+}
+
+// CheckFiles loads the theme, and makes sure that the templates and static
+// files can be found, using opts from then on like NewServer.
+func CheckFiles(opts Options) error {
+	serverOpts = opts
+	if err := loadTheme(); err != nil {
+		return fmt.Errorf("failed to load theme %q: %v", opts.Theme, err)
+	}
+	if _, err := readFile(path.Join(opts.Static, "loading.gif")); err != nil {
+		return fmt.Errorf("couldn't find 'loading.gif'. Did you 'go generate'? -mem_files=%t -disk_files=%t -static=%q", opts.MemFiles, opts.DiskFiles, opts.Static)
+	}
+	if _, err := readFile(path.Join(opts.Templates, "page.html")); err != nil {
+		return fmt.Errorf("couldn't find 'page.html'. -mem_files=%t -disk_files=%t -templates=%q", opts.MemFiles, opts.DiskFiles, opts.Templates)
+	}
+	return nil
+}
+
+// Migrate brings a database from an older version up to date with the
+// schema in opts. See store.Migrate.
+func Migrate(db *sql.DB, opts Options) error {
+	serverOpts = opts
+	b, err := readFile(opts.Schema)
+	if err != nil {
+		return fmt.Errorf("reading schema %q: %v", opts.Schema, err)
+	}
+	return store.Migrate(db, string(b))
+}
+
+// StartBackground starts the jobs that keep the database up to date: event
+// streams, the janitor, ACL schedules, list and threat feed syncing, syslog
+// receiving, log ingestion for learning, quotas, stats, client discovery and
+// alerts, metrics exporters, publishing changes, and anonymization. Call it once, after NewServer.
+func StartBackground() {
+	startPublisher()
+	go events.run()
+	go janitor()
+	go jobRunner()
+	go backupScheduler()
+	go digestScheduler()
+	go aclScheduler.run()
+	go listSyncer()
+	go threatSyncer()
+	go refreshBypassACL()
+	startSyslog()
+	startLearning()
+	startQuotas()
+	startStats()
+	startDiscovery()
+	startMetrics()
+	startPrivacy()
+	startAlerts()
+}
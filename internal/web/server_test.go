@@ -0,0 +1,2874 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/google/squidwarden/internal/store"
+)
+
+var (
+	sqliteBin = "/usr/bin/sqlite3"
+
+	update = flag.Bool("update", false, "Update golden files.")
+)
+
+// guestsGroup is the group in testdata/test.sql with a real ID. The others
+// predate IDs being UUIDs, and don't match the routes.
+const guestsGroup = "5f0c3d2e-8b1a-4c6e-9d7f-2a4b6c8e0f13"
+
+var testOpts = func() Options {
+	o := DefaultOptions()
+	o.Templates = "templates"
+	o.Static = "static"
+	o.CSRFKey = bytes.Repeat([]byte("k"), 32)
+	return o
+}()
+
+// newTestServer starts the whole UI against a fresh database with the
+// schema and test data.
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	if _, err := os.Stat(sqliteBin); err != nil {
+		t.Skipf("%s not available: %v", sqliteBin, err)
+	}
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := path.Join(dir, "squidwarden_test.sqlite")
+	for _, sqlFile := range []string{"../../sqlite.schema", "../../testdata/test.sql"} {
+		f, err := os.Open(sqlFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e bytes.Buffer
+		cmd := exec.Command(sqliteBin, fn)
+		cmd.Stdin = f
+		cmd.Stderr = &e
+		err = cmd.Run()
+		f.Close()
+		if err != nil {
+			t.Fatalf("sqlite setup reading %q: %v, stderr %q", sqlFile, err, e.String())
+		}
+	}
+	d, err := store.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(NewServer(d, testOpts))
+	return s, func() {
+		s.Close()
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServerPages(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	for _, p := range []string{
+		"/",
+		"/about",
+		"/access/",
+		"/access/" + guestsGroup,
+		"/acl/",
+		"/analysis",
+		"/changes",
+		"/digest",
+		"/digest/preview",
+		"/exception",
+		"/exceptions",
+		"/export.json",
+		"/ignore",
+		"/lists",
+		"/matrix",
+		"/members/",
+		"/pause",
+		"/preferences",
+		"/promotions",
+		"/quota",
+		"/registrations",
+		"/report",
+		"/review",
+		"/snapshots",
+		"/static/squidwarden.css",
+		"/theme.css",
+		"/tokens",
+	} {
+		resp, err := http.Get(s.URL + p)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %q", p, resp.Status)
+		}
+	}
+}
+
+var reCSRFField = regexp.MustCompile(`id="csrf" value="([^"]+)"`)
+
+// newTestClient returns a client with a session cookie, and the
+// matching CSRF token.
+func newTestClient(t *testing.T, s *httptest.Server) (*http.Client, string) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Jar: jar}
+	resp, err := c.Get(s.URL + "/acl/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := reCSRFField.FindStringSubmatch(string(b))
+	if m == nil {
+		t.Fatalf("no CSRF token in page")
+	}
+	// The token is base64, and html/template escapes its '+'.
+	return c, html.UnescapeString(m[1])
+}
+
+// postForm posts form values the way doPost() in squidwarden.js does.
+func postForm(t *testing.T, c *http.Client, u, token string, v url.Values) *http.Response {
+	return sendForm(t, c, "POST", u, token, v)
+}
+
+// sendForm is postForm for any method, e.g. DELETE like doDelete().
+func sendForm(t *testing.T, c *http.Client, method, u, token string, v url.Values) *http.Response {
+	req, err := http.NewRequest(method, u, strings.NewReader(v.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("X-CSRF-Token", token)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// getJSON fetches a JSON handler the way $.getJSON() in the UI does.
+func getJSON(t *testing.T, c *http.Client, u string) *http.Response {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// newTestACL creates an ACL through the UI and returns its ID.
+func newTestACL(t *testing.T, c *http.Client, s *httptest.Server, token, comment string) string {
+	resp := postForm(t, c, s.URL+"/acl/new", token, url.Values{"comment": {comment}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %q", resp.Status)
+	}
+	var got struct {
+		ACL string `json:"acl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	return got.ACL
+}
+
+func TestServerNewACL(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	resp := postForm(t, c, s.URL+"/acl/new", "bogus", url.Values{"comment": {"test acl"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("bad CSRF token: got status %q, want 403", resp.Status)
+	}
+
+	id := newTestACL(t, c, s, token, "test acl")
+	if !reUUID.MatchString(id) {
+		t.Fatalf("got ACL ID %q, want UUID", id)
+	}
+
+	resp = postForm(t, c, s.URL+"/acl/"+id, token, url.Values{"comment": {"renamed"}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rename: got status %q", resp.Status)
+	}
+	var got struct {
+		ACL     string `json:"acl"`
+		Comment string `json:"comment"`
+		Updated int    `json:"updated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ACL != id || got.Comment != "renamed" || got.Updated != 1 {
+		t.Errorf("rename: got %+v", got)
+	}
+}
+
+func TestServerMoveRules(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	a := newTestACL(t, c, s, token, "move from")
+	b := newTestACL(t, c, s, token, "move to")
+	rule := "11111111-2222-3333-4444-555555555555"
+	for _, test := range []struct {
+		src, dst string
+		code     int
+	}{
+		{a, a, http.StatusBadRequest},
+		{a, "not-an-acl", http.StatusBadRequest},
+		{a, "00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+		{a, b, http.StatusOK},
+	} {
+		resp := postForm(t, c, s.URL+"/acl/move", token, url.Values{
+			"source":      {test.src},
+			"destination": {test.dst},
+			"rules[]":     {rule},
+		})
+		var got struct {
+			Moved int `json:"moved"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("move %s -> %s: got status %q, want %d", test.src, test.dst, resp.Status, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Moved != 0 {
+			t.Errorf("move %s -> %s: moved %d rules not in source ACL", test.src, test.dst, got.Moved)
+		}
+	}
+}
+
+func TestServerBulkRules(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	acl := newTestACL(t, c, s, token, "bulk")
+	form := url.Values{
+		"acl":     {acl},
+		"type":    {"domain"},
+		"action":  {"allow"},
+		"comment": {"pasted"},
+		"values":  {"a.example.com\nb.example.com\n"},
+	}
+	type result struct {
+		Created  int `json:"created"`
+		Rejected int `json:"rejected"`
+		Results  []struct {
+			Value  string `json:"value"`
+			Status string `json:"status"`
+			Rule   string `json:"rule"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	for _, want := range []struct{ created, rejected int }{{2, 0}, {0, 2}} {
+		resp := postForm(t, c, s.URL+"/rule/bulk", token, form)
+		var got result
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %q", resp.Status)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Created != want.created || got.Rejected != want.rejected || len(got.Results) != 2 {
+			t.Errorf("got %+v, want %d created and %d rejected", got, want.created, want.rejected)
+		}
+	}
+
+	// One duplicate aborts the whole batch.
+	form.Set("values", "c.example.com\na.example.com")
+	form.Set("abort_on_error", "true")
+	resp := postForm(t, c, s.URL+"/rule/bulk", token, form)
+	var aborted struct {
+		Error struct {
+			Details result `json:"details"`
+		} `json:"error"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&aborted)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("abort: got status %q", resp.Status)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := aborted.Error.Details; d.Created != 0 || d.Rejected != 1 || len(d.Results) != 2 || d.Results[0].Status != bulkSkipped {
+		t.Errorf("abort: got %+v", d)
+	}
+	form.Set("values", "c.example.com")
+	form.Set("abort_on_error", "false")
+	resp = postForm(t, c, s.URL+"/rule/bulk", token, form)
+	var again result
+	err = json.NewDecoder(resp.Body).Decode(&again)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Created != 1 {
+		t.Errorf("abort: c.example.com not rolled back, got %+v", again)
+	}
+
+	form.Set("type", "bogus")
+	resp = postForm(t, c, s.URL+"/rule/bulk", token, form)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad type: got status %q, want 400", resp.Status)
+	}
+}
+
+func TestServerRuleNewACL(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	acl := newTestACL(t, c, s, token, "block here")
+
+	for n, test := range []struct {
+		acl  string
+		want int
+	}{
+		{acl, http.StatusOK},
+		{"", http.StatusOK},
+		{"00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+		{"sfw", http.StatusBadRequest},
+	} {
+		resp := postForm(t, c, s.URL+"/rule/new", token, url.Values{
+			"type":   {"domain"},
+			"value":  {fmt.Sprintf("acl%d.example.com", n)},
+			"action": {"block"},
+			"acl":    {test.acl},
+		})
+		var rule struct {
+			Rule string `json:"rule"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&rule)
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%q: got status %q, want %d", test.acl, resp.Status, test.want)
+			continue
+		}
+		if test.want != http.StatusOK {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantACL := test.acl
+		if wantACL == "" {
+			wantACL = string(newACLID)
+		}
+		var got string
+		if err := db.QueryRow(`SELECT acl_id FROM aclrules WHERE rule_id=?`, rule.Rule).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != wantACL {
+			t.Errorf("%q: rule in ACL %q, want %q", test.acl, got, wantACL)
+		}
+	}
+}
+
+func TestClientACLs(t *testing.T) {
+	_, done := newTestServer(t)
+	defer done()
+
+	clients := []*activeClient{
+		{Client: "127.0.0.1", Source: &source{SourceID: "bob"}},
+		// In no source, and there's no default group.
+		{Client: "::1"},
+	}
+	if err := addClientACLs(clients); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range clients[0].ACLs {
+		got = append(got, string(a.ACLID))
+	}
+	if want := []string{"noc-acl"}; !clients[0].GroupACLs || !reflect.DeepEqual(got, want) {
+		t.Errorf("bob: got %q (group %t), want %q from its group", got, clients[0].GroupACLs, want)
+	}
+	all, err := getACLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clients[1].GroupACLs || !reflect.DeepEqual(clients[1].ACLs, all) {
+		t.Errorf("No source: got %v (group %t), want all ACLs to pick from", clients[1].ACLs, clients[1].GroupACLs)
+	}
+}
+
+func TestICAPConf(t *testing.T) {
+	_, done := newTestServer(t)
+	defer done()
+
+	var buf bytes.Buffer
+	sg := newSquidGroups([]groupSources{{Group: group{GroupID: "friends"}, Sources: []string{"127.0.0.0/8"}}}, "")
+	if err := generateICAPConf(&buf, sg); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("no services: got %q, want nothing", buf.String())
+	}
+
+	for _, q := range []string{
+		`INSERT INTO icapservices(icap_id, name, vectoring_point, url, bypass) VALUES('i1', 'av', 'respmod_precache', 'icap://127.0.0.1:1344/av', 1)`,
+		`INSERT INTO groupicap(group_id, icap_id) VALUES('friends', 'i1')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := generateICAPConf(&buf, sg); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+# ICAP services.
+icap_enable on
+icap_service sw_icap_av respmod_precache icap://127.0.0.1:1344/av bypass=on
+adaptation_access sw_icap_av allow sw_group_friends
+adaptation_access sw_icap_av deny all
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGoldenTemplates renders templates with fixed data, and compares them
+// to testdata/*.golden. Run with -update after intended changes.
+func TestGoldenTemplates(t *testing.T) {
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts = testOpts
+	for _, test := range []struct {
+		template string
+		data     interface{}
+	}{
+		{"analysis.html", &policyAnalysis{
+			Findings: []finding{{
+				Kind:    findingRedundant,
+				Message: `Group "kids": rule is covered.`,
+				Links:   []errHTTPLink{{Text: "covered rule", Link: "/rule/r1"}},
+			}},
+		}},
+		{"pause.html", &struct {
+			Groups  []groupPause
+			CanKill bool
+		}{
+			Groups: []groupPause{
+				{Group: group{GroupID: "g1", Comment: "kids"}, Paused: true, Expires: "2016-01-01 20:00:00 UTC"},
+				{Group: group{GroupID: "g2", Comment: "adults"}},
+			},
+		}},
+		{"report.html", &policyReport{
+			Generated: "2016-01-01 20:00:00 UTC",
+			Zone:      "UTC",
+			Revision:  42,
+			Groups: []reportGroup{
+				{GroupID: "g1", Name: "kids", Owner: owner{Owner: "Parents", Contact: "parents@example.com"}, Paused: "until 2016-01-02 08:00:00 UTC", Members: []string{"10.0.0.0/24"}, ACLs: []string{"school"},
+					LastChange: &reportChange{Time: "2016-01-01 10:00:00 UTC", Actor: "alice", Summary: "pause"}},
+				{GroupID: "g2", Name: "guests", Default: true},
+			},
+			ACLs: []reportACL{
+				{ACLID: "a1", Name: "school", Description: "Homework sites.", Enabled: true, Schedule: "Mon-Fri 08:00-15:00", Groups: []string{"kids"},
+					Rules: []reportRule{
+						{RuleID: "r1", Type: "domain", Value: ".example.edu", Action: "allow", Comment: "school", Enabled: true, Expires: "2016-06-01 00:00:00 UTC",
+							LastChange: &reportChange{Time: "2016-01-01 09:00:00 UTC", Actor: "bob", Summary: "rule update"}},
+						{RuleID: "r2", Type: "regex", Value: "^http://games\\.", Action: "block"},
+					}},
+				{ACLID: "a2", Name: "old", Archived: true},
+			},
+		}},
+		{"tail.html", &struct {
+			CSRF  string
+			Theme siteTheme
+		}{
+			CSRF:  "token",
+			Theme: defaultTheme,
+		}},
+	} {
+		var buf bytes.Buffer
+		if err := getTemplate(test.template, nil).Execute(&buf, test.data); err != nil {
+			t.Errorf("%s: %v", test.template, err)
+			continue
+		}
+		fn := path.Join("testdata", test.template+".golden")
+		if *update {
+			if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != string(want) {
+			t.Errorf("%s: differs from %s. Got:\n%s", test.template, fn, got)
+		}
+	}
+}
+
+func TestServerTriageNext(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	f, err := ioutil.TempFile("", "squidwarden-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	for _, l := range []string{
+		// Not denied.
+		"1451606401 10 10.0.1.1 TCP_MISS/200 100 GET http://www.example.net/ - HIER_DIRECT/- text/html",
+		// Covered by the .unencrypted.habets.se rule.
+		"1451606402 10 10.0.1.1 TCP_DENIED/403 100 GET http://www.unencrypted.habets.se/ - HIER_NONE/- text/html",
+		"1451606403 10 10.0.1.1 TCP_DENIED/403 100 GET http://www.example.org/ - HIER_NONE/- text/html",
+	} {
+		fmt.Fprintln(f, l)
+	}
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.SquidLog = f.Name()
+
+	resp := getJSON(t, http.DefaultClient, s.URL+"/triage/next")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %q", resp.Status)
+	}
+	var got struct {
+		Entry *squidlog.Entry
+		Type  string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Entry == nil || got.Entry.Host != "www.example.org" || got.Type != typeDomain {
+		t.Errorf("got %+v, want the www.example.org domain", got)
+	}
+}
+
+func TestServerDashboard(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	a := newTestACL(t, c, s, token, "dashboard")
+	resp := postForm(t, c, s.URL+"/acl/"+a, token, url.Values{"comment": {"renamed"}})
+	resp.Body.Close()
+
+	resp = getJSON(t, c, s.URL+"/dashboard.json?limit=1")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %q", resp.Status)
+	}
+	var got dashboard
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(got.Changes))
+	}
+	if c := got.Changes[0]; c.Summary != "acl update" || c.EntityID != a || c.Link != "/acl/"+a {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestServerCompactStats(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	now := time.Date(2020, 6, 15, 12, 30, 0, 0, time.UTC)
+	old := now.AddDate(0, 0, -10).Truncate(time.Hour)
+	for _, e := range []struct {
+		t      time.Time
+		denied bool
+	}{
+		{old, false},
+		{old.Add(time.Minute), true},
+		{now.Add(-time.Minute), false},
+	} {
+		if _, err := db.Exec(`INSERT INTO trafficlog(time, client, status, method, host, bytes, denied) VALUES(?,?,?,?,?,?,?)`, e.t.Unix(), "10.0.0.1", "TCP_MISS/200", "GET", "example.com", 100, e.denied); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ancient := now.AddDate(-2, 0, 0).Unix()
+	if _, err := db.Exec(`INSERT INTO trafficstats(hour, client, host, requests, denied, bytes) VALUES(?,?,?,?,?,?)`, ancient, "10.0.0.1", "example.com", 1, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactStats(now, 7, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(s.URL + "/stats/traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []trafficRecord
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []trafficRecord{
+		{Time: now.Truncate(time.Hour).Format(saneTime), Client: "10.0.0.1", Host: "example.com", Requests: 1, Bytes: 100},
+		{Time: old.Format(saneTime), Client: "10.0.0.1", Host: "example.com", Requests: 2, Denied: 1, Bytes: 200},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	var raw int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM trafficlog`).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw != 1 {
+		t.Errorf("got %d raw entries left, want 1", raw)
+	}
+}
+
+func TestServerAnonymize(t *testing.T) {
+	_, done := newTestServer(t)
+	defer done()
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-48 * time.Hour).Unix()
+	for _, c := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, err := db.Exec(`INSERT INTO trafficstats(hour, client, host, requests, denied, bytes) VALUES(?,?,?,?,?,?)`, old, c, "example.com", 2, 1, 100); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`INSERT INTO trafficlog(time, client, status, method, host, bytes, denied) VALUES(?,?,?,?,?,?,?)`, now.Unix(), c, "TCP_MISS/200", "GET", "example.com", 1, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := anonymize(now.Add(-time.Hour), privacyTruncate, ""); err != nil {
+		t.Fatal(err)
+	}
+	var client string
+	var requests, bytes int64
+	if err := db.QueryRow(`SELECT client, requests, bytes FROM trafficstats`).Scan(&client, &requests, &bytes); err != nil {
+		t.Fatal(err)
+	}
+	if client != "10.0.0.0" || requests != 4 || bytes != 200 {
+		t.Errorf("got %q %d %d, want merged totals for 10.0.0.0", client, requests, bytes)
+	}
+	var recent int
+	if err := db.QueryRow(`SELECT COUNT(DISTINCT client) FROM trafficlog`).Scan(&recent); err != nil {
+		t.Fatal(err)
+	}
+	if recent != 2 {
+		t.Errorf("recent traffic anonymized: %d clients left", recent)
+	}
+}
+
+func TestServerActivityReport(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	src := "22222222-3333-4444-5555-666666666666"
+	if _, err := db.Exec(`INSERT INTO sources(source_id, source) VALUES(?, '10.1.0.0/16')`, src); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, e := range []struct {
+		client, host string
+		denied       bool
+	}{
+		{"10.1.2.3", "www.example.com", false},
+		{"10.1.2.4", "example.com", true},
+		{"10.1.2.4", "other.org", false},
+		{"10.2.0.1", "example.com", false},
+	} {
+		if _, err := db.Exec(`INSERT INTO trafficlog(time, client, status, method, host, bytes, denied) VALUES(?,?,?,?,?,?,?)`, now.Unix(), e.client, "TCP_MISS/200", "GET", e.host, 10, e.denied); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Get(s.URL + "/source/" + src + "/activity/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []activityDomain
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []activityDomain{
+		{Domain: ".example.com", Requests: 2, Denied: 1, Bytes: 20},
+		{Domain: ".other.org", Requests: 1, Bytes: 10},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	resp, err = http.Get(s.URL + "/source/" + src + "/activity/export?format=pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("got Content-Type %q, want PDF", got)
+	}
+}
+
+func TestServerThreatFeedExpiry(t *testing.T) {
+	_, done := newTestServer(t)
+	defer done()
+	feeds := []threatFeedID{"33333333-4444-5555-6666-777777777777", "44444444-5555-6666-7777-888888888888"}
+	for n, f := range feeds {
+		if _, err := db.Exec(`INSERT INTO threatfeeds(feed_id, name, url, format, ttl_seconds) VALUES(?,?,?,?,?)`, string(f), fmt.Sprintf("feed%d", n), "http://example.com/", threatURLs, 3600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := threatIndicator{Type: typeExact, Value: "http://a.example.com/"}
+	b := threatIndicator{Type: typeExact, Value: "http://b.example.com/"}
+	apply := func(f threatFeedID, now time.Time, is ...threatIndicator) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if _, _, err := applyThreatFeed(tx, f, is, time.Hour, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := func() map[string]string {
+		rows, err := db.Query(`
+SELECT rules.value, aclrules.comment
+FROM aclrules
+JOIN acls ON aclrules.acl_id=acls.acl_id
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE acls.comment=?`, threatACLName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		ret := make(map[string]string)
+		for rows.Next() {
+			var v, c string
+			if err := rows.Scan(&v, &c); err != nil {
+				t.Fatal(err)
+			}
+			ret[v] = c
+		}
+		return ret
+	}
+
+	now := time.Unix(1500000000, 0)
+	apply(feeds[0], now, a, b)
+	apply(feeds[1], now, a)
+	want := map[string]string{a.Value: "threat feed: feed0, feed1", b.Value: "threat feed: feed0"}
+	if got := rules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Dropped from the feeds, but within the TTL.
+	apply(feeds[0], now.Add(30*time.Minute))
+	if got := rules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("within TTL: got %q, want %q", got, want)
+	}
+
+	// Past the TTL of feed0, but feed1 still lists a.
+	apply(feeds[0], now.Add(2*time.Hour))
+	want = map[string]string{a.Value: "threat feed: feed1"}
+	if got := rules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after TTL: got %q, want %q", got, want)
+	}
+}
+
+func TestServerSimulate(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, _ := newTestClient(t, s)
+
+	resp := getJSON(t, c, s.URL+"/simulate.json?"+url.Values{"client": {"203.0.113.9"}, "url": {"https://www.example.com/"}}.Encode())
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %q", resp.Status)
+	}
+	var got simulation
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Action != policy.ActionDefault || len(got.Trace) == 0 || got.Trace[len(got.Trace)-1].Result != policy.TraceDefault {
+		t.Errorf("got %+v, want default with trace", got)
+	}
+
+	resp = getJSON(t, c, s.URL+"/simulate.json?client=nope&url=http://example.com/")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad client: got status %q, want 400", resp.Status)
+	}
+}
+
+func TestServerDiscoverClients(t *testing.T) {
+	_, done := newTestServer(t)
+	defer done()
+	for _, q := range []string{
+		`INSERT INTO groups(group_id, comment) VALUES('7c5a4ea4-0000-4000-8000-000000000001', 'discover')`,
+		`INSERT INTO sources(source_id, source, comment) VALUES('7c5a4ea4-0000-4000-8000-000000000002', '198.51.100.0/24', 'known')`,
+		`INSERT INTO members(group_id, source_id) VALUES('7c5a4ea4-0000-4000-8000-000000000001', '7c5a4ea4-0000-4000-8000-000000000002')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2020, 6, 15, 12, 30, 0, 0, time.UTC)
+	c := newClientTracker()
+	for _, e := range []squidlog.Entry{
+		{Time: now.Format(squidlog.TimeFormat), Client: "203.0.113.5", Status: "TCP_DENIED/403"},
+		{Time: now.Format(squidlog.TimeFormat), Client: "203.0.113.5", Status: "TCP_MISS/200"},
+		{Time: now.Format(squidlog.TimeFormat), Client: "198.51.100.7", Status: "TCP_MISS/200"},
+	} {
+		c.add(&e)
+	}
+	if err := c.flush(now); err != nil {
+		t.Fatal(err)
+	}
+	c.add(&squidlog.Entry{Time: now.Add(time.Minute).Format(squidlog.TimeFormat), Client: "203.0.113.5", Status: "TCP_MISS/200"})
+	if err := c.flush(now); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getUnknownClients(0, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *unknownClient
+	for n := range got {
+		if got[n].Client == "198.51.100.7" {
+			t.Errorf("client in a group's source listed: %+v", got[n])
+		}
+		if got[n].Client == "203.0.113.5" {
+			found = &got[n]
+		}
+	}
+	if found == nil {
+		t.Fatalf("unknown client missing from %+v", got)
+	}
+	if found.Hits != 3 || found.Denied != 1 || found.Source != "203.0.113.5/32" {
+		t.Errorf("got %+v, want 3 hits, 1 denied", found)
+	}
+}
+
+func TestServerSetup(t *testing.T) {
+	if _, err := os.Stat(sqliteBin); err != nil {
+		t.Skipf("%s not available: %v", sqliteBin, err)
+	}
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := store.Open(path.Join(dir, "empty.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	opts := testOpts
+	opts.Schema = "../../sqlite.schema"
+	s := httptest.NewServer(NewServer(d, opts))
+	defer s.Close()
+
+	// Empty database, so everything goes to the wizard.
+	c, token := newTestClient(t, s)
+	resp, err := c.Get(s.URL + "/acl/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Request.URL.Path, "/setup"; got != want {
+		t.Errorf("before setup: ended up at %q, want %q", got, want)
+	}
+
+	for _, step := range []struct {
+		path string
+		v    url.Values
+	}{
+		{"/setup/schema", nil},
+		{"/setup/group", url.Values{"comment": {"kids"}, "source": {"10.1.0.0/24"}, "template": {"kids"}}},
+		{"/setup/finish", nil},
+	} {
+		resp := postForm(t, c, s.URL+step.path, token, step.v)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %q", step.path, resp.Status)
+		}
+	}
+	var acls int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM groupaccess`).Scan(&acls); err != nil {
+		t.Fatal(err)
+	}
+	if acls == 0 {
+		t.Errorf("group from template has no ACLs")
+	}
+
+	resp, err = c.Get(s.URL + "/acl/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Request.URL.Path, "/acl/"; got != want {
+		t.Errorf("after setup: ended up at %q, want %q", got, want)
+	}
+}
+
+func TestServerRuleOrigin(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	resp := postForm(t, c, s.URL+"/rule/new", token, url.Values{
+		"type":       {"domain"},
+		"value":      {"origin.example.com"},
+		"action":     {"allow"},
+		"log_time":   {"2016-01-01 00:00:00 UTC"},
+		"log_client": {"10.0.0.1"},
+		"log_url":    {"http://origin.example.com/x"},
+	})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %q", resp.Status)
+	}
+	var got struct {
+		Rule string `json:"rule"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	var comment string
+	if err := db.QueryRow(`SELECT comment FROM rules WHERE rule_id=?`, got.Rule).Scan(&comment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(comment, "10.0.0.1 requested http://origin.example.com/x") {
+		t.Errorf("got comment %q", comment)
+	}
+	o, err := getRuleOrigin(ruleID(got.Rule), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o == nil || o.Client != "10.0.0.1" || o.Time != 1451606400 {
+		t.Errorf("got origin %+v", o)
+	}
+}
+
+func TestServerArchiveACL(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	id := newTestACL(t, c, s, token, "retired acl")
+
+	resp := postForm(t, c, s.URL+"/acl/"+id+"/archive", token, url.Values{"archived": {"true"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("archive: got status %q", resp.Status)
+	}
+	acls, err := getACLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range acls {
+		if string(a.ACLID) == id {
+			t.Errorf("archived ACL %s still listed", id)
+		}
+	}
+	resp = postForm(t, c, s.URL+"/acl/"+id, token, url.Values{"comment": {"renamed"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("rename archived: got status %q, want 409", resp.Status)
+	}
+	resp = postForm(t, c, s.URL+"/rule/new", token, url.Values{"type": {"domain"}, "value": {".example.com"}, "action": {"allow"}, "acl": {id}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("new rule in archived: got status %q, want 409", resp.Status)
+	}
+
+	resp = postForm(t, c, s.URL+"/acl/"+id+"/archive", token, url.Values{"archived": {"false"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unarchive: got status %q", resp.Status)
+	}
+	resp = postForm(t, c, s.URL+"/acl/"+id, token, url.Values{"comment": {"renamed"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("rename unarchived: got status %q", resp.Status)
+	}
+}
+
+func TestServerDeleteACLConfirm(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	id := newTestACL(t, c, s, token, "doomed acl")
+
+	resp := sendForm(t, c, "DELETE", s.URL+"/acl/"+id, token, url.Values{})
+	var got struct {
+		Error struct {
+			Code    string       `json:"code"`
+			Details deleteImpact `json:"details"`
+		} `json:"error"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPreconditionRequired || got.Error.Code != "confirm_required" {
+		t.Fatalf("unconfirmed delete: got status %q, code %q", resp.Status, got.Error.Code)
+	}
+	im := got.Error.Details
+	if im.Kind != "acl" || im.ID != id || im.Name != "doomed acl" || im.Confirm == "" {
+		t.Fatalf("got impact %+v", im)
+	}
+
+	resp = sendForm(t, c, "DELETE", s.URL+"/acl/"+id+"?confirm=bogus", token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("bad token: got status %q", resp.Status)
+	}
+	resp = sendForm(t, c, "DELETE", s.URL+"/acl/"+id+"?confirm="+im.Confirm, token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("confirmed delete: got status %q", resp.Status)
+	}
+}
+
+func TestServerIdempotencyKey(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	newACL := func(comment string) (int, string) {
+		req, err := http.NewRequest("POST", s.URL+"/acl/new", strings.NewReader(url.Values{"comment": {comment}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		req.Header.Set("X-CSRF-Token", token)
+		req.Header.Set("Idempotency-Key", "retry-1")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var got struct {
+			ACL string `json:"acl"`
+		}
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got.ACL
+	}
+	code, first := newACL("once")
+	if code != http.StatusOK || first == "" {
+		t.Fatalf("first: got status %d, ACL %q", code, first)
+	}
+	code, second := newACL("once")
+	if code != http.StatusOK || second != first {
+		t.Errorf("retry: got status %d, ACL %q, want %q", code, second, first)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM acls WHERE comment='once'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d ACLs, want 1", n)
+	}
+	if code, _ := newACL("twice"); code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key: got status %d, want 422", code)
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	batch := func(ops string) (*http.Response, []batchResult) {
+		resp := postForm(t, c, s.URL+"/batch", token, url.Values{"ops": {ops}})
+		defer resp.Body.Close()
+		var got struct {
+			Results []batchResult `json:"results"`
+		}
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp, got.Results
+	}
+
+	resp, res := batch(`[
+  {"op": "acl.create", "comment": "batch acl"},
+  {"op": "rule.create", "acl": "$0", "type": "domain", "value": ".batch.example.com", "action": "allow"},
+  {"op": "group.create", "comment": "batch group"},
+  {"op": "access.grant", "group": "$2", "acl": "$0"}
+]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %q", resp.Status)
+	}
+	if len(res) != 4 || res[0].ID == "" || res[1].ID == "" || res[3].Updated != 1 {
+		t.Fatalf("got results %+v", res)
+	}
+
+	// The duplicate rule fails, so the ACL isn't created either.
+	resp, _ = batch(`[
+  {"op": "acl.create", "comment": "half acl"},
+  {"op": "rule.create", "acl": "$0", "type": "domain", "value": ".batch.example.com", "action": "allow"}
+]`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate: got status %q", resp.Status)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM acls WHERE comment='half acl'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("half applied batch left %d ACLs", n)
+	}
+}
+
+func TestServerWhyPage(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.WhyPage = false
+	resp, err := http.Get(s.URL + "/why")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("disabled: got status %q", resp.Status)
+	}
+
+	serverOpts.WhyPage = true
+	resp, err = http.Get(s.URL + "/why?url=" + url.QueryEscape("http://nothing.example.com/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %q", resp.Status)
+	}
+	if !strings.Contains(string(b), "<h2>Blocked</h2>") {
+		t.Errorf("not shown as blocked: %s", b)
+	}
+}
+
+func TestServerFreeze(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	resp := postForm(t, c, s.URL+"/freeze/new", token, url.Values{"duration": {"1h"}, "reason": {"release"}})
+	var got struct {
+		Freeze string `json:"freeze"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("new freeze: got status %q", resp.Status)
+	}
+
+	resp = postForm(t, c, s.URL+"/acl/new", token, url.Values{"comment": {"frozen"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLocked {
+		t.Errorf("during freeze: got status %q, want 423", resp.Status)
+	}
+
+	req, err := http.NewRequest("POST", s.URL+"/acl/new", strings.NewReader(url.Values{"comment": {"glass"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("X-CSRF-Token", token)
+	req.Header.Set("X-Break-Glass", "outage")
+	if resp, err = c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("break glass: got status %q", resp.Status)
+	}
+
+	resp = sendForm(t, c, "DELETE", s.URL+"/freeze/"+got.Freeze, token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("end freeze: got status %q", resp.Status)
+	}
+	newTestACL(t, c, s, token, "thawed")
+}
+
+func TestServerJobs(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	newJob := func() string {
+		resp := postForm(t, c, s.URL+"/jobs/new", token, url.Values{"kind": {jobConfigApply}})
+		var got struct {
+			Job string `json:"job"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("new job: got status %q", resp.Status)
+		}
+		return got.Job
+	}
+	id := newJob()
+	if again := newJob(); again != id {
+		t.Errorf("Queued twice: %q and %q", id, again)
+	}
+
+	// No -squid_conf, so it fails, and is retried after a backoff.
+	now := time.Now()
+	if ran, err := runNextJob(now); err != nil || !ran {
+		t.Fatalf("runNextJob: %v %v", ran, err)
+	}
+	var state, msg string
+	var attempts int
+	if err := db.QueryRow(`SELECT state, attempts, error FROM jobs WHERE job_id=?`, id).Scan(&state, &attempts, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if state != jobQueued || attempts != 1 || !strings.Contains(msg, "-squid_conf") {
+		t.Errorf("After first attempt: state %q, attempts %d, error %q", state, attempts, msg)
+	}
+	if ran, err := runNextJob(now); err != nil || ran {
+		t.Fatalf("Ran before backoff: %v %v", ran, err)
+	}
+	if _, err := db.Exec(`UPDATE jobs SET attempts=max_attempts-1 WHERE job_id=?`, id); err != nil {
+		t.Fatal(err)
+	}
+	if ran, err := runNextJob(now.Add(jobMaxBackoff)); err != nil || !ran {
+		t.Fatalf("runNextJob: %v %v", ran, err)
+	}
+	if err := db.QueryRow(`SELECT state FROM jobs WHERE job_id=?`, id).Scan(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state != jobFailed {
+		t.Errorf("After last attempt: state %q, want %q", state, jobFailed)
+	}
+
+	resp := postForm(t, c, s.URL+"/jobs/"+id+"/retry", token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("retry: got status %q", resp.Status)
+	}
+	resp = postForm(t, c, s.URL+"/jobs/"+id+"/retry", token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("retry queued job: got status %q, want 409", resp.Status)
+	}
+
+	resp = postForm(t, c, s.URL+"/jobs/new", token, url.Values{"kind": {jobListSync}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("list sync by hand: got status %q, want 400", resp.Status)
+	}
+
+	resp, err := c.Get(s.URL + "/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("jobs page: got status %q", resp.Status)
+	}
+}
+
+func TestServerAPIToken(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	resp := postForm(t, c, s.URL+"/tokens/new", token, url.Values{"name": {"ci"}, "permission": {"write"}})
+	var got struct {
+		Token string `json:"token"`
+		ID    string `json:"id"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("new token: got status %q", resp.Status)
+	}
+
+	// Like curl: no cookies, CSRF token or X-Requested-With.
+	apiPost := func(bearer string) *http.Response {
+		req, err := http.NewRequest("POST", s.URL+"/acl/new", strings.NewReader(url.Values{"comment": {"from script"}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := apiPost(got.Token); resp.StatusCode != http.StatusOK {
+		t.Errorf("with token: got status %q", resp.Status)
+	}
+	var actor string
+	if err := db.QueryRow(`SELECT actor FROM changelog ORDER BY time DESC, rowid DESC LIMIT 1`).Scan(&actor); err != nil {
+		t.Fatal(err)
+	}
+	if want := "token:ci"; actor != want {
+		t.Errorf("got actor %q, want %q", actor, want)
+	}
+	if resp := apiPost("swt_wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token: got status %q, want 401", resp.Status)
+	}
+	if resp := apiPost(""); resp.StatusCode == http.StatusOK {
+		t.Errorf("no token: got status %q", resp.Status)
+	}
+
+	// Basic auth is the web server's, and passes through.
+	req, err := http.NewRequest("GET", s.URL+"/acl/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("ranger", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("basic auth: got status %q", resp.Status)
+	}
+
+	resp = sendForm(t, c, "DELETE", s.URL+"/tokens/"+got.ID, token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: got status %q", resp.Status)
+	}
+	if resp := apiPost(got.Token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked token: got status %q, want 401", resp.Status)
+	}
+}
+
+func TestServerJSONBody(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	post := func(u, body string) *http.Response {
+		req, err := http.NewRequest("POST", s.URL+u, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		req.Header.Set("X-CSRF-Token", token)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := post("/acl/new", `{"comment": "from JSON"}`)
+	var got struct {
+		ACL string `json:"acl"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("new ACL: got status %q", resp.Status)
+	}
+	var comment string
+	if err := db.QueryRow(`SELECT comment FROM acls WHERE acl_id=?`, got.ACL).Scan(&comment); err != nil {
+		t.Fatal(err)
+	}
+	if want := "from JSON"; comment != want {
+		t.Errorf("got comment %q, want %q", comment, want)
+	}
+
+	resp = post("/acl/new", `{"comment": `)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad JSON: got status %q, want 400", resp.Status)
+	}
+}
+
+func TestServerRuleHistory(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	resp := postForm(t, c, s.URL+"/rule/new", token, url.Values{
+		"type":   {"domain"},
+		"value":  {"history.example.com"},
+		"action": {"allow"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("/rule/new: got status %q", resp.Status)
+	}
+	var rule struct {
+		Rule string `json:"rule"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&rule)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		u string
+		v url.Values
+	}{
+		{"/rule/" + rule.Rule, url.Values{"type": {"domain"}, "value": {"history.example.com"}, "action": {"block"}, "comment": {"ticket 1"}}},
+		{"/rule/" + rule.Rule, url.Values{"type": {"domain"}, "value": {"history.example.com"}, "action": {"block"}, "comment": {"ticket 1"}}},
+		{"/rule/" + rule.Rule + "/enabled", url.Values{"enabled": {"false"}}},
+	} {
+		resp := postForm(t, c, s.URL+e.u, token, e.v)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %q", e.u, resp.Status)
+		}
+	}
+
+	resp = sendForm(t, c, "GET", s.URL+"/rule/"+rule.Rule+"/history.json", token, url.Values{})
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("history.json: got status %q", resp.Status)
+	}
+	var got struct {
+		Edits []ruleEdit `json:"edits"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second save changed nothing, so isn't shown.
+	if len(got.Edits) != 2 {
+		t.Fatalf("got %d edits, want 2: %+v", len(got.Edits), got.Edits)
+	}
+	if e := got.Edits[0]; !reflect.DeepEqual(e.Changed, []string{"enabled"}) || !e.From.Enabled || e.To.Enabled {
+		t.Errorf("newest edit: got %+v", e)
+	}
+	if e := got.Edits[1]; !reflect.DeepEqual(e.Changed, []string{"action", "comment"}) || e.From.Action != "allow" || e.To.Action != "block" || e.To.Comment != "ticket 1" {
+		t.Errorf("oldest edit: got %+v", e)
+	}
+
+	resp = postForm(t, c, s.URL+"/rule/delete", token, url.Values{"rules[]": {rule.Rule}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: got status %q", resp.Status)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM rulehistory WHERE rule_id=?`, rule.Rule).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("got %d history rows after delete, want 0", n)
+	}
+}
+
+func TestServerDigestSubscription(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	resp := postForm(t, c, s.URL+"/digest/subscribe", token, url.Values{"email": {"Someone <x@example.com>"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("named address: got status %q, want 400", resp.Status)
+	}
+	resp = postForm(t, c, s.URL+"/digest/subscribe", token, url.Values{"email": {" admin@example.com "}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("subscribe: got status %q", resp.Status)
+	}
+	subs, err := getDigestSubscriptions(time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].Email != "admin@example.com" {
+		t.Errorf("got subscriptions %+v", subs)
+	}
+
+	resp = sendForm(t, c, "DELETE", s.URL+"/digest/subscribe", token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unsubscribe: got status %q", resp.Status)
+	}
+	if subs, err = getDigestSubscriptions(time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 0 {
+		t.Errorf("got subscriptions %+v after unsubscribing", subs)
+	}
+}
+
+func TestServerTimeZone(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer loadTimeZones()
+	c, token := newTestClient(t, s)
+	newTestACL(t, c, s, token, "zoned")
+
+	// changeTime returns the time of the newest change, as shown.
+	changeTime := func() string {
+		resp := getJSON(t, c, s.URL+"/dashboard.json?limit=1")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("dashboard.json: got status %q", resp.Status)
+		}
+		var got dashboard
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Changes) != 1 {
+			t.Fatalf("got %d changes, want 1", len(got.Changes))
+		}
+		return got.Changes[0].Time
+	}
+	if got := changeTime(); !strings.HasSuffix(got, " UTC") {
+		t.Errorf("default: got %q, want UTC", got)
+	}
+
+	resp := postForm(t, c, s.URL+"/preferences/timezone", token, url.Values{"zone": {"Mars/Olympus"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown zone: got status %q, want 400", resp.Status)
+	}
+	resp = postForm(t, c, s.URL+"/config/timezone", token, url.Values{"zone": {"Asia/Tokyo"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("deployment zone: got status %q", resp.Status)
+	}
+	if got := changeTime(); !strings.HasSuffix(got, " JST") {
+		t.Errorf("deployment zone: got %q, want JST", got)
+	}
+	resp = postForm(t, c, s.URL+"/preferences/timezone", token, url.Values{"zone": {"America/Sao_Paulo"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("user zone: got status %q", resp.Status)
+	}
+	if got := changeTime(); !strings.HasSuffix(got, " -03") {
+		t.Errorf("user zone: got %q, want -03", got)
+	}
+	resp = postForm(t, c, s.URL+"/preferences/timezone", token, url.Values{"zone": {""}})
+	resp.Body.Close()
+	if got := changeTime(); !strings.HasSuffix(got, " JST") {
+		t.Errorf("user zone cleared: got %q, want JST", got)
+	}
+
+	// Zones survive a restart.
+	loadTimeZones()
+	if got := displayZone().String(); got != "Asia/Tokyo" {
+		t.Errorf("after reload: got deployment zone %q", got)
+	}
+}
+
+func TestServerDashboardStats(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	p := policy.New()
+	if err := p.AddRule("r1", "domain", "blocked.example.com", "block"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddGrant("127.0.0.0/8", policy.Grant{Group: "friends", ACL: "sfw", Rule: "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	entries := []trafficEntry{
+		// In friends and noc.
+		{time: hour.Unix() + 60, client: "127.0.0.1", method: "GET", url: "http://blocked.example.com/", host: "blocked.example.com", bytes: 10, denied: true},
+		// In friends.
+		{time: hour.Unix() + 120, client: "127.0.0.2", method: "GET", url: "http://other.example.com/", host: "other.example.com", bytes: 20, denied: true},
+		// In no group.
+		{time: hour.Unix() + 3600, client: "200.0.0.1", method: "GET", url: "http://ok.example.com/", host: "ok.example.com", bytes: 30},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addDashboardStats(tx, p, entries); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(u string, v interface{}) {
+		resp, err := http.Get(s.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %q", u, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rng := fmt.Sprintf("?from=%d&to=%s", hour.Unix()*1000, url.QueryEscape(hour.Add(2*time.Hour).Format(time.RFC3339)))
+	var denials []aclDenialsRecord
+	get("/stats/acl-denials"+rng, &denials)
+	wantDenials := []aclDenialsRecord{
+		{Time: "2020-06-15T12:00:00Z", ACLID: "", Denied: 1},
+		{Time: "2020-06-15T12:00:00Z", ACLID: "sfw", Denied: 1},
+	}
+	if !reflect.DeepEqual(denials, wantDenials) {
+		t.Errorf("got denials %+v, want %+v", denials, wantDenials)
+	}
+
+	var traffic []groupTrafficRecord
+	get("/stats/group-traffic"+rng, &traffic)
+	want := []groupTrafficRecord{
+		{Time: "2020-06-15T12:00:00Z", GroupID: "friends", Requests: 2, Denied: 2, Bytes: 30},
+		{Time: "2020-06-15T12:00:00Z", GroupID: "noc", Requests: 1, Denied: 1, Bytes: 10},
+		{Time: "2020-06-15T13:00:00Z", GroupID: "", Requests: 1, Bytes: 30},
+	}
+	if !reflect.DeepEqual(traffic, want) {
+		t.Errorf("got traffic %+v, want %+v", traffic, want)
+	}
+
+	// Outside the range.
+	get("/stats/group-traffic?from=0&to=1000", &traffic)
+	if len(traffic) != 0 {
+		t.Errorf("got %+v outside the range", traffic)
+	}
+}
+
+func TestServerChangeLogRange(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	now := time.Now()
+	for _, c := range []struct {
+		ago     time.Duration
+		summary string
+	}{
+		{48 * time.Hour, "old"},
+		{2 * time.Hour, "recent"},
+		{time.Minute, "new"},
+	} {
+		if _, err := db.Exec(`INSERT INTO changelog(time, actor, entity, entity_id, summary) VALUES(?,?,?,?,?)`, now.Add(-c.ago).Unix(), "ranger", "acl", "", c.summary); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"new", "recent", "old"}},
+		{"from=-24h", []string{"new", "recent"}},
+		{"from=-24h&to=-1h", []string{"recent"}},
+		{"to=" + url.QueryEscape(now.Add(-24*time.Hour).Format(time.RFC3339)), []string{"old"}},
+		{"limit=1", []string{"new"}},
+	} {
+		resp, err := http.Get(s.URL + "/log/changes?actor=ranger&" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []change
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		var summaries []string
+		for _, c := range got {
+			summaries = append(summaries, c.Summary)
+		}
+		if !reflect.DeepEqual(summaries, test.want) {
+			t.Errorf("%q: got %q, want %q", test.query, summaries, test.want)
+		}
+	}
+
+	for _, u := range []string{
+		"/log/changes?from=yesterday",
+		"/log/changes?from=-1h&to=-2h",
+		"/log/search?from=yesterday",
+		"/stats/traffic?to=bad",
+		"/ajax/tail-log?from=bad",
+		"/ajax/tail-log/page?to=bad",
+	} {
+		resp, err := http.Get(s.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %q, want 400", u, resp.Status)
+		}
+	}
+}
+
+func TestServerTailCount(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	f, err := ioutil.TempFile("", "squidwarden-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(f, "%d 10 10.0.0.%d TCP_DENIED/403 100 GET http://example.com/ - HIER_NONE/- text/html\n", 1451606400+i, i)
+	}
+	defer func(fn string) { serverOpts.SquidLog = fn }(serverOpts.SquidLog)
+	serverOpts.SquidLog = f.Name()
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.TailMaxLines = 3
+
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"count=2", []string{"10.0.0.5", "10.0.0.4"}},
+		{"count=100", []string{"10.0.0.5", "10.0.0.4", "10.0.0.3"}},
+		{"count=0", nil},
+		{"", []string{"10.0.0.5", "10.0.0.4", "10.0.0.3"}},
+	} {
+		resp, err := http.Get(s.URL + "/ajax/tail-log?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []squidlog.Entry
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Client)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.query, got, test.want)
+		}
+	}
+
+	for _, u := range []string{"/ajax/tail-log?count=-1", "/ajax/tail-log?count=lots", "/ajax/tail-log/page?group=host"} {
+		resp := getJSON(t, http.DefaultClient, s.URL+u)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %q, want 400", u, resp.Status)
+		}
+	}
+
+	// A second apart, so it's all one burst.
+	resp := getJSON(t, http.DefaultClient, s.URL+"/ajax/tail-log/page?group=domain")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("tail page: got status %q", resp.Status)
+	}
+	var page tailPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || len(page.Entries[0].Grouped) != 4 {
+		t.Errorf("Got %+v, want one burst of 5", page.Entries)
+	}
+}
+
+func TestServerIgnoreList(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { ignores.set = nil }()
+	c, token := newTestClient(t, s)
+
+	var ids []string
+	for _, v := range []url.Values{
+		{"kind": {"domain"}, "value": {"*.Telemetry.example.com"}, "comment": {"phones home"}},
+		{"kind": {"client"}, "value": {"10.0.0.0/24"}},
+	} {
+		resp := postForm(t, c, s.URL+"/ignore/new", token, v)
+		var got struct {
+			Ignore string `json:"ignore"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: got status %q", v, resp.Status)
+		}
+		ids = append(ids, got.Ignore)
+	}
+	for _, v := range []url.Values{
+		{"kind": {"domain"}, "value": {"telemetry.example.com"}}, // Already there.
+		{"kind": {"client"}, "value": {"not an address"}},
+		{"kind": {"host"}, "value": {"example.com"}},
+	} {
+		resp := postForm(t, c, s.URL+"/ignore/new", token, v)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 4 {
+			t.Errorf("%v: got status %q, want 4xx", v, resp.Status)
+		}
+	}
+
+	resp := getJSON(t, c, s.URL+"/ignore.json")
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("ignore.json: got status %q", resp.Status)
+	}
+	var list []ignoreEntry
+	err := json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, e := range list {
+		values = append(values, e.Kind+" "+e.Value)
+	}
+	if want := []string{"domain telemetry.example.com", "client 10.0.0.0/24"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("Got %q, want %q", values, want)
+	}
+
+	// Hidden from the review queue, but still in the database.
+	for _, h := range []string{"eu.telemetry.example.com", "www.example.com"} {
+		if _, err := db.Exec(`INSERT INTO reviewqueue(host, type, hits, first_seen, last_seen) VALUES(?,'domain',1,0,0)`, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue := func() []string {
+		entries, err := getReviewQueue(time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, e := range entries {
+			ret = append(ret, e.Host)
+		}
+		return ret
+	}
+	if got, want := queue(), []string{"www.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Review queue: got %q, want %q", got, want)
+	}
+
+	// And from the tail.
+	f, err := ioutil.TempFile("", "squidwarden-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	for _, l := range []string{
+		"1451606401 10 10.0.1.1 TCP_DENIED/403 100 GET http://www.example.com/ - HIER_NONE/- text/html",
+		"1451606402 10 10.0.1.1 TCP_DENIED/403 100 GET http://eu.telemetry.example.com/ - HIER_NONE/- text/html",
+		"1451606403 10 10.0.0.9 TCP_DENIED/403 100 GET http://www.example.com/ - HIER_NONE/- text/html",
+	} {
+		fmt.Fprintln(f, l)
+	}
+	defer func(fn string) { serverOpts.SquidLog = fn }(serverOpts.SquidLog)
+	serverOpts.SquidLog = f.Name()
+	resp = getJSON(t, c, s.URL+"/ajax/tail-log/page")
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("tail page: got status %q", resp.Status)
+	}
+	var page tailPage
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Host != "www.example.com" || page.Entries[0].Client != "10.0.1.1" {
+		t.Errorf("Tail: got %+v, want just www.example.com from 10.0.1.1", page.Entries)
+	}
+
+	for _, id := range ids {
+		resp := sendForm(t, c, "DELETE", s.URL+"/ignore/"+id, token, url.Values{})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("delete: got status %q", resp.Status)
+		}
+	}
+	if got := queue(); len(got) != 2 {
+		t.Errorf("Review queue after deleting: got %q, want both", got)
+	}
+}
+
+func TestServerSiteInfo(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.SiteInfo = false
+
+	// A 1x1 PNG.
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+	if _, err := db.Exec(`INSERT INTO siteinfo(domain, title, icon, icon_type, fetched, error) VALUES('example.com', 'Example', ?, 'image/png', ?, '')`, png, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		domain string
+		want   siteInfo
+	}{
+		{"www.example.com", siteInfo{Domain: "example.com", Title: "Example", Icon: "/site/example.com/favicon", Offline: true}},
+		// Not cached, and offline, so not fetched.
+		{".example.org", siteInfo{Domain: "example.org", Offline: true}},
+	} {
+		resp := getJSON(t, http.DefaultClient, s.URL+"/site/"+test.domain+"/info.json")
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("%s: got status %q", test.domain, resp.Status)
+		}
+		var got siteInfo
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Fetched = ""
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.domain, got, test.want)
+		}
+	}
+
+	resp, err := http.Get(s.URL + "/site/example.com/favicon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(b, png) {
+		t.Errorf("Favicon: got %q %q %q", resp.Status, resp.Header.Get("Content-Type"), b)
+	}
+
+	for _, test := range []struct {
+		path string
+		code int
+	}{
+		{"/site/example.org/favicon", http.StatusNotFound},
+		{"/site/10.0.0.1/info.json", http.StatusBadRequest},
+	} {
+		resp := getJSON(t, http.DefaultClient, s.URL+test.path)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s: got status %q, want %d", test.path, resp.Status, test.code)
+		}
+	}
+}
+
+func TestServerReport(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	a := newTestACL(t, c, s, token, "reported")
+	resp := postForm(t, c, s.URL+"/acl/"+a+"/owner", token, url.Values{"owner": {"Security"}, "contact": {"sec@example.com"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Setting owner: %q", resp.Status)
+	}
+
+	resp, err := c.Get(s.URL + "/report?download=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %q", resp.Status)
+	}
+	if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, `attachment; filename="squidwarden-policy-`) {
+		t.Errorf("Got Content-Disposition %q", got)
+	}
+	for _, want := range []string{
+		"<h3>friends</h3>",
+		"127.0.0.0/8",
+		"<h3>reported</h3>",
+		"Security &lt;sec@example.com&gt;",
+		".unencrypted.habets.se",
+		// Downloads are read away from the UI, so have their style inline.
+		"page-break-inside: avoid;",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Report doesn't contain %q", want)
+		}
+	}
+
+	// Shown in the UI, where the CSP doesn't allow inline style.
+	resp, err = c.Get(s.URL + "/report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "<style>") || !strings.Contains(string(b), `href="/static/report.css"`) {
+		t.Errorf("Report shown in the UI doesn't link its style:\n%s", b)
+	}
+}
+
+func TestServerSnapshots(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	a := newTestACL(t, c, s, token, "before")
+
+	take := func(name string) snapshot {
+		resp := postForm(t, c, s.URL+"/snapshots/new", token, url.Values{"name": {name}, "comment": {"audit"}})
+		var got snapshot
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Taking %q: got status %q", name, resp.Status)
+		}
+		return got
+	}
+	snap := take("2024-Q3-audit")
+	for _, name := range []string{"2024-Q3-audit", "bad name", ""} {
+		resp := postForm(t, c, s.URL+"/snapshots/new", token, url.Values{"name": {name}})
+		resp.Body.Close()
+		if resp.StatusCode/100 != 4 {
+			t.Errorf("%q: got status %q, want 4xx", name, resp.Status)
+		}
+	}
+	if _, err := db.Exec(`UPDATE snapshots SET name='changed'`); err == nil {
+		t.Error("Changed a snapshot")
+	}
+
+	resp := postForm(t, c, s.URL+"/acl/"+a, token, url.Values{"comment": {"after"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Renaming ACL: %q", resp.Status)
+	}
+
+	getDiff := func(to string) []string {
+		resp := getJSON(t, c, s.URL+"/snapshot/"+string(snap.SnapshotID)+"/diff.json?to="+to)
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("Diff to %q: got status %q", to, resp.Status)
+		}
+		var d struct {
+			Changes []snapshotChange `json:"changes"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&d)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, ch := range d.Changes {
+			ret = append(ret, fmt.Sprintf("%s %s %s %v", ch.Table, ch.Key, ch.Change, ch.New["comment"]))
+		}
+		return ret
+	}
+	if got, want := getDiff("current"), []string{"acls " + a + " changed after"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff: got %q, want %q", got, want)
+	}
+
+	resp, err := c.Get(s.URL + "/snapshot/" + string(snap.SnapshotID) + "/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&recs)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != snap.Records {
+		t.Errorf("Export: got %d records, want %d", len(recs), snap.Records)
+	}
+
+	resp = postForm(t, c, s.URL+"/snapshot/"+string(snap.SnapshotID)+"/restore", token, url.Values{})
+	var restored struct {
+		Backup string `json:"backup"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&restored)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Restore: got status %q", resp.Status)
+	}
+	var comment string
+	if err := db.QueryRow(`SELECT comment FROM acls WHERE acl_id=?`, a).Scan(&comment); err != nil {
+		t.Fatal(err)
+	}
+	if comment != "before" {
+		t.Errorf("Restored ACL comment %q, want %q", comment, "before")
+	}
+	if got := getDiff("current"); len(got) != 0 {
+		t.Errorf("Diff after restore: got %q", got)
+	}
+	// The backup taken before restoring has the rename.
+	if got, want := getDiff(restored.Backup), []string{"acls " + a + " changed after"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff with backup: got %q, want %q", got, want)
+	}
+}
+
+func TestServerSnapshotImport(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	newTestACL(t, c, s, token, "prod")
+	resp := postForm(t, c, s.URL+"/snapshots/new", token, url.Values{"name": {"prod"}})
+	var snap snapshot
+	err := json.NewDecoder(resp.Body).Decode(&snap)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var access, rules int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM groupaccess), (SELECT COUNT(*) FROM rules)`).Scan(&access, &rules); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = postForm(t, c, s.URL+"/snapshots/import", token, url.Values{"snapshot": {string(snap.SnapshotID)}, "suffix": {"-staging"}})
+	var got struct {
+		ACLs []importedACL `json:"acls"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Import: got status %q", resp.Status)
+	}
+	byName := make(map[string]importedACL)
+	for _, a := range got.ACLs {
+		byName[a.Name] = a
+	}
+	if a, ok := byName["prod-staging"]; !ok || a.Rules != 0 {
+		t.Errorf("prod-staging: got %+v", a)
+	}
+	if a := byName["sfw-staging"]; a.From != "sfw" || a.Rules == 0 || a.NewRules != 0 {
+		t.Errorf("Copy of sfw: got %+v, want its rules shared", a)
+	}
+
+	// Nothing live changed.
+	var access2, rules2 int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM groupaccess), (SELECT COUNT(*) FROM rules)`).Scan(&access2, &rules2); err != nil {
+		t.Fatal(err)
+	}
+	if access2 != access || rules2 != rules {
+		t.Errorf("Got %d grants and %d rules, want %d and %d", access2, rules2, access, rules)
+	}
+
+	for _, v := range []url.Values{
+		{"snapshot": {string(snap.SnapshotID)}, "suffix": {"-staging"}}, // Names taken.
+		{"data": {"not json"}, "suffix": {"-x"}},
+		{"suffix": {"-x"}},
+	} {
+		resp := postForm(t, c, s.URL+"/snapshots/import", token, v)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 4 {
+			t.Errorf("%v: got status %q, want 4xx", v, resp.Status)
+		}
+	}
+
+	// An export from elsewhere, with a rule that isn't here.
+	data := `[
+{"table": "acls", "acl_id": "x1", "comment": "remote", "enabled": 1},
+{"table": "rules", "rule_id": "xr1", "type": "domain", "value": ".remote.example.com", "action": "allow", "comment": null, "enabled": 1},
+{"table": "aclrules", "acl_id": "x1", "rule_id": "xr1", "comment": null}
+]`
+	resp = postForm(t, c, s.URL+"/snapshots/import", token, url.Values{"data": {data}, "suffix": {" (remote)"}})
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ACLs) != 1 || got.ACLs[0].Name != "remote (remote)" || got.ACLs[0].NewRules != 1 {
+		t.Errorf("Import of export: got %+v", got.ACLs)
+	}
+}
+
+func TestServerReputation(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	resp := getJSON(t, http.DefaultClient, s.URL+"/site/example.com/reputation.json")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("No sources: got status %q, want 404", resp.Status)
+	}
+
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "reputation.txt")
+	if err := ioutil.WriteFile(fn, []byte("example.com 20\nbad.example.com 90 phishing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var apiCalls int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiCalls++
+		if got := r.Header.Get("X-Api-Key"); got != "secret" {
+			t.Errorf("API key: got %q", got)
+		}
+		switch r.URL.Query().Get("d") {
+		case "www.example.com":
+			fmt.Fprintf(w, `{"score": 45, "label": "new domain"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.ReputationList, serverOpts.ReputationAPI, serverOpts.ReputationAPIHeader = fn, api.URL+"/?d={domain}", "X-Api-Key: secret"
+	reputations.checked = time.Time{}
+
+	for _, test := range []struct {
+		host string
+		want reputation
+	}{
+		{"www.example.com", reputation{Host: "www.example.com", Score: 45, Level: "medium", Sources: []reputationScore{
+			{Source: "list", Score: 20},
+			{Source: "api", Score: 45, Label: "new domain"},
+		}}},
+		// Cached this time.
+		{"www.example.com", reputation{Host: "www.example.com", Score: 45, Level: "medium", Sources: []reputationScore{
+			{Source: "list", Score: 20},
+			{Source: "api", Score: 45, Label: "new domain"},
+		}}},
+		{"x.bad.example.com", reputation{Host: "x.bad.example.com", Score: 90, Level: "high", Sources: []reputationScore{
+			{Source: "list", Score: 90, Label: "phishing"},
+		}}},
+		{"example.org", reputation{Host: "example.org", Score: -1, Level: "unknown", Sources: []reputationScore{}}},
+	} {
+		resp := getJSON(t, http.DefaultClient, s.URL+"/site/"+test.host+"/reputation.json")
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("%s: got status %q", test.host, resp.Status)
+		}
+		var got reputation
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.host, got, test.want)
+		}
+	}
+	if want := 3; apiCalls != want {
+		t.Errorf("Got %d API calls, want %d", apiCalls, want)
+	}
+}
+
+func TestServerLogIngester(t *testing.T) {
+	_, done := newTestServer(t)
+	defer done()
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "access-1.log")
+	line := func(n int) string {
+		return fmt.Sprintf("1592224200.%03d 10 127.0.0.1 TCP_MISS/200 100 GET http://example.com/%d - HIER_DIRECT/1.2.3.4 text/html\n", n, n)
+	}
+	appendLines := func(lines ...string) {
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for _, l := range lines {
+			if _, err := f.WriteString(l); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var got []string
+	newIngester := func() *logIngester {
+		return newLogIngester("test", func(e *squidlog.Entry) { got = append(got, e.Path) })
+	}
+	followOnce := func(g *logIngester, off logOffset) logOffset {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return g.followOnce(f, off)
+	}
+	checkpoint := func(g *logIngester) {
+		offsets := g.checkpoint(func() {})
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := g.saveOffsets(tx, offsets); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(what string, want ...string) {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", what, got, want)
+		}
+		got = nil
+	}
+
+	// Starts at the end the first time, and skips duplicates.
+	appendLines(line(1))
+	g := newIngester()
+	if off := g.loadOffset(fn); off.pos != -1 {
+		t.Fatalf("Got offset %+v before any checkpoint", off)
+	}
+	off := followOnce(g, g.loadOffset(fn))
+	appendLines(line(2), line(3), line(2))
+	off = followOnce(g, off)
+	check("first run", "/2", "/3")
+	checkpoint(g)
+
+	// Picks up where the checkpoint left off after a restart.
+	appendLines(line(4))
+	g = newIngester()
+	followOnce(g, g.loadOffset(fn))
+	check("after restart", "/4")
+	checkpoint(g)
+
+	// Reads a rotated log from the start.
+	if err := os.Rename(fn, fn+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(line(5), line(6), line(7), line(8), line(9))
+	g = newIngester()
+	followOnce(g, g.loadOffset(fn))
+	check("after rotation", "/5", "/6", "/7", "/8", "/9")
+}
+
+func TestServerPromotion(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	// Staging has an ACL more, and no members.
+	cur, err := currentConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var staging []snapshotRecord
+	for _, rec := range cur {
+		if recString(rec, "table") != "members" {
+			staging = append(staging, rec)
+		}
+	}
+	staging = append(staging, snapshotRecord{"table": "acls", "acl_id": "staged", "comment": "staged", "enabled": 1})
+	stagingData, err := json.Marshal(staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := path.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/export.json" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write(stagingData)
+	}))
+	defer src.Close()
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.PromoteFrom, serverOpts.PromoteFromToken = src.URL, tokenFile
+
+	resp := postForm(t, c, s.URL+"/promotions/pull", token, url.Values{})
+	var p promotion
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.State != promotionPending || p.Records != len(staging) || p.Source != src.URL {
+		t.Fatalf("Pull: got %+v", p)
+	}
+
+	var diff struct {
+		Revision int64            `json:"revision"`
+		Changes  []snapshotChange `json:"changes"`
+		Problems []string         `json:"problems"`
+	}
+	resp = getJSON(t, http.DefaultClient, s.URL+"/promotion/"+string(p.PromotionID)+"/diff.json")
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("Diff: got status %q", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&diff)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Members aren't promoted, so not removing them isn't a change.
+	if len(diff.Changes) != 1 || diff.Changes[0].Table != "acls" || diff.Changes[0].Change != snapshotAdded || len(diff.Problems) != 0 {
+		t.Errorf("Diff: got %+v", diff)
+	}
+
+	approve := func(rev int64) int {
+		resp := postForm(t, c, s.URL+"/promotion/"+string(p.PromotionID)+"/approve", token, url.Values{"revision": {fmt.Sprint(rev)}})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := approve(diff.Revision); got != http.StatusForbidden {
+		t.Errorf("Approving own promotion: got status %d, want 403", got)
+	}
+	serverOpts.PromoteSelfApprove = true
+	if got := approve(diff.Revision - 1); got != http.StatusConflict {
+		t.Errorf("Approving old revision: got status %d, want 409", got)
+	}
+	if got := approve(diff.Revision); got != http.StatusOK {
+		t.Fatalf("Approving: got status %d", got)
+	}
+	if got := approve(diff.Revision + 1); got != http.StatusConflict {
+		t.Errorf("Approving again: got status %d, want 409", got)
+	}
+	var acls, members, backups int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM acls WHERE acl_id='staged'), (SELECT COUNT(*) FROM members), (SELECT COUNT(*) FROM snapshots WHERE name LIKE 'before-promotion-%')`).Scan(&acls, &members, &backups); err != nil {
+		t.Fatal(err)
+	}
+	if acls != 1 || members == 0 || backups != 1 {
+		t.Errorf("Got %d staged ACLs, %d members and %d backups, want 1, some and 1", acls, members, backups)
+	}
+
+	// A policy without the groups there are members of can't be promoted.
+	var noGroups []snapshotRecord
+	for _, rec := range staging {
+		if tbl := recString(rec, "table"); tbl != "groups" && tbl != "groupaccess" && tbl != "grouppause" {
+			noGroups = append(noGroups, rec)
+		}
+	}
+	noGroupsData, err := json.Marshal(noGroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = postForm(t, c, s.URL+"/promotions/receive", token, url.Values{"data": {string(noGroupsData)}, "source": {"staging"}})
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = getJSON(t, http.DefaultClient, s.URL+"/promotion/"+string(p.PromotionID)+"/diff.json")
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("Diff: got status %q", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&diff)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Problems) == 0 {
+		t.Errorf("Orphaned members: got no problems")
+	}
+	if got := approve(diff.Revision); got != http.StatusConflict {
+		t.Errorf("Approving orphaning promotion: got status %d, want 409", got)
+	}
+
+	for _, data := range []string{"not json", `[{"table": "nope"}]`} {
+		resp := postForm(t, c, s.URL+"/promotions/receive", token, url.Values{"data": {data}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Receiving %q: got status %q, want 400", data, resp.Status)
+		}
+	}
+}
+
+func TestServerTokenScopes(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+	mine := newTestACL(t, c, s, token, "ci rules")
+	other := newTestACL(t, c, s, token, "someone else's")
+
+	resp := postForm(t, c, s.URL+"/tokens/new", token, url.Values{
+		"name":       {"ci"},
+		"permission": {"write"},
+		"scopes[]":   {scopeRulesWrite},
+		"acls[]":     {mine},
+	})
+	var got struct {
+		Token string `json:"token"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("new token: got status %q", resp.Status)
+	}
+
+	api := func(method, u string, v url.Values) int {
+		req, err := http.NewRequest(method, s.URL+u, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+got.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, test := range []struct {
+		method, u string
+		v         url.Values
+		want      int
+	}{
+		{"POST", "/acl/" + mine + "/description", url.Values{"description": {"by CI"}}, http.StatusOK},
+		{"POST", "/rule/bulk", url.Values{"acl": {mine}, "type": {"domain"}, "action": {"allow"}, "values": {".ci.example.com"}}, http.StatusOK},
+		{"POST", "/acl/" + other + "/description", url.Values{"description": {"by CI"}}, http.StatusForbidden},
+		{"POST", "/rule/bulk", url.Values{"acl": {other}, "type": {"domain"}, "action": {"allow"}, "values": {".ci.example.com"}}, http.StatusForbidden},
+		// Not for an ACL.
+		{"POST", "/acl/new", url.Values{"comment": {"from CI"}}, http.StatusForbidden},
+		// Outside the scope.
+		{"POST", "/group/new", url.Values{"comment": {"from CI"}}, http.StatusForbidden},
+		{"GET", "/log/search", nil, http.StatusForbidden},
+		{"GET", "/matrix.json", nil, http.StatusForbidden},
+	} {
+		if got := api(test.method, test.u, test.v); got != test.want {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.u, got, test.want)
+		}
+	}
+
+	resp = postForm(t, c, s.URL+"/tokens/new", token, url.Values{"name": {"bad"}, "permission": {"read"}, "scopes[]": {"everything"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown scope: got status %q, want 400", resp.Status)
+	}
+}
+
+func TestServerTokenRotation(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	resp := postForm(t, c, s.URL+"/tokens/new", token, url.Values{"name": {"ci"}, "permission": {"write"}})
+	var first struct {
+		Token string `json:"token"`
+		ID    string `json:"id"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&first)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := db.QueryRow(`SELECT hash FROM apitokensecrets WHERE token_id=?`, first.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "$argon2id$") {
+		t.Errorf("Stored %q, want argon2id", stored)
+	}
+
+	api := func(method, u, bearer string, v url.Values) *http.Response {
+		req, err := http.NewRequest(method, s.URL+u, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	works := func(bearer string) bool {
+		resp := api("GET", "/dashboard.json", bearer, nil)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+	rotated := func(resp *http.Response) string {
+		var got struct {
+			Token string `json:"token"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("rotate: got status %q", resp.Status)
+		}
+		return got.Token
+	}
+
+	// The token rotates itself, and both work during the overlap.
+	second := rotated(api("POST", "/tokens/rotate", first.Token, url.Values{"overlap": {"1h"}}))
+	if !works(first.Token) || !works(second) {
+		t.Errorf("During overlap: got first %v, second %v, want both working", works(first.Token), works(second))
+	}
+	// An admin rotates it with no overlap.
+	third := rotated(postForm(t, c, s.URL+"/tokens/"+first.ID+"/rotate", token, url.Values{"overlap": {"0"}}))
+	if works(first.Token) || works(second) || !works(third) {
+		t.Errorf("After rotating without overlap: got %v, %v, %v, want only the last working", works(first.Token), works(second), works(third))
+	}
+
+	// Tokens from before argon2id work until they're rotated away.
+	legacy := tokenPrefix + strings.Repeat("ab", 32)
+	const legacyID = "9f1d0c3e-7a55-4a1f-9c59-2d8a3c1e5b00"
+	if _, err := db.Exec(`INSERT INTO apitokens(token_id, name, token_hash, permission, actor, created) VALUES(?, 'old', ?, 'read', 'test', 0)`, legacyID, hashToken(legacy)); err != nil {
+		t.Fatal(err)
+	}
+	if !works(legacy) {
+		t.Errorf("Old token doesn't work")
+	}
+	newer := rotated(postForm(t, c, s.URL+"/tokens/"+legacyID+"/rotate", token, url.Values{"overlap": {"1h"}}))
+	if !works(legacy) || !works(newer) {
+		t.Errorf("Old token during overlap: got %v, %v, want both working", works(legacy), works(newer))
+	}
+	rotated(postForm(t, c, s.URL+"/tokens/"+legacyID+"/rotate", token, url.Values{"overlap": {"0"}}))
+	if works(legacy) || works(newer) {
+		t.Errorf("Old token after rotating without overlap: got %v, %v, want neither working", works(legacy), works(newer))
+	}
+
+	for _, v := range []url.Values{{"overlap": {"forever"}}, {"overlap": {"90d"}}} {
+		resp := postForm(t, c, s.URL+"/tokens/"+first.ID+"/rotate", token, v)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: got status %q, want 400", v, resp.Status)
+		}
+	}
+	resp = postForm(t, c, s.URL+"/tokens/rotate", token, url.Values{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Rotating without a token: got status %q, want 400", resp.Status)
+	}
+}
+
+func TestServerMemberExpiry(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	const gid = "55555555-6666-7777-8888-999999999999"
+	const sid = "66666666-7777-8888-9999-aaaaaaaaaaaa"
+	const guest = "88888888-9999-aaaa-bbbb-cccccccccccc"
+	for _, q := range []string{
+		`INSERT INTO groups(group_id, comment) VALUES('` + gid + `', 'guests')`,
+		`INSERT INTO sources(source_id, source, comment) VALUES('` + sid + `', '10.9.0.1/32', 'resident')`,
+		`INSERT INTO sources(source_id, source, comment) VALUES('` + guest + `', '10.9.0.2/32', 'guest phone')`,
+		`INSERT INTO members(group_id, source_id) VALUES('` + gid + `', '` + sid + `')`,
+		`INSERT INTO members(group_id, source_id) VALUES('` + gid + `', '` + guest + `')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp := postForm(t, c, s.URL+"/members/"+gid+"/expiry", token, url.Values{"source": {guest}, "expires": {"7d"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %q", resp.Status)
+	}
+	var expires int64
+	if err := db.QueryRow(`SELECT expires FROM memberexpiry WHERE group_id=? AND source_id=?`, gid, guest).Scan(&expires); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Unix(expires, 0).Sub(time.Now()); d < 6*24*time.Hour || d > 7*24*time.Hour {
+		t.Errorf("Expires in %v, want 7d", d)
+	}
+
+	for _, test := range []struct {
+		source, expires string
+		want            int
+	}{
+		{sid, "soon", http.StatusBadRequest},
+		{"77777777-8888-9999-aaaa-bbbbbbbbbbbb", "1h", http.StatusNotFound},
+		{sid, "1h", http.StatusOK},
+		{sid, "", http.StatusOK},
+	} {
+		resp := postForm(t, c, s.URL+"/members/"+gid+"/expiry", token, url.Values{"source": {test.source}, "expires": {test.expires}})
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s %q: got status %q, want %d", test.source, test.expires, resp.Status, test.want)
+		}
+	}
+
+	// Only the guest's membership expires.
+	if err := expireMembers(time.Now().Add(8 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var members, expiries int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM members WHERE group_id=?`, gid).Scan(&members); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM memberexpiry`).Scan(&expiries); err != nil {
+		t.Fatal(err)
+	}
+	if members != 1 || expiries != 0 {
+		t.Errorf("Got %d members and %d expiries left, want 1 and 0", members, expiries)
+	}
+}
+
+func TestServerRegistration(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	c, token := newTestClient(t, s)
+
+	const gid = "99999999-aaaa-bbbb-cccc-dddddddddddd"
+	if _, err := db.Exec(`INSERT INTO groups(group_id, comment) VALUES(?, 'guests')`, gid); err != nil {
+		t.Fatal(err)
+	}
+	resp := postForm(t, c, s.URL+"/registrations/codes/new", token, url.Values{"group": {gid}, "uses": {"1"}})
+	var code struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&code)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, test := range []struct {
+		client, name, code string
+		want               int
+	}{
+		{"200.8.0.1", "phone", "", http.StatusBadRequest},
+		{"200.8.0.1", "", code.Code, http.StatusBadRequest},
+		{"200.8.0.1", "phone", "WRONGONE", http.StatusForbidden},
+		{"127.0.0.1", "laptop", code.Code, http.StatusConflict},
+		{"200.8.0.1", "phone", strings.ToLower(code.Code), 0},
+		// Used up.
+		{"200.8.0.2", "tablet", code.Code, http.StatusForbidden},
+	} {
+		err := submitRegistration(test.client, test.name, test.code, now)
+		got := 0
+		if e, ok := err.(errHTTP); ok {
+			got = e.code
+		} else if err != nil {
+			t.Fatalf("%s %q: %v", test.client, test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s %q %q: got %d, want %d", test.client, test.name, test.code, got, test.want)
+		}
+	}
+
+	var id string
+	if err := db.QueryRow(`SELECT registration_id FROM registrations WHERE client='200.8.0.1' AND status=?`, registrationPending).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	resp = postForm(t, c, s.URL+"/registrations/"+id+"/approve", token, url.Values{"group": {gid}, "expires": {"7d"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Approve: got status %q", resp.Status)
+	}
+	var members, expiries int
+	if err := db.QueryRow(`
+SELECT COUNT(*) FROM members
+JOIN sources ON members.source_id=sources.source_id
+WHERE members.group_id=? AND sources.source='200.8.0.1/32' AND sources.comment='phone'`, gid).Scan(&members); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM memberexpiry WHERE group_id=?`, gid).Scan(&expiries); err != nil {
+		t.Fatal(err)
+	}
+	if members != 1 || expiries != 1 {
+		t.Errorf("Got %d members and %d expiries, want 1 and 1", members, expiries)
+	}
+
+	// Already decided, and now registered.
+	resp = postForm(t, c, s.URL+"/registrations/"+id+"/approve", token, url.Values{"group": {gid}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Approve again: got status %q", resp.Status)
+	}
+	if err := submitRegistration("200.8.0.1", "phone", code.Code, now); err == nil {
+		t.Errorf("Registered twice")
+	}
+}
@@ -0,0 +1,406 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// First run setup wizard. Until setup is done, or there's a group in the
+// database, browsers are sent to /setup, which walks through creating the
+// schema, an admin user, pointing at the squid log, creating the first group
+// and generating the squid config.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/squidwarden/internal/store"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	settingSquidLog  = "squid_log"
+	settingSetupDone = "setup_done"
+)
+
+// setupComplete is set once the wizard isn't needed any more, so that
+// setupNeeded doesn't query the database on every request.
+var setupComplete struct {
+	sync.Mutex
+	done bool
+}
+
+// getSetting returns a setting, or "" if it's not set.
+func getSetting(name string) (string, error) {
+	var v string
+	if err := db.QueryRow(`SELECT value FROM settings WHERE name=?`, name).Scan(&v); err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+func setSetting(name, value string) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO settings(name, value) VALUES(?,?)`, name, value)
+	return err
+}
+
+func hasSchema() (bool, error) {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='revision'`).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// loadSettings applies the settings made in the wizard that the command line
+// doesn't override. Called from NewServer.
+func loadSettings() {
+	setupComplete.Lock()
+	setupComplete.done = false
+	setupComplete.Unlock()
+
+	if ok, err := hasSchema(); err != nil || !ok {
+		return
+	}
+	if err := loadUsers(); err != nil {
+		log.Printf("Failed to load users: %v", err)
+	}
+	if serverOpts.SquidLog == "" {
+		l, err := getSetting(settingSquidLog)
+		if err != nil {
+			log.Printf("Failed to read squid log setting: %v", err)
+		}
+		serverOpts.SquidLog = l
+	}
+	loadTimeZones()
+	if err := loadIgnores(); err != nil {
+		log.Printf("Failed to load the ignore list: %v", err)
+	}
+}
+
+// setupNeeded returns true if the database has no schema, or is empty and
+// the wizard hasn't been finished.
+func setupNeeded() bool {
+	setupComplete.Lock()
+	defer setupComplete.Unlock()
+	if setupComplete.done {
+		return false
+	}
+	if ok, err := hasSchema(); err != nil {
+		log.Printf("Failed to check for schema: %v", err)
+		return false
+	} else if !ok {
+		return true
+	}
+	var groups int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM groups`).Scan(&groups); err != nil {
+		log.Printf("Failed to count groups: %v", err)
+		return false
+	}
+	done, err := getSetting(settingSetupDone)
+	if err != nil {
+		// Schema from before the settings table.
+		done = "old"
+	}
+	if groups > 0 || done != "" {
+		setupComplete.done = true
+	}
+	return !setupComplete.done
+}
+
+// setupRedirect sends browsers to the wizard while it's needed.
+type setupRedirect struct{ h http.Handler }
+
+func (s setupRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	if r.Method == "GET" && !strings.HasPrefix(p, "/setup") && !strings.HasPrefix(p, "/static/") && !strings.HasSuffix(p, ".json") && setupNeeded() {
+		http.Redirect(w, r, "/setup", http.StatusFound)
+		return
+	}
+	s.h.ServeHTTP(w, r)
+}
+
+type setupState struct {
+	Schema    bool
+	Admin     bool   // Authorization is on.
+	User      string // Logged in user, who'd become admin.
+	SquidLog  string
+	Restart   bool // The squid log setting isn't in use yet.
+	Groups    int
+	SquidConf string
+	Config    string
+	Templates []groupTemplate
+	Done      bool
+}
+
+func getSetupState(r *http.Request) (*setupState, error) {
+	s := &setupState{
+		Admin:     authEnabled(),
+		User:      remoteUser(r),
+		SquidLog:  serverOpts.SquidLog,
+		SquidConf: serverOpts.SquidConf,
+	}
+	var err error
+	if s.Templates, err = getGroupTemplates(); err != nil {
+		return nil, err
+	}
+	if s.Schema, err = hasSchema(); err != nil || !s.Schema {
+		return s, err
+	}
+	l, err := getSetting(settingSquidLog)
+	if err != nil {
+		return nil, err
+	}
+	if l != "" && l != s.SquidLog {
+		s.SquidLog = l
+		s.Restart = true
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM groups`).Scan(&s.Groups); err != nil {
+		return nil, err
+	}
+	done, err := getSetting(settingSetupDone)
+	if err != nil {
+		return nil, err
+	}
+	s.Done = done != ""
+	var conf bytes.Buffer
+	if err := generateSquidConf(&conf); err != nil {
+		return nil, err
+	}
+	s.Config = conf.String()
+	return s, nil
+}
+
+func setupHandler(r *http.Request) (template.HTML, error) {
+	s, err := getSetupState(r)
+	if err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("setup.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// needSchema fails setup steps that need the schema.
+func needSchema() error {
+	ok, err := hasSchema()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errHTTP{
+			external: "create the database schema first",
+			code:     http.StatusConflict,
+		}
+	}
+	return nil
+}
+
+func setupSchemaHandler(r *http.Request) (interface{}, error) {
+	if ok, err := hasSchema(); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, errHTTP{
+			external: "database already has a schema",
+			code:     http.StatusConflict,
+		}
+	}
+	b, err := readFile(serverOpts.Schema)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("couldn't read schema %q. Did you 'go generate'?", serverOpts.Schema),
+			code:     http.StatusInternalServerError,
+		}
+	}
+	log.Printf("Creating database schema from %q", serverOpts.Schema)
+	if err := store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(string(b))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &struct{}{}, loadUsers()
+}
+
+// setupAdminHandler makes the logged in user an admin, which turns on
+// authorization. Only users the web server authenticated can do it, or
+// nobody could log in afterwards.
+func setupAdminHandler(r *http.Request) (interface{}, error) {
+	if err := needSchema(); err != nil {
+		return nil, err
+	}
+	user := remoteUser(r)
+	if user == "" {
+		return nil, errHTTP{
+			external: "not logged in. Set up authentication in the web server in front of squidwarden first",
+			code:     http.StatusBadRequest,
+		}
+	}
+	log.Printf("Making %q admin", user)
+	if err := store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		return addUser(tx, user, permAdmin)
+	}); err != nil {
+		return nil, err
+	}
+	return &struct {
+		User string `json:"user"`
+	}{user}, loadUsers()
+}
+
+// setupSquidLogHandler saves where the squid log is. It's used from the
+// next start, unless -squidlog is given.
+func setupSquidLogHandler(r *http.Request) (interface{}, error) {
+	if err := needSchema(); err != nil {
+		return nil, err
+	}
+	var data struct {
+		Path string `form:"path,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	fn := data.Path
+	if fi, err := os.Stat(fn); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("can't read squid log: %v", err),
+			code:     http.StatusBadRequest,
+		}
+	} else if !fi.Mode().IsRegular() {
+		return nil, errHTTP{
+			external: fmt.Sprintf("%q is not a file", fn),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if err := setSetting(settingSquidLog, fn); err != nil {
+		return nil, err
+	}
+	return &struct {
+		Path    string `json:"path"`
+		Restart bool   `json:"restart"`
+	}{fn, fn != serverOpts.SquidLog}, nil
+}
+
+// setupGroupHandler creates the first group, optionally from a template,
+// with one source in it.
+func setupGroupHandler(r *http.Request) (interface{}, error) {
+	if err := needSchema(); err != nil {
+		return nil, err
+	}
+	var data struct {
+		Comment  string `form:"comment,trim"`
+		Source   string `form:"source,trim"`
+		Template string `form:"template"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	comment := data.Comment
+	if comment == "" {
+		return nil, errHTTP{
+			external: "group needs a name",
+			code:     http.StatusBadRequest,
+		}
+	}
+	source := data.Source
+	if ip := net.ParseIP(source); ip != nil {
+		source = hostSource(ip)
+	} else if _, _, err := net.ParseCIDR(source); source != "" && err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("%q is not an address or CIDR", source),
+			code:     http.StatusBadRequest,
+		}
+	}
+	var t *groupTemplate
+	if name := data.Template; name != "" {
+		var err error
+		if t, err = findGroupTemplate(name); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Setup creating group %q with source %q", comment, source)
+	resp := struct {
+		Group string `json:"group"`
+	}{}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if t != nil {
+			g, err := applyGroupTemplate(tx, t, comment)
+			if err != nil {
+				return err
+			}
+			resp.Group = string(g)
+		} else {
+			resp.Group = uuid.NewV4().String()
+			if _, err := tx.Exec(`INSERT INTO groups(group_id, comment) VALUES(?,?)`, resp.Group, comment); err != nil {
+				return err
+			}
+		}
+		if source == "" {
+			return nil
+		}
+		var id string
+		if err := tx.QueryRow(`SELECT source_id FROM sources WHERE source=?`, source).Scan(&id); err == sql.ErrNoRows {
+			id = uuid.NewV4().String()
+			if _, err := tx.Exec(`INSERT INTO sources(source_id, source, comment) VALUES(?,?,?)`, id, source, comment); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO members(group_id, source_id) VALUES(?,?)`, resp.Group, id)
+		return err
+	})
+}
+
+// setupFinishHandler applies the squid config, if -squid_conf is set, and
+// marks setup as done.
+func setupFinishHandler(r *http.Request) (interface{}, error) {
+	if err := needSchema(); err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Applied string `json:"applied,omitempty"`
+	}{}
+	if serverOpts.SquidConf != "" {
+		if err := applySquidConf(); err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("failed to apply config: %v", err),
+				code:     http.StatusInternalServerError,
+			}
+		}
+		resp.Applied = serverOpts.SquidConf
+	}
+	if err := setSetting(settingSetupDone, "1"); err != nil {
+		return nil, err
+	}
+	setupComplete.Lock()
+	setupComplete.done = true
+	setupComplete.Unlock()
+	return &resp, nil
+}
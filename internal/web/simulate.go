@@ -0,0 +1,148 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The simulator evaluates a URL for a client against the current policy,
+// like the helper would, and shows every step of the evaluation.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+type simulationStep struct {
+	Result    string `json:"result"`
+	Source    string `json:"source,omitempty"`
+	Group     string `json:"group,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+	ACL       string `json:"acl,omitempty"`
+	ACLName   string `json:"acl_name,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+type simulation struct {
+	Client string           `json:"client"`
+	URL    string           `json:"url"`
+	Action string           `json:"action"`
+	Reason string           `json:"reason,omitempty"`
+	Rule   string           `json:"rule,omitempty"`
+	Trace  []simulationStep `json:"trace"`
+}
+
+// simulate evaluates the client and url parameters, if set.
+func simulate(r *http.Request) (*simulation, error) {
+	s := &simulation{
+		Client: r.FormValue("client"),
+		URL:    r.FormValue("url"),
+	}
+	if s.Client == "" && s.URL == "" {
+		return s, nil
+	}
+	if net.ParseIP(s.Client) == nil {
+		return nil, errHTTP{
+			external: fmt.Sprintf("client %q is not an address", s.Client),
+			code:     http.StatusBadRequest,
+		}
+	}
+	req, err := policy.URLRequest(s.Client, s.URL)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: err.Error(),
+			code:     http.StatusBadRequest,
+		}
+	}
+	p, err := currentPolicy()
+	if err != nil {
+		return nil, err
+	}
+	d, trace, err := p.Explain(req)
+	if err != nil {
+		return nil, err
+	}
+	s.Action, s.Reason, s.Rule = d.Action, d.Reason, d.Rule
+
+	groups, _, err := getGroups("")
+	if err != nil {
+		return nil, err
+	}
+	groupNames := make(map[string]string)
+	for _, g := range groups {
+		groupNames[string(g.GroupID)] = g.Comment
+	}
+	acls, err := getACLs()
+	if err != nil {
+		return nil, err
+	}
+	aclNames := make(map[string]string)
+	for _, a := range acls {
+		aclNames[string(a.ACLID)] = a.Comment
+	}
+	s.Trace = []simulationStep{}
+	for _, t := range trace {
+		s.Trace = append(s.Trace, simulationStep{
+			Result:    t.Result,
+			Source:    t.Source,
+			Group:     t.Group,
+			GroupName: groupNames[t.Group],
+			ACL:       t.ACL,
+			ACLName:   aclNames[t.ACL],
+			Rule:      t.Rule,
+			Type:      t.Type,
+			Value:     t.Value,
+			Action:    t.Action,
+			Detail:    t.Detail,
+		})
+	}
+	return s, nil
+}
+
+func simulateHandler(r *http.Request) (template.HTML, error) {
+	s, err := simulate(r)
+	if err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("simulate.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func simulateJSONHandler(r *http.Request) (interface{}, error) {
+	return simulate(r)
+}
+
+// policyMaxAge is how stale the shared policy may get when the revision
+// didn't change, e.g. for schedules and quotas.
+const policyMaxAge = 10 * time.Second
+
+// currentPolicy returns the policy as of now, from the shared cache.
+func currentPolicy() (*policy.Policy, error) {
+	p, _, err := policies.Get(time.Now())
+	return p, err
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Favicons and page titles of domains, shown next to them in the review
+// queue and ACLs, to make it quicker to tell what e.g. xyzcdn-assets.net
+// is before allowing it. They're fetched from the sites when first asked
+// for, and cached in the database. With -site_info=false nothing is
+// fetched, and only what's already cached is shown.
+//
+// Only addresses on the internet are connected to, so that this can't be
+// used to probe the local network. That's checked when dialing, for every
+// connection including redirects and icons, so a domain that resolves to
+// a public address when looked up and a private one when connected to
+// doesn't get through.
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// siteInfoTTL is how long fetched site info is used, and
+	// siteInfoRetry how long until a failed fetch is retried.
+	siteInfoTTL   = 30 * 24 * time.Hour
+	siteInfoRetry = 24 * time.Hour
+
+	maxSitePage    = 256 << 10
+	maxSiteIcon    = 64 << 10
+	maxSiteTitle   = 200
+	maxSiteFetches = 4
+)
+
+var (
+	siteInfoClient = &http.Client{
+		Timeout: 10 * time.Second,
+		// No proxy, the address dialed is the site's.
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: siteDialControl,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			return checkSiteHost(req.URL.Hostname())
+		},
+	}
+
+	// siteInfoSem limits concurrent fetches, since a page can ask for
+	// the info of many domains at once.
+	siteInfoSem = make(chan struct{}, maxSiteFetches)
+
+	// siteInfoFetches are the domains being fetched, so that concurrent
+	// requests for one wait for the same fetch.
+	siteInfoFetches = struct {
+		sync.Mutex
+		m map[string]chan struct{}
+	}{m: make(map[string]chan struct{})}
+
+	reSiteTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	reSiteLink  = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+	reSiteAttr  = regexp.MustCompile(`(?is)\b(rel|href)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+	// Icon types served, as sniffed. Not SVG, which can have scripts.
+	siteIconTypes = map[string]bool{
+		"image/x-icon": true,
+		"image/png":    true,
+		"image/gif":    true,
+		"image/jpeg":   true,
+		"image/webp":   true,
+		"image/bmp":    true,
+	}
+)
+
+type siteInfo struct {
+	Domain  string `json:"domain"`
+	Title   string `json:"title"`
+	Icon    string `json:"icon,omitempty"` // URL of the cached icon.
+	Fetched string `json:"fetched,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Offline bool   `json:"offline"`
+
+	icon     []byte
+	iconType string
+	fetched  time.Time
+}
+
+// siteDomain returns the registered domain of a host or domain rule
+// value, which site info is kept per, or "" if it's not a domain.
+func siteDomain(s string) string {
+	s = strings.ToLower(strings.TrimPrefix(s, "."))
+	if !validListHost(s) {
+		return ""
+	}
+	return strings.TrimPrefix(squidlog.HostToDomain(s), ".")
+}
+
+// publicIP returns true if ip is on the internet, and not a private,
+// loopback or link local address.
+func publicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, n := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, cidr, _ := net.ParseCIDR(n)
+		if cidr.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// siteDialControl refuses connections to addresses that aren't on the
+// internet. address is what's being connected to, after the lookup.
+func siteDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("not connecting to private address %s", host)
+	}
+	return nil
+}
+
+// checkSiteHost returns an error if host isn't on the internet. It gives a
+// clearer error up front than siteDialControl does.
+func checkSiteHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return fmt.Errorf("%s resolves to private address %s", host, ip)
+		}
+	}
+	return nil
+}
+
+// parseSitePage returns the title and icon URL of an HTML page at base.
+// The icon is /favicon.ico if the page doesn't say.
+func parseSitePage(base *url.URL, page string) (string, string) {
+	var title string
+	if m := reSiteTitle.FindStringSubmatch(page); m != nil {
+		title = strings.Join(strings.Fields(html.UnescapeString(m[1])), " ")
+		if r := []rune(title); len(r) > maxSiteTitle {
+			title = string(r[:maxSiteTitle])
+		}
+	}
+	icon := "/favicon.ico"
+	for _, l := range reSiteLink.FindAllString(page, -1) {
+		var rel, href string
+		for _, a := range reSiteAttr.FindAllStringSubmatch(l, -1) {
+			v := html.UnescapeString(a[2] + a[3] + a[4])
+			if strings.EqualFold(a[1], "rel") {
+				rel = strings.ToLower(v)
+			} else {
+				href = v
+			}
+		}
+		if href != "" && (rel == "icon" || rel == "shortcut icon") {
+			icon = href
+			break
+		}
+	}
+	u, err := base.Parse(icon)
+	if err != nil {
+		return title, ""
+	}
+	return title, u.String()
+}
+
+// getSite GETs u, and returns up to max bytes of the body, and the final
+// URL after redirects.
+func getSite(u string, max int64) ([]byte, *url.URL, error) {
+	resp, err := siteInfoClient.Get(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%q returned %q", u, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, max))
+	return b, resp.Request.URL, err
+}
+
+// fetchSiteInfo fetches the title and favicon of domain's front page.
+func fetchSiteInfo(domain string) *siteInfo {
+	info := &siteInfo{Domain: domain, fetched: time.Now()}
+	if err := checkSiteHost(domain); err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	var page []byte
+	var base *url.URL
+	var err error
+	for _, scheme := range []string{"https", "http"} {
+		if page, base, err = getSite(scheme+"://"+domain+"/", maxSitePage); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	var iconURL string
+	info.Title, iconURL = parseSitePage(base, string(page))
+	if iconURL == "" {
+		return info
+	}
+	icon, _, err := getSite(iconURL, maxSiteIcon)
+	if err != nil {
+		// The title is still worth having.
+		return info
+	}
+	if t := http.DetectContentType(icon); siteIconTypes[t] {
+		info.icon, info.iconType = icon, t
+	}
+	return info
+}
+
+// readSiteInfo returns the cached info of domain, or nil.
+func readSiteInfo(domain string) (*siteInfo, error) {
+	info := &siteInfo{Domain: domain}
+	var fetched int64
+	if err := db.QueryRow(`SELECT title, icon, icon_type, fetched, error FROM siteinfo WHERE domain=?`, domain).Scan(&info.Title, &info.icon, &info.iconType, &fetched, &info.Error); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info.fetched = time.Unix(fetched, 0)
+	return info, nil
+}
+
+// getSiteInfo returns the info of domain, fetching it if it's not cached
+// or is stale, unless offline. It returns nil if there's none.
+func getSiteInfo(domain string, now time.Time) (*siteInfo, error) {
+	info, err := readSiteInfo(domain)
+	if err != nil || !serverOpts.SiteInfo {
+		return info, err
+	}
+	if info != nil {
+		ttl := siteInfoTTL
+		if info.Error != "" {
+			ttl = siteInfoRetry
+		}
+		if now.Sub(info.fetched) < ttl {
+			return info, nil
+		}
+	}
+
+	siteInfoFetches.Lock()
+	if wait, ok := siteInfoFetches.m[domain]; ok {
+		siteInfoFetches.Unlock()
+		<-wait
+		return readSiteInfo(domain)
+	}
+	done := make(chan struct{})
+	siteInfoFetches.m[domain] = done
+	siteInfoFetches.Unlock()
+	defer func() {
+		siteInfoFetches.Lock()
+		delete(siteInfoFetches.m, domain)
+		siteInfoFetches.Unlock()
+		close(done)
+	}()
+
+	siteInfoSem <- struct{}{}
+	info = fetchSiteInfo(domain)
+	<-siteInfoSem
+	if info.Error != "" {
+		log.Printf("Failed to fetch site info of %q: %s", domain, info.Error)
+	}
+	if _, err := db.Exec(`INSERT OR REPLACE INTO siteinfo(domain, title, icon, icon_type, fetched, error) VALUES(?,?,?,?,?,?)`, domain, info.Title, info.icon, info.iconType, info.fetched.Unix(), info.Error); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// siteInfoHandler returns the title of a domain, and where its icon is.
+func siteInfoHandler(r *http.Request) (interface{}, error) {
+	domain := siteDomain(mux.Vars(r)["domain"])
+	if domain == "" {
+		return nil, errHTTP{
+			external: fmt.Sprintf("%q is not a domain", mux.Vars(r)["domain"]),
+			code:     http.StatusBadRequest,
+		}
+	}
+	info, err := getSiteInfo(domain, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		info = &siteInfo{Domain: domain}
+	}
+	info.Offline = !serverOpts.SiteInfo
+	if !info.fetched.IsZero() {
+		info.Fetched = formatTime(info.fetched, requestZone(r))
+	}
+	if len(info.icon) > 0 {
+		info.Icon = "/site/" + domain + "/favicon"
+	}
+	return info, nil
+}
+
+// siteFaviconHandler serves the cached favicon of a domain. It doesn't
+// fetch it; asking for the info does.
+func siteFaviconHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := readSiteInfo(siteDomain(mux.Vars(r)["domain"]))
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	if info == nil || len(info.icon) == 0 || !siteIconTypes[info.iconType] {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", info.iconType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if _, err := w.Write(info.icon); err != nil {
+		log.Printf("Failed to write favicon: %v", err)
+	}
+}
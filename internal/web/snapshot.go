@@ -0,0 +1,531 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Snapshots are named copies of the configuration, like "2024-Q3-audit",
+// taken at a policy revision. They can't be changed once taken (a trigger
+// refuses updates), only compared with the current configuration or each
+// other, downloaded, restored, or deleted by an admin.
+//
+// A snapshot holds the same records as /export.json. Restoring replaces
+// every exported table with what's in the snapshot, in one transaction,
+// after first taking a snapshot of the configuration it replaces.
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+// snapshotNameRE is what snapshot names may look like, so that they're
+// usable as file names.
+var snapshotNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+const (
+	// Snapshot changes are added, removed or changed rows.
+	snapshotAdded   = "added"
+	snapshotRemoved = "removed"
+	snapshotChanged = "changed"
+
+	// snapshotRestorePrefix starts the names of snapshots taken before
+	// restoring.
+	snapshotRestorePrefix = "before-restore-"
+)
+
+type snapshotID string
+
+func assertSnapshotID(s string) snapshotID { return snapshotID(assertUUID(s)) }
+
+type snapshot struct {
+	SnapshotID snapshotID `json:"snapshot"`
+	Name       string     `json:"name"`
+	Comment    string     `json:"comment"`
+	Revision   int64      `json:"revision"`
+	Records    int        `json:"records"`
+	Actor      string     `json:"actor"`
+	Created    string     `json:"created"`
+}
+
+// snapshotRecord is a row of an exported table, as decoded from JSON.
+type snapshotRecord map[string]interface{}
+
+// decodeSnapshot decodes records as exported. Numbers that are integers
+// stay integers, so that they compare equal to and restore as what they
+// were.
+func decodeSnapshot(b []byte) ([]snapshotRecord, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var recs []snapshotRecord
+	if err := d.Decode(&recs); err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		for k, v := range rec {
+			n, ok := v.(json.Number)
+			if !ok {
+				continue
+			}
+			if i, err := n.Int64(); err == nil {
+				rec[k] = i
+			} else if f, err := n.Float64(); err == nil {
+				rec[k] = f
+			} else {
+				return nil, fmt.Errorf("bad number %q", n)
+			}
+		}
+	}
+	return recs, nil
+}
+
+// readConfig returns every record of the exported tables, as JSON.
+func readConfig(tx *sql.Tx) ([]byte, int, error) {
+	var recs []map[string]interface{}
+	for _, t := range exportTables {
+		if err := exportRows(tx, t, func(rec map[string]interface{}) error {
+			recs = append(recs, rec)
+			return nil
+		}); err != nil {
+			return nil, 0, fmt.Errorf("exporting %s: %v", t, err)
+		}
+	}
+	if recs == nil {
+		recs = []map[string]interface{}{}
+	}
+	b, err := json.Marshal(recs)
+	return b, len(recs), err
+}
+
+// takeSnapshot snapshots the configuration as seen by tx.
+func takeSnapshot(tx *sql.Tx, name, comment, actor string, now time.Time) (*snapshot, error) {
+	s := &snapshot{
+		SnapshotID: snapshotID(uuid.NewV4().String()),
+		Name:       name,
+		Comment:    comment,
+		Actor:      actor,
+	}
+	if err := tx.QueryRow(`SELECT revision FROM revision`).Scan(&s.Revision); err != nil {
+		return nil, err
+	}
+	data, n, err := readConfig(tx)
+	if err != nil {
+		return nil, err
+	}
+	s.Records = n
+	if _, err := tx.Exec(`INSERT INTO snapshots(snapshot_id, name, comment, revision, records, actor, created, data) VALUES(?,?,?,?,?,?,?,?)`, string(s.SnapshotID), name, comment, s.Revision, n, actor, now.Unix(), string(data)); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("failed to take snapshot %q, is the name taken?", name),
+			code:     http.StatusConflict,
+			details:  map[string]fieldErrors{"fields": {"name": "already taken"}},
+		}
+	}
+	return s, nil
+}
+
+func getSnapshots(loc *time.Location) ([]snapshot, error) {
+	rows, err := db.Query(`SELECT snapshot_id, name, comment, revision, records, actor, created FROM snapshots ORDER BY created DESC, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []snapshot{}
+	for rows.Next() {
+		var s snapshot
+		var created int64
+		if err := rows.Scan(&s.SnapshotID, &s.Name, &s.Comment, &s.Revision, &s.Records, &s.Actor, &created); err != nil {
+			return nil, err
+		}
+		s.Created = formatUnix(created, loc)
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
+
+// getSnapshotData returns the name and records of a snapshot, as a 404 if
+// there's no such snapshot.
+func getSnapshotData(id snapshotID) (string, []byte, error) {
+	var name, data string
+	if err := db.QueryRow(`SELECT name, data FROM snapshots WHERE snapshot_id=?`, string(id)).Scan(&name, &data); err == sql.ErrNoRows {
+		return "", nil, errHTTP{
+			external: "snapshot not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return "", nil, err
+	}
+	return name, []byte(data), nil
+}
+
+// snapshotChange is a row that differs between two configurations. Old is
+// the row in the first, New in the second.
+type snapshotChange struct {
+	Table  string         `json:"table"`
+	Key    string         `json:"key"`
+	Change string         `json:"change"`
+	Old    snapshotRecord `json:"old,omitempty"`
+	New    snapshotRecord `json:"new,omitempty"`
+}
+
+type snapshotChangesByKey []snapshotChange
+
+func (a snapshotChangesByKey) Len() int      { return len(a) }
+func (a snapshotChangesByKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a snapshotChangesByKey) Less(i, j int) bool {
+	if a[i].Table != a[j].Table {
+		return tableOrder[a[i].Table] < tableOrder[a[j].Table]
+	}
+	return a[i].Key < a[j].Key
+}
+
+// tableOrder is the position of each table in exportTables.
+var tableOrder = func() map[string]int {
+	ret := make(map[string]int)
+	for n, t := range exportTables {
+		ret[t] = n
+	}
+	return ret
+}()
+
+// primaryKeys returns the primary key columns of each exported table.
+// Tables without one are keyed by all their columns.
+func primaryKeys(q querier) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	for _, t := range exportTables {
+		rows, err := q.Query(`PRAGMA table_info(` + t + `)`)
+		if err != nil {
+			return nil, err
+		}
+		var all, pk []string
+		for rows.Next() {
+			var cid, notNull, pkPos int
+			var name, typ string
+			var def interface{}
+			if err := rows.Scan(&cid, &name, &typ, &notNull, &def, &pkPos); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			all = append(all, name)
+			if pkPos > 0 {
+				pk = append(pk, name)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if len(pk) == 0 {
+			pk = all
+		}
+		ret[t] = pk
+	}
+	return ret, nil
+}
+
+// recordKey returns the table and primary key of rec, as a string.
+func recordKey(rec snapshotRecord, keys map[string][]string) (string, string) {
+	t, _ := rec["table"].(string)
+	var parts []string
+	for _, k := range keys[t] {
+		parts = append(parts, fmt.Sprint(rec[k]))
+	}
+	return t, strings.Join(parts, "/")
+}
+
+// diffSnapshots returns the rows that were added, removed or changed from
+// a to b, keyed by primary key.
+func diffSnapshots(a, b []snapshotRecord, keys map[string][]string) []snapshotChange {
+	type key struct{ table, key string }
+	old := make(map[key]snapshotRecord)
+	for _, rec := range a {
+		t, k := recordKey(rec, keys)
+		old[key{t, k}] = rec
+	}
+	ret := []snapshotChange{}
+	for _, rec := range b {
+		t, k := recordKey(rec, keys)
+		o, found := old[key{t, k}]
+		delete(old, key{t, k})
+		switch {
+		case !found:
+			ret = append(ret, snapshotChange{Table: t, Key: k, Change: snapshotAdded, New: rec})
+		case !reflect.DeepEqual(o, rec):
+			ret = append(ret, snapshotChange{Table: t, Key: k, Change: snapshotChanged, Old: o, New: rec})
+		}
+	}
+	for k, rec := range old {
+		ret = append(ret, snapshotChange{Table: k.table, Key: k.key, Change: snapshotRemoved, Old: rec})
+	}
+	sort.Sort(snapshotChangesByKey(ret))
+	return ret
+}
+
+// currentConfig returns the current configuration, decoded the same way
+// as snapshots.
+func currentConfig() ([]snapshotRecord, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Only reading.
+	defer tx.Rollback()
+	b, _, err := readConfig(tx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(b)
+}
+
+// restoreSnapshot replaces the exported tables with recs. Columns that
+// have been added since the snapshot was taken get their defaults.
+func restoreSnapshot(tx *sql.Tx, recs []snapshotRecord) error {
+	return restoreTables(tx, recs, nil)
+}
+
+// restoreTables replaces the exported tables, except those in keep, with
+// recs. Records of tables in keep are ignored.
+func restoreTables(tx *sql.Tx, recs []snapshotRecord, keep map[string]bool) error {
+	cols := make(map[string]map[string]bool)
+	for _, t := range exportTables {
+		rows, err := tx.Query(`SELECT * FROM ` + t + ` LIMIT 0`)
+		if err != nil {
+			return err
+		}
+		names, err := rows.Columns()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		cols[t] = make(map[string]bool)
+		for _, c := range names {
+			cols[t][c] = true
+		}
+	}
+
+	// Usage and list change history refer to quotas and lists, which
+	// are deleted and inserted again.
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return err
+	}
+	for n := len(exportTables) - 1; n >= 0; n-- {
+		if keep[exportTables[n]] {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM ` + exportTables[n]); err != nil {
+			return fmt.Errorf("clearing %s: %v", exportTables[n], err)
+		}
+	}
+	byTable := make(map[string][]snapshotRecord)
+	for _, rec := range recs {
+		t, _ := rec["table"].(string)
+		if cols[t] == nil {
+			return fmt.Errorf("snapshot has unknown table %q", t)
+		}
+		if keep[t] {
+			continue
+		}
+		byTable[t] = append(byTable[t], rec)
+	}
+	for _, t := range exportTables {
+		for _, rec := range byTable[t] {
+			var names, marks []string
+			var args []interface{}
+			for c, v := range rec {
+				if c == "table" {
+					continue
+				}
+				if !cols[t][c] {
+					return fmt.Errorf("snapshot has column %q, which %s no longer has", c, t)
+				}
+				names = append(names, c)
+				marks = append(marks, "?")
+				args = append(args, v)
+			}
+			if _, err := tx.Exec(`INSERT INTO `+t+`(`+strings.Join(names, ",")+`) VALUES(`+strings.Join(marks, ",")+`)`, args...); err != nil {
+				return fmt.Errorf("restoring %s: %v", t, err)
+			}
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM quotausage WHERE quota_id NOT IN (SELECT quota_id FROM quotas)`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM listchanges WHERE list_id NOT IN (SELECT list_id FROM listsubscriptions)`)
+	return err
+}
+
+func snapshotsHandler(r *http.Request) (template.HTML, error) {
+	snaps, err := getSnapshots(requestZone(r))
+	if err != nil {
+		return "", err
+	}
+	data := struct {
+		Snapshots []snapshot
+		Admin     bool
+	}{
+		Snapshots: snaps,
+		Admin:     requestPermission(r) >= permAdmin,
+	}
+	tmpl := getTemplate("snapshots.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func snapshotsJSONHandler(r *http.Request) (interface{}, error) {
+	return getSnapshots(requestZone(r))
+}
+
+// snapshotNewHandler snapshots the current configuration.
+func snapshotNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Name    string `form:"name,required,trim,max=100"`
+		Comment string `form:"comment,trim,max=1000"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	if !snapshotNameRE.MatchString(data.Name) {
+		return nil, errHTTP{
+			external: fmt.Sprintf("bad snapshot name %q, want letters, digits, '.', '_' and '-'", data.Name),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"name": "letters, digits, '.', '_' and '-' only"}},
+		}
+	}
+	var s *snapshot
+	if err := store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		var err error
+		s, err = takeSnapshot(tx, data.Name, data.Comment, remoteUser(r), time.Now())
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	log.Printf("Took snapshot %q of revision %d", s.Name, s.Revision)
+	s.Created = formatTime(time.Now(), requestZone(r))
+	return s, nil
+}
+
+// snapshotExportHandler downloads a snapshot, in the same format as
+// /export.json.
+func snapshotExportHandler(w http.ResponseWriter, r *http.Request) {
+	name, data, err := getSnapshotData(assertSnapshotID(mux.Vars(r)["snapshotID"]))
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="squidwarden-snapshot-%s.json"`, name))
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Failed to write snapshot %q: %v", name, err)
+	}
+}
+
+// snapshotDiffHandler compares a snapshot with the current configuration,
+// or with the snapshot in to.
+func snapshotDiffHandler(r *http.Request) (interface{}, error) {
+	_, data, err := getSnapshotData(assertSnapshotID(mux.Vars(r)["snapshotID"]))
+	if err != nil {
+		return nil, err
+	}
+	from, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		To      string           `json:"to"`
+		Changes []snapshotChange `json:"changes"`
+	}{To: "current"}
+	var to []snapshotRecord
+	if t := r.FormValue("to"); t != "" && t != "current" {
+		if !reUUID.MatchString(t) {
+			return nil, errHTTP{
+				external: fmt.Sprintf("bad snapshot %q", t),
+				code:     http.StatusBadRequest,
+			}
+		}
+		if resp.To, data, err = getSnapshotData(snapshotID(t)); err != nil {
+			return nil, err
+		}
+		if to, err = decodeSnapshot(data); err != nil {
+			return nil, err
+		}
+	} else if to, err = currentConfig(); err != nil {
+		return nil, err
+	}
+	keys, err := primaryKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	resp.Changes = diffSnapshots(from, to, keys)
+	return &resp, nil
+}
+
+// snapshotRestoreHandler makes a snapshot the current configuration.
+func snapshotRestoreHandler(r *http.Request) (interface{}, error) {
+	id := assertSnapshotID(mux.Vars(r)["snapshotID"])
+	name, data, err := getSnapshotData(id)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	resp := struct {
+		Snapshot string `json:"snapshot"`
+		Backup   string `json:"backup"`
+	}{Snapshot: string(id)}
+	log.Printf("Restoring snapshot %q", name)
+	if err := txWrap(func(tx *sql.Tx) error {
+		backup, err := takeSnapshot(tx, snapshotRestorePrefix+now.UTC().Format("20060102-150405"), "Taken before restoring "+name, remoteUser(r), now)
+		if err != nil {
+			return err
+		}
+		resp.Backup = string(backup.SnapshotID)
+		return restoreSnapshot(tx, recs)
+	}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func snapshotDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertSnapshotID(mux.Vars(r)["snapshotID"])
+	log.Printf("Deleting snapshot %s", id)
+	resp := struct {
+		Snapshot string `json:"snapshot"`
+		Deleted  int64  `json:"deleted"`
+	}{Snapshot: string(id)}
+	var err error
+	if resp.Deleted, err = rowsAffected(db.Exec(`DELETE FROM snapshots WHERE snapshot_id=?`, string(id))); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
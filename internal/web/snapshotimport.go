@@ -0,0 +1,252 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// A snapshot, or a configuration export from another installation, can be
+// imported as a parallel set of ACLs, named like the originals plus a
+// suffix, for comparing with the live ACLs before switching over or when
+// moving between environments. Nothing live changes: the new ACLs aren't
+// granted to any group, and rules that already exist are shared rather
+// than changed.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/squidwarden/internal/store"
+	uuid "github.com/satori/go.uuid"
+)
+
+// importedACL is an ACL made by an import.
+type importedACL struct {
+	From     aclID  `json:"from"`
+	ACL      aclID  `json:"acl"`
+	Name     string `json:"name"`
+	Rules    int    `json:"rules"`
+	NewRules int    `json:"new_rules"`
+}
+
+// recString returns a column of a record as a string, which is empty if
+// it's NULL.
+func recString(rec snapshotRecord, col string) string {
+	if v, ok := rec[col]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// recBool returns an integer column of a record as a bool, with def if
+// it's missing or NULL.
+func recBool(rec snapshotRecord, col string, def bool) bool {
+	switch v := rec[col].(type) {
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	}
+	return def
+}
+
+// importSnapshotACLs copies the ACLs in recs, except archived ones, to new
+// ACLs named with suffix. Unnamed ACLs are named by their ID. It fails with a conflict if any of the names is
+// taken.
+func importSnapshotACLs(tx *sql.Tx, recs []snapshotRecord, suffix string) ([]importedACL, error) {
+	var acls []snapshotRecord
+	archived := make(map[string]bool)
+	extra := map[string]map[string]snapshotRecord{
+		"acldescriptions": {},
+		"aclschedule":     {},
+		"aclowners":       {},
+	}
+	rules := make(map[string]snapshotRecord)
+	expiry := make(map[string]snapshotRecord)
+	aclRules := make(map[string][]snapshotRecord)
+	for _, rec := range recs {
+		t := recString(rec, "table")
+		switch t {
+		case "acls":
+			acls = append(acls, rec)
+		case "aclarchive":
+			archived[recString(rec, "acl_id")] = true
+		case "acldescriptions", "aclschedule", "aclowners":
+			extra[t][recString(rec, "acl_id")] = rec
+		case "rules":
+			rules[recString(rec, "rule_id")] = rec
+		case "ruleexpiry":
+			expiry[recString(rec, "rule_id")] = rec
+		case "aclrules":
+			a := recString(rec, "acl_id")
+			aclRules[a] = append(aclRules[a], rec)
+		}
+	}
+
+	// Rule IDs in recs to the IDs of the same rules here.
+	ruleIDs := make(map[string]string)
+	ret := []importedACL{}
+	for _, rec := range acls {
+		from := recString(rec, "acl_id")
+		if from == "" || archived[from] {
+			continue
+		}
+		// Unnamed ones go by their ID.
+		name := recString(rec, "comment")
+		if name == "" {
+			name = from
+		}
+		imp := importedACL{
+			From: aclID(from),
+			ACL:  aclID(uuid.NewV4().String()),
+			Name: name + suffix,
+		}
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM acls WHERE comment=?`, imp.Name).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, errHTTP{
+				external: fmt.Sprintf("there's already an ACL named %q, pick another suffix", imp.Name),
+				code:     http.StatusConflict,
+				details:  map[string]fieldErrors{"fields": {"suffix": "names taken"}},
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment, enabled) VALUES(?,?,?)`, string(imp.ACL), imp.Name, recBool(rec, "enabled", true)); err != nil {
+			return nil, err
+		}
+		if d := extra["acldescriptions"][from]; d != nil {
+			if _, err := tx.Exec(`INSERT INTO acldescriptions(acl_id, description) VALUES(?,?)`, string(imp.ACL), recString(d, "description")); err != nil {
+				return nil, err
+			}
+		}
+		if s := extra["aclschedule"][from]; s != nil {
+			if _, err := tx.Exec(`INSERT INTO aclschedule(acl_id, schedule) VALUES(?,?)`, string(imp.ACL), recString(s, "schedule")); err != nil {
+				return nil, err
+			}
+		}
+		if o := extra["aclowners"][from]; o != nil {
+			if _, err := tx.Exec(`INSERT INTO aclowners(acl_id, owner, contact) VALUES(?,?,?)`, string(imp.ACL), recString(o, "owner"), recString(o, "contact")); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, ar := range aclRules[from] {
+			src := recString(ar, "rule_id")
+			id, found := ruleIDs[src]
+			if !found {
+				rule := rules[src]
+				if rule == nil {
+					return nil, errHTTP{
+						external: fmt.Sprintf("ACL %q has rule %q, which isn't in the snapshot", from, src),
+						code:     http.StatusBadRequest,
+					}
+				}
+				typ, value, action := recString(rule, "type"), recString(rule, "value"), recString(rule, "action")
+				if err := store.CheckRule(typ, action); err != nil {
+					return nil, errHTTP{
+						internal: err,
+						external: fmt.Sprintf("rule %q: %v", src, err),
+						code:     http.StatusBadRequest,
+					}
+				}
+				err := tx.QueryRow(`SELECT rule_id FROM rules WHERE type=? AND value=? AND action=?`, typ, value, action).Scan(&id)
+				switch {
+				case err == sql.ErrNoRows:
+					id = uuid.NewV4().String()
+					var comment interface{}
+					if c, ok := rule["comment"]; ok {
+						comment = c
+					}
+					if _, err := tx.Exec(`INSERT INTO rules(rule_id, type, value, action, comment, enabled) VALUES(?,?,?,?,?,?)`, id, typ, value, action, comment, recBool(rule, "enabled", true)); err != nil {
+						return nil, err
+					}
+					if e := expiry[src]; e != nil {
+						if _, err := tx.Exec(`INSERT INTO ruleexpiry(rule_id, expires) VALUES(?,?)`, id, e["expires"]); err != nil {
+							return nil, err
+						}
+					}
+					imp.NewRules++
+				case err != nil:
+					return nil, err
+				}
+				ruleIDs[src] = id
+			}
+			var comment interface{}
+			if c, ok := ar["comment"]; ok {
+				comment = c
+			}
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO aclrules(acl_id, rule_id, comment) VALUES(?,?,?)`, string(imp.ACL), id, comment); err != nil {
+				return nil, err
+			}
+			imp.Rules++
+		}
+		ret = append(ret, imp)
+	}
+	return ret, nil
+}
+
+// snapshotImportHandler imports the ACLs of a snapshot, or of a
+// configuration export in data, as new ACLs named with suffix.
+func snapshotImportHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Snapshot string `form:"snapshot,trim"`
+		Data     string `form:"data"`
+		Suffix   string `form:"suffix,required,max=50"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	if (data.Snapshot == "") == (data.Data == "") {
+		return nil, errHTTP{
+			external: "want either a snapshot or the data of an export",
+			code:     http.StatusBadRequest,
+		}
+	}
+	b := []byte(data.Data)
+	if data.Snapshot != "" {
+		if !reUUID.MatchString(data.Snapshot) {
+			return nil, errHTTP{
+				external: fmt.Sprintf("bad snapshot %q", data.Snapshot),
+				code:     http.StatusBadRequest,
+			}
+		}
+		var err error
+		if _, b, err = getSnapshotData(snapshotID(data.Snapshot)); err != nil {
+			return nil, err
+		}
+	}
+	recs, err := decodeSnapshot(b)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("not a configuration export: %v", err),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"data": "not a configuration export"}},
+		}
+	}
+	resp := struct {
+		ACLs []importedACL `json:"acls"`
+	}{}
+	if err := txWrap(func(tx *sql.Tx) error {
+		var err error
+		resp.ACLs, err = importSnapshotACLs(tx, recs, data.Suffix)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	log.Printf("Imported %d ACLs with suffix %q", len(resp.ACLs), data.Suffix)
+	return &resp, nil
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Importing sources from a DHCP server's leases, or a neighbour table,
+// suggests a source per client address with its host name as comment.
+// Supported are dnsmasq and ISC dhcpd lease files, `ip neigh` and `arp -an`
+// output. The leases file of a DHCP server on the same machine can be read
+// directly with -dhcp_leases.
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Formats of imported lines.
+const (
+	importDnsmasq = "dnsmasq"
+	importDhcpd   = "dhcpd"
+	importNeigh   = "ip-neigh"
+	importARP     = "arp"
+)
+
+// sourceCandidate is a source suggested by an import.
+type sourceCandidate struct {
+	Source   string `json:"source"`
+	Address  string `json:"address"`
+	MAC      string `json:"mac,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Comment  string `json:"comment"`
+	Format   string `json:"format"`
+	Existing string `json:"existing,omitempty"` // Source ID, if already known.
+}
+
+var reARP = regexp.MustCompile(`^\S+ \(([^)]+)\) at ([0-9a-fA-F:]+) `)
+
+// hostSource is the source for a single address.
+func hostSource(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// parseSourceImport turns leases or neighbour table text into candidate
+// sources, one per address. Later lines win, like later leases do.
+func parseSourceImport(text string) []sourceCandidate {
+	var ret []sourceCandidate
+	idx := make(map[string]int)
+	add := func(format, addr, mac, host string) {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return
+		}
+		if host == "*" {
+			host = ""
+		}
+		c := sourceCandidate{
+			Source:   hostSource(ip),
+			Address:  ip.String(),
+			MAC:      strings.ToLower(mac),
+			Hostname: host,
+			Comment:  host,
+			Format:   format,
+		}
+		if c.Comment == "" {
+			c.Comment = c.MAC
+		}
+		if n, found := idx[c.Source]; found {
+			ret[n] = c
+			return
+		}
+		idx[c.Source] = len(ret)
+		ret = append(ret, c)
+	}
+
+	// State of an ISC dhcpd lease block.
+	var lease, leaseMAC, leaseHost string
+	inLease := false
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), maxPasteSize)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		f := strings.Fields(l)
+		switch {
+		case inLease:
+			v := strings.Trim(strings.TrimSuffix(l, ";"), " ")
+			switch {
+			case strings.HasPrefix(v, "}"):
+				add(importDhcpd, lease, leaseMAC, leaseHost)
+				inLease = false
+			case strings.HasPrefix(v, "hardware ethernet "):
+				leaseMAC = strings.TrimPrefix(v, "hardware ethernet ")
+			case strings.HasPrefix(v, "client-hostname "):
+				leaseHost = strings.Trim(strings.TrimPrefix(v, "client-hostname "), `"`)
+			case strings.HasPrefix(v, "binding state ") && v != "binding state active":
+				// Expired or free; skip this lease.
+				lease = ""
+			}
+		case len(f) >= 3 && f[0] == "lease" && f[2] == "{":
+			inLease = true
+			lease, leaseMAC, leaseHost = f[1], "", ""
+		case len(f) >= 4 && isNumber(f[0]) && net.ParseIP(f[2]) != nil:
+			// dnsmasq: expiry mac ip hostname client-id
+			add(importDnsmasq, f[2], f[1], f[3])
+		case len(f) >= 5 && net.ParseIP(f[0]) != nil && f[1] == "dev":
+			// ip neigh: ip dev eth0 lladdr mac STATE
+			for n := 2; n < len(f)-1; n++ {
+				if f[n] == "lladdr" {
+					add(importNeigh, f[0], f[n+1], "")
+				}
+			}
+		default:
+			if m := reARP.FindStringSubmatch(l); m != nil {
+				host := f[0]
+				if host == "?" {
+					host = ""
+				}
+				add(importARP, m[1], m[2], host)
+			}
+		}
+	}
+	return ret
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// markExistingSources sets Existing of candidates that are already sources.
+func markExistingSources(cands []sourceCandidate) error {
+	sources, err := getSources()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]string)
+	for _, s := range sources {
+		known[s.Source] = string(s.SourceID)
+	}
+	for n := range cands {
+		cands[n].Existing = known[cands[n].Source]
+	}
+	return nil
+}
+
+func sourceCandidatesResponse(cands []sourceCandidate) (interface{}, error) {
+	if cands == nil {
+		cands = []sourceCandidate{}
+	}
+	if err := markExistingSources(cands); err != nil {
+		return nil, err
+	}
+	return &struct {
+		Candidates []sourceCandidate `json:"candidates"`
+	}{cands}, nil
+}
+
+// sourceParseHandler suggests sources from uploaded leases or neighbours.
+func sourceParseHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Text string `form:"text"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	text := data.Text
+	if len(text) > maxPasteSize {
+		return nil, errHTTP{
+			external: fmt.Sprintf("text too long, max %d bytes", maxPasteSize),
+			code:     http.StatusBadRequest,
+		}
+	}
+	return sourceCandidatesResponse(parseSourceImport(text))
+}
+
+// sourceLeasesHandler suggests sources from -dhcp_leases.
+func sourceLeasesHandler(r *http.Request) (interface{}, error) {
+	if serverOpts.DHCPLeases == "" {
+		return nil, errHTTP{
+			external: "-dhcp_leases not configured",
+			code:     http.StatusNotFound,
+		}
+	}
+	b, err := ioutil.ReadFile(serverOpts.DHCPLeases)
+	if err != nil {
+		return nil, err
+	}
+	return sourceCandidatesResponse(parseSourceImport(string(b)))
+}
+
+// membersImportHandler adds sources to a group, creating the ones that
+// don't exist yet.
+func membersImportHandler(r *http.Request) (interface{}, error) {
+	gid := assertGroupID(mux.Vars(r)["groupID"])
+	var data struct {
+		Sources  []string `form:"sources[]"`
+		Comments []string `form:"comments[]"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	sources, comments := data.Sources, data.Comments
+	if len(comments) != len(sources) {
+		return nil, errHTTP{
+			external: fmt.Sprintf("got %d sources but %d comments", len(sources), len(comments)),
+			code:     http.StatusBadRequest,
+		}
+	}
+	for _, s := range sources {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("%q is not a CIDR source", s),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	log.Printf("Importing %d sources into group %s", len(sources), gid)
+	resp := struct {
+		Group   string `json:"group"`
+		Created int    `json:"created"`
+		Added   int64  `json:"added"`
+	}{Group: string(gid)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		for n, s := range sources {
+			var id string
+			if err := tx.QueryRow(`SELECT source_id FROM sources WHERE source=?`, s).Scan(&id); err == sql.ErrNoRows {
+				id = uuid.NewV4().String()
+				if _, err := tx.Exec(`INSERT INTO sources(source_id, source, comment) VALUES(?,?,?)`, id, s, comments[n]); err != nil {
+					return err
+				}
+				resp.Created++
+			} else if err != nil {
+				return err
+			}
+			added, err := rowsAffected(tx.Exec(`INSERT OR IGNORE INTO members(group_id, source_id) VALUES(?,?)`, string(gid), id))
+			if err != nil {
+				return err
+			}
+			resp.Added += added
+		}
+		return nil
+	})
+}
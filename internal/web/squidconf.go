@@ -0,0 +1,331 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The generated squid config is meant to be included from squid.conf. The
+// access decisions themselves are made by the external ACL helper; the
+// generated config holds what the helper can't do, such as adaptation.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+)
+
+var (
+	// Only one apply at a time.
+	applyLock sync.Mutex
+)
+
+// groupACLName is the name of the squid 'src' acl matching a group.
+func groupACLName(g groupID) string {
+	return "sw_group_" + string(g)
+}
+
+type groupSources struct {
+	Group   group
+	Sources []string
+}
+
+// assignedACL is the squid acl of every source in a group, used to match
+// the clients of the default group.
+const assignedACL = "sw_assigned"
+
+// squidGroups are the groups that have squid acls.
+type squidGroups struct {
+	groups  []groupSources
+	defined map[groupID]bool // Squid refuses to reference undefined acls.
+	def     groupID          // Default group, if any.
+	rev     int64            // Policy revision they're from.
+}
+
+func newSquidGroups(groups []groupSources, def groupID) *squidGroups {
+	s := &squidGroups{groups: groups, defined: make(map[groupID]bool), def: def}
+	for _, g := range groups {
+		s.defined[g.Group.GroupID] = true
+	}
+	return s
+}
+
+// ids returns the groups with acls, the default group last.
+func (s *squidGroups) ids() []groupID {
+	var ret []groupID
+	for _, g := range s.groups {
+		if g.Group.GroupID != s.def {
+			ret = append(ret, g.Group.GroupID)
+		}
+	}
+	if s.def != "" {
+		ret = append(ret, s.def)
+	}
+	return ret
+}
+
+// refs returns the acl lists that together match the clients of a group.
+// For the default group those are the clients in no group's sources.
+func (s *squidGroups) refs(g groupID) []string {
+	var ret []string
+	if s.defined[g] {
+		ret = append(ret, groupACLName(g))
+	}
+	if g == s.def {
+		if len(s.groups) > 0 {
+			ret = append(ret, "!"+assignedACL)
+		} else {
+			ret = append(ret, "all")
+		}
+	}
+	return ret
+}
+
+// getAllGroupSources returns the groups with members, and their sources,
+// sorted by ID so that the generated config only changes with the policy.
+func getAllGroupSources() ([]groupSources, error) {
+	rows, err := db.Query(`
+SELECT groups.group_id, groups.comment, sources.source
+FROM groups
+JOIN members ON groups.group_id=members.group_id
+JOIN sources ON members.source_id=sources.source_id
+ORDER BY groups.group_id, sources.source`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []groupSources
+	for rows.Next() {
+		var g, src string
+		var c sql.NullString
+		if err := rows.Scan(&g, &c, &src); err != nil {
+			return nil, err
+		}
+		if len(ret) == 0 || ret[len(ret)-1].Group.GroupID != groupID(g) {
+			ret = append(ret, groupSources{Group: group{GroupID: groupID(g), Comment: c.String}})
+		}
+		ret[len(ret)-1].Sources = append(ret[len(ret)-1].Sources, src)
+	}
+	return ret, rows.Err()
+}
+
+// getSquidGroups returns the groups with sources, and the default group.
+func getSquidGroups() (*squidGroups, error) {
+	// Read first, so that a change while generating is in the next
+	// revision rather than missing from this one.
+	rev, err := store.Revision(db)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := getAllGroupSources()
+	if err != nil {
+		return nil, err
+	}
+	def, err := getDefaultGroup()
+	if err != nil {
+		return nil, err
+	}
+	sg := newSquidGroups(groups, def)
+	sg.rev = rev
+	return sg, nil
+}
+
+// confHeader starts a generated file. Everything after it only depends on
+// the policy, in a stable order, so that generated files can be kept in
+// version control and diffed.
+func confHeader(w io.Writer, rev int64) {
+	fmt.Fprintf(w, "# Generated by squidwarden %s. Do not edit.\n", version)
+	fmt.Fprintf(w, "# Policy revision %d.\n", rev)
+}
+
+// generateSquidConf writes the squid config for the current policy.
+func generateSquidConf(w io.Writer) error {
+	sg, err := getSquidGroups()
+	if err != nil {
+		return err
+	}
+	confHeader(w, sg.rev)
+	fmt.Fprintf(w, "\n# Groups.\n")
+	var all []string
+	for _, g := range sg.groups {
+		fmt.Fprintf(w, "# %s\n", oneLine(g.Group.Comment))
+		fmt.Fprintf(w, "acl %s src %s\n", groupACLName(g.Group.GroupID), strings.Join(g.Sources, " "))
+		all = append(all, g.Sources...)
+	}
+	if sg.def != "" && len(all) > 0 {
+		fmt.Fprintf(w, "# Clients in any group, so that the rest get the default group.\n")
+		fmt.Fprintf(w, "acl %s src %s\n", assignedACL, strings.Join(all, " "))
+	}
+
+	quic, err := getQUICGroups()
+	if err != nil {
+		return err
+	}
+	generateQUICConf(w, sg, quic)
+
+	if err := generateICAPConf(w, sg); err != nil {
+		return err
+	}
+	if serverOpts.ACLFilesDir != "" {
+		sets, err := getACLFileSets(time.Now(), serverOpts.ACLFileShard)
+		if err != nil {
+			return err
+		}
+		generateACLFilesConf(w, serverOpts.ACLFilesDir, sets)
+	}
+	return generateDenyPageConf(w)
+}
+
+// oneLine makes a comment safe to put in a config comment.
+func oneLine(s string) string {
+	return strings.Replace(strings.Replace(s, "\r", " ", -1), "\n", " ", -1)
+}
+
+// applySquidConf writes the config atomically and asks squid to reload it.
+func applySquidConf() error {
+	if serverOpts.SquidConf == "" {
+		return fmt.Errorf("-squid_conf not configured")
+	}
+	applyLock.Lock()
+	defer applyLock.Unlock()
+
+	if err := writeDenyPages(); err != nil {
+		return err
+	}
+	if serverOpts.ACLFilesDir != "" {
+		now := time.Now()
+		sets, err := getACLFileSets(now, serverOpts.ACLFileShard)
+		if err != nil {
+			return err
+		}
+		if err := writeACLFiles(serverOpts.ACLFilesDir, sets, serverOpts.ACLFileShard, now); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := generateSquidConf(&buf); err != nil {
+		return err
+	}
+	if err := writeConf(serverOpts.SquidConf, buf.Bytes()); err != nil {
+		return err
+	}
+	if serverOpts.FirewallConf != "" {
+		buf.Reset()
+		if err := generateAllFirewallConf(&buf); err != nil {
+			return err
+		}
+		if err := writeConf(serverOpts.FirewallConf, buf.Bytes()); err != nil {
+			return err
+		}
+		if err := runCommand(serverOpts.FirewallReload); err != nil {
+			return err
+		}
+	}
+	if serverOpts.BundleFile != "" {
+		if err := writeBundle(); err != nil {
+			return err
+		}
+	}
+	return runCommand(serverOpts.SquidReconfigure)
+}
+
+// writeConf writes a config file atomically.
+func writeConf(fn string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".squidwarden")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), fn); err != nil {
+		return err
+	}
+	log.Printf("Wrote config %q", fn)
+	return nil
+}
+
+// runCommand runs a reload command, if configured.
+func runCommand(cmd string) error {
+	if cmd == "" {
+		return nil
+	}
+	args := strings.Fields(cmd)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%q failed: %v, output %q", args, err, out)
+	}
+	return nil
+}
+
+func configHandler(r *http.Request) (template.HTML, error) {
+	var conf bytes.Buffer
+	if err := generateSquidConf(&conf); err != nil {
+		return "", err
+	}
+	var fw bytes.Buffer
+	if err := generateAllFirewallConf(&fw); err != nil {
+		return "", err
+	}
+	data := struct {
+		Path         string
+		Config       string
+		FirewallPath string
+		Firewall     string
+	}{
+		Path:         serverOpts.SquidConf,
+		Config:       conf.String(),
+		FirewallPath: serverOpts.FirewallConf,
+		Firewall:     fw.String(),
+	}
+	tmpl := getTemplate("config.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func configApplyHandler(r *http.Request) (interface{}, error) {
+	if err := applySquidConf(); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("failed to apply config: %v", err),
+			code:     http.StatusInternalServerError,
+		}
+	}
+	return &struct {
+		Path    string `json:"path"`
+		Applied string `json:"applied"`
+	}{Path: serverOpts.SquidConf, Applied: formatTime(time.Now(), requestZone(r))}, nil
+}
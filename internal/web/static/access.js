@@ -6,6 +6,11 @@ $(document).ready(function() {
 	window.location.href = "/access/" + $(this).val();
     });
     $("#button-update").click(update);
+    $("#button-block-bypass").click(function() {
+	doPost("/group/" + $("#access-group-selection").val() + "/block-bypass", {}, function() {
+	    window.location.reload();
+	});
+    });
     // $("table#acl-rules input.checked-rules").change(function() {checkedRulesChanged($(this))});
     //changeSelected(1);
 });
@@ -0,0 +1,529 @@
+var selected_rule = 0;
+var editing = false;
+
+$(document).ready(function() {
+    $("#acl-selection").change(function(e) {
+	window.location.href = "/acl/" + $(this).val();
+    });
+
+    $("body").keypress(keypressHandler);
+
+    // New ACL.
+    $("#new-acl").keydown(function(e) {
+	if (e.keyCode != 13) { return; }
+	newACL($(this).val());
+    });
+
+    // Delete ACL.
+    $("#delete-acl").click(function() {
+	var acl_id = $("#current-acl").val();
+	doDeleteConfirmed("/acl/" + acl_id, function(){
+	    window.location.href = "/acl/";
+	});
+    });
+
+    // Archive/unarchive ACL.
+    $("#archive-acl").click(function() {
+	var acl_id = $("#current-acl").val();
+	doPost("/acl/" + acl_id + "/archive", {"archived": $(this).data("archived")}, function(){
+	    window.location.reload();
+	});
+    });
+
+    // Rename ACL.
+    $("#rename-acl").click(function() {
+	var acl_id = $("#current-acl").val();
+	var new_name = $("#rename-name").val();
+	doPost("/acl/" + acl_id, {"comment": new_name}, function(){
+	    window.location.reload();
+	});
+    });
+
+    // Enable/disable ACL.
+    $("#acl-enabled").change(function() {
+	var acl_id = $("#current-acl").val();
+	doPost("/acl/" + acl_id + "/enabled", {"enabled": $(this).prop("checked")});
+    });
+
+    // ACL description.
+    $("#acl-description-edit").click(function() {
+	$(this).hide();
+	$("#acl-description-text,#acl-description-save").show();
+    });
+    $("#acl-description-save").click(function() {
+	var acl_id = $("#current-acl").val();
+	doPost("/acl/" + acl_id + "/description", {"description": $("#acl-description-text").val()}, function(resp) {
+	    $("#acl-description").html(resp.html);
+	    $("#acl-description-text,#acl-description-save").hide();
+	    $("#acl-description-edit").text(resp.description ? "Edit description" : "Add description").show();
+	});
+    });
+
+    // ACL schedule.
+    $("#acl-schedule-save").click(function() {
+	var acl_id = $("#current-acl").val();
+	doPost("/acl/" + acl_id + "/schedule", {"schedule": $("#acl-schedule").val()});
+    });
+
+    // Enable/disable rule.
+    $(".acl-rules-enabled").change(function() {
+	var cb = $(this);
+	var rule_id = cb.data("ruleid");
+	doPost("/rule/" + rule_id + "/enabled", {"enabled": cb.prop("checked")}, function() {
+	    $("#acl-rules-row-" + rule_id).toggleClass("acl-rules-disabled", !cb.prop("checked"));
+	});
+    });
+
+    // Rule selection.
+    $("#acl-rules input.checked-rules").change(function() { checkedRulesChanged($(this)); });
+    changeSelected(0);
+    $("#acl-move-selection").on("input", updateActionButtons);
+
+    // Rule editing.
+    var f = function(e) { ruleTextChanged($(this), e); }
+    $("#acl-rules input[type=text],#acl-rules select").change(f);
+    $("#acl-rules input[type=text]").keydown(f);
+    $("#acl-rules input.acl-rules-rule-value").on("input", function() { lintRule($(this).data("ruleid")); });
+    $("#button-save").click(save);
+    $("#button-move").click(move);
+    $("#button-delete").click(delete_button);
+    $("#comment-op").change(commentOpChange);
+    $("#button-comment-preview").click(function() { commentEdit(true); });
+    $("#button-comment-apply").click(function() { commentEdit(false); });
+    commentOpChange();
+
+    // Bulk add.
+    $("#bulk-values,#bulk-comment,#comment-text,#comment-find,#comment-replace,#owner-name,#owner-contact,#acl-description-text").keypress(function(e) { e.stopPropagation(); });
+    $("#bulk-add").click(bulkAdd);
+    $("#bulk-parse").click(bulkParse);
+    $("#bulk-add-selected").click(bulkAddSelected);
+
+    // Rule history.
+    $("#acl-rules a.acl-rules-history").click(function(e) {
+	e.preventDefault();
+	showRuleHistory($(this).data("ruleid"));
+    });
+    $("#rule-history-close").click(function(e) {
+	e.preventDefault();
+	$("#rule-history").hide();
+    });
+
+    updateActionColors();
+});
+
+// Describe the editable parts of a rule, for the history.
+function ruleHistoryValues(v) {
+    var s = v.action + " " + v.type + " " + v.value;
+    if (!v.enabled) {
+	s += " (disabled)";
+    }
+    if (v.comment !== "") {
+	s += "\n" + v.comment;
+    }
+    return s;
+}
+
+// Show the edits of a rule in the history drawer.
+function showRuleHistory(id) {
+    $.getJSON("/rule/" + id + "/history.json", function(resp) {
+	$("#rule-history-rule").text(id).attr("href", "/rule/" + id);
+	var o = $("#rule-history tbody");
+	o.html("");
+	for (var i = 0; i < resp.edits.length; i++) {
+	    var e = resp.edits[i];
+	    var tr = $("<tr></tr>");
+	    tr.append($("<td></td>").text(e.time));
+	    tr.append($("<td></td>").text(e.actor));
+	    tr.append($("<td></td>").text(e.changed.join(", ")));
+	    tr.append($("<td class='rule-history-values'></td>").text(ruleHistoryValues(e.from)));
+	    tr.append($("<td class='rule-history-values'></td>").text(ruleHistoryValues(e.to)));
+	    o.append(tr);
+	}
+	if (resp.edits.length === 0) {
+	    o.append($("<tr><td colspan='5'>No edits recorded.</td></tr>"));
+	}
+	$("#rule-history").show();
+    }).fail(ajaxError);
+}
+
+function updateActionColors() {
+    var o = $("select.acl-rules-rule-action option[value='allow']").parent();
+    o.removeClass("acl-button-block");
+    o.removeClass("acl-button-allow");
+    $("select.acl-rules-rule-action option[value='allow']:selected").parent().addClass("acl-button-allow");
+    $("select.acl-rules-rule-action option[value='ignore']:selected").parent().addClass("acl-button-block");
+}
+
+function delete_button() {
+    var rules = get_all_checked();
+    var data = {"rules": rules};
+    doPost("/rule/delete",
+	   data,
+	   function() {
+	       console.log("Delete successful");
+	       for (var i = 0; i < rules.length; i++) {
+		   $("#acl-rules-row-" + rules[i]).remove();
+		   changeSelected(0);
+	       }
+	   });
+}
+
+function commentOpChange() {
+    var replace = $("#comment-op").val() === "replace";
+    $("#comment-text").toggle(!replace);
+    $("#comment-find,#comment-replace").toggle(replace);
+    $("#comment-regex").parent().toggle(replace);
+}
+
+function commentEdit(preview) {
+    doPost("/rule/comments", {
+	"rules": get_all_checked(),
+	"op": $("#comment-op").val(),
+	"text": $("#comment-text").val(),
+	"find": $("#comment-find").val(),
+	"replace": $("#comment-replace").val(),
+	"regex": $("#comment-regex").is(":checked"),
+	"preview": preview
+    }, function(resp) {
+	if (!preview) {
+	    window.location.reload();
+	    return;
+	}
+	var o = $("#comment-changes tbody");
+	o.html("");
+	for (var i = 0; i < resp.changes.length; i++) {
+	    var c = resp.changes[i];
+	    var tr = $("<tr></tr>");
+	    tr.append($("<td></td>").text(c.type));
+	    tr.append($("<td></td>").text(c.value));
+	    tr.append($("<td></td>").text(c.old));
+	    tr.append($("<td></td>").text(c.new));
+	    o.append(tr);
+	}
+	if (resp.changes.length === 0) {
+	    o.append($("<tr><td colspan='4'>No comments would change.</td></tr>"));
+	}
+	$("#comment-changes").show();
+    });
+}
+
+function get_ruleid_by_index(n) {
+    return $("#acl-rules tbody tr:nth-child("+(selected_rule+1)+") input.checked-rules").data("ruleid");
+}
+
+function save() {
+    var id = get_ruleid_by_index(selected_rule);
+    var data = {
+	"type": $(".acl-rules-rule-type[data-ruleid='"+id+"']").val(),
+	"value": $(".acl-rules-rule-value[data-ruleid='"+id+"']").val(),
+	"action": $(".acl-rules-rule-action[data-ruleid='"+id+"']").val(),
+	"comment": $(".acl-rules-rule-comment[data-ruleid='"+id+"']").val()
+    };
+    doPost("/rule/" + id,
+	   data,
+	   function() {
+	       window.location.reload();
+	   });
+}
+
+function ruleTextChanged(me, e) {
+    var ruleid = me.data("ruleid");
+    if ('keyCode' in e) {
+	if (e.keyCode == 13) {
+	    $("#button-save").click();
+	    return;
+	}
+    }
+
+    // Remove all checkmarks.
+    $("#acl-rules input.checked-rules").prop("checked", false);
+    $("#acl-rules tr").removeClass("selected");
+    updateActionButtons();
+
+    // Disable all but active rule for editing.
+    $("#acl-rules input,#acl-rules select").each(function(index) {
+	if ($(this).data("ruleid") !== ruleid) {
+	    $(this).attr("disabled", "disabled");
+	}
+    });
+
+    // Set active.
+    $("#acl-rules input.checked-rules").each(function(index) {
+	if ($(this).data("ruleid") === ruleid) {
+	    changeSelected(index-selected_rule);
+	}
+    });
+
+    // Enable save button.
+    $("#button-save").removeAttr("disabled");
+    lintRule(ruleid);
+
+    // Disable active-changing.
+    editing = true;
+    updateActionColors();
+}
+
+// Show warnings about the rule being edited, before it's saved.
+function lintRule(id) {
+    var data = {
+	"type": $(".acl-rules-rule-type[data-ruleid='"+id+"']").val(),
+	"value": $(".acl-rules-rule-value[data-ruleid='"+id+"']").val()
+    };
+    $.getJSON("/rule/lint", data, function(resp) {
+	var l = $("#acl-rule-warnings");
+	l.html("");
+	for (var i = 0; i < resp.warnings.length; i++) {
+	    var li = document.createElement("li");
+	    li.innerText = resp.warnings[i].message;
+	    l.append(li);
+	}
+    });
+}
+
+function newACL(name) {
+    doPost("/acl/new",
+	   {"comment": name},
+	   function(resp) {
+	       window.location.href = "/acl/" + resp.acl;
+	   });
+}
+
+function checkedRulesChanged(me) {
+    var ruleid = me.data("ruleid");
+    if (me.prop("checked")) {
+	$("#acl-rules-row-"+ruleid).addClass("selected");
+    } else {
+	$("#acl-rules-row-"+ruleid).removeClass("selected");
+    }
+    updateActionButtons();
+}
+
+function keyCheck() {
+    var o = $("#acl-rules tbody tr:nth-child("+(selected_rule+1)+") input.checked-rules");
+    o.prop("checked", !o.prop("checked"));
+    checkedRulesChanged(o);
+    updateActionButtons();
+}
+
+function updateActionButtons() {
+    var o = $(".button-check-action");
+    if ($(".checked-rules:checked").length > 0) {
+	o.removeAttr("disabled");
+    } else {
+	o.attr("disabled", "disabled");
+    }
+    // Disable 'move' unless the destination names another ACL.
+    if (moveDestination() === "") {
+	$("#button-move").attr("disabled", "disabled");
+    }
+}
+
+function keypressHandler(event) {
+    switch (event.which) {
+    case 106: // 'j'
+	changeSelected(1);
+	break;
+    case 107: // 'k'
+	changeSelected(-1);
+	break;
+    case 120: // 'x'
+	keyCheck();
+	break;
+    default:
+	console.log("Keypress: " + event.which);
+	break;
+    }
+}
+
+function changeSelected(delta) {
+    if (editing) {
+	return;
+    }
+    var o;
+    $("#acl-rules tbody tr:nth-child("+(selected_rule+1)+") td.acl-rules-row-selected").text("");
+    selected_rule += delta;
+    if (selected_rule < 0) {
+	selected_rule = 0;
+    }
+    var c = $("#acl-rules tbody tr").length - 1;
+    if (selected_rule >= c) {
+	selected_rule = c;
+    }
+    o = $("#acl-rules tbody tr:nth-child("+(selected_rule+1)+") td.acl-rules-row-selected");
+    o.text(">");
+    var screen_pos = o[0].getBoundingClientRect().top;
+    var delta = 0;
+    var min = 20;
+    var max = window.innerHeight - 50;
+    if (screen_pos < min) {
+	delta = screen_pos - min;
+    } else if (screen_pos > max) {
+	delta = screen_pos - max;
+    }
+    window.scroll(0, window.scrollY+delta);
+}
+
+function get_all_checked() {
+    var rules = new Array;
+    $(".checked-rules:checked").each(function(index) {
+	rules[index] = $(this).data("ruleid");
+    });
+    return rules;
+}
+
+// Return the ID of the ACL named in the move type-ahead, or "" if it
+// doesn't match exactly one entry.
+function moveDestination() {
+    var name = $("#acl-move-selection").val();
+    var ids = $("#acl-move-list option").filter(function() {
+	return $(this).val() === name;
+    });
+    if (ids.length !== 1) {
+	return "";
+    }
+    return ids.data("aclid");
+}
+
+function move() {
+    var data = {};
+    var rules = get_all_checked();
+    data["source"] = $("#current-acl").val();
+    data["destination"] = moveDestination();
+    data["rules"] = rules;
+    doPost("/acl/move",
+	   data,
+	   function(resp) {
+	       console.log("moved " + resp.moved + " rules");
+	       for (var i = 0; i < rules.length; i++) {
+		   $("#acl-rules-row-" + rules[i]).remove();
+	       }
+	       changeSelected(0);
+	       if (resp.moved !== rules.length) {
+		   alert("Moved " + resp.moved + " of " + rules.length + " rules; the rest were no longer in this ACL.");
+	       }
+	   });
+}
+
+function bulkAdd() {
+    var data = {
+	"acl": $("#current-acl").val(),
+	"type": $("#bulk-type").val(),
+	"action": $("#bulk-action").val(),
+	"comment": $("#bulk-comment").val(),
+	"values": $("#bulk-values").val(),
+	"abort_on_error": $("#bulk-abort").prop("checked")
+    };
+    doPost("/rule/bulk", data, function(resp) {
+	if (resp.rejected === 0 && resp.warned === 0) {
+	    window.location.reload();
+	    return;
+	}
+	showBulkResults(resp);
+    }, function(o) {
+	if (o.responseJSON && o.responseJSON.error && o.responseJSON.error.details) {
+	    showBulkResults(o.responseJSON.error.details);
+	}
+    });
+}
+
+// List rejected values and ones added with warnings.
+function showBulkResults(resp) {
+    var o = $("#bulk-results");
+    o.html("");
+    for (var i = 0; i < resp.results.length; i++) {
+	var res = resp.results[i];
+	if (res.status === "rejected") {
+	    o.append($("<li></li>").text(res.value + ": rejected: " + res.error));
+	} else if (res.status === "warning") {
+	    var w = [];
+	    for (var j = 0; j < res.warnings.length; j++) {
+		w.push(res.warnings[j].message);
+	    }
+	    o.append($("<li></li>").text(res.value + ": added, but " + w.join(" ")));
+	}
+    }
+    if (resp.aborted) {
+	o.append($("<li></li>").text("Nothing was added."));
+    } else {
+	o.append($("<li></li>").text("Added " + resp.created + " rules. Reload to see them."));
+    }
+}
+
+// Show the rules found in the pasted text, for the user to pick from.
+function bulkParse() {
+    doPost("/rule/parse", {"text": $("#bulk-values").val()}, function(resp) {
+	var tbody = $("#bulk-candidates tbody");
+	tbody.html("");
+	for (var i = 0; i < resp.candidates.length; i++) {
+	    var c = resp.candidates[i];
+	    var warnings = [];
+	    for (var j = 0; c.warnings && j < c.warnings.length; j++) {
+		warnings.push(c.warnings[j].message);
+	    }
+	    var cb = $("<input type='checkbox' class='bulk-candidate' checked />");
+	    cb.data("type", c.type);
+	    cb.data("value", c.value);
+	    cb.data("action", c.action || $("#bulk-action").val());
+	    var tr = $("<tr></tr>");
+	    tr.append($("<td></td>").append(cb));
+	    tr.append($("<td></td>").text(c.type));
+	    tr.append($("<td></td>").text(c.value));
+	    tr.append($("<td></td>").text(cb.data("action")));
+	    tr.append($("<td></td>").text(warnings.join(" ")));
+	    tbody.append(tr);
+	}
+	var o = $("#bulk-results");
+	o.html("");
+	for (var i = 0; i < resp.skipped.length; i++) {
+	    o.append($("<li></li>").text("Line " + resp.skipped[i].line + ": " + resp.skipped[i].reason));
+	}
+	var show = resp.candidates.length > 0;
+	$("#bulk-candidates").toggle(show);
+	$("#bulk-add-selected").toggle(show);
+    });
+}
+
+// Add the picked candidates, with one bulk add per type and action.
+function bulkAddSelected() {
+    var batches = {};
+    $(".bulk-candidate:checked").each(function() {
+	var k = $(this).data("type") + " " + $(this).data("action");
+	if (!(k in batches)) {
+	    batches[k] = {
+		"acl": $("#current-acl").val(),
+		"type": $(this).data("type"),
+		"action": $(this).data("action"),
+		"comment": $("#bulk-comment").val(),
+		"values": []
+	    };
+	}
+	batches[k].values.push($(this).data("value"));
+    });
+    var keys = Object.keys(batches);
+    var errors = [];
+    var next = function() {
+	if (keys.length === 0) {
+	    if (errors.length === 0) {
+		window.location.reload();
+		return;
+	    }
+	    var o = $("#bulk-results");
+	    o.html("");
+	    for (var i = 0; i < errors.length; i++) {
+		o.append($("<li></li>").text(errors[i]));
+	    }
+	    o.append($("<li></li>").text("Reload to see added rules."));
+	    return;
+	}
+	doPost("/rule/bulk", batches[keys.shift()], function(resp) {
+	    for (var i = 0; i < resp.results.length; i++) {
+		if (resp.results[i].error) {
+		    errors.push(resp.results[i].value + ": " + resp.results[i].error);
+		}
+	    }
+	    next();
+	});
+    };
+    next();
+}
+
@@ -0,0 +1,26 @@
+$(document).ready(function() {
+    $(".active-kill").click(function() {
+	activeKill($(this).data("client"));
+    });
+    $(".active-block").click(function() {
+	var btn = $(this);
+	doPost("/rule/new", {
+	    "type": btn.data("type"),
+	    "value": btn.data("value"),
+	    "action": "block",
+	    "acl": btn.closest(".active-client").find(".active-acl").val()
+	}, function() {
+	    if ($(".active-kill").length > 0) {
+		activeKill(btn.data("client"));
+	    } else {
+		window.location.reload();
+	    }
+	});
+    });
+});
+
+function activeKill(client) {
+    doPost("/active/kill", {"client": client}, function() {
+	window.location.reload();
+    });
+}
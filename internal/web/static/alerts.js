@@ -0,0 +1,21 @@
+$(document).ready(function() {
+    $("#alert-new-kind").change(function() {
+	$("#alert-new-acl").toggle($(this).val() === "acl-hits");
+    }).change();
+    $("#alert-new").click(function() {
+	doPost("/alerts/new", {
+	    "kind": $("#alert-new-kind").val(),
+	    "acl": $("#alert-new-acl").val(),
+	    "threshold": $("#alert-new-threshold").val(),
+	    "minutes": $("#alert-new-minutes").val(),
+	    "comment": $("#alert-new-comment").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".alert-delete").click(function() {
+	doDelete("/alerts/" + $(this).data("alertid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,33 @@
+var changesLimit = 1000;
+
+$(document).ready(function() {
+    dateRangePicker("#changes-range", "Latest", changesLoad);
+    changesLoad({});
+});
+
+function changesLoad(range) {
+    var l = $("#changes tbody");
+    l.html("");
+    $("#changes-more").text("");
+    $.getJSON("/log/changes", $.extend({"limit": changesLimit}, range), function(data) {
+	for (var i = 0; i < data.length; i++) {
+	    var c = data[i];
+	    var summary = $("<td>");
+	    if (c.link) {
+		summary.append($("<a>").attr("href", c.link).text(c.summary));
+	    } else {
+		summary.text(c.summary);
+	    }
+	    l.append($("<tr>").append(
+		$("<td>").addClass("min").text(c.time),
+		$("<td>").addClass("min").text(c.actor || "-"),
+		summary));
+	}
+	if (data.length == 0) {
+	    l.append($("<tr>").append($("<td>").attr("colspan", 3).text("No changes.")));
+	}
+	if (data.length >= changesLimit) {
+	    $("#changes-more").text("Only the latest " + changesLimit + " are shown. Pick a shorter range to see older ones.");
+	}
+    }).fail(ajaxError);
+}
@@ -0,0 +1,7 @@
+$(document).ready(function() {
+    $("#config-apply").click(function() {
+	doPost("/config/apply", {}, function() {
+	    $("#config-apply").text("Applied");
+	});
+    });
+});
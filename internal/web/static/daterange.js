@@ -0,0 +1,60 @@
+// Date range picker for pages backed by endpoints that take from and to.
+// It offers ranges relative to now, like the last 24 hours, and custom
+// ones, whose times are in the user's time zone.
+
+var dateRangePresets = [
+    ["-1h", "Last hour"],
+    ["-24h", "Last 24 hours"],
+    ["-7d", "Last 7 days"],
+    ["-30d", "Last 30 days"]
+];
+
+// dateRangePicker fills el with a picker. latest names the choice of no
+// range, like "Live". onChange is called with the picked range as query
+// parameters, {} for no range.
+function dateRangePicker(el, latest, onChange) {
+    el = $(el);
+    var preset = $("<select>").addClass("daterange-preset");
+    preset.append($("<option>").attr("value", "").text(latest));
+    $.each(dateRangePresets, function(i, p) {
+	preset.append($("<option>").attr("value", p[0]).text(p[1]));
+    });
+    preset.append($("<option>").attr("value", "custom").text("Custom"));
+    var from = $("<input>").attr("type", "datetime-local").addClass("daterange-from");
+    var to = $("<input>").attr("type", "datetime-local").addClass("daterange-to");
+    var custom = $("<span>").addClass("daterange-custom").css("display", "none")
+	.append(" from ", from, " to ", to, " ");
+    var apply = $("<button>").text("Show");
+    custom.append(apply);
+    el.empty().append(preset, custom);
+
+    function params() {
+	var v = preset.val();
+	if (v === "") {
+	    return {};
+	}
+	if (v !== "custom") {
+	    return {"from": v};
+	}
+	var p = {};
+	if (from.val()) {
+	    p["from"] = from.val();
+	}
+	if (to.val()) {
+	    p["to"] = to.val();
+	}
+	return p;
+    }
+    preset.change(function() {
+	if (preset.val() === "custom") {
+	    custom.css("display", "inline");
+	    return;
+	}
+	custom.css("display", "none");
+	onChange(params());
+    });
+    apply.click(function() {
+	onChange(params());
+    });
+    return params;
+}
@@ -0,0 +1,18 @@
+$(document).ready(function() {
+    var url = "/acl/" + $("#current-acl").val() + "/denypage";
+    $("#denypage-save").click(function() {
+	doPost(url, {
+	    "title": $("#denypage-title").val(),
+	    "body": $("#denypage-body").val(),
+	    "contact": $("#denypage-contact").val(),
+	    "exception_link": $("#denypage-exception-link").prop("checked")
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#denypage-delete").click(function() {
+	doDelete(url, {}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,14 @@
+$(document).ready(function() {
+    $("#digest-subscribe").click(function() {
+	doPost("/digest/subscribe", {
+	    "email": $("#digest-email").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#digest-unsubscribe").click(function() {
+	doDelete("/digest/subscribe", {}, function() {
+	    window.location.reload();
+	});
+    });
+});
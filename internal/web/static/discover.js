@@ -0,0 +1,12 @@
+$(document).ready(function() {
+    $(".discover-add").click(function() {
+	var tr = $(this).closest("tr");
+	var comment = tr.find(".discover-comment").val();
+	doPost("/members/" + tr.find(".discover-group").val() + "/import", {
+	    "sources": [$(this).data("source")],
+	    "comments": [comment],
+	}, function() {
+	    tr.remove();
+	});
+    });
+});
@@ -0,0 +1,19 @@
+$(document).ready(function() {
+    $(".exception-approve").click(function() {
+	var btn = $(this);
+	doPost("/exceptions/" + btn.data("exceptionid") + "/approve", {
+	    "type": btn.data("type"),
+	    "value": btn.data("value"),
+	    "acl": $("#exception-acl").val(),
+	    "expiry": $("#exception-expiry").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".exception-reject").click(function() {
+	var btn = $(this);
+	doPost("/exceptions/" + btn.data("exceptionid") + "/reject", {}, function() {
+	    window.location.reload();
+	});
+    });
+});
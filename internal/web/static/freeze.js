@@ -0,0 +1,16 @@
+$(document).ready(function() {
+    $("#freeze-new").click(function() {
+	doPost("/freeze/new", {
+	    "start": $("#freeze-start").val(),
+	    "duration": $("#freeze-duration").val(),
+	    "reason": $("#freeze-reason").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".freeze-delete").click(function() {
+	doDelete("/freeze/" + $(this).data("freezeid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
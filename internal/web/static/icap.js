@@ -0,0 +1,26 @@
+$(document).ready(function() {
+    $("#icap-new").click(function() {
+	doPost("/icap/new", {
+	    "name": $("#icap-new-name").val(),
+	    "vectoring_point": $("#icap-new-vectoring-point").val(),
+	    "url": $("#icap-new-url").val(),
+	    "bypass": $("#icap-new-bypass").prop("checked"),
+	    "comment": $("#icap-new-comment").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".icap-delete").click(function() {
+	doDelete("/icap/" + $(this).data("icapid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".icap-save").click(function() {
+	var id = $(this).data("icapid");
+	var groups = new Array;
+	$(".icap-group[data-icapid='" + id + "']:checked").each(function() {
+	    groups.push($(this).val());
+	});
+	doPost("/icap/" + id + "/groups", {"groups": groups});
+    });
+});
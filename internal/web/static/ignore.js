@@ -0,0 +1,16 @@
+$(document).ready(function() {
+    $("#ignore-new").click(function() {
+	doPost("/ignore/new", {
+	    "kind": $("#ignore-kind").val(),
+	    "value": $("#ignore-value").val(),
+	    "comment": $("#ignore-comment").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".ignore-delete").click(function() {
+	doDelete("/ignore/" + $(this).data("ignoreid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,14 @@
+$(document).ready(function() {
+    $("#job-new").click(function() {
+	doPost("/jobs/new", {
+	    "kind": $("#job-kind").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".job-retry").click(function() {
+	doPost("/jobs/" + $(this).data("jobid") + "/retry", {}, function() {
+	    window.location.reload();
+	});
+    });
+});
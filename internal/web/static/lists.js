@@ -0,0 +1,52 @@
+$(document).ready(function() {
+    $("#lists-import").click(function() {
+	doPost("/lists/import", {
+	    "acl": $("#lists-acl").val(),
+	    "format": $("#lists-format").val(),
+	    "action": $("#lists-action").val(),
+	    "list": $("#lists-import-text").val()
+	}, function(data) {
+	    $("#lists-import-result").text(data.entries + " entries, " + data.added + " rules added");
+	});
+    });
+    $("#lists-subscribe").click(function() {
+	doPost("/lists/subscribe", {
+	    "acl": $("#lists-acl").val(),
+	    "format": $("#lists-format").val(),
+	    "action": $("#lists-action").val(),
+	    "url": $("#lists-new-url").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".lists-sync").click(function() {
+	doPost("/lists/" + $(this).data("listid") + "/sync", {}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".lists-delete").click(function() {
+	doDelete("/lists/" + $(this).data("listid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#threats-new").click(function() {
+	doPost("/threats/new", {
+	    "name": $("#threats-new-name").val(),
+	    "url": $("#threats-new-url").val(),
+	    "format": $("#threats-new-format").val(),
+	    "ttl_days": $("#threats-new-ttl").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".threats-sync").click(function() {
+	doPost("/threats/" + $(this).data("feedid") + "/sync", {}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".threats-delete").click(function() {
+	doDelete("/threats/" + $(this).data("feedid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
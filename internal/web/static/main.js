@@ -7,13 +7,45 @@ $(document).ready(function() {
     } else {
 	$("button#pause-scroll").css("display", "none");
 	$("button#refresh-tail").css("display", "inline-block");
-	$("button#refresh-tail").click(refreshTail);
+	$("button#refresh-tail").click(function() {
+	    refreshTail(tailRangeParams());
+	});
 	refreshTail();
     }
     $("#action").change(actionChange);
     actionChange();
+    tailRangeParams = dateRangePicker("#tail-range", "Latest", tailRange);
+    $("#tail-count").change(function() {
+	tailRange(tailRangeParams());
+    });
 });
 
+// tailCount returns how many blocked URLs to show.
+function tailCount() {
+    return $("#tail-count").val() || 30;
+}
+
+// tailRangeParams returns the picked range.
+var tailRangeParams;
+
+// tailRange shows the blocked URLs of a range, instead of streaming, or
+// goes back to the latest ones if none is picked.
+function tailRange(range) {
+    var streaming = window.WebSocket && $("#websockets").val() == "true";
+    if (streaming && wsTail) {
+	wsTail.onclose = function(){}
+	wsTail.close();
+    }
+    var live = $.isEmptyObject(range);
+    $("button#pause-scroll").prop("disabled", !live);
+    if (live && streaming && $("button#pause-scroll").data("paused") != true) {
+	$("#latest tbody").html("");
+	streamTail();
+	return;
+    }
+    refreshTail(range);
+}
+
 function actionChange() {
     if ($("#action").val() === "allow") {
 	$(".acl-buttons button").removeClass("acl-button-block");
@@ -35,7 +67,7 @@ function openWebsocket(path) {
 
 var wsTail;
 function streamTail() {
-    wsTail = openWebsocket("/ajax/tail-log/stream");
+    wsTail = openWebsocket("/ajax/tail-log/stream?count=" + tailCount());
     wsTail.onopen = function() {
 	console.log("Tail log open");
 	$("#latest tbody").html("");
@@ -51,6 +83,11 @@ function streamTail() {
     wsTail.onmessage = function(evt) {
 	var data = JSON.parse(evt.data);
 	var l = $("#latest tbody");
+	if (data.Skipped !== undefined) {
+	    // Fell behind, and the server skipped ahead.
+	    l.prepend($("<tr>").append($("<td>").attr("colspan", 7).text("Skipped " + Math.round(data.Skipped / 1024) + " KiB of log to catch up.")));
+	    return;
+	}
 	l.prepend(tailLogRow(data));
 	$("#initial-loading").css("display", "none");
 	actionChange();
@@ -76,13 +113,14 @@ function tailLogRow(data) {
     ul = document.createElement("ul");
     ul.classList = ["buttons acl-buttons"];
     type = (data.Method == "CONNECT") ? "https-domain" : "domain";
-    ul.appendChild(createButtonLI("Domain", {type: type, value: data.Domain}, data.Domain));
-    ul.appendChild(createButtonLI("Host", {type: type, value: data.Host}, data.Host));
+    var origin = {log_time: data.Time, log_client: data.Client, log_url: data.URL};
+    ul.appendChild(createButtonLI("Domain", $.extend({type: type, value: data.Domain}, origin), data.Domain));
+    ul.appendChild(createButtonLI("Host", $.extend({type: type, value: data.Host}, origin), data.Host));
     if (data.Method != "CONNECT") {
-	ul.appendChild(createButtonLI("Path", {
+	ul.appendChild(createButtonLI("Path", $.extend({
 	    type: "exact",
 	    value: data.URL,
-	}, data.URL));
+	}, origin), data.URL));
     }
     td.appendChild(ul);
     tr.appendChild(td);
@@ -125,10 +163,11 @@ function pauseScroll() {
     }
 }
 
-function refreshTail() {
+function refreshTail(range) {
     var l = $("#latest tbody");
     l.html("");
-    $.getJSON("/ajax/tail-log", function(data) {
+    var params = $.extend({"count": tailCount()}, range);
+    $.getJSON("/ajax/tail-log", params, function(data) {
         for (var i = 0; i < data.length; i++) {
 	    l.append(tailLogRow(data[i]));
 	}
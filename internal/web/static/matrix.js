@@ -0,0 +1,10 @@
+$(document).ready(function() {
+    $(".matrix-access").change(function() {
+	var cb = $(this);
+	doPost("/matrix/" + cb.data("groupid") + "/" + cb.data("aclid"), {
+	    "access": cb.prop("checked")
+	}, function() {}, function() {
+	    cb.prop("checked", !cb.prop("checked"));
+	});
+    });
+});
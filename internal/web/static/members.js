@@ -17,14 +17,37 @@ $(document).ready(function() {
 	    window.location.href = "/members/";
 	});
     });
+    $("#group-default").change(function() {
+	doPost($(this).data("url"), {"default": $(this).is(":checked")}, function() {});
+    });
+    $("#quic-block").change(function() {
+	doPost($(this).data("url"), {"block": $(this).is(":checked")}, function() {});
+    });
+    $("#import-parse").click(function() {
+	doPost("/sources/parse", {"text": $("#import-text").val()}, showImportCandidates);
+    });
+    $("#import-leases").click(function() {
+	$.getJSON("/sources/leases", showImportCandidates);
+    });
+    $("#import-save").click(btnImport);
     $("#action-save").click(btnSave);
     $("#action-new").click(btnCreate);
+    $(".members-expires").keydown(function(e) {
+	if (e.keyCode != 13) { return; }
+	var group_id = $("#members-group-selection").val();
+	doPost("/members/"+group_id+"/expiry", {
+	    "source": $(this).data("sourceid"),
+	    "expires": $(this).val(),
+	}, function() {
+	    window.location.reload();
+	});
+    });
     $(".action-delete").click(btnDelete);
 });
 
 function btnDelete() {
     var sourceID = $(this).data("sourceid");
-    doDelete("/source/" + sourceID, {}, function() {
+    doDeleteConfirmed("/source/" + sourceID, function() {
 	$("#members-row-"+sourceID).remove();
     });
 }
@@ -48,6 +71,7 @@ function btnCreate() {
 	"source": $("#new-member-addr").val(),
 	"source-comment": $("#new-member-source").val(),
 	"comment": $("#new-member-comment").val(),
+	"expires": $("#new-member-expires").val(),
     }, function() {
 	console.log("Success!");
 	window.location.reload();
@@ -55,11 +79,16 @@ function btnCreate() {
 }
 
 function newGroup(name) {
-    doPost("/group/new",
-	   {"comment": name},
-	   function(resp) {
-	       window.location.href = "/members/" + resp.group;
-	   });
+    var template = $("#new-group-template").val();
+    var url = "/group/new";
+    var data = {"comment": name};
+    if (template !== "") {
+	url = "/group/new/template";
+	data["template"] = template;
+    }
+    doPost(url, data, function(resp) {
+	window.location.href = "/members/" + resp.group;
+    });
 }
 
 function btnSave() {
@@ -93,3 +122,41 @@ function btnSave() {
 	       });
 	   });
 }
+
+// Show sources suggested from leases or neighbours, new ones selected.
+function showImportCandidates(resp) {
+    var tbody = $("#import-candidates tbody");
+    tbody.html("");
+    for (var i = 0; i < resp.candidates.length; i++) {
+	var c = resp.candidates[i];
+	var tr = $("<tr>");
+	var cb = $("<input type='checkbox' class='import-checked' />").data("source", c.source).prop("checked", !c.existing);
+	tr.append($("<td>").append(cb));
+	tr.append($("<td>").text(c.source));
+	tr.append($("<td>").append($("<input type='text' class='import-comment' />").val(c.comment)));
+	tr.append($("<td>").text(c.mac));
+	var existing = $("<td>");
+	if (c.existing) {
+	    existing.append($("<a>").attr("href", "/source/" + c.existing).text(c.existing));
+	}
+	tr.append(existing);
+	tbody.append(tr);
+    }
+    $("#import-save").prop("disabled", resp.candidates.length == 0);
+}
+
+function btnImport() {
+    var group_id = $("#current-group").val();
+    var sources = new Array;
+    var comments = new Array;
+    $(".import-checked:checked").each(function(index) {
+	sources[index] = $(this).data("source");
+	comments[index] = $(this).closest("tr").find(".import-comment").val();
+    });
+    doPost("/members/" + group_id + "/import", {
+	"sources": sources,
+	"comments": comments,
+    }, function() {
+	window.location.reload();
+    });
+}
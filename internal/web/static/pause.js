@@ -0,0 +1,14 @@
+$(document).ready(function() {
+    $(".pause-pause").click(function() {
+	doPost("/pause/" + $(this).data("groupid"), {
+	    "duration": $("#pause-duration").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".pause-resume").click(function() {
+	doDelete("/pause/" + $(this).data("groupid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
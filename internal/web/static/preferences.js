@@ -0,0 +1,29 @@
+$(document).ready(function() {
+    if (Intl.supportedValuesOf) {
+	var list = $("#prefs-zones");
+	$.each(Intl.supportedValuesOf("timeZone"), function(i, z) {
+	    list.append($("<option>").attr("value", z));
+	});
+    }
+    var browser = Intl.DateTimeFormat().resolvedOptions().timeZone;
+    if (browser) {
+	$("#prefs-browser-zone").text("Use your browser's, " + browser + ".").click(function(e) {
+	    e.preventDefault();
+	    $("#prefs-zone").val(browser);
+	});
+    }
+    $("#prefs-zone-save").click(function() {
+	doPost("/preferences/timezone", {
+	    "zone": $("#prefs-zone").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#prefs-deployment-zone-save").click(function() {
+	doPost("/config/timezone", {
+	    "zone": $("#prefs-deployment-zone").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,66 @@
+// promotionRecord shows a row of a table, without the table name.
+function promotionRecord(rec) {
+    if (!rec) {
+	return "";
+    }
+    var parts = [];
+    $.each(rec, function(k, v) {
+	if (k != "table") {
+	    parts.push(k + "=" + JSON.stringify(v));
+	}
+    });
+    return parts.join(" ");
+}
+
+// showPromotionDiff compares a promotion with the current policy, and
+// sets up approving it as of the revision compared with.
+function showPromotionDiff(id, source) {
+    $.getJSON("/promotion/" + id + "/diff.json", function(data) {
+	$("#promotion-diff-title").text("Policy from " + source + " compared with revision " + data.revision + ": " + data.changes.length + " changes");
+	var problems = $("#promotion-problems").empty();
+	$.each(data.problems, function(n, p) {
+	    problems.append($("<li>").text(p));
+	});
+	var rows = $("#promotion-diff-rows").empty();
+	$.each(data.changes, function(n, c) {
+	    rows.append($("<tr>")
+			.append($("<td>").addClass("min").text(c.table))
+			.append($("<td>").addClass("min fixed").text(c.key))
+			.append($("<td>").addClass("min").text(c.change))
+			.append($("<td>").addClass("fixed").text(promotionRecord(c.old)))
+			.append($("<td>").addClass("fixed").text(promotionRecord(c.new))));
+	});
+	$("#promotion-approve").prop("disabled", data.problems.length > 0).off("click").click(function() {
+	    if (!confirm("Replace the policy with the one from " + source + "?")) {
+		return;
+	    }
+	    doPost("/promotion/" + id + "/approve", {"revision": data.revision}, function() {
+		window.location.reload();
+	    });
+	});
+	$("#promotion-reject").off("click").click(function() {
+	    doPost("/promotion/" + id + "/reject", {}, function() {
+		window.location.reload();
+	    });
+	});
+	$("#promotion-diff").show();
+    }).fail(function(xhr) {
+	alert("Comparing failed: " + xhr.responseText);
+    });
+}
+
+$(document).ready(function() {
+    $("#promotion-pull").click(function() {
+	doPost("/promotions/pull", {}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#promotion-send").click(function() {
+	doPost("/promotions/send", {}, function(p) {
+	    alert("Pushed " + p.records + " records, waiting for approval there.");
+	});
+    });
+    $(".promotion-diff").click(function() {
+	showPromotionDiff($(this).data("promotion"), $(this).data("source"));
+    });
+});
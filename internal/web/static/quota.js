@@ -0,0 +1,25 @@
+$(document).ready(function() {
+    $("#quota-new").click(function() {
+	doPost("/quota/new", {
+	    "group": $("#quota-new-group").val(),
+	    "acl": $("#quota-new-acl").val(),
+	    "kind": $("#quota-new-kind").val(),
+	    "limit": $("#quota-new-limit").val(),
+	    "comment": $("#quota-new-comment").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".quota-delete").click(function() {
+	doDelete("/quota/" + $(this).data("quotaid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".quota-reset").click(function() {
+	doPost("/quota/" + $(this).data("quotaid") + "/reset", {
+	    "client": $(this).data("client")
+	}, function() {
+	    window.location.reload();
+	});
+    });
+});
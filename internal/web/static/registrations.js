@@ -0,0 +1,32 @@
+$(document).ready(function() {
+    $(".registration-approve").click(function() {
+	var tr = $(this).closest("tr");
+	doPost("/registrations/" + tr.data("registrationid") + "/approve", {
+	    "group": tr.find(".registration-group").val(),
+	    "expires": tr.find(".registration-expires").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".registration-reject").click(function() {
+	var tr = $(this).closest("tr");
+	doPost("/registrations/" + tr.data("registrationid") + "/reject", {}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#code-new").click(function() {
+	doPost("/registrations/codes/new", {
+	    "group": $("#code-group").val(),
+	    "comment": $("#code-comment").val(),
+	    "expires": $("#code-expires").val(),
+	    "uses": $("#code-uses").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".code-delete").click(function() {
+	doDelete("/registrations/codes/" + $(this).data("codeid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,37 @@
+// showReputation fills in the risk of each host in the queue.
+function showReputation() {
+    $(".reputation").each(function() {
+	var el = $(this);
+	$.getJSON("/site/" + encodeURIComponent(el.data("domain")) + "/reputation.json", function(rep) {
+	    var title = $.map(rep.sources, function(s) {
+		return s.source + ": " + s.score + (s.label ? " (" + s.label + ")" : "");
+	    }).concat(rep.errors || []).join("\n");
+	    el.addClass("reputation-" + rep.level)
+		.text(rep.score < 0 ? "?" : rep.level + " " + rep.score)
+		.attr("title", title || "No source knows this host");
+	});
+    });
+}
+
+$(document).ready(function() {
+    showReputation();
+    $(".review-convert").click(function() {
+	var btn = $(this);
+	doPost("/review/convert", {
+	    "type": btn.data("type"),
+	    "value": btn.data("value"),
+	    "action": $("#review-action").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".review-dismiss").click(function() {
+	var btn = $(this);
+	doPost("/review/dismiss", {
+	    "hosts": [btn.data("host")],
+	    "types": [btn.data("type")]
+	}, function() {
+	    btn.closest("tr").remove();
+	});
+    });
+});
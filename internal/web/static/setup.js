@@ -0,0 +1,33 @@
+$(document).ready(function() {
+    $("#setup-schema").click(function() {
+	doPost("/setup/schema", {}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#setup-admin").click(function() {
+	doPost("/setup/admin", {}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#setup-squidlog-save").click(function() {
+	doPost("/setup/squidlog", {
+	    "path": $("#setup-squidlog").val(),
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#setup-group-create").click(function() {
+	doPost("/setup/group", {
+	    "comment": $("#setup-group").val(),
+	    "source": $("#setup-source").val(),
+	    "template": $("#setup-template").val(),
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $("#setup-finish").click(function() {
+	doPost("/setup/finish", {}, function() {
+	    window.location.href = "/";
+	});
+    });
+});
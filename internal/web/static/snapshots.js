@@ -0,0 +1,95 @@
+// snapshotRecord shows a row of a table, without the table name.
+function snapshotRecord(rec) {
+    if (!rec) {
+	return "";
+    }
+    var parts = [];
+    $.each(rec, function(k, v) {
+	if (k != "table") {
+	    parts.push(k + "=" + JSON.stringify(v));
+	}
+    });
+    return parts.join(" ");
+}
+
+function showSnapshotDiff(id, name) {
+    var to = $("#snapshot-to");
+    $.getJSON("/snapshot/" + id + "/diff.json", {"to": to.val()}, function(data) {
+	var toName = to.val() == "current" ? "the current configuration" : data.to;
+	$("#snapshot-diff-title").text(name + " compared with " + toName + ": " + data.changes.length + " changes");
+	var rows = $("#snapshot-diff-rows").empty();
+	$.each(data.changes, function(n, c) {
+	    rows.append($("<tr>")
+			.append($("<td>").addClass("min").text(c.table))
+			.append($("<td>").addClass("min fixed").text(c.key))
+			.append($("<td>").addClass("min").text(c.change))
+			.append($("<td>").addClass("fixed").text(snapshotRecord(c.old)))
+			.append($("<td>").addClass("fixed").text(snapshotRecord(c.new))));
+	});
+	$("#snapshot-diff").show();
+    }).fail(function(xhr) {
+	alert("Comparing failed: " + xhr.responseText);
+    });
+}
+
+// importSnapshot imports from the selected snapshot, or the file.
+function importSnapshot() {
+    var post = function(data) {
+	data.suffix = $("#snapshot-import-suffix").val();
+	doPost("/snapshots/import", data, function(resp) {
+	    var list = $("#snapshot-imported").empty();
+	    $.each(resp.acls, function(n, a) {
+		list.append($("<li>")
+			    .append($("<a>").attr("href", "/acl/" + a.acl).text(a.name))
+			    .append(document.createTextNode(": " + a.rules + " rules, " + a.new_rules + " of them new")));
+	    });
+	});
+    };
+    var from = $("#snapshot-import-from").val();
+    if (from) {
+	post({"snapshot": from});
+	return;
+    }
+    var file = $("#snapshot-import-file")[0].files[0];
+    if (!file) {
+	alert("Pick a snapshot or a file to import.");
+	return;
+    }
+    var reader = new FileReader();
+    reader.onload = function() {
+	post({"data": reader.result});
+    };
+    reader.readAsText(file);
+}
+
+$(document).ready(function() {
+    $("#snapshot-import").click(importSnapshot);
+    $("#snapshot-new").click(function() {
+	doPost("/snapshots/new", {
+	    "name": $("#snapshot-name").val(),
+	    "comment": $("#snapshot-comment").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".snapshot-diff").click(function() {
+	showSnapshotDiff($(this).data("snapshot"), $(this).data("name"));
+    });
+    $(".snapshot-restore").click(function() {
+	var btn = $(this);
+	if (!confirm("Replace the whole configuration with snapshot " + btn.data("name") + "?")) {
+	    return;
+	}
+	doPost("/snapshot/" + btn.data("snapshot") + "/restore", {}, function() {
+	    window.location.reload();
+	});
+    });
+    $(".snapshot-delete").click(function() {
+	if (!confirm("Delete this snapshot? It can't be undone.")) {
+	    return;
+	}
+	doDelete("/snapshot/" + $(this).data("snapshot"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,236 @@
+function loading(b) {
+    if (b) {
+	$("#loading-window").css("display", "block");
+    } else {
+	$("#loading-window").css("display", "none");
+    }
+}
+
+// The latest revision this tab knows about, and how many of its own
+// writes are in flight. Writes return the revision they made in
+// X-Revision, so that the tab's own revision bumps don't trigger the
+// "changed by someone else" banner, but other tabs' do.
+var knownRevision = 0;
+var writesInFlight = 0;
+var eventRevision = 0;
+
+function writeStarted() {
+    writesInFlight++;
+}
+
+function writeDone(xhr) {
+    writesInFlight--;
+    var rev = xhr ? parseInt(xhr.getResponseHeader("X-Revision"), 10) : NaN;
+    if (rev == knownRevision + 1) {
+	// Nobody else changed anything in between.
+	knownRevision = rev;
+    }
+    checkRevision();
+}
+
+// checkRevision shows the banner if the policy is at a revision this tab
+// didn't make. It waits for the tab's writes, so that their events don't
+// count if they arrive before the responses.
+function checkRevision() {
+    if (writesInFlight > 0 || eventRevision <= knownRevision) {
+	return;
+    }
+    knownRevision = eventRevision;
+    $("#revision-banner").css("display", "block");
+}
+
+function doPost(url, data, success, fail) {
+    loading(true);
+    writeStarted();
+    $.ajax({
+	method: "POST",
+	url: url,
+	data: data,
+	dataType: "json",
+	"success": function(data, status, xhr) {
+	    loading(false);
+	    writeDone(xhr);
+	    if (success != undefined) { success(data); }
+	},
+	"error": function(o, text, error) {
+	    console.log("POST failed");
+	    loading(false);
+	    writeDone(null);
+	    ajaxError(o, text, error);
+	    if (fail != undefined) { fail(o, text, error); }
+	}
+    });
+}
+
+function doDelete(url, indata, success, fail) {
+    // We need *some* data or the content-type doesn't get set.
+    var data = $.extend({"dummy": ""}, indata);
+    loading(true);
+    writeStarted();
+    $.ajax({
+	method: "DELETE",
+	url: url,
+	data: data,
+	"success": function(data, status, xhr) {
+	    loading(false);
+	    writeDone(xhr);
+	    console.log("DELETE success", success);
+	    if (success != undefined) { success(); }
+	},
+	"error": function(o, text, error) {
+	    console.log("DELETE failed", o, text, error);
+	    loading(false);
+	    writeDone(null);
+	    ajaxError(o, text, error);
+	    if (fail != undefined) { fail(o, text, error); }
+	}
+    });
+}
+
+// doDeleteConfirmed shows what deleting url would take with it, and
+// deletes with the confirm token if the user agrees.
+function doDeleteConfirmed(url, success) {
+    $.getJSON(url + "/impact.json", function(im) {
+	var msg = "Delete " + im.kind + " \"" + im.name + "\"?\n";
+	if (im.groups.length > 0) {
+	    msg += "\nGroups affected: " + im.groups.join(", ");
+	}
+	if (im.kind == "acl") {
+	    msg += "\nRules: " + im.rules + ", of which " + im.orphaned + " are in no other ACL and will be deleted";
+	    if (im.quotas > 0) {
+		msg += "\nQuotas deleted: " + im.quotas;
+	    }
+	}
+	msg += "\nRequests in the last week: " + im.requests;
+	if (!confirm(msg)) {
+	    return;
+	}
+	// DELETE bodies aren't parsed, so it goes in the URL.
+	doDelete(url + "?confirm=" + encodeURIComponent(im.confirm), {}, success);
+    }).fail(ajaxError);
+}
+
+function ajaxError(o, text, error) {
+    var title;
+    var msg;
+    var links = new Array;
+    if (o.readyState == 0) {
+	msg = "Network error";
+	title = msg;
+    } else if (o.readyState == 4) {
+	title = error;
+	msg = error;
+	if (o.responseJSON && o.responseJSON.error) {
+	    var e = o.responseJSON.error;
+	    msg = e.message;
+	    if (e.links) {
+		links = e.links;
+	    }
+	    if (e.request_id) {
+		console.log("Request ID of error: " + e.request_id);
+	    }
+	}
+    } else {
+	title = "Unknown error";
+	msg = "unknown error type for readyState " + o.readyState;
+    }
+    if (links.length > 0) {
+	$("#error-window-links-header").css("display", "block");
+	var o = $("#error-window-links");
+	o.html("");
+	for (var i = 0; i < links.length; i++) {
+	    var a = $("<a></a>");
+	    a.prop("href", links[i].link);
+	    a.text(links[i].text);
+	    var li = $("<li></li>");
+	    li.append(a);
+	    o.append(li);
+	}
+    } else {
+	$("#error-window-links-header").css("display", "none");
+    }
+    $("#error-window-title").text(title);
+    $("#error-window-body").text(msg);
+    $("#error-window").css("display", "block");
+    $("#error-window-close").focus();
+    return msg;
+}
+
+$(document).ready(function() {
+    $.ajaxPrefilter(function (options, originalOptions, jqXHR) {
+	jqXHR.setRequestHeader('X-CSRF-Token', $("#csrf").val());
+	var reason = window.sessionStorage.getItem("break-glass");
+	if (reason && $("#freeze-banner").length) {
+	    jqXHR.setRequestHeader('X-Break-Glass', reason);
+	}
+    });
+    // Change freeze override, for this tab, for admins.
+    $("#break-glass-reason").text(window.sessionStorage.getItem("break-glass") ? "Glass broken in this tab." : "");
+    $("#break-glass").click(function() {
+	var reason = prompt("Why do you need to make changes during the freeze? This is logged.");
+	if (reason) {
+	    window.sessionStorage.setItem("break-glass", reason);
+	    $("#break-glass-reason").text("Glass broken in this tab.");
+	}
+    });
+    $("#error-window-close").click(function(){
+	$("#error-window").css("display", "none");
+    });
+    // Pin ACL or group to the top of the menu.
+    $("button.pin").click(function() {
+	var b = $(this);
+	doPost("/pin/" + b.data("kind") + "/" + b.data("id"), {"pinned": !b.data("pinned")}, function() {
+	    window.location.reload();
+	});
+    });
+    // Owner of ACL or group.
+    $("#owner-save").click(function() {
+	doPost($(this).data("url"), {
+	    "owner": $("#owner-name").val(),
+	    "contact": $("#owner-contact").val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
+    watchRevision();
+    siteInfo();
+});
+
+// siteInfo adds favicons and titles to .site-info elements, whose
+// data-domain is a host or domain rule value.
+var siteInfoCache = {};
+function siteInfo() {
+    $(".site-info").each(function() {
+	var el = $(this);
+	var domain = String(el.data("domain")).replace(/^\./, "");
+	if (!domain) {
+	    return;
+	}
+	if (!siteInfoCache[domain]) {
+	    siteInfoCache[domain] = $.getJSON("/site/" + encodeURIComponent(domain) + "/info.json");
+	}
+	siteInfoCache[domain].done(function(info) {
+	    if (info.icon) {
+		el.append($("<img>").addClass("site-icon").attr("src", info.icon).attr("alt", ""));
+	    }
+	    if (info.title) {
+		el.attr("title", info.title);
+		if (el.data("showtitle")) {
+		    el.append($("<span>").addClass("site-title").text(info.title));
+		}
+	    }
+	});
+    });
+}
+
+function watchRevision() {
+    if (!window.EventSource) {
+	return;
+    }
+    knownRevision = parseInt($("#revision").val(), 10);
+    var es = new EventSource("/ajax/events");
+    es.addEventListener("revision", function(evt) {
+	eventRevision = Math.max(eventRevision, JSON.parse(evt.data).revision);
+	checkRevision();
+    });
+}
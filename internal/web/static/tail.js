@@ -0,0 +1,155 @@
+// Compact, newest first tail log. Older entries are loaded when scrolling
+// to the bottom, and newer ones are polled for.
+
+var tailNext = "";     // Cursor for older entries. Empty when at the start.
+var tailNewest = -1;   // Offset of the newest entry shown.
+var tailLoading = false;
+var tailRange = {};    // Picked date range, or {} for the latest entries.
+
+$(document).ready(function() {
+    $("#tail-denied").change(tailReset);
+    $("#tail-group").change(tailReset);
+    dateRangePicker("#tail-range", "Latest", function(range) {
+	tailRange = range;
+	tailReset();
+    });
+    $(window).scroll(function() {
+	if ($(window).scrollTop() + $(window).height() > $(document).height() - 200) {
+	    tailOlder();
+	}
+    });
+    tailReset();
+    setInterval(tailNewer, 10000);
+});
+
+function tailParams(extra) {
+    var p = {"denied": $("#tail-denied").is(":checked") ? "true" : "false"};
+    if ($("#tail-group").is(":checked")) {
+	p["group"] = "domain";
+    }
+    return $.extend(p, tailRange, extra);
+}
+
+function tailReset() {
+    tailNext = "";
+    tailNewest = -1;
+    $("#tail-entries").html("");
+    tailLoad({});
+}
+
+function tailOlder() {
+    if (tailNext === "") {
+	return;
+    }
+    tailLoad({"before": tailNext});
+}
+
+function tailNewer() {
+    // Entries of a picked range don't change.
+    if (tailLoading || tailNewest < 0 || !$.isEmptyObject(tailRange)) {
+	return;
+    }
+    $.getJSON("/ajax/tail-log/page", tailParams({}), function(data) {
+	var fresh = [];
+	for (var i = 0; i < data.entries.length; i++) {
+	    if (parseInt(data.entries[i].o, 10) <= tailNewest) {
+		break;
+	    }
+	    fresh.push(data.entries[i]);
+	}
+	for (var i = fresh.length - 1; i >= 0; i--) {
+	    $("#tail-entries").prepend(tailRow(fresh[i]));
+	}
+	if (fresh.length > 0) {
+	    tailNewest = parseInt(fresh[0].o, 10);
+	}
+    });
+}
+
+function tailLoad(params) {
+    if (tailLoading) {
+	return;
+    }
+    tailLoading = true;
+    $("#tail-more").css("display", "block");
+    $.getJSON("/ajax/tail-log/page", tailParams(params), function(data) {
+	tailLoading = false;
+	var l = $("#tail-entries");
+	for (var i = 0; i < data.entries.length; i++) {
+	    l.append(tailRow(data.entries[i]));
+	}
+	if (tailNewest < 0 && data.entries.length > 0) {
+	    tailNewest = parseInt(data.entries[0].o, 10);
+	}
+	tailNext = data.next || "";
+	if (tailNext === "") {
+	    $("#tail-more").css("display", "none");
+	}
+    }).fail(function(o, text, error) {
+	tailLoading = false;
+	$("#tail-more").css("display", "none");
+	ajaxError(o, text, error);
+    });
+}
+
+function tailRow(e) {
+    var li = document.createElement("li");
+    if (e.s.indexOf("DENIED") >= 0) {
+	li.classList.add("tail-denied");
+	var type = (e.m == "CONNECT") ? "https-domain" : "domain";
+	li.appendChild(tailButton("Allow", {
+	    type: type,
+	    value: e.d,
+	    action: "allow",
+	    log_time: e.t,
+	    log_client: e.c,
+	    log_url: e.u
+	}));
+    }
+    var host = document.createElement("div");
+    host.classList.add("tail-host");
+    host.innerText = e.h;
+    li.appendChild(host);
+    var meta = document.createElement("div");
+    meta.classList.add("tail-meta");
+    meta.innerText = e.t + " " + e.c + " " + e.m;
+    li.appendChild(meta);
+    if (e.g) {
+	tailGroup(li, host, e);
+    }
+    return li;
+}
+
+// tailGroup adds a counter to the row of a burst of requests to one domain,
+// which shows the rest of them when tapped.
+function tailGroup(li, host, e) {
+    host.innerText = e.d;
+    var count = document.createElement("span");
+    count.classList.add("tail-count");
+    count.innerText = e.g.length + 1;
+    host.appendChild(count);
+    var details = document.createElement("ul");
+    details.classList.add("tail-group");
+    $.each([e].concat(e.g), function(i, g) {
+	var d = document.createElement("li");
+	d.innerText = g.t + " " + g.c + " " + g.m + " " + g.u;
+	details.appendChild(d);
+    });
+    li.appendChild(details);
+    host.onclick = function() {
+	$(details).toggle();
+    };
+}
+
+function tailButton(name, data) {
+    var button = document.createElement("button");
+    button.innerText = name;
+    button.title = data.value;
+    button.onclick = function() {
+	doPost("/rule/new", data, function(resp) {
+	    button.innerText = "Added";
+	    button.disabled = true;
+	});
+    };
+    return button;
+}
@@ -0,0 +1,37 @@
+$(document).ready(function() {
+    $("#token-new").click(function() {
+	var scopes = [];
+	$(".token-scope:checked").each(function() {
+	    scopes.push($(this).val());
+	});
+	doPost("/tokens/new", {
+	    "name": $("#token-name").val(),
+	    "permission": $("#token-permission").val(),
+	    "scopes": scopes,
+	    "acls": $("#token-acls").val() || []
+	}, function(data) {
+	    $("#token-value").text(data.token);
+	    $("#token-created").show();
+	    $("#token-name").val("");
+	});
+    });
+    $(".token-rotate").click(function() {
+	if (!confirm("Rotate this token? The old secret stops working after the overlap.")) {
+	    return;
+	}
+	doPost("/tokens/" + $(this).data("tokenid") + "/rotate", {
+	    "overlap": $("#token-overlap").val()
+	}, function(data) {
+	    $("#token-value").text(data.token);
+	    $("#token-created").show();
+	});
+    });
+    $(".token-delete").click(function() {
+	if (!confirm("Revoke this token? Scripts using it will stop working.")) {
+	    return;
+	}
+	doDelete("/tokens/" + $(this).data("tokenid"), {}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,137 @@
+var triageOffset = 0;
+var triageEntry = null;
+var triageType = "";
+var triageUseHost = false;
+var triagePending = new Array;
+
+$(document).ready(function() {
+    $("body").keypress(triageKeypress);
+    $("#triage-commit").click(triageCommit);
+    triageNext();
+});
+
+function triageValue() {
+    if (triageEntry === null) {
+	return "";
+    }
+    return triageUseHost ? triageEntry.Host : triageEntry.Domain;
+}
+
+function triageSkipList() {
+    var skip = new Array;
+    for (var i = 0; i < triagePending.length; i++) {
+	skip.push(triagePending[i].domain);
+    }
+    return skip;
+}
+
+function triageNext() {
+    $.getJSON("/triage/next", {"offset": triageOffset, "skip": triageSkipList()}, function(data) {
+	triageOffset = data.offset;
+	triageEntry = data.entry;
+	triageType = data.type;
+	triageUseHost = false;
+	triageShow();
+    }).fail(function(o, text, error) {
+	ajaxError(o, text, error);
+    });
+}
+
+function triageShow() {
+    if (triageEntry === null) {
+	$("#triage-current td span,#triage-current td").text("");
+	$("#triage-status").text("No more blocked entries.");
+	return;
+    }
+    $("#triage-status").text("");
+    $("#triage-time").text(triageEntry.Time);
+    $("#triage-client").text(triageEntry.Client);
+    $("#triage-method").text(triageEntry.Method);
+    $("#triage-url").text(triageEntry.URL);
+    $("#triage-type").text(triageType);
+    $("#triage-value").text(triageValue());
+}
+
+function triageDecide(action) {
+    if (triageEntry === null) {
+	return;
+    }
+    triagePending.push({
+	domain: triageEntry.Domain,
+	type: triageType,
+	value: triageValue(),
+	action: action,
+	time: triageEntry.Time,
+	client: triageEntry.Client,
+	url: triageEntry.URL
+    });
+    triageShowPending();
+    triageNext();
+}
+
+function triageShowPending() {
+    var l = $("#triage-pending tbody");
+    l.html("");
+    for (var i = 0; i < triagePending.length; i++) {
+	var d = triagePending[i];
+	var tr = $("<tr></tr>");
+	tr.append($("<td></td>").text(d.type));
+	tr.append($("<td class='fixed'></td>").text(d.value));
+	tr.append($("<td></td>").text(d.action));
+	tr.append($("<td></td>").text(d.result || ""));
+	l.append(tr);
+    }
+    if (triagePending.length > 0) {
+	$("#triage-commit").removeAttr("disabled");
+    } else {
+	$("#triage-commit").attr("disabled", "disabled");
+    }
+}
+
+function triageCommit() {
+    var data = {types: [], values: [], actions: [], log_times: [], log_clients: [], log_urls: []};
+    for (var i = 0; i < triagePending.length; i++) {
+	data.types.push(triagePending[i].type);
+	data.values.push(triagePending[i].value);
+	data.actions.push(triagePending[i].action);
+	data.log_times.push(triagePending[i].time);
+	data.log_clients.push(triagePending[i].client);
+	data.log_urls.push(triagePending[i].url);
+    }
+    doPost("/triage/commit", data, function(resp) {
+	for (var i = 0; i < resp.length; i++) {
+	    triagePending[i].result = resp[i].error || ("added " + resp[i].rule);
+	}
+	triageShowPending();
+	triagePending = new Array;
+	$("#triage-commit").attr("disabled", "disabled");
+    });
+}
+
+function triageKeypress(event) {
+    switch (event.which) {
+    case 97: // 'a'
+	triageDecide("allow");
+	break;
+    case 98: // 'b'
+	triageDecide("block");
+	break;
+    case 105: // 'i'
+	triageDecide("ignore");
+	break;
+    case 115: // 's'
+	triageNext();
+	break;
+    case 104: // 'h'
+	triageUseHost = !triageUseHost;
+	triageShow();
+	break;
+    case 117: // 'u'
+	triagePending.pop();
+	triageShowPending();
+	break;
+    case 99: // 'c'
+	triageCommit();
+	break;
+    }
+}
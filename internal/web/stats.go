@@ -0,0 +1,252 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Traffic stats record every request in the squid log. Raw entries are kept
+// for -stats_raw_days, and then compacted into per hour, client and host
+// totals that are kept for -stats_hourly_months.
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/google/squidwarden/internal/store"
+)
+
+const (
+	statsFlushInterval   = 10 * time.Second
+	statsCompactInterval = time.Hour
+)
+
+type trafficRecord struct {
+	Time     string
+	Client   string
+	Host     string
+	Requests int64
+	Denied   int64
+	Bytes    int64
+}
+
+type trafficEntry struct {
+	time   int64
+	client string
+	status string
+	method string
+	url    string
+	host   string
+	bytes  int64
+	denied bool
+}
+
+// statsRecorder buffers entries in memory so that busy proxies don't cause a
+// write per log line.
+type statsRecorder struct {
+	ingest *logIngester // Nil in tests.
+
+	mu      sync.Mutex
+	pending []trafficEntry
+}
+
+func (s *statsRecorder) add(e *squidlog.Entry) {
+	t, err := time.Parse(squidlog.TimeFormat, e.Time)
+	if err != nil {
+		log.Printf("Stats: bad time %q: %v", e.Time, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, trafficEntry{
+		time:   t.Unix(),
+		client: e.Client,
+		status: e.Status,
+		method: e.Method,
+		url:    e.URL,
+		host:   e.Host,
+		bytes:  e.Bytes,
+		denied: strings.Contains(e.Status, "DENIED"),
+	})
+}
+
+func (s *statsRecorder) flush() error {
+	var p []trafficEntry
+	offsets := s.ingest.checkpoint(func() {
+		s.mu.Lock()
+		p = s.pending
+		s.pending = nil
+		s.mu.Unlock()
+	})
+	if len(p) == 0 {
+		return nil
+	}
+
+	return store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		for _, e := range p {
+			if _, err := tx.Exec(`INSERT INTO trafficlog(time, client, status, method, host, bytes, denied) VALUES(?,?,?,?,?,?,?)`, e.time, e.client, e.status, e.method, e.host, e.bytes, e.denied); err != nil {
+				return err
+			}
+		}
+		pol, err := currentPolicy()
+		if err != nil {
+			log.Printf("Stats: failed to load policy, denials won't be counted per ACL: %v", err)
+			pol = nil
+		}
+		if err := addDashboardStats(tx, pol, p); err != nil {
+			return err
+		}
+		return s.ingest.saveOffsets(tx, offsets)
+	})
+}
+
+func (s *statsRecorder) run() {
+	for range time.Tick(statsFlushInterval) {
+		if err := s.flush(); err != nil {
+			log.Printf("Failed to flush traffic stats: %v", err)
+		}
+	}
+}
+
+func statsCompactor() {
+	for {
+		if err := compactStats(time.Now(), serverOpts.StatsRawDays, serverOpts.StatsHourlyMonths); err != nil {
+			log.Printf("Failed to compact traffic stats: %v", err)
+		}
+		time.Sleep(statsCompactInterval)
+	}
+}
+
+func startStats() {
+	if !serverOpts.Stats {
+		return
+	}
+	if !ingestConfigured() {
+		log.Fatalf("-stats requires -squidlog or -ingest_logs")
+	}
+	s := &statsRecorder{}
+	s.ingest = newLogIngester("stats", s.add)
+	go s.run()
+	go statsCompactor()
+	go s.ingest.run()
+}
+
+// compactStats rolls raw entries older than rawDays into hourly totals, and
+// deletes hourly totals older than hourlyMonths. Totals for an hour that's
+// only partly compacted are added to on the next run.
+func compactStats(now time.Time, rawDays, hourlyMonths int) error {
+	return store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		if rawDays > 0 {
+			cutoff := now.AddDate(0, 0, -rawDays).Unix()
+			rows, err := tx.Query(`
+SELECT time/3600*3600, client, host, COUNT(*), SUM(denied), SUM(bytes)
+FROM trafficlog
+WHERE time < ?
+GROUP BY 1, client, host`, cutoff)
+			if err != nil {
+				return err
+			}
+			type total struct {
+				hour                    int64
+				client, host            string
+				requests, denied, bytes int64
+			}
+			var totals []total
+			for rows.Next() {
+				var t total
+				if err := rows.Scan(&t.hour, &t.client, &t.host, &t.requests, &t.denied, &t.bytes); err != nil {
+					rows.Close()
+					return err
+				}
+				totals = append(totals, t)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for _, t := range totals {
+				n, err := rowsAffected(tx.Exec(`UPDATE trafficstats SET requests=requests+?, denied=denied+?, bytes=bytes+? WHERE hour=? AND client=? AND host=?`, t.requests, t.denied, t.bytes, t.hour, t.client, t.host))
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					continue
+				}
+				if _, err := tx.Exec(`INSERT INTO trafficstats(hour, client, host, requests, denied, bytes) VALUES(?,?,?,?,?,?)`, t.hour, t.client, t.host, t.requests, t.denied, t.bytes); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.Exec(`DELETE FROM trafficlog WHERE time < ?`, cutoff); err != nil {
+				return err
+			}
+			if len(totals) > 0 {
+				log.Printf("Compacted traffic stats into %d hourly totals", len(totals))
+			}
+		}
+		if hourlyMonths > 0 {
+			cutoff := now.AddDate(0, -hourlyMonths, 0).Unix()
+			for _, t := range []string{"trafficstats", "groupstats", "acldenials"} {
+				if _, err := tx.Exec(`DELETE FROM `+t+` WHERE hour < ?`, cutoff); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// trafficStatsHandler streams hourly traffic totals, newest first. Raw
+// entries not yet compacted are totalled on the fly. ?client= limits it to
+// one client, and from and to to the hours they're in.
+func trafficStatsHandler(r *http.Request, s *recordStream) error {
+	tr, err := parseTimeRange(r, time.Now())
+	if err != nil {
+		return err
+	}
+	q := `
+SELECT hour, client, host, SUM(requests), SUM(denied), SUM(bytes)
+FROM (
+  SELECT hour, client, host, requests, denied, bytes FROM trafficstats
+  UNION ALL
+  SELECT time/3600*3600, client, host, 1, denied, bytes FROM trafficlog
+)
+WHERE hour >= ? AND hour < ?`
+	args := []interface{}{tr.fromUnix() / 3600 * 3600, tr.toUnix()}
+	if c := r.FormValue("client"); c != "" {
+		q += ` AND client=?`
+		args = append(args, c)
+	}
+	rows, err := db.Query(q+` GROUP BY hour, client, host ORDER BY hour DESC, client, host`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	loc := requestZone(r)
+	for rows.Next() {
+		var t trafficRecord
+		var hour int64
+		if err := rows.Scan(&hour, &t.Client, &t.Host, &t.Requests, &t.Denied, &t.Bytes); err != nil {
+			return err
+		}
+		t.Time = formatUnix(hour, loc)
+		if err := s.Write(&t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,435 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Streamed responses, for lists too big to build in memory. Records are
+// written as they're produced, as one JSON array by default. ?format=ndjson
+// (or "Accept: application/x-ndjson") gives newline delimited JSON with one
+// record per line, and ?format=csv (or "Accept: text/csv") gives CSV with a
+// header row, for spreadsheets.
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+// Flush after this many records, so the client sees progress.
+const streamFlushEvery = 100
+
+// Stream formats.
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+type recordStream struct {
+	w      http.ResponseWriter
+	format string
+	enc    *json.Encoder
+	csv    *csv.Writer
+	header []string // CSV columns, from the first record.
+	n      int
+}
+
+// streamFormat returns the format asked for, or "" if it's not one of
+// the stream formats.
+func streamFormat(r *http.Request) string {
+	switch f := r.FormValue("format"); f {
+	case formatJSON, formatNDJSON, formatCSV:
+		return f
+	case "":
+	default:
+		return ""
+	}
+	a := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(a, "application/x-ndjson"):
+		return formatNDJSON
+	case strings.Contains(a, "text/csv"):
+		return formatCSV
+	}
+	return formatJSON
+}
+
+func newRecordStream(w http.ResponseWriter, r *http.Request) *recordStream {
+	return &recordStream{
+		w:      w,
+		format: streamFormat(r),
+		enc:    json.NewEncoder(w),
+		csv:    csv.NewWriter(w),
+	}
+}
+
+// start sends the headers. It's delayed until the first record, so that
+// errors before that can still get a proper status code.
+func (s *recordStream) start() error {
+	switch s.format {
+	case formatNDJSON:
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+		return nil
+	case formatCSV:
+		s.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		return nil
+	}
+	s.w.Header().Set("Content-Type", "application/json")
+	_, err := io.WriteString(s.w, "[")
+	return err
+}
+
+// csvFields returns the columns and values of v, a struct or a map with
+// string keys. Struct columns are named like in JSON.
+func csvFields(v interface{}) ([]string, map[string]string, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	str := func(v reflect.Value) string {
+		for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+			if v.IsNil() {
+				return ""
+			}
+			v = v.Elem()
+		}
+		if !v.IsValid() {
+			return ""
+		}
+		return fmt.Sprint(v.Interface())
+	}
+	var cols []string
+	vals := make(map[string]string)
+	switch rv.Kind() {
+	case reflect.Struct:
+		t := rv.Type()
+		for n := 0; n < t.NumField(); n++ {
+			f := t.Field(n)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			cols = append(cols, name)
+			vals[name] = str(rv.Field(n))
+		}
+	case reflect.Map:
+		for _, k := range rv.MapKeys() {
+			if k.Kind() != reflect.String {
+				return nil, nil, fmt.Errorf("can't make CSV of map with %v keys", k.Kind())
+			}
+			cols = append(cols, k.String())
+			vals[k.String()] = str(rv.MapIndex(k))
+		}
+		sort.Strings(cols)
+	default:
+		return nil, nil, fmt.Errorf("can't make CSV of %v", rv.Kind())
+	}
+	return cols, vals, nil
+}
+
+func (s *recordStream) writeCSV(v interface{}) error {
+	cols, vals, err := csvFields(v)
+	if err != nil {
+		return err
+	}
+	if s.header == nil {
+		s.header = cols
+		if err := s.csv.Write(cols); err != nil {
+			return err
+		}
+	}
+	row := make([]string, len(s.header))
+	for n, c := range s.header {
+		row[n] = vals[c]
+	}
+	return s.csv.Write(row)
+}
+
+// Write sends one record.
+func (s *recordStream) Write(v interface{}) error {
+	if s.n == 0 {
+		if err := s.start(); err != nil {
+			return err
+		}
+	} else if s.format == formatJSON {
+		if _, err := io.WriteString(s.w, ","); err != nil {
+			return err
+		}
+	}
+	var err error
+	if s.format == formatCSV {
+		err = s.writeCSV(v)
+	} else {
+		err = s.enc.Encode(v)
+	}
+	if err != nil {
+		return err
+	}
+	s.n++
+	if s.n%streamFlushEvery == 0 {
+		s.flush()
+	}
+	return nil
+}
+
+func (s *recordStream) flush() {
+	if s.format == formatCSV {
+		s.csv.Flush()
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close ends the stream.
+func (s *recordStream) Close() error {
+	if s.n == 0 {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+	if s.format == formatJSON {
+		if _, err := io.WriteString(s.w, "]\n"); err != nil {
+			return err
+		}
+	}
+	s.flush()
+	return s.csv.Error()
+}
+
+// streamWrap turns f into a handler streaming what f writes. If f fails
+// before writing anything the client gets an error status. After that
+// it's too late, so a JSON array is left unterminated, NDJSON gets a last
+// line with the error, and CSV just ends.
+func streamWrap(f func(*http.Request, *recordStream) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := newRecordStream(w, r)
+		if s.format == "" {
+			writeJSONError(w, r, errHTTP{
+				external: "format must be json, ndjson or csv",
+				code:     http.StatusBadRequest,
+			})
+			return
+		}
+		err := f(r, s)
+		if err == nil {
+			if err := s.Close(); err != nil {
+				log.Printf("Failed to write stream: %v", err)
+			}
+			return
+		}
+		if s.n == 0 {
+			writeJSONError(w, r, err)
+			return
+		}
+		if e, ok := err.(errHTTP); ok {
+			log.Printf("HTTP error. External: %q Code: %d. Internal: %v", e.external, e.code, e.internal)
+		} else {
+			log.Printf("Error in streaming handler: %v", err)
+		}
+		switch s.format {
+		case formatNDJSON:
+			s.enc.Encode(struct {
+				Error string `json:"error"`
+			}{"internal error, output truncated"})
+		case formatCSV:
+			s.flush()
+		}
+	}
+}
+
+// Tables in the config export. Usage and logs, like quotausage and
+// reviewqueue, are left out.
+var exportTables = []string{
+	"sources",
+	"groups",
+	"members",
+	"memberexpiry",
+	"acls",
+	"aclschedule",
+	"aclarchive",
+	"aclowners",
+	"acldescriptions",
+	"rules",
+	"ruleexpiry",
+	"ruleorigins",
+	"aclrules",
+	"groupaccess",
+	"grouppause",
+	"groupowners",
+	"groupquic",
+	"defaultgroup",
+	"denypages",
+	"icapservices",
+	"groupicap",
+	"quotas",
+	"listsubscriptions",
+	"alertrules",
+	"threatfeeds",
+	"threatindicators",
+}
+
+// querier is a *sql.DB or *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// exportTable writes every row of table as an object of its columns, plus
+// "table".
+func exportTable(s *recordStream, table string) error {
+	return exportRows(db, table, func(rec map[string]interface{}) error { return s.Write(rec) })
+}
+
+// exportRows calls f with every row of table as a map of its columns, plus
+// "table".
+func exportRows(q querier, table string, f func(map[string]interface{}) error) error {
+	rows, err := q.Query(`SELECT * FROM ` + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for n := range vals {
+		ptrs[n] = &vals[n]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		rec := map[string]interface{}{"table": table}
+		for n, c := range cols {
+			if b, ok := vals[n].([]byte); ok {
+				rec[c] = string(b)
+			} else {
+				rec[c] = vals[n]
+			}
+		}
+		if err := f(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func configExportHandler(r *http.Request, s *recordStream) error {
+	if s.format == formatCSV {
+		return errHTTP{
+			external: "tables have different columns, so there's no CSV export",
+			code:     http.StatusBadRequest,
+		}
+	}
+	for _, t := range exportTables {
+		if err := exportTable(s, t); err != nil {
+			return fmt.Errorf("exporting %s: %v", t, err)
+		}
+	}
+	return nil
+}
+
+const defaultLogSearchLimit = 1000
+
+// logSearchHandler streams entries of the squid log containing q in the
+// URL, oldest first. client and status, if set, must match exactly, and
+// entries must be between from and to, if set.
+func logSearchHandler(r *http.Request, s *recordStream) error {
+	tr, err := parseTimeRange(r, time.Now())
+	if err != nil {
+		return err
+	}
+	q := r.FormValue("q")
+	client := r.FormValue("client")
+	status := r.FormValue("status")
+	limit := defaultLogSearchLimit
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return errHTTP{
+				internal: err,
+				external: "invalid limit",
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	if serverOpts.SquidLog == "" {
+		return errHTTP{
+			external: "no squid log configured",
+			code:     http.StatusNotFound,
+		}
+	}
+	f, err := os.Open(serverOpts.SquidLog)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	found := 0
+	loc := requestZone(r)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && (limit == 0 || found < limit) {
+		line := scanner.Text()
+		// Cheap check before parsing.
+		if q != "" && !strings.Contains(line, q) {
+			continue
+		}
+		e, err := squidlog.Parse(line)
+		if err != nil {
+			continue
+		}
+		if (q != "" && !strings.Contains(e.URL, q)) || (client != "" && e.Client != client) || (status != "" && e.Status != status) {
+			continue
+		}
+		if !tr.unbounded() {
+			t, err := time.Parse(squidlog.TimeFormat, e.Time)
+			if err != nil {
+				continue
+			}
+			if !tr.to.IsZero() && !t.Before(tr.to) {
+				// The log is oldest first, so the rest is later.
+				break
+			}
+			if !tr.contains(t) {
+				continue
+			}
+		}
+		e.Time = formatLogTime(e.Time, loc)
+		if err := s.Write(e); err != nil {
+			return err
+		}
+		found++
+	}
+	return scanner.Err()
+}
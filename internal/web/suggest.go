@@ -0,0 +1,130 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+// knownServices maps domains to what they are, so that the review queue
+// can say "this is just a CDN" instead of showing a dozen random-looking
+// hostnames. Some, like .cloudfront.net, are public suffixes, so they're
+// matched on the host rather than its registered domain.
+var knownServices = map[string]string{
+	".akamaihd.net":          "CDN (Akamai)",
+	".akamaized.net":         "CDN (Akamai)",
+	".edgekey.net":           "CDN (Akamai)",
+	".edgesuite.net":         "CDN (Akamai)",
+	".cloudfront.net":        "CDN (Amazon)",
+	".fastly.net":            "CDN (Fastly)",
+	".fastlylb.net":          "CDN (Fastly)",
+	".cloudflare.com":        "CDN (Cloudflare)",
+	".cdnjs.com":             "CDN (Cloudflare)",
+	".azureedge.net":         "CDN (Microsoft)",
+	".jsdelivr.net":          "CDN (jsDelivr)",
+	".gstatic.com":           "CDN (Google)",
+	".googleusercontent.com": "CDN (Google)",
+	".ytimg.com":             "CDN (YouTube)",
+	".fbcdn.net":             "CDN (Facebook)",
+	".twimg.com":             "CDN (Twitter)",
+	".googleapis.com":        "API (Google)",
+	".google-analytics.com":  "Analytics (Google)",
+	".googletagmanager.com":  "Analytics (Google)",
+	".doubleclick.net":       "Ads (Google)",
+	".googlesyndication.com": "Ads (Google)",
+	".scorecardresearch.com": "Analytics (comScore)",
+	".hotjar.com":            "Analytics (Hotjar)",
+	".newrelic.com":          "Analytics (New Relic)",
+	".nr-data.net":           "Analytics (New Relic)",
+}
+
+type suggestion struct {
+	Type     string
+	Value    string
+	Category string
+	Hosts    []string
+	Hits     int64
+}
+
+// suggestRules groups review queue entries by registered domain and
+// proposes one domain rule per group. Single hosts are only suggested if
+// they belong to a known service.
+func suggestRules(entries []reviewEntry) []suggestion {
+	type key struct{ typ, domain string }
+	groups := make(map[key]*suggestion)
+	var order []key
+	for _, e := range entries {
+		d, category := knownService(e.Host)
+		if d == "" {
+			d = squidlog.HostToDomain(e.Host)
+		}
+		if !strings.HasPrefix(d, ".") {
+			// IP address or similar.
+			continue
+		}
+		k := key{typ: e.Type, domain: d}
+		s, found := groups[k]
+		if !found {
+			s = &suggestion{
+				Type:     e.Type,
+				Value:    d,
+				Category: category,
+			}
+			groups[k] = s
+			order = append(order, k)
+		}
+		s.Hosts = append(s.Hosts, e.Host)
+		s.Hits += e.Hits
+	}
+
+	var ret []suggestion
+	for _, k := range order {
+		s := groups[k]
+		if len(s.Hosts) < 2 && s.Category == "" {
+			continue
+		}
+		sort.Strings(s.Hosts)
+		ret = append(ret, *s)
+	}
+	sort.Stable(bySuggestionSize(ret))
+	return ret
+}
+
+// knownService returns the longest domain of knownServices that host is
+// in, and what it is, or "" if it's in none.
+func knownService(host string) (string, string) {
+	var domain string
+	for d := range knownServices {
+		if (strings.HasSuffix(host, d) || host == d[1:]) && len(d) > len(domain) {
+			domain = d
+		}
+	}
+	return domain, knownServices[domain]
+}
+
+type bySuggestionSize []suggestion
+
+func (a bySuggestionSize) Len() int      { return len(a) }
+func (a bySuggestionSize) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySuggestionSize) Less(i, j int) bool {
+	if len(a[i].Hosts) != len(a[j].Hosts) {
+		return len(a[i].Hosts) > len(a[j].Hosts)
+	}
+	return a[i].Hits > a[j].Hits
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Squid logs can be received over syslog, for when squid runs on another
+// host. Received lines that parse as squid log entries are appended to
+// -squidlog, which everything else reads as if squid had written it.
+//
+// Changes can also be sent to syslog as audit events, one per change log
+// entry.
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+// syslogIdleTimeout is how long an idle TCP sender stays connected.
+const syslogIdleTimeout = 10 * time.Minute
+
+// syslogEnabled returns true if squid logs are received over syslog.
+func syslogEnabled() bool {
+	return serverOpts.SyslogUDP != "" || serverOpts.SyslogTCP != ""
+}
+
+// syslogSink appends squid log lines to a file, reopening it when it's
+// rotated.
+type syslogSink struct {
+	fn      string
+	mu      sync.Mutex
+	f       *os.File
+	checked time.Time
+}
+
+func (s *syslogSink) open() error {
+	f, err := os.OpenFile(s.fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = f
+	return nil
+}
+
+// reopenIfRotated reopens the file if it's been renamed or removed, at most
+// every ingestPollInterval.
+func (s *syslogSink) reopenIfRotated(now time.Time) error {
+	if now.Sub(s.checked) < ingestPollInterval {
+		return nil
+	}
+	s.checked = now
+	cur, err := s.f.Stat()
+	if err != nil {
+		return s.open()
+	}
+	st, err := os.Stat(s.fn)
+	if err != nil || !os.SameFile(cur, st) {
+		return s.open()
+	}
+	return nil
+}
+
+// add appends the squid log line of a syslog message.
+func (s *syslogSink) add(msg string) {
+	m, err := squidlog.ParseSyslog(msg)
+	if err != nil {
+		log.Printf("Syslog: %v", err)
+		return
+	}
+	// One message is one line, whatever the sender put in it.
+	line := strings.Replace(strings.TrimSpace(m.Message), "\n", " ", -1)
+	switch _, err := squidlog.Parse(line); err {
+	case nil:
+	case squidlog.ErrSkip:
+		return
+	default:
+		log.Printf("Syslog: from %q: %v", m.Host, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reopenIfRotated(time.Now()); err != nil {
+		log.Printf("Syslog: reopening %q: %v", s.fn, err)
+		return
+	}
+	if _, err := s.f.WriteString(line + "\n"); err != nil {
+		log.Printf("Syslog: writing %q: %v", s.fn, err)
+	}
+}
+
+func (s *syslogSink) serveUDP(c net.PacketConn) {
+	b := make([]byte, squidlog.MaxSyslogSize)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			log.Printf("Syslog: UDP read: %v", err)
+			time.Sleep(ingestPollInterval)
+			continue
+		}
+		s.add(string(b[:n]))
+	}
+}
+
+func (s *syslogSink) serveTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Printf("Syslog: TCP accept: %v", err)
+			time.Sleep(ingestPollInterval)
+			continue
+		}
+		go func() {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			for {
+				c.SetReadDeadline(time.Now().Add(syslogIdleTimeout))
+				msg, err := squidlog.ReadSyslog(r)
+				if err != nil {
+					return
+				}
+				s.add(msg)
+			}
+		}()
+	}
+}
+
+// startSyslog starts receiving squid logs over syslog, if enabled. It has
+// to be called before anything starts following -squidlog, so that it
+// exists.
+func startSyslog() {
+	if !syslogEnabled() {
+		return
+	}
+	if serverOpts.SquidLog == "" {
+		log.Fatalf("-syslog_udp and -syslog_tcp need -squidlog, the file to write received logs to")
+	}
+	s := &syslogSink{fn: serverOpts.SquidLog}
+	if err := s.open(); err != nil {
+		log.Fatalf("Failed to open %q for syslog: %v", s.fn, err)
+	}
+	if serverOpts.SyslogUDP != "" {
+		c, err := net.ListenPacket("udp", serverOpts.SyslogUDP)
+		if err != nil {
+			log.Fatalf("Failed to listen for syslog on UDP %q: %v", serverOpts.SyslogUDP, err)
+		}
+		log.Printf("Receiving squid logs over syslog on UDP %s", c.LocalAddr())
+		go s.serveUDP(c)
+	}
+	if serverOpts.SyslogTCP != "" {
+		l, err := net.Listen("tcp", serverOpts.SyslogTCP)
+		if err != nil {
+			log.Fatalf("Failed to listen for syslog on TCP %q: %v", serverOpts.SyslogTCP, err)
+		}
+		log.Printf("Receiving squid logs over syslog on TCP %s", l.Addr())
+		go s.serveTCP(l)
+	}
+}
+
+// auditQueue is how many audit events can wait to be sent, so that a slow
+// or unreachable syslog server doesn't hold up changes.
+const auditQueue = 1000
+
+// audit sends changes to -syslog_audit.
+var audit = &auditLogger{c: make(chan string, auditQueue)}
+
+type auditLogger struct {
+	once sync.Once
+	c    chan string
+}
+
+// dialSyslog connects to dst, as in -syslog_audit.
+func dialSyslog(dst string) (*syslog.Writer, error) {
+	const prio = syslog.LOG_NOTICE | syslog.LOG_AUTH
+	if dst == "local" {
+		return syslog.New(prio, "squidwarden")
+	}
+	parts := strings.SplitN(dst, ":", 2)
+	if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") {
+		return nil, fmt.Errorf("want 'local' or udp:host:port or tcp:host:port, got %q", dst)
+	}
+	return syslog.Dial(parts[0], parts[1], prio, "squidwarden")
+}
+
+// auditMessage formats a change log entry as an audit event.
+func auditMessage(actor, entity, id, summary string) string {
+	return fmt.Sprintf("change actor=%q entity=%q id=%q summary=%q", actor, entity, id, summary)
+}
+
+// change queues a change log entry to be sent as an audit event. Events are
+// dropped if the queue is full.
+func (a *auditLogger) change(actor, entity, id, summary string) {
+	if serverOpts.SyslogAudit == "" {
+		return
+	}
+	a.once.Do(func() { go a.run() })
+	select {
+	case a.c <- auditMessage(actor, entity, id, summary):
+	default:
+		log.Printf("Audit event queue full, dropping %q", summary)
+	}
+}
+
+// run sends queued audit events. Connecting is retried with the next event
+// if it fails, and the syslog package reconnects if writing fails.
+func (a *auditLogger) run() {
+	var w *syslog.Writer
+	for msg := range a.c {
+		if w == nil {
+			var err error
+			if w, err = dialSyslog(serverOpts.SyslogAudit); err != nil {
+				log.Printf("Failed to connect to syslog %q for audit events: %v", serverOpts.SyslogAudit, err)
+				continue
+			}
+		}
+		if err := w.Notice(msg); err != nil {
+			log.Printf("Failed to send audit event to syslog: %v", err)
+		}
+	}
+}
@@ -13,19 +13,22 @@ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 See the License for the specific language governing permissions and
 limitations under the License.
 */
-package main
+package web
 
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/google/squidwarden/internal/squidlog"
 	"github.com/gorilla/websocket"
 )
 
@@ -40,22 +43,81 @@ var (
 )
 
 const (
-	maxLineLength = 1000
+	// defaultTailLines is how many entries the tail log shows without a
+	// count.
+	defaultTailLines = 30
+
+	// tailWriteTimeout is how long a browser has to take an entry before
+	// it's disconnected. Writes block while it's behind, so nothing is
+	// buffered for it.
+	tailWriteTimeout = 30 * time.Second
+
+	// maxTailLag is how far, in bytes of log, a browser can fall behind
+	// before entries are skipped to catch up.
+	maxTailLag = 1 << 20
 )
 
+// parseTailCount returns the count form value, or the default, capped at
+// -tail_max_lines.
+func parseTailCount(r *http.Request) (int, error) {
+	n := defaultTailLines
+	if s := r.FormValue("count"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			return 0, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("bad count %q", s),
+				code:     http.StatusBadRequest,
+				details:  map[string]fieldErrors{"fields": {"count": "must be a number, 0 or more"}},
+			}
+		}
+	}
+	if n > serverOpts.TailMaxLines {
+		n = serverOpts.TailMaxLines
+	}
+	return n, nil
+}
+
+// tailSkipped is sent instead of an entry when entries were skipped
+// because the browser fell behind.
+type tailSkipped struct {
+	Skipped int64 // Bytes of log.
+}
+
+// tailHandler streams the latest count entries over a websocket, oldest
+// first, and then new ones as they're logged. With follow=false it stops
+// after the latest ones. Ignored entries are left out.
 func tailHandler(w http.ResponseWriter, r *http.Request) {
-	f, err := os.Open(*squidLog)
+	count, err := parseTailCount(r)
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	follow := r.FormValue("follow") != "false"
+	f, err := os.Open(serverOpts.SquidLog)
 	if err != nil {
 		log.Printf("File open failed: %v", err)
 		http.Error(w, "File open failed", http.StatusInternalServerError)
 		return
 	}
-	pos, err := f.Seek(-maxLineLength, 2)
+	defer f.Close()
+	st, err := f.Stat()
 	if err != nil {
-		// Ignore errors since they are probably due to file being shorter than maxLineLength.
-		if false {
-			log.Printf("File seek failed: %v", err)
-			http.Error(w, "File seek failed", http.StatusInternalServerError)
+		log.Printf("File stat failed: %v", err)
+		http.Error(w, "File stat failed", http.StatusInternalServerError)
+		return
+	}
+	pos := st.Size()
+	loc := requestZone(r)
+	var latest []*squidlog.Entry
+	if count > 0 {
+		keep := func(e *squidlog.Entry) bool { return !currentIgnores().hides(e) }
+		if _, err := readLogBefore(f, pos, count, timeRange{}, keep, func(_ int64, e *squidlog.Entry) {
+			e.Time = formatLogTime(e.Time, loc)
+			latest = append(latest, e)
+		}); err != nil {
+			log.Printf("File read failed: %v", err)
+			http.Error(w, "File read failed", http.StatusInternalServerError)
 			return
 		}
 	}
@@ -71,6 +133,28 @@ func tailHandler(w http.ResponseWriter, r *http.Request) {
 		//log.Printf("Closing websocket")
 		conn.Close()
 	}()
+	send := func(v interface{}) bool {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Printf("Failed to mashal tail: %v", err)
+			return false
+		}
+		conn.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			//log.Printf("Message write failed: %v", err)
+			return false
+		}
+		return true
+	}
+	for i := len(latest) - 1; i >= 0; i-- {
+		if !send(latest[i]) {
+			return
+		}
+	}
+	if !follow {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(tailWriteTimeout))
+		return
+	}
 	changeTick := make(chan struct{}, 1)
 	changeTick <- struct{}{}
 
@@ -81,8 +165,8 @@ func tailHandler(w http.ResponseWriter, r *http.Request) {
 			log.Fatalf("Couldn't create watcher: %v", err)
 		}
 		defer w.Close()
-		if err := w.Add(*squidLog); err != nil {
-			log.Fatalf("Couldn't add watcher on %s: %v", *squidLog, err)
+		if err := w.Add(serverOpts.SquidLog); err != nil {
+			log.Fatalf("Couldn't add watcher on %s: %v", serverOpts.SquidLog, err)
 		}
 		go func() {
 			defer close(changeTick)
@@ -115,6 +199,17 @@ func tailHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Skip to the end if the browser can't keep up, rather than
+		// falling ever further behind.
+		if st, err := f.Stat(); err == nil && st.Size()-pos > maxTailLag {
+			if !send(&tailSkipped{Skipped: st.Size() - pos}) {
+				return
+			}
+			pos = st.Size()
+			// Carry on from the start of a line.
+			first = true
+		}
+
 		if _, err := f.Seek(pos, 0); err != nil {
 			log.Printf("File seek failed: %v", err)
 			return
@@ -144,8 +239,9 @@ func tailHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		pos += int64(len(line))
 
-		e, err := parseLogEntry(line)
-		if err == errSkip {
+		e, err := squidlog.Parse(line)
+		if err == squidlog.ErrSkip {
+			continue
 		} else if err != nil {
 			if !first {
 				log.Printf("Error parsing log line: %v", err)
@@ -153,13 +249,11 @@ func tailHandler(w http.ResponseWriter, r *http.Request) {
 			first = false
 			continue
 		}
-		data, err := json.Marshal(e)
-		if err != nil {
-			log.Printf("Failed to mashal tail: %v", err)
-			return
+		if currentIgnores().hides(e) {
+			continue
 		}
-		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-			//log.Printf("Message write failed: %v", err)
+		e.Time = formatLogTime(e.Time, loc)
+		if !send(e) {
 			return
 		}
 	}
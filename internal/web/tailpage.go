@@ -0,0 +1,260 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Paged tail log, newest first, for the compact (phone) view. The cursor is
+// the file offset of the oldest entry returned, and the next page is the
+// entries before it. Every entry has its offset, so a client polling for
+// newer entries can fetch the first page and keep the ones it doesn't have.
+//
+// With group=domain, bursts of requests to the same registered domain,
+// like the dozens a web page makes when it loads, are collapsed into their
+// newest entry, with the rest in it.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/gorilla/csrf"
+)
+
+const (
+	defaultTailPageSize = 50
+	maxTailPageSize     = 500
+	tailChunkSize       = 64 << 10
+
+	// Max bytes of log to read for one page, so that filtering on a big
+	// log can't make a request run forever.
+	maxTailScan = 16 << 20
+
+	// tailBurst is the longest gap between requests to a domain for them
+	// to be grouped together.
+	tailBurst = 10 * time.Second
+)
+
+// Short field names, since this goes over mobile networks.
+type tailEntry struct {
+	Cursor string `json:"o"`
+	Time   string `json:"t"`
+	Client string `json:"c"`
+	Status string `json:"s"`
+	Method string `json:"m"`
+	Domain string `json:"d"`
+	Host   string `json:"h"`
+	URL    string `json:"u"`
+
+	// Grouped are the older entries of the burst, with group=domain.
+	Grouped []tailEntry `json:"g,omitempty"`
+
+	at time.Time
+}
+
+type tailPage struct {
+	Entries []tailEntry `json:"entries"`
+	Next    string      `json:"next,omitempty"` // Empty at start of log.
+}
+
+func tailPageHandler(r *http.Request) (interface{}, error) {
+	limit := defaultTailPageSize
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxTailPageSize {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("limit must be 1-%d", maxTailPageSize),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	deniedOnly := r.FormValue("denied") == "true"
+	group := r.FormValue("group")
+	if group != "" && group != "domain" {
+		return nil, errHTTP{
+			external: fmt.Sprintf("invalid group %q, want domain or none", group),
+			code:     http.StatusBadRequest,
+		}
+	}
+	tr, err := parseTimeRange(r, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(serverOpts.SquidLog)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := fi.Size()
+	if s := r.FormValue("before"); s != "" {
+		c, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || c < 0 {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("invalid cursor %q", s),
+				code:     http.StatusBadRequest,
+			}
+		}
+		// A cursor past the end means the log was rotated. Start over.
+		if c < end {
+			end = c
+		}
+	}
+
+	page, err := readTailPage(f, end, limit, deniedOnly, tr, requestZone(r))
+	if err != nil {
+		return nil, err
+	}
+	if group == "domain" {
+		page.Entries = groupTailEntries(page.Entries)
+	}
+	return page, nil
+}
+
+// readLogBefore calls fn with up to limit entries of f before offset end,
+// newest first, that are in tr and that keep, if not nil, returns true
+// for. It returns the offset to carry on from, which is 0 once the start
+// of the log, or of tr, is reached.
+func readLogBefore(f *os.File, end int64, limit int, tr timeRange, keep func(*squidlog.Entry) bool, fn func(offset int64, e *squidlog.Entry)) (int64, error) {
+	start := end
+	n := 0
+	for n < limit && end > 0 && start-end < maxTailScan {
+		lines, err := squidlog.ReadLinesBefore(f, end, limit-n, tailChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(lines) == 0 {
+			return 0, nil
+		}
+		for _, l := range lines {
+			end = l.Offset
+			e, err := squidlog.Parse(l.Text)
+			if err == squidlog.ErrSkip {
+				continue
+			} else if err != nil {
+				log.Printf("Parsing log entry: %v", err)
+				continue
+			}
+			if !tr.unbounded() {
+				t, err := time.Parse(squidlog.TimeFormat, e.Time)
+				if err != nil {
+					continue
+				}
+				if !tr.from.IsZero() && t.Before(tr.from) {
+					// The rest is older still.
+					return 0, nil
+				}
+				if !tr.contains(t) {
+					continue
+				}
+			}
+			if keep != nil && !keep(e) {
+				continue
+			}
+			fn(l.Offset, e)
+			n++
+		}
+	}
+	return end, nil
+}
+
+// readTailPage reads up to limit entries in tr from f before offset end,
+// newest first, with times in loc. Ignored entries are left out.
+func readTailPage(f *os.File, end int64, limit int, deniedOnly bool, tr timeRange, loc *time.Location) (*tailPage, error) {
+	page := tailPage{Entries: []tailEntry{}}
+	ign := currentIgnores()
+	keep := func(e *squidlog.Entry) bool {
+		return !ign.hides(e) && (!deniedOnly || strings.Contains(e.Status, "DENIED"))
+	}
+	end, err := readLogBefore(f, end, limit, tr, keep, func(offset int64, e *squidlog.Entry) {
+		at, _ := time.Parse(squidlog.TimeFormat, e.Time)
+		page.Entries = append(page.Entries, tailEntry{
+			Cursor: strconv.FormatInt(offset, 10),
+			Time:   formatLogTime(e.Time, loc),
+			Client: e.Client,
+			Status: e.Status,
+			Method: e.Method,
+			Domain: e.Domain,
+			Host:   e.Host,
+			URL:    e.URL,
+			at:     at,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if end > 0 {
+		page.Next = strconv.FormatInt(end, 10)
+	}
+	return &page, nil
+}
+
+// groupTailEntries collapses bursts of entries, newest first, to the same
+// registered domain into the newest one. A burst carries on as long as the
+// gaps between its requests are at most tailBurst, even with requests to
+// other domains in between. Blocked and allowed requests aren't grouped
+// together, so that a blocked burst keeps its allow button.
+func groupTailEntries(entries []tailEntry) []tailEntry {
+	ret := []tailEntry{}
+	open := make(map[string]int) // Key to index in ret of its latest burst.
+	for _, e := range entries {
+		key := e.Domain
+		if key == "" {
+			key = e.Host
+		}
+		if strings.Contains(e.Status, "DENIED") {
+			key += " denied"
+		}
+		if i, ok := open[key]; ok {
+			g := &ret[i]
+			oldest := g.at
+			if n := len(g.Grouped); n > 0 {
+				oldest = g.Grouped[n-1].at
+			}
+			if oldest.Sub(e.at) <= tailBurst {
+				g.Grouped = append(g.Grouped, e)
+				continue
+			}
+		}
+		open[key] = len(ret)
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// tailViewHandler is the compact tail page. It's standalone rather than in
+// page.html, since the nav doesn't fit on a phone.
+func tailViewHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := getTemplate("tail.html", nil)
+	if err := tmpl.Execute(w, &struct {
+		CSRF  string
+		Theme siteTheme
+	}{
+		CSRF:  csrf.Token(r),
+		Theme: theme,
+	}); err != nil {
+		log.Printf("template execute fail: %v", err)
+	}
+}
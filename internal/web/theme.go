@@ -0,0 +1,144 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Themes let a site brand the UI without forking the templates. A theme is
+// a directory with any of:
+//
+//   theme.json   {"title": ..., "logo": ..., "nav_color": ..., ...}
+//   templates/   Templates that replace the built in ones of the same name.
+//   static/      Static files that replace or add to the built in ones.
+//
+// Anything the theme doesn't have comes from the built in (embedded)
+// assets.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"text/template"
+)
+
+var (
+	// Colors go into CSS, so only allow things that can't break out of it.
+	reThemeColor = regexp.MustCompile(`^(#[\da-fA-F]{3}|#[\da-fA-F]{6}|[a-zA-Z]+)$`)
+
+	theme = defaultTheme
+)
+
+type siteTheme struct {
+	Title     string `json:"title"`
+	Logo      string `json:"logo"` // URL. Relative ones are under /static/.
+	NavColor  string `json:"nav_color"`
+	NavText   string `json:"nav_text"`
+	Highlight string `json:"highlight"`
+}
+
+var defaultTheme = siteTheme{
+	Title:     "Squidwarden",
+	NavColor:  "#ccf",
+	NavText:   "black",
+	Highlight: "#88f",
+}
+
+var themeCSS = template.Must(template.New("theme.css").Parse(`#nav {
+    color: {{.NavText}};
+    background-color: {{.NavColor}};
+}
+table.standard tbody tr:hover {
+    background: {{.Highlight}};
+}
+`))
+
+// parseTheme parses theme.json. Missing fields keep their defaults.
+func parseTheme(b []byte) (siteTheme, error) {
+	t := defaultTheme
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, err
+	}
+	for _, c := range []struct {
+		name, value string
+	}{
+		{"nav_color", t.NavColor},
+		{"nav_text", t.NavText},
+		{"highlight", t.Highlight},
+	} {
+		if !reThemeColor.MatchString(c.value) {
+			return t, fmt.Errorf("invalid color %q for %s", c.value, c.name)
+		}
+	}
+	return t, nil
+}
+
+// loadTheme reads the branding of -theme, if any.
+func loadTheme() error {
+	if serverOpts.Theme == "" {
+		return nil
+	}
+	fi, err := os.Stat(serverOpts.Theme)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", serverOpts.Theme)
+	}
+	b, err := ioutil.ReadFile(path.Join(serverOpts.Theme, "theme.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if theme, err = parseTheme(b); err != nil {
+		return fmt.Errorf("theme.json: %v", err)
+	}
+	return nil
+}
+
+// readThemed reads fn from the theme's sub directory if it's there, and
+// otherwise from dir.
+func readThemed(sub, dir, fn string) ([]byte, error) {
+	if serverOpts.Theme != "" {
+		b, err := ioutil.ReadFile(path.Join(serverOpts.Theme, sub, path.Clean("/"+fn)))
+		if err == nil {
+			return b, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return readFile(path.Join(dir, fn))
+}
+
+// LogoURL returns the URL of the logo, or "" if there isn't one.
+func (t siteTheme) LogoURL() string {
+	if t.Logo == "" || path.IsAbs(t.Logo) || reURLScheme.MatchString(t.Logo) {
+		return t.Logo
+	}
+	return path.Join("/static", t.Logo)
+}
+
+var reURLScheme = regexp.MustCompile(`^[a-zA-Z][a-zA-Z\d+.-]*:`)
+
+func themeCSSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	if err := themeCSS.Execute(w, &theme); err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
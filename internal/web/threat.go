@@ -0,0 +1,461 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Threat feeds (e.g. URLhaus, OpenPhish) keep the managed "threat-block"
+// ACL populated with block rules. Every indicator remembers which feeds
+// list it, and is retired once no feed has listed it for the feed's TTL,
+// so that one failed or truncated fetch doesn't unblock everything.
+//
+//   urls:  One URL per line. http URLs become exact rules, and https URLs
+//          https-domain rules for their host, since paths can't be seen.
+//   hosts: Hosts files, as for lists. Domain and https-domain rules.
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	threatURLs  = "urls"
+	threatHosts = "hosts"
+
+	// Comment of the ACL feeds add rules to. It's created if missing.
+	threatACLName = "threat-block"
+
+	defaultThreatTTLDays = 7
+)
+
+var (
+	threatFormats = []string{threatURLs, threatHosts}
+)
+
+type threatFeedID string
+
+func assertThreatFeedID(s string) threatFeedID { return threatFeedID(assertUUID(s)) }
+
+type threatFeed struct {
+	FeedID     threatFeedID
+	Name       string
+	URL        string
+	Format     string
+	TTL        time.Duration
+	Indicators int64
+	LastSync   string
+	LastError  string
+}
+
+// TTLDays is the TTL for the UI.
+func (f *threatFeed) TTLDays() int64 { return int64(f.TTL / (24 * time.Hour)) }
+
+// threatIndicator is a block rule from a feed. Value is as for rules of
+// Type.
+type threatIndicator struct {
+	Type  string
+	Value string
+}
+
+// parseThreatFeed parses a feed into indicators.
+func parseThreatFeed(r io.Reader, format string) ([]threatIndicator, error) {
+	var ret []threatIndicator
+	seen := make(map[threatIndicator]bool)
+	add := func(i threatIndicator) {
+		if !seen[i] {
+			seen[i] = true
+			ret = append(ret, i)
+		}
+	}
+	switch format {
+	case threatHosts:
+		entries, err := parseList(r, listHosts, actionBlock)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			add(threatIndicator{Type: typeDomain, Value: e.Value})
+			add(threatIndicator{Type: typeHTTPSDomain, Value: e.Value})
+		}
+		return ret, nil
+	case threatURLs:
+	default:
+		return nil, fmt.Errorf("unknown threat feed format %q", format)
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		u, err := url.Parse(l)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			add(threatIndicator{Type: typeExact, Value: l})
+		case "https":
+			h := strings.ToLower(u.Host)
+			if strings.HasSuffix(h, ":443") {
+				h = strings.TrimSuffix(h, ":443")
+			}
+			add(threatIndicator{Type: typeHTTPSDomain, Value: h})
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// threatACL returns the managed ACL, creating it if needed.
+func threatACL(tx *sql.Tx) (aclID, error) {
+	var id string
+	if err := tx.QueryRow(`SELECT acl_id FROM acls WHERE comment=? ORDER BY acl_id LIMIT 1`, threatACLName).Scan(&id); err == nil {
+		return aclID(id), nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	id = uuid.NewV4().String()
+	log.Printf("Creating threat feed ACL %s", id)
+	if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, id, threatACLName); err != nil {
+		return "", err
+	}
+	return aclID(id), nil
+}
+
+// attributeIndicator sets the comment of the indicator's rule in the ACL to
+// the feeds that list it.
+func attributeIndicator(tx *sql.Tx, acl aclID, i threatIndicator) error {
+	rows, err := tx.Query(`
+SELECT threatfeeds.name
+FROM threatindicators
+JOIN threatfeeds ON threatindicators.feed_id=threatfeeds.feed_id
+WHERE threatindicators.type=? AND threatindicators.value=?
+ORDER BY threatfeeds.name`, i.Type, i.Value)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+UPDATE aclrules SET comment=?
+WHERE acl_id=? AND rule_id IN (SELECT rule_id FROM rules WHERE type=? AND value=? AND action=?)`,
+		"threat feed: "+strings.Join(names, ", "), string(acl), i.Type, i.Value, actionBlock)
+	return err
+}
+
+// retireIndicators forgets the indicators of a feed last seen before
+// before. Those no other feed lists are removed from the ACL, and their
+// rules deleted unless used elsewhere.
+func retireIndicators(tx *sql.Tx, acl aclID, feed threatFeedID, before int64) (int, error) {
+	rows, err := tx.Query(`SELECT type, value FROM threatindicators WHERE feed_id=? AND last_seen < ?`, string(feed), before)
+	if err != nil {
+		return 0, err
+	}
+	var stale []threatIndicator
+	for rows.Next() {
+		var i threatIndicator
+		if err := rows.Scan(&i.Type, &i.Value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM threatindicators WHERE feed_id=? AND last_seen < ?`, string(feed), before); err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, i := range stale {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM threatindicators WHERE type=? AND value=?`, i.Type, i.Value).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			if err := attributeIndicator(tx, acl, i); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		var rid string
+		if err := tx.QueryRow(`SELECT rule_id FROM rules WHERE type=? AND value=? AND action=?`, i.Type, i.Value, actionBlock).Scan(&rid); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM aclrules WHERE acl_id=? AND rule_id=?`, string(acl), rid); err != nil {
+			return 0, err
+		}
+		// Delete the rule too, unless something else still uses it.
+		if _, err := tx.Exec(`
+DELETE FROM rules
+WHERE rule_id=?
+AND rule_id NOT IN (SELECT rule_id FROM aclrules)
+AND rule_id NOT IN (SELECT rule_id FROM ruleexpiry)`, rid); err != nil {
+			return 0, err
+		}
+		removed++
+	}
+	return removed, deleteOrphanOrigins(tx)
+}
+
+// applyThreatFeed records that the feed lists indicators as of now, adds
+// them to the ACL, and retires those not listed for ttl.
+func applyThreatFeed(tx *sql.Tx, feed threatFeedID, indicators []threatIndicator, ttl time.Duration, now time.Time) (added, retired int, err error) {
+	acl, err := threatACL(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	l, err := newRuleLinker(tx, acl)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer l.close()
+	for _, i := range indicators {
+		n, err := rowsAffected(tx.Exec(`UPDATE threatindicators SET last_seen=? WHERE feed_id=? AND type=? AND value=?`, now.Unix(), string(feed), i.Type, i.Value))
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 {
+			if _, err := tx.Exec(`INSERT INTO threatindicators(feed_id, type, value, first_seen, last_seen) VALUES(?,?,?,?,?)`, string(feed), i.Type, i.Value, now.Unix(), now.Unix()); err != nil {
+				return 0, 0, err
+			}
+		}
+		// Also for known indicators, in case the rule was removed by hand.
+		a, err := l.add(i.Type, i.Value, actionBlock)
+		if err != nil {
+			return 0, 0, err
+		}
+		if a {
+			added++
+		}
+		if a || n == 0 {
+			if err := attributeIndicator(tx, acl, i); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	retired, err = retireIndicators(tx, acl, feed, now.Add(-ttl).Unix())
+	return added, retired, err
+}
+
+// syncThreatFeed fetches a feed and applies it.
+func syncThreatFeed(id threatFeedID) error {
+	var u, format string
+	var ttl int64
+	if err := db.QueryRow(`SELECT url, format, ttl_seconds FROM threatfeeds WHERE feed_id=?`, string(id)).Scan(&u, &format, &ttl); err != nil {
+		return err
+	}
+	err := func() error {
+		b, err := fetchList(u)
+		if err != nil {
+			return err
+		}
+		indicators, err := parseThreatFeed(bytes.NewReader(b), format)
+		if err != nil {
+			return err
+		}
+		return txWrap(func(tx *sql.Tx) error {
+			added, retired, err := applyThreatFeed(tx, id, indicators, time.Duration(ttl)*time.Second, time.Now())
+			if err != nil {
+				return err
+			}
+			log.Printf("Synced threat feed %s from %q: %d indicators, %d rules added, %d retired", id, u, len(indicators), added, retired)
+			return nil
+		})
+	}()
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	if _, e := db.Exec(`UPDATE threatfeeds SET last_sync=?, last_error=? WHERE feed_id=?`, time.Now().Unix(), msg, string(id)); e != nil {
+		log.Printf("Failed to update sync status of threat feed %s: %v", id, e)
+	}
+	return err
+}
+
+func getThreatFeeds(loc *time.Location) ([]threatFeed, error) {
+	rows, err := db.Query(`
+SELECT threatfeeds.feed_id, name, url, format, ttl_seconds, last_sync, last_error, COUNT(threatindicators.value)
+FROM threatfeeds
+LEFT JOIN threatindicators ON threatfeeds.feed_id=threatindicators.feed_id
+GROUP BY threatfeeds.feed_id
+ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []threatFeed
+	for rows.Next() {
+		var f threatFeed
+		var id string
+		var ttl int64
+		var lastErr sql.NullString
+		var last sql.NullInt64
+		if err := rows.Scan(&id, &f.Name, &f.URL, &f.Format, &ttl, &last, &lastErr, &f.Indicators); err != nil {
+			return nil, err
+		}
+		f.FeedID = threatFeedID(id)
+		f.TTL = time.Duration(ttl) * time.Second
+		if last.Valid {
+			f.LastSync = formatUnix(last.Int64, loc)
+		}
+		f.LastError = lastErr.String
+		ret = append(ret, f)
+	}
+	return ret, rows.Err()
+}
+
+// threatSyncer refreshes all threat feeds every -threat_sync_interval.
+func threatSyncer() {
+	if serverOpts.ThreatSyncInterval <= 0 {
+		return
+	}
+	for range time.Tick(serverOpts.ThreatSyncInterval) {
+		feeds, err := getThreatFeeds(displayZone())
+		if err != nil {
+			log.Printf("Failed to get threat feeds: %v", err)
+			continue
+		}
+		for _, f := range feeds {
+			if _, err := enqueueJob(jobThreatSync, string(f.FeedID)); err != nil {
+				log.Printf("Failed to queue sync of threat feed %s: %v", f.FeedID, err)
+			}
+		}
+	}
+}
+
+func threatNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Name    string `form:"name,trim"`
+		Format  string `form:"format"`
+		URL     string `form:"url"`
+		TTLDays string `form:"ttl_days,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	name, format, u := data.Name, data.Format, data.URL
+	if name == "" {
+		return nil, errHTTP{
+			external: "threat feed needs a name",
+			code:     http.StatusBadRequest,
+		}
+	}
+	switch format {
+	case threatURLs, threatHosts:
+	default:
+		return nil, errHTTP{
+			external: fmt.Sprintf("unknown threat feed format %q", format),
+			code:     http.StatusBadRequest,
+		}
+	}
+	if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid feed URL %q", u),
+			code:     http.StatusBadRequest,
+		}
+	}
+	days := int64(defaultThreatTTLDays)
+	if s := data.TTLDays; s != "" {
+		var err error
+		if days, err = strconv.ParseInt(s, 10, 64); err != nil || days < 1 {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("invalid TTL %q, want days", s),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	id := uuid.NewV4().String()
+	log.Printf("Adding %s threat feed %q from %q", format, name, u)
+	if _, err := db.Exec(`INSERT INTO threatfeeds(feed_id, name, url, format, ttl_seconds) VALUES(?,?,?,?,?)`, id, name, u, format, days*24*3600); err != nil {
+		return nil, err
+	}
+	if _, err := enqueueJob(jobThreatSync, id); err != nil {
+		log.Printf("Failed to queue initial sync of threat feed %s: %v", id, err)
+	}
+	return &struct {
+		Feed string `json:"feed"`
+	}{Feed: id}, nil
+}
+
+func threatSyncHandler(r *http.Request) (interface{}, error) {
+	id := assertThreatFeedID(mux.Vars(r)["feedID"])
+	if err := syncThreatFeed(id); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("sync failed: %v", err),
+			code:     http.StatusBadGateway,
+		}
+	}
+	var n int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM threatindicators WHERE feed_id=?`, string(id)).Scan(&n); err != nil {
+		return nil, err
+	}
+	return &struct {
+		Feed       string `json:"feed"`
+		Indicators int64  `json:"indicators"`
+	}{Feed: string(id), Indicators: n}, nil
+}
+
+// threatDeleteHandler removes a feed, and the rules only it listed.
+func threatDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertThreatFeedID(mux.Vars(r)["feedID"])
+	log.Printf("Deleting threat feed %s", id)
+	resp := struct {
+		Feed    string `json:"feed"`
+		Retired int    `json:"retired"`
+		Deleted int64  `json:"deleted"`
+	}{Feed: string(id)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		acl, err := threatACL(tx)
+		if err != nil {
+			return err
+		}
+		if resp.Retired, err = retireIndicators(tx, acl, id, math.MaxInt64); err != nil {
+			return err
+		}
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM threatfeeds WHERE feed_id=?`, string(id)))
+		return err
+	})
+}
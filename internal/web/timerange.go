@@ -0,0 +1,135 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Log, stats and audit endpoints take from and to, so that the UI's date
+// range pickers and scripts can ask for a time range rather than the last
+// N entries. Times are RFC 3339, a date or date and time in the user's
+// time zone (as sent by <input type="date"> and "datetime-local"), "now",
+// or relative to now, like -24h or -7d.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// rangeTimeHelp is how to write a time, for errors.
+const rangeTimeHelp = "want RFC 3339, YYYY-MM-DD[THH:MM], now, or relative like -24h or -7d"
+
+// Layouts of absolute times in the user's time zone, besides RFC 3339.
+var rangeTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	quotaDay,
+}
+
+// parseRangeTime parses a from or to time. Times without a zone are in loc.
+func parseRangeTime(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(s, "-") {
+		d, err := parseExpiry(s[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad relative time %q: %v", s, err)
+		}
+		if d == 0 {
+			return time.Time{}, fmt.Errorf("bad relative time %q", s)
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, l := range rangeTimeLayouts {
+		if t, err := time.ParseInLocation(l, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
+}
+
+// timeRange is a half open range of time, [from, to). Zero ends are
+// unbounded.
+type timeRange struct {
+	from, to time.Time
+}
+
+// contains returns true if t is in the range.
+func (tr timeRange) contains(t time.Time) bool {
+	return (tr.from.IsZero() || !t.Before(tr.from)) && (tr.to.IsZero() || t.Before(tr.to))
+}
+
+// unbounded returns true if neither from nor to is set.
+func (tr timeRange) unbounded() bool {
+	return tr.from.IsZero() && tr.to.IsZero()
+}
+
+// fromUnix and toUnix return the ends as Unix times, for queries.
+// Unbounded ends are 0 and the largest time.
+func (tr timeRange) fromUnix() int64 {
+	if tr.from.IsZero() {
+		return 0
+	}
+	return tr.from.Unix()
+}
+
+func (tr timeRange) toUnix() int64 {
+	if tr.to.IsZero() {
+		return 1<<63 - 1
+	}
+	return tr.to.Unix()
+}
+
+// parseTimeRange parses the from and to form values, as 400s if they're
+// bad. Both are optional.
+func parseTimeRange(r *http.Request, now time.Time) (timeRange, error) {
+	var tr timeRange
+	loc := requestZone(r)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"from", &tr.from},
+		{"to", &tr.to},
+	} {
+		s := strings.TrimSpace(r.FormValue(p.name))
+		if s == "" {
+			continue
+		}
+		t, err := parseRangeTime(s, now, loc)
+		if err != nil {
+			return tr, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("bad %s %q, %s", p.name, s, rangeTimeHelp),
+				code:     http.StatusBadRequest,
+				details:  map[string]fieldErrors{"fields": {p.name: rangeTimeHelp}},
+			}
+		}
+		*p.t = t
+	}
+	if !tr.from.IsZero() && !tr.to.IsZero() && !tr.from.Before(tr.to) {
+		return tr, errHTTP{
+			external: "from must be before to",
+			code:     http.StatusBadRequest,
+		}
+	}
+	return tr, nil
+}
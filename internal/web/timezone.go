@@ -0,0 +1,277 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Times are shown in the deployment's time zone, set with -time_zone or on
+// the preferences page, or in UTC if it has none. Users can pick their own
+// zone, which overrides it for them. Schedules use the deployment's zone,
+// or the server's local time if it has none, as they did before zones
+// could be set.
+//
+// Times sent to other programs, like the dashboard JSON and published
+// events, stay in UTC.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+const settingTimeZone = "time_zone"
+
+// zones holds the deployment's and users' time zones, loaded by
+// loadTimeZones and kept up to date when they're changed.
+var zones struct {
+	sync.Mutex
+	deployment *time.Location
+	users      map[string]*time.Location
+}
+
+// parseTimeZone loads a zone by its IANA name, as a 400 if it's unknown.
+func parseTimeZone(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		return nil, errHTTP{
+			internal: err,
+			external: fmt.Sprintf("unknown time zone %q", name),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"zone": "unknown time zone"}},
+		}
+	}
+	return loc, nil
+}
+
+// loadTimeZones loads the deployment's and users' zones. Called from
+// loadSettings. Zones that no longer load are ignored, with a log message.
+func loadTimeZones() {
+	name := serverOpts.TimeZone
+	if name == "" {
+		var err error
+		if name, err = getSetting(settingTimeZone); err != nil {
+			log.Printf("Failed to read time zone setting: %v", err)
+		}
+	}
+	var deployment *time.Location
+	if name != "" {
+		var err error
+		if deployment, err = parseTimeZone(name); err != nil {
+			if serverOpts.TimeZone != "" {
+				log.Fatalf("Invalid -time_zone %q", name)
+			}
+			log.Printf("Ignoring unknown time zone setting %q", name)
+		}
+	}
+
+	users := make(map[string]*time.Location)
+	rows, err := db.Query(`SELECT user, time_zone FROM userprefs`)
+	if err != nil {
+		log.Printf("Failed to read user time zones: %v", err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var user, name string
+			if err := rows.Scan(&user, &name); err != nil {
+				log.Printf("Failed to read user time zones: %v", err)
+				break
+			}
+			loc, err := parseTimeZone(name)
+			if err != nil {
+				log.Printf("Ignoring unknown time zone %q of %q", name, user)
+				continue
+			}
+			users[user] = loc
+		}
+	}
+
+	zones.Lock()
+	defer zones.Unlock()
+	zones.deployment = deployment
+	zones.users = users
+}
+
+// displayZone returns the zone to show times in when there's no user to
+// ask, like in emails and job logs.
+func displayZone() *time.Location {
+	zones.Lock()
+	defer zones.Unlock()
+	if zones.deployment != nil {
+		return zones.deployment
+	}
+	return time.UTC
+}
+
+// scheduleZone returns the zone schedules are in.
+func scheduleZone() *time.Location {
+	zones.Lock()
+	defer zones.Unlock()
+	if zones.deployment != nil {
+		return zones.deployment
+	}
+	return time.Local
+}
+
+// requestZone returns the zone to show times in to the user making the
+// request.
+func requestZone(r *http.Request) *time.Location {
+	zones.Lock()
+	loc := zones.users[remoteUser(r)]
+	zones.Unlock()
+	if loc != nil {
+		return loc
+	}
+	return displayZone()
+}
+
+// formatTime formats t for humans, in loc.
+func formatTime(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(saneTime)
+}
+
+// formatUnix formats seconds since the epoch for humans, in loc.
+func formatUnix(t int64, loc *time.Location) string {
+	return formatTime(time.Unix(t, 0), loc)
+}
+
+// formatLogTime re-formats the time of a squid log entry, which is in UTC,
+// in loc. Times that don't parse are returned as they are.
+func formatLogTime(s string, loc *time.Location) string {
+	t, err := time.Parse(squidlog.TimeFormat, s)
+	if err != nil {
+		return s
+	}
+	return formatTime(t, loc)
+}
+
+func preferencesHandler(r *http.Request) (template.HTML, error) {
+	user := remoteUser(r)
+	data := struct {
+		User       string
+		Zone       string
+		Deployment string
+		Flag       bool
+		Admin      bool
+	}{
+		User:       user,
+		Deployment: displayZone().String(),
+		Flag:       serverOpts.TimeZone != "",
+		Admin:      requestPermission(r) >= permAdmin,
+	}
+	zones.Lock()
+	if loc := zones.users[user]; loc != nil {
+		data.Zone = loc.String()
+	}
+	zones.Unlock()
+	tmpl := getTemplate("preferences.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// userTimeZoneHandler sets the time zone of the user making the request, or
+// clears it if it's empty.
+func userTimeZoneHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Zone string `form:"zone,trim,max=100"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	var loc *time.Location
+	if data.Zone != "" {
+		var err error
+		if loc, err = parseTimeZone(data.Zone); err != nil {
+			return nil, err
+		}
+	}
+	user := remoteUser(r)
+	log.Printf("Setting time zone of %q to %q", user, data.Zone)
+	var err error
+	if loc == nil {
+		_, err = db.Exec(`DELETE FROM userprefs WHERE user=?`, user)
+	} else {
+		_, err = db.Exec(`INSERT OR REPLACE INTO userprefs(user, time_zone) VALUES(?,?)`, user, data.Zone)
+	}
+	if err != nil {
+		return nil, err
+	}
+	zones.Lock()
+	if zones.users == nil {
+		zones.users = make(map[string]*time.Location)
+	}
+	if loc == nil {
+		delete(zones.users, user)
+	} else {
+		zones.users[user] = loc
+	}
+	zones.Unlock()
+	return &struct {
+		User string `json:"user"`
+		Zone string `json:"zone"`
+	}{
+		User: user,
+		Zone: data.Zone,
+	}, nil
+}
+
+// deploymentTimeZoneHandler sets the deployment's time zone, or clears it
+// if it's empty. It can't be changed when -time_zone is set.
+func deploymentTimeZoneHandler(r *http.Request) (interface{}, error) {
+	if serverOpts.TimeZone != "" {
+		return nil, errHTTP{
+			external: "the time zone is set with -time_zone",
+			code:     http.StatusConflict,
+		}
+	}
+	var data struct {
+		Zone string `form:"zone,trim,max=100"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	var loc *time.Location
+	if data.Zone != "" {
+		var err error
+		if loc, err = parseTimeZone(data.Zone); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Setting deployment time zone to %q", data.Zone)
+	var err error
+	if loc == nil {
+		_, err = db.Exec(`DELETE FROM settings WHERE name=?`, settingTimeZone)
+	} else {
+		err = setSetting(settingTimeZone, data.Zone)
+	}
+	if err != nil {
+		return nil, err
+	}
+	zones.Lock()
+	zones.deployment = loc
+	zones.Unlock()
+	return &struct {
+		Zone string `json:"zone"`
+	}{
+		Zone: data.Zone,
+	}, nil
+}
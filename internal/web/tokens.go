@@ -0,0 +1,532 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// API tokens let scripts use the JSON API without a browser. A request
+// with "Authorization: Bearer <token>" is authenticated by the token
+// instead of the web server, with the permission the token was created
+// with, and acts as "token:<name>". Browsers never send that header on
+// their own, so such requests can't be forged cross-site, and skip the
+// CSRF token and X-Requested-With checks. Requests without it still get
+// them. Only a hash of each token is stored.
+//
+// Tokens can be limited further, to scopes (like only writing rules) and
+// to changing only some ACLs, so that e.g. a CI job that only updates its
+// own rules can't delete groups. A token without scopes can do anything
+// its permission allows.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// tokenPrefix starts every token, so that they're easy to recognize,
+	// e.g. by secret scanners.
+	tokenPrefix = "swt_"
+
+	// tokenLastUsedPeriod is how often last_used is written.
+	tokenLastUsedPeriod = time.Minute
+
+	// Token scopes.
+	scopeRead       = "read"
+	scopeLogsRead   = "logs:read"
+	scopeRulesWrite = "rules:write"
+	scopeApply      = "apply"
+)
+
+var tokenScopes = []string{scopeRead, scopeLogsRead, scopeRulesWrite, scopeApply}
+
+// reTokenName is what token names can be. They end up in the change log
+// as "token:<name>".
+var reTokenName = regexp.MustCompile(`^[\w.-]{1,64}$`)
+
+type tokenID string
+
+func assertTokenID(s string) tokenID { return tokenID(assertUUID(s)) }
+
+// apiToken is a token, without the secret.
+type apiToken struct {
+	TokenID    tokenID
+	Name       string
+	Permission permission
+	Actor      string
+	Created    string
+	LastUsed   string
+
+	// OldExpires is when secrets replaced by rotating stop working, if
+	// any still do.
+	OldExpires string
+
+	// Scopes are what the token is limited to, or empty if it isn't.
+	Scopes []string
+
+	// ACLs are the only ACLs the token can change, or empty if it can
+	// change any. ACLNames are their names, for showing.
+	ACLs     []aclID
+	ACLNames []string
+}
+
+// User is who requests with the token act as.
+func (t *apiToken) User() string { return "token:" + t.Name }
+
+type tokenContextKey struct{}
+
+// requestToken returns the token r was authenticated with, or nil.
+func requestToken(r *http.Request) *apiToken {
+	t, _ := r.Context().Value(tokenContextKey{}).(*apiToken)
+	return t
+}
+
+// logRoute returns true if route reads squid logs, or stats from them.
+func logRoute(route string) bool {
+	for _, p := range []string{"/log/", "/stats/", "/tail", "/ajax/tail-log"} {
+		if strings.HasPrefix(route, p) {
+			return true
+		}
+	}
+	return strings.HasPrefix(route, "/source/") && strings.Contains(route, "/activity")
+}
+
+// rulesRoute returns true if route changes rules or ACLs.
+func rulesRoute(route string) bool {
+	return strings.HasPrefix(route, "/rule/") || strings.HasPrefix(route, "/acl/") || route == "/review/convert" || route == "/triage/commit"
+}
+
+// scopeAllows returns true if scope covers a request with method to
+// route, which needs perm.
+func scopeAllows(scope, method, route string, perm permission) bool {
+	if route == "/tokens/rotate" {
+		// Any token can rotate itself.
+		return true
+	}
+	write := perm >= permWrite && method != "GET" && method != "HEAD"
+	switch scope {
+	case scopeRead:
+		return !write && !logRoute(route)
+	case scopeLogsRead:
+		return !write && logRoute(route)
+	case scopeRulesWrite:
+		return write && rulesRoute(route)
+	case scopeApply:
+		return route == "/config/apply"
+	}
+	return false
+}
+
+// denies returns why the token can't be used for r to route, which needs
+// perm, or "" if it can. Its permission is checked separately.
+func (t *apiToken) denies(r *http.Request, route string, perm permission) string {
+	if len(t.Scopes) > 0 {
+		ok := false
+		for _, s := range t.Scopes {
+			if scopeAllows(s, r.Method, route, perm) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Sprintf("token scopes %s don't cover %s %s", strings.Join(t.Scopes, ", "), r.Method, route)
+		}
+	}
+	if len(t.ACLs) == 0 || perm < permWrite || r.Method == "GET" || r.Method == "HEAD" {
+		return ""
+	}
+	acls, err := requestACLs(r)
+	if err != nil {
+		log.Printf("Failed to find ACLs changed by %s %s: %v", r.Method, r.URL.Path, err)
+		return "failed to find which ACLs the request changes"
+	}
+	if len(acls) == 0 {
+		return "token can only change its ACLs, and the request isn't for one of them"
+	}
+	for _, a := range acls {
+		found := false
+		for _, b := range t.ACLs {
+			if a == b {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("token can't change ACL %s", a)
+		}
+	}
+	return ""
+}
+
+// requestACLs returns the ACLs a request changes, going by its aclID, an
+// acl form value, and the ACLs its rules (ruleID or rules[]) are in.
+// Rules in no ACL count as in the one new rules go to.
+func requestACLs(r *http.Request) ([]aclID, error) {
+	if err := parseJSONBody(r); err != nil {
+		return nil, err
+	}
+	r.ParseForm()
+	var ret []aclID
+	if a := mux.Vars(r)["aclID"]; a != "" {
+		ret = append(ret, aclID(a))
+	}
+	if a := r.FormValue("acl"); a != "" {
+		ret = append(ret, aclID(a))
+	}
+	rules := r.Form["rules[]"]
+	if rule := mux.Vars(r)["ruleID"]; rule != "" {
+		rules = append(rules, rule)
+	}
+	for _, rule := range rules {
+		rows, err := db.Query(`SELECT acl_id FROM aclrules WHERE rule_id=?`, rule)
+		if err != nil {
+			return nil, err
+		}
+		n := 0
+		for rows.Next() {
+			var a string
+			if err := rows.Scan(&a); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			ret = append(ret, aclID(a))
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			ret = append(ret, newACLID)
+		}
+	}
+	return ret, nil
+}
+
+// hashToken returns the SHA-256 of a token, as stored for tokens from
+// before argon2id.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// lookupToken returns the token with the secret token, or nil if there's
+// none.
+func lookupToken(token string, now time.Time) (*apiToken, error) {
+	id, err := tokenOwner(token, now)
+	if err != nil || id == "" {
+		return nil, err
+	}
+	t := &apiToken{}
+	var perm string
+	var created int64
+	var lastUsed sql.NullInt64
+	if err := db.QueryRow(`SELECT name, permission, actor, created, last_used FROM apitokens WHERE token_id=?`, id).Scan(&t.Name, &perm, &t.Actor, &created, &lastUsed); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if t.Permission, err = parsePermission(perm); err != nil {
+		return nil, fmt.Errorf("token %s: %v", id, err)
+	}
+	t.TokenID = tokenID(id)
+	t.Created = formatUnix(created, displayZone())
+	if err := loadTokenLimits(t); err != nil {
+		return nil, err
+	}
+	if !lastUsed.Valid || now.Unix()-lastUsed.Int64 >= int64(tokenLastUsedPeriod.Seconds()) {
+		if _, err := db.Exec(`UPDATE apitokens SET last_used=? WHERE token_id=?`, now.Unix(), id); err != nil {
+			log.Printf("Failed to update last use of token %s: %v", id, err)
+		}
+	}
+	return t, nil
+}
+
+// getTokens returns all tokens, by name, with times in loc.
+func getTokens(loc *time.Location) ([]apiToken, error) {
+	rows, err := db.Query(`SELECT token_id, name, permission, actor, created, last_used FROM apitokens ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []apiToken
+	for rows.Next() {
+		var t apiToken
+		var id, perm string
+		var created int64
+		var lastUsed sql.NullInt64
+		if err := rows.Scan(&id, &t.Name, &perm, &t.Actor, &created, &lastUsed); err != nil {
+			return nil, err
+		}
+		t.TokenID = tokenID(id)
+		if t.Permission, err = parsePermission(perm); err != nil {
+			return nil, fmt.Errorf("token %s: %v", id, err)
+		}
+		t.Created = formatUnix(created, loc)
+		if lastUsed.Valid {
+			t.LastUsed = formatUnix(lastUsed.Int64, loc)
+		}
+		ret = append(ret, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for n := range ret {
+		if err := loadTokenLimits(&ret[n]); err != nil {
+			return nil, err
+		}
+		var old sql.NullInt64
+		if err := db.QueryRow(`SELECT MAX(expires) FROM apitokensecrets WHERE token_id=? AND expires>?`, string(ret[n].TokenID), now).Scan(&old); err != nil {
+			return nil, err
+		}
+		if old.Valid {
+			ret[n].OldExpires = formatUnix(old.Int64, loc)
+		}
+	}
+	return ret, nil
+}
+
+// loadTokenLimits reads the scopes and ACLs of t.
+func loadTokenLimits(t *apiToken) error {
+	rows, err := db.Query(`SELECT scope FROM apitokenscopes WHERE token_id=? ORDER BY scope`, string(t.TokenID))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return err
+		}
+		t.Scopes = append(t.Scopes, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// ACLs that have been deleted since are still listed, by ID.
+	rows2, err := db.Query(`
+SELECT apitokenacls.acl_id, COALESCE(acls.comment, apitokenacls.acl_id)
+FROM apitokenacls
+LEFT JOIN acls ON apitokenacls.acl_id=acls.acl_id
+WHERE token_id=?
+ORDER BY 2`, string(t.TokenID))
+	if err != nil {
+		return err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var id, name string
+		if err := rows2.Scan(&id, &name); err != nil {
+			return err
+		}
+		t.ACLs = append(t.ACLs, aclID(id))
+		t.ACLNames = append(t.ACLNames, name)
+	}
+	return rows2.Err()
+}
+
+// tokenAuth authenticates requests with a bearer token. It has to be
+// outside the CSRF protection, which it turns off for them. Other
+// Authorization schemes, like the Basic auth of nginx's auth_basic, are
+// the web server's business and pass through untouched.
+type tokenAuth struct{ h http.Handler }
+
+func (c tokenAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a := r.Header.Get("Authorization")
+	if !strings.HasPrefix(a, "Bearer ") {
+		c.h.ServeHTTP(w, r)
+		return
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(a, "Bearer "))
+	if token == "" {
+		writeJSONError(w, r, errHTTP{
+			external: "Unauthorized - empty Bearer token",
+			code:     http.StatusUnauthorized,
+		})
+		return
+	}
+	t, err := lookupToken(token, time.Now())
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	if t == nil {
+		log.Printf("Invalid API token from %s for %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		writeJSONError(w, r, errHTTP{
+			external: "Unauthorized - invalid token",
+			code:     http.StatusUnauthorized,
+		})
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, t))
+	c.h.ServeHTTP(w, csrf.UnsafeSkipCheck(r))
+}
+
+// jsRequest matches API requests: from JS in the UI, or with a token.
+func jsRequest(r *http.Request, rm *mux.RouteMatch) bool {
+	if requestToken(r) != nil {
+		return true
+	}
+	h := r.Header["X-Requested-With"]
+	return len(h) == 1 && h[0] == "XMLHttpRequest"
+}
+
+func tokensHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Tokens      []apiToken
+		Permissions []permission
+		Scopes      []string
+		ACLs        []acl
+	}{
+		Permissions: []permission{permRead, permWrite, permAdmin},
+		Scopes:      tokenScopes,
+	}
+	var err error
+	if data.Tokens, err = getTokens(requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.ACLs, err = getACLs(); err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("tokens.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func tokenNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Name       string   `form:"name,required,trim"`
+		Permission string   `form:"permission,required,enum=permission"`
+		Scopes     []string `form:"scopes[],enum=scope"`
+		ACLs       []string `form:"acls[],uuid"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	name := data.Name
+	if !reTokenName.MatchString(name) {
+		return nil, errHTTP{
+			external: fmt.Sprintf("invalid token name %q: want letters, digits, '.', '-' and '_'", name),
+			code:     http.StatusBadRequest,
+			details:  map[string]fieldErrors{"fields": {"name": "may only have letters, digits, '.', '-' and '_'"}},
+		}
+	}
+	perm, err := parsePermission(data.Permission)
+	if err != nil {
+		return nil, err
+	}
+	token, lookup, hash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Token      string   `json:"token"`
+		ID         string   `json:"id"`
+		Name       string   `json:"name"`
+		Permission string   `json:"permission"`
+		Scopes     []string `json:"scopes"`
+		ACLs       []string `json:"acls"`
+	}{
+		Token:      token,
+		ID:         uuid.NewV4().String(),
+		Name:       name,
+		Permission: perm.String(),
+		Scopes:     data.Scopes,
+		ACLs:       data.ACLs,
+	}
+	if resp.Scopes == nil {
+		resp.Scopes = []string{}
+	}
+	if resp.ACLs == nil {
+		resp.ACLs = []string{}
+	}
+	actor := remoteUser(r)
+	log.Printf("Adding API token %s %q with %s permission, scopes %q and ACLs %q for %q", resp.ID, name, perm, resp.Scopes, resp.ACLs, actor)
+	return &resp, store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		now := time.Now()
+		if _, err := tx.Exec(`INSERT INTO apitokens(token_id, name, token_hash, permission, actor, created) VALUES(?,?,?,?,?,?)`, resp.ID, name, noLegacyHash+resp.ID, perm.String(), actor, now.Unix()); err != nil {
+			var n int
+			if err2 := tx.QueryRow(`SELECT COUNT(*) FROM apitokens WHERE name=?`, name).Scan(&n); err2 == nil && n > 0 {
+				return errHTTP{
+					internal: err,
+					external: fmt.Sprintf("there's already a token named %q", name),
+					code:     http.StatusConflict,
+				}
+			}
+			return err
+		}
+		if err := addTokenSecret(tx, tokenID(resp.ID), lookup, hash, now); err != nil {
+			return err
+		}
+		for _, s := range resp.Scopes {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO apitokenscopes(token_id, scope) VALUES(?,?)`, resp.ID, s); err != nil {
+				return err
+			}
+		}
+		for _, a := range resp.ACLs {
+			var n int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM acls WHERE acl_id=?`, a).Scan(&n); err != nil {
+				return err
+			}
+			if n == 0 {
+				return errHTTP{
+					external: fmt.Sprintf("ACL %s not found", a),
+					code:     http.StatusBadRequest,
+					details:  map[string]fieldErrors{"fields": {"acls[]": "no such ACL"}},
+				}
+			}
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO apitokenacls(token_id, acl_id) VALUES(?,?)`, resp.ID, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func tokenDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertTokenID(mux.Vars(r)["tokenID"])
+	log.Printf("Revoking API token %s", id)
+	resp := struct {
+		ID      string `json:"id"`
+		Deleted int64  `json:"deleted"`
+	}{ID: string(id)}
+	return &resp, store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		for _, table := range []string{"apitokenscopes", "apitokenacls", "apitokensecrets"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE token_id=?`, string(id)); err != nil {
+				return err
+			}
+		}
+		var err error
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM apitokens WHERE token_id=?`, string(id)))
+		return err
+	})
+}
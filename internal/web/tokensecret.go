@@ -0,0 +1,331 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Token secrets are stored with argon2id, so that a copy of the database
+// doesn't give away working tokens. A token is swt_<lookup>_<secret>: the
+// lookup part finds the stored hash without trying every one, and only the
+// secret is hashed. Tokens from before this are only a secret, stored as
+// its SHA-256, and keep working until they're rotated.
+//
+// Rotating a token gives it a new secret, and keeps the ones it had valid
+// for a while, so that whatever uses it can switch over without failing
+// requests. A token can rotate itself.
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// argon2id parameters of new secrets. Stored hashes have their own, so
+	// these can be raised.
+	argonTime    = 2
+	argonMemory  = 19 * 1024 // KiB.
+	argonThreads = 1
+	argonKeyLen  = 32
+
+	// tokenVerifiedPeriod is how long a token that's been checked against
+	// its hash isn't checked again. Its secret being revoked or expired
+	// is still noticed right away.
+	tokenVerifiedPeriod = 10 * time.Minute
+
+	// Default and longest time old secrets stay valid after rotating.
+	defaultTokenOverlap = 24 * time.Hour
+	maxTokenOverlap     = 30 * 24 * time.Hour
+
+	// legacyHashPrefix marks SHA-256 hashes of tokens from before
+	// argon2id, moved to apitokensecrets by rotating.
+	legacyHashPrefix = "sha256$"
+
+	// noLegacyHash is the token_hash of tokens with no SHA-256 hash in
+	// apitokens, followed by their ID to keep it unique.
+	noLegacyHash = "none:"
+)
+
+var (
+	// kdfSem limits how many hashes are computed at once, as each takes
+	// argonMemory.
+	kdfSem = make(chan struct{}, 4)
+
+	// verifiedTokens are the SHA-256 of recently verified tokens, and the
+	// secret and time they were verified with.
+	verifiedTokens = struct {
+		sync.Mutex
+		m map[string]verifiedToken
+	}{m: make(map[string]verifiedToken)}
+)
+
+type verifiedToken struct {
+	secretID string
+	at       time.Time
+}
+
+// hashSecret returns the argon2id hash of secret, in the PHC string format.
+func hashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	kdfSem <- struct{}{}
+	key := argon2.IDKey([]byte(secret), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	<-kdfSem
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// checkSecret returns true if secret matches hash, from hashSecret.
+func checkSecret(secret, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	var memory, tm uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &tm, &threads); err != nil {
+		return false, fmt.Errorf("bad argon2 parameters %q: %v", parts[3], err)
+	}
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("bad salt: %v", err)
+	}
+	want, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("bad key: %v", err)
+	}
+	kdfSem <- struct{}{}
+	got := argon2.IDKey([]byte(secret), salt, tm, memory, threads, uint32(len(want)))
+	<-kdfSem
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// newToken returns a new random token, its lookup part and the hash to
+// store.
+func newToken() (token, lookup, hash string, err error) {
+	b := make([]byte, 8+32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	lookup, secret := hex.EncodeToString(b[:8]), hex.EncodeToString(b[8:])
+	if hash, err = hashSecret(secret); err != nil {
+		return "", "", "", err
+	}
+	return tokenPrefix + lookup + "_" + secret, lookup, hash, nil
+}
+
+// splitToken returns the lookup and secret parts of a token, and false if
+// it's from before they were.
+func splitToken(token string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(token, tokenPrefix), "_", 2)
+	if len(parts) != 2 || len(parts[0]) != 16 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// tokenOwner returns the ID of the token token is a valid secret of, or
+// "" if there's none.
+func tokenOwner(token string, now time.Time) (string, error) {
+	lookup, secret, ok := splitToken(token)
+	if !ok {
+		return legacyTokenOwner(token, now)
+	}
+	var id, hash string
+	var expires sql.NullInt64
+	if err := db.QueryRow(`SELECT token_id, hash, expires FROM apitokensecrets WHERE secret_id=?`, lookup).Scan(&id, &hash, &expires); err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if expires.Valid && expires.Int64 <= now.Unix() {
+		return "", nil
+	}
+	key := hashToken(token)
+	verifiedTokens.Lock()
+	v, found := verifiedTokens.m[key]
+	verifiedTokens.Unlock()
+	if found && v.secretID == lookup && now.Sub(v.at) < tokenVerifiedPeriod {
+		return id, nil
+	}
+	ok, err := checkSecret(secret, hash)
+	if err != nil {
+		return "", fmt.Errorf("secret %s of token %s: %v", lookup, id, err)
+	}
+	if !ok {
+		return "", nil
+	}
+	verifiedTokens.Lock()
+	for k, v := range verifiedTokens.m {
+		if now.Sub(v.at) >= tokenVerifiedPeriod {
+			delete(verifiedTokens.m, k)
+		}
+	}
+	verifiedTokens.m[key] = verifiedToken{secretID: lookup, at: now}
+	verifiedTokens.Unlock()
+	return id, nil
+}
+
+// legacyTokenOwner is tokenOwner for tokens stored as their SHA-256:
+// in apitokens until they're rotated, then in apitokensecrets until they
+// expire.
+func legacyTokenOwner(token string, now time.Time) (string, error) {
+	h := hashToken(token)
+	var id string
+	if err := db.QueryRow(`SELECT token_id FROM apitokens WHERE token_hash=?`, h).Scan(&id); err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	var expires sql.NullInt64
+	if err := db.QueryRow(`SELECT token_id, expires FROM apitokensecrets WHERE hash=?`, legacyHashPrefix+h).Scan(&id, &expires); err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if expires.Valid && expires.Int64 <= now.Unix() {
+		return "", nil
+	}
+	return id, nil
+}
+
+// addTokenSecret stores a new secret of token id.
+func addTokenSecret(tx *sql.Tx, id tokenID, lookup, hash string, now time.Time) error {
+	_, err := tx.Exec(`INSERT INTO apitokensecrets(secret_id, token_id, hash, created) VALUES(?,?,?,?)`, lookup, string(id), hash, now.Unix())
+	return err
+}
+
+// rotateToken gives token id a new secret, and its other secrets until
+// expires, if they'd last longer. It returns the new token.
+func rotateToken(tx *sql.Tx, id tokenID, expires, now time.Time) (string, error) {
+	var legacy string
+	if err := tx.QueryRow(`SELECT token_hash FROM apitokens WHERE token_id=?`, string(id)).Scan(&legacy); err == sql.ErrNoRows {
+		return "", errHTTP{
+			external: "token not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM apitokensecrets WHERE token_id=? AND expires<=?`, string(id), now.Unix()); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE apitokensecrets SET expires=? WHERE token_id=? AND (expires IS NULL OR expires>?)`, expires.Unix(), string(id), expires.Unix()); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(legacy, noLegacyHash) {
+		if _, err := tx.Exec(`INSERT INTO apitokensecrets(secret_id, token_id, hash, created, expires) VALUES(?,?,?,?,?)`, uuid.NewV4().String(), string(id), legacyHashPrefix+legacy, now.Unix(), expires.Unix()); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec(`UPDATE apitokens SET token_hash=? WHERE token_id=?`, noLegacyHash+string(id), string(id)); err != nil {
+			return "", err
+		}
+	}
+	token, lookup, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if err := addTokenSecret(tx, id, lookup, hash, now); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// rotate rotates token id, with the overlap in r, and returns the reply.
+func rotate(r *http.Request, id tokenID) (interface{}, error) {
+	var data struct {
+		Overlap string `form:"overlap,trim,max=20"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	overlap := defaultTokenOverlap
+	switch data.Overlap {
+	case "":
+	case "0":
+		overlap = 0
+	default:
+		var err error
+		overlap, err = parseExpiry(data.Overlap)
+		if err == nil && overlap > maxTokenOverlap {
+			err = fmt.Errorf("longer than %s", maxTokenOverlap)
+		}
+		if err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("bad overlap %q: %v", data.Overlap, err),
+				code:     http.StatusBadRequest,
+				details:  map[string]fieldErrors{"fields": {"overlap": "want a duration like 1h or 7d, at most 30d"}},
+			}
+		}
+	}
+	now := time.Now()
+	expires := now.Add(overlap)
+	log.Printf("Rotating API token %s for %q, old secrets valid until %s", id, remoteUser(r), expires.UTC().Format(time.RFC3339))
+	var token string
+	if err := store.UpdateNoBump(db, func(tx *sql.Tx) error {
+		var err error
+		token, err = rotateToken(tx, id, expires, now)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &struct {
+		Token      string `json:"token"`
+		ID         string `json:"id"`
+		OldExpires string `json:"old_expires"`
+	}{
+		Token:      token,
+		ID:         string(id),
+		OldExpires: expires.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// tokenRotateHandler rotates any token, for admins.
+func tokenRotateHandler(r *http.Request) (interface{}, error) {
+	return rotate(r, assertTokenID(mux.Vars(r)["tokenID"]))
+}
+
+// tokenRotateSelfHandler rotates the token the request is made with, so
+// that automation can rotate its own.
+func tokenRotateSelfHandler(r *http.Request) (interface{}, error) {
+	t := requestToken(r)
+	if t == nil {
+		return nil, errHTTP{
+			external: "only requests with an API token can rotate it",
+			code:     http.StatusBadRequest,
+		}
+	}
+	return rotate(r, t.TokenID)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// Triage walks through the squid log one denied entry at a time, letting
+// the user decide allow/block/ignore per domain and then commit all the
+// decisions as one batch.
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+type triageDecision struct {
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Action string `json:"action"`
+	Rule   string `json:"rule,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	origin *logOrigin
+}
+
+func triageHandler(r *http.Request) (template.HTML, error) {
+	tmpl := getTemplate("triage.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// logRequest returns the policy request of a squid log entry.
+func logRequest(client, method, url string) policy.Request {
+	proto := policy.ProtoHTTP
+	if method == "CONNECT" {
+		proto = policy.ProtoConnect
+	}
+	return policy.Request{Proto: proto, Source: client, Method: method, URI: url}
+}
+
+// triageNextHandler returns the first denied log entry after byte offset
+// 'offset' whose domain is not in 'skip[]' and isn't already covered by a
+// rule.
+func triageNextHandler(r *http.Request) (interface{}, error) {
+	r.ParseForm()
+	var offset int64
+	if o := r.FormValue("offset"); o != "" {
+		var err error
+		offset, err = strconv.ParseInt(o, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("bad offset %q", o),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	skip := make(map[string]bool)
+	for _, d := range r.Form["skip[]"] {
+		skip[d] = true
+	}
+
+	pol, err := currentPolicy()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(serverOpts.SquidLog)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, 0); err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		Entry  *squidlog.Entry `json:"entry"`
+		Type   string          `json:"type"`
+		Offset int64           `json:"offset"`
+	}{}
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF {
+			// Don't consume partial lines.
+			resp.Offset = offset
+			return &resp, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(len(line))
+		e, err := squidlog.Parse(line)
+		if err != nil || skip[e.Domain] || !strings.Contains(e.Status, "DENIED") {
+			continue
+		}
+		if pol.Covers(logRequest(e.Client, e.Method, e.URL)) {
+			continue
+		}
+		e.Time = formatLogTime(e.Time, requestZone(r))
+		resp.Entry = e
+		resp.Type = typeDomain
+		if e.Method == "CONNECT" {
+			resp.Type = typeHTTPSDomain
+		}
+		resp.Offset = offset
+		return &resp, nil
+	}
+}
+
+// triageCommitHandler creates rules in the "new" ACL for all decisions.
+// Duplicates are reported per decision and don't fail the batch. The log
+// entries decided on can be passed in log_times[], log_clients[] and
+// log_urls[], to record them with the rules.
+func triageCommitHandler(r *http.Request) (interface{}, error) {
+	r.ParseForm()
+	types := r.Form["types[]"]
+	values := r.Form["values[]"]
+	actions := r.Form["actions[]"]
+	if len(types) != len(values) || len(types) != len(actions) {
+		return nil, errHTTP{
+			internal: fmt.Errorf("type/value/action list lengths unequal: %d/%d/%d", len(types), len(values), len(actions)),
+			external: "type, value and action lists must have equal length",
+			code:     http.StatusBadRequest,
+		}
+	}
+	times := r.Form["log_times[]"]
+	clients := r.Form["log_clients[]"]
+	urls := r.Form["log_urls[]"]
+	withOrigin := len(times) > 0 || len(clients) > 0 || len(urls) > 0
+	if withOrigin && (len(times) != len(types) || len(clients) != len(types) || len(urls) != len(types)) {
+		return nil, errHTTP{
+			external: "log entry lists must have one entry per decision",
+			code:     http.StatusBadRequest,
+		}
+	}
+	var decisions []*triageDecision
+	for n := range types {
+		d := &triageDecision{
+			Type:   types[n],
+			Value:  values[n],
+			Action: actions[n],
+		}
+		switch d.Type {
+		case typeDomain, typeHTTPSDomain:
+		default:
+			return nil, errHTTP{external: fmt.Sprintf("bad type %q", d.Type), code: http.StatusBadRequest}
+		}
+		switch d.Action {
+		case actionAllow, actionBlock, actionIgnore:
+		default:
+			return nil, errHTTP{external: fmt.Sprintf("bad action %q", d.Action), code: http.StatusBadRequest}
+		}
+		if d.Value == "" {
+			return nil, errHTTP{external: "empty value", code: http.StatusBadRequest}
+		}
+		if withOrigin {
+			var err error
+			if d.origin, err = parseLogOrigin(times[n], clients[n], urls[n], requestZone(r)); err != nil {
+				return nil, err
+			}
+		}
+		decisions = append(decisions, d)
+	}
+
+	return &decisions, txWrap(func(tx *sql.Tx) error {
+		for _, d := range decisions {
+			id, err := insertRule(tx, newACLID, d.Type, d.Value, d.Action)
+			if e, ok := err.(errHTTP); ok && e.code == http.StatusConflict {
+				d.Error = e.external
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := recordRuleOrigin(tx, id, d.origin); err != nil {
+				return err
+			}
+			d.Rule = id
+		}
+		return nil
+	})
+}
@@ -0,0 +1,1964 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/squidlog"
+	"github.com/google/squidwarden/internal/store"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	version = "0.99"
+
+	newACLID = aclID("88bf513a-802f-450d-9fc4-b49eeabf1b8f")
+
+	actionAllow  = policy.ActionAllow
+	actionBlock  = policy.ActionBlock
+	actionIgnore = policy.ActionIgnore
+
+	typeDomain      = policy.TypeDomain
+	typeHTTPSDomain = policy.TypeHTTPSDomain
+	typeExact       = policy.TypeExact
+	typeRegex       = policy.TypeRegex
+	typeHTTPSRegex  = policy.TypeHTTPSRegex
+
+	saneTime = squidlog.TimeFormat
+)
+
+var (
+	db *sql.DB
+
+	// The policy as the helper sees it, for everything that decides
+	// requests. Set with db.
+	policies *policy.Cache
+)
+
+type aclID string
+type acl struct {
+	ACLID   aclID
+	Comment string
+	Enabled bool
+	Pinned  bool `json:"-"` // By the current user, only set for menus.
+}
+type sourceID string
+type source struct {
+	SourceID sourceID
+	Source   string
+	Comment  string
+}
+
+type ruleID string
+type rule struct {
+	RuleID  ruleID
+	Type    string
+	Value   string
+	Action  string
+	Comment string
+	Enabled bool
+	Expires string
+	Origin  *logOrigin
+}
+
+func getTemplate(fn string, fm template.FuncMap) *template.Template {
+	b, err := readThemed("templates", serverOpts.Templates, fn)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := template.New(fn)
+	if fm != nil {
+		tmpl.Funcs(fm)
+	}
+	return template.Must(tmpl.Parse(string(b)))
+}
+
+func getTextTemplate(fn string, fm texttemplate.FuncMap) *texttemplate.Template {
+	b, err := readThemed("templates", serverOpts.Templates, fn)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := texttemplate.New(fn)
+	if fm != nil {
+		tmpl.Funcs(fm)
+	}
+	return texttemplate.Must(tmpl.Parse(string(b)))
+}
+
+func rootHandler(r *http.Request) (template.HTML, error) {
+	data, err := getDashboard(defaultChangeFeed, requestZone(r))
+	if err != nil {
+		return "", err
+	}
+	tmpl := getTemplate("main.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func pacHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-javascript-config")
+	tmpl := getTextTemplate("pac.js", nil)
+	if err := tmpl.Execute(w, &struct {
+		Proxy string
+	}{
+		Proxy: serverOpts.Proxy,
+	}); err != nil {
+		log.Printf("template execute fail: %v", err)
+	}
+}
+
+func aboutHandler(r *http.Request) (template.HTML, error) {
+	tmpl := getTemplate("about.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &struct {
+		Version   string
+		MemFiles  bool
+		DiskFiles bool
+		Theme     string
+	}{Version: version,
+		MemFiles:  serverOpts.MemFiles,
+		DiskFiles: serverOpts.DiskFiles,
+		Theme:     serverOpts.Theme,
+	}); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// ruleNewHandler adds a rule to the ACL in acl, or to the "new" ACL.
+func ruleNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Type   string `form:"type,required,enum=type"`
+		Value  string `form:"value,required"`
+		Action string `form:"action,required,enum=action"`
+		ACL    string `form:"acl,uuid"`
+
+		LogTime   string `form:"log_time"`
+		LogClient string `form:"log_client"`
+		LogURL    string `form:"log_url"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	dst := newACLID
+	if data.ACL != "" {
+		dst = aclID(data.ACL)
+	}
+	origin, err := parseLogOrigin(data.LogTime, data.LogClient, data.LogURL, requestZone(r))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		Rule string `json:"rule"`
+	}{}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if dst != newACLID {
+			var n int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM acls WHERE acl_id=?`, string(dst)).Scan(&n); err != nil {
+				return err
+			}
+			if n == 0 {
+				return errHTTP{external: "ACL not found", code: http.StatusNotFound}
+			}
+			if err := checkNotArchived(tx, dst); err != nil {
+				return err
+			}
+		}
+		var err error
+		if resp.Rule, err = insertRule(tx, dst, data.Type, data.Value, data.Action); err != nil {
+			return err
+		}
+		return recordRuleOrigin(tx, resp.Rule, origin)
+	})
+}
+
+// insertRule creates a new rule in the given ACL, returning its ID.
+// Duplicates are rejected with StatusConflict.
+func insertRule(tx *sql.Tx, aclID aclID, typ, value, action string) (string, error) {
+	if err := store.CheckRule(typ, action); err != nil {
+		return "", errHTTP{
+			internal: err,
+			external: err.Error(),
+			code:     http.StatusBadRequest,
+		}
+	}
+	id := uuid.NewV4().String()
+	log.Printf("Adding rule %q", id)
+	if _, err := tx.Exec(`INSERT INTO rules(rule_id, action, type, value) VALUES(?,?,?,?)`, id, action, typ, value); err != nil {
+		var existing string
+		if e := tx.QueryRow(`SELECT rule_id FROM rules WHERE type=? AND value=?`, typ, value).Scan(&existing); e != nil {
+			return "", errHTTP{
+				internal: fmt.Errorf("first %q, then %q", err, e),
+				external: "failed to insert rule",
+				code:     http.StatusInternalServerError,
+			}
+		}
+		return "", errHTTP{
+			internal: nil,
+			external: fmt.Sprintf("refusing to create duplicate of rule %s", existing),
+			details:  map[string]string{"existing": existing},
+			links: []errHTTPLink{
+				{
+					Text: "existing rule",
+					Link: "/rule/" + existing,
+				},
+			},
+			code: http.StatusConflict,
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO aclrules(acl_id, rule_id) VALUES(?, ?)`, string(aclID), id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func errWrapJSON(f func(*http.Request) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				writeJSONError(w, r, panicError(r, p))
+			}
+		}()
+		j, err := func() (interface{}, error) {
+			// Check that it was requested from JS. Token requests
+			// can't be forged by browsers.
+			if requestToken(r) == nil {
+				hn := "X-Requested-With"
+				h := r.Header[hn]
+				if len(h) != 1 {
+					return "", errHTTP{
+						internal: fmt.Errorf("possible XSRF attack: Want 1 %s, got %q", hn, h),
+						external: fmt.Sprintf("missing or duplicate %s header", hn),
+						code:     http.StatusBadRequest,
+					}
+				}
+				if got, want := h[0], "XMLHttpRequest"; got != want {
+					return "", errHTTP{
+						internal: fmt.Errorf("possible XSRF attack: want %s %q, got %q", hn, want, got),
+						external: fmt.Sprintf("bad %s header", hn),
+						code:     http.StatusBadRequest,
+					}
+				}
+			}
+			// Check that it's not enctype evilness.
+			if false {
+				hn := "Content-Type"
+				h := r.Header[hn]
+				if len(h) == 0 {
+					return "", errHTTP{
+						internal: fmt.Errorf("possible XSRF attack. got %q", h),
+						external: fmt.Sprintf("missing %s header", hn),
+						code:     http.StatusBadRequest,
+					}
+				}
+				// fcgi seems to sometimes generate duplicate headers.
+				for _, got := range h {
+					if want := "application/x-www-form-urlencoded; "; !strings.HasPrefix(got, want) {
+						return "", errHTTP{
+							internal: fmt.Errorf("possible XSRF attack: want %s prefixed %q, got %q", hn, want, h),
+							external: fmt.Sprintf("bad %s header", hn),
+							code:     http.StatusBadRequest,
+						}
+					}
+				}
+			}
+			if err := parseJSONBody(r); err != nil {
+				return nil, err
+			}
+			return f(r)
+		}()
+		if err != nil {
+			writeJSONError(w, r, err)
+			return
+		}
+		b, err := json.Marshal(j)
+		if err != nil {
+			writeJSONError(w, r, fmt.Errorf("marshalling JSON reply: %v", err))
+			return
+		}
+		if r.Method != "GET" {
+			// Lets the tab that made a change tell its own revision
+			// bumps from other people's. See watchRevision().
+			if rev, err := store.Revision(db); err == nil {
+				w.Header().Set("X-Revision", fmt.Sprint(rev))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(b); err != nil {
+			log.Printf("Failed to write JSON reply: %v", err)
+		}
+	}
+}
+
+func errWrap(f func(*http.Request) (template.HTML, error)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				httpError(w, r, panicError(r, p))
+			}
+		}()
+		tmpl := getTemplate("page.html", nil)
+		rev, err := store.Revision(db)
+		if err != nil {
+			log.Printf("Failed to read revision: %v", err)
+		}
+		freeze, err := activeFreeze(time.Now(), requestZone(r))
+		if err != nil {
+			log.Printf("Failed to read change freezes: %v", err)
+		}
+		h, err := f(r)
+		if err != nil {
+			if e, ok := err.(errHTTP); ok {
+				log.Printf("HTTP error. External: %q Code: %d. Internal: %v", e.external, e.code, e.internal)
+				http.Error(w, e.external, e.code)
+			} else {
+				log.Printf("Error in HTTP handler: %v", err)
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+			return
+		}
+		if err := tmpl.Execute(w, struct {
+			Now        string
+			Version    string
+			Websockets bool
+			CSRF       string
+			Revision   int64
+			Theme      siteTheme
+			Demo       bool
+			Freeze     *freezeWindow
+			Content    template.HTML
+		}{
+			Now:        formatTime(time.Now(), requestZone(r)),
+			Version:    version,
+			Websockets: serverOpts.Websockets && !serverOpts.FastCGI,
+			CSRF:       csrf.Token(r),
+			Revision:   rev,
+			Theme:      theme,
+			Demo:       serverOpts.Demo,
+			Freeze:     freeze,
+			Content:    h,
+		}); err != nil {
+			log.Printf("Error in main handler: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+const uuidRE = `[\da-f]{8}-[\da-f]{4}-[\da-f]{4}-[\da-f]{4}-[\da-f]{12}`
+
+var reUUID = regexp.MustCompile(`^` + uuidRE + `$`)
+
+func txWrap(f func(tx *sql.Tx) error) error {
+	if err := store.Update(db, f); err != nil {
+		return err
+	}
+	events.notify()
+	return nil
+}
+
+// rowsAffected wraps tx.Exec() for handlers that report how many rows
+// they changed.
+func rowsAffected(res sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func aclNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Comment string `form:"comment,required"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	u := uuid.NewV4().String()
+	resp := struct {
+		ACL string `json:"acl"`
+	}{ACL: u}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, u, data.Comment); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func groupNewHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Comment string `form:"comment,required"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	u := uuid.NewV4().String()
+	resp := struct {
+		Group string `json:"group"`
+	}{Group: u}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO groups(group_id, comment) VALUES(?,?)`, u, data.Comment); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func aclMoveHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Source      string   `form:"source,required,uuid"`
+		Destination string   `form:"destination,required,uuid"`
+		Rules       []string `form:"rules[],uuid"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	src, dst, rules := data.Source, data.Destination, data.Rules
+	if src == dst {
+		return nil, errHTTP{
+			external: "Rules are already in that ACL.",
+			code:     http.StatusBadRequest,
+		}
+	}
+	resp := struct {
+		Moved int64 `json:"moved"`
+	}{}
+	if len(rules) == 0 {
+		return &resp, nil
+	}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM acls WHERE acl_id=?`, dst).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return errHTTP{
+				external: "Destination ACL not found.",
+				code:     http.StatusNotFound,
+			}
+		}
+		if err := checkNotArchived(tx, aclID(src), aclID(dst)); err != nil {
+			return err
+		}
+		args := []interface{}{dst, src}
+		for _, ruleID := range rules {
+			args = append(args, ruleID)
+		}
+		q := `UPDATE aclrules SET acl_id=? WHERE acl_id=? AND rule_id IN (?` + strings.Repeat(",?", len(rules)-1) + `)`
+		res, err := tx.Exec(q, args...)
+		if err != nil {
+			return err
+		}
+		resp.Moved, err = res.RowsAffected()
+		return err
+	})
+}
+
+func accessUpdateHandler(r *http.Request) (interface{}, error) {
+	groupID := groupID(mux.Vars(r)["groupID"])
+	var data struct {
+		ACLs     []string `form:"acls[],uuid"`
+		Comments []string `form:"comments[]"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	acls, comments := data.ACLs, data.Comments
+	if len(comments) != len(acls) {
+		return nil, fmt.Errorf("acl list and comment list length unequal. acl=%d comment=%d", len(acls), len(comments))
+	}
+
+	resp := struct {
+		Group string   `json:"group"`
+		ACLs  []string `json:"acls"`
+	}{Group: string(groupID), ACLs: acls}
+	if resp.ACLs == nil {
+		resp.ACLs = []string{}
+	}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		// Archived ACLs aren't on the access page, so keep their grants.
+		if _, err := tx.Exec(`DELETE FROM groupaccess WHERE group_id=? AND acl_id NOT IN (SELECT acl_id FROM aclarchive)`, string(groupID)); err != nil {
+			return err
+		}
+		for _, a := range acls {
+			if err := checkNotArchived(tx, aclID(a)); err != nil {
+				return err
+			}
+		}
+		var rows [][]interface{}
+		for n := range acls {
+			rows = append(rows, []interface{}{string(groupID), acls[n], comments[n]})
+		}
+		return store.InsertMany(tx, `INSERT INTO groupaccess(group_id, acl_id, comment)`, rows)
+	})
+}
+
+type groupID string
+type group struct {
+	GroupID groupID
+	Comment string
+	Pinned  bool `json:"-"` // By the current user, only set for menus.
+}
+
+func membersHandler(r *http.Request) (template.HTML, error) {
+	current := groupID(mux.Vars(r)["groupID"])
+
+	type maybeSource struct {
+		Active  bool
+		Comment string
+		Expires string
+		Source  source
+	}
+	data := struct {
+		Groups    []group
+		Current   group
+		Owner     owner
+		QUIC      bool
+		Default   bool
+		Leases    bool
+		Templates []groupTemplate
+		Sources   []maybeSource
+	}{Leases: serverOpts.DHCPLeases != ""}
+	{
+		var err error
+		data.Groups, data.Current, err = getGroups(current)
+		if err != nil {
+			return "", fmt.Errorf("getGroups: %v", err)
+		}
+		pins, err := getPins(remoteUser(r), pinGroup)
+		if err != nil {
+			return "", err
+		}
+		data.Groups = pinGroups(data.Groups, pins)
+		data.Current.Pinned = pins[string(current)]
+		if data.Templates, err = getGroupTemplates(); err != nil {
+			return "", err
+		}
+	}
+	if len(current) > 0 {
+		active, err := getGroupSources(current)
+		if err != nil {
+			return "", err
+		}
+		if data.Owner, err = getGroupOwner(current); err != nil {
+			return "", err
+		}
+		quic, err := getQUICGroups()
+		if err != nil {
+			return "", err
+		}
+		data.QUIC = quic[current]
+		def, err := getDefaultGroup()
+		if err != nil {
+			return "", err
+		}
+		data.Default = def == current
+
+		expires, err := getMemberExpiries(current, requestZone(r))
+		if err != nil {
+			return "", err
+		}
+
+		sources, err := getSources()
+		if err != nil {
+			return "", err
+		}
+		for _, a := range sources {
+			e := maybeSource{Source: a, Expires: expires[a.SourceID]}
+			e.Comment, e.Active = active[a.SourceID]
+			data.Sources = append(data.Sources, e)
+		}
+	}
+
+	tmpl := getTemplate("members.html", template.FuncMap{"groupIDEQ": func(a, b groupID) bool { return a == b }})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func getGroups(currentID groupID) ([]group, group, error) {
+	var groups []group
+	var current group
+	rows, err := db.Query(`SELECT group_id, comment FROM groups ORDER BY comment`)
+	if err != nil {
+		return nil, group{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &c); err != nil {
+			return nil, group{}, err
+		}
+		e := group{
+			GroupID: groupID(s),
+			Comment: c.String,
+		}
+		groups = append(groups, e)
+		if currentID == e.GroupID {
+			current = e
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, group{}, err
+	}
+	return groups, current, nil
+}
+
+func accessHandler(r *http.Request) (template.HTML, error) {
+	current := groupID(mux.Vars(r)["groupID"])
+
+	type maybeACL struct {
+		Active  bool
+		Comment string
+		ACL     acl
+	}
+	data := struct {
+		Groups  []group
+		Current group
+		ACLs    []maybeACL
+	}{}
+	{
+		var err error
+		data.Groups, data.Current, err = getGroups(current)
+		if err != nil {
+			return "", err
+		}
+		pins, err := getPins(remoteUser(r), pinGroup)
+		if err != nil {
+			return "", err
+		}
+		data.Groups = pinGroups(data.Groups, pins)
+		data.Current.Pinned = pins[string(current)]
+	}
+	if len(current) > 0 {
+		active, err := getGroupACLs(current)
+		if err != nil {
+			return "", err
+		}
+
+		acls, err := getACLs()
+		if err != nil {
+			return "", err
+		}
+		for _, a := range acls {
+			e := maybeACL{ACL: a}
+			e.Comment, e.Active = active[a.ACLID]
+			data.ACLs = append(data.ACLs, e)
+		}
+	}
+
+	tmpl := getTemplate("access.html", template.FuncMap{"groupIDEQ": func(a, b groupID) bool { return a == b }})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func getGroupACLs(g groupID) (map[aclID]string, error) {
+	acls := make(map[aclID]string)
+
+	rows, err := db.Query(`SELECT acl_id, comment FROM groupaccess WHERE group_id=?`, string(g))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &c); err != nil {
+			return nil, err
+		}
+		acls[aclID(s)] = c.String
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return acls, nil
+}
+
+func getGroupSources(g groupID) (map[sourceID]string, error) {
+	// First see if it exists.
+	{
+		var t string
+		if err := db.QueryRow(`SELECT group_id FROM groups WHERE group_id=?`, string(g)).Scan(&t); err == sql.ErrNoRows {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("group %q not found", g),
+				code:     http.StatusNotFound,
+			}
+		} else if err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("failed looking up group %q", g),
+				code:     http.StatusInternalServerError,
+			}
+		}
+	}
+
+	sources := make(map[sourceID]string)
+
+	rows, err := db.Query(`SELECT source_id, comment FROM members WHERE group_id=?`, string(g))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &c); err != nil {
+			return nil, err
+		}
+		sources[sourceID(s)] = c.String
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+func getACLs() ([]acl, error) {
+	var acls []acl
+	rows, err := db.Query(`SELECT acl_id, comment FROM acls WHERE acl_id NOT IN (SELECT acl_id FROM aclarchive) ORDER BY comment`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &c); err != nil {
+			return nil, err
+		}
+		e := acl{
+			ACLID:   aclID(s),
+			Comment: c.String,
+		}
+		acls = append(acls, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return acls, nil
+}
+
+func getSources() ([]source, error) {
+	var sources []source
+	rows, err := db.Query(`SELECT source_id, source, comment FROM sources ORDER BY comment`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		var src string
+		var c sql.NullString
+		if err := rows.Scan(&s, &src, &c); err != nil {
+			return nil, err
+		}
+		e := source{
+			SourceID: sourceID(s),
+			Source:   src,
+			Comment:  c.String,
+		}
+		sources = append(sources, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// assertUUID returns s if it's a UUID. Otherwise it panics with an error
+// that recoverPanics replies to with a 400.
+func assertUUID(s string) string {
+	if !reUUID.MatchString(s) {
+		panic(errHTTP{
+			external: fmt.Sprintf("%q is not a valid ID", s),
+			code:     http.StatusBadRequest,
+		})
+	}
+	return s
+}
+
+func assertUUIDOrNull(s string) string {
+	if s == "" {
+		return ""
+	}
+	return assertUUID(s)
+}
+
+func assertACLID(s string) aclID       { return aclID(assertUUID(s)) }
+func assertACLIDOrNull(s string) aclID { return aclID(assertUUIDOrNull(s)) }
+func assertGroupID(s string) groupID   { return groupID(assertUUID(s)) }
+func assertRuleID(s string) ruleID     { return ruleID(assertUUID(s)) }
+func assertSourceID(s string) sourceID { return sourceID(assertUUID(s)) }
+
+func sourceDeleteHandler(r *http.Request) (interface{}, error) {
+	sid := assertSourceID(mux.Vars(r)["sourceID"])
+	im, err := readImpact(func(tx *sql.Tx) (*deleteImpact, error) { return getSourceImpact(tx, sid) })
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfirm(r, im); err != nil {
+		return nil, err
+	}
+	log.Printf("Deleting source %s", sid)
+	resp := struct {
+		Source  string `json:"source"`
+		Deleted int64  `json:"deleted"`
+	}{Source: string(sid)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		// Check again, in case something changed since.
+		im, err := getSourceImpact(tx, sid)
+		if err != nil {
+			return err
+		}
+		if err := checkConfirm(r, im); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM memberexpiry WHERE source_id=?`, string(sid)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM members WHERE source_id=?`, string(sid)); err != nil {
+			return err
+		}
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM sources WHERE source_id=?`, string(sid)))
+		return err
+	})
+}
+
+func groupDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	log.Printf("Deleting group %s", id)
+	resp := struct {
+		Group   string `json:"group"`
+		Deleted int64  `json:"deleted"`
+	}{Group: string(id)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM grouppause WHERE group_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM groupowners WHERE group_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM groupquic WHERE group_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM defaultgroup WHERE group_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM registrationcodes WHERE group_id=?`, string(id)); err != nil {
+			return err
+		}
+		if err := deletePins(tx, pinGroup, string(id)); err != nil {
+			return err
+		}
+		var err error
+		if resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM groups WHERE group_id=?`, string(id))); err != nil {
+			// Any group members left?
+			r := tx.QueryRow(`SELECT COUNT(*) FROM members WHERE group_id=?`, string(id))
+			var n uint64
+			if e := r.Scan(&n); e != nil {
+				log.Printf("Failed to find member count: %v", e)
+				return err
+			}
+			if n > 0 {
+				return errHTTP{
+					internal: err,
+					external: fmt.Sprintf("group still used by %d sources", n),
+					code:     http.StatusBadRequest,
+				}
+			}
+			// Any group accesses left?
+			r = tx.QueryRow(`SELECT COUNT(*) FROM groupaccess WHERE group_id=?`, string(id))
+			if e := r.Scan(&n); e != nil {
+				log.Printf("Failed to find groupaccess count: %v", e)
+				return err
+			}
+			if n > 0 {
+				return errHTTP{
+					internal: err,
+					external: fmt.Sprintf("group still granted access to %d acls", n),
+					code:     http.StatusBadRequest,
+				}
+			}
+			// Any ICAP services left?
+			r = tx.QueryRow(`SELECT COUNT(*) FROM groupicap WHERE group_id=?`, string(id))
+			if e := r.Scan(&n); e != nil {
+				log.Printf("Failed to find groupicap count: %v", e)
+				return err
+			}
+			if n > 0 {
+				return errHTTP{
+					internal: err,
+					external: fmt.Sprintf("group still sent through %d ICAP services", n),
+					code:     http.StatusBadRequest,
+				}
+			}
+			// Any quotas left?
+			r = tx.QueryRow(`SELECT COUNT(*) FROM quotas WHERE group_id=?`, string(id))
+			if e := r.Scan(&n); e != nil {
+				log.Printf("Failed to find quota count: %v", e)
+				return err
+			}
+			if n > 0 {
+				return errHTTP{
+					internal: err,
+					external: fmt.Sprintf("group still has %d quotas", n),
+					code:     http.StatusBadRequest,
+				}
+			}
+			// No? Then I'm out of ideas.
+			return errHTTP{
+				internal: err,
+				external: "can't delete group",
+				code:     http.StatusInternalServerError,
+			}
+		}
+		return nil
+	})
+}
+
+func aclDeleteHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	im, err := readImpact(func(tx *sql.Tx) (*deleteImpact, error) { return getACLImpact(tx, id) })
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfirm(r, im); err != nil {
+		return nil, err
+	}
+	log.Printf("Deleting ACL %s", id)
+	resp := struct {
+		ACL     string `json:"acl"`
+		Deleted int64  `json:"deleted"`
+	}{ACL: string(id)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		// Check again, in case something changed since.
+		im, err := getACLImpact(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkConfirm(r, im); err != nil {
+			return err
+		}
+		if err := deleteACLDependents(tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM denypages WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM aclschedule WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM aclarchive WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM aclowners WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM acldescriptions WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if err := deletePins(tx, pinACL, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM alertrules WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM listchanges WHERE list_id IN (SELECT list_id FROM listsubscriptions WHERE acl_id=?)`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM listentries WHERE list_id IN (SELECT list_id FROM listsubscriptions WHERE acl_id=?)`, string(id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM listsubscriptions WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		resp.Deleted, err = rowsAffected(tx.Exec(`DELETE FROM acls WHERE acl_id=?`, string(id)))
+		return err
+	})
+}
+
+func aclUpdateHandler(r *http.Request) (interface{}, error) {
+	id := assertSourceID(mux.Vars(r)["aclID"])
+	var data struct {
+		Comment string `form:"comment,required"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	comment := data.Comment
+	log.Printf("Updating ACL %s", id)
+	resp := struct {
+		ACL     string `json:"acl"`
+		Comment string `json:"comment"`
+		Updated int64  `json:"updated"`
+	}{ACL: string(id), Comment: comment}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if err := checkNotArchived(tx, aclID(id)); err != nil {
+			return err
+		}
+		var err error
+		if resp.Updated, err = rowsAffected(tx.Exec(`UPDATE acls SET comment=? WHERE acl_id=?`, comment, string(id))); err != nil {
+			log.Printf("Failed to update comment for %v: %v", id, err)
+			return err
+		}
+		return nil
+	})
+}
+
+// aclDescriptionHandler sets the Markdown description of the ACL, and
+// returns it rendered.
+func aclDescriptionHandler(r *http.Request) (interface{}, error) {
+	id := assertACLID(mux.Vars(r)["aclID"])
+	var data struct {
+		Description string `form:"description,trim,max=65536"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	desc := data.Description
+	log.Printf("Setting description of ACL %s", id)
+	resp := struct {
+		ACL         string        `json:"acl"`
+		Description string        `json:"description"`
+		HTML        template.HTML `json:"html"`
+	}{ACL: string(id), Description: desc, HTML: renderMarkdown(desc)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if err := checkNotArchived(tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM acldescriptions WHERE acl_id=?`, string(id)); err != nil {
+			return err
+		}
+		if desc == "" {
+			return nil
+		}
+		_, err := tx.Exec(`INSERT INTO acldescriptions(acl_id, description) VALUES(?,?)`, string(id), desc)
+		return err
+	})
+}
+
+func membersNewHandler(r *http.Request) (interface{}, error) {
+	gid := assertGroupID(mux.Vars(r)["groupID"])
+	var data struct {
+		Source        string `form:"source,required"`
+		SourceComment string `form:"source-comment"`
+		Comment       string `form:"comment"`
+		Expires       string `form:"expires,trim"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	expiry, err := parseMemberExpiry(data.Expires)
+	if err != nil {
+		return nil, err
+	}
+	u := assertSourceID(uuid.NewV4().String())
+	log.Printf("Creating member %s in %s", u, gid)
+	resp := struct {
+		Group  string `json:"group"`
+		Source string `json:"source"`
+	}{Group: string(gid), Source: string(u)}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO sources(source_id, source, comment) VALUES(?,?,?)`, string(u), data.Source, data.SourceComment); err != nil {
+			var existing string
+			if e := tx.QueryRow(`SELECT source_id FROM sources WHERE source=?`, data.Source).Scan(&existing); e != nil {
+				return errHTTP{
+					internal: fmt.Errorf("first %q, then %q", err, e),
+					external: "failed to insert source",
+					code:     http.StatusInternalServerError,
+				}
+			}
+			return errHTTP{
+				internal: nil,
+				external: fmt.Sprintf("refusing to create duplicate of source %s", existing),
+				details:  map[string]string{"existing": existing},
+				links: []errHTTPLink{
+					{
+						Text: "existing source",
+						Link: "/source/" + existing,
+					},
+				},
+				code: http.StatusConflict,
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO members(group_id, source_id, comment) VALUES(?,?,?)`, string(gid), string(u), data.Comment); err != nil {
+			return err
+		}
+		return setMemberExpiry(tx, gid, u, expiry, time.Now())
+	})
+}
+
+func membersmembersHandler(r *http.Request) (interface{}, error) {
+	gid := assertGroupID(mux.Vars(r)["groupID"])
+	var data struct {
+		Sources  []string `form:"sources[],uuid"`
+		Comments []string `form:"comments[]"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	sources, comments := data.Sources, data.Comments
+	if len(comments) != len(sources) {
+		return nil, fmt.Errorf("source list and comment list length unequal. source=%d comment=%d", len(sources), len(comments))
+	}
+
+	log.Printf("Updating group %s to %v", gid, sources)
+	resp := struct {
+		Group   string   `json:"group"`
+		Sources []string `json:"sources"`
+	}{Group: string(gid), Sources: sources}
+	if resp.Sources == nil {
+		resp.Sources = []string{}
+	}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE from members WHERE group_id=?`, string(gid)); err != nil {
+			return err
+		}
+		var rows [][]interface{}
+		for n := range sources {
+			rows = append(rows, []interface{}{string(gid), sources[n], comments[n]})
+		}
+		if err := store.InsertMany(tx, `INSERT INTO members(group_id, source_id, comment)`, rows); err != nil {
+			return err
+		}
+		// Expiry of sources no longer in the group goes with them.
+		_, err := tx.Exec(`DELETE FROM memberexpiry WHERE group_id=? AND source_id NOT IN (SELECT source_id FROM members WHERE group_id=?)`, string(gid), string(gid))
+		return err
+	})
+}
+
+func ruleDeleteHandler(r *http.Request) (interface{}, error) {
+	var data struct {
+		Rules []string `form:"rules[],uuid"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	rules := data.Rules
+	log.Printf("Deleting %s", strings.Join(rules, ", "))
+	resp := struct {
+		Rules   []string `json:"rules"`
+		Deleted int64    `json:"deleted"`
+	}{Rules: rules}
+	if resp.Rules == nil {
+		resp.Rules = []string{}
+	}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if err := checkRulesNotArchived(tx, rules...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM ruleexpiry WHERE rule_id IN ('%s')`, strings.Join(rules, "','"))); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM aclrules WHERE rule_id IN ('%s')`, strings.Join(rules, "','"))); err != nil {
+			return err
+		}
+		var err error
+		if resp.Deleted, err = rowsAffected(tx.Exec(fmt.Sprintf(`DELETE FROM rules WHERE rule_id IN ('%s')`, strings.Join(rules, "','")))); err != nil {
+			return err
+		}
+		return deleteOrphanOrigins(tx)
+	})
+}
+
+func ruleEditHandler(r *http.Request) (interface{}, error) {
+	ruleID := assertRuleID(mux.Vars(r)["ruleID"])
+	var data struct {
+		Action  string `form:"action,required,enum=action"`
+		Type    string `form:"type,required,enum=type"`
+		Value   string `form:"value,required"`
+		Comment string `form:"comment"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	log.Printf("Updating %q with %+v", ruleID, data)
+	resp := struct {
+		Rule      string   `json:"rule"`
+		Type      string   `json:"type"`
+		Value     string   `json:"value"`
+		Action    string   `json:"action"`
+		Comment   string   `json:"comment"`
+		Updated   int64    `json:"updated"`
+		Conflicts []string `json:"conflicts"`
+	}{
+		Rule:      string(ruleID),
+		Type:      data.Type,
+		Value:     data.Value,
+		Action:    data.Action,
+		Comment:   data.Comment,
+		Conflicts: []string{},
+	}
+	if err := txWrap(func(tx *sql.Tx) error {
+		if err := checkRulesNotArchived(tx, string(ruleID)); err != nil {
+			return err
+		}
+		if err := saveRuleVersion(tx, remoteUser(r), string(ruleID), time.Now()); err != nil {
+			return err
+		}
+		var err error
+		resp.Updated, err = rowsAffected(tx.Exec(`UPDATE rules SET type=?, value=?, action=?, comment=? WHERE rule_id=?`, data.Type, data.Value, data.Action, data.Comment, string(ruleID)))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	conflicts, err := getRuleConflicts(ruleID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range conflicts {
+		resp.Conflicts = append(resp.Conflicts, c.Message())
+	}
+	return &resp, nil
+}
+
+func ruleEnabledHandler(r *http.Request) (interface{}, error) {
+	id := assertRuleID(mux.Vars(r)["ruleID"])
+	var data struct {
+		Enabled bool `form:"enabled"`
+	}
+	if err := decodeForm(r, &data); err != nil {
+		return nil, err
+	}
+	enabled := data.Enabled
+	log.Printf("Setting rule %s enabled=%t", id, enabled)
+	resp := struct {
+		Rule    string `json:"rule"`
+		Enabled bool   `json:"enabled"`
+		Updated int64  `json:"updated"`
+	}{Rule: string(id), Enabled: enabled}
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if err := checkRulesNotArchived(tx, string(id)); err != nil {
+			return err
+		}
+		if err := saveRuleVersion(tx, remoteUser(r), string(id), time.Now()); err != nil {
+			return err
+		}
+		var err error
+		resp.Updated, err = rowsAffected(tx.Exec(`UPDATE rules SET enabled=? WHERE rule_id=?`, enabled, string(id)))
+		return err
+	})
+}
+
+func ruleListHandler(r *http.Request) (template.HTML, error) {
+	return "TODO", nil
+}
+
+func ruleHandler(r *http.Request) (template.HTML, error) {
+	current := assertRuleID(mux.Vars(r)["ruleID"])
+
+	data := struct {
+		Current rule
+		ACLs    []acl
+		History []ruleEdit
+	}{
+		Current: rule{
+			RuleID: current,
+		},
+	}
+
+	// Load rule.
+	var c sql.NullString
+	if err := db.QueryRow(`SELECT type, value, action, comment, enabled FROM rules WHERE rule_id=? `, string(current)).Scan(&data.Current.Type, &data.Current.Value, &data.Current.Action, &c, &data.Current.Enabled); err == sql.ErrNoRows {
+		return "", errHTTP{
+			external: "rule not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return "", err
+	}
+	data.Current.Comment = c.String
+
+	// Load expiry, if any.
+	var expires int64
+	if err := db.QueryRow(`SELECT expires FROM ruleexpiry WHERE rule_id=?`, string(current)).Scan(&expires); err == nil {
+		data.Current.Expires = formatUnix(expires, requestZone(r))
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	var err error
+	if data.Current.Origin, err = getRuleOrigin(current, requestZone(r)); err != nil {
+		return "", err
+	}
+	if data.History, err = getRuleHistory(current, requestZone(r)); err != nil {
+		return "", err
+	}
+
+	// Load ACLs.
+	rows, err := db.Query(`
+SELECT acls.acl_id,acls.comment
+FROM aclrules
+JOIN acls ON aclrules.acl_id=acls.acl_id
+WHERE aclrules.rule_id=?
+ORDER BY acls.comment`, string(current))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &c); err != nil {
+			return "", err
+		}
+
+		data.ACLs = append(data.ACLs, acl{
+			ACLID:   aclID(s),
+			Comment: c.String,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	// Render output
+	tmpl := getTemplate("rule.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func sourceHandler(r *http.Request) (template.HTML, error) {
+	current := assertSourceID(mux.Vars(r)["sourceID"])
+
+	data := struct {
+		Current source
+		Groups  []group
+	}{
+		Current: source{
+			SourceID: current,
+		},
+	}
+
+	// Load rule.
+	var c sql.NullString
+	if err := db.QueryRow(`SELECT source, comment FROM sources WHERE source_id=? `, string(current)).Scan(&data.Current.Source, &c); err == sql.ErrNoRows {
+		return "", errHTTP{
+			external: "source not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return "", err
+	}
+	data.Current.Comment = c.String
+
+	// Load ACLs.
+	rows, err := db.Query(`
+SELECT groups.group_id, groups.comment
+FROM groups
+JOIN members ON groups.group_id=members.group_id
+WHERE members.source_id=?
+ORDER BY groups.comment`, string(current))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &c); err != nil {
+			return "", err
+		}
+
+		data.Groups = append(data.Groups, group{
+			GroupID: groupID(s),
+			Comment: c.String,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	// Render output
+	tmpl := getTemplate("source.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func aclHandler(r *http.Request) (template.HTML, error) {
+	current := assertACLIDOrNull(mux.Vars(r)["aclID"])
+
+	data := struct {
+		ACLs []acl
+
+		Current     acl
+		Archived    *archivedACL // Current, if archived.
+		Owner       owner
+		Description string
+		Schedule    string
+		Rules       []rule
+		Conflicts   []ruleConflict
+		Actions     []string
+		Types       []string
+
+		ArchivedACLs []archivedACL
+	}{
+		Actions: []string{actionAllow, actionIgnore},
+		Types:   []string{typeDomain, typeHTTPSDomain, typeRegex, typeHTTPSRegex, typeExact},
+	}
+	{
+		rows, err := db.Query(`SELECT acl_id, comment, enabled FROM acls ORDER BY comment`)
+		if err != nil {
+			return "", err
+		}
+		defer rows.Close()
+
+		if data.ArchivedACLs, err = getArchivedACLs(requestZone(r)); err != nil {
+			return "", err
+		}
+		archived := make(map[aclID]int)
+		for n, a := range data.ArchivedACLs {
+			archived[a.ACLID] = n
+		}
+		for rows.Next() {
+			var s string
+			var c sql.NullString
+			var enabled bool
+			if err := rows.Scan(&s, &c, &enabled); err != nil {
+				return "", err
+			}
+			e := acl{
+				ACLID:   aclID(s),
+				Comment: c.String,
+				Enabled: enabled,
+			}
+			n, isArchived := archived[e.ACLID]
+			if current == e.ACLID {
+				data.Current = e
+				if isArchived {
+					data.Archived = &data.ArchivedACLs[n]
+				}
+			}
+			// Archived ACLs are only in the menu when looked at.
+			if !isArchived || current == e.ACLID {
+				data.ACLs = append(data.ACLs, e)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		pins, err := getPins(remoteUser(r), pinACL)
+		if err != nil {
+			return "", err
+		}
+		data.ACLs = pinACLs(data.ACLs, pins)
+		data.Current.Pinned = pins[string(current)]
+	}
+
+	if len(current) > 0 {
+		r, err := loadACL(current)
+		if err != nil {
+			return "", err
+		}
+		data.Rules = r
+		var ids []ruleID
+		for _, e := range r {
+			ids = append(ids, e.RuleID)
+		}
+		if data.Conflicts, err = getRuleConflicts(ids...); err != nil {
+			return "", err
+		}
+		if err := db.QueryRow(`SELECT schedule FROM aclschedule WHERE acl_id=?`, string(current)).Scan(&data.Schedule); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		if data.Owner, err = getACLOwner(current); err != nil {
+			return "", err
+		}
+		if err := db.QueryRow(`SELECT description FROM acldescriptions WHERE acl_id=?`, string(current)).Scan(&data.Description); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	tmpl := getTemplate("acl.html", template.FuncMap{
+		"aclIDEQ":  func(a, b aclID) bool { return a == b },
+		"markdown": renderMarkdown,
+	})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func loadACL(id aclID) ([]rule, error) {
+	// First check that it exists.
+	{
+		var t string
+		if err := db.QueryRow(`SELECT acl_id FROM acls WHERE acl_id=?`, string(id)).Scan(&t); err == sql.ErrNoRows {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("ACL %q not found", id),
+				code:     http.StatusNotFound,
+			}
+		} else if err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("failed looking up ACL %q", id),
+				code:     http.StatusInternalServerError,
+			}
+		}
+	}
+	rows, err := db.Query(`
+SELECT rules.rule_id, rules.type, rules.value, rules.action, rules.comment, rules.enabled
+FROM aclrules
+JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE aclrules.acl_id=?
+ORDER BY rules.comment, rules.type, rules.value`, string(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []rule
+	for rows.Next() {
+		var e rule
+		var s string
+		var c sql.NullString
+		if err := rows.Scan(&s, &e.Type, &e.Value, &e.Action, &c, &e.Enabled); err != nil {
+			return nil, err
+		}
+		e.RuleID = ruleID(s)
+		e.Comment = c.String
+		rules = append(rules, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// tailLogHandler returns the latest count entries, newest first, or the
+// latest ones between from and to. Ignored entries are left out.
+func tailLogHandler(w http.ResponseWriter, r *http.Request) {
+	count, err := parseTailCount(r)
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	tr, err := parseTimeRange(r, time.Now())
+	if err != nil {
+		writeJSONError(w, r, err)
+		return
+	}
+	f, err := os.Open(serverOpts.SquidLog)
+	if err != nil {
+		log.Printf("Failed to read squid log: %v", err)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		log.Printf("Failed to stat squid log: %v", err)
+		return
+	}
+	// Only read the end of the log, not the whole file.
+	entries := []*squidlog.Entry{}
+	loc := requestZone(r)
+	ign := currentIgnores()
+	keep := func(e *squidlog.Entry) bool { return !ign.hides(e) }
+	if _, err := readLogBefore(f, st.Size(), count, tr, keep, func(_ int64, e *squidlog.Entry) {
+		e.Time = formatLogTime(e.Time, loc)
+		entries = append(entries, e)
+	}); err != nil {
+		log.Printf("Failed to read squid log: %v", err)
+		return
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		log.Printf("Failed writing tail stuff: %v", err)
+	}
+}
+
+func getCSRFKey() []byte {
+	l := 32
+	k := make([]byte, l, l)
+	if n, err := rand.Read(k); err != nil {
+		if n != l {
+			panic(fmt.Sprintf("want %d random bytes, got %d", l, n))
+		}
+	}
+	return k
+}
+
+type csrfFail struct{}
+
+func (csrfFail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CSRF error with %q: %v", r.FormValue("csrf"), csrf.FailureReason(r))
+	httpError(w, r, errHTTP{
+		external: "Forbidden - CSRF token invalid",
+		code:     http.StatusForbidden,
+		reason:   "csrf",
+	})
+}
+
+func makeRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	rget := r.Methods("GET", "HEAD").Subrouter()
+	rpost := r.Methods("POST").MatcherFunc(jsRequest).Subrouter()
+	rdelete := r.Methods("DELETE").MatcherFunc(jsRequest).Subrouter()
+
+	// End user pages. Plain form POST, so not on rpost.
+	rform := r.Methods("GET", "HEAD", "POST").Subrouter()
+
+	u := uuidRE
+	rget.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(&myDir{"static", serverOpts.Static})))
+	pg := "{groupID:" + u + "}"
+	pa := "{aclID:" + u + "}"
+	pr := "{ruleID:" + u + "}"
+	ps := "{sourceID:" + u + "}"
+	pi := "{icapID:" + u + "}"
+	px := "{exceptionID:" + u + "}"
+	pq := "{quotaID:" + u + "}"
+	pl := "{listID:" + u + "}"
+	pal := "{alertID:" + u + "}"
+	pt := "{feedID:" + u + "}"
+	pf := "{freezeID:" + u + "}"
+	pj := "{jobID:" + u + "}"
+	pk := "{tokenID:" + u + "}"
+	pig := "{ignoreID:" + u + "}"
+	psn := "{snapshotID:" + u + "}"
+	ppr := "{promotionID:" + u + "}"
+	prg := "{registrationID:" + u + "}"
+	prc := "{codeID:" + u + "}"
+
+	// Handlers that write their own response.
+	for _, e := range []struct {
+		path    string
+		r       *mux.Router
+		perm    permission
+		handler http.HandlerFunc
+	}{
+		{path.Join("/exception"), rform, permPublic, exceptionFormHandler},
+		{path.Join("/register"), rform, permPublic, registerHandler},
+		{path.Join("/why"), rget, permPublic, whyHandler},
+		{path.Join("/proxy.pac"), rget, permPublic, pacHandler},
+		{path.Join("/theme.css"), rget, permPublic, themeCSSHandler},
+
+		{path.Join("/acl/", pa, "export"), rget, permRead, aclExportHandler},
+		{path.Join("/source/", ps, "activity/export"), rget, permRead, activityExportHandler},
+		{path.Join("/export.json"), rget, permRead, streamWrap(configExportHandler)},
+		{path.Join("/report"), rget, permRead, reportHandler},
+		{path.Join("/snapshot/", psn, "export"), rget, permRead, snapshotExportHandler},
+		{path.Join("/log/search"), rget, permRead, streamWrap(logSearchHandler)},
+		{path.Join("/log/changes"), rget, permRead, streamWrap(changeLogHandler)},
+		{path.Join("/stats/quota"), rget, permRead, streamWrap(quotaStatsHandler)},
+		{path.Join("/stats/review"), rget, permRead, streamWrap(reviewStatsHandler)},
+		{path.Join("/stats/traffic"), rget, permRead, streamWrap(trafficStatsHandler)},
+		{path.Join("/stats/acl-denials"), rget, permRead, streamWrap(aclDenialsHandler)},
+		{path.Join("/stats/group-traffic"), rget, permRead, streamWrap(groupTrafficHandler)},
+		{path.Join("/ajax/events"), rget, permRead, eventsHandler},
+		{path.Join("/ajax/tail-log"), rget, permRead, tailLogHandler},
+		{path.Join("/ajax/tail-log/stream"), rget, permRead, tailHandler},
+		{path.Join("/tail"), rget, permRead, tailViewHandler},
+		{path.Join("/site/{domain}/favicon"), rget, permRead, siteFaviconHandler},
+	} {
+		e.r.HandleFunc(e.path, authWrap(e.perm, e.path, e.handler))
+	}
+
+	for _, e := range []struct {
+		path    string
+		js      bool
+		r       *mux.Router
+		perm    permission
+		handler interface{}
+	}{
+		{path.Join("/"), false, rget, permRead, rootHandler},
+
+		{path.Join("/about"), false, rget, permRead, aboutHandler},
+
+		{path.Join("/dashboard.json"), true, rget, permRead, dashboardHandler},
+		{path.Join("/changes"), false, rget, permRead, changesHandler},
+
+		{path.Join("/alerts"), false, rget, permRead, alertsHandler},
+		{path.Join("/alerts/new"), true, rpost, permWrite, alertNewHandler},
+		{path.Join("/alerts/", pal), true, rdelete, permWrite, alertDeleteHandler},
+		{path.Join("/digest"), false, rget, permRead, digestHandler},
+		{path.Join("/digest/preview"), false, rget, permRead, digestPreviewHandler},
+		{path.Join("/digest/subscribe"), true, rpost, permRead, digestSubscribeHandler},
+		{path.Join("/digest/subscribe"), true, rdelete, permRead, digestUnsubscribeHandler},
+		{path.Join("/preferences"), false, rget, permRead, preferencesHandler},
+		{path.Join("/preferences/timezone"), true, rpost, permRead, userTimeZoneHandler},
+		{path.Join("/config/timezone"), true, rpost, permAdmin, deploymentTimeZoneHandler},
+
+		{path.Join("/analysis"), false, rget, permRead, analysisHandler},
+		{path.Join("/analysis.json"), true, rget, permRead, analysisJSONHandler},
+		{path.Join("/groupdiff"), false, rget, permRead, groupDiffHandler},
+		{path.Join("/groupdiff.json"), true, rget, permRead, groupDiffJSONHandler},
+		{path.Join("/discover"), false, rget, permRead, discoverHandler},
+		{path.Join("/discover.json"), true, rget, permRead, discoverJSONHandler},
+		{path.Join("/setup"), false, rget, permAdmin, setupHandler},
+		{path.Join("/setup/schema"), true, rpost, permAdmin, setupSchemaHandler},
+		{path.Join("/setup/admin"), true, rpost, permAdmin, setupAdminHandler},
+		{path.Join("/setup/squidlog"), true, rpost, permAdmin, setupSquidLogHandler},
+		{path.Join("/setup/group"), true, rpost, permAdmin, setupGroupHandler},
+		{path.Join("/setup/finish"), true, rpost, permAdmin, setupFinishHandler},
+
+		{path.Join("/simulate"), false, rget, permRead, simulateHandler},
+		{path.Join("/simulate.json"), true, rget, permRead, simulateJSONHandler},
+
+		{path.Join("/access") + "/", false, rget, permRead, accessHandler},
+		{path.Join("/access", pg), false, rget, permRead, accessHandler},
+		{path.Join("/access", pg), true, rpost, permWrite, accessUpdateHandler},
+
+		{path.Join("/active"), false, rget, permRead, activeHandler},
+		{path.Join("/active/kill"), true, rpost, permWrite, activeKillHandler},
+
+		{path.Join("/acl") + "/", false, rget, permRead, aclHandler},
+		{path.Join("/acl/", pa), false, rget, permRead, aclHandler},
+		{path.Join("/acl/", pa), true, rdelete, permWrite, aclDeleteHandler},
+		{path.Join("/acl/", pa), true, rpost, permWrite, aclUpdateHandler},
+		{path.Join("/acl/", pa, "enabled"), true, rpost, permWrite, aclEnabledHandler},
+		{path.Join("/acl/", pa, "archive"), true, rpost, permWrite, aclArchiveHandler},
+		{path.Join("/acl/", pa, "impact.json"), true, rget, permRead, aclImpactHandler},
+		{path.Join("/acl/", pa, "schedule"), true, rpost, permWrite, aclScheduleHandler},
+		{path.Join("/acl/", pa, "owner"), true, rpost, permWrite, aclOwnerHandler},
+		{path.Join("/acl/", pa, "description"), true, rpost, permWrite, aclDescriptionHandler},
+		{path.Join("/acl/", pa, "denypage"), false, rget, permRead, denyPageHandler},
+		{path.Join("/acl/", pa, "denypage"), true, rpost, permWrite, denyPageUpdateHandler},
+		{path.Join("/acl/", pa, "denypage"), true, rdelete, permWrite, denyPageDeleteHandler},
+		{path.Join("/acl/move"), true, rpost, permWrite, aclMoveHandler},
+		{path.Join("/acl/new"), true, rpost, permWrite, aclNewHandler},
+
+		{path.Join("/cachemgr"), false, rget, permAdmin, cacheMgrHandler},
+
+		{path.Join("/config"), false, rget, permRead, configHandler},
+		{path.Join("/config/apply"), true, rpost, permAdmin, configApplyHandler},
+
+		{path.Join("/exceptions"), false, rget, permRead, exceptionsHandler},
+		{path.Join("/exceptions/", px, "approve"), true, rpost, permWrite, exceptionApproveHandler},
+		{path.Join("/exceptions/", px, "reject"), true, rpost, permWrite, exceptionRejectHandler},
+		{path.Join("/registrations"), false, rget, permRead, registrationsHandler},
+		{path.Join("/registrations/", prg, "approve"), true, rpost, permWrite, registrationApproveHandler},
+		{path.Join("/registrations/", prg, "reject"), true, rpost, permWrite, registrationRejectHandler},
+		{path.Join("/registrations/codes/new"), true, rpost, permWrite, registrationCodeNewHandler},
+		{path.Join("/registrations/codes/", prc), true, rdelete, permWrite, registrationCodeDeleteHandler},
+
+		{path.Join("/group/", pg), true, rdelete, permWrite, groupDeleteHandler},
+		{path.Join("/group/new"), true, rpost, permWrite, groupNewHandler},
+		{path.Join("/group/new/template"), true, rpost, permWrite, groupNewFromTemplateHandler},
+		{path.Join("/group/templates.json"), true, rget, permRead, groupTemplatesHandler},
+		{path.Join("/group/", pg, "template.json"), true, rget, permRead, groupTemplateExportHandler},
+		{"/pin/{kind}/{id}", true, rpost, permRead, pinHandler},
+		{path.Join("/group/", pg, "owner"), true, rpost, permWrite, groupOwnerHandler},
+		{path.Join("/group/", pg, "block-bypass"), true, rpost, permWrite, groupBlockBypassHandler},
+		{path.Join("/group/", pg, "quic"), true, rpost, permWrite, groupQUICHandler},
+		{path.Join("/group/", pg, "default"), true, rpost, permWrite, groupDefaultHandler},
+
+		{path.Join("/icap"), false, rget, permRead, icapHandler},
+		{path.Join("/icap/new"), true, rpost, permAdmin, icapNewHandler},
+		{path.Join("/icap/", pi), true, rdelete, permAdmin, icapDeleteHandler},
+		{path.Join("/icap/", pi, "groups"), true, rpost, permAdmin, icapGroupsHandler},
+
+		{path.Join("/lists"), false, rget, permRead, listsHandler},
+		{path.Join("/lists/import"), true, rpost, permWrite, listImportHandler},
+		{path.Join("/lists/subscribe"), true, rpost, permWrite, listSubscribeHandler},
+		{path.Join("/lists/", pl), true, rdelete, permWrite, listDeleteHandler},
+		{path.Join("/lists/", pl, "sync"), true, rpost, permWrite, listSyncHandler},
+		{path.Join("/threats/new"), true, rpost, permWrite, threatNewHandler},
+		{path.Join("/threats/", pt), true, rdelete, permWrite, threatDeleteHandler},
+		{path.Join("/threats/", pt, "sync"), true, rpost, permWrite, threatSyncHandler},
+
+		{path.Join("/matrix"), false, rget, permRead, matrixHandler},
+		{path.Join("/matrix.json"), true, rget, permRead, matrixJSONHandler},
+		{path.Join("/matrix/", pg, pa), true, rpost, permWrite, matrixAccessHandler},
+
+		{path.Join("/members") + "/", false, rget, permRead, membersHandler},
+		{path.Join("/members/", pg), false, rget, permRead, membersHandler},
+		{path.Join("/members/", pg, "members"), true, rpost, permWrite, membersmembersHandler},
+		{path.Join("/members/", pg, "new"), true, rpost, permWrite, membersNewHandler},
+		{path.Join("/members/", pg, "import"), true, rpost, permWrite, membersImportHandler},
+		{path.Join("/members/", pg, "expiry"), true, rpost, permWrite, memberExpiryHandler},
+
+		{path.Join("/pause"), false, rget, permRead, pauseHandler},
+		{path.Join("/pause/", pg), true, rpost, permWrite, pauseGroupHandler},
+		{path.Join("/pause/", pg), true, rdelete, permWrite, unpauseGroupHandler},
+
+		{path.Join("/quota"), false, rget, permRead, quotaHandler},
+		{path.Join("/quota/new"), true, rpost, permWrite, quotaNewHandler},
+		{path.Join("/quota/", pq), true, rdelete, permWrite, quotaDeleteHandler},
+		{path.Join("/quota/", pq, "reset"), true, rpost, permWrite, quotaResetHandler},
+
+		{path.Join("/review"), false, rget, permRead, reviewHandler},
+		{path.Join("/review/convert"), true, rpost, permWrite, reviewConvertHandler},
+		{path.Join("/review/dismiss"), true, rpost, permWrite, reviewDismissHandler},
+		{path.Join("/site/{domain}/info.json"), true, rget, permRead, siteInfoHandler},
+		{path.Join("/site/{domain}/reputation.json"), true, rget, permRead, reputationHandler},
+
+		{path.Join("/rule/") + "/", false, rget, permRead, ruleHandler},
+		{path.Join("/rule/", pr), false, rget, permRead, ruleHandler},
+		{path.Join("/rule/", pr), true, rpost, permWrite, ruleEditHandler},
+		{path.Join("/rule/", pr, "enabled"), true, rpost, permWrite, ruleEnabledHandler},
+		{path.Join("/rule/", pr, "history.json"), true, rget, permRead, ruleHistoryHandler},
+		{path.Join("/rule/lint"), true, rget, permRead, ruleLintHandler},
+		{path.Join("/rule/new"), true, rpost, permWrite, ruleNewHandler},
+		{path.Join("/rule/bulk"), true, rpost, permWrite, ruleBulkHandler},
+		{path.Join("/rule/parse"), true, rpost, permRead, rulePasteHandler},
+		{path.Join("/rule/delete"), true, rpost, permWrite, ruleDeleteHandler},
+		{path.Join("/batch"), true, rpost, permWrite, batchHandler},
+		{path.Join("/freeze"), false, rget, permRead, freezeHandler},
+		{path.Join("/freeze/new"), true, rpost, permAdmin, freezeNewHandler},
+		{path.Join("/freeze/", pf), true, rdelete, permAdmin, freezeDeleteHandler},
+		{path.Join("/ignore"), false, rget, permRead, ignoreHandler},
+		{path.Join("/ignore.json"), true, rget, permRead, ignoreJSONHandler},
+		{path.Join("/ignore/new"), true, rpost, permAdmin, ignoreNewHandler},
+		{path.Join("/ignore/", pig), true, rdelete, permAdmin, ignoreDeleteHandler},
+		{path.Join("/snapshots"), false, rget, permRead, snapshotsHandler},
+		{path.Join("/snapshots.json"), true, rget, permRead, snapshotsJSONHandler},
+		{path.Join("/snapshots/new"), true, rpost, permWrite, snapshotNewHandler},
+		{path.Join("/snapshots/import"), true, rpost, permWrite, snapshotImportHandler},
+		{path.Join("/snapshot/", psn, "diff.json"), true, rget, permRead, snapshotDiffHandler},
+		{path.Join("/snapshot/", psn, "restore"), true, rpost, permAdmin, snapshotRestoreHandler},
+		{path.Join("/snapshot/", psn), true, rdelete, permAdmin, snapshotDeleteHandler},
+		{path.Join("/promotions"), false, rget, permRead, promotionsHandler},
+		{path.Join("/promotions.json"), true, rget, permRead, promotionsJSONHandler},
+		{path.Join("/promotions/pull"), true, rpost, permWrite, promotionPullHandler},
+		{path.Join("/promotions/receive"), true, rpost, permWrite, promotionReceiveHandler},
+		{path.Join("/promotions/send"), true, rpost, permWrite, promotionSendHandler},
+		{path.Join("/promotion/", ppr, "diff.json"), true, rget, permRead, promotionDiffHandler},
+		{path.Join("/promotion/", ppr, "approve"), true, rpost, permAdmin, promotionApproveHandler},
+		{path.Join("/promotion/", ppr, "reject"), true, rpost, permAdmin, promotionRejectHandler},
+		{path.Join("/jobs"), false, rget, permRead, jobsHandler},
+		{path.Join("/jobs/new"), true, rpost, permAdmin, jobNewHandler},
+		{path.Join("/jobs/", pj, "retry"), true, rpost, permAdmin, jobRetryHandler},
+		{path.Join("/tokens"), false, rget, permAdmin, tokensHandler},
+		{path.Join("/tokens/new"), true, rpost, permAdmin, tokenNewHandler},
+		{path.Join("/tokens/", pk), true, rdelete, permAdmin, tokenDeleteHandler},
+		{path.Join("/tokens/", pk, "rotate"), true, rpost, permAdmin, tokenRotateHandler},
+		{path.Join("/tokens/rotate"), true, rpost, permRead, tokenRotateSelfHandler},
+		{path.Join("/rule/comments"), true, rpost, permWrite, ruleCommentsHandler},
+
+		{path.Join("/sources/parse"), true, rpost, permRead, sourceParseHandler},
+		{path.Join("/sources/leases"), true, rget, permRead, sourceLeasesHandler},
+		{path.Join("/source/", ps), false, rget, permRead, sourceHandler},
+		{path.Join("/source/", ps), true, rdelete, permWrite, sourceDeleteHandler},
+		{path.Join("/source/", ps, "impact.json"), true, rget, permRead, sourceImpactHandler},
+		{path.Join("/source/", ps, "activity"), false, rget, permRead, activityHandler},
+
+		{path.Join("/ajax/tail-log/page"), true, rget, permRead, tailPageHandler},
+		{path.Join("/triage"), false, rget, permRead, triageHandler},
+		{path.Join("/triage/next"), true, rget, permRead, triageNextHandler},
+		{path.Join("/triage/commit"), true, rpost, permWrite, triageCommitHandler},
+	} {
+		if e.js {
+			h := e.handler.(func(*http.Request) (interface{}, error))
+			switch {
+			case e.perm < permWrite:
+			case e.r == rpost:
+				h = changeWrap("POST", e.path, h)
+			case e.r == rdelete:
+				h = changeWrap("DELETE", e.path, h)
+			}
+			if e.perm >= permWrite && (e.r == rpost || e.r == rdelete) && !freezeExempt(e.path) {
+				h = freezeWrap(h)
+			}
+			if (e.r == rpost || e.r == rdelete) && !idempotencyExempt(e.path) {
+				h = idempotencyWrap(h)
+			}
+			e.r.HandleFunc(e.path, authWrap(e.perm, e.path, errWrapJSON(h)))
+		} else {
+			e.r.HandleFunc(e.path, authWrap(e.perm, e.path, errWrap(e.handler.(func(*http.Request) (template.HTML, error)))))
+		}
+	}
+	return r
+}
+
+// securityHeaders adds headers that keep browsers from framing, sniffing or
+// leaking the admin UI.
+type securityHeaders struct{ h http.Handler }
+
+func (c securityHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Security-Policy", contentSecurityPolicy())
+	h.Set("X-Content-Type-Options", "nosniff")
+	if serverOpts.FrameOptions != "" {
+		h.Set("X-Frame-Options", serverOpts.FrameOptions)
+	}
+	if serverOpts.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", serverOpts.ReferrerPolicy)
+	}
+	c.h.ServeHTTP(w, r)
+}
+
+func contentSecurityPolicy() string {
+	if serverOpts.CSP != "" {
+		return serverOpts.CSP
+	}
+	// Websockets can't match on 'self'. :-(
+	ws := "'self' ws: wss:"
+	if serverOpts.CSPWebsocket != "" {
+		ws = "'self' " + serverOpts.CSPWebsocket
+	}
+	frame := "'none'"
+	if serverOpts.FrameOptions == "" {
+		frame = "*"
+	} else if strings.EqualFold(serverOpts.FrameOptions, "SAMEORIGIN") {
+		frame = "'self'"
+	}
+	return fmt.Sprintf("default-src 'self'; connect-src %s; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors %s", ws, frame)
+}
+
+type hstsAdder struct{ h http.Handler }
+
+func (c hstsAdder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int(serverOpts.HSTS.Seconds())))
+	c.h.ServeHTTP(w, r)
+}
@@ -0,0 +1,2438 @@
+package web
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+	"github.com/google/squidwarden/internal/squidlog"
+)
+
+func TestSuggestRules(t *testing.T) {
+	got := suggestRules([]reviewEntry{
+		{Host: "www.example.com", Type: typeDomain, Hits: 1},
+		{Host: "img.example.com", Type: typeDomain, Hits: 2},
+		{Host: "img.example.com", Type: typeHTTPSDomain, Hits: 4},
+		{Host: "d1234.cloudfront.net", Type: typeHTTPSDomain, Hits: 10},
+		{Host: "maps.googleapis.com", Type: typeHTTPSDomain, Hits: 5},
+		{Host: "lonely.example.org", Type: typeDomain, Hits: 100},
+		{Host: "1.2.3.4", Type: typeDomain, Hits: 100},
+	})
+	want := []suggestion{
+		{
+			Type:  typeDomain,
+			Value: ".example.com",
+			Hosts: []string{"img.example.com", "www.example.com"},
+			Hits:  3,
+		},
+		{
+			Type:     typeHTTPSDomain,
+			Value:    ".cloudfront.net",
+			Category: "CDN (Amazon)",
+			Hosts:    []string{"d1234.cloudfront.net"},
+			Hits:     10,
+		},
+		{
+			Type:     typeHTTPSDomain,
+			Value:    ".googleapis.com",
+			Category: "API (Google)",
+			Hosts:    []string{"maps.googleapis.com"},
+			Hits:     5,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseCacheMgrInfo(t *testing.T) {
+	in := `Squid Object Cache: Version 3.5.23
+Connection information for squid:
+	Number of clients accessing cache:	3
+	Average HTTP requests per minute since start:	12.5
+Resource usage for squid:
+	UP Time:	3600.123 seconds
+	CPU Usage:	0.50 seconds
+`
+	want := []cacheMgrValue{
+		{"UP Time", "3600.123 seconds"},
+		{"Number of clients accessing cache", "3"},
+		{"Average HTTP requests per minute since start", "12.5"},
+		{"CPU Usage", "0.50 seconds"},
+	}
+	if got := parseCacheMgrInfo(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseActiveRequests(t *testing.T) {
+	in := `Connection: 0x55d0f1e0
+	FD 12, read 517, wrote 0
+	FD desc: Reading next request
+	remote: 10.0.0.5:51234
+	local: 10.0.0.1:3128
+uri blog.habets.se:443
+logType TCP_TUNNEL
+start 1476000000.123 (2.500 seconds ago)
+Connection: 0x55d0f2f0
+	remote: [2001:db8::1]:40000
+uri http://www.example.com/foo
+start 1476000001.123 (1.500 seconds ago)
+`
+	want := []activeRequest{
+		{Client: "10.0.0.5", URI: "blog.habets.se:443", Age: "2.500 seconds", Type: typeHTTPSDomain, Host: "blog.habets.se"},
+		{Client: "2001:db8::1", URI: "http://www.example.com/foo", Age: "1.500 seconds", Type: typeDomain, Host: "www.example.com"},
+	}
+	if got := parseActiveRequests(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSourceContains(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		ip   string
+		want bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+		{"129.99.0.1/255.255.0.255", "129.99.99.1", true},
+		{"129.99.0.1/255.255.0.255", "129.99.99.2", false},
+		{"::1234:5678/::ffff:ffff", "2001:db8::1234:5678", true},
+		{"garbage", "10.1.2.3", false},
+	} {
+		if got := sourceContains(test.src, net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("sourceContains(%q, %q) = %t, want %t", test.src, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{"", 0, false},
+		{"1h", time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"xd", 0, true},
+		{"soon", 0, true},
+	} {
+		got, err := parseExpiry(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("parseExpiry(%q) error %v, want error %t", test.in, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseExpiry(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestAccountantUsesEntryTime(t *testing.T) {
+	a := &accountant{
+		defs: []quotaDef{
+			{id: "q", kind: quotaMinutes, sources: []string{"10.0.0.0/8"}, rules: []rule{{Type: typeDomain, Value: ".example.com"}}},
+		},
+		loaded:  time.Now(),
+		pending: make(map[usageKey]int64),
+	}
+	then := time.Now().AddDate(0, 0, -2)
+	a.add(&squidlog.Entry{Time: then.UTC().Format(squidlog.TimeFormat), Elapsed: 90 * time.Second, Client: "10.1.2.3", Host: "www.example.com"})
+	k := usageKey{quota: "q", client: "10.1.2.3", day: then.Format(quotaDay)}
+	if got := a.pending[k]; got < 2 || got > 3 {
+		t.Errorf("usage on %s: got %d minutes, want 2 or 3 (pending: %v)", k.day, got, a.pending)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	for _, test := range []struct {
+		format, in string
+		want       []listEntry
+	}{
+		{
+			listHosts,
+			`# pi-hole style
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+::1 ip6-localhost
+Plain.Example.NET
+0.0.0.0 ads.example.com
+`,
+			[]listEntry{
+				{"ads.example.com", actionBlock},
+				{"tracker.example.com", actionBlock},
+				{"plain.example.net", actionBlock},
+			},
+		},
+		{
+			listAdblock,
+			`[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+@@||good.example.com^
+||third.example.com^$third-party
+example.com##.banner
+/banner/*
+`,
+			[]listEntry{
+				{".ads.example.com", actionBlock},
+				{".good.example.com", actionAllow},
+			},
+		},
+	} {
+		got, err := parseList(strings.NewReader(test.in), test.format, actionBlock)
+		if err != nil {
+			t.Errorf("%s: %v", test.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.format, got, test.want)
+		}
+	}
+}
+
+func TestFormatList(t *testing.T) {
+	rules := []rule{
+		{Type: typeDomain, Value: ".ads.example.com", Action: actionBlock, Enabled: true},
+		{Type: typeHTTPSDomain, Value: ".ads.example.com", Action: actionBlock, Enabled: true},
+		{Type: typeHTTPSDomain, Value: "good.example.com", Action: actionAllow, Enabled: true},
+		{Type: typeDomain, Value: "off.example.com", Action: actionBlock},
+		{Type: typeDomain, Value: "port.example.com:8080", Action: actionBlock, Enabled: true},
+		{Type: typeRegex, Value: "http://.*", Action: actionBlock, Enabled: true},
+	}
+	for _, test := range []struct {
+		format, want string
+	}{
+		{listHosts, "0.0.0.0 ads.example.com\n"},
+		{listAdblock, "@@||good.example.com^\n||ads.example.com^\n"},
+	} {
+		var buf bytes.Buffer
+		if err := formatList(&buf, rules, test.format); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.format, got, test.want)
+		}
+	}
+}
+
+func TestSyncListRules(t *testing.T) {
+	var err error
+	db, err = sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skipf("No sqlite: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	schema, err := ioutil.ReadFile("../../sqlite.schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		string(schema),
+		`INSERT INTO acls(acl_id, comment) VALUES('lists', 'Lists')`,
+		`INSERT INTO rules(rule_id, type, value, action) VALUES('hand', 'domain', 'hand.example.com', 'block')`,
+		`INSERT INTO aclrules(acl_id, rule_id) VALUES('lists', 'hand')`,
+		`INSERT INTO listsubscriptions(list_id, acl_id, url, format, action) VALUES('a', 'lists', 'http://a/', 'hosts', 'block')`,
+		`INSERT INTO listsubscriptions(list_id, acl_id, url, format, action) VALUES('b', 'lists', 'http://b/', 'hosts', 'block')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func(id listID, hosts ...string) {
+		var entries []listEntry
+		for _, h := range hosts {
+			entries = append(entries, listEntry{Value: h, Action: actionBlock})
+		}
+		if err := txWrap(func(tx *sql.Tx) error {
+			_, _, err := syncListRules(tx, id, "lists", entries)
+			return err
+		}); err != nil {
+			t.Fatalf("sync %s: %v", id, err)
+		}
+	}
+	check := func(when string, want ...string) {
+		rows, err := db.Query(`
+SELECT rules.value FROM aclrules JOIN rules ON aclrules.rule_id=rules.rule_id
+WHERE aclrules.acl_id='lists' AND rules.type='domain'
+ORDER BY rules.value`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var v string
+			if err := rows.Scan(&v); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, v)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", when, got, want)
+		}
+	}
+	sync("a", "ads.example.com", "hand.example.com", "both.example.com")
+	sync("b", "both.example.com", "b.example.com")
+	check("after first sync", "ads.example.com", "b.example.com", "both.example.com", "hand.example.com")
+
+	// Dropping entries from a takes out only what a alone put there.
+	sync("a", "new.example.com")
+	check("after a changed", "b.example.com", "both.example.com", "hand.example.com", "new.example.com")
+
+	sync("b")
+	check("after b emptied", "hand.example.com", "new.example.com")
+}
+
+func TestNextSyncTime(t *testing.T) {
+	now := time.Date(2016, 5, 10, 12, 30, 0, 0, time.UTC)
+	for _, test := range []struct {
+		clock string
+		want  time.Time
+	}{
+		{"13:00", time.Date(2016, 5, 10, 13, 0, 0, 0, time.UTC)},
+		{"12:30", time.Date(2016, 5, 11, 12, 30, 0, 0, time.UTC)},
+		{"03:00", time.Date(2016, 5, 11, 3, 0, 0, 0, time.UTC)},
+	} {
+		got, err := nextSyncTime(now, test.clock)
+		if err != nil {
+			t.Fatalf("%q: %v", test.clock, err)
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%q: got %v, want %v", test.clock, got, test.want)
+		}
+	}
+	if _, err := nextSyncTime(now, "3am"); err == nil {
+		t.Errorf("want error for invalid time")
+	}
+}
+
+func TestParseTheme(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    siteTheme
+		wantErr bool
+	}{
+		{in: `{}`, want: defaultTheme},
+		{
+			in: `{"title": "Example Corp proxy", "logo": "logo.png", "nav_color": "#204080"}`,
+			want: siteTheme{
+				Title:     "Example Corp proxy",
+				Logo:      "logo.png",
+				NavColor:  "#204080",
+				NavText:   defaultTheme.NavText,
+				Highlight: defaultTheme.Highlight,
+			},
+		},
+		{in: `{"nav_color": "red; background: url(x)"}`, wantErr: true},
+		{in: `{"highlight": "#12345"}`, wantErr: true},
+		{in: `not json`, wantErr: true},
+	} {
+		got, err := parseTheme([]byte(test.in))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: want error, got %+v", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestUserPermission(t *testing.T) {
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.Readers = "*"
+	serverOpts.Writers = "alice, bob"
+	serverOpts.Admins = "root"
+	for _, test := range []struct {
+		user string
+		want permission
+	}{
+		{"", permPublic},
+		{"eve", permRead},
+		{"alice", permWrite},
+		{"bob", permWrite},
+		{"root", permAdmin},
+	} {
+		if got := userPermission(test.user); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.user, got, test.want)
+		}
+	}
+	serverOpts.Readers = ""
+	if got := userPermission("eve"); got != permPublic {
+		t.Errorf("unlisted user: got %s, want %s", got, permPublic)
+	}
+}
+
+func TestUserPermissionTable(t *testing.T) {
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	defer func(m map[string]permission) { dbUsers.m = m }(dbUsers.m)
+	serverOpts.Readers, serverOpts.Writers, serverOpts.Admins = "", "alice", ""
+	dbUsers.m = map[string]permission{}
+	if !authEnabled() {
+		t.Errorf("-writers set: auth not enabled")
+	}
+	serverOpts.Writers = ""
+	if authEnabled() {
+		t.Errorf("no users: auth enabled")
+	}
+	dbUsers.m = map[string]permission{"root": permAdmin, "alice": permRead}
+	if !authEnabled() {
+		t.Errorf("users in table: auth not enabled")
+	}
+	serverOpts.Writers = "alice"
+	for _, test := range []struct {
+		user string
+		want permission
+	}{
+		{"eve", permPublic},
+		{"root", permAdmin},
+		{"alice", permWrite}, // Highest of flag and table.
+	} {
+		if got := userPermission(test.user); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.user, got, test.want)
+		}
+	}
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	for _, test := range []struct {
+		csp, frame, ws string
+		want           string
+	}{
+		{"", "DENY", "", "default-src 'self'; connect-src 'self' ws: wss:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"},
+		{"", "SAMEORIGIN", "wss://example.com", "default-src 'self'; connect-src 'self' wss://example.com; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'self'"},
+		{"", "", "", "default-src 'self'; connect-src 'self' ws: wss:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors *"},
+		{"default-src *", "DENY", "", "default-src *"},
+	} {
+		serverOpts.CSP, serverOpts.FrameOptions, serverOpts.CSPWebsocket = test.csp, test.frame, test.ws
+		if got := contentSecurityPolicy(); got != test.want {
+			t.Errorf("csp=%q frame=%q ws=%q: got %q, want %q", test.csp, test.frame, test.ws, got, test.want)
+		}
+	}
+}
+
+func TestFindSourceOverlaps(t *testing.T) {
+	kids := group{GroupID: "g1", Comment: "kids"}
+	adults := group{GroupID: "g2", Comment: "adults"}
+	srcs := []analysisSource{
+		{Source: "10.0.0.0/8", Group: adults},
+		{Source: "10.1.2.3/32", Group: kids},
+		{Source: "10.1.2.4/255.255.255.255", Group: kids},
+		{Source: "10.1.2.4/255.255.255.255", Group: adults},
+		{Source: "192.168.0.0/16", Group: kids},
+		{Source: "2001:db8::/32", Group: adults},
+	}
+	var got []string
+	for _, f := range findSourceOverlaps(srcs) {
+		got = append(got, f.Message)
+	}
+	want := []string{
+		`Source 10.1.2.3/32 of group "kids" is inside source 10.0.0.0/8 of group "adults". Clients there get the rules of both groups.`,
+		`Source 10.1.2.4/255.255.255.255 of group "kids" is inside source 10.0.0.0/8 of group "adults". Clients there get the rules of both groups.`,
+		`Source 10.1.2.4/255.255.255.255 of group "kids" is inside source 10.1.2.4/255.255.255.255 of group "adults". Clients there get the rules of both groups.`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRuleShadows(t *testing.T) {
+	for _, test := range []struct {
+		outer, inner analysisRule
+		want         bool
+	}{
+		{analysisRule{Type: typeDomain, Value: ".example.com"}, analysisRule{Type: typeDomain, Value: "www.example.com"}, true},
+		{analysisRule{Type: typeDomain, Value: ".example.com"}, analysisRule{Type: typeDomain, Value: "example.com"}, true},
+		{analysisRule{Type: typeDomain, Value: ".example.com"}, analysisRule{Type: typeDomain, Value: ".a.example.com"}, true},
+		{analysisRule{Type: typeDomain, Value: "example.com"}, analysisRule{Type: typeDomain, Value: "www.example.com"}, false},
+		{analysisRule{Type: typeDomain, Value: ".example.com"}, analysisRule{Type: typeDomain, Value: "badexample.com"}, false},
+		{analysisRule{Type: typeDomain, Value: ".example.com"}, analysisRule{Type: typeHTTPSDomain, Value: "www.example.com"}, false},
+		{analysisRule{Type: typeDomain, Value: ".example.com"}, analysisRule{Type: typeDomain, Value: "www.example.com:8080"}, false},
+		{analysisRule{Type: typeDomain, Value: ".example.com:*"}, analysisRule{Type: typeDomain, Value: "www.example.com:8080"}, true},
+		{analysisRule{Type: typeDomain, Value: ".example.com"}, analysisRule{Type: typeExact, Value: "http://www.example.com/foo"}, true},
+		{analysisRule{Type: typeHTTPSDomain, Value: ".example.com"}, analysisRule{Type: typeHTTPSDomain, Value: "www.example.com:443"}, true},
+		{analysisRule{Type: typeExact, Value: "http://example.com/"}, analysisRule{Type: typeDomain, Value: "example.com"}, false},
+		{analysisRule{Type: typeRegex, Value: ".*"}, analysisRule{Type: typeDomain, Value: "example.com"}, false},
+	} {
+		if got := ruleShadows(test.outer, test.inner); got != test.want {
+			t.Errorf("%+v covers %+v: got %t, want %t", test.outer, test.inner, got, test.want)
+		}
+	}
+}
+
+func TestFindShadowedRules(t *testing.T) {
+	rules := []analysisRule{
+		{RuleID: "r1", Type: typeDomain, Value: ".example.com", Action: actionBlock},
+		{RuleID: "r2", Type: typeDomain, Value: "www.example.com", Action: actionAllow},
+		{RuleID: "r3", Type: typeDomain, Value: "ads.example.com", Action: actionBlock},
+		{RuleID: "r4", Type: typeDomain, Value: "example.org", Action: actionAllow},
+	}
+	got := make(map[string]string)
+	for _, f := range findShadowedRules(group{Comment: "kids"}, rules) {
+		got[f.Links[0].Link] = f.Kind
+	}
+	want := map[string]string{
+		"/rule/r2": findingConflict,
+		"/rule/r3": findingRedundant,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFindValueConflicts(t *testing.T) {
+	games := acl{ACLID: "a1", Comment: "games"}
+	homework := acl{ACLID: "a2", Comment: "homework"}
+	rules := []analysisRule{
+		{RuleID: "r1", Type: typeHTTPSDomain, Value: ".games.com", Action: actionAllow, ACL: homework},
+		{RuleID: "r2", Type: typeHTTPSDomain, Value: ".games.com", Action: actionBlock, ACL: games},
+		{RuleID: "r3", Type: typeDomain, Value: ".games.com", Action: actionAllow, ACL: homework},
+		{RuleID: "r4", Type: typeDomain, Value: ".games.com", Action: actionAllow, ACL: games},
+	}
+	got := findValueConflicts(group{Comment: "kids"}, rules)
+	if len(got) != 1 {
+		t.Fatalf("got %d conflicts, want 1: %+v", len(got), got)
+	}
+	if got[0].Winner.RuleID != "r2" {
+		t.Errorf("got winner %q, want r2", got[0].Winner.RuleID)
+	}
+	if got, want := got[0].Message(), `Group "kids": https-domain ".games.com" is block in ACL "games", which wins over allow in ACL "homework".`; got != want {
+		t.Errorf("got message %q, want %q", got, want)
+	}
+	// Reported as a value conflict only.
+	if f := findShadowedRules(group{Comment: "kids"}, rules); len(f) != 0 {
+		t.Errorf("got shadowed findings %+v, want none", f)
+	}
+}
+
+func TestRecordStream(t *testing.T) {
+	three := func(r *http.Request, s *recordStream) error {
+		for n := 0; n < 3; n++ {
+			if err := s.Write(map[string]int{"n": n}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	none := func(r *http.Request, s *recordStream) error { return nil }
+	fail := func(r *http.Request, s *recordStream) error {
+		return errHTTP{external: "bad", code: http.StatusBadRequest}
+	}
+	failLate := func(r *http.Request, s *recordStream) error {
+		three(r, s)
+		return fmt.Errorf("oops")
+	}
+	for _, test := range []struct {
+		f          func(*http.Request, *recordStream) error
+		url        string
+		code       int
+		ctype, out string
+	}{
+		{three, "/", 200, "application/json", "[{\"n\":0}\n,{\"n\":1}\n,{\"n\":2}\n]\n"},
+		{three, "/?format=ndjson", 200, "application/x-ndjson", "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n"},
+		{none, "/", 200, "application/json", "[]\n"},
+		{none, "/?format=ndjson", 200, "application/x-ndjson", ""},
+		{fail, "/", 400, "application/json", `{"error":{"code":"invalid","message":"bad","request_id":"req1"}}`},
+		{failLate, "/", 200, "application/json", "[{\"n\":0}\n,{\"n\":1}\n,{\"n\":2}\n"},
+		{three, "/?format=csv", 200, "text/csv; charset=utf-8", "n\n0\n1\n2\n"},
+		{three, "/?format=hosts", 400, "application/json", `{"error":{"code":"invalid","message":"format must be json, ndjson or csv","request_id":"req1"}}`},
+		{failLate, "/?format=csv", 200, "text/csv; charset=utf-8", "n\n0\n1\n2\n"},
+		{failLate, "/?format=ndjson", 200, "application/x-ndjson", "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n{\"error\":\"internal error, output truncated\"}\n"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.url, nil)
+		r.Header.Set("X-Request-Id", "req1")
+		streamWrap(test.f)(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: got code %d, want %d", test.url, w.Code, test.code)
+		}
+		if got := w.Header().Get("Content-Type"); got != test.ctype {
+			t.Errorf("%s: got Content-Type %q, want %q", test.url, got, test.ctype)
+		}
+		if got := w.Body.String(); got != test.out {
+			t.Errorf("%s: got %q, want %q", test.url, got, test.out)
+		}
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		f      func(*http.Request) (interface{}, error)
+		header map[string]string
+		code   int
+		out    string
+	}{
+		{
+			name: "ok",
+			f:    func(*http.Request) (interface{}, error) { return "fine", nil },
+			code: http.StatusOK,
+			out:  `"fine"`,
+		},
+		{
+			name: "not XHR",
+			f:    func(*http.Request) (interface{}, error) { return "fine", nil },
+			header: map[string]string{
+				"X-Requested-With": "",
+			},
+			code: http.StatusBadRequest,
+			out:  `{"error":{"code":"invalid","message":"bad X-Requested-With header","request_id":"req1"}}`,
+		},
+		{
+			name: "conflict",
+			f: func(*http.Request) (interface{}, error) {
+				return nil, errHTTP{
+					external: "duplicate",
+					code:     http.StatusConflict,
+					details:  map[string]string{"existing": "r1"},
+					links:    []errHTTPLink{{Text: "existing rule", Link: "/rule/r1"}},
+				}
+			},
+			code: http.StatusConflict,
+			out:  `{"error":{"code":"conflict","message":"duplicate","details":{"existing":"r1"},"links":[{"text":"existing rule","link":"/rule/r1"}],"request_id":"req1"}}`,
+		},
+		{
+			name: "reason",
+			f: func(*http.Request) (interface{}, error) {
+				return nil, errHTTP{external: "no", code: http.StatusForbidden, reason: "csrf"}
+			},
+			code: http.StatusForbidden,
+			out:  `{"error":{"code":"csrf","message":"no","request_id":"req1"}}`,
+		},
+		{
+			name: "internal",
+			f:    func(*http.Request) (interface{}, error) { return nil, fmt.Errorf("secret") },
+			code: http.StatusInternalServerError,
+			out:  `{"error":{"code":"internal","message":"Internal error","request_id":"req1"}}`,
+		},
+		{
+			name: "panic",
+			f:    func(*http.Request) (interface{}, error) { panic("secret") },
+			code: http.StatusInternalServerError,
+			out:  `{"error":{"code":"internal","message":"Internal error","request_id":"req1"}}`,
+		},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("X-Request-Id", "req1")
+		r.Header.Set("X-Requested-With", "XMLHttpRequest")
+		for k, v := range test.header {
+			r.Header.Set(k, v)
+		}
+		errWrapJSON(test.f)(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: got code %d, want %d", test.name, w.Code, test.code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: got Content-Type %q", test.name, got)
+		}
+		if got := w.Body.String(); got != test.out {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.out)
+		}
+	}
+}
+
+func TestCSVFields(t *testing.T) {
+	type rec struct {
+		Name    string
+		Count   int    `json:"count"`
+		Skipped string `json:"-"`
+		private string
+		Note    *string
+	}
+	for _, test := range []struct {
+		in   interface{}
+		cols []string
+		vals map[string]string
+	}{
+		{
+			&rec{Name: "a,b", Count: 2, Skipped: "x", private: "y"},
+			[]string{"Name", "count", "Note"},
+			map[string]string{"Name": "a,b", "count": "2", "Note": ""},
+		},
+		{
+			map[string]interface{}{"b": 1, "a": nil, "c": true},
+			[]string{"a", "b", "c"},
+			map[string]string{"a": "", "b": "1", "c": "true"},
+		},
+	} {
+		cols, vals, err := csvFields(test.in)
+		if err != nil {
+			t.Fatalf("%+v: %v", test.in, err)
+		}
+		if !reflect.DeepEqual(cols, test.cols) || !reflect.DeepEqual(vals, test.vals) {
+			t.Errorf("%+v: got %q %q, want %q %q", test.in, cols, vals, test.cols, test.vals)
+		}
+	}
+	if _, _, err := csvFields(3); err == nil {
+		t.Errorf("csvFields(3) succeeded, want error")
+	}
+}
+
+func TestBulkValues(t *testing.T) {
+	for _, test := range []struct {
+		list []string
+		text string
+		want []string
+	}{
+		{nil, "", nil},
+		{nil, "a.com\n\n b.com \r\na.com\n", []string{"a.com", "b.com"}},
+		{[]string{"a.com", "", "c.com"}, "b.com", []string{"a.com", "c.com"}},
+	} {
+		if got := bulkValues(test.list, test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("bulkValues(%q, %q) = %q, want %q", test.list, test.text, got, test.want)
+		}
+	}
+}
+
+func TestParsePasted(t *testing.T) {
+	type cand struct{ typ, value, action string }
+	for _, test := range []struct {
+		in      string
+		want    []cand
+		skipped int
+	}{
+		{"", nil, 0},
+		{"# comment\n\n! adblock comment", nil, 0},
+		{"0.0.0.0 ads.example.com tracker.example.com # comment", []cand{
+			{typeDomain, "ads.example.com", actionBlock},
+			{typeHTTPSDomain, "ads.example.com", actionBlock},
+			{typeDomain, "tracker.example.com", actionBlock},
+			{typeHTTPSDomain, "tracker.example.com", actionBlock},
+		}, 0},
+		{"127.0.0.1 localhost", nil, 1},
+		{"||Ads.example.com^\n@@||ok.example.com^\n||x.com^$third-party", []cand{
+			{typeDomain, ".ads.example.com", actionBlock},
+			{typeHTTPSDomain, ".ads.example.com", actionBlock},
+			{typeDomain, ".ok.example.com", actionAllow},
+			{typeHTTPSDomain, ".ok.example.com", actionAllow},
+		}, 1},
+		{"https://WWW.example.com/path?q=1\nhttp://example.org:80/\nhttp://example.net:8080/\nftp://example.com/", []cand{
+			{typeHTTPSDomain, "www.example.com", ""},
+			{typeDomain, "example.org", ""},
+			{typeDomain, "example.net:8080", ""},
+		}, 1},
+		{"acl kids dstdomain -i .Example.com foo.org\nacl x ssl::server_name .bar.com\nacl y url_regex ads ^http://a\\.com/$\nacl z dstdomain \"/etc/squid/list\"\nacl w src 10.0.0.0/8", []cand{
+			{typeDomain, ".example.com", ""},
+			{typeHTTPSDomain, ".example.com", ""},
+			{typeDomain, "foo.org", ""},
+			{typeHTTPSDomain, "foo.org", ""},
+			{typeHTTPSDomain, ".bar.com", ""},
+			{typeRegex, ".*ads.*", ""},
+			{typeRegex, `http://a\.com/`, ""},
+		}, 2},
+		{"*.example.com\nexample.com\nexample.com\nnot a host\nlocalhost", []cand{
+			{typeDomain, ".example.com", ""},
+			{typeHTTPSDomain, ".example.com", ""},
+			{typeDomain, "example.com", ""},
+			{typeHTTPSDomain, "example.com", ""},
+		}, 2},
+	} {
+		c, skipped := parsePasted(test.in)
+		var got []cand
+		for _, e := range c {
+			got = append(got, cand{e.Type, e.Value, e.Action})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.in, got, test.want)
+		}
+		if len(skipped) != test.skipped {
+			t.Errorf("%q: got skipped %+v, want %d", test.in, skipped, test.skipped)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	for _, test := range []struct {
+		form url.Values
+		want string
+		err  bool
+	}{
+		{url.Values{}, "", false},
+		{url.Values{"owner": {" Network team "}}, "Network team", false},
+		{url.Values{"contact": {"net@example.com"}}, "net@example.com", false},
+		{url.Values{"owner": {"Network team"}, "contact": {"net@example.com"}}, "Network team <net@example.com>", false},
+		{url.Values{"contact": {"not an address"}}, "", true},
+		{url.Values{"contact": {"Net <net@example.com>"}}, "", true},
+		{url.Values{"owner": {strings.Repeat("x", maxOwnerLength+1)}}, "", true},
+	} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		o, err := parseOwner(r)
+		if (err != nil) != test.err {
+			t.Errorf("%v: got err %v, want err %t", test.form, err, test.err)
+			continue
+		}
+		if got := o.String(); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.form, got, test.want)
+		}
+	}
+}
+
+func TestListReport(t *testing.T) {
+	got := listReport([]*listDelta{
+		{
+			URL:   "https://example.com/hosts",
+			ACL:   "ads",
+			Owner: owner{Owner: "Network team", Contact: "net@example.com"},
+			Added: []listEntry{{Value: "ads.example.com", Action: actionBlock}},
+		},
+		{URL: "https://example.com/unchanged"},
+	}, nil)
+	want := `https://example.com/hosts: 1 added, 0 removed
+  ACL: ads
+  Owner: Network team <net@example.com>
+  + block ads.example.com
+
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Implements the *PCI* egress policy,\nsee **ticket 12**.", "<p>Implements the <em>PCI</em> egress policy, see <strong>ticket 12</strong>.</p>\n"},
+		{"# Intent\n\n- one\n- `two`\n1. first\n\nafter", "<h3>Intent</h3>\n<ul>\n<li>one</li>\n<li><code>two</code></li>\n</ul>\n<ol>\n<li>first</li>\n</ol>\n<p>after</p>\n"},
+		{"### deep ###\n###### deeper\n####### not a heading", "<h5>deep</h5>\n<h6>deeper</h6>\n<p>####### not a heading</p>\n"},
+		{"```\n<b>x</b>\n  y\n```", "<pre><code>&lt;b&gt;x&lt;/b&gt;\n  y</code></pre>\n"},
+		{"see [ticket](https://bugs.example.com/1?a=1&b=2) and [acl](/acl/)", `<p>see <a href="https://bugs.example.com/1?a=1&amp;b=2">ticket</a> and <a href="/acl/">acl</a></p>` + "\n"},
+		{"snake_case_name and 2*3*4", "<p>snake_case_name and 2*3*4</p>\n"},
+		{"unclosed *em and `code", "<p>unclosed *em and `code</p>\n"},
+
+		// Nothing gets through unescaped.
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>\n"},
+		{"[x](//evil.example.com/)", "<p>[x](//evil.example.com/)</p>\n"},
+		{`[x](http://a/"onmouseover="alert(1))`, `<p><a href="http://a/&#34;onmouseover=&#34;alert(1">x</a>)</p>` + "\n"},
+	} {
+		if got := string(renderMarkdown(test.in)); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestPinACLs(t *testing.T) {
+	acls := []acl{{ACLID: "a", Comment: "a"}, {ACLID: "b", Comment: "b"}, {ACLID: "c", Comment: "c"}, {ACLID: "d", Comment: "d"}}
+	got := pinACLs(acls, map[string]bool{"c": true, "b": true})
+	want := []acl{{ACLID: "b", Comment: "b", Pinned: true}, {ACLID: "c", Comment: "c", Pinned: true}, {ACLID: "a", Comment: "a"}, {ACLID: "d", Comment: "d"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	groups := []group{{GroupID: "x"}, {GroupID: "y"}}
+	if got := pinGroups(groups, map[string]bool{"y": true}); got[0].GroupID != "y" || !got[0].Pinned || got[1].Pinned {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestChangeSummary(t *testing.T) {
+	for _, test := range []struct {
+		method, route   string
+		entity, summary string
+	}{
+		{"POST", "/acl/new", "acl", "acl new"},
+		{"POST", "/acl/{aclID:[0-9a-f-]+}", "acl", "acl update"},
+		{"DELETE", "/acl/{aclID:[0-9a-f-]+}", "acl", "delete acl"},
+		{"POST", "/acl/{aclID:[0-9a-f-]+}/owner", "acl", "acl owner"},
+		{"POST", "/matrix/{groupID:[0-9a-f-]+}/{aclID:[0-9a-f-]+}", "matrix", "matrix update"},
+	} {
+		entity, summary := changeSummary(test.method, test.route)
+		if entity != test.entity || summary != test.summary {
+			t.Errorf("%s %s: got %q %q, want %q %q", test.method, test.route, entity, summary, test.entity, test.summary)
+		}
+	}
+	if got := changeLink("acl", "x", "delete acl"); got != "" {
+		t.Errorf("link to deleted acl: %q", got)
+	}
+	if got, want := changeLink("group", "x", "group owner"), "/members/x"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFormatMetrics(t *testing.T) {
+	ms := []metric{{"requests", 10}, {"denied", 2}}
+	now := time.Unix(1500000000, 0)
+	if got, want := formatInflux(ms, now), "squidwarden requests=10i,denied=2i 1500000000000000000\n"; got != want {
+		t.Errorf("influx: got %q, want %q", got, want)
+	}
+	if got, want := formatGraphite("sw", ms, now), "sw.requests 10 1500000000\nsw.denied 2 1500000000\n"; got != want {
+		t.Errorf("graphite: got %q, want %q", got, want)
+	}
+}
+
+func TestAnonymizeClient(t *testing.T) {
+	for _, test := range []struct {
+		mode, client, want string
+	}{
+		{privacyTruncate, "192.168.1.42", "192.168.1.0"},
+		{privacyTruncate, "2001:db8:1:2::5", "2001:db8:1::"},
+		{privacyTruncate, "192.168.1.0", "192.168.1.0"},
+		{privacyHash, "192.168.1.42", "h:"},
+		{privacyTruncate, "laptop", "h:"},
+	} {
+		got := anonymizeClient(test.mode, "salt", test.client)
+		if test.want == "h:" {
+			if !strings.HasPrefix(got, "h:") || len(got) != 18 {
+				t.Errorf("%s %q: got %q, want hash", test.mode, test.client, got)
+			} else if again := anonymizeClient(test.mode, "salt", got); again != got {
+				t.Errorf("%s %q: hashed again to %q", test.mode, got, again)
+			}
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s %q: got %q, want %q", test.mode, test.client, got, test.want)
+		}
+	}
+	if a, b := anonymizeClient(privacyHash, "a", "1.2.3.4"), anonymizeClient(privacyHash, "b", "1.2.3.4"); a == b {
+		t.Errorf("salt ignored: %q", a)
+	}
+	for in, want := range map[string]string{
+		"https://example.com/secret/path?q=1": "https://example.com/",
+		"http://example.com:8080/x":           "http://example.com:8080/",
+		"not a url":                           "",
+	} {
+		if got := stripURLPath(in); got != want {
+			t.Errorf("stripURLPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseActivityParams(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		query    string
+		from, to string
+		limit    int
+		err      bool
+	}{
+		{"", "2020-06-09", "2020-06-15", defaultActivityDomains, false},
+		{"from=2020-01-01&to=2020-01-31&limit=10", "2020-01-01", "2020-01-31", 10, false},
+		{"from=-30d", "2020-05-16", "2020-06-15", defaultActivityDomains, false},
+		{"from=2020-02-01&to=2020-01-31", "", "", 0, true},
+		{"from=yesterday", "", "", 0, true},
+		{"limit=0", "", "", 0, true},
+	} {
+		r := httptest.NewRequest("GET", "/?"+test.query, nil)
+		from, to, limit, err := parseActivityParams(r, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: want error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if got := from.Format(quotaDay); got != test.from {
+			t.Errorf("%q: from %q, want %q", test.query, got, test.from)
+		}
+		if got := to.Format(quotaDay); got != test.to {
+			t.Errorf("%q: to %q, want %q", test.query, got, test.to)
+		}
+		if limit != test.limit {
+			t.Errorf("%q: limit %d, want %d", test.query, limit, test.limit)
+		}
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	var sent []string
+	a := newAlerter(func(subject, text string) { sent = append(sent, subject) })
+	p := policy.New()
+	if err := p.AddRule("r1", "domain", ".malware.example", "block"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddGrant("10.0.0.0/8", policy.Grant{Group: "g", ACL: "bad", Rule: "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	a.setRules([]alertRule{
+		{AlertID: "denials", Kind: alertClientDenials, Threshold: 2, Window: time.Minute},
+		{AlertID: "malware", Kind: alertACLHits, ACL: acl{ACLID: "bad", Comment: "malware"}, Window: time.Hour},
+	}, p)
+
+	denied := &squidlog.Entry{Client: "10.0.0.1", Status: "TCP_DENIED/403", Method: "GET", URL: "http://example.com/"}
+	now := time.Unix(1500000000, 0)
+	for n := 0; n < 3; n++ {
+		a.check(denied, now.Add(time.Duration(n)*time.Second))
+	}
+	// Already fired this window.
+	a.check(denied, now.Add(10*time.Second))
+	// Other client is counted separately.
+	a.check(&squidlog.Entry{Client: "10.0.0.2", Status: "TCP_DENIED/403", Method: "GET", URL: "http://example.com/"}, now)
+	// Window passed.
+	for n := 0; n < 3; n++ {
+		a.check(denied, now.Add(2*time.Minute+time.Duration(n)*time.Second))
+	}
+	a.check(&squidlog.Entry{Client: "10.0.0.3", Status: "TCP_MISS/200", Method: "GET", URL: "http://www.malware.example/x"}, now)
+	a.check(&squidlog.Entry{Client: "10.0.0.3", Status: "TCP_MISS/200", Method: "GET", URL: "http://www.malware.example/y"}, now)
+
+	want := []string{
+		"squidwarden alert: 3 denials from 10.0.0.1",
+		"squidwarden alert: 3 denials from 10.0.0.1",
+		"squidwarden alert: 1 hits on ACL malware",
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("got %q, want %q", sent, want)
+	}
+
+	a.expire(now.Add(2 * time.Hour))
+	if len(a.hits) != 0 || len(a.fired) != 0 {
+		t.Errorf("not expired: %v %v", a.hits, a.fired)
+	}
+}
+
+func TestParseThreatFeed(t *testing.T) {
+	urls := `# URLhaus
+http://bad.example.com/payload.exe
+https://Phish.Example.org/login
+https://phish.example.org/other
+https://evil.example.net:8443/x
+ftp://ignored.example.com/
+
+not a url
+`
+	got, err := parseThreatFeed(strings.NewReader(urls), threatURLs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []threatIndicator{
+		{Type: typeExact, Value: "http://bad.example.com/payload.exe"},
+		{Type: typeHTTPSDomain, Value: "phish.example.org"},
+		{Type: typeHTTPSDomain, Value: "evil.example.net:8443"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("urls: got %+v, want %+v", got, want)
+	}
+
+	got, err = parseThreatFeed(strings.NewReader("0.0.0.0 malware.example.com\n"), threatHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []threatIndicator{
+		{Type: typeDomain, Value: "malware.example.com"},
+		{Type: typeHTTPSDomain, Value: "malware.example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts: got %+v, want %+v", got, want)
+	}
+
+	if _, err := parseThreatFeed(strings.NewReader(""), "stix"); err == nil {
+		t.Error("want error for unknown format")
+	}
+}
+
+func TestBypassEntries(t *testing.T) {
+	p := policy.New()
+	seen := make(map[string]bool)
+	for n, e := range bypassEntries {
+		if seen[e.value] {
+			t.Errorf("%q listed twice", e.value)
+		}
+		seen[e.value] = true
+		for _, typ := range []string{typeDomain, typeHTTPSDomain} {
+			if err := p.AddRule(fmt.Sprintf("%s-%d", typ, n), typ, e.value, actionBlock); err != nil {
+				t.Errorf("%s %q: %v", typ, e.value, err)
+			}
+			if err := p.AddGrant("10.0.0.0/8", policy.Grant{Group: "g", ACL: "bypass", Rule: fmt.Sprintf("%s-%d", typ, n)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, req := range []policy.Request{
+		{Proto: policy.ProtoConnect, Source: "10.0.0.1", Method: "CONNECT", URI: "dns.google:443"},
+		{Proto: policy.ProtoConnect, Source: "10.0.0.1", Method: "CONNECT", URI: "1.1.1.1:443"},
+		{Proto: policy.ProtoConnect, Source: "10.0.0.1", Method: "CONNECT", URI: "mozilla.cloudflare-dns.com:443"},
+		{Proto: policy.ProtoHTTP, Source: "10.0.0.1", Method: "GET", URI: "http://www.torproject.org/download/"},
+	} {
+		d, err := p.Decide(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Action != actionBlock {
+			t.Errorf("%s: got %q, want block", req.URI, d.Action)
+		}
+	}
+}
+
+func TestGenerateFirewallConf(t *testing.T) {
+	groups := []groupSources{
+		{Group: group{GroupID: "kids", Comment: "Kids"}, Sources: []string{"10.0.1.0/24", "fd00::/64", "10.0.0.5/255.0.0.255"}},
+		{Group: group{GroupID: "adults", Comment: "Adults"}, Sources: []string{"10.0.2.0/24"}},
+	}
+	quic := map[groupID]bool{"kids": true}
+	sg := newSquidGroups(groups, "")
+	sg.rev = 42
+	var buf bytes.Buffer
+	if err := generateFirewallConf(&buf, sg, quic); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	var again bytes.Buffer
+	if err := generateFirewallConf(&again, sg, quic); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != got {
+		t.Errorf("output not stable:\n%s\nthen:\n%s", got, again.String())
+	}
+	for _, want := range []string{
+		"# Policy revision 42.\n",
+		"delete table inet squidwarden_quic\n",
+		"\t\t# Kids\n",
+		"\t\tip saddr 10.0.1.0/24 udp dport 443 reject\n",
+		"\t\tip6 saddr fd00::/64 udp dport 443 reject\n",
+		"\t\tip saddr & 255.0.0.255 == 10.0.0.5 udp dport 443 reject\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "10.0.2.0") {
+		t.Errorf("group without QUIC blocked included:\n%s", got)
+	}
+
+	buf.Reset()
+	generateQUICConf(&buf, newSquidGroups(groups, ""), quic)
+	if want := "reply_header_access Alt-Svc deny sw_group_kids\n"; !strings.HasSuffix(buf.String(), want) || strings.Contains(buf.String(), "adults") {
+		t.Errorf("squid conf: got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSquidGroupsDefault(t *testing.T) {
+	groups := []groupSources{
+		{Group: group{GroupID: "kids", Comment: "Kids"}, Sources: []string{"10.0.1.0/24"}},
+		{Group: group{GroupID: "guests", Comment: "Guests"}, Sources: []string{"10.0.9.0/24"}},
+	}
+	sg := newSquidGroups(groups, "guests")
+	if got, want := sg.refs("guests"), []string{"sw_group_guests", "!sw_assigned"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("default refs: got %q, want %q", got, want)
+	}
+	if got, want := sg.refs("kids"), []string{"sw_group_kids"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("refs: got %q, want %q", got, want)
+	}
+	if got, want := newSquidGroups(nil, "guests").refs("guests"), []string{"all"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no groups: got %q, want %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := generateFirewallConf(&buf, sg, map[groupID]bool{"guests": true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "\t\t# Guests\n" +
+		"\t\tip saddr 10.0.9.0/24 udp dport 443 reject\n" +
+		"\t\t# Clients in no group, for the default group.\n" +
+		"\t\tip saddr 10.0.1.0/24 udp dport 443 accept\n" +
+		"\t\tip saddr 10.0.9.0/24 udp dport 443 accept\n" +
+		"\t\tudp dport 443 reject\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("got:\n%s\nwant it to contain:\n%s", buf.String(), want)
+	}
+}
+
+func TestDiffGroupRules(t *testing.T) {
+	kids := acl{ACLID: "kids", Comment: "Kids"}
+	all := acl{ACLID: "all", Comment: "Everyone"}
+	a := []analysisRule{
+		{RuleID: "r1", Type: typeHTTPSDomain, Value: ".example.com", Action: actionAllow, ACL: all},
+		{RuleID: "r2", Type: typeHTTPSDomain, Value: ".games.com", Action: actionAllow, ACL: all},
+		{RuleID: "r3", Type: typeDomain, Value: ".news.com", Action: actionAllow, ACL: all},
+	}
+	b := []analysisRule{
+		{RuleID: "r1", Type: typeHTTPSDomain, Value: ".example.com", Action: actionAllow, ACL: all},
+		{RuleID: "r4", Type: typeHTTPSDomain, Value: ".games.com", Action: actionBlock, ACL: kids},
+		{RuleID: "r3", Type: typeDomain, Value: ".news.com", Action: actionAllow, ACL: all},
+		{RuleID: "r5", Type: typeDomain, Value: ".news.com", Action: actionBlock, ACL: kids},
+		{RuleID: "r6", Type: typeDomain, Value: ".kids.com", Action: actionAllow, ACL: kids},
+	}
+	want := []groupDiffEntry{
+		{Type: typeHTTPSDomain, Value: ".games.com", ActionA: actionAllow, ActionB: actionBlock, RuleA: "r2", RuleB: "r4", ACLA: "Everyone", ACLB: "Kids"},
+		{Type: typeDomain, Value: ".kids.com", ActionB: actionAllow, RuleB: "r6", ACLB: "Kids"},
+		{Type: typeDomain, Value: ".news.com", ActionA: actionAllow, ActionB: actionBlock, RuleA: "r3", RuleB: "r5", ACLA: "Everyone", ACLB: "Kids"},
+	}
+	if got := diffGroupRules(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	da, db, err := decideForGroups("https://www.games.com/", a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (diffDecision{Action: actionAllow, ACL: "Everyone", Rule: "r2"}); da != want {
+		t.Errorf("A: got %+v, want %+v", da, want)
+	}
+	if want := (diffDecision{Action: actionBlock, ACL: "Kids", Rule: "r4"}); db != want {
+		t.Errorf("B: got %+v, want %+v", db, want)
+	}
+	if _, db, _ := decideForGroups("https://www.kids.com/", a, b); db.Action != "default" {
+		t.Errorf("https to domain rule: got %+v, want default", db)
+	}
+}
+
+func TestParseSourceImport(t *testing.T) {
+	text := `1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:01
+1700000000 aa:bb:cc:dd:ee:02 192.168.1.11 * *
+lease 192.168.1.12 {
+  starts 4 2023/11/16 10:00:00;
+  binding state active;
+  hardware ethernet AA:BB:CC:DD:EE:03;
+  client-hostname "tablet";
+}
+lease 192.168.1.13 {
+  binding state free;
+  hardware ethernet aa:bb:cc:dd:ee:04;
+}
+192.168.1.14 dev eth0 lladdr aa:bb:cc:dd:ee:05 REACHABLE
+192.168.1.15 dev eth0  FAILED
+fe80::1 dev eth0 lladdr aa:bb:cc:dd:ee:06 STALE
+printer.lan (192.168.1.16) at aa:bb:cc:dd:ee:07 on en0 ifscope [ethernet]
+1700000001 aa:bb:cc:dd:ee:08 192.168.1.10 laptop2 *
+`
+	want := []sourceCandidate{
+		{Source: "192.168.1.10/32", Address: "192.168.1.10", MAC: "aa:bb:cc:dd:ee:08", Hostname: "laptop2", Comment: "laptop2", Format: importDnsmasq},
+		{Source: "192.168.1.11/32", Address: "192.168.1.11", MAC: "aa:bb:cc:dd:ee:02", Comment: "aa:bb:cc:dd:ee:02", Format: importDnsmasq},
+		{Source: "192.168.1.12/32", Address: "192.168.1.12", MAC: "aa:bb:cc:dd:ee:03", Hostname: "tablet", Comment: "tablet", Format: importDhcpd},
+		{Source: "192.168.1.14/32", Address: "192.168.1.14", MAC: "aa:bb:cc:dd:ee:05", Comment: "aa:bb:cc:dd:ee:05", Format: importNeigh},
+		{Source: "fe80::1/128", Address: "fe80::1", MAC: "aa:bb:cc:dd:ee:06", Comment: "aa:bb:cc:dd:ee:06", Format: importNeigh},
+		{Source: "192.168.1.16/32", Address: "192.168.1.16", MAC: "aa:bb:cc:dd:ee:07", Hostname: "printer.lan", Comment: "printer.lan", Format: importARP},
+	}
+	if got := parseSourceImport(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	seen := make(map[string]bool)
+	for n := range builtinTemplates {
+		tmpl := &builtinTemplates[n]
+		if seen[tmpl.Name] {
+			t.Errorf("template %q listed twice", tmpl.Name)
+		}
+		seen[tmpl.Name] = true
+		if tmpl.Description == "" {
+			t.Errorf("template %q has no description", tmpl.Name)
+		}
+		if err := validateTemplate(tmpl); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, want := range []string{"kids", "guests", "servers-egress-only"} {
+		if !seen[want] {
+			t.Errorf("template %q missing", want)
+		}
+	}
+}
+
+func TestWriteDemoEntry(t *testing.T) {
+	for _, g := range demoGroups {
+		if _, err := findGroupTemplate(g.template); err != nil {
+			t.Errorf("group %q: %v", g.name, err)
+		}
+	}
+	p := policy.New()
+	if err := p.AddRule("r1", typeHTTPSDomain, ".wikipedia.org", actionAllow); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddGrant("192.168.0.0/16", policy.Grant{Group: "g", ACL: "a", Rule: "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	clients := demoClients()
+	now := time.Now()
+	var buf bytes.Buffer
+	for n := 0; n < 100; n++ {
+		if err := writeDemoEntry(&buf, p, clients, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		e, err := squidlog.Parse(l)
+		if err != nil {
+			t.Errorf("%q: %v", l, err)
+			continue
+		}
+		allowed := e.Method == "CONNECT" && strings.HasSuffix(e.Host, "wikipedia.org") && strings.HasPrefix(e.Client, "192.168.")
+		if denied := e.Status == "TCP_DENIED/403"; denied == allowed {
+			t.Errorf("%q: allowed=%t but status %q", l, allowed, e.Status)
+		}
+	}
+}
+
+func TestParseLogOrigin(t *testing.T) {
+	if o, err := parseLogOrigin("", "", "", time.UTC); err != nil || o != nil {
+		t.Errorf("no fields: got %+v, %v, want nil", o, err)
+	}
+	if _, err := parseLogOrigin("yesterday", "10.0.0.1", "", time.UTC); err == nil {
+		t.Errorf("bad time: want error")
+	}
+	o, err := parseLogOrigin("2016-01-01 00:00:00 UTC", "10.0.0.1", "http://example.com/x", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.Time, int64(1451606400); got != want {
+		t.Errorf("time: got %d, want %d", got, want)
+	}
+	if got, want := o.Comment(), "From log: 10.0.0.1 requested http://example.com/x at "+time.Unix(1451606400, 0).UTC().Format(saneTime); got != want {
+		t.Errorf("comment: got %q, want %q", got, want)
+	}
+	o, err = parseLogOrigin("", "10.0.0.1", "", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.Comment(), "From log: 10.0.0.1"; got != want {
+		t.Errorf("comment: got %q, want %q", got, want)
+	}
+}
+
+func TestCommentEdit(t *testing.T) {
+	for _, test := range []struct {
+		e        commentEdit
+		old, new string
+	}{
+		{commentEdit{op: commentAppend, text: "TICKET-1"}, "", "TICKET-1"},
+		{commentEdit{op: commentAppend, text: "TICKET-1"}, "blocked for ads", "blocked for ads TICKET-1"},
+		{commentEdit{op: commentPrepend, text: "[netops]"}, "ads", "[netops] ads"},
+		{commentEdit{op: commentSet, text: "x"}, "ads", "x"},
+		{commentEdit{op: commentSet}, "ads", ""},
+		{commentEdit{op: commentReplace, find: "team-a", replace: "team-b"}, "owned by team-a, team-a knows", "owned by team-b, team-b knows"},
+		{commentEdit{op: commentReplace, find: "T-\\d+", re: regexp.MustCompile(`T-(\d+)`), replace: "TICKET-$1"}, "see T-12", "see TICKET-12"},
+	} {
+		if got := test.e.apply(test.old); got != test.new {
+			t.Errorf("%+v on %q: got %q, want %q", test.e, test.old, got, test.new)
+		}
+	}
+}
+
+func TestConfirmToken(t *testing.T) {
+	a := confirmToken("acl", "x", 1)
+	if a != confirmToken("acl", "x", 1) {
+		t.Errorf("token not stable")
+	}
+	for _, b := range []string{confirmToken("acl", "x", 2), confirmToken("acl", "y", 1), confirmToken("source", "x", 1)} {
+		if a == b {
+			t.Errorf("token %q reused", a)
+		}
+	}
+}
+
+func TestRequestHash(t *testing.T) {
+	hash := func(method, u, body string) string {
+		r := httptest.NewRequest(method, u, strings.NewReader(body))
+		h, err := requestHash(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(r.Body); string(b) != body {
+			t.Errorf("body not restored, got %q", b)
+		}
+		return h
+	}
+	a := hash("POST", "/acl/new", "comment=x")
+	if a != hash("POST", "/acl/new", "comment=x") {
+		t.Errorf("hash not stable")
+	}
+	for _, b := range []string{
+		hash("POST", "/acl/new", "comment=y"),
+		hash("DELETE", "/acl/new", "comment=x"),
+		hash("POST", "/acl/new?x=1", "comment=x"),
+	} {
+		if a == b {
+			t.Errorf("different requests got the same hash")
+		}
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	for _, s := range []string{``, `[]`, `{}`, `[{"op": "acl.explode"}]`} {
+		if _, err := parseBatch(s); err == nil {
+			t.Errorf("parseBatch(%q) succeeded", s)
+		}
+	}
+	ops, err := parseBatch(`[{"op": "acl.create", "comment": "x"}, {"op": "rule.create", "acl": "$0"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || ops[1].ACL != "$0" {
+		t.Fatalf("got %+v", ops)
+	}
+
+	results := []batchResult{{Op: "acl.create", ID: "a"}, {Op: "rule.unbind"}}
+	if err := ops[1].resolve(results); err != nil {
+		t.Fatal(err)
+	}
+	if ops[1].ACL != "a" {
+		t.Errorf("got ACL %q, want a", ops[1].ACL)
+	}
+	for _, ref := range []string{"$1", "$2", "$-1", "$x"} {
+		op := batchOp{Rule: ref}
+		if err := op.resolve(results); err == nil {
+			t.Errorf("resolved %q", ref)
+		}
+	}
+}
+
+func TestWhyExplain(t *testing.T) {
+	for _, test := range []struct {
+		d       policy.Decision
+		blocked bool
+		want    string
+	}{
+		{policy.Decision{Match: true, Action: policy.ActionAllow}, false, "allowed"},
+		{policy.Decision{Match: true, Action: policy.ActionBlock}, true, "rule blocks"},
+		{policy.Decision{Match: true, Action: policy.ActionIgnore}, true, "rule blocks"},
+		{policy.Decision{Action: policy.ActionDefault}, true, "No rule"},
+		{policy.Decision{Match: true, Action: policy.ActionBlock, Reason: "paused"}, true, "paused"},
+		{policy.Decision{Match: true, Action: policy.ActionBlock, Reason: "quota exhausted"}, true, "quota"},
+	} {
+		blocked, why := whyExplain(test.d)
+		if blocked != test.blocked || !strings.Contains(why, test.want) {
+			t.Errorf("%+v: got %t %q, want %t and %q", test.d, blocked, why, test.blocked, test.want)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	for _, test := range []struct {
+		trusted, remote, realIP, forwarded string
+		want                               string
+	}{
+		{"", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"", "127.0.0.1:1234", "10.0.0.9", "", "127.0.0.1"},
+		{"", "127.0.0.1:1234", "", "10.0.0.9", "127.0.0.1"},
+		{"127.0.0.1,::1", "127.0.0.1:1234", "10.0.0.9", "", "10.0.0.9"},
+		{"127.0.0.1,::1", "[::1]:1234", "", "1.2.3.4, 10.0.0.9", "10.0.0.9"},
+		{"127.0.0.1,::1", "127.0.0.1:1234", "", "", "127.0.0.1"},
+		{"127.0.0.1", "10.0.0.1:1234", "10.0.0.9", "", "10.0.0.1"},
+		{"192.168.0.0/24", "192.168.0.7:1234", "10.0.0.9", "", "10.0.0.9"},
+		{"bogus", "127.0.0.1:1234", "10.0.0.9", "", "127.0.0.1"},
+	} {
+		serverOpts.TrustedProxy = test.trusted
+		r := httptest.NewRequest("GET", "/why", nil)
+		r.RemoteAddr = test.remote
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := clientAddr(r); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test, got, test.want)
+		}
+	}
+}
+
+func TestFreezeExempt(t *testing.T) {
+	for route, want := range map[string]bool{
+		"/freeze/new":                      true,
+		"/freeze/{freezeID:[0-9a-f-]+}":    true,
+		"/setup/schema":                    true,
+		"/snapshots/new":                   true,
+		"/promotions/send":                 true,
+		"/promotion/{promotionID}/approve": false,
+		"/tokens/{tokenID}/rotate":         true,
+		"/acl/new":                         false,
+		"/batch":                           false,
+	} {
+		if got := freezeExempt(route); got != want {
+			t.Errorf("freezeExempt(%q) = %t, want %t", route, got, want)
+		}
+	}
+}
+
+func TestWriteDomainShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	domains := []string{".a.example.com", ".b.example.com", ".c.example.com", ".d.example.com", ".e.example.com"}
+	stream := func(f func(string) error) error {
+		for _, d := range domains {
+			if err := f(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	files := []string{"acl_x.0.domains", "acl_x.1.domains", "acl_x.2.domains"}
+	if err := writeDomainShards(dir, files, 2, stream); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fn := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	want := []string{
+		".a.example.com\n.b.example.com\n",
+		".c.example.com\n.d.example.com\n",
+		".e.example.com\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := writeDomainShards(dir, files[:2], 2, stream); err == nil {
+		t.Errorf("too few files accepted")
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, ".squidwarden*")); len(left) != 0 {
+		t.Errorf("temp files left: %q", left)
+	}
+
+	a, err := hashDomains(2, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := hashDomains(3, stream); a == b {
+		t.Errorf("shard size doesn't change checksum")
+	}
+	domains = domains[1:]
+	if b, _ := hashDomains(2, stream); a == b {
+		t.Errorf("domains don't change checksum")
+	}
+}
+
+func TestJobBackoff(t *testing.T) {
+	for _, test := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	} {
+		if got := jobBackoff(test.attempts); got != test.want {
+			t.Errorf("jobBackoff(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestRemoveOldBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, fn := range []string{
+		backupPrefix + "20160101-020000" + backupSuffix,
+		backupPrefix + "20160102-020000" + backupSuffix,
+		backupPrefix + "20160103-020000" + backupSuffix,
+		"other.json",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := removeOldBackups(&jobRun{}, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fs {
+		got = append(got, f.Name())
+	}
+	want := []string{"other.json", backupPrefix + "20160102-020000" + backupSuffix, backupPrefix + "20160103-020000" + backupSuffix}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestSchemaDiff(t *testing.T) {
+	want := map[string][]string{
+		"acls":  {"acl_id", "comment", "enabled"},
+		"jobs":  {"job_id"},
+		"rules": {"rule_id"},
+	}
+	got := map[string][]string{
+		"acls":  {"acl_id", "comment"},
+		"rules": {"rule_id", "extra"},
+	}
+	if d, w := schemaDiff(want, got), []string{"acls.enabled", "jobs"}; !reflect.DeepEqual(d, w) {
+		t.Errorf("Got %q, want %q", d, w)
+	}
+}
+
+func TestDoctorTemplates(t *testing.T) {
+	var buf bytes.Buffer
+	d := &doctor{w: &buf}
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	d.checkFiles(testOpts)
+	if d.problems != 0 {
+		t.Errorf("Problems with the templates:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "templates parse") {
+		t.Errorf("Templates not checked:\n%s", buf.String())
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		h      http.HandlerFunc
+		status int
+		bytes  int64
+	}{
+		{
+			name:   "ok",
+			h:      func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "hello") },
+			status: http.StatusOK,
+			bytes:  5,
+		},
+		{
+			name:   "empty",
+			h:      func(w http.ResponseWriter, r *http.Request) {},
+			status: http.StatusOK,
+		},
+		{
+			name:   "not found",
+			h:      http.NotFound,
+			status: http.StatusNotFound,
+			bytes:  19,
+		},
+		{
+			name:   "bad ID",
+			h:      func(w http.ResponseWriter, r *http.Request) { assertUUID("nope") },
+			status: http.StatusBadRequest,
+			bytes:  25,
+		},
+	} {
+		var buf bytes.Buffer
+		h := newRequestLogger(recoverPanics{test.h}, &buf)
+		r := httptest.NewRequest("GET", "/acl/?q=x", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set("X-Remote-User", "alice")
+		r.Header.Set("X-Request-Id", "req1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		var got requestLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("%s: bad log line %q: %v", test.name, buf.String(), err)
+		}
+		if got.Status != w.Code || got.Status != test.status {
+			t.Errorf("%s: logged status %d, replied %d, want %d", test.name, got.Status, w.Code, test.status)
+		}
+		if got.Bytes != int64(w.Body.Len()) || got.Bytes != test.bytes {
+			t.Errorf("%s: logged %d bytes, replied %d, want %d", test.name, got.Bytes, w.Body.Len(), test.bytes)
+		}
+		if got.RequestID != "req1" || got.User != "alice" || got.Method != "GET" || got.Path != "/acl/?q=x" {
+			t.Errorf("%s: got %+v", test.name, got)
+		}
+	}
+}
+
+func TestTrackingWriterFlush(t *testing.T) {
+	var canFlush bool
+	h := newRequestLogger(recoverPanics{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var f http.Flusher
+		if f, canFlush = w.(http.Flusher); canFlush {
+			f.Flush()
+		}
+	})}, ioutil.Discard)
+	r := httptest.NewRequest("GET", "/events", nil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !canFlush || !w.Flushed {
+		t.Errorf("Flusher: handler can flush %t, flushed %t, want both", canFlush, w.Flushed)
+	}
+
+	// A writer that can't flush.
+	h.ServeHTTP(struct{ http.ResponseWriter }{httptest.NewRecorder()}, r)
+	if canFlush {
+		t.Errorf("Not a Flusher: handler can flush")
+	}
+}
+
+func TestJSONForm(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want url.Values
+		err  bool
+	}{
+		{in: `{}`, want: url.Values{}},
+		{
+			in:   `{"comment": "hi", "n": 1.50, "enabled": true, "none": null}`,
+			want: url.Values{"comment": {"hi"}, "n": {"1.50"}, "enabled": {"true"}},
+		},
+		{
+			in:   `{"rules": ["r1", "r2"], "acls[]": ["a1"]}`,
+			want: url.Values{"rules[]": {"r1", "r2"}, "acls[]": {"a1"}},
+		},
+		{
+			in:   `{"ops": [{"op": "acl.create"}], "meta": {"a": 1}}`,
+			want: url.Values{"ops": {`[{"op": "acl.create"}]`}, "meta": {`{"a": 1}`}},
+		},
+		{in: `["a"]`, err: true},
+		{in: `{"a":`, err: true},
+	} {
+		got, err := jsonForm([]byte(test.in))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestDecodeForm(t *testing.T) {
+	type req struct {
+		Comment string   `form:"comment,required,trim"`
+		Action  string   `form:"action,enum=action"`
+		Rules   []string `form:"rules[],uuid"`
+		Enabled bool     `form:"enabled"`
+		Limit   int64    `form:"limit"`
+		Short   string   `form:"short,max=3"`
+	}
+	const id = "88bf513a-802f-450d-9fc4-b49eeabf1b8f"
+	for _, test := range []struct {
+		form   url.Values
+		want   req
+		fields fieldErrors
+	}{
+		{
+			form: url.Values{"comment": {" hi "}, "action": {"block"}, "rules[]": {id}, "enabled": {"true"}, "limit": {"10"}},
+			want: req{Comment: "hi", Action: "block", Rules: []string{id}, Enabled: true, Limit: 10},
+		},
+		{
+			form:   url.Values{"comment": {" "}},
+			fields: fieldErrors{"comment": "required"},
+		},
+		{
+			form: url.Values{"action": {"permit"}, "rules[]": {id, "x"}, "limit": {"many"}, "short": {"long"}},
+			fields: fieldErrors{
+				"comment": "required",
+				"action":  `"permit" is not one of allow, block, ignore`,
+				"rules[]": `"x" is not a valid ID`,
+				"limit":   `"many" is not a number`,
+				"short":   "may be at most 3 bytes",
+			},
+		},
+	} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		var got req
+		err := decodeForm(r, &got)
+		if test.fields == nil {
+			if err != nil {
+				t.Errorf("%v: %v", test.form, err)
+			} else if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%v: got %+v, want %+v", test.form, got, test.want)
+			}
+			continue
+		}
+		e, ok := err.(errHTTP)
+		if !ok || e.code != http.StatusBadRequest {
+			t.Errorf("%v: got %v, want 400", test.form, err)
+			continue
+		}
+		if got := e.details.(map[string]fieldErrors)["fields"]; !reflect.DeepEqual(got, test.fields) {
+			t.Errorf("%v: got field errors %v, want %v", test.form, got, test.fields)
+		}
+	}
+}
+
+func TestNextDigestTime(t *testing.T) {
+	now := time.Date(2016, 5, 10, 12, 30, 0, 0, time.UTC) // A Tuesday.
+	for _, test := range []struct {
+		day, clock string
+		want       time.Time
+	}{
+		{"tue", "13:00", time.Date(2016, 5, 10, 13, 0, 0, 0, time.UTC)},
+		{"tue", "12:30", time.Date(2016, 5, 17, 12, 30, 0, 0, time.UTC)},
+		{"Wed", "03:00", time.Date(2016, 5, 11, 3, 0, 0, 0, time.UTC)},
+		{"mon", "08:00", time.Date(2016, 5, 16, 8, 0, 0, 0, time.UTC)},
+	} {
+		got, err := nextDigestTime(now, test.day, test.clock)
+		if err != nil {
+			t.Fatalf("%q %q: %v", test.day, test.clock, err)
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%q %q: got %v, want %v", test.day, test.clock, got, test.want)
+		}
+	}
+	if _, err := nextDigestTime(now, "someday", "08:00"); err == nil {
+		t.Errorf("want error for invalid day")
+	}
+}
+
+func TestParseDashboardRange(t *testing.T) {
+	now := time.Date(2016, 5, 10, 12, 30, 0, 0, time.UTC)
+	for _, test := range []struct {
+		query    string
+		from, to time.Time
+		bad      bool
+	}{
+		{query: "", from: now.AddDate(0, 0, -7), to: now},
+		{query: "from=1462838400000&to=1462842000000", from: time.Date(2016, 5, 10, 0, 0, 0, 0, time.UTC), to: time.Date(2016, 5, 10, 1, 0, 0, 0, time.UTC)},
+		{query: "from=2016-05-09T00:00:00Z", from: time.Date(2016, 5, 9, 0, 0, 0, 0, time.UTC), to: now},
+		{query: "from=-24h&to=-1h", from: now.Add(-24 * time.Hour), to: now.Add(-time.Hour)},
+		{query: "from=yesterday", bad: true},
+		{query: "from=2016-05-11T00:00:00Z", bad: true},
+	} {
+		r, err := http.NewRequest("GET", "/stats/group-traffic?"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, to, err := parseDashboardRange(r, now)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%q: want error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if !from.Equal(test.from) || !to.Equal(test.to) {
+			t.Errorf("%q: got %v-%v, want %v-%v", test.query, from, to, test.from, test.to)
+		}
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "access.log")
+	s := &syslogSink{fn: fn}
+	if err := s.open(); err != nil {
+		t.Fatal(err)
+	}
+	const line = "1451606400.123 523 10.0.0.1 TCP_MISS/200 1234 GET http://a/ - HIER_DIRECT/1.2.3.4 text/html"
+	s.add("<166>Jan  1 00:00:00 proxy1 squid[1234]: " + line)
+	s.add("<166>Jan  1 00:00:00 proxy1 sshd[1]: Accepted publickey for root")
+	s.add("not syslog")
+
+	// Rotated.
+	if err := os.Rename(fn, fn+".1"); err != nil {
+		t.Fatal(err)
+	}
+	s.checked = time.Time{}
+	s.add("<166>1 2016-01-01T00:00:00Z proxy1 squid - - - " + line + "\n")
+
+	for _, f := range []string{fn + ".1", fn} {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), line+"\n"; got != want {
+			t.Errorf("%s: got %q, want %q", f, got, want)
+		}
+	}
+}
+
+func TestAuditMessage(t *testing.T) {
+	got := auditMessage("alice", "rule", "b4e1d2a0-0000-4000-8000-000000000000", "rule update")
+	if want := `change actor="alice" entity="rule" id="b4e1d2a0-0000-4000-8000-000000000000" summary="rule update"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChangeEvent(t *testing.T) {
+	b, err := json.Marshal(&changeEvent{
+		Type: "change",
+		change: change{
+			Time:     "2016-05-10T12:30:00Z",
+			Actor:    "alice",
+			Entity:   "acl",
+			EntityID: "b4e1d2a0-0000-4000-8000-000000000000",
+			Summary:  "acl update",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"type":"change","time":"2016-05-10T12:30:00Z","actor":"alice","entity":"acl","entity_id":"b4e1d2a0-0000-4000-8000-000000000000","summary":"acl update"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRecentLines(t *testing.T) {
+	r := newRecentLines(2)
+	for _, test := range []struct {
+		line string
+		want bool
+	}{
+		{"a", false},
+		{"a", true},
+		{"b", false},
+		{"a", true},
+		{"c", false}, // Forgets a.
+		{"b", true},
+		{"a", false},
+	} {
+		if got := r.seen(test.line); got != test.want {
+			t.Errorf("seen(%q) = %t, want %t", test.line, got, test.want)
+		}
+	}
+}
+
+func TestLogFingerprint(t *testing.T) {
+	f, err := ioutil.TempFile("", "squidwarden-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fingerprint := func() string {
+		fp, err := logFingerprint(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	if fp := fingerprint(); fp != "" {
+		t.Errorf("Empty file: got %q, want none", fp)
+	}
+	f.WriteString("first")
+	if fp := fingerprint(); fp != "" {
+		t.Errorf("Incomplete first line: got %q, want none", fp)
+	}
+	f.WriteString(" line\n")
+	want := fingerprint()
+	if want == "" {
+		t.Fatal("No fingerprint for a complete first line")
+	}
+	f.WriteString("second line\n")
+	if fp := fingerprint(); fp != want {
+		t.Errorf("Fingerprint changed with the second line: %q, was %q", fp, want)
+	}
+}
+
+func TestFormatTimeZone(t *testing.T) {
+	berlin, err := parseTimeZone("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "Local", "Mars/Olympus"} {
+		if _, err := parseTimeZone(name); err == nil {
+			t.Errorf("parseTimeZone(%q): want error", name)
+		}
+	}
+
+	ts := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	if got, want := formatTime(ts, berlin), "2016-07-01 14:00:00 CEST"; got != want {
+		t.Errorf("formatTime: got %q, want %q", got, want)
+	}
+	if got, want := formatUnix(ts.Unix(), time.UTC), "2016-07-01 12:00:00 UTC"; got != want {
+		t.Errorf("formatUnix: got %q, want %q", got, want)
+	}
+	if got, want := formatLogTime("2016-01-01 00:00:00 UTC", berlin), "2016-01-01 01:00:00 CET"; got != want {
+		t.Errorf("formatLogTime: got %q, want %q", got, want)
+	}
+	if got, want := formatLogTime("garbage", berlin), "garbage"; got != want {
+		t.Errorf("formatLogTime of bad time: got %q, want %q", got, want)
+	}
+
+	// Times shown in a zone are sent back when making rules from the log.
+	o, err := parseLogOrigin(formatLogTime("2016-07-01 12:00:00 UTC", berlin), "10.0.0.1", "", berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.Time, ts.Unix(); got != want {
+		t.Errorf("origin time: got %d, want %d", got, want)
+	}
+	if got, want := o.When(), "2016-07-01 14:00:00 CEST"; got != want {
+		t.Errorf("origin When: got %q, want %q", got, want)
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	berlin, err := parseTimeZone("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"now", now},
+		{"-24h", now.Add(-24 * time.Hour)},
+		{"-7d", now.Add(-7 * 24 * time.Hour)},
+		{"2016-06-01T10:00:00Z", time.Date(2016, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{"2016-06-01T10:00:00+02:00", time.Date(2016, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"2016-06-01T10:00", time.Date(2016, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"2016-06-01 10:00:30", time.Date(2016, 6, 1, 8, 0, 30, 0, time.UTC)},
+		{"2016-06-01", time.Date(2016, 5, 31, 22, 0, 0, 0, time.UTC)},
+	} {
+		got, err := parseRangeTime(test.in, now, berlin)
+		if err != nil {
+			t.Errorf("parseRangeTime(%q): %v", test.in, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("parseRangeTime(%q): got %v, want %v", test.in, got, test.want)
+		}
+	}
+	for _, in := range []string{"", "-", "-0h", "-1x", "yesterday", "2016-13-01", "1467374400"} {
+		if got, err := parseRangeTime(in, now, berlin); err == nil {
+			t.Errorf("parseRangeTime(%q): got %v, want error", in, got)
+		}
+	}
+
+	for _, test := range []struct {
+		query string
+		from  time.Time
+		to    time.Time
+		err   bool
+	}{
+		{"", time.Time{}, time.Time{}, false},
+		{"from=-1h", now.Add(-time.Hour), time.Time{}, false},
+		{"to=2016-06-01T00:00:00Z", time.Time{}, time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{"from=-2h&to=-1h", now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"from=-1h&to=-2h", time.Time{}, time.Time{}, true},
+		{"from=-1h&to=-1h", time.Time{}, time.Time{}, true},
+		{"from=bad", time.Time{}, time.Time{}, true},
+		{"to=bad", time.Time{}, time.Time{}, true},
+	} {
+		r := httptest.NewRequest("GET", "/log/search?"+test.query, nil)
+		tr, err := parseTimeRange(r, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: want error", test.query)
+			} else if e, ok := err.(errHTTP); !ok || e.code != http.StatusBadRequest {
+				t.Errorf("%q: got %v, want 400", test.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if !tr.from.Equal(test.from) || !tr.to.Equal(test.to) {
+			t.Errorf("%q: got %v - %v, want %v - %v", test.query, tr.from, tr.to, test.from, test.to)
+		}
+	}
+
+	tr := timeRange{from: now.Add(-time.Hour), to: now}
+	for _, test := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{now.Add(-2 * time.Hour), false},
+		{now.Add(-time.Hour), true},
+		{now.Add(-time.Minute), true},
+		{now, false},
+	} {
+		if got := tr.contains(test.t); got != test.want {
+			t.Errorf("contains(%v): got %v, want %v", test.t, got, test.want)
+		}
+	}
+	if !(timeRange{}).contains(now) || !(timeRange{}).unbounded() || tr.unbounded() {
+		t.Error("Unbounded range is wrong")
+	}
+}
+
+func TestParseTailCount(t *testing.T) {
+	defer func(o Options) { serverOpts = o }(serverOpts)
+	serverOpts.TailMaxLines = 100
+	for _, test := range []struct {
+		query string
+		want  int
+		err   bool
+	}{
+		{"", defaultTailLines, false},
+		{"count=0", 0, false},
+		{"count=50", 50, false},
+		{"count=1000", 100, false},
+		{"count=-1", 0, true},
+		{"count=x", 0, true},
+	} {
+		got, err := parseTailCount(httptest.NewRequest("GET", "/ajax/tail-log?"+test.query, nil))
+		if test.err != (err != nil) {
+			t.Errorf("%q: got error %v, want error %t", test.query, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %d, want %d", test.query, got, test.want)
+		}
+	}
+	// The default is capped too.
+	serverOpts.TailMaxLines = 3
+	if got, err := parseTailCount(httptest.NewRequest("GET", "/ajax/tail-log", nil)); err != nil || got != 3 {
+		t.Errorf("default over the max: got %d, %v, want 3", got, err)
+	}
+}
+
+func TestGroupTailEntries(t *testing.T) {
+	now := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	e := func(cursor, domain, status string, ago time.Duration) tailEntry {
+		return tailEntry{Cursor: cursor, Domain: domain, Host: "www." + domain, Status: status, at: now.Add(-ago)}
+	}
+	// Newest first.
+	entries := []tailEntry{
+		e("9", "example.com", "TCP_DENIED/403", 0),
+		e("8", "cdn.com", "TCP_DENIED/403", time.Second),
+		e("7", "example.com", "TCP_DENIED/403", 2*time.Second),
+		e("6", "example.com", "TCP_MISS/200", 3*time.Second),
+		e("5", "example.com", "TCP_DENIED/403", 10*time.Second),
+		e("4", "cdn.com", "TCP_DENIED/403", 5*time.Minute),
+		e("3", "example.com", "TCP_DENIED/403", 5*time.Minute),
+		e("2", "", "TCP_DENIED/403", 5*time.Minute),
+	}
+	entries[7].Host = "10.0.0.1"
+	type row struct {
+		cursor  string
+		grouped []string
+	}
+	var got []row
+	for _, g := range groupTailEntries(entries) {
+		r := row{cursor: g.Cursor}
+		for _, e := range g.Grouped {
+			r.grouped = append(r.grouped, e.Cursor)
+		}
+		got = append(got, r)
+	}
+	want := []row{
+		{"9", []string{"7", "5"}},
+		{"8", nil},
+		{"6", nil},
+		{"4", nil},
+		{"3", nil},
+		{"2", nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	a, err := decodeSnapshot([]byte(`[
+{"table": "acls", "acl_id": "a1", "comment": "work", "enabled": 1},
+{"table": "acls", "acl_id": "a2", "comment": "play", "enabled": 1},
+{"table": "aclrules", "acl_id": "a1", "rule_id": "r1", "comment": null}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a[0]["enabled"]; got != int64(1) {
+		t.Errorf("Decoded enabled as %#v, want int64(1)", got)
+	}
+	b, err := decodeSnapshot([]byte(`[
+{"table": "acls", "acl_id": "a1", "comment": "work", "enabled": 0},
+{"table": "aclrules", "acl_id": "a1", "rule_id": "r1", "comment": null},
+{"table": "aclrules", "acl_id": "a1", "rule_id": "r2", "comment": null}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]string{
+		"acls":     {"acl_id"},
+		"aclrules": {"acl_id", "rule_id"},
+	}
+	var got []string
+	for _, c := range diffSnapshots(a, b, keys) {
+		got = append(got, c.Table+" "+c.Key+" "+c.Change)
+	}
+	want := []string{
+		"acls a1 changed",
+		"acls a2 removed",
+		"aclrules a1/r2 added",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if got := diffSnapshots(a, a, keys); len(got) != 0 {
+		t.Errorf("Same snapshot: got %+v", got)
+	}
+}
+
+func TestIgnoreSet(t *testing.T) {
+	for _, test := range []struct {
+		kind, in, want string
+	}{
+		{ignoreDomain, "Example.com", "example.com"},
+		{ignoreDomain, "*.example.com", "example.com"},
+		{ignoreDomain, ".example.com", "example.com"},
+		{ignoreDomain, "", ""},
+		{ignoreDomain, "http://example.com/", ""},
+		{ignoreDomain, "a.*.com", ""},
+		{ignoreClient, "10.0.0.1", "10.0.0.1"},
+		{ignoreClient, "10.0.0.1/24", "10.0.0.0/24"},
+		{ignoreClient, "2001:db8::0:1", "2001:db8::1"},
+		{ignoreClient, "host.example.com", ""},
+		{"host", "example.com", ""},
+	} {
+		got, err := parseIgnoreValue(test.kind, test.in)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s %q: got %q, want error", test.kind, test.in, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s %q: got %q, %v, want %q", test.kind, test.in, got, err, test.want)
+		}
+	}
+
+	var none *ignoreSet
+	if none.hides(&squidlog.Entry{Host: "example.com", Client: "10.0.0.1"}) {
+		t.Error("Nil set hides things")
+	}
+	_, n, _ := net.ParseCIDR("10.1.0.0/16")
+	s := &ignoreSet{
+		domains: map[string]bool{"telemetry.example.com": true},
+		clients: map[string]bool{"10.0.0.1": true},
+		nets:    []*net.IPNet{n},
+	}
+	for _, test := range []struct {
+		host, client string
+		want         bool
+	}{
+		{"telemetry.example.com", "192.168.0.1", true},
+		{"EU.telemetry.example.com", "192.168.0.1", true},
+		{"example.com", "192.168.0.1", false},
+		{"notelemetry.example.com", "192.168.0.1", false},
+		{"example.com", "10.0.0.1", true},
+		{"example.com", "10.0.0.2", false},
+		{"example.com", "10.1.2.3", true},
+		{"example.com", "bogus", false},
+	} {
+		if got := s.hides(&squidlog.Entry{Host: test.host, Client: test.client}); got != test.want {
+			t.Errorf("%s from %s: got %t, want %t", test.host, test.client, got, test.want)
+		}
+	}
+}
+
+func TestSiteInfo(t *testing.T) {
+	for in, want := range map[string]string{
+		"www.Example.com":     "example.com",
+		".cdn.example.co.uk":  "example.co.uk",
+		"example.com":         "example.com",
+		"10.0.0.1":            "",
+		"http://example.com/": "",
+		"":                    "",
+	} {
+		if got := siteDomain(in); got != want {
+			t.Errorf("siteDomain(%q): got %q, want %q", in, got, want)
+		}
+	}
+
+	for ip, want := range map[string]bool{
+		"8.8.8.8":     true,
+		"2001:4860::": true,
+		"10.1.2.3":    false,
+		"172.16.0.1":  false,
+		"192.168.1.1": false,
+		"127.0.0.1":   false,
+		"169.254.1.1": false,
+		"::1":         false,
+		"fd00::1":     false,
+	} {
+		if got := publicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("publicIP(%s): got %t, want %t", ip, got, want)
+		}
+	}
+
+	// Whatever the name resolves to, private addresses aren't connected
+	// to, e.g. an icon URL pointing at the local network.
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("site info fetch reached %s", r.URL)
+	}))
+	defer local.Close()
+	if _, _, err := getSite(local.URL+"/favicon.ico", maxSiteIcon); err == nil {
+		t.Errorf("getSite(%q) succeeded, want error", local.URL)
+	}
+
+	base, err := url.Parse("https://www.example.com/start/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		page, title, icon string
+	}{
+		{"<html><head><title>\n  Example &amp; Co\n</title></head>", "Example & Co", "https://www.example.com/favicon.ico"},
+		{`<TITLE>X</TITLE><link rel="stylesheet" href="/s.css"><link href='i.png' rel="icon">`, "X", "https://www.example.com/start/i.png"},
+		{`<link rel="shortcut icon" href="//cdn.example.com/f.ico" />`, "", "https://cdn.example.com/f.ico"},
+		{`<link rel=icon href=/a.gif>`, "", "https://www.example.com/a.gif"},
+	} {
+		title, icon := parseSitePage(base, test.page)
+		if title != test.title || icon != test.icon {
+			t.Errorf("%q: got %q, %q, want %q, %q", test.page, title, icon, test.title, test.icon)
+		}
+	}
+}
+
+func TestReputation(t *testing.T) {
+	got, err := parseReputationList(strings.NewReader(`# Scores.
+Example.com 10
+.bad.example.org 95 malware host  # From the feed.
+
+mid.example.net 50
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]reputationScore{
+		"example.com":     {Source: reputationSourceList, Score: 10},
+		"bad.example.org": {Source: reputationSourceList, Score: 95, Label: "malware host"},
+		"mid.example.net": {Source: reputationSourceList, Score: 50},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+	for _, bad := range []string{"example.com", "example.com high", "example.com 101", "example.com -1"} {
+		if _, err := parseReputationList(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+
+	for score, want := range map[int]string{
+		-1:  "unknown",
+		0:   "low",
+		29:  "low",
+		30:  "medium",
+		69:  "medium",
+		70:  "high",
+		100: "high",
+	} {
+		if got := reputationLevel(score); got != want {
+			t.Errorf("reputationLevel(%d): got %q, want %q", score, got, want)
+		}
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	acl := "/acl/{aclID:" + uuidRE + "}"
+	for _, test := range []struct {
+		scope, method, route string
+		perm                 permission
+		want                 bool
+	}{
+		{scopeRead, "GET", "/matrix.json", permRead, true},
+		{scopeRead, "POST", "/rule/parse", permRead, true},
+		{scopeRead, "GET", "/log/search", permRead, false},
+		{scopeRead, "POST", "/group/new", permWrite, false},
+		{scopeLogsRead, "GET", "/log/search", permRead, true},
+		{scopeLogsRead, "GET", "/ajax/tail-log/stream", permRead, true},
+		{scopeLogsRead, "GET", "/source/{sourceID}/activity/export", permRead, true},
+		{scopeLogsRead, "GET", "/matrix.json", permRead, false},
+		{scopeRulesWrite, "POST", "/rule/new", permWrite, true},
+		{scopeRulesWrite, "POST", acl + "/description", permWrite, true},
+		{scopeRulesWrite, "DELETE", "/group/{groupID}", permWrite, false},
+		{scopeRulesWrite, "GET", "/rule/lint", permRead, false},
+		{scopeApply, "POST", "/config/apply", permAdmin, true},
+		{scopeApply, "POST", "/freeze/new", permAdmin, false},
+		{"nope", "GET", "/matrix.json", permRead, false},
+	} {
+		if got := scopeAllows(test.scope, test.method, test.route, test.perm); got != test.want {
+			t.Errorf("%s %s %s: got %v, want %v", test.scope, test.method, test.route, got, test.want)
+		}
+	}
+}
+
+func TestTokenSecrets(t *testing.T) {
+	token, lookup, hash, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotLookup, secret, ok := splitToken(token)
+	if !ok || gotLookup != lookup || !strings.HasPrefix(token, tokenPrefix) {
+		t.Fatalf("splitToken(%q): got %q, %q, %v", token, gotLookup, secret, ok)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") || strings.Contains(hash, secret) {
+		t.Errorf("Bad hash %q", hash)
+	}
+	for _, test := range []struct {
+		secret string
+		want   bool
+	}{
+		{secret, true},
+		{secret + "x", false},
+		{"", false},
+	} {
+		if got, err := checkSecret(test.secret, hash); err != nil || got != test.want {
+			t.Errorf("checkSecret(%q): got %v, %v, want %v", test.secret, got, err, test.want)
+		}
+	}
+	if _, err := checkSecret(secret, legacyHashPrefix+hashToken(token)); err == nil {
+		t.Errorf("SHA-256 hash: want error")
+	}
+	// Tokens from before argon2id.
+	if _, _, ok := splitToken(tokenPrefix + strings.Repeat("ab", 32)); ok {
+		t.Errorf("Old token split")
+	}
+}
+
+func TestMemberExpiryReport(t *testing.T) {
+	ms := []expiredMember{
+		{SourceID: "s1", GroupID: "g1", Source: "10.0.0.5/32", SourceComment: "guest phone", Group: "guests", Expires: 1500000000},
+		{SourceID: "s2", GroupID: "g2", Expires: 1500000000},
+	}
+	want := "10.0.0.5/32 (guest phone) removed from guests, expired 2017-07-14 02:40:00 UTC\n" +
+		"s2 removed from g2, expired 2017-07-14 02:40:00 UTC"
+	if got := memberExpiryReport(ms, time.UTC); got != want {
+		t.Errorf("Got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegistrationCode(t *testing.T) {
+	code, err := newRegistrationCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != registrationCodeLen || strings.Trim(code, registrationCodeChars) != "" {
+		t.Errorf("Bad code %q", code)
+	}
+	for in, want := range map[string]string{
+		"ABCD2345":   "ABCD2345",
+		"abcd-2345":  "ABCD2345",
+		" ab cd 23 ": "ABCD23",
+		"":           "",
+	} {
+		if got := normalizeRegistrationCode(in); got != want {
+			t.Errorf("normalizeRegistrationCode(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+// The "why is this blocked?" page lets end users check a URL against the
+// policy for their own address, and see their recent blocked requests,
+// before asking for help. It has no auth, so it's off unless -why_page is
+// set.
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/squidwarden/internal/policy"
+)
+
+const (
+	whyBlockedHours = 24
+	whyBlockedTop   = 10
+)
+
+type whyBlockedHost struct {
+	Host     string
+	Requests int64
+}
+
+// getBlockedHosts returns the hosts client was denied the most since from.
+func getBlockedHosts(client string, from time.Time) ([]whyBlockedHost, error) {
+	start := from.Unix()
+	rows, err := db.Query(`
+SELECT host, SUM(denied) AS n
+FROM (
+  SELECT host, denied FROM trafficstats WHERE hour >= ? AND client=?
+  UNION ALL
+  SELECT host, denied FROM trafficlog WHERE time >= ? AND client=?
+)
+GROUP BY host
+HAVING n > 0
+ORDER BY n DESC, host
+LIMIT ?`, start, client, start, client, whyBlockedTop)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []whyBlockedHost
+	for rows.Next() {
+		var h whyBlockedHost
+		if err := rows.Scan(&h.Host, &h.Requests); err != nil {
+			return nil, err
+		}
+		ret = append(ret, h)
+	}
+	return ret, rows.Err()
+}
+
+// whyExplain says in end user terms what the policy decided.
+func whyExplain(d policy.Decision) (blocked bool, why string) {
+	switch {
+	case d.Action == policy.ActionAllow:
+		return false, "It's allowed"
+	case d.Reason == "paused":
+		return true, "Internet access for your computer's group is paused"
+	case d.Reason == "quota exhausted":
+		return true, "Your computer has used up its quota for this site"
+	case !d.Match:
+		return true, "No rule allows it, so it's blocked"
+	}
+	return true, "A rule blocks it"
+}
+
+func whyHandler(w http.ResponseWriter, r *http.Request) {
+	if !serverOpts.WhyPage {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		URL     string
+		Client  string
+		Checked bool
+		Blocked bool
+		Why     string
+		ACL     string
+		Error   string
+		Hours   int
+		Recent  []whyBlockedHost
+	}{
+		URL:    r.FormValue("url"),
+		Client: clientAddr(r),
+		Hours:  whyBlockedHours,
+	}
+	if data.URL != "" {
+		if err := func() error {
+			req, err := policy.URLRequest(data.Client, data.URL)
+			if err != nil {
+				return errHTTP{
+					internal: err,
+					external: "Please enter the full address, starting with http:// or https://.",
+					code:     http.StatusBadRequest,
+				}
+			}
+			// Shared and cached, so anonymous users can't make it
+			// load the policy.
+			p, err := currentPolicy()
+			if err != nil {
+				return err
+			}
+			d, err := p.Decide(req)
+			if err != nil {
+				return err
+			}
+			data.Checked = true
+			data.Blocked, data.Why = whyExplain(d)
+			if d.ACL != "" {
+				if err := db.QueryRow(`SELECT comment FROM acls WHERE acl_id=?`, d.ACL).Scan(&data.ACL); err != nil {
+					log.Printf("Why page: failed to look up ACL %q: %v", d.ACL, err)
+				}
+			}
+			return nil
+		}(); err != nil {
+			if e, ok := err.(errHTTP); ok {
+				data.Error = e.external
+				w.WriteHeader(e.code)
+			} else {
+				log.Printf("Why page: %v", err)
+				data.Error = "Internal error. Please try again later."
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+	}
+	var err error
+	if data.Recent, err = getBlockedHosts(data.Client, time.Now().Add(-whyBlockedHours*time.Hour)); err != nil {
+		log.Printf("Why page: failed to get blocked hosts of %s: %v", data.Client, err)
+	}
+	tmpl := getTemplate("why.html", nil)
+	if err := tmpl.Execute(w, &data); err != nil {
+		log.Printf("template execute fail: %v", err)
+	}
+}
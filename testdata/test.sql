@@ -13,11 +13,13 @@ INSERT INTO sources(source_id, source) VALUES('zuul',   '::1234:5678/::ffff:ffff
 INSERT INTO sources(source_id, source) VALUES('zuul2',  '129.99.0.1/255.255.0.255');
 INSERT INTO groups(group_id) VALUES('friends');
 INSERT INTO groups(group_id) VALUES('noc');
+INSERT INTO groups(group_id, comment) VALUES('5f0c3d2e-8b1a-4c6e-9d7f-2a4b6c8e0f13', 'guests');
 INSERT INTO members(source_id, group_id) VALUES('local',    'friends');
 INSERT INTO members(source_id, group_id) VALUES('bob',      'noc');
 INSERT INTO members(source_id, group_id) VALUES('upper',    'friends');
 INSERT INTO members(source_id, group_id) VALUES('zuul',     'friends');
 INSERT INTO members(source_id, group_id) VALUES('zuul2',    'friends');
+INSERT INTO acls(acl_id, comment) VALUES('88bf513a-802f-450d-9fc4-b49eeabf1b8f', 'new');
 INSERT INTO acls(acl_id) VALUES('sfw');
 INSERT INTO rules(rule_id, type, value, action) VALUES('ru1', 'domain',        '.unencrypted.habets.se', 'allow');
 INSERT INTO rules(rule_id, type, value, action) VALUES('ru2', 'regex',         '^http://www.google.co.uk/url?.*$', 'allow');